@@ -0,0 +1,305 @@
+// Package client is a Go client for the OwlRelay HTTP API.
+//
+//	c := client.New("https://relay.example.com", "owl_...")
+//	tabs, err := c.Tabs(ctx)
+//	...
+//	_, err = c.Navigate(ctx, tabs[0].ID, "https://example.com")
+//
+// Calls made while the browser extension is offline are retried with
+// backoff, so agents can start before the browser reconnects.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes returned by the relay
+const (
+	CodeExtensionOffline = "EXTENSION_OFFLINE"
+	CodeTimeout          = "TIMEOUT"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+)
+
+// Error is a failure reported by the relay, either as an HTTP error response
+// or as a failed command
+type Error struct {
+	StatusCode int // HTTP status; 200 for a command that ran and failed
+	Code       string
+	Message    string
+	RetryAfter int // seconds, for rate limiting
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("owlrelay: %s: %s", e.Code, e.Message)
+}
+
+// IsOffline reports whether err means no extension is connected for the token
+func IsOffline(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == CodeExtensionOffline
+}
+
+// Client talks to one relay with one token. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	maxRetries int
+	retryDelay time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetry sets how many times a call is retried while the extension is
+// offline and the delay before the first retry. The delay doubles after
+// each attempt, up to 30 seconds. Use 0 retries to fail immediately.
+func WithRetry(maxRetries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryDelay = delay
+	}
+}
+
+// New creates a Client for the relay at baseURL authenticating with token
+func New(baseURL, token string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 2 * time.Minute},
+		maxRetries: 5,
+		retryDelay: 500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Status returns whether the extension is connected
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, "/api/v1/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Tabs lists attached tabs. With refresh set the relay first asks the
+// extension for its full tab list.
+func (c *Client) Tabs(ctx context.Context, refresh bool) ([]Tab, error) {
+	path := "/api/v1/tabs"
+	if refresh {
+		path += "?refresh=1"
+	}
+
+	var resp struct {
+		Tabs []Tab `json:"tabs"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tabs, nil
+}
+
+// CreateTab opens a new tab and attaches it
+func (c *Client) CreateTab(ctx context.Context, req CreateTabRequest) (*Tab, error) {
+	var tab Tab
+	if err := c.do(ctx, http.MethodPost, "/api/v1/tabs", req, &tab); err != nil {
+		return nil, err
+	}
+	return &tab, nil
+}
+
+// CloseTab closes an attached tab
+func (c *Client) CloseTab(ctx context.Context, tabID string) error {
+	resp, err := c.send(ctx, http.MethodDelete, "/api/v1/tabs/"+url.PathEscape(tabID), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Command runs an action on a tab. If the extension reports a failure the
+// response is returned along with an *Error carrying its code.
+func (c *Client) Command(ctx context.Context, req CommandRequest) (*CommandResponse, error) {
+	var resp CommandResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/command", req, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		e := &Error{StatusCode: http.StatusOK, Code: "COMMAND_FAILED", Message: "command failed"}
+		if resp.Error != nil {
+			e.Code, e.Message = resp.Error.Code, resp.Error.Message
+		}
+		return &resp, e
+	}
+	return &resp, nil
+}
+
+// CommandResult fetches a command that kept running after its request was
+// abandoned, such as one cut short by a context deadline. Set
+// CommandRequest.ID beforehand to know which ID to ask for.
+func (c *Client) CommandResult(ctx context.Context, id string) (*CommandRecord, error) {
+	var rec CommandRecord
+	if err := c.do(ctx, http.MethodGet, "/api/v1/commands/"+url.PathEscape(id), nil, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Navigate loads url in a tab and returns the final URL
+func (c *Client) Navigate(ctx context.Context, tabID, url string) (*NavigateResult, error) {
+	resp, err := c.Command(ctx, CommandRequest{
+		TabID:  tabID,
+		Action: Action{Kind: "navigate", URL: url},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result NavigateResult
+	if err := resp.Decode(&result); err != nil {
+		return nil, fmt.Errorf("owlrelay: invalid navigate result: %w", err)
+	}
+	return &result, nil
+}
+
+// Screenshot captures a tab and returns the image bytes
+func (c *Client) Screenshot(ctx context.Context, req ScreenshotRequest) (*Screenshot, error) {
+	body := struct {
+		ScreenshotRequest
+		ReturnFormat string `json:"returnFormat"`
+	}{req, "inline"}
+
+	resp, err := c.send(ctx, http.MethodPost, "/api/v1/screenshot", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("owlrelay: failed to read screenshot: %w", err)
+	}
+
+	shot := &Screenshot{Data: data, ContentType: resp.Header.Get("Content-Type")}
+	shot.Width, _ = strconv.Atoi(resp.Header.Get("X-Screenshot-Width"))
+	shot.Height, _ = strconv.Atoi(resp.Header.Get("X-Screenshot-Height"))
+	return shot, nil
+}
+
+// Snapshot captures a tab's DOM
+func (c *Client) Snapshot(ctx context.Context, req SnapshotRequest) (*Snapshot, error) {
+	var snap Snapshot
+	if err := c.do(ctx, http.MethodPost, "/api/v1/snapshot", req, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// do sends a request and decodes a JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	resp, err := c.send(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("owlrelay: invalid response: %w", err)
+	}
+	return nil
+}
+
+// send performs a request, retrying while the extension is offline. The
+// caller closes the body of a successful response.
+func (c *Client) send(ctx context.Context, method, path string, in any) (*http.Response, error) {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("owlrelay: failed to encode request: %w", err)
+		}
+	}
+
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.sendOnce(ctx, method, path, payload)
+		if err == nil {
+			return resp, nil
+		}
+		if !IsOffline(err) || attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, method, path string, payload []byte) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("owlrelay: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("owlrelay: %w", err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr struct {
+		Error struct {
+			Code       string `json:"code"`
+			Message    string `json:"message"`
+			RetryAfter int    `json:"retryAfter,omitempty"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Error.Code == "" {
+		return nil, &Error{StatusCode: resp.StatusCode, Code: "HTTP_" + strconv.Itoa(resp.StatusCode),
+			Message: strings.TrimSpace(string(data))}
+	}
+	return nil, &Error{
+		StatusCode: resp.StatusCode,
+		Code:       apiErr.Error.Code,
+		Message:    apiErr.Error.Message,
+		RetryAfter: apiErr.Error.RetryAfter,
+	}
+}
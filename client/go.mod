@@ -0,0 +1,3 @@
+module github.com/emreylmaz/owlrelay/client
+
+go 1.22
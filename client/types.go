@@ -0,0 +1,242 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Status is the connection state of the extension sessions for a token
+type Status struct {
+	Connected        bool   `json:"connected"`
+	LastSeen         string `json:"lastSeen,omitempty"`
+	ExtensionVersion string `json:"extensionVersion,omitempty"`
+	SessionName      string `json:"sessionName,omitempty"`
+	TabCount         int    `json:"tabCount,omitempty"`
+	SessionCount     int    `json:"sessionCount,omitempty"`
+
+	Sessions []SessionSummary `json:"sessions,omitempty"` // oldest first
+}
+
+// SessionSummary describes one connected extension session
+type SessionSummary struct {
+	ID               string      `json:"id"`
+	Name             string      `json:"name,omitempty"` // e.g. "Chrome 126 on macOS — work laptop"
+	ExtensionVersion string      `json:"extensionVersion,omitempty"`
+	Client           *ClientInfo `json:"client,omitempty"`
+	TabCount         int         `json:"tabCount"`
+	ConnectedAt      time.Time   `json:"connectedAt"`
+	Node             string      `json:"node,omitempty"`
+}
+
+// ClientInfo identifies the browser an extension session runs in
+type ClientInfo struct {
+	Browser        string `json:"browser,omitempty"`
+	BrowserVersion string `json:"browserVersion,omitempty"`
+	OS             string `json:"os,omitempty"`
+	InstallID      string `json:"installId,omitempty"`
+	DeviceName     string `json:"deviceName,omitempty"`
+}
+
+// Tab is a browser tab attached through the extension
+type Tab struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Title      string    `json:"title"`
+	FavIconURL string    `json:"favIconUrl,omitempty"`
+	SessionID  string    `json:"sessionId,omitempty"`
+	AttachedAt time.Time `json:"attachedAt"`
+}
+
+// CreateTabRequest opens a new tab
+type CreateTabRequest struct {
+	URL        string `json:"url,omitempty"` // about:blank if empty
+	Background bool   `json:"background,omitempty"`
+	SessionID  string `json:"sessionId,omitempty"` // the newest session if empty
+}
+
+// Action describes a browser command. Kind selects which other fields apply.
+type Action struct {
+	Kind        string   `json:"kind"` // click, type, scroll, screenshot, snapshot, navigate, evaluate, tab_create, tab_close
+	Selector    string   `json:"selector,omitempty"`
+	Coordinates *Point   `json:"coordinates,omitempty"`
+	Button      string   `json:"button,omitempty"`
+	Modifiers   []string `json:"modifiers,omitempty"`
+	Text        string   `json:"text,omitempty"`
+	Clear       bool     `json:"clear,omitempty"`
+	Delay       int      `json:"delay,omitempty"`
+	Direction   string   `json:"direction,omitempty"`
+	Amount      int      `json:"amount,omitempty"`
+	FullPage    bool     `json:"fullPage,omitempty"`
+	Clip        *Rect    `json:"clip,omitempty"`
+	Quality     int      `json:"quality,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	MaxDepth    int      `json:"maxDepth,omitempty"`
+	MaxLength   int      `json:"maxLength,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	WaitUntil   string   `json:"waitUntil,omitempty"`
+	Script      string   `json:"script,omitempty"`
+	Background  bool     `json:"background,omitempty"` // tab_create: open without focusing
+	// Actionability false skips the visible/enabled check of click and
+	// type; nil uses the token's default
+	Actionability *bool `json:"actionability,omitempty"`
+}
+
+// Point is a position in CSS pixels
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Rect is a region in CSS pixels
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// What the relay does with a command whose HTTP request goes away
+const (
+	OnDisconnectCancel   = "cancel"
+	OnDisconnectComplete = "complete"
+)
+
+// CommandRequest runs one action on a tab
+type CommandRequest struct {
+	ID      string `json:"id,omitempty"` // generated by the relay if empty
+	TabID   string `json:"tabId"`
+	Action  Action `json:"action"`
+	Timeout int    `json:"timeout,omitempty"` // ms; the relay's COMMAND_TIMEOUT if zero
+	// OnDisconnect overrides the relay's COMMAND_ON_DISCONNECT
+	OnDisconnect string `json:"onDisconnect,omitempty"`
+	// ScreenshotOnFailure overrides the token's default
+	ScreenshotOnFailure *bool `json:"screenshotOnFailure,omitempty"`
+}
+
+// CommandResponse is the outcome of a command. Result holds the
+// kind-specific payload; use Decode to read it into a typed struct.
+type CommandResponse struct {
+	ID      string          `json:"id"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *CommandError   `json:"error,omitempty"`
+	Timing  struct {
+		Total int64 `json:"total"` // ms
+	} `json:"timing,omitempty"`
+	// FailureScreenshot is the tab when the command failed, if requested
+	FailureScreenshot *SavedScreenshot `json:"failureScreenshot,omitempty"`
+}
+
+// SavedScreenshot is a capture stored on the relay until ExpiresAt
+type SavedScreenshot struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"` // relative to the relay's base URL
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int       `json:"size"` // bytes
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Decode unmarshals Result into v, e.g. a *NavigateResult
+func (r *CommandResponse) Decode(v any) error {
+	if len(r.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+// CommandRecord is a command that outlived its HTTP request
+type CommandRecord struct {
+	ID          string           `json:"id"`
+	Status      string           `json:"status"` // running, completed
+	CreatedAt   time.Time        `json:"createdAt"`
+	CompletedAt *time.Time       `json:"completedAt,omitempty"`
+	Response    *CommandResponse `json:"response,omitempty"`
+}
+
+// CommandError is reported by the extension when a command fails
+type CommandError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Typed results for CommandResponse.Decode, one per built-in action kind
+
+// ClickResult is the result of a "click" command
+type ClickResult struct {
+	Selector string `json:"selector,omitempty"`
+}
+
+// TypeResult is the result of a "type" command
+type TypeResult struct {
+	Selector string `json:"selector,omitempty"`
+	Length   int    `json:"length,omitempty"` // characters typed
+}
+
+// ScrollResult is the result of a "scroll" command
+type ScrollResult struct {
+	ScrollX int `json:"scrollX,omitempty"`
+	ScrollY int `json:"scrollY,omitempty"`
+}
+
+// NavigateResult is the result of a "navigate" command
+type NavigateResult struct {
+	URL string `json:"url,omitempty"`
+}
+
+// EvaluateResult is the result of an "evaluate" command
+type EvaluateResult struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Type  string          `json:"type,omitempty"` // JavaScript typeof the value
+}
+
+// TabCreateResult is the result of a "tab_create" command
+type TabCreateResult struct {
+	TabID string `json:"tabId"`
+	URL   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// ScreenshotRequest captures a tab
+type ScreenshotRequest struct {
+	TabID    string `json:"tabId"`
+	FullPage bool   `json:"fullPage,omitempty"`
+	Format   string `json:"format,omitempty"`  // png (default) or jpeg
+	Quality  int    `json:"quality,omitempty"` // 0-100 for jpeg
+}
+
+// Screenshot is a captured image
+type Screenshot struct {
+	Data        []byte
+	ContentType string // image/png or image/jpeg
+	Width       int
+	Height      int
+}
+
+// SnapshotRequest captures a tab's DOM
+type SnapshotRequest struct {
+	TabID     string `json:"tabId"`
+	MaxDepth  int    `json:"maxDepth,omitempty"`
+	MaxLength int    `json:"maxLength,omitempty"` // bytes
+	Format    string `json:"format,omitempty"`    // html or simplified
+}
+
+// Snapshot is a tab's serialized DOM and its interactive elements
+type Snapshot struct {
+	HTML                string               `json:"html"`
+	URL                 string               `json:"url"`
+	Title               string               `json:"title"`
+	Truncated           bool                 `json:"truncated"`
+	InteractiveElements []InteractiveElement `json:"interactiveElements,omitempty"`
+}
+
+// InteractiveElement is a clickable or editable element found in a snapshot
+type InteractiveElement struct {
+	Selector    string `json:"selector"`
+	Type        string `json:"type"` // button, link, input, select, textarea
+	Text        string `json:"text,omitempty"`
+	Placeholder string `json:"placeholder,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ID          string `json:"id,omitempty"`
+}
@@ -0,0 +1,111 @@
+// What the relay is told about the browser: its name, version, and OS in
+// the connect message, and the window it sees focused, kept up to date
+// with window_update messages so schedulers can pick a session by it
+import type { WindowState } from '../shared/types';
+import { isConnected, sendMessage } from './websocket';
+
+// Window events come in bursts while a window is dragged or resized
+const WINDOW_UPDATE_DELAY = 500;
+
+const OS_NAMES: Record<string, string> = {
+  mac: 'macOS',
+  win: 'Windows',
+  linux: 'Linux',
+  cros: 'ChromeOS',
+  android: 'Android',
+  openbsd: 'OpenBSD',
+  fuchsia: 'Fuchsia',
+};
+
+// Brands as navigator.userAgentData reports them, by the name sessions
+// are labeled with
+const BROWSER_NAMES: Record<string, string> = {
+  'Google Chrome': 'Chrome',
+  'Microsoft Edge': 'Edge',
+  'Brave': 'Brave',
+  'Opera': 'Opera',
+  'Chromium': 'Chromium',
+};
+
+interface UADataBrand {
+  brand: string;
+  version: string;
+}
+
+interface UAData {
+  brands: UADataBrand[];
+  getHighEntropyValues(hints: string[]): Promise<{ fullVersionList?: UADataBrand[] }>;
+}
+
+export async function browserInfo(): Promise<{ browser?: string; browserVersion?: string; os?: string }> {
+  const info: { browser?: string; browserVersion?: string; os?: string } = {};
+  try {
+    info.os = OS_NAMES[(await chrome.runtime.getPlatformInfo()).os];
+  } catch {
+    // Leave it out
+  }
+
+  const uaData = (navigator as Navigator & { userAgentData?: UAData }).userAgentData;
+  if (uaData) {
+    let brands = uaData.brands;
+    try {
+      brands = (await uaData.getHighEntropyValues(['fullVersionList'])).fullVersionList ?? brands;
+    } catch {
+      // Major versions only
+    }
+    // Chromium is listed by every Chromium-based browser; prefer the other
+    const known = brands.filter((b) => BROWSER_NAMES[b.brand]);
+    const brand = known.find((b) => b.brand !== 'Chromium') ?? known[0];
+    if (brand) {
+      info.browser = BROWSER_NAMES[brand.brand];
+      info.browserVersion = brand.version;
+    }
+  }
+  return info;
+}
+
+// The last focused normal window, or undefined when none is open
+export async function windowState(): Promise<WindowState | undefined> {
+  const windows = await chrome.windows.getAll({ windowTypes: ['normal'] });
+  if (windows.length === 0) return undefined;
+  const current = windows.find((w) => w.focused) ?? (await lastFocused()) ?? windows[0];
+  return {
+    width: current.width ?? 0,
+    height: current.height ?? 0,
+    state: current.state === 'locked-fullscreen' ? 'fullscreen' : (current.state ?? 'normal'),
+    focused: windows.some((w) => w.focused),
+    windows: windows.length,
+  };
+}
+
+async function lastFocused(): Promise<chrome.windows.Window | undefined> {
+  try {
+    return await chrome.windows.getLastFocused({ windowTypes: ['normal'] });
+  } catch {
+    return undefined;
+  }
+}
+
+let updateTimer: ReturnType<typeof setTimeout> | null = null;
+let lastSent = '';
+
+// Send the window state once a burst of window events settles, if it
+// changed
+export function scheduleWindowUpdate(): void {
+  if (updateTimer) clearTimeout(updateTimer);
+  updateTimer = setTimeout(async () => {
+    updateTimer = null;
+    if (!isConnected()) return;
+    const state = await windowState();
+    if (!state) return;
+    const serialized = JSON.stringify(state);
+    if (serialized === lastSent) return;
+    lastSent = serialized;
+    sendMessage({ type: 'window_update', window: state });
+  }, WINDOW_UPDATE_DELAY);
+}
+
+// A new connection starts from what the connect message carried
+export function resetWindowUpdates(state: WindowState | undefined): void {
+  lastSent = state ? JSON.stringify(state) : '';
+}
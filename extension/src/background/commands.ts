@@ -1,34 +1,95 @@
-import type { CommandRequest, CommandResponse, CommandAction } from '../shared/types';
+import type { CommandRequest, CommandResponse, CommandAction, ScreenshotAction, Rect } from '../shared/types';
 import type { BackgroundToContentMessage, ContentToBackgroundMessage } from '../shared/messages';
 import { sendMessage } from './websocket';
-import { getAttachedTabByUuid } from './tabs';
+import { getAttachedTabByUuid, createTab, closeTab } from './tabs';
+import { runCookieAction } from './cookies';
+import { runStorageAction } from './storage';
+import { runEmulationAction, runViewportAction } from './emulation';
+import { runNetworkConditionsAction } from './throttling';
+import { runRequestRulesAction } from './rules';
+import { runHeadersAction } from './headers';
+import { runCredentialsAction } from './credentials';
+import { runUploadAction } from './upload';
+import { runEvaluateAction, EvaluateFailure } from './evaluate';
 import { DEFAULT_COMMAND_TIMEOUT } from '../shared/constants';
 
+// Reject functions of commands still executing, by command ID
+const runningCommands = new Map<string, (err: Error) => void>();
+
+class CommandCancelledError extends Error {}
+
+// An error with a code other than EXECUTION_ERROR
+class CommandFailure extends Error {
+  constructor(public code: string, message: string) {
+    super(message);
+  }
+}
+
+// Stop waiting for a command the relay no longer needs. Work already handed
+// to the page may still finish, but no response is sent.
+export function cancelCommand(id: string, reason: string): void {
+  runningCommands.get(id)?.(new CommandCancelledError(reason));
+}
+
 // Handle incoming command from relay
 export async function handleRelayMessage(command: CommandRequest): Promise<void> {
   const startTime = Date.now();
   
+  // New tabs have no attached tab to act in yet
+  if (command.action.kind === 'tab_create') {
+    try {
+      const timeout = command.timeout || DEFAULT_COMMAND_TIMEOUT;
+      const tab = await createTab(command.action.url, !command.action.background, timeout);
+      sendCommandResponse(command, true, startTime, { tabId: tab.uuid, url: tab.url, title: tab.title });
+    } catch (err) {
+      sendCommandResponse(command, false, startTime, undefined, {
+        code: 'EXECUTION_ERROR',
+        message: err instanceof Error ? err.message : 'Unknown error',
+      });
+    }
+    return;
+  }
+  
   // Find the attached tab
   const attachedTab = getAttachedTabByUuid(command.tabId);
   if (!attachedTab) {
-    sendCommandResponse(command.id, false, startTime, undefined, {
+    sendCommandResponse(command, false, startTime, undefined, {
       code: 'TAB_NOT_FOUND',
       message: `Tab ${command.tabId} is not attached`,
     });
     return;
   }
   
+  if (command.action.kind === 'tab_close') {
+    try {
+      await closeTab(command.tabId);
+      sendCommandResponse(command, true, startTime, { tabId: command.tabId });
+    } catch (err) {
+      sendCommandResponse(command, false, startTime, undefined, {
+        code: 'EXECUTION_ERROR',
+        message: err instanceof Error ? err.message : 'Unknown error',
+      });
+    }
+    return;
+  }
+  
   const timeout = command.timeout || DEFAULT_COMMAND_TIMEOUT;
   
   try {
     const result = await executeCommand(attachedTab.tabId, command.id, command.action, timeout);
-    sendCommandResponse(command.id, true, startTime, result);
+    sendCommandResponse(command, true, startTime, result);
   } catch (err) {
+    if (err instanceof CommandCancelledError) {
+      console.log('[OwlRelay] Command cancelled:', command.id, err.message);
+      return;
+    }
     const errorMessage = err instanceof Error ? err.message : 'Unknown error';
-    sendCommandResponse(command.id, false, startTime, undefined, {
-      code: 'EXECUTION_ERROR',
+    sendCommandResponse(command, false, startTime, undefined, {
+      code: err instanceof CommandFailure ? err.code : 'EXECUTION_ERROR',
       message: errorMessage,
     });
+  } finally {
+    runningCommands.delete(command.id);
   }
 }
 
@@ -38,7 +99,9 @@ async function executeCommand(
   action: CommandAction,
   timeout: number
 ): Promise<unknown> {
-  return new Promise((resolve, reject) => {
+  return new Promise<unknown>((resolve, reject) => {
+    runningCommands.set(commandId, reject);
+    
     const timer = setTimeout(() => {
       reject(new Error('Command timed out'));
     }, timeout);
@@ -49,7 +112,54 @@ async function executeCommand(
     if (action.kind === 'screenshot') {
       // Screenshot uses chrome.tabs.captureVisibleTab, handled in background
       clearTimeout(timer);
-      captureScreenshot(tabId).then(resolve).catch(reject);
+      const capture = action.count ? captureBurst(tabId, action, action.count, action.interval ?? 0) : captureScreenshot(tabId, action);
+      capture.then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'cookies_get' || action.kind === 'cookies_set' || action.kind === 'cookies_clear') {
+      // The cookies API is only available in the background
+      clearTimeout(timer);
+      runCookieAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'storage_get' || action.kind === 'storage_set' || action.kind === 'storage_remove') {
+      clearTimeout(timer);
+      runStorageAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'emulation_get' || action.kind === 'emulation_set' || action.kind === 'emulation_clear') {
+      // Emulation goes through the tab's debugger session
+      clearTimeout(timer);
+      runEmulationAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'set_viewport') {
+      clearTimeout(timer);
+      runViewportAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'set_network_conditions') {
+      clearTimeout(timer);
+      runNetworkConditionsAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'request_rules_get' || action.kind === 'request_rules_set' || action.kind === 'request_rules_clear') {
+      clearTimeout(timer);
+      runRequestRulesAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'headers_get' || action.kind === 'headers_set' || action.kind === 'headers_clear') {
+      clearTimeout(timer);
+      runHeadersAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'credentials_get' || action.kind === 'credentials_set' || action.kind === 'credentials_clear') {
+      clearTimeout(timer);
+      runCredentialsAction(tabId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'upload') {
+      clearTimeout(timer);
+      runUploadAction(tabId, commandId, action).then(resolve).catch(reject);
+      return;
+    } else if (action.kind === 'evaluate') {
+      // Runs in the page's world, which content scripts cannot reach. The
+      // timer stays: a promise the script returns may never settle.
+      runEvaluateAction(tabId, action)
+        .then(resolve)
+        .catch((err) => reject(err instanceof EvaluateFailure ? new CommandFailure(err.code, err.message) : err))
+        .finally(() => clearTimeout(timer));
       return;
     } else if (action.kind === 'snapshot') {
       message = {
@@ -57,6 +167,11 @@ async function executeCommand(
         commandId,
         maxDepth: action.maxDepth,
         maxLength: action.maxLength,
+        // Markdown needs the spaces between inline elements
+        keepSpaces: action.format === 'markdown',
+        interactive: action.interactive,
+        // List elements inside shadow roots too, with pierce= selectors
+        pierce: action.selectorEngine === 'pierce',
       };
     } else {
       message = {
@@ -90,7 +205,14 @@ async function executeCommand(
         if (response.error) {
           reject(new Error(response.error));
         } else {
-          resolve({ html: response.html, elements: response.elements });
+          resolve({
+            html: response.html,
+            elements: response.elements,
+            elementsTruncated: response.elementsTruncated,
+            url: response.url,
+            title: response.title,
+            truncated: response.truncated,
+          });
         }
       } else {
         reject(new Error('Unexpected response type'));
@@ -99,8 +221,83 @@ async function executeCommand(
   });
 }
 
-async function captureScreenshot(tabId: number): Promise<{ data: string; width: number; height: number }> {
-  // First, make sure the tab is active
+interface Capture {
+  data: string;
+  width: number;
+  height: number;
+  format: string;
+}
+
+// Part of the viewport a capture keeps, in CSS pixels
+interface Crop {
+  rect: Rect;
+  viewportWidth: number;
+}
+
+async function captureScreenshot(tabId: number, action: ScreenshotAction): Promise<Capture> {
+  const windowId = await focusTab(tabId);
+  const crop = await resolveCrop(tabId, action);
+  return captureFrame(windowId, crop);
+}
+
+// Find what part of the viewport to keep: the element matched by
+// action.selector, scrolled into view, or action.clip
+async function resolveCrop(tabId: number, action: ScreenshotAction): Promise<Crop | undefined> {
+  if (!action.selector && !action.clip) {
+    return undefined;
+  }
+  const message: BackgroundToContentMessage = { type: 'GET_CLIP', selector: action.selector, selectorEngine: action.selectorEngine };
+  let reply: ContentToBackgroundMessage;
+  try {
+    reply = await chrome.tabs.sendMessage(tabId, message);
+  } catch (err) {
+    throw new Error(err instanceof Error ? err.message : 'Failed to communicate with tab');
+  }
+  if (reply?.type !== 'CLIP_RESULT') {
+    throw new Error('No response from content script');
+  }
+  if (reply.error) {
+    throw new CommandFailure('ELEMENT_NOT_FOUND', reply.error);
+  }
+  return { rect: reply.rect ?? action.clip!, viewportWidth: reply.viewport.width };
+}
+
+// Wait before retrying a capture the browser refused for its quota
+const CAPTURE_RETRY_DELAY = 500;
+
+// Take count captures interval ms apart. The browser allows about two
+// captures a second, so refused captures are retried and later frames
+// slip; each frame reports when it was actually taken.
+async function captureBurst(tabId: number, action: ScreenshotAction, count: number, interval: number): Promise<{ frames: (Capture & { offset: number })[] }> {
+  const windowId = await focusTab(tabId);
+  const crop = await resolveCrop(tabId, action);
+  const frames: (Capture & { offset: number })[] = [];
+  let first = 0;
+
+  for (let i = 0; i < count; i++) {
+    if (i > 0) {
+      const wait = first + i * interval - Date.now();
+      if (wait > 0) await new Promise((resolve) => setTimeout(resolve, wait));
+    }
+    for (;;) {
+      const takenAt = Date.now();
+      try {
+        const frame = await captureFrame(windowId, crop);
+        if (i === 0) first = takenAt;
+        frames.push({ ...frame, offset: takenAt - first });
+        break;
+      } catch (err) {
+        // The first refusal is left to the relay, which retries the command
+        if (i === 0 || !(err instanceof CommandFailure) || err.code !== 'CAPTURE_RATE_LIMITED') throw err;
+        await new Promise((resolve) => setTimeout(resolve, CAPTURE_RETRY_DELAY));
+      }
+    }
+  }
+  return { frames };
+}
+
+// Bring a tab to the front so it can be captured; returns its window
+async function focusTab(tabId: number): Promise<number> {
   const tab = await chrome.tabs.get(tabId);
   if (!tab.windowId) {
     throw new Error('Tab has no window');
@@ -112,12 +309,25 @@ async function captureScreenshot(tabId: number): Promise<{ data: string; width:
   
   // Small delay to ensure rendering
   await new Promise(resolve => setTimeout(resolve, 100));
-  
-  // Capture
-  const dataUrl = await chrome.tabs.captureVisibleTab(tab.windowId, {
-    format: 'png',
-    quality: 90,
-  });
+  return tab.windowId;
+}
+
+async function captureFrame(windowId: number, crop?: Crop): Promise<Capture> {
+  // Capture. Chrome allows only a couple of captures per second; the relay
+  // retries those it refuses.
+  let dataUrl: string;
+  try {
+    dataUrl = await chrome.tabs.captureVisibleTab(windowId, {
+      format: 'png',
+      quality: 90,
+    });
+  } catch (err) {
+    const message = err instanceof Error ? err.message : String(err);
+    if (message.includes('MAX_CAPTURE_VISIBLE_TAB_CALLS_PER_SECOND')) {
+      throw new CommandFailure('CAPTURE_RATE_LIMITED', message);
+    }
+    throw err;
+  }
   
   // Extract base64 data without the data URL prefix
   const base64Data = dataUrl.split(',')[1];
@@ -128,13 +338,48 @@ async function captureScreenshot(tabId: number): Promise<{ data: string; width:
   const bitmap = await createImageBitmap(blob);
   const width = bitmap.width;
   const height = bitmap.height;
+  
+  if (crop) {
+    try {
+      return await cropBitmap(bitmap, crop);
+    } finally {
+      bitmap.close();
+    }
+  }
   bitmap.close();
   
-  return { data: base64Data, width, height };
+  return { data: base64Data, width, height, format: 'png' };
+}
+
+// Cut a capture down to the crop, scaled from CSS to device pixels and
+// limited to what the viewport shows
+async function cropBitmap(bitmap: ImageBitmap, crop: Crop): Promise<Capture> {
+  const scale = bitmap.width / crop.viewportWidth;
+  const left = Math.max(0, Math.round(crop.rect.x * scale));
+  const top = Math.max(0, Math.round(crop.rect.y * scale));
+  const right = Math.min(bitmap.width, Math.round((crop.rect.x + crop.rect.width) * scale));
+  const bottom = Math.min(bitmap.height, Math.round((crop.rect.y + crop.rect.height) * scale));
+  if (right <= left || bottom <= top) {
+    throw new CommandFailure('INVALID_CLIP', 'The area to capture is outside the viewport');
+  }
+
+  const canvas = new OffscreenCanvas(right - left, bottom - top);
+  const ctx = canvas.getContext('2d');
+  if (!ctx) {
+    throw new Error('Failed to crop the capture');
+  }
+  ctx.drawImage(bitmap, left, top, right - left, bottom - top, 0, 0, right - left, bottom - top);
+  const blob = await canvas.convertToBlob({ type: 'image/png' });
+  const bytes = new Uint8Array(await blob.arrayBuffer());
+  let binary = '';
+  for (let i = 0; i < bytes.length; i += 0x8000) {
+    binary += String.fromCharCode(...bytes.subarray(i, i + 0x8000));
+  }
+  return { data: btoa(binary), width: canvas.width, height: canvas.height, format: 'png' };
 }
 
 function sendCommandResponse(
-  id: string,
+  command: CommandRequest,
   success: boolean,
   startTime: number,
   result?: unknown,
@@ -142,7 +387,8 @@ function sendCommandResponse(
 ): void {
   const response: CommandResponse = {
     type: 'command_response',
-    id,
+    id: command.id,
+    seq: command.seq,
     success,
     result,
     error,
@@ -150,6 +396,7 @@ function sendCommandResponse(
       received: startTime,
       completed: Date.now(),
     },
+    traceparent: command.traceparent,
   };
   
   sendMessage(response);
@@ -0,0 +1,95 @@
+// Console capture for attached tabs. The hook runs in the page's own world,
+// where it can see the page's console and errors, and posts entries to the
+// content script, which forwards them here.
+import { PAGE_CONSOLE_SOURCE, PAGE_BRIDGE_READY } from '../shared/messages';
+
+// Install the console hook in a tab; safe to call again after navigation
+export async function installConsoleHook(tabId: number): Promise<void> {
+  try {
+    await chrome.scripting.executeScript({
+      target: { tabId },
+      world: 'MAIN',
+      injectImmediately: true,
+      func: consoleHook,
+      args: [PAGE_CONSOLE_SOURCE, PAGE_BRIDGE_READY],
+    });
+  } catch {
+    // Pages such as chrome:// cannot be scripted
+  }
+}
+
+// Runs in the page; must not reference anything outside itself
+function consoleHook(consoleSource: string, readySource: string): void {
+  const w = window as unknown as { __owlrelayConsole?: boolean };
+  if (w.__owlrelayConsole) return;
+  w.__owlrelayConsole = true;
+
+  const MAX_PENDING = 100;
+  let ready = false;
+  let pending: unknown[] = [];
+
+  const post = (entry: Record<string, unknown>) => {
+    entry.timestamp = Date.now();
+    if (ready) {
+      window.postMessage({ source: consoleSource, entry }, '*');
+    } else if (pending.length < MAX_PENDING) {
+      pending.push(entry);
+    }
+  };
+
+  window.addEventListener('message', (event) => {
+    if (event.source !== window || event.data?.source !== readySource || ready) return;
+    ready = true;
+    for (const entry of pending) {
+      window.postMessage({ source: consoleSource, entry }, '*');
+    }
+    pending = [];
+  });
+
+  const format = (value: unknown): string => {
+    if (typeof value === 'string') return value;
+    if (value instanceof Error) return value.stack || `${value.name}: ${value.message}`;
+    try {
+      return JSON.stringify(value) ?? String(value);
+    } catch {
+      return String(value);
+    }
+  };
+
+  for (const level of ['debug', 'log', 'info', 'warn', 'error'] as const) {
+    const original = console[level];
+    console[level] = (...args: unknown[]) => {
+      try {
+        post({ level, source: 'console', message: args.map(format).join(' ') });
+      } catch {
+        // Never break the page's logging
+      }
+      original.apply(console, args);
+    };
+  }
+
+  window.addEventListener('error', (event) => {
+    post({
+      level: 'error',
+      source: 'exception',
+      message: event.message,
+      url: event.filename || undefined,
+      line: event.lineno || undefined,
+      column: event.colno || undefined,
+      stack: event.error instanceof Error ? event.error.stack : undefined,
+    });
+  });
+
+  window.addEventListener('unhandledrejection', (event) => {
+    const reason = event.reason;
+    post({
+      level: 'error',
+      source: 'rejection',
+      message: reason instanceof Error ? `${reason.name}: ${reason.message}` : `Unhandled rejection: ${format(reason)}`,
+      stack: reason instanceof Error ? reason.stack : undefined,
+    });
+  });
+
+  // The content script may already be listening
+  window.postMessage({ source: consoleSource, hello: true }, '*');
+}
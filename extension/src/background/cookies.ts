@@ -0,0 +1,83 @@
+// Cookie commands. They act on the cookies the tab's current URL would
+// send, in the tab's own cookie store (separate for incognito windows).
+import type { Cookie, CookiesGetAction, CookiesSetAction, CookiesClearAction } from '../shared/types';
+
+type CookieAction = CookiesGetAction | CookiesSetAction | CookiesClearAction;
+
+export async function runCookieAction(tabId: number, action: CookieAction): Promise<unknown> {
+  const tab = await chrome.tabs.get(tabId);
+  const url = tab.url;
+  if (!url || !/^https?:/.test(url)) {
+    throw new Error('Tab is not showing an http(s) page');
+  }
+  const storeId = await cookieStoreFor(tabId);
+
+  switch (action.kind) {
+    case 'cookies_get': {
+      const cookies = await chrome.cookies.getAll({ url, storeId, ...(action.name ? { name: action.name } : {}) });
+      return { url, cookies: cookies.map(fromChrome) };
+    }
+    case 'cookies_set': {
+      const stored: Cookie[] = [];
+      for (const cookie of action.cookies) {
+        const result = await chrome.cookies.set(toChrome(cookie, url, storeId));
+        if (!result) {
+          throw new Error(`Browser rejected cookie ${cookie.name}`);
+        }
+        stored.push(fromChrome(result));
+      }
+      return { url, cookies: stored };
+    }
+    case 'cookies_clear': {
+      const cookies = await chrome.cookies.getAll({ url, storeId, ...(action.name ? { name: action.name } : {}) });
+      let removed = 0;
+      for (const cookie of cookies) {
+        if (await chrome.cookies.remove({ url: cookieUrl(cookie), name: cookie.name, storeId })) {
+          removed++;
+        }
+      }
+      return { url, removed };
+    }
+  }
+}
+
+async function cookieStoreFor(tabId: number): Promise<string | undefined> {
+  const stores = await chrome.cookies.getAllCookieStores();
+  return stores.find((store) => store.tabIds.includes(tabId))?.id;
+}
+
+function fromChrome(cookie: chrome.cookies.Cookie): Cookie {
+  return {
+    name: cookie.name,
+    value: cookie.value,
+    domain: cookie.domain,
+    path: cookie.path,
+    secure: cookie.secure || undefined,
+    httpOnly: cookie.httpOnly || undefined,
+    sameSite: cookie.sameSite === 'no_restriction' ? 'none'
+      : cookie.sameSite === 'unspecified' ? undefined
+      : cookie.sameSite,
+    expires: cookie.expirationDate ? Math.floor(cookie.expirationDate) : undefined,
+  };
+}
+
+function toChrome(cookie: Cookie, url: string, storeId: string | undefined): chrome.cookies.SetDetails {
+  return {
+    url,
+    storeId,
+    name: cookie.name,
+    value: cookie.value,
+    domain: cookie.domain,
+    path: cookie.path,
+    secure: cookie.secure,
+    httpOnly: cookie.httpOnly,
+    sameSite: cookie.sameSite === 'none' ? 'no_restriction' : cookie.sameSite,
+    expirationDate: cookie.expires,
+  };
+}
+
+// The URL a stored cookie belongs to, which remove() needs to find it
+function cookieUrl(cookie: chrome.cookies.Cookie): string {
+  const host = cookie.domain.replace(/^\./, '');
+  return `${cookie.secure ? 'https' : 'http'}://${host}${cookie.path}`;
+}
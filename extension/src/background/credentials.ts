@@ -0,0 +1,83 @@
+// Credential commands: usernames and passwords that answer the HTTP basic
+// and digest auth challenges of a tab's pages, in place of the browser's
+// sign-in dialog, which would stall every command after it. They are kept
+// in session storage, never written to disk, and forgotten when the tab
+// is detached or closed.
+import type { Credential, CredentialsGetAction, CredentialsSetAction, CredentialsClearAction } from '../shared/types';
+
+type CredentialsAction = CredentialsGetAction | CredentialsSetAction | CredentialsClearAction;
+
+// Credentials by tab ID, then origin
+const STORAGE_KEY = 'credentials';
+
+// Requests already answered once; a second challenge means the
+// credential was refused, and is cancelled rather than retried forever
+const answered = new Set<string>();
+const MAX_ANSWERED = 1000;
+
+export async function runCredentialsAction(tabId: number, action: CredentialsAction): Promise<{ credentials: Credential[] }> {
+  const stored = await loadCredentials();
+  let tab = stored[tabId] ?? {};
+  switch (action.kind) {
+    case 'credentials_set':
+      tab[action.credential.origin] = action.credential;
+      stored[tabId] = tab;
+      await chrome.storage.session.set({ [STORAGE_KEY]: stored });
+      break;
+    case 'credentials_clear':
+      if (action.origin) {
+        delete tab[action.origin];
+        stored[tabId] = tab;
+        await chrome.storage.session.set({ [STORAGE_KEY]: stored });
+      } else {
+        await clearCredentials(tabId);
+        tab = {};
+      }
+      break;
+  }
+  return {
+    credentials: Object.values(tab).map(({ origin, username }) => ({ origin, username })),
+  };
+}
+
+// Forget a tab's credentials
+export async function clearCredentials(tabId: number): Promise<void> {
+  const stored = await loadCredentials();
+  if (!stored[tabId]) return;
+  delete stored[tabId];
+  await chrome.storage.session.set({ [STORAGE_KEY]: stored });
+}
+
+// Answer an auth challenge of an attached tab with its credential for the
+// origin, or cancel it so the page gets the 401 instead of a dialog.
+// Proxy challenges and other tabs are left to the browser.
+export function handleAuthRequired(
+  details: chrome.webRequest.WebAuthenticationChallengeDetails,
+  attached: boolean,
+  callback: (response: chrome.webRequest.BlockingResponse) => void
+): void {
+  if (!attached || details.isProxy) {
+    callback({});
+    return;
+  }
+  if (answered.has(details.requestId)) {
+    answered.delete(details.requestId);
+    callback({ cancel: true });
+    return;
+  }
+  loadCredentials().then((stored) => {
+    const credential = stored[details.tabId]?.[new URL(details.url).origin];
+    if (!credential) {
+      callback({ cancel: true });
+      return;
+    }
+    if (answered.size >= MAX_ANSWERED) answered.clear();
+    answered.add(details.requestId);
+    callback({ authCredentials: { username: credential.username, password: credential.password ?? '' } });
+  }).catch(() => callback({ cancel: true }));
+}
+
+async function loadCredentials(): Promise<Record<number, Record<string, Credential>>> {
+  const result = await chrome.storage.session.get(STORAGE_KEY);
+  return result[STORAGE_KEY] || {};
+}
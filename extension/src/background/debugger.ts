@@ -0,0 +1,77 @@
+// Chrome DevTools Protocol access to attached tabs, for what the extension
+// APIs cannot do. A tab's debugger session is attached on first use and
+// kept while any feature holds it; Chrome shows a banner meanwhile.
+// Dismissing the banner or opening DevTools ends the session, and with it
+// everything set through it.
+
+const PROTOCOL_VERSION = '1.3';
+
+// Features holding each tab's session, by tab ID
+const holders = new Map<number, Set<string>>();
+// Attaches in progress, so concurrent commands attach once
+const attaching = new Map<number, Promise<void>>();
+const detachListeners: ((tabId: number) => void)[] = [];
+
+// Hold a tab's debugger session for a feature, attaching it if needed
+export async function acquireDebugger(tabId: number, holder: string): Promise<void> {
+  if (!holders.has(tabId)) {
+    let pending = attaching.get(tabId);
+    if (!pending) {
+      pending = chrome.debugger.attach({ tabId }, PROTOCOL_VERSION).then(() => {
+        holders.set(tabId, new Set());
+      }).finally(() => attaching.delete(tabId));
+      attaching.set(tabId, pending);
+    }
+    try {
+      await pending;
+    } catch (err) {
+      throw new Error(`Cannot debug this tab: ${err instanceof Error ? err.message : String(err)}`);
+    }
+  }
+  holders.get(tabId)?.add(holder);
+}
+
+// Let go of a tab's session; it is detached once no feature holds it
+export async function releaseDebugger(tabId: number, holder: string): Promise<void> {
+  const held = holders.get(tabId);
+  if (!held) return;
+  held.delete(holder);
+  if (held.size > 0) return;
+  holders.delete(tabId);
+  try {
+    await chrome.debugger.detach({ tabId });
+  } catch {
+    // Already gone with the tab
+  }
+}
+
+// Send a protocol command to a tab whose session is held
+export async function sendDebuggerCommand<T = unknown>(tabId: number, method: string, params?: object): Promise<T> {
+  return await chrome.debugger.sendCommand({ tabId }, method, params) as T;
+}
+
+// Be told when a tab's session ends other than by releaseDebugger: the tab
+// closed, the user dismissed the banner, or DevTools took over
+export function onDebuggerDetached(listener: (tabId: number) => void): void {
+  detachListeners.push(listener);
+}
+
+chrome.debugger.onDetach.addListener((source) => {
+  if (source.tabId === undefined || !holders.has(source.tabId)) return;
+  holders.delete(source.tabId);
+  for (const listener of detachListeners) {
+    listener(source.tabId);
+  }
+});
+
+// Detach sessions left by an earlier run of the service worker, whose
+// overrides nothing tracks any more. Sessions of DevTools are not ours to
+// detach and stay.
+export async function detachStaleDebuggers(): Promise<void> {
+  const targets = await chrome.debugger.getTargets();
+  for (const target of targets) {
+    if (target.attached && target.tabId !== undefined && !holders.has(target.tabId)) {
+      chrome.debugger.detach({ tabId: target.tabId }).catch(() => {});
+    }
+  }
+}
@@ -0,0 +1,133 @@
+// Download collection. While the relay subscribes to "downloads", files
+// downloaded from attached tabs are read once complete and streamed to the
+// relay in download_chunk messages.
+import type { AttachedTab } from '../shared/types';
+import { isSubscribed, sendMessage } from './websocket';
+import { getAttachedTabsForRelay, getAttachedTabById } from './tabs';
+
+// File bytes per download_chunk; base64 makes the message a third larger
+const DOWNLOAD_CHUNK_SIZE = 1024 * 1024;
+
+// Pause between chunks, keeping well under the relay's inbound byte limit
+const DOWNLOAD_CHUNK_INTERVAL = 250;
+
+// Attached tab each download in progress started from, by download ID
+const downloadTabs = new Map<number, AttachedTab>();
+
+export async function handleDownloadCreated(item: chrome.downloads.DownloadItem): Promise<void> {
+  if (!isSubscribed('downloads')) return;
+  const tab = await findSourceTab(item);
+  if (tab) downloadTabs.set(item.id, tab);
+}
+
+export function handleDownloadChanged(delta: chrome.downloads.DownloadDelta): void {
+  const tab = downloadTabs.get(delta.id);
+  const state = delta.state?.current;
+  if (!tab || !state || state === 'in_progress') return;
+  downloadTabs.delete(delta.id);
+
+  const error = state === 'interrupted' ? `Download interrupted: ${delta.error?.current ?? 'unknown reason'}` : undefined;
+  reportDownload(delta.id, tab, error).catch((err) => {
+    console.error('[OwlRelay] Failed to report download:', err);
+  });
+}
+
+// Downloads do not carry the tab they started in; prefer the attached tab
+// that was showing the referring page, then the focused tab
+async function findSourceTab(item: chrome.downloads.DownloadItem): Promise<AttachedTab | undefined> {
+  const byReferrer = item.referrer ? getAttachedTabsForRelay().find((t) => t.url === item.referrer) : undefined;
+  if (byReferrer) return byReferrer;
+  const [active] = await chrome.tabs.query({ active: true, lastFocusedWindow: true });
+  return active?.id !== undefined ? getAttachedTabById(active.id) : undefined;
+}
+
+async function reportDownload(downloadId: number, tab: AttachedTab, error?: string): Promise<void> {
+  const [item] = await chrome.downloads.search({ id: downloadId });
+  if (!item) return;
+
+  const id = String(downloadId);
+  const url = item.finalUrl || item.url;
+  const base = {
+    type: 'download' as const,
+    id,
+    tabId: tab.uuid,
+    filename: item.filename.split(/[\\/]/).pop() || 'download',
+    mimeType: item.mime || undefined,
+    url,
+  };
+  if (error) {
+    sendMessage({ ...base, size: 0, total: 0, error });
+    return;
+  }
+
+  let bytes: Uint8Array;
+  try {
+    bytes = await readDownload(tab.tabId, url);
+  } catch (err) {
+    sendMessage({ ...base, size: 0, total: 0, error: err instanceof Error ? err.message : String(err) });
+    return;
+  }
+
+  const total = Math.ceil(bytes.length / DOWNLOAD_CHUNK_SIZE);
+  sendMessage({ ...base, size: bytes.length, total });
+  for (let seq = 0; seq < total; seq++) {
+    if (seq > 0) await new Promise((resolve) => setTimeout(resolve, DOWNLOAD_CHUNK_INTERVAL));
+    const part = bytes.subarray(seq * DOWNLOAD_CHUNK_SIZE, (seq + 1) * DOWNLOAD_CHUNK_SIZE);
+    sendMessage({ type: 'download_chunk', id, seq, data: toBase64(part) });
+  }
+}
+
+// Extensions cannot read downloaded files from disk, so the content is
+// fetched again: blob: URLs from the page that created them, others here
+// with the browser's cookies
+async function readDownload(tabId: number, url: string): Promise<Uint8Array> {
+  if (url.startsWith('blob:')) {
+    const [injection] = await chrome.scripting.executeScript({
+      target: { tabId },
+      func: readBlob,
+      args: [url],
+    });
+    const result = injection?.result as { data?: string; error?: string } | undefined;
+    if (result?.data === undefined) {
+      throw new Error(result?.error || 'The file is no longer available');
+    }
+    return fromBase64(result.data);
+  }
+
+  const response = await fetch(url, { credentials: 'include' });
+  if (!response.ok) {
+    throw new Error(`Fetching the file again failed with status ${response.status}`);
+  }
+  return new Uint8Array(await response.arrayBuffer());
+}
+
+// Runs in the page; must not reference anything outside itself
+async function readBlob(url: string): Promise<{ data?: string; error?: string }> {
+  try {
+    const blob = await (await fetch(url)).blob();
+    return await new Promise((resolve) => {
+      const reader = new FileReader();
+      reader.onload = () => resolve({ data: String(reader.result).split(',')[1] ?? '' });
+      reader.onerror = () => resolve({ error: 'Failed to read the file' });
+      reader.readAsDataURL(blob);
+    });
+  } catch (err) {
+    // Pages often revoke the blob URL right after starting the download
+    return { error: err instanceof Error ? err.message : String(err) };
+  }
+}
+
+function toBase64(bytes: Uint8Array): string {
+  let binary = '';
+  for (let i = 0; i < bytes.length; i += 0x8000) {
+    binary += String.fromCharCode(...bytes.subarray(i, i + 0x8000));
+  }
+  return btoa(binary);
+}
+
+function fromBase64(data: string): Uint8Array {
+  const binary = atob(data);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+  return bytes;
+}
@@ -0,0 +1,185 @@
+// Emulation commands: the geolocation, timezone, and language a tab
+// reports, and the viewport it lays out for, set through its debugger
+// session (see debugger.ts). They hold until cleared, the tab is detached,
+// or the session ends.
+import type { Emulation, EmulationGetAction, EmulationSetAction, EmulationClearAction, SetViewportAction, Viewport } from '../shared/types';
+import { acquireDebugger, releaseDebugger, sendDebuggerCommand, onDebuggerDetached } from './debugger';
+
+type EmulationAction = EmulationGetAction | EmulationSetAction | EmulationClearAction;
+
+const HOLDER = 'emulation';
+const VIEWPORT_HOLDER = 'viewport';
+const DEFAULT_ACCURACY = 100; // meters
+const MAX_TOUCH_POINTS = 5;
+
+// What each tab emulates, by tab ID
+const emulations = new Map<number, Emulation>();
+const viewports = new Map<number, Viewport>();
+
+onDebuggerDetached((tabId) => {
+  emulations.delete(tabId);
+  viewports.delete(tabId);
+});
+
+export async function runEmulationAction(tabId: number, action: EmulationAction): Promise<{ emulation: Emulation }> {
+  switch (action.kind) {
+    case 'emulation_get':
+      break;
+    case 'emulation_set':
+      await applyEmulation(tabId, action.emulation);
+      break;
+    case 'emulation_clear':
+      await clearEmulation(tabId);
+      break;
+  }
+  return { emulation: emulations.get(tabId) ?? {} };
+}
+
+// Replace what a tab emulates; what emulation leaves out is no longer
+// emulated. If the browser rejects a value, the tab emulates nothing.
+async function applyEmulation(tabId: number, emulation: Emulation): Promise<void> {
+  const next: Emulation = { ...emulation };
+  if (!next.acceptLanguage && next.locale) {
+    next.acceptLanguage = acceptLanguageFor(next.locale);
+  }
+  if (!next.geolocation && !next.timezone && !next.locale && !next.acceptLanguage) {
+    await clearEmulation(tabId);
+    return;
+  }
+
+  await acquireDebugger(tabId, HOLDER);
+  const previous = emulations.get(tabId) ?? {};
+  try {
+    await applyOverrides(tabId, previous, next);
+  } catch (err) {
+    // Undo whatever either emulation may have set
+    emulations.set(tabId, { ...previous, ...next });
+    await clearEmulation(tabId);
+    throw new Error(err instanceof Error ? err.message : String(err));
+  }
+  emulations.set(tabId, next);
+}
+
+// Stop emulating anything in a tab
+export async function clearEmulation(tabId: number): Promise<void> {
+  const previous = emulations.get(tabId);
+  if (!previous) return;
+  emulations.delete(tabId);
+  try {
+    await applyOverrides(tabId, previous, {});
+  } catch {
+    // The session is going away anyway
+  }
+  await releaseDebugger(tabId, HOLDER);
+}
+
+// Send the protocol commands that take a tab from one emulation to another
+async function applyOverrides(tabId: number, previous: Emulation, next: Emulation): Promise<void> {
+  if (next.geolocation) {
+    await sendDebuggerCommand(tabId, 'Emulation.setGeolocationOverride', {
+      latitude: next.geolocation.latitude,
+      longitude: next.geolocation.longitude,
+      accuracy: next.geolocation.accuracy ?? DEFAULT_ACCURACY,
+    });
+  } else if (previous.geolocation) {
+    await sendDebuggerCommand(tabId, 'Emulation.clearGeolocationOverride');
+  }
+
+  if (next.timezone || previous.timezone) {
+    // An empty ID restores the browser's own
+    await sendDebuggerCommand(tabId, 'Emulation.setTimezoneOverride', { timezoneId: next.timezone ?? '' });
+  }
+
+  if (previous.locale) {
+    // A locale is only replaced once the previous one is cleared
+    await sendDebuggerCommand(tabId, 'Emulation.setLocaleOverride', {});
+  }
+  if (next.locale) {
+    await sendDebuggerCommand(tabId, 'Emulation.setLocaleOverride', { locale: next.locale });
+  }
+
+  if (next.acceptLanguage || previous.acceptLanguage) {
+    await applyUserAgent(tabId, viewports.get(tabId)?.userAgent, next.acceptLanguage);
+  }
+}
+
+export async function runViewportAction(tabId: number, action: SetViewportAction): Promise<{ viewport?: Viewport }> {
+  if (action.viewport) {
+    await applyViewport(tabId, action.viewport);
+  } else {
+    await clearViewport(tabId);
+  }
+  return { viewport: viewports.get(tabId) };
+}
+
+// Replace the viewport a tab lays out for. If the browser rejects it, the
+// tab gets the window's own back.
+async function applyViewport(tabId: number, viewport: Viewport): Promise<void> {
+  await acquireDebugger(tabId, VIEWPORT_HOLDER);
+  const previous = viewports.get(tabId);
+  try {
+    await sendDebuggerCommand(tabId, 'Emulation.setDeviceMetricsOverride', {
+      width: viewport.width,
+      height: viewport.height,
+      // 0 keeps the display's own
+      deviceScaleFactor: viewport.deviceScaleFactor ?? 0,
+      mobile: viewport.mobile ?? false,
+      screenWidth: viewport.width,
+      screenHeight: viewport.height,
+    });
+    if (viewport.mobile || previous?.mobile) {
+      await sendDebuggerCommand(tabId, 'Emulation.setTouchEmulationEnabled', {
+        enabled: viewport.mobile ?? false,
+        maxTouchPoints: MAX_TOUCH_POINTS,
+      });
+    }
+    if (viewport.userAgent || previous?.userAgent) {
+      await applyUserAgent(tabId, viewport.userAgent, emulations.get(tabId)?.acceptLanguage);
+    }
+  } catch (err) {
+    // Undo whatever either viewport may have set
+    viewports.set(tabId, {
+      ...viewport,
+      mobile: viewport.mobile || previous?.mobile,
+      userAgent: viewport.userAgent || previous?.userAgent,
+    });
+    await clearViewport(tabId);
+    throw new Error(err instanceof Error ? err.message : String(err));
+  }
+  viewports.set(tabId, viewport);
+}
+
+// Give a tab the browser window's own viewport back
+export async function clearViewport(tabId: number): Promise<void> {
+  const previous = viewports.get(tabId);
+  if (!previous) return;
+  viewports.delete(tabId);
+  try {
+    await sendDebuggerCommand(tabId, 'Emulation.clearDeviceMetricsOverride');
+    if (previous.mobile) {
+      await sendDebuggerCommand(tabId, 'Emulation.setTouchEmulationEnabled', { enabled: false });
+    }
+    if (previous.userAgent) {
+      await applyUserAgent(tabId, undefined, emulations.get(tabId)?.acceptLanguage);
+    }
+  } catch {
+    // The session is going away anyway
+  }
+  await releaseDebugger(tabId, VIEWPORT_HOLDER);
+}
+
+// The user agent of a viewport and the Accept-Language of an emulation
+// are set by one protocol command, so each passes the other's along. An
+// empty user agent restores the browser's own.
+async function applyUserAgent(tabId: number, userAgent: string | undefined, acceptLanguage: string | undefined): Promise<void> {
+  await sendDebuggerCommand(tabId, 'Emulation.setUserAgentOverride', {
+    userAgent: userAgent || (acceptLanguage ? navigator.userAgent : ''),
+    acceptLanguage,
+  });
+}
+
+// "tr-TR" prefers Turkish as spoken in Turkey, then any Turkish
+function acceptLanguageFor(locale: string): string {
+  const language = locale.split('-')[0];
+  return language === locale ? locale : `${locale},${language};q=0.9`;
+}
@@ -0,0 +1,146 @@
+// JavaScript evaluation. The script runs in the page's own world, where it
+// sees the page's globals, and its value is serialized there, since most
+// page objects cannot cross into the extension.
+import type { EvaluateAction, EvaluateResult } from '../shared/types';
+
+// An evaluation failure, carrying the error code the relay reports
+export class EvaluateFailure extends Error {
+  constructor(public code: string, message: string) {
+    super(message);
+  }
+}
+
+export async function runEvaluateAction(tabId: number, action: EvaluateAction): Promise<EvaluateResult> {
+  const [injection] = await chrome.scripting.executeScript({
+    target: { tabId },
+    world: 'MAIN',
+    func: evaluateInPage,
+    args: [action.script, action.args ?? [], action.awaitPromise !== false, action.returnByValue !== false, action.maxDepth ?? 10],
+  });
+  const outcome = injection?.result as (EvaluateResult & { error?: string; code?: string }) | undefined;
+  if (!outcome) {
+    throw new EvaluateFailure('EVALUATION_FAILED', 'Scripts cannot run in this tab');
+  }
+  if (outcome.error) {
+    throw new EvaluateFailure(outcome.code ?? 'EVALUATION_FAILED', outcome.error);
+  }
+  return outcome;
+}
+
+// Runs in the page; must not reference anything outside itself
+async function evaluateInPage(
+  script: string,
+  args: unknown[],
+  awaitPromise: boolean,
+  returnByValue: boolean,
+  maxDepth: number,
+): Promise<unknown> {
+  const MAX_DESCRIPTION = 1000;
+
+  const describe = (value: unknown): string => {
+    if (value instanceof Element) {
+      const id = value.id ? `#${value.id}` : '';
+      const classes = typeof value.className === 'string' && value.className.trim()
+        ? '.' + value.className.trim().split(/\s+/).join('.')
+        : '';
+      return `${value.tagName.toLowerCase()}${id}${classes}`;
+    }
+    if (value instanceof Node) return value.nodeName;
+    if (typeof value === 'function') return String(value).split('\n')[0];
+    if (value instanceof Error) return `${value.name}: ${value.message}`;
+    if (Array.isArray(value)) return `Array(${value.length})`;
+    try {
+      return String(value);
+    } catch {
+      return Object.prototype.toString.call(value);
+    }
+  };
+
+  const className = (value: unknown): string | undefined => {
+    if (value === null || typeof value !== 'object') return undefined;
+    return (value as object).constructor?.name || 'Object';
+  };
+
+  // JSON-compatible copy of value, cut at maxDepth levels; what JSON cannot
+  // hold is described instead
+  const seen = new Set<unknown>();
+  const serialize = (value: unknown, depth: number): unknown => {
+    switch (typeof value) {
+      case 'undefined':
+        return null;
+      case 'string':
+      case 'boolean':
+        return value;
+      case 'number':
+        return Number.isFinite(value) ? value : String(value);
+      case 'bigint':
+      case 'symbol':
+      case 'function':
+        return describe(value);
+    }
+    if (value === null) return null;
+    if (value instanceof Date) return isNaN(value.getTime()) ? 'Invalid Date' : value.toISOString();
+    if (value instanceof Node) return describe(value);
+    if (value instanceof Error) return { name: value.name, message: value.message, stack: value.stack };
+    if (seen.has(value)) return '[Circular]';
+    if (depth >= maxDepth) return Array.isArray(value) ? '[Array]' : '[Object]';
+
+    seen.add(value);
+    try {
+      if (Array.isArray(value)) return value.map((v) => serialize(v, depth + 1));
+      if (value instanceof Map) return Array.from(value, ([k, v]) => [serialize(k, depth + 1), serialize(v, depth + 1)]);
+      if (value instanceof Set) return Array.from(value, (v) => serialize(v, depth + 1));
+      const copy: Record<string, unknown> = {};
+      for (const key of Object.keys(value as object)) {
+        let v: unknown;
+        try {
+          v = (value as Record<string, unknown>)[key];
+        } catch (err) {
+          v = `[Thrown: ${describe(err)}]`;
+        }
+        if (v !== undefined && typeof v !== 'function' && typeof v !== 'symbol') {
+          copy[key] = serialize(v, depth + 1);
+        }
+      }
+      return copy;
+    } finally {
+      seen.delete(value);
+    }
+  };
+
+  let fn: (args: unknown[]) => unknown;
+  try {
+    fn = new Function('args', script) as (args: unknown[]) => unknown;
+  } catch (err) {
+    if (err instanceof SyntaxError) {
+      return { error: `SyntaxError: ${err.message}`, code: 'EVALUATION_FAILED' };
+    }
+    // EvalError: the page's Content-Security-Policy forbids eval
+    return { error: `The page does not allow scripts to be evaluated: ${describe(err)}`, code: 'EVALUATION_BLOCKED' };
+  }
+
+  let value: unknown;
+  try {
+    value = fn(args);
+    if (awaitPromise && value instanceof Promise) {
+      value = await value;
+    }
+  } catch (err) {
+    return { error: `Uncaught ${describe(err)}`, code: 'EVALUATION_FAILED' };
+  }
+
+  const type = value === null ? 'object' : typeof value;
+  const result: Record<string, unknown> = { type };
+  const name = className(value);
+  if (name) result.className = name;
+  if (type === 'undefined') return result;
+
+  const byValue = returnByValue && !(value instanceof Node) && !(value instanceof Promise) &&
+    type !== 'function' && type !== 'symbol' && type !== 'bigint';
+  if (byValue) {
+    result.value = serialize(value, 0);
+  } else {
+    result.description = describe(value).slice(0, MAX_DESCRIPTION);
+  }
+  return result;
+}
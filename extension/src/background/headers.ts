@@ -0,0 +1,88 @@
+// Header commands: extra headers on the outgoing requests of a tab,
+// installed as declarativeNetRequest session rules limited to the tab.
+// Like request rules, they hold until cleared or the tab is detached or
+// closed, and are gone when the browser restarts.
+import type { ExtraHeaders, HeadersGetAction, HeadersSetAction, HeadersClearAction } from '../shared/types';
+import { serialized, freeRuleIds } from './rules';
+
+type HeadersAction = HeadersGetAction | HeadersSetAction | HeadersClearAction;
+
+// What each tab was given, by tab ID, kept for the browser session so a
+// restarted service worker still knows
+const STORAGE_KEY = 'extraHeaders';
+
+// Above the request rules' priority, so their allow rules do not keep
+// the headers off the requests they exempt
+const HEADER_RULE_PRIORITY = 2;
+
+interface InstalledHeaders extends ExtraHeaders {
+  id: number; // session rule ID
+}
+
+export async function runHeadersAction(tabId: number, action: HeadersAction): Promise<ExtraHeaders> {
+  switch (action.kind) {
+    case 'headers_set':
+      await serialized(() => installHeaders(tabId, action.extraHeaders));
+      break;
+    case 'headers_clear':
+      await clearHeaders(tabId);
+      break;
+  }
+  const installed = (await loadInstalled())[tabId];
+  return installed ? { headers: installed.headers, domains: installed.domains } : { headers: {} };
+}
+
+// Stop adding headers to a tab's requests
+export function clearHeaders(tabId: number): Promise<void> {
+  return serialized(async () => {
+    const installed = await loadInstalled();
+    const previous = installed[tabId];
+    if (!previous) return;
+    await chrome.declarativeNetRequest.updateSessionRules({ removeRuleIds: [previous.id] });
+    delete installed[tabId];
+    await chrome.storage.session.set({ [STORAGE_KEY]: installed });
+  });
+}
+
+// Replace a tab's headers with one rule that sets them all
+async function installHeaders(tabId: number, next: ExtraHeaders): Promise<void> {
+  const installed = await loadInstalled();
+  const previous = installed[tabId];
+  const replacing = previous ? [previous.id] : [];
+  const [id] = await freeRuleIds(1, replacing);
+
+  const condition: chrome.declarativeNetRequest.RuleCondition = {
+    tabIds: [tabId],
+    // Every kind of request, the page itself included
+    resourceTypes: Object.values(chrome.declarativeNetRequest.ResourceType),
+  };
+  if (next.domains?.length) condition.requestDomains = next.domains;
+
+  try {
+    await chrome.declarativeNetRequest.updateSessionRules({
+      removeRuleIds: replacing,
+      addRules: [{
+        id,
+        priority: HEADER_RULE_PRIORITY,
+        condition,
+        action: {
+          type: 'modifyHeaders' as chrome.declarativeNetRequest.RuleActionType,
+          requestHeaders: Object.entries(next.headers).map(([header, value]) => ({
+            header,
+            operation: 'set' as chrome.declarativeNetRequest.HeaderOperation,
+            value,
+          })),
+        },
+      }],
+    });
+  } catch (err) {
+    throw new Error(`Browser rejected the headers: ${err instanceof Error ? err.message : String(err)}`);
+  }
+  installed[tabId] = { headers: next.headers, domains: next.domains, id };
+  await chrome.storage.session.set({ [STORAGE_KEY]: installed });
+}
+
+async function loadInstalled(): Promise<Record<number, InstalledHeaders>> {
+  const result = await chrome.storage.session.get(STORAGE_KEY);
+  return result[STORAGE_KEY] || {};
+}
@@ -1,7 +1,11 @@
 // OwlRelay Background Service Worker
-import type { PopupToBackgroundMessage, BackgroundToPopupResponse } from '../shared/messages';
+import type { PopupToBackgroundMessage, BackgroundToPopupResponse, ContentEventMessage } from '../shared/messages';
 import { connect, disconnect, getConnectionState, onConnectionStateChange } from './websocket';
-import { initTabs, attachTab, detachTab, getAttachedTabsForRelay, handleTabUpdate, handleTabRemove } from './tabs';
+import { initTabs, attachTab, detachTab, getAttachedTabsForRelay, handleTabUpdate, handleTabRemove, forwardConsoleEntry, forwardPageEvent, isTabAttached } from './tabs';
+import { handleAuthRequired } from './credentials';
+import { scheduleWindowUpdate } from './browserinfo';
+import { handleDownloadCreated, handleDownloadChanged } from './downloads';
+import { detachStaleDebuggers } from './debugger';
 import { getRelayUrl, getToken, setRelayUrl, setToken } from '../shared/storage';
 
 console.log('[OwlRelay] Background service worker started');
@@ -9,6 +13,7 @@ console.log('[OwlRelay] Background service worker started');
 // Initialize on startup
 async function init(): Promise<void> {
   await initTabs();
+  await detachStaleDebuggers();
   
   // Auto-connect if we have saved credentials
   const [relayUrl, token] = await Promise.all([getRelayUrl(), getToken()]);
@@ -23,9 +28,10 @@ init();
 // Listen for messages from popup
 chrome.runtime.onMessage.addListener((
   message: PopupToBackgroundMessage,
-  _sender,
+  sender,
   sendResponse: (response: BackgroundToPopupResponse) => void
 ) => {
+  if (sender.tab) return false; // From a content script
   handlePopupMessage(message).then(sendResponse);
   return true; // Keep channel open for async response
 });
@@ -101,6 +107,17 @@ async function handlePopupMessage(message: PopupToBackgroundMessage): Promise<Ba
   }
 }
 
+// Listen for events from content scripts
+chrome.runtime.onMessage.addListener((message: ContentEventMessage, sender) => {
+  if (message.type === 'CONSOLE_ENTRY' && sender.tab?.id !== undefined) {
+    forwardConsoleEntry(sender.tab.id, message.entry);
+  }
+  if (message.type === 'PAGE_EVENT' && sender.tab?.id !== undefined) {
+    forwardPageEvent(sender.tab.id, message.event);
+  }
+  return false;
+});
+
 // Listen for tab updates
 chrome.tabs.onUpdated.addListener((tabId, changeInfo) => {
   handleTabUpdate(tabId, changeInfo);
@@ -111,6 +128,29 @@ chrome.tabs.onRemoved.addListener((tabId) => {
   handleTabRemove(tabId);
 });
 
+// Report downloads from attached tabs
+chrome.downloads.onCreated.addListener((item) => {
+  handleDownloadCreated(item);
+});
+chrome.downloads.onChanged.addListener((delta) => {
+  handleDownloadChanged(delta);
+});
+
+// Keep the relay's view of the browser window current
+chrome.windows.onFocusChanged.addListener(scheduleWindowUpdate);
+chrome.windows.onBoundsChanged.addListener(scheduleWindowUpdate);
+chrome.windows.onCreated.addListener(scheduleWindowUpdate);
+chrome.windows.onRemoved.addListener(scheduleWindowUpdate);
+
+// Answer auth challenges of attached tabs instead of showing a dialog
+chrome.webRequest.onAuthRequired.addListener(
+  (details, callback) => {
+    handleAuthRequired(details, isTabAttached(details.tabId), callback!);
+  },
+  { urls: ['<all_urls>'] },
+  ['asyncBlocking']
+);
+
 // Handle extension install/update
 chrome.runtime.onInstalled.addListener((details) => {
   console.log('[OwlRelay] Extension installed/updated:', details.reason);
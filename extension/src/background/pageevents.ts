@@ -0,0 +1,60 @@
+// Page event capture for attached tabs. The hook runs in the page's own
+// world, where it can see dialogs being opened, and reports them and DOM
+// mutations to the content script, which forwards them here.
+import { PAGE_EVENT_NAME } from '../shared/messages';
+
+// Install the page event hook in a tab; safe to call again after navigation
+export async function installPageEventHook(tabId: number): Promise<void> {
+  try {
+    await chrome.scripting.executeScript({
+      target: { tabId },
+      world: 'MAIN',
+      injectImmediately: true,
+      func: pageEventHook,
+      args: [PAGE_EVENT_NAME],
+    });
+  } catch {
+    // Pages such as chrome:// cannot be scripted
+  }
+}
+
+// Runs in the page; must not reference anything outside itself
+function pageEventHook(eventName: string): void {
+  const w = window as unknown as { __owlrelayPageEvents?: boolean };
+  if (w.__owlrelayPageEvents) return;
+  w.__owlrelayPageEvents = true;
+
+  // A DOM event reaches the content script before a dialog blocks the
+  // page, which a posted message would not. Only strings cross worlds.
+  const emit = (event: Record<string, unknown>) => {
+    event.timestamp = Date.now();
+    window.dispatchEvent(new CustomEvent(eventName, { detail: JSON.stringify(event) }));
+  };
+
+  for (const type of ['alert', 'confirm', 'prompt'] as const) {
+    const original = window[type] as (...args: unknown[]) => unknown;
+    (window as unknown as Record<string, unknown>)[type] = function (this: unknown, ...args: unknown[]) {
+      try {
+        emit({ event: 'dialog_opened', dialog: { type, message: args.length > 0 ? String(args[0]) : '' } });
+      } catch {
+        // Never break the page's dialogs
+      }
+      return original.apply(this, args);
+    };
+  }
+
+  // Mutations are counted and reported at most once a second
+  const MUTATION_INTERVAL = 1000;
+  let mutations = 0;
+  let timer: number | undefined;
+  const observer = new MutationObserver((records) => {
+    mutations += records.length;
+    if (timer !== undefined) return;
+    timer = window.setTimeout(() => {
+      emit({ event: 'dom_mutated', mutations });
+      mutations = 0;
+      timer = undefined;
+    }, MUTATION_INTERVAL);
+  });
+  observer.observe(document, { childList: true, subtree: true, attributes: true, characterData: true });
+}
@@ -0,0 +1,104 @@
+// Request rule commands: the blocking and redirect rules of a tab,
+// installed as declarativeNetRequest session rules limited to the tab.
+// They hold until cleared or the tab is detached or closed, and are gone
+// when the browser restarts.
+import type { RequestRule, RequestRules, RequestRulesGetAction, RequestRulesSetAction, RequestRulesClearAction } from '../shared/types';
+
+type RequestRulesAction = RequestRulesGetAction | RequestRulesSetAction | RequestRulesClearAction;
+
+// What each tab was given, by tab ID, kept for the browser session so a
+// restarted service worker still knows
+const STORAGE_KEY = 'requestRules';
+
+interface InstalledRules extends RequestRules {
+  ids: number[]; // session rule IDs
+}
+
+// Changes run one at a time, so concurrent ones never pick the same IDs;
+// header rules share the IDs and go through here too
+let pending: Promise<unknown> = Promise.resolve();
+
+export function serialized<T>(fn: () => Promise<T>): Promise<T> {
+  const run = pending.then(fn, fn);
+  pending = run.catch(() => {});
+  return run;
+}
+
+export async function runRequestRulesAction(tabId: number, action: RequestRulesAction): Promise<RequestRules> {
+  switch (action.kind) {
+    case 'request_rules_set':
+      await serialized(() => installRules(tabId, action.requestRules));
+      break;
+    case 'request_rules_clear':
+      await clearRequestRules(tabId);
+      break;
+  }
+  const installed = (await loadInstalled())[tabId];
+  return installed ? { ruleSet: installed.ruleSet, rules: installed.rules } : { rules: [] };
+}
+
+// Remove a tab's request rules
+export function clearRequestRules(tabId: number): Promise<void> {
+  return serialized(async () => {
+    const installed = await loadInstalled();
+    const previous = installed[tabId];
+    if (!previous) return;
+    await chrome.declarativeNetRequest.updateSessionRules({ removeRuleIds: previous.ids });
+    delete installed[tabId];
+    await chrome.storage.session.set({ [STORAGE_KEY]: installed });
+  });
+}
+
+// Replace a tab's rules in one update, so it never goes without either
+async function installRules(tabId: number, next: RequestRules): Promise<void> {
+  const installed = await loadInstalled();
+  const previous = installed[tabId];
+  const ids = await freeRuleIds(next.rules.length, previous?.ids ?? []);
+  try {
+    await chrome.declarativeNetRequest.updateSessionRules({
+      removeRuleIds: previous?.ids ?? [],
+      addRules: next.rules.map((rule, i) => toDeclarative(tabId, ids[i], rule)),
+    });
+  } catch (err) {
+    throw new Error(`Browser rejected the rules: ${err instanceof Error ? err.message : String(err)}`);
+  }
+  installed[tabId] = { ruleSet: next.ruleSet, rules: next.rules, ids };
+  await chrome.storage.session.set({ [STORAGE_KEY]: installed });
+}
+
+async function loadInstalled(): Promise<Record<number, InstalledRules>> {
+  const result = await chrome.storage.session.get(STORAGE_KEY);
+  return result[STORAGE_KEY] || {};
+}
+
+// Session rule IDs no other rule uses; IDs being replaced count as free
+export async function freeRuleIds(count: number, replacing: number[]): Promise<number[]> {
+  const used = new Set((await chrome.declarativeNetRequest.getSessionRules()).map((rule) => rule.id));
+  for (const id of replacing) used.delete(id);
+  const ids: number[] = [];
+  for (let id = 1; ids.length < count; id++) {
+    if (!used.has(id)) ids.push(id);
+  }
+  return ids;
+}
+
+function toDeclarative(tabId: number, id: number, rule: RequestRule): chrome.declarativeNetRequest.Rule {
+  const condition: chrome.declarativeNetRequest.RuleCondition = { tabIds: [tabId] };
+  if (rule.urlFilter) condition.urlFilter = rule.urlFilter;
+  if (rule.regexFilter) condition.regexFilter = rule.regexFilter;
+  if (rule.domains?.length) condition.requestDomains = rule.domains;
+  if (rule.resourceTypes?.length) {
+    condition.resourceTypes = rule.resourceTypes as chrome.declarativeNetRequest.ResourceType[];
+  }
+
+  let action: chrome.declarativeNetRequest.RuleAction;
+  if (rule.action === 'redirect') {
+    action = {
+      type: 'redirect' as chrome.declarativeNetRequest.RuleActionType,
+      redirect: rule.redirectUrl ? { url: rule.redirectUrl } : { regexSubstitution: rule.regexSubstitution },
+    };
+  } else {
+    action = { type: rule.action as chrome.declarativeNetRequest.RuleActionType };
+  }
+  return { id, priority: 1, condition, action };
+}
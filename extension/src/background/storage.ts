@@ -0,0 +1,74 @@
+// Web storage commands. localStorage and sessionStorage belong to the
+// page's origin, so they are read and written by a function run in the tab.
+import type { StorageGetAction, StorageSetAction, StorageRemoveAction } from '../shared/types';
+
+type StorageAction = StorageGetAction | StorageSetAction | StorageRemoveAction;
+
+export async function runStorageAction(tabId: number, action: StorageAction): Promise<unknown> {
+  const [injection] = await chrome.scripting.executeScript({
+    target: { tabId },
+    func: storageOp,
+    args: [action],
+  });
+  const result = injection?.result as { error?: string } | undefined;
+  if (!result) {
+    throw new Error('Storage is not accessible in this tab');
+  }
+  if (result.error) {
+    throw new Error(result.error);
+  }
+  return result;
+}
+
+// Runs in the page; must not reference anything outside itself
+function storageOp(action: StorageAction): unknown {
+  try {
+    const storage = action.area === 'session' ? window.sessionStorage : window.localStorage;
+    const url = location.href;
+
+    switch (action.kind) {
+      case 'storage_get': {
+        const keys = action.keys?.length ? action.keys : Object.keys(storage);
+        const items: Record<string, string> = {};
+        let size = 0;
+        let truncated = false;
+        for (const key of keys) {
+          const value = storage.getItem(key);
+          if (value === null) continue;
+          size += key.length + value.length;
+          if (action.maxLength && size > action.maxLength) {
+            truncated = true;
+            break;
+          }
+          items[key] = value;
+        }
+        return { url, items, truncated };
+      }
+      case 'storage_set': {
+        for (const [key, value] of Object.entries(action.items)) {
+          storage.setItem(key, value);
+        }
+        return { url, items: action.items };
+      }
+      case 'storage_remove': {
+        if (!action.keys?.length) {
+          const removed = storage.length;
+          storage.clear();
+          return { url, removed };
+        }
+        let removed = 0;
+        for (const key of action.keys) {
+          if (storage.getItem(key) !== null) {
+            storage.removeItem(key);
+            removed++;
+          }
+        }
+        return { url, removed };
+      }
+    }
+    return { error: 'Unknown storage action' };
+  } catch (err) {
+    // Opaque origins and full quotas throw
+    return { error: err instanceof Error ? err.message : String(err) };
+  }
+}
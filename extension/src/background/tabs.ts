@@ -1,7 +1,14 @@
-import type { AttachedTab } from '../shared/types';
+import type { AttachedTab, PageConsoleEntry, PageEventEntry } from '../shared/types';
 import { getAttachedTabs, addAttachedTab, removeAttachedTab, setAttachedTabs } from '../shared/storage';
 import { isBlacklisted } from '../shared/constants';
-import { sendMessage, isConnected } from './websocket';
+import { sendMessage, isConnected, isSubscribed } from './websocket';
+import { installConsoleHook } from './console';
+import { installPageEventHook } from './pageevents';
+import { clearEmulation, clearViewport } from './emulation';
+import { clearNetworkConditions } from './throttling';
+import { clearRequestRules } from './rules';
+import { clearHeaders } from './headers';
+import { clearCredentials } from './credentials';
 
 // In-memory cache of attached tabs
 let attachedTabs: AttachedTab[] = [];
@@ -36,6 +43,10 @@ export async function initTabs(): Promise<void> {
   
   attachedTabs = validTabs;
   await setAttachedTabs(validTabs);
+  for (const tab of validTabs) {
+    installConsoleHook(tab.tabId);
+    installPageEventHook(tab.tabId);
+  }
 }
 
 // Attach a tab
@@ -76,6 +87,8 @@ export async function attachTab(tabId: number): Promise<AttachedTab | null> {
   
   // Update badge for this tab
   await updateTabBadge(tabId, true);
+  await installConsoleHook(tabId);
+  await installPageEventHook(tabId);
   
   // Notify relay
   if (isConnected()) {
@@ -91,6 +104,51 @@ export async function attachTab(tabId: number): Promise<AttachedTab | null> {
   return tab;
 }
 
+// Open a new tab for the relay, wait for it to load, and attach it
+export async function createTab(url: string | undefined, active: boolean, timeout: number): Promise<AttachedTab> {
+  if (url && isBlacklisted(url)) {
+    throw new Error('This site is on the security blacklist and cannot be controlled');
+  }
+  
+  const chromeTab = await chrome.tabs.create({ url: url || 'about:blank', active });
+  if (chromeTab.id === undefined) {
+    throw new Error('Failed to create tab');
+  }
+  
+  await waitForTabLoad(chromeTab.id, timeout);
+  
+  const tab = await attachTab(chromeTab.id);
+  if (!tab) {
+    throw new Error('Failed to attach tab');
+  }
+  return tab;
+}
+
+// Resolve once the tab finishes loading, or after timeout
+function waitForTabLoad(tabId: number, timeout: number): Promise<void> {
+  return new Promise(resolve => {
+    const done = () => {
+      clearTimeout(timer);
+      chrome.tabs.onUpdated.removeListener(listener);
+      resolve();
+    };
+    const listener = (updatedId: number, changeInfo: chrome.tabs.TabChangeInfo) => {
+      if (updatedId === tabId && changeInfo.status === 'complete') done();
+    };
+    const timer = setTimeout(done, timeout);
+    chrome.tabs.onUpdated.addListener(listener);
+  });
+}
+
+// Close an attached tab; handleTabRemove reports the detach
+export async function closeTab(uuid: string): Promise<void> {
+  const tab = getAttachedTabByUuid(uuid);
+  if (!tab) {
+    throw new Error(`Tab ${uuid} is not attached`);
+  }
+  await chrome.tabs.remove(tab.tabId);
+}
+
 // Detach a tab
 export async function detachTab(tabId: number): Promise<void> {
   const index = attachedTabs.findIndex(t => t.tabId === tabId);
@@ -102,6 +160,12 @@ export async function detachTab(tabId: number): Promise<void> {
   
   // Update badge for this tab
   await updateTabBadge(tabId, false);
+  await clearEmulation(tabId);
+  await clearViewport(tabId);
+  await clearNetworkConditions(tabId);
+  await clearRequestRules(tabId);
+  await clearHeaders(tabId);
+  await clearCredentials(tabId);
   
   // Notify relay
   if (isConnected()) {
@@ -153,6 +217,12 @@ export function handleTabUpdate(tabId: number, changeInfo: chrome.tabs.TabChange
   
   let updated = false;
   
+  // A new document needs the hooks again
+  if (changeInfo.status === 'loading') {
+    installConsoleHook(tabId);
+    installPageEventHook(tabId);
+  }
+  
   if (changeInfo.url) {
     // Check if new URL is blacklisted
     if (isBlacklisted(changeInfo.url)) {
@@ -182,6 +252,15 @@ export function handleTabUpdate(tabId: number, changeInfo: chrome.tabs.TabChange
       title: tab.title,
     });
   }
+  
+  if (changeInfo.status === 'complete') {
+    forwardPageEvent(tabId, {
+      event: 'navigation_completed',
+      url: tab.url,
+      title: tab.title,
+      timestamp: Date.now(),
+    });
+  }
 }
 
 // Handle tab removal from Chrome
@@ -191,6 +270,9 @@ export function handleTabRemove(tabId: number): void {
     const tab = attachedTabs[index];
     attachedTabs.splice(index, 1);
     removeAttachedTab(tabId);
+    clearRequestRules(tabId);
+    clearHeaders(tabId);
+    clearCredentials(tabId);
     
     if (isConnected()) {
       sendMessage({
@@ -200,3 +282,27 @@ export function handleTabRemove(tabId: number): void {
     }
   }
 }
+
+// Forward a console entry from an attached tab if the relay subscribed
+export function forwardConsoleEntry(tabId: number, entry: PageConsoleEntry): void {
+  const tab = attachedTabs.find(t => t.tabId === tabId);
+  if (!tab || !isSubscribed('console')) return;
+  
+  sendMessage({
+    type: 'console',
+    tabId: tab.uuid,
+    ...entry,
+  });
+}
+
+// Forward a page event from an attached tab if the relay subscribed
+export function forwardPageEvent(tabId: number, event: PageEventEntry): void {
+  const tab = attachedTabs.find(t => t.tabId === tabId);
+  if (!tab || !isSubscribed('page_events')) return;
+  
+  sendMessage({
+    type: 'page_event',
+    tabId: tab.uuid,
+    ...event,
+  });
+}
@@ -0,0 +1,66 @@
+// Network condition commands: the connection a tab's requests get, set
+// through its debugger session (see debugger.ts) as DevTools throttles.
+// They hold until restored, the tab is detached, or the session ends.
+import type { NetworkConditions, SetNetworkConditionsAction } from '../shared/types';
+import { acquireDebugger, releaseDebugger, sendDebuggerCommand, onDebuggerDetached } from './debugger';
+
+const HOLDER = 'network';
+
+// The connection each tab emulates, by tab ID
+const conditions = new Map<number, NetworkConditions>();
+
+onDebuggerDetached((tabId) => {
+  conditions.delete(tabId);
+});
+
+export async function runNetworkConditionsAction(
+  tabId: number,
+  action: SetNetworkConditionsAction,
+): Promise<{ networkConditions?: NetworkConditions }> {
+  if (action.networkConditions) {
+    await applyNetworkConditions(tabId, action.networkConditions);
+  } else {
+    await clearNetworkConditions(tabId);
+  }
+  return { networkConditions: conditions.get(tabId) };
+}
+
+// Replace the connection a tab emulates. If the browser rejects it, the
+// tab gets the real one back.
+async function applyNetworkConditions(tabId: number, next: NetworkConditions): Promise<void> {
+  await acquireDebugger(tabId, HOLDER);
+  try {
+    // Conditions only apply while the network domain is enabled
+    await sendDebuggerCommand(tabId, 'Network.enable');
+    await sendDebuggerCommand(tabId, 'Network.emulateNetworkConditions', {
+      offline: next.offline ?? false,
+      latency: next.latency ?? 0,
+      // -1 leaves a direction unthrottled
+      downloadThroughput: next.downloadThroughput || -1,
+      uploadThroughput: next.uploadThroughput || -1,
+    });
+  } catch (err) {
+    conditions.set(tabId, next);
+    await clearNetworkConditions(tabId);
+    throw new Error(err instanceof Error ? err.message : String(err));
+  }
+  conditions.set(tabId, next);
+}
+
+// Give a tab its real connection back
+export async function clearNetworkConditions(tabId: number): Promise<void> {
+  if (!conditions.has(tabId)) return;
+  conditions.delete(tabId);
+  try {
+    await sendDebuggerCommand(tabId, 'Network.emulateNetworkConditions', {
+      offline: false,
+      latency: 0,
+      downloadThroughput: -1,
+      uploadThroughput: -1,
+    });
+    await sendDebuggerCommand(tabId, 'Network.disable');
+  } catch {
+    // The session is going away anyway
+  }
+  await releaseDebugger(tabId, HOLDER);
+}
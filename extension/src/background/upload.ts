@@ -0,0 +1,90 @@
+// File uploads. The relay streams an upload command's files in
+// upload_chunk messages just ahead of the command; they are collected here
+// and handed to a function run in the tab, which sets them on the input.
+import type { UploadAction, UploadChunk } from '../shared/types';
+
+// Chunks of commands that never arrive are dropped after this long
+const UPLOAD_CHUNK_TTL = 60_000;
+
+interface PendingFile {
+  parts: string[]; // base64, by seq
+  received: number;
+}
+
+interface PendingUpload {
+  files: PendingFile[];
+  timer: ReturnType<typeof setTimeout>;
+}
+
+const pendingUploads = new Map<string, PendingUpload>();
+
+export function addUploadChunk(chunk: UploadChunk): void {
+  let upload = pendingUploads.get(chunk.id);
+  if (!upload) {
+    upload = {
+      files: [],
+      timer: setTimeout(() => pendingUploads.delete(chunk.id), UPLOAD_CHUNK_TTL),
+    };
+    pendingUploads.set(chunk.id, upload);
+  }
+  const file = (upload.files[chunk.file] ??= { parts: new Array<string>(chunk.total), received: 0 });
+  if (file.parts[chunk.seq] === undefined) file.received++;
+  file.parts[chunk.seq] = chunk.data;
+}
+
+export async function runUploadAction(tabId: number, commandId: string, action: UploadAction): Promise<unknown> {
+  const upload = pendingUploads.get(commandId);
+  pendingUploads.delete(commandId);
+  if (upload) clearTimeout(upload.timer);
+
+  const files = action.files.map((file, i) => {
+    const pending = upload?.files[i];
+    if (!pending || pending.received < pending.parts.length) {
+      throw new Error(`File ${file.name} did not arrive`);
+    }
+    return { name: file.name, type: file.mimeType ?? '', parts: pending.parts };
+  });
+
+  const [injection] = await chrome.scripting.executeScript({
+    target: { tabId },
+    func: setInputFiles,
+    args: [action.selector, files],
+  });
+  const result = injection?.result as { files?: number; error?: string } | undefined;
+  if (!result) {
+    throw new Error('Cannot upload files in this tab');
+  }
+  if (result.error) {
+    throw new Error(result.error);
+  }
+  return result;
+}
+
+// Runs in the page; must not reference anything outside itself
+function setInputFiles(
+  selector: string,
+  files: { name: string; type: string; parts: string[] }[]
+): { files?: number; error?: string } {
+  const input = document.querySelector(selector);
+  if (!(input instanceof HTMLInputElement) || input.type !== 'file') {
+    return { error: `No file input matches ${selector}` };
+  }
+  if (files.length > 1 && !input.multiple) {
+    return { error: 'The file input accepts a single file' };
+  }
+
+  const transfer = new DataTransfer();
+  for (const file of files) {
+    const chunks = file.parts.map((part) => {
+      const binary = atob(part);
+      const bytes = new Uint8Array(binary.length);
+      for (let i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+      return bytes;
+    });
+    transfer.items.add(new File(chunks, file.name, { type: file.type }));
+  }
+  input.files = transfer.files;
+  input.dispatchEvent(new Event('input', { bubbles: true }));
+  input.dispatchEvent(new Event('change', { bubbles: true }));
+  return { files: input.files.length };
+}
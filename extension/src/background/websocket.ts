@@ -1,7 +1,18 @@
 import type { RelayMessage, ExtensionMessage, ConnectionState } from '../shared/types';
-import { HEARTBEAT_INTERVAL, RECONNECT_DELAY_BASE, RECONNECT_DELAY_MAX, MAX_RECONNECT_ATTEMPTS } from '../shared/constants';
-import { handleRelayMessage } from './commands';
+import {
+  HEARTBEAT_INTERVAL,
+  RECONNECT_DELAY_BASE,
+  RECONNECT_DELAY_MAX,
+  MAX_RECONNECT_ATTEMPTS,
+  PROTOCOL_VERSION,
+  MIN_PROTOCOL_VERSION,
+  CAPABILITIES,
+  ACTIONS,
+} from '../shared/constants';
+import { handleRelayMessage, cancelCommand } from './commands';
 import { getAttachedTabsForRelay } from './tabs';
+import { addUploadChunk } from './upload';
+import { browserInfo, windowState, resetWindowUpdates } from './browserinfo';
 
 let socket: WebSocket | null = null;
 let heartbeatInterval: ReturnType<typeof setInterval> | null = null;
@@ -10,6 +21,9 @@ let reconnectAttempts = 0;
 let currentRelayUrl = '';
 let currentToken = '';
 
+// Page events the relay subscribed to on this connection
+let subscriptions = new Set<string>();
+
 // Connection state
 let connectionState: ConnectionState = {
   status: 'disconnected',
@@ -53,7 +67,36 @@ export function connect(relayUrl: string, token: string): void {
   doConnect();
 }
 
-function doConnect(): void {
+// The relay URL may list several comma-separated endpoints (a primary and
+// its warm standby). Pick the one whose /health reports role "primary",
+// falling back to the first endpoint if none answer.
+async function resolveRelayUrl(relayUrl: string): Promise<string> {
+  const endpoints = relayUrl.split(',').map((u) => u.trim()).filter(Boolean);
+  if (endpoints.length <= 1) {
+    return endpoints[0] || '';
+  }
+  
+  for (const endpoint of endpoints) {
+    try {
+      const healthUrl = new URL(endpoint);
+      healthUrl.protocol = healthUrl.protocol === 'wss:' ? 'https:' : 'http:';
+      healthUrl.pathname = healthUrl.pathname.replace(/\/?(ws)?$/, '/health');
+      
+      const response = await fetch(healthUrl.toString(), { signal: AbortSignal.timeout(3000) });
+      const health = await response.json() as { role?: string };
+      // Relays predating replication do not report a role
+      if (!health.role || health.role === 'primary') {
+        return endpoint;
+      }
+    } catch {
+      // Unreachable; try the next endpoint
+    }
+  }
+  
+  return endpoints[0];
+}
+
+async function doConnect(): Promise<void> {
   if (!currentRelayUrl || !currentToken) {
     connectionState = { status: 'error', error: 'Missing relay URL or token' };
     notifyStateChange();
@@ -61,11 +104,19 @@ function doConnect(): void {
   }
   
   connectionState = { status: 'connecting' };
+  subscriptions = new Set();
   notifyStateChange();
   
+  const token = currentToken;
+  const relayUrl = await resolveRelayUrl(currentRelayUrl);
+  // Disconnected or reconnected elsewhere while probing
+  if (token !== currentToken || connectionState.status !== 'connecting') {
+    return;
+  }
+  
   try {
     // Build WebSocket URL with token
-    const wsUrl = new URL(currentRelayUrl);
+    const wsUrl = new URL(relayUrl);
     // Ensure /ws path
     if (!wsUrl.pathname.endsWith('/ws')) {
       wsUrl.pathname = wsUrl.pathname.replace(/\/?$/, '/ws');
@@ -94,9 +145,6 @@ function handleOpen(): void {
   
   // Start heartbeat
   startHeartbeat();
-  
-  // Send initial tab list
-  sendAttachedTabs();
 }
 
 function handleClose(event: CloseEvent): void {
@@ -120,6 +168,9 @@ function handleError(event: Event): void {
 }
 
 function handleMessage(event: MessageEvent): void {
+  // When the message arrived, by our clock; echoed in pongs so the relay
+  // can estimate how far our clock is from its own
+  const receivedAt = Date.now();
   try {
     const message = JSON.parse(event.data) as RelayMessage;
     
@@ -131,6 +182,21 @@ function handleMessage(event: MessageEvent): void {
           lastHeartbeat: Date.now(),
         };
         notifyStateChange();
+        identify().then(sendMessage).then(sendSync);
+        sendMessage({
+          type: 'pong',
+          timestamp: message.serverTime,
+          clientTime: receivedAt,
+          tabCount: getAttachedTabsForRelay().length,
+        });
+        break;
+        
+      case 'connect_accepted':
+        console.log('[OwlRelay] Speaking protocol version', message.protocolVersion);
+        break;
+        
+      case 'sync_request':
+        sendSync();
         break;
         
       case 'connect_error':
@@ -139,16 +205,27 @@ function handleMessage(event: MessageEvent): void {
           error: message.message,
         };
         notifyStateChange();
-        // Don't reconnect on auth errors
-        if (message.code === 'INVALID_TOKEN' || message.code === 'TOKEN_EXPIRED') {
+        // Don't reconnect on auth errors, or to a relay that does not speak our protocol
+        if (message.code === 'INVALID_TOKEN' || message.code === 'TOKEN_EXPIRED' || message.code === 'UNSUPPORTED_PROTOCOL') {
           disconnect();
         }
         break;
         
+      case 'server_shutdown':
+        // The relay closes the socket next; reconnect from the first backoff step
+        console.log('[OwlRelay] Relay shutting down:', message.reason);
+        reconnectAttempts = 0;
+        break;
+        
+      case 'subscribe':
+        subscriptions = new Set(message.events);
+        break;
+        
       case 'ping':
         sendMessage({
           type: 'pong',
           timestamp: message.timestamp,
+          clientTime: receivedAt,
           tabCount: getAttachedTabsForRelay().length,
         });
         connectionState.lastHeartbeat = Date.now();
@@ -157,12 +234,52 @@ function handleMessage(event: MessageEvent): void {
       case 'command':
         handleRelayMessage(message);
         break;
+        
+      case 'upload_chunk':
+        addUploadChunk(message);
+        break;
+        
+      case 'command_cancel':
+        cancelCommand(message.id, message.reason);
+        break;
+        
+      case 'protocol_error':
+        // The relay rejected one of our messages; this is an extension bug
+        console.error('[OwlRelay] Relay rejected message:', message.messageType, message.code, message.details);
+        break;
     }
   } catch (err) {
     console.error('[OwlRelay] Failed to parse message:', err);
   }
 }
 
+// The connect message. Canary builds carry "canary" in their manifest
+// version_name, which the relay can match with CANARY_LABELS. The relay
+// answers the protocol versions with connect_accepted, or with
+// connect_error when it speaks none of them.
+async function identify(): Promise<ExtensionMessage> {
+  const manifest = chrome.runtime.getManifest();
+  const labels = /canary/i.test(manifest.version_name ?? '') ? ['canary'] : undefined;
+  const [browser, state] = await Promise.all([browserInfo(), windowState().catch(() => undefined)]);
+  resetWindowUpdates(state);
+  return {
+    type: 'connect',
+    extensionVersion: manifest.version,
+    labels,
+    ...browser,
+    window: state,
+    protocolVersion: PROTOCOL_VERSION,
+    minProtocolVersion: MIN_PROTOCOL_VERSION,
+    capabilities: CAPABILITIES,
+    actions: ACTIONS,
+  };
+}
+
+// Whether the relay wants a page event forwarded
+export function isSubscribed(event: string): boolean {
+  return isConnected() && subscriptions.has(event);
+}
+
 export function sendMessage(message: ExtensionMessage): void {
   if (socket?.readyState === WebSocket.OPEN) {
     socket.send(JSON.stringify(message));
@@ -234,17 +351,17 @@ function clearReconnectTimeout(): void {
   }
 }
 
-async function sendAttachedTabs(): Promise<void> {
-  const tabs = getAttachedTabsForRelay();
-  for (const tab of tabs) {
-    sendMessage({
-      type: 'tab_attach',
+// Send the full tab list, replacing what the relay has for this session
+function sendSync(): void {
+  sendMessage({
+    type: 'sync',
+    tabs: getAttachedTabsForRelay().map((tab) => ({
       tabId: tab.uuid,
       url: tab.url,
       title: tab.title,
       favIconUrl: tab.favIconUrl,
-    });
-  }
+    })),
+  });
 }
 
 export function isConnected(): boolean {
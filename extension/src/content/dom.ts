@@ -1,9 +1,11 @@
 // DOM utility functions for content script
+import type { SelectorEngine } from '../shared/types';
+import { queryOne } from './selector';
 
 // Find element by selector
-export function findElement(selector: string): Element | null {
+export function findElement(selector: string, engine?: SelectorEngine): Element | null {
   try {
-    return document.querySelector(selector);
+    return queryOne(selector, engine);
   } catch {
     return null;
   }
@@ -28,6 +30,17 @@ export function isElementVisible(element: Element): boolean {
   );
 }
 
+// Check that an element can take input; returns why not, or null
+export function checkActionable(element: Element): string | null {
+  if (!isElementVisible(element)) {
+    return 'not visible';
+  }
+  if ((element as HTMLButtonElement).disabled) {
+    return 'disabled';
+  }
+  return null;
+}
+
 // Get element center coordinates
 export function getElementCenter(element: Element): { x: number; y: number } {
   const rect = element.getBoundingClientRect();
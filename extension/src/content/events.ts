@@ -1,6 +1,6 @@
 // Event injection for content script
-import { findElement, getElementAtPoint, getElementCenter, isInputElement, isContentEditable, focusElement, getScrollableParent } from './dom';
-import type { ClickAction, TypeAction, ScrollAction } from '../shared/types';
+import { findElement, checkActionable, getElementAtPoint, getElementCenter, isInputElement, isContentEditable, isElementVisible, focusElement, getScrollableParent } from './dom';
+import type { ClickAction, TypeAction, PressAction, ScrollAction, ScrollToAction, ScrollToResult } from '../shared/types';
 
 // Execute click action
 export function executeClick(action: ClickAction): { success: boolean; error?: string } {
@@ -9,10 +9,16 @@ export function executeClick(action: ClickAction): { success: boolean; error?: s
   let y: number;
   
   if (action.selector) {
-    element = findElement(action.selector);
+    element = findElement(action.selector, action.selectorEngine);
     if (!element) {
       return { success: false, error: `Element not found: ${action.selector}` };
     }
+    if (action.actionability !== false) {
+      const reason = checkActionable(element);
+      if (reason) {
+        return { success: false, error: `Element is ${reason}: ${action.selector}` };
+      }
+    }
     const center = getElementCenter(element);
     x = center.x;
     y = center.y;
@@ -73,10 +79,16 @@ export function executeClick(action: ClickAction): { success: boolean; error?: s
 
 // Execute type action
 export async function executeType(action: TypeAction): Promise<{ success: boolean; error?: string }> {
-  const element = findElement(action.selector);
+  const element = findElement(action.selector, action.selectorEngine);
   if (!element) {
     return { success: false, error: `Element not found: ${action.selector}` };
   }
+  if (action.actionability !== false) {
+    const reason = checkActionable(element);
+    if (reason) {
+      return { success: false, error: `Element is ${reason}: ${action.selector}` };
+    }
+  }
   
   // Focus the element
   focusElement(element);
@@ -135,12 +147,208 @@ export async function executeType(action: TypeAction): Promise<{ success: boolea
   return { success: true };
 }
 
+// Key codes of named keys, for pages that still read keyCode
+const NAMED_KEYS: Record<string, { key: string; code: string; keyCode: number }> = {
+  Enter: { key: 'Enter', code: 'Enter', keyCode: 13 },
+  Tab: { key: 'Tab', code: 'Tab', keyCode: 9 },
+  Escape: { key: 'Escape', code: 'Escape', keyCode: 27 },
+  Backspace: { key: 'Backspace', code: 'Backspace', keyCode: 8 },
+  Delete: { key: 'Delete', code: 'Delete', keyCode: 46 },
+  Insert: { key: 'Insert', code: 'Insert', keyCode: 45 },
+  ArrowUp: { key: 'ArrowUp', code: 'ArrowUp', keyCode: 38 },
+  ArrowDown: { key: 'ArrowDown', code: 'ArrowDown', keyCode: 40 },
+  ArrowLeft: { key: 'ArrowLeft', code: 'ArrowLeft', keyCode: 37 },
+  ArrowRight: { key: 'ArrowRight', code: 'ArrowRight', keyCode: 39 },
+  Home: { key: 'Home', code: 'Home', keyCode: 36 },
+  End: { key: 'End', code: 'End', keyCode: 35 },
+  PageUp: { key: 'PageUp', code: 'PageUp', keyCode: 33 },
+  PageDown: { key: 'PageDown', code: 'PageDown', keyCode: 34 },
+  Space: { key: ' ', code: 'Space', keyCode: 32 },
+  Control: { key: 'Control', code: 'ControlLeft', keyCode: 17 },
+  Shift: { key: 'Shift', code: 'ShiftLeft', keyCode: 16 },
+  Alt: { key: 'Alt', code: 'AltLeft', keyCode: 18 },
+  Meta: { key: 'Meta', code: 'MetaLeft', keyCode: 91 },
+};
+
+function describeKey(name: string, shift: boolean): { key: string; code: string; keyCode: number } {
+  const named = NAMED_KEYS[name];
+  if (named) return named;
+  const fn = /^F([1-9]|1[0-2])$/.exec(name);
+  if (fn) return { key: name, code: name, keyCode: 111 + Number(fn[1]) };
+
+  const key = shift ? name.toUpperCase() : name;
+  const upper = name.toUpperCase();
+  if (/^[A-Z]$/.test(upper)) return { key, code: `Key${upper}`, keyCode: upper.charCodeAt(0) };
+  if (/^[0-9]$/.test(name)) return { key, code: `Digit${name}`, keyCode: name.charCodeAt(0) };
+  return { key, code: '', keyCode: 0 };
+}
+
+// Split "Control+Shift+K" into held modifiers and the key; "Control++"
+// presses the plus key
+function parseCombo(combo: string): { modifiers: string[]; key: string } {
+  if (combo === '+') return { modifiers: [], key: '+' };
+  const parts = combo.endsWith('++') ? [...combo.slice(0, -2).split('+'), '+'] : combo.split('+');
+  return { modifiers: parts.slice(0, -1), key: parts[parts.length - 1] };
+}
+
+// Execute press action: keydown for each modifier, then the key, then
+// keyup in reverse order. Synthetic key events have no default action,
+// so the usual effects of editing and navigation keys are applied here
+// unless the page cancels the keydown.
+export function executePress(action: PressAction): { success: boolean; error?: string } {
+  let target: Element;
+  if (action.selector) {
+    const element = findElement(action.selector, action.selectorEngine);
+    if (!element) {
+      return { success: false, error: `Element not found: ${action.selector}` };
+    }
+    if (action.actionability !== false) {
+      const reason = checkActionable(element);
+      if (reason) {
+        return { success: false, error: `Element is ${reason}: ${action.selector}` };
+      }
+    }
+    focusElement(element);
+    target = element;
+  } else {
+    target = document.activeElement || document.body;
+  }
+
+  const { modifiers, key } = parseCombo(action.key);
+  const flags = {
+    ctrlKey: modifiers.includes('Control') || key === 'Control',
+    shiftKey: modifiers.includes('Shift') || key === 'Shift',
+    altKey: modifiers.includes('Alt') || key === 'Alt',
+    metaKey: modifiers.includes('Meta') || key === 'Meta',
+  };
+  const init = (name: string): KeyboardEventInit => {
+    const { key, code, keyCode } = describeKey(name, flags.shiftKey);
+    return { bubbles: true, cancelable: true, composed: true, key, code, keyCode, which: keyCode, ...flags };
+  };
+
+  for (const modifier of modifiers) {
+    target.dispatchEvent(new KeyboardEvent('keydown', init(modifier)));
+  }
+
+  const keyInit = init(key);
+  const proceed = target.dispatchEvent(new KeyboardEvent('keydown', keyInit));
+  const printable = keyInit.key!.length === 1 && !flags.ctrlKey && !flags.metaKey && !flags.altKey;
+  if (proceed && (printable || key === 'Enter')) {
+    target.dispatchEvent(new KeyboardEvent('keypress', { ...keyInit, charCode: printable ? keyInit.key!.charCodeAt(0) : 13 }));
+  }
+  if (proceed) {
+    applyKeyDefault(target, key, keyInit.key!, printable, flags);
+  }
+  target.dispatchEvent(new KeyboardEvent('keyup', keyInit));
+
+  for (const modifier of [...modifiers].reverse()) {
+    target.dispatchEvent(new KeyboardEvent('keyup', init(modifier)));
+  }
+  return { success: true };
+}
+
+// The browser's own effect of a key the page let through
+function applyKeyDefault(
+  target: Element,
+  name: string,
+  key: string,
+  printable: boolean,
+  flags: { ctrlKey: boolean; shiftKey: boolean; altKey: boolean; metaKey: boolean }
+): void {
+  const editable = isInputElement(target) && !target.readOnly && !target.disabled;
+
+  if (printable && (editable || isContentEditable(target))) {
+    insertText(target, key);
+    return;
+  }
+  if ((flags.ctrlKey || flags.metaKey) && name.toLowerCase() === 'a') {
+    if (isInputElement(target)) {
+      target.select();
+    } else {
+      window.getSelection()?.selectAllChildren(isContentEditable(target) ? target : document.body);
+    }
+    return;
+  }
+
+  switch (name) {
+    case 'Enter':
+      if (target instanceof HTMLTextAreaElement || isContentEditable(target)) {
+        insertText(target, '\n');
+      } else if (target instanceof HTMLInputElement && target.form) {
+        target.form.requestSubmit();
+      } else if (target instanceof HTMLElement && (target.tagName === 'BUTTON' || target.tagName === 'A')) {
+        target.click();
+      }
+      break;
+    case 'Space':
+      if (target instanceof HTMLElement && (target.tagName === 'BUTTON' || (target instanceof HTMLInputElement && ['checkbox', 'radio'].includes(target.type)))) {
+        target.click();
+      } else if (editable || isContentEditable(target)) {
+        insertText(target, ' ');
+      }
+      break;
+    case 'Backspace':
+    case 'Delete':
+      if (editable) {
+        deleteText(target as HTMLInputElement | HTMLTextAreaElement, name === 'Backspace');
+      } else if (isContentEditable(target)) {
+        document.execCommand(name === 'Backspace' ? 'delete' : 'forwardDelete');
+      }
+      break;
+    case 'Tab':
+      moveFocus(target, flags.shiftKey ? -1 : 1);
+      break;
+  }
+}
+
+function insertText(target: Element, text: string): void {
+  if (isInputElement(target)) {
+    const start = target.selectionStart ?? target.value.length;
+    const end = target.selectionEnd ?? target.value.length;
+    target.value = target.value.slice(0, start) + text + target.value.slice(end);
+    target.selectionStart = target.selectionEnd = start + text.length;
+    target.dispatchEvent(new InputEvent('input', { bubbles: true, data: text, inputType: 'insertText' }));
+  } else {
+    document.execCommand('insertText', false, text);
+  }
+}
+
+function deleteText(target: HTMLInputElement | HTMLTextAreaElement, backward: boolean): void {
+  let start = target.selectionStart ?? target.value.length;
+  let end = target.selectionEnd ?? target.value.length;
+  if (start === end) {
+    if (backward && start > 0) start--;
+    else if (!backward && end < target.value.length) end++;
+    else return;
+  }
+  target.value = target.value.slice(0, start) + target.value.slice(end);
+  target.selectionStart = target.selectionEnd = start;
+  target.dispatchEvent(new InputEvent('input', {
+    bubbles: true,
+    inputType: backward ? 'deleteContentBackward' : 'deleteContentForward',
+  }));
+}
+
+// Focus the next or previous element in tab order
+function moveFocus(from: Element, direction: 1 | -1): void {
+  const focusable = Array.from(document.querySelectorAll<HTMLElement>(
+    'a[href], button, input, select, textarea, [tabindex], [contenteditable="true"]'
+  )).filter((el) => el.tabIndex >= 0 && !(el as HTMLButtonElement).disabled && isElementVisible(el));
+  if (focusable.length === 0) return;
+
+  const index = focusable.indexOf(from as HTMLElement);
+  const next = index === -1
+    ? focusable[direction === 1 ? 0 : focusable.length - 1]
+    : focusable[(index + direction + focusable.length) % focusable.length];
+  next.focus();
+}
+
 // Execute scroll action
 export function executeScroll(action: ScrollAction): { success: boolean; error?: string } {
   let scrollTarget: Element | Window;
   
   if (action.selector) {
-    const element = findElement(action.selector);
+    const element = findElement(action.selector, action.selectorEngine);
     if (!element) {
       return { success: false, error: `Element not found: ${action.selector}` };
     }
@@ -184,3 +392,66 @@ export function executeScroll(action: ScrollAction): { success: boolean; error?:
   
   return { success: true };
 }
+
+// Longest a smooth scroll is waited for before the offsets are read
+const SCROLL_SETTLE_TIMEOUT = 2000;
+
+// Execute scroll_to action: bring an element into view, or scroll the page
+// to a position, and report where the page ended up
+export async function executeScrollTo(action: ScrollToAction): Promise<{ success: boolean; result?: ScrollToResult; error?: string }> {
+  const behavior: ScrollBehavior = action.behavior === 'smooth' ? 'smooth' : 'instant';
+  let element: Element | null = null;
+
+  if (action.selector) {
+    element = findElement(action.selector, action.selectorEngine);
+    if (!element) {
+      return { success: false, error: `Element not found: ${action.selector}` };
+    }
+    element.scrollIntoView({ block: action.block || 'center', inline: 'nearest', behavior });
+  } else if (action.position) {
+    window.scrollTo({ left: action.position.x, top: action.position.y, behavior });
+  } else {
+    return { success: false, error: 'scroll_to needs a selector or a position' };
+  }
+
+  if (behavior === 'smooth') {
+    await scrollSettled();
+  }
+
+  const result: ScrollToResult = {
+    scrollX: Math.round(window.scrollX),
+    scrollY: Math.round(window.scrollY),
+  };
+  if (element) {
+    const rect = element.getBoundingClientRect();
+    result.inView = rect.top >= 0 && rect.left >= 0 &&
+      rect.bottom <= window.innerHeight && rect.right <= window.innerWidth;
+  }
+  return { success: true, result };
+}
+
+// Resolves once scrolling stops: no scroll event for a few frames, or
+// SCROLL_SETTLE_TIMEOUT
+function scrollSettled(): Promise<void> {
+  return new Promise((resolve) => {
+    const started = performance.now();
+    let lastX = window.scrollX;
+    let lastY = window.scrollY;
+    let still = 0;
+    const check = () => {
+      if (window.scrollX === lastX && window.scrollY === lastY) {
+        still++;
+      } else {
+        still = 0;
+        lastX = window.scrollX;
+        lastY = window.scrollY;
+      }
+      if (still >= 5 || performance.now() - started > SCROLL_SETTLE_TIMEOUT) {
+        resolve();
+        return;
+      }
+      requestAnimationFrame(check);
+    };
+    requestAnimationFrame(check);
+  });
+}
@@ -0,0 +1,195 @@
+// Form filling for content script. Every field is checked before any is
+// changed, so a form is filled entirely or not at all.
+import { findElement, checkActionable, isContentEditable, focusElement } from './dom';
+import type { FillFormAction, FormFieldResult, FormValue, SelectAction, SelectResult } from '../shared/types';
+
+interface PlannedField {
+  selector: string;
+  element: Element | null;
+  apply?: () => FormValue;
+  error?: string;
+}
+
+export function executeFillForm(action: FillFormAction): { filled: boolean; fields: FormFieldResult[] } {
+  const planned: PlannedField[] = Object.entries(action.fields).map(([selector, value]) => {
+    const element = findElement(selector, action.selectorEngine);
+    if (!element) {
+      return { selector, element, error: `Element not found: ${selector}` };
+    }
+    if (action.actionability !== false) {
+      const reason = checkActionable(element);
+      if (reason) {
+        return { selector, element, error: `Element is ${reason}: ${selector}` };
+      }
+    }
+    const apply = planField(element, value);
+    return typeof apply === 'string' ? { selector, element, error: apply } : { selector, element, apply };
+  });
+
+  // Report and fill in document order; missing elements go last
+  planned.sort((a, b) => {
+    if (!a.element || !b.element || a.element === b.element) return (a.element ? 0 : 1) - (b.element ? 0 : 1);
+    return a.element.compareDocumentPosition(b.element) & Node.DOCUMENT_POSITION_FOLLOWING ? -1 : 1;
+  });
+
+  if (planned.some((field) => field.error)) {
+    return {
+      filled: false,
+      fields: planned.map(({ selector, error }) => ({ selector, success: !error, error })),
+    };
+  }
+
+  const fields = planned.map(({ selector, element, apply }) => {
+    focusElement(element!);
+    const value = apply!();
+    element!.dispatchEvent(new Event('input', { bubbles: true }));
+    element!.dispatchEvent(new Event('change', { bubbles: true }));
+    return { selector, success: true, value };
+  });
+  return { filled: true, fields };
+}
+
+// Check that an element takes a value; returns how to set it, or why not
+function planField(element: Element, value: FormValue): (() => FormValue) | string {
+  if (element instanceof HTMLSelectElement) {
+    return planSelect(element, value);
+  }
+
+  if (element instanceof HTMLInputElement && (element.type === 'checkbox' || element.type === 'radio')) {
+    if (typeof value !== 'boolean') {
+      return `A ${element.type} takes true or false`;
+    }
+    return () => {
+      element.checked = value;
+      return element.checked;
+    };
+  }
+
+  if (element instanceof HTMLInputElement && element.type === 'file') {
+    return 'File inputs are set with POST /api/v1/upload';
+  }
+
+  if (typeof value !== 'string' && typeof value !== 'number') {
+    return 'A text field takes a string';
+  }
+  const text = String(value);
+
+  if (element instanceof HTMLInputElement || element instanceof HTMLTextAreaElement) {
+    if (element.readOnly) {
+      return 'Element is read-only';
+    }
+    return () => {
+      setNativeValue(element, text);
+      return element.value;
+    };
+  }
+  if (isContentEditable(element)) {
+    return () => {
+      (element as HTMLElement).textContent = text;
+      return text;
+    };
+  }
+  return `Not a form field: <${element.tagName.toLowerCase()}>`;
+}
+
+function planSelect(select: HTMLSelectElement, value: FormValue): (() => FormValue) | string {
+  const wanted = Array.isArray(value) ? value : typeof value === 'string' || typeof value === 'number' ? [String(value)] : null;
+  if (!wanted) {
+    return 'A select takes an option value or label';
+  }
+  if (wanted.length > 1 && !select.multiple) {
+    return 'Only a multiple select takes several options';
+  }
+
+  const options: HTMLOptionElement[] = [];
+  for (const want of wanted) {
+    const option = Array.from(select.options).find((o) => o.value === want) ??
+      Array.from(select.options).find((o) => o.label.trim() === want.trim());
+    if (!option) {
+      return `No option matches: ${want}`;
+    }
+    if (option.disabled) {
+      return `Option is disabled: ${want}`;
+    }
+    options.push(option);
+  }
+
+  return () => {
+    for (const option of Array.from(select.options)) {
+      option.selected = options.includes(option);
+    }
+    return select.multiple ? options.map((o) => o.value) : select.value;
+  };
+}
+
+// Choose one option of a <select>, by value, label, or index. Events fire
+// only when the selection changes, as when a user picks the same option.
+export function executeSelect(action: SelectAction): { success: boolean; result?: SelectResult; error?: string } {
+  const element = findElement(action.selector, action.selectorEngine);
+  if (!element) {
+    return { success: false, error: `Element not found: ${action.selector}` };
+  }
+  if (!(element instanceof HTMLSelectElement)) {
+    return { success: false, error: `Not a select: <${element.tagName.toLowerCase()}>` };
+  }
+  if (action.actionability !== false) {
+    const reason = checkActionable(element);
+    if (reason) {
+      return { success: false, error: `Element is ${reason}: ${action.selector}` };
+    }
+  }
+
+  const options = Array.from(element.options);
+  let option: HTMLOptionElement | undefined;
+  let wanted: string;
+  if (action.index !== undefined) {
+    option = options[action.index];
+    wanted = `index ${action.index}`;
+  } else if (action.label !== undefined) {
+    const label = action.label.trim();
+    option = options.find((o) => o.label.trim() === label);
+    wanted = `label ${action.label}`;
+  } else {
+    option = options.find((o) => o.value === action.value);
+    wanted = `value ${action.value}`;
+  }
+  if (!option) {
+    return { success: false, error: `No option matches ${wanted}` };
+  }
+  if (option.disabled || (option.parentElement instanceof HTMLOptGroupElement && option.parentElement.disabled)) {
+    return { success: false, error: `Option is disabled: ${wanted}` };
+  }
+
+  const changed = options.some((o) => o.selected !== (o === option));
+  if (changed) {
+    focusElement(element);
+    for (const o of options) {
+      o.selected = o === option;
+    }
+    element.dispatchEvent(new Event('input', { bubbles: true }));
+    element.dispatchEvent(new Event('change', { bubbles: true }));
+  }
+
+  return {
+    success: true,
+    result: {
+      selector: action.selector,
+      value: option.value,
+      label: option.label,
+      index: option.index,
+      changed,
+    },
+  };
+}
+
+// Set a value through the prototype's setter, which frameworks such as
+// React watch, rather than the instance property they shadow
+function setNativeValue(element: HTMLInputElement | HTMLTextAreaElement, value: string): void {
+  const proto = element instanceof HTMLTextAreaElement ? HTMLTextAreaElement.prototype : HTMLInputElement.prototype;
+  const setter = Object.getOwnPropertyDescriptor(proto, 'value')?.set;
+  if (setter) {
+    setter.call(element, value);
+  } else {
+    element.value = value;
+  }
+}
@@ -1,11 +1,48 @@
 // OwlRelay Content Script
-import type { CommandAction } from '../shared/types';
-import type { BackgroundToContentMessage, ContentToBackgroundMessage } from '../shared/messages';
-import { executeClick, executeType, executeScroll } from './events';
+import type { CommandAction, PageEventEntry } from '../shared/types';
+import type { BackgroundToContentMessage, ContentToBackgroundMessage, ContentEventMessage } from '../shared/messages';
+import { PAGE_CONSOLE_SOURCE, PAGE_BRIDGE_READY, PAGE_EVENT_NAME } from '../shared/messages';
+import { executeClick, executeType, executePress, executeScroll, executeScrollTo } from './events';
 import { captureSnapshot } from './snapshot';
+import { findElement } from './dom';
+import { executeFillForm, executeSelect } from './form';
+import { executeDoubleClick, executeHover, executeDrag } from './pointer';
+import { executeQuery } from './query';
 
 console.log('[OwlRelay] Content script loaded');
 
+// Relay console entries from the page-world hook (background/console.ts)
+// to background. The hook holds entries until it hears we are listening.
+window.addEventListener('message', (event) => {
+  if (event.source !== window || event.data?.source !== PAGE_CONSOLE_SOURCE) return;
+  if (event.data.hello) {
+    window.postMessage({ source: PAGE_BRIDGE_READY }, '*');
+
+// Relay page events from the page-world hook (background/pageevents.ts)
+// to background
+window.addEventListener(PAGE_EVENT_NAME, (event) => {
+  const detail = (event as CustomEvent).detail;
+  if (typeof detail !== 'string') return;
+  let entry: PageEventEntry;
+  try {
+    entry = JSON.parse(detail);
+  } catch {
+    return;
+  }
+  const message: ContentEventMessage = { type: 'PAGE_EVENT', event: entry };
+  chrome.runtime.sendMessage(message).catch(() => {
+    // Background is restarting; the event is lost
+  });
+});
+    return;
+  }
+  const message: ContentEventMessage = { type: 'CONSOLE_ENTRY', entry: event.data.entry };
+  chrome.runtime.sendMessage(message).catch(() => {
+    // Background is restarting; the entry is lost
+  });
+});
+window.postMessage({ source: PAGE_BRIDGE_READY }, '*');
+
 // Listen for messages from background
 chrome.runtime.onMessage.addListener((
   message: BackgroundToContentMessage,
@@ -24,12 +61,20 @@ async function handleMessage(message: BackgroundToContentMessage): Promise<Conte
     
     case 'GET_SNAPSHOT': {
       try {
-        const result = captureSnapshot(message.maxDepth, message.maxLength);
+        const result = captureSnapshot(message.maxDepth, message.maxLength, {
+          keepSpaces: message.keepSpaces,
+          interactive: message.interactive,
+          pierce: message.pierce,
+        });
         return {
           type: 'SNAPSHOT_RESULT',
           commandId: message.commandId,
           html: result.html,
           elements: result.elements,
+          elementsTruncated: result.elementsTruncated,
+          url: result.url,
+          title: result.title,
+          truncated: result.truncated,
         };
       } catch (err) {
         return {
@@ -40,6 +85,28 @@ async function handleMessage(message: BackgroundToContentMessage): Promise<Conte
       }
     }
     
+    case 'GET_CLIP': {
+      // Where the element to capture is, scrolled into view first
+      const viewport = { width: window.innerWidth, height: window.innerHeight };
+      if (!message.selector) {
+        return { type: 'CLIP_RESULT', viewport };
+      }
+      const element = findElement(message.selector, message.selectorEngine);
+      if (!element) {
+        return { type: 'CLIP_RESULT', viewport, error: `Element not found: ${message.selector}` };
+      }
+      element.scrollIntoView({ block: 'center', inline: 'center', behavior: 'instant' });
+      const rect = element.getBoundingClientRect();
+      if (rect.width === 0 || rect.height === 0) {
+        return { type: 'CLIP_RESULT', viewport, error: `Element has no size: ${message.selector}` };
+      }
+      return {
+        type: 'CLIP_RESULT',
+        viewport,
+        rect: { x: rect.left, y: rect.top, width: rect.width, height: rect.height },
+      };
+    }
+    
     case 'TAKE_SCREENSHOT': {
       // Screenshot is handled by background script via chrome.tabs.captureVisibleTab
       // This message type is here for completeness but shouldn't be called
@@ -68,6 +135,20 @@ async function executeCommand(
         };
       }
       
+      case 'doubleclick':
+      case 'hover':
+      case 'drag': {
+        const result = action.kind === 'doubleclick' ? executeDoubleClick(action)
+          : action.kind === 'hover' ? executeHover(action)
+          : await executeDrag(action);
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: result.success,
+          error: result.error,
+        };
+      }
+      
       case 'type': {
         const result = await executeType(action);
         return {
@@ -78,6 +159,36 @@ async function executeCommand(
         };
       }
       
+      case 'press': {
+        const result = executePress(action);
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: result.success,
+          error: result.error,
+        };
+      }
+      
+      case 'select': {
+        const result = executeSelect(action);
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: result.success,
+          result: result.result,
+          error: result.error,
+        };
+      }
+      
+      case 'query': {
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: true,
+          result: executeQuery(action),
+        };
+      }
+      
       case 'scroll': {
         const result = executeScroll(action);
         return {
@@ -88,6 +199,28 @@ async function executeCommand(
         };
       }
       
+      case 'scroll_to': {
+        const result = await executeScrollTo(action);
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: result.success,
+          result: result.result,
+          error: result.error,
+        };
+      }
+      
+      case 'fill_form': {
+        // Success means the fields were checked; result.filled says
+        // whether they were set
+        return {
+          type: 'COMMAND_RESULT',
+          commandId,
+          success: true,
+          result: executeFillForm(action),
+        };
+      }
+      
       case 'navigate': {
         // Navigate to URL
         window.location.href = action.url;
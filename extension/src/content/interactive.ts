@@ -0,0 +1,194 @@
+// Interactive elements of a page for snapshots: what an agent can click,
+// type into, or choose from, each with a selector that finds it again.
+import { isElementVisible } from './dom';
+import { searchRoots } from './selector';
+
+export interface InteractiveElement {
+  selector: string;
+  type: 'button' | 'link' | 'input' | 'select' | 'textarea';
+  text?: string;
+  label?: string;
+  placeholder?: string;
+  value?: string;
+  name?: string;
+  id?: string;
+  href?: string;
+  inputType?: string;
+  disabled?: boolean;
+}
+
+const MAX_ELEMENTS = 500;
+const MAX_TEXT = 100;
+
+const CANDIDATES = [
+  'a[href]', 'button', 'input:not([type="hidden"])', 'select', 'textarea', 'summary',
+  '[role="button"]', '[role="link"]', '[role="checkbox"]', '[role="radio"]', '[role="tab"]',
+  '[role="menuitem"]', '[role="option"]', '[role="switch"]', '[role="textbox"]', '[role="combobox"]',
+  '[contenteditable=""]', '[contenteditable="true"]', '[onclick]',
+].join(', ');
+
+// Attributes that usually identify an element on purpose, tried in order
+const ID_ATTRIBUTES = ['data-testid', 'data-test', 'data-test-id', 'data-qa', 'data-cy', 'name', 'aria-label', 'placeholder', 'title'];
+
+// List the visible interactive elements in document order, at most
+// MAX_ELEMENTS; returns whether some were left out. With pierce, those in
+// open shadow roots follow, each with a pierce= selector.
+export function collectInteractive(pierce = false): { elements: InteractiveElement[]; truncated: boolean } {
+  const elements: InteractiveElement[] = [];
+  const roots = pierce ? searchRoots() : [document];
+  for (const root of roots) {
+    for (const element of Array.from(root.querySelectorAll(CANDIDATES))) {
+      if (!isElementVisible(element)) continue;
+      if (elements.length === MAX_ELEMENTS) {
+        return { elements, truncated: true };
+      }
+      elements.push(describe(element));
+    }
+  }
+  return { elements, truncated: false };
+}
+
+function describe(element: Element): InteractiveElement {
+  const info: InteractiveElement = {
+    selector: uniqueSelector(element),
+    type: kindOf(element),
+    id: element.id || undefined,
+    name: element.getAttribute('name') || undefined,
+    label: labelOf(element),
+  };
+  if ((element as HTMLButtonElement).disabled || element.getAttribute('aria-disabled') === 'true') {
+    info.disabled = true;
+  }
+
+  if (element instanceof HTMLInputElement) {
+    info.inputType = element.type;
+    info.placeholder = element.placeholder || undefined;
+    if (['button', 'submit', 'reset'].includes(element.type)) {
+      info.text = element.value || undefined;
+    } else if (element.type === 'checkbox' || element.type === 'radio') {
+      info.value = element.checked ? 'checked' : 'unchecked';
+    } else if (element.type !== 'password') {
+      info.value = element.value.slice(0, MAX_TEXT) || undefined;
+    }
+  } else if (element instanceof HTMLTextAreaElement) {
+    info.placeholder = element.placeholder || undefined;
+    info.value = element.value.slice(0, MAX_TEXT) || undefined;
+  } else if (element instanceof HTMLSelectElement) {
+    info.value = element.value || undefined;
+    info.text = element.selectedOptions[0]?.label.trim().slice(0, MAX_TEXT) || undefined;
+  } else {
+    info.text = textOf(element);
+    if (element instanceof HTMLAnchorElement) {
+      info.href = element.href || undefined;
+    }
+  }
+  return info;
+}
+
+function kindOf(element: Element): InteractiveElement['type'] {
+  const role = element.getAttribute('role');
+  if (element instanceof HTMLAnchorElement || role === 'link') return 'link';
+  if (element instanceof HTMLSelectElement || role === 'combobox' || role === 'option') return 'select';
+  if (element instanceof HTMLTextAreaElement || (element as HTMLElement).isContentEditable || role === 'textbox') return 'textarea';
+  if (element instanceof HTMLInputElement && !['button', 'submit', 'reset', 'image'].includes(element.type)) return 'input';
+  return 'button';
+}
+
+function textOf(element: Element): string | undefined {
+  const text = (element instanceof HTMLElement ? element.innerText : element.textContent) ?? '';
+  return text.replace(/\s+/g, ' ').trim().slice(0, MAX_TEXT) || undefined;
+}
+
+// The accessible name, when it differs from the visible text
+function labelOf(element: Element): string | undefined {
+  let label = element.getAttribute('aria-label') ?? '';
+  const labelledBy = element.getAttribute('aria-labelledby');
+  if (!label && labelledBy) {
+    label = labelledBy.split(/\s+/).map((id) => document.getElementById(id)?.textContent ?? '').join(' ');
+  }
+  if (!label && 'labels' in element) {
+    const labels = (element as HTMLInputElement).labels;
+    if (labels?.length) {
+      label = Array.from(labels).map((l) => l.textContent ?? '').join(' ');
+    }
+  }
+  if (!label && element instanceof HTMLImageElement) {
+    label = element.alt;
+  }
+  if (!label) {
+    label = element.querySelector('img[alt]')?.getAttribute('alt') ?? '';
+  }
+  label = label.replace(/\s+/g, ' ').trim().slice(0, MAX_TEXT);
+  return label && label !== textOf(element) ? label : undefined;
+}
+
+// A selector matching only this element, preferring ones that survive
+// changes elsewhere in the page: its id, an identifying attribute, or its
+// classes, and only then its position below the nearest ancestor with an id.
+// An element in a shadow root gets a pierce= selector, unique among the
+// document and all open shadow roots.
+export function uniqueSelector(element: Element): string {
+  if (element.getRootNode() instanceof ShadowRoot) {
+    const roots = searchRoots();
+    return 'pierce=' + buildSelector(element, (selector) => {
+      try {
+        return roots.reduce((n, root) => n + root.querySelectorAll(selector).length, 0) === 1;
+      } catch {
+        return false;
+      }
+    });
+  }
+  return buildSelector(element, (selector) => {
+    try {
+      return document.querySelectorAll(selector).length === 1;
+    } catch {
+      return false;
+    }
+  });
+}
+
+function buildSelector(element: Element, isUnique: (selector: string) => boolean): string {
+  const tag = element.tagName.toLowerCase();
+
+  if (element.id && isUnique(`#${CSS.escape(element.id)}`)) {
+    return `#${CSS.escape(element.id)}`;
+  }
+
+  for (const attr of ID_ATTRIBUTES) {
+    const value = element.getAttribute(attr);
+    if (value) {
+      const selector = `${tag}[${attr}="${CSS.escape(value)}"]`;
+      if (isUnique(selector)) return selector;
+    }
+  }
+
+  const classes = Array.from(element.classList).filter((c) => !/^(js-|_)|\d{3,}|--/.test(c));
+  if (classes.length > 0) {
+    const selector = `${tag}.${classes.slice(0, 3).map((c) => CSS.escape(c)).join('.')}`;
+    if (isUnique(selector)) return selector;
+  }
+
+  if (element instanceof HTMLAnchorElement) {
+    const href = element.getAttribute('href');
+    if (href) {
+      const selector = `a[href="${CSS.escape(href)}"]`;
+      if (isUnique(selector)) return selector;
+    }
+  }
+
+  // Position from the nearest ancestor that has a unique id
+  const path: string[] = [];
+  let current: Element | null = element;
+  while (current && current !== document.documentElement) {
+    const parent: Element | null = current.parentElement;
+    if (current !== element && current.id && isUnique(`#${CSS.escape(current.id)}`)) {
+      path.unshift(`#${CSS.escape(current.id)}`);
+      break;
+    }
+    const currentTag = current.tagName.toLowerCase();
+    const sameTag = parent ? Array.from(parent.children).filter((c) => c.tagName === current!.tagName) : [current];
+    path.unshift(sameTag.length > 1 ? `${currentTag}:nth-of-type(${sameTag.indexOf(current) + 1})` : currentTag);
+    current = parent;
+  }
+  return path.join(' > ');
+}
@@ -0,0 +1,183 @@
+// Pointer actions beyond click: double-click, hover, and drag. Like click,
+// they dispatch synthetic events, so page handlers run but CSS :hover does
+// not apply.
+import { findElement, checkActionable, getElementAtPoint, getElementCenter } from './dom';
+import type { DoubleClickAction, HoverAction, DragAction, SelectorEngine } from '../shared/types';
+
+type Result = { success: boolean; error?: string };
+
+interface Point {
+  element: Element;
+  x: number;
+  y: number;
+}
+
+const DEFAULT_DRAG_STEPS = 10;
+const DEFAULT_DRAG_DELAY = 16;
+
+// Resolve a selector or coordinates to the element and viewport point to
+// act on; returns an error message if there is none
+function locate(
+  selector: string | undefined,
+  coordinates: { x: number; y: number } | undefined,
+  actionability: boolean | undefined,
+  engine: SelectorEngine | undefined,
+  what = 'selector or coordinates'
+): Point | string {
+  if (selector) {
+    const element = findElement(selector, engine);
+    if (!element) {
+      return `Element not found: ${selector}`;
+    }
+    if (actionability !== false) {
+      const reason = checkActionable(element);
+      if (reason) {
+        return `Element is ${reason}: ${selector}`;
+      }
+    }
+    element.scrollIntoView({ block: 'nearest', inline: 'nearest' });
+    const { x, y } = getElementCenter(element);
+    return { element, x, y };
+  }
+  if (coordinates) {
+    const element = getElementAtPoint(coordinates.x, coordinates.y) || document.body;
+    return { element, x: coordinates.x, y: coordinates.y };
+  }
+  return `No ${what} provided`;
+}
+
+function mouseInit(x: number, y: number, extra: MouseEventInit = {}): MouseEventInit {
+  return {
+    bubbles: true,
+    cancelable: true,
+    composed: true,
+    view: window,
+    clientX: x,
+    clientY: y,
+    screenX: x,
+    screenY: y,
+    ...extra,
+  };
+}
+
+function pointerInit(x: number, y: number, extra: PointerEventInit = {}): PointerEventInit {
+  return { ...mouseInit(x, y, extra), pointerId: 1, pointerType: 'mouse', isPrimary: true };
+}
+
+// Move the pointer onto an element, leaving the previous one
+function moveTo(target: Element, x: number, y: number, previous: Element | null, buttons: number): void {
+  if (previous !== target) {
+    if (previous) {
+      previous.dispatchEvent(new PointerEvent('pointerout', pointerInit(x, y, { buttons, relatedTarget: target })));
+      previous.dispatchEvent(new PointerEvent('pointerleave', { ...pointerInit(x, y, { buttons, relatedTarget: target }), bubbles: false }));
+      previous.dispatchEvent(new MouseEvent('mouseout', mouseInit(x, y, { buttons, relatedTarget: target })));
+      previous.dispatchEvent(new MouseEvent('mouseleave', { ...mouseInit(x, y, { buttons, relatedTarget: target }), bubbles: false }));
+    }
+    target.dispatchEvent(new PointerEvent('pointerover', pointerInit(x, y, { buttons, relatedTarget: previous })));
+    target.dispatchEvent(new PointerEvent('pointerenter', { ...pointerInit(x, y, { buttons, relatedTarget: previous }), bubbles: false }));
+    target.dispatchEvent(new MouseEvent('mouseover', mouseInit(x, y, { buttons, relatedTarget: previous })));
+    target.dispatchEvent(new MouseEvent('mouseenter', { ...mouseInit(x, y, { buttons, relatedTarget: previous }), bubbles: false }));
+  }
+  target.dispatchEvent(new PointerEvent('pointermove', pointerInit(x, y, { buttons })));
+  target.dispatchEvent(new MouseEvent('mousemove', mouseInit(x, y, { buttons })));
+}
+
+// Execute hover action: move the pointer over the element and leave it there
+export function executeHover(action: HoverAction): Result {
+  const point = locate(action.selector, action.coordinates, action.actionability, action.selectorEngine);
+  if (typeof point === 'string') {
+    return { success: false, error: point };
+  }
+  moveTo(point.element, point.x, point.y, null, 0);
+  return { success: true };
+}
+
+// Execute doubleclick action: two clicks then dblclick, as a browser sends
+export function executeDoubleClick(action: DoubleClickAction): Result {
+  const point = locate(action.selector, action.coordinates, action.actionability, action.selectorEngine);
+  if (typeof point === 'string') {
+    return { success: false, error: point };
+  }
+  const modifiers = action.modifiers || [];
+  const keys = {
+    ctrlKey: modifiers.includes('ctrl'),
+    shiftKey: modifiers.includes('shift'),
+    altKey: modifiers.includes('alt'),
+    metaKey: modifiers.includes('meta'),
+  };
+  const { element, x, y } = point;
+
+  moveTo(element, x, y, null, 0);
+  for (const detail of [1, 2]) {
+    element.dispatchEvent(new PointerEvent('pointerdown', pointerInit(x, y, { ...keys, button: 0, buttons: 1, detail })));
+    element.dispatchEvent(new MouseEvent('mousedown', mouseInit(x, y, { ...keys, button: 0, buttons: 1, detail })));
+    element.dispatchEvent(new PointerEvent('pointerup', pointerInit(x, y, { ...keys, button: 0, buttons: 0, detail })));
+    element.dispatchEvent(new MouseEvent('mouseup', mouseInit(x, y, { ...keys, button: 0, buttons: 0, detail })));
+    element.dispatchEvent(new MouseEvent('click', mouseInit(x, y, { ...keys, button: 0, buttons: 0, detail })));
+  }
+  element.dispatchEvent(new MouseEvent('dblclick', mouseInit(x, y, { ...keys, button: 0, buttons: 0, detail: 2 })));
+  return { success: true };
+}
+
+// Execute drag action: press at the start, move in steps, release at the
+// end. A draggable start element also gets HTML drag-and-drop events.
+export async function executeDrag(action: DragAction): Promise<Result> {
+  const from = locate(action.selector, action.coordinates, action.actionability, action.selectorEngine);
+  if (typeof from === 'string') {
+    return { success: false, error: from };
+  }
+  // The drop target may only appear once the drag starts, so it is not
+  // checked for actionability
+  const to = locate(action.toSelector, action.toCoordinates, false, action.selectorEngine, 'toSelector or toCoordinates');
+  if (typeof to === 'string') {
+    return { success: false, error: to };
+  }
+
+  const steps = Math.max(1, action.steps ?? DEFAULT_DRAG_STEPS);
+  const delay = action.delay ?? DEFAULT_DRAG_DELAY;
+  const source = from.element;
+  const html5 = source instanceof HTMLElement && source.draggable;
+  const dataTransfer = html5 ? new DataTransfer() : null;
+
+  moveTo(source, from.x, from.y, null, 0);
+  source.dispatchEvent(new PointerEvent('pointerdown', pointerInit(from.x, from.y, { button: 0, buttons: 1 })));
+  source.dispatchEvent(new MouseEvent('mousedown', mouseInit(from.x, from.y, { button: 0, buttons: 1 })));
+
+  const dragging = html5 && source.dispatchEvent(new DragEvent('dragstart', { ...mouseInit(from.x, from.y, { buttons: 1 }), dataTransfer }));
+  let over: Element | null = source;
+  let dropAllowed = false;
+
+  for (let i = 1; i <= steps; i++) {
+    if (delay > 0) {
+      await new Promise((resolve) => setTimeout(resolve, delay));
+    }
+    const x = from.x + ((to.x - from.x) * i) / steps;
+    const y = from.y + ((to.y - from.y) * i) / steps;
+    // The last move lands on the target element even if something covers it
+    const target = i === steps ? to.element : getElementAtPoint(x, y) || document.body;
+
+    if (dragging) {
+      if (target !== over) {
+        over?.dispatchEvent(new DragEvent('dragleave', { ...mouseInit(x, y, { buttons: 1 }), dataTransfer }));
+        target.dispatchEvent(new DragEvent('dragenter', { ...mouseInit(x, y, { buttons: 1 }), dataTransfer }));
+      }
+      source.dispatchEvent(new DragEvent('drag', { ...mouseInit(x, y, { buttons: 1 }), dataTransfer }));
+      // A cancelled dragover is how a drop target accepts the drop
+      dropAllowed = !target.dispatchEvent(new DragEvent('dragover', { ...mouseInit(x, y, { buttons: 1 }), dataTransfer }));
+    } else {
+      moveTo(target, x, y, over, 1);
+    }
+    over = target;
+  }
+
+  const end = to.element;
+  if (dragging) {
+    if (dropAllowed) {
+      end.dispatchEvent(new DragEvent('drop', { ...mouseInit(to.x, to.y), dataTransfer }));
+    }
+    source.dispatchEvent(new DragEvent('dragend', { ...mouseInit(to.x, to.y), dataTransfer }));
+  }
+  end.dispatchEvent(new PointerEvent('pointerup', pointerInit(to.x, to.y, { button: 0, buttons: 0 })));
+  end.dispatchEvent(new MouseEvent('mouseup', mouseInit(to.x, to.y, { button: 0, buttons: 0 })));
+  return { success: true };
+}
@@ -0,0 +1,40 @@
+// Element queries: a short description of each element matching a
+// selector or XPath expression, for agents that need a few facts about the
+// page without a full snapshot.
+import { isElementVisible } from './dom';
+import { queryAll, evaluateXPath } from './selector';
+import type { QueryAction, QueryElement } from '../shared/types';
+
+const DEFAULT_LIMIT = 50;
+const MAX_TEXT = 500;
+
+export function executeQuery(action: QueryAction): { count: number; elements: QueryElement[] } {
+  const matches = action.xpath ? evaluateXPath(action.xpath) : queryAll(action.selector ?? '', action.selectorEngine);
+  const limit = action.limit || DEFAULT_LIMIT;
+  return {
+    count: matches.length,
+    elements: matches.slice(0, limit).map(describe),
+  };
+}
+
+function describe(element: Element): QueryElement {
+  const attributes: Record<string, string> = {};
+  for (const attr of Array.from(element.attributes)) {
+    attributes[attr.name] = attr.value;
+  }
+  const raw = element instanceof HTMLElement ? element.innerText : element.textContent ?? '';
+  const text = raw.replace(/\s+/g, ' ').trim().slice(0, MAX_TEXT);
+  const rect = element.getBoundingClientRect();
+  return {
+    tag: element.tagName.toLowerCase(),
+    text: text || undefined,
+    attributes,
+    visible: isElementVisible(element),
+    rect: {
+      x: Math.round(rect.left),
+      y: Math.round(rect.top),
+      width: Math.round(rect.width),
+      height: Math.round(rect.height),
+    },
+  };
+}
@@ -0,0 +1,136 @@
+// Selector engines. A selector is CSS unless the action names another
+// engine, or the selector starts with one as in "text=Sign in":
+//   css     document.querySelectorAll
+//   xpath   an XPath expression; only the elements it selects
+//   text    elements whose visible text contains the string, ignoring case
+//           and repeated spaces; "text=\"Sign in\"" matches the whole text.
+//           Only the innermost such elements count, and open shadow roots
+//           are searched too.
+//   pierce  CSS matched in the document and every open shadow root below it
+import type { SelectorEngine } from '../shared/types';
+
+const ENGINES: SelectorEngine[] = ['css', 'xpath', 'text', 'pierce'];
+const PREFIX = /^(css|xpath|text|pierce)=/;
+
+// Elements text= never matches: their text is not what the page shows
+const SKIP_TEXT = new Set(['SCRIPT', 'STYLE', 'NOSCRIPT', 'TEMPLATE', 'HEAD']);
+
+// The engine and expression of a selector
+export function parseSelector(selector: string, engine?: SelectorEngine): { engine: SelectorEngine; expression: string } {
+  const prefix = PREFIX.exec(selector);
+  if (prefix) {
+    return { engine: prefix[1] as SelectorEngine, expression: selector.slice(prefix[0].length) };
+  }
+  if (engine && !ENGINES.includes(engine)) {
+    throw new Error(`Unknown selector engine: ${engine}`);
+  }
+  return { engine: engine ?? 'css', expression: selector };
+}
+
+// Every element a selector matches, in document order; throws when the
+// selector is invalid
+export function queryAll(selector: string, engine?: SelectorEngine): Element[] {
+  const parsed = parseSelector(selector, engine);
+  switch (parsed.engine) {
+    case 'xpath':
+      return evaluateXPath(parsed.expression);
+    case 'text':
+      return matchText(parsed.expression);
+    case 'pierce':
+      return pierce(parsed.expression);
+    default:
+      try {
+        return Array.from(document.querySelectorAll(parsed.expression));
+      } catch {
+        throw new Error(`Invalid selector: ${selector}`);
+      }
+  }
+}
+
+// The first element a selector matches; throws when it is invalid
+export function queryOne(selector: string, engine?: SelectorEngine): Element | null {
+  const parsed = parseSelector(selector, engine);
+  if (parsed.engine === 'css') {
+    try {
+      return document.querySelector(parsed.expression);
+    } catch {
+      throw new Error(`Invalid selector: ${selector}`);
+    }
+  }
+  return queryAll(selector, engine)[0] ?? null;
+}
+
+// Elements an XPath expression selects, in document order; other nodes it
+// selects, such as text or attributes, are skipped
+export function evaluateXPath(expression: string): Element[] {
+  let snapshot: XPathResult;
+  try {
+    snapshot = document.evaluate(expression, document, null, XPathResult.ORDERED_NODE_SNAPSHOT_TYPE, null);
+  } catch {
+    throw new Error(`Invalid XPath: ${expression}`);
+  }
+  const elements: Element[] = [];
+  for (let i = 0; i < snapshot.snapshotLength; i++) {
+    const node = snapshot.snapshotItem(i);
+    if (node instanceof Element) {
+      elements.push(node);
+    }
+  }
+  return elements;
+}
+
+// The document and every open shadow root below it, outermost first
+export function searchRoots(): (Document | ShadowRoot)[] {
+  const roots: (Document | ShadowRoot)[] = [document];
+  for (let i = 0; i < roots.length; i++) {
+    const walker = document.createTreeWalker(roots[i], NodeFilter.SHOW_ELEMENT);
+    for (let node = walker.nextNode(); node; node = walker.nextNode()) {
+      const shadow = (node as Element).shadowRoot;
+      if (shadow) roots.push(shadow);
+    }
+  }
+  return roots;
+}
+
+function pierce(selector: string): Element[] {
+  const matches: Element[] = [];
+  try {
+    for (const root of searchRoots()) {
+      matches.push(...Array.from(root.querySelectorAll(selector)));
+    }
+  } catch {
+    throw new Error(`Invalid selector: pierce=${selector}`);
+  }
+  return matches;
+}
+
+const normalize = (text: string) => text.replace(/\s+/g, ' ').trim().toLowerCase();
+
+function matchText(expression: string): Element[] {
+  const exact = expression.length >= 2 && expression.startsWith('"') && expression.endsWith('"');
+  const wanted = normalize(exact ? expression.slice(1, -1) : expression);
+  if (!wanted) {
+    throw new Error('text= needs some text to match');
+  }
+  const matches = (element: Element) => {
+    if (SKIP_TEXT.has(element.tagName)) return false;
+    // textContent is cheap and holds the visible text, except a shadow
+    // root's
+    if (!element.shadowRoot && !normalize(element.textContent ?? '').includes(wanted)) return false;
+    const text = normalize((element instanceof HTMLElement ? element.innerText : element.textContent) ?? '');
+    return exact ? text === wanted : text.includes(wanted);
+  };
+
+  const found: Element[] = [];
+  for (const root of searchRoots()) {
+    for (const element of Array.from(root.querySelectorAll('*'))) {
+      if (!matches(element)) continue;
+      // Keep the innermost match: skip an element a child of it also
+      // matches, as the child is what shows the text
+      const children = Array.from(element.children).concat(Array.from(element.shadowRoot?.children ?? []));
+      if (children.some(matches)) continue;
+      found.push(element);
+    }
+  }
+  return found;
+}
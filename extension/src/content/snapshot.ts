@@ -1,26 +1,29 @@
 // DOM snapshot for content script
-
-interface InteractiveElement {
-  selector: string;
-  type: 'button' | 'link' | 'input' | 'select' | 'textarea';
-  text?: string;
-  placeholder?: string;
-  value?: string;
-  name?: string;
-  id?: string;
-}
+import { collectInteractive, type InteractiveElement } from './interactive';
 
 interface SnapshotResult {
   html: string;
-  elements: InteractiveElement[];
+  elements?: InteractiveElement[];
+  elementsTruncated?: boolean;
   url: string;
   title: string;
   truncated: boolean;
 }
 
-// Generate a simplified DOM snapshot
-export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResult {
-  const elements: InteractiveElement[] = [];
+export interface SnapshotOptions {
+  keepSpaces?: boolean;
+  interactive?: boolean;
+  pierce?: boolean;
+}
+
+// Generate a simplified DOM snapshot. With keepSpaces, runs of whitespace
+// in text collapse to one space instead of being trimmed away, so words in
+// neighboring inline elements stay apart. With interactive, the page's
+// interactive elements are listed too, wherever they are in the page. With
+// pierce, open shadow roots are included, as declarative shadow DOM
+// templates, and so are the interactive elements inside them.
+export function captureSnapshot(maxDepth = 10, maxLength = 100000, options: SnapshotOptions = {}): SnapshotResult {
+  const { keepSpaces = false, interactive = false, pierce = false } = options;
   let truncated = false;
   
   // Serialize the DOM
@@ -30,6 +33,10 @@ export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResu
     }
     
     if (node.nodeType === Node.TEXT_NODE) {
+      if (keepSpaces) {
+        const text = node.textContent || '';
+        return escapeHtml(node.parentElement?.closest('pre') ? text : text.replace(/\s+/g, ' '));
+      }
       const text = node.textContent?.trim() || '';
       return text ? escapeHtml(text) : '';
     }
@@ -62,12 +69,6 @@ export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResu
       }
     }
     
-    // Track interactive elements
-    const interactive = getInteractiveInfo(element);
-    if (interactive) {
-      elements.push(interactive);
-    }
-    
     // Self-closing tags
     const selfClosing = ['img', 'br', 'hr', 'input', 'meta', 'link'];
     if (selfClosing.includes(tagName)) {
@@ -76,6 +77,13 @@ export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResu
     
     // Serialize children
     const children: string[] = [];
+    if (pierce && element.shadowRoot) {
+      const shadow: string[] = [];
+      for (const child of element.shadowRoot.childNodes) {
+        shadow.push(serializeNode(child, depth + 1));
+      }
+      children.push(`<template shadowrootmode="open">${shadow.filter(c => c).join('')}</template>`);
+    }
     for (const child of element.childNodes) {
       children.push(serializeNode(child, depth + 1));
     }
@@ -85,128 +93,6 @@ export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResu
     return `<${tagName}${attrs.length ? ' ' + attrs.join(' ') : ''}>${childContent}</${tagName}>`;
   }
   
-  // Get info about interactive elements
-  function getInteractiveInfo(element: Element): InteractiveElement | null {
-    const tagName = element.tagName.toLowerCase();
-    const selector = generateSelector(element);
-    
-    if (tagName === 'button' || (element as HTMLButtonElement).type === 'button' || (element as HTMLButtonElement).type === 'submit') {
-      return {
-        selector,
-        type: 'button',
-        text: element.textContent?.trim().slice(0, 100),
-        name: element.getAttribute('name') || undefined,
-        id: element.id || undefined,
-      };
-    }
-    
-    if (tagName === 'a') {
-      return {
-        selector,
-        type: 'link',
-        text: element.textContent?.trim().slice(0, 100),
-        id: element.id || undefined,
-      };
-    }
-    
-    if (tagName === 'input') {
-      const input = element as HTMLInputElement;
-      if (['button', 'submit', 'reset'].includes(input.type)) {
-        return {
-          selector,
-          type: 'button',
-          text: input.value || undefined,
-          name: input.name || undefined,
-          id: input.id || undefined,
-        };
-      }
-      return {
-        selector,
-        type: 'input',
-        placeholder: input.placeholder || undefined,
-        value: input.type !== 'password' ? input.value : undefined,
-        name: input.name || undefined,
-        id: input.id || undefined,
-      };
-    }
-    
-    if (tagName === 'textarea') {
-      const textarea = element as HTMLTextAreaElement;
-      return {
-        selector,
-        type: 'textarea',
-        placeholder: textarea.placeholder || undefined,
-        value: textarea.value?.slice(0, 100),
-        name: textarea.name || undefined,
-        id: textarea.id || undefined,
-      };
-    }
-    
-    if (tagName === 'select') {
-      const select = element as HTMLSelectElement;
-      return {
-        selector,
-        type: 'select',
-        value: select.value,
-        name: select.name || undefined,
-        id: select.id || undefined,
-      };
-    }
-    
-    // Check for clickable role
-    const role = element.getAttribute('role');
-    if (role === 'button' || role === 'link') {
-      return {
-        selector,
-        type: role as 'button' | 'link',
-        text: element.textContent?.trim().slice(0, 100),
-        id: element.id || undefined,
-      };
-    }
-    
-    return null;
-  }
-  
-  // Generate a unique selector for an element
-  function generateSelector(element: Element): string {
-    if (element.id) {
-      return `#${element.id}`;
-    }
-    
-    const tagName = element.tagName.toLowerCase();
-    
-    // Try unique class combination
-    if (element.className && typeof element.className === 'string') {
-      const classes = element.className.split(/\s+/).filter(c => c && !c.match(/^(js-|_)/));
-      if (classes.length > 0) {
-        const selector = `${tagName}.${classes.slice(0, 2).join('.')}`;
-        if (document.querySelectorAll(selector).length === 1) {
-          return selector;
-        }
-      }
-    }
-    
-    // Try with attributes
-    const name = element.getAttribute('name');
-    if (name) {
-      const selector = `${tagName}[name="${name}"]`;
-      if (document.querySelectorAll(selector).length === 1) {
-        return selector;
-      }
-    }
-    
-    // Fall back to nth-child
-    const parent = element.parentElement;
-    if (parent) {
-      const siblings = Array.from(parent.children).filter(c => c.tagName === element.tagName);
-      const index = siblings.indexOf(element) + 1;
-      const parentSelector = parent.tagName.toLowerCase();
-      return `${parentSelector} > ${tagName}:nth-child(${index})`;
-    }
-    
-    return tagName;
-  }
-  
   // Start serialization
   let html = serializeNode(document.body, 0);
   
@@ -216,9 +102,12 @@ export function captureSnapshot(maxDepth = 10, maxLength = 100000): SnapshotResu
     truncated = true;
   }
   
+  const listed = interactive ? collectInteractive(pierce) : undefined;
+  
   return {
     html,
-    elements,
+    elements: listed?.elements,
+    elementsTruncated: listed?.truncated,
     url: window.location.href,
     title: document.title,
     truncated,
@@ -38,9 +38,10 @@ export function ServerConfig({ connected, loading, onConnect, onDisconnect }: Se
         </label>
         <input
           id="relay-url"
-          type="url"
+          type="text"
           className="form-input"
           placeholder="ws://localhost:3000"
+          title="Separate a primary and standby with a comma"
           value={relayUrl}
           onChange={(e) => setRelayUrl((e.target as HTMLInputElement).value)}
           disabled={connected || loading}
@@ -1,3 +1,5 @@
+import type { CommandAction } from './types';
+
 // Default relay URL (localhost for development)
 export const DEFAULT_RELAY_URL = 'ws://localhost:3000';
 
@@ -12,6 +14,57 @@ export const MAX_RECONNECT_ATTEMPTS = 10;
 // Command timeout
 export const DEFAULT_COMMAND_TIMEOUT = 10_000;
 
+// Relay protocol versions this build speaks, and the optional features it
+// supports: forwarding downloads as download and download_chunk messages
+export const PROTOCOL_VERSION = 2;
+export const MIN_PROTOCOL_VERSION = 1;
+export const CAPABILITIES = ['downloads'];
+
+// Command kinds this build runs, sent as actions so the relay fails any
+// other kind at once instead of letting it time out. Keyed by kind so a
+// new action cannot be left out.
+const ACTION_KINDS: Record<CommandAction['kind'], true> = {
+  click: true,
+  doubleclick: true,
+  hover: true,
+  drag: true,
+  type: true,
+  press: true,
+  select: true,
+  query: true,
+  scroll: true,
+  scroll_to: true,
+  evaluate: true,
+  screenshot: true,
+  snapshot: true,
+  navigate: true,
+  tab_create: true,
+  tab_close: true,
+  cookies_get: true,
+  cookies_set: true,
+  cookies_clear: true,
+  storage_get: true,
+  storage_set: true,
+  storage_remove: true,
+  upload: true,
+  fill_form: true,
+  emulation_get: true,
+  emulation_set: true,
+  emulation_clear: true,
+  set_viewport: true,
+  set_network_conditions: true,
+  request_rules_get: true,
+  request_rules_set: true,
+  request_rules_clear: true,
+  headers_get: true,
+  headers_set: true,
+  headers_clear: true,
+  credentials_get: true,
+  credentials_set: true,
+  credentials_clear: true,
+};
+export const ACTIONS = Object.keys(ACTION_KINDS);
+
 // Banking and sensitive sites blacklist
 export const BLACKLISTED_PATTERNS = [
   // Banking - US
@@ -1,4 +1,4 @@
-import type { ConnectionState, AttachedTab, CommandAction } from './types';
+import type { ConnectionState, AttachedTab, CommandAction, PageConsoleEntry, PageEventEntry, Rect, SelectorEngine } from './types';
 
 // ===== Background ↔ Popup Messages =====
 
@@ -24,12 +24,28 @@ export type BackgroundToPopupResponse =
 export type BackgroundToContentMessage =
   | { type: 'EXECUTE_COMMAND'; commandId: string; action: CommandAction }
   | { type: 'TAKE_SCREENSHOT'; commandId: string }
-  | { type: 'GET_SNAPSHOT'; commandId: string; maxDepth?: number; maxLength?: number };
+  | { type: 'GET_SNAPSHOT'; commandId: string; maxDepth?: number; maxLength?: number; keepSpaces?: boolean; interactive?: boolean; pierce?: boolean }
+  | { type: 'GET_CLIP'; selector?: string; selectorEngine?: SelectorEngine };
 
 export type ContentToBackgroundMessage =
   | { type: 'COMMAND_RESULT'; commandId: string; success: boolean; result?: unknown; error?: string }
   | { type: 'SCREENSHOT_RESULT'; commandId: string; dataUrl?: string; error?: string }
-  | { type: 'SNAPSHOT_RESULT'; commandId: string; html?: string; elements?: unknown[]; error?: string };
+  | { type: 'CLIP_RESULT'; rect?: Rect; viewport: { width: number; height: number }; error?: string }
+  | { type: 'SNAPSHOT_RESULT'; commandId: string; html?: string; elements?: unknown[]; elementsTruncated?: boolean; url?: string; title?: string; truncated?: boolean; error?: string };
+
+// Events content scripts report on their own
+export type ContentEventMessage =
+  | { type: 'CONSOLE_ENTRY'; entry: PageConsoleEntry }
+  | { type: 'PAGE_EVENT'; event: PageEventEntry };
+
+// ===== Page (main world) ↔ Content Script Messages =====
+
+// window.postMessage tag of console entries from the page-world hook
+export const PAGE_CONSOLE_SOURCE = 'owlrelay-console';
+// window.postMessage tag telling the hook the content script is listening
+export const PAGE_BRIDGE_READY = 'owlrelay-bridge-ready';
+// DOM event name of page events from the page-world hook
+export const PAGE_EVENT_NAME = 'owlrelay-page-event';
 
 // Helper to send message from popup to background
 export function sendToBackground<T extends PopupToBackgroundMessage>(
@@ -7,12 +7,54 @@ export interface ConnectAck {
   serverVersion: string;
 }
 
+// Identifies the extension to the relay
+export interface ExtensionConnect {
+  type: 'connect';
+  extensionVersion?: string;
+  browser?: string; // e.g. 'Chrome'
+  browserVersion?: string;
+  os?: string; // e.g. 'macOS'
+  labels?: string[]; // rollout labels, e.g. 'canary'
+  window?: WindowState;
+  protocolVersion?: number; // highest version spoken
+  minProtocolVersion?: number;
+  capabilities?: string[];
+  actions?: string[]; // command kinds this build runs
+}
+
+// The relay's answer to a connect carrying protocolVersion
+export interface ConnectAccepted {
+  type: 'connect_accepted';
+  protocolVersion: number;
+  encoding?: string;
+}
+
+// The browser window the extension sees focused
+export interface WindowState {
+  width: number;
+  height: number;
+  state: 'normal' | 'minimized' | 'maximized' | 'fullscreen';
+  focused: boolean; // the browser is the active application
+  windows: number; // normal windows open
+}
+
+// Sent when the focused window's size, state, or focus changes
+export interface WindowUpdate {
+  type: 'window_update';
+  window: WindowState;
+}
+
 export interface ConnectError {
   type: 'connect_error';
-  code: 'INVALID_TOKEN' | 'TOKEN_EXPIRED' | 'RATE_LIMITED' | 'SERVER_ERROR';
+  code: 'INVALID_TOKEN' | 'TOKEN_EXPIRED' | 'RATE_LIMITED' | 'SERVER_ERROR' | 'UNSUPPORTED_PROTOCOL';
   message: string;
 }
 
+export interface ServerShutdown {
+  type: 'server_shutdown';
+  reason: string;
+}
+
 export interface TabAttach {
   type: 'tab_attach';
   tabId: string;
@@ -33,6 +75,81 @@ export interface TabUpdate {
   title?: string;
 }
 
+// The full list of attached tabs; tabs missing from it are removed
+export interface Sync {
+  type: 'sync';
+  tabs: {
+    tabId: string;
+    url: string;
+    title?: string;
+    favIconUrl?: string;
+  }[];
+}
+
+// The relay asks for a Sync
+export interface SyncRequest {
+  type: 'sync_request';
+}
+
+// Page events the relay asks to be forwarded
+export interface Subscribe {
+  type: 'subscribe';
+  events: ('console' | 'downloads' | 'page_events')[];
+}
+
+export type ConsoleLevel = 'debug' | 'log' | 'info' | 'warn' | 'error';
+
+// A console call or uncaught error, as captured in the page
+export interface PageConsoleEntry {
+  level: ConsoleLevel;
+  source: 'console' | 'exception' | 'rejection';
+  message: string;
+  url?: string;
+  line?: number;
+  column?: number;
+  stack?: string;
+  timestamp: number;
+}
+
+export interface ConsoleEvent extends PageConsoleEntry {
+  type: 'console';
+  tabId: string;
+}
+
+// Something clients may be waiting for, as seen in the page
+export interface PageEventEntry {
+  event: 'navigation_completed' | 'dialog_opened' | 'dom_mutated';
+  url?: string;
+  title?: string;
+  dialog?: { type: 'alert' | 'confirm' | 'prompt'; message: string };
+  mutations?: number;
+  timestamp: number;
+}
+
+export interface PageEvent extends PageEventEntry {
+  type: 'page_event';
+  tabId: string;
+}
+
+export interface DownloadEvent {
+  type: 'download';
+  id: string;
+  tabId: string;
+  filename: string;
+  mimeType?: string;
+  url?: string;
+  size: number;
+  total: number; // download_chunk messages that follow
+  error?: string;
+}
+
+export interface DownloadChunk {
+  type: 'download_chunk';
+  id: string;
+  seq: number;
+  data: string; // base64
+}
+
 export interface Ping {
   type: 'ping';
   timestamp: number;
@@ -40,18 +157,54 @@ export interface Ping {
 
 export interface Pong {
   type: 'pong';
-  timestamp: number;
+  timestamp: number; // the relay's time when answering it, else our own
+  clientTime?: number; // when the ping or connect_ack arrived
   tabCount: number;
 }
 
 // ===== Command Types =====
 
+// How the selectors of an action are matched; a selector may also start
+// with its engine, as in "text=Sign in". See content/selector.ts.
+export type SelectorEngine = 'css' | 'xpath' | 'text' | 'pierce';
+
 export interface ClickAction {
   kind: 'click';
   selector?: string;
   coordinates?: { x: number; y: number };
   button?: 'left' | 'right' | 'middle';
   modifiers?: ('ctrl' | 'shift' | 'alt' | 'meta')[];
+  actionability?: boolean; // false skips the visible/enabled check
+  selectorEngine?: SelectorEngine;
+}
+
+export interface DoubleClickAction {
+  kind: 'doubleclick';
+  selector?: string;
+  coordinates?: { x: number; y: number };
+  modifiers?: ('ctrl' | 'shift' | 'alt' | 'meta')[];
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
+}
+
+export interface HoverAction {
+  kind: 'hover';
+  selector?: string;
+  coordinates?: { x: number; y: number };
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
+}
+
+export interface DragAction {
+  kind: 'drag';
+  selector?: string; // where the drag starts
+  coordinates?: { x: number; y: number };
+  toSelector?: string; // where it ends
+  toCoordinates?: { x: number; y: number };
+  steps?: number; // pointer moves between the two
+  delay?: number; // ms between moves
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
 }
 
 export interface TypeAction {
@@ -60,6 +213,52 @@ export interface TypeAction {
   text: string;
   clear?: boolean;
   delay?: number;
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
+}
+
+// Describes the elements matching selector or xpath (exactly one is set)
+export interface QueryAction {
+  kind: 'query';
+  selector?: string;
+  xpath?: string;
+  limit?: number; // elements to describe
+  selectorEngine?: SelectorEngine;
+}
+
+export interface QueryElement {
+  tag: string;
+  text?: string;
+  attributes: Record<string, string>;
+  visible: boolean;
+  rect: { x: number; y: number; width: number; height: number }; // viewport CSS pixels
+}
+
+// Chooses one option; exactly one of value, label, and index is set
+export interface SelectAction {
+  kind: 'select';
+  selector: string;
+  value?: string;
+  label?: string; // the option's visible text
+  index?: number;
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
+}
+
+export interface SelectResult {
+  selector: string;
+  value: string;
+  label: string;
+  index: number;
+  changed: boolean; // false when it was already chosen
+}
+
+export interface PressAction {
+  kind: 'press';
+  key: string; // "Enter", "a", or a combination such as "Control+A"
+  selector?: string; // defaults to the focused element
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
 }
 
 export interface ScrollAction {
@@ -67,20 +266,72 @@ export interface ScrollAction {
   selector?: string;
   direction: 'up' | 'down' | 'left' | 'right';
   amount: number;
+  selectorEngine?: SelectorEngine;
+}
+
+// Scrolls an element into view or the page to a position; exactly one of
+// selector and position is set
+export interface ScrollToAction {
+  kind: 'scroll_to';
+  selector?: string;
+  position?: { x: number; y: number }; // page CSS pixels
+  behavior?: 'instant' | 'smooth';
+  block?: ScrollLogicalPosition; // with selector; defaults to "center"
+  selectorEngine?: SelectorEngine;
+}
+
+export interface ScrollToResult {
+  scrollX: number;
+  scrollY: number;
+  inView?: boolean; // with selector: the element is entirely in the viewport
+}
+
+// CSS pixels relative to the viewport
+export interface Rect {
+  x: number;
+  y: number;
+  width: number;
+  height: number;
+}
+
+// Runs script as the body of a function in the page's own context, with
+// args as its args parameter
+export interface EvaluateAction {
+  kind: 'evaluate';
+  script: string;
+  args?: unknown[];
+  awaitPromise?: boolean; // default true
+  returnByValue?: boolean; // default true; false only describes the value
+  maxDepth?: number; // levels of objects serialized
+}
+
+export interface EvaluateResult {
+  value?: unknown;
+  type: string; // typeof the value
+  className?: string;
+  description?: string;
 }
 
 export interface ScreenshotAction {
   kind: 'screenshot';
   fullPage?: boolean;
-  clip?: { x: number; y: number; width: number; height: number };
+  selector?: string; // capture just this element
+  clip?: Rect; // or this part of the viewport
   quality?: number;
+  // A burst: captures to take, interval ms apart
+  count?: number;
+  interval?: number;
+  selectorEngine?: SelectorEngine;
 }
 
 export interface SnapshotAction {
   kind: 'snapshot';
   maxDepth?: number;
   maxLength?: number;
+  format?: 'html' | 'simplified' | 'markdown'; // the relay converts markdown from html
+  interactive?: boolean; // also list the page's interactive elements
   includeStyles?: boolean;
+  selectorEngine?: SelectorEngine;
 }
 
 export interface NavigateAction {
@@ -89,25 +340,296 @@ export interface NavigateAction {
   waitUntil?: 'load' | 'domcontentloaded' | 'networkidle';
 }
 
+export interface TabCreateAction {
+  kind: 'tab_create';
+  url?: string;
+  background?: boolean;
+}
+
+export interface TabCloseAction {
+  kind: 'tab_close';
+}
+
+export interface Cookie {
+  name: string;
+  value: string;
+  domain?: string;
+  path?: string;
+  secure?: boolean;
+  httpOnly?: boolean;
+  sameSite?: 'strict' | 'lax' | 'none';
+  expires?: number; // unix seconds; omitted for session cookies
+}
+
+export interface CookiesGetAction {
+  kind: 'cookies_get';
+  name?: string;
+}
+
+export interface CookiesSetAction {
+  kind: 'cookies_set';
+  cookies: Cookie[];
+}
+
+export interface CookiesClearAction {
+  kind: 'cookies_clear';
+  name?: string;
+}
+
+export interface StorageGetAction {
+  kind: 'storage_get';
+  area: 'local' | 'session';
+  keys?: string[]; // all keys when omitted
+  maxLength?: number; // bytes of keys and values to return
+}
+
+export interface StorageSetAction {
+  kind: 'storage_set';
+  area: 'local' | 'session';
+  items: Record<string, string>;
+}
+
+export interface StorageRemoveAction {
+  kind: 'storage_remove';
+  area: 'local' | 'session';
+  keys?: string[]; // clears the area when omitted
+}
+
+// What a tab reports about where and in which language its user is; each
+// field left out is not emulated
+export interface Emulation {
+  geolocation?: { latitude: number; longitude: number; accuracy?: number }; // accuracy in meters
+  timezone?: string; // IANA time zone, e.g. "Europe/Istanbul"
+  locale?: string; // BCP 47 language tag, e.g. "tr-TR"
+  acceptLanguage?: string; // Accept-Language header; derived from locale when omitted
+}
+
+export interface EmulationGetAction {
+  kind: 'emulation_get';
+}
+
+// Replaces what the tab emulates
+export interface EmulationSetAction {
+  kind: 'emulation_set';
+  emulation: Emulation;
+}
+
+export interface EmulationClearAction {
+  kind: 'emulation_clear';
+}
+
+// The screen a tab lays its pages out for, as a device would report it
+export interface Viewport {
+  width: number; // CSS pixels
+  height: number;
+  deviceScaleFactor?: number; // the display's own when omitted
+  mobile?: boolean; // mobile layout and touch input
+  userAgent?: string;
+}
+
+// Restores the browser window's own viewport when viewport is omitted
+export interface SetViewportAction {
+  kind: 'set_viewport';
+  viewport?: Viewport;
+}
+
+// The connection a tab's requests get; presets are filled in by the relay
+export interface NetworkConditions {
+  preset?: string;
+  offline?: boolean;
+  latency?: number; // ms added to each request
+  downloadThroughput?: number; // bytes/s; unlimited when omitted
+  uploadThroughput?: number;
+}
+
+// Restores the real connection when networkConditions is omitted
+export interface SetNetworkConditionsAction {
+  kind: 'set_network_conditions';
+  networkConditions?: NetworkConditions;
+}
+
+// Blocks, allows, or redirects the requests of a tab; see the relay's
+// models.RequestRule
+export interface RequestRule {
+  action: 'block' | 'allow' | 'redirect';
+  urlFilter?: string;
+  regexFilter?: string;
+  domains?: string[];
+  resourceTypes?: string[];
+  redirectUrl?: string;
+  regexSubstitution?: string;
+}
+
+export interface RequestRules {
+  ruleSet?: string; // the stored rule set they came from
+  rules: RequestRule[];
+}
+
+export interface RequestRulesGetAction {
+  kind: 'request_rules_get';
+}
+
+// Replaces the tab's rules
+export interface RequestRulesSetAction {
+  kind: 'request_rules_set';
+  requestRules: RequestRules;
+}
+
+export interface RequestRulesClearAction {
+  kind: 'request_rules_clear';
+}
+
+// Headers added to a tab's outgoing requests; see the relay's
+// models.ExtraHeaders
+export interface ExtraHeaders {
+  headers: Record<string, string>;
+  domains?: string[]; // request hosts, subdomains included
+}
+
+export interface HeadersGetAction {
+  kind: 'headers_get';
+}
+
+// Replaces the tab's headers
+export interface HeadersSetAction {
+  kind: 'headers_set';
+  extraHeaders: ExtraHeaders;
+}
+
+export interface HeadersClearAction {
+  kind: 'headers_clear';
+}
+
+// Answers an origin's basic or digest auth challenges; see the relay's
+// models.Credential
+export interface Credential {
+  origin: string; // scheme://host[:port]
+  username: string;
+  password?: string; // never reported back
+}
+
+export interface CredentialsGetAction {
+  kind: 'credentials_get';
+}
+
+// Replaces the credential for the same origin
+export interface CredentialsSetAction {
+  kind: 'credentials_set';
+  credential: Credential;
+}
+
+// Forgets every credential of the tab, or only the origin's
+export interface CredentialsClearAction {
+  kind: 'credentials_clear';
+  origin?: string;
+}
+
+export interface UploadFile {
+  name: string;
+  mimeType?: string;
+  size: number;
+}
+
+export interface UploadAction {
+  kind: 'upload';
+  selector: string;
+  files: UploadFile[]; // contents arrive first in upload_chunk messages
+}
+
+export type FormValue = string | number | boolean | string[];
+
+export interface FillFormAction {
+  kind: 'fill_form';
+  fields: Record<string, FormValue>; // selector to value
+  actionability?: boolean;
+  selectorEngine?: SelectorEngine;
+}
+
+export interface FormFieldResult {
+  selector: string;
+  success: boolean;
+  value?: FormValue;
+  error?: string;
+}
+
 export type CommandAction =
   | ClickAction
+  | DoubleClickAction
+  | HoverAction
+  | DragAction
   | TypeAction
+  | PressAction
+  | SelectAction
+  | QueryAction
   | ScrollAction
+  | ScrollToAction
+  | EvaluateAction
   | ScreenshotAction
   | SnapshotAction
-  | NavigateAction;
+  | NavigateAction
+  | TabCreateAction
+  | TabCloseAction
+  | CookiesGetAction
+  | CookiesSetAction
+  | CookiesClearAction
+  | StorageGetAction
+  | StorageSetAction
+  | StorageRemoveAction
+  | UploadAction
+  | FillFormAction
+  | EmulationGetAction
+  | EmulationSetAction
+  | EmulationClearAction
+  | SetViewportAction
+  | SetNetworkConditionsAction
+  | RequestRulesGetAction
+  | RequestRulesSetAction
+  | RequestRulesClearAction
+  | HeadersGetAction
+  | HeadersSetAction
+  | HeadersClearAction
+  | CredentialsGetAction
+  | CredentialsSetAction
+  | CredentialsClearAction;
 
 export interface CommandRequest {
   type: 'command';
   id: string;
+  seq?: number; // increases across the relay; echoed in the response
   action: CommandAction;
   tabId: string;
   timeout: number;
+  canary?: boolean; // use new protocol features; only sent to canary builds
+  traceparent?: string; // W3C trace context when the relay traces the command
+}
+
+export interface ProtocolError {
+  type: 'protocol_error';
+  code: 'MALFORMED_MESSAGE' | 'UNKNOWN_TYPE' | 'INVALID_MESSAGE';
+  message: string;
+  messageType?: string;
+  details?: string[];
+}
+
+export interface UploadChunk {
+  type: 'upload_chunk';
+  id: string; // the upload command's ID
+  file: number; // index into the action's files
+  seq: number;
+  total: number;
+  data: string; // base64
+}
+
+export interface CommandCancel {
+  type: 'command_cancel';
+  id: string;
+  reason: string;
 }
 
 export interface CommandResponse {
   type: 'command_response';
   id: string;
+  seq?: number; // echoed from the command
   success: boolean;
   result?: unknown;
   error?: {
@@ -118,21 +640,36 @@ export interface CommandResponse {
     received: number;
     completed: number;
   };
+  traceparent?: string; // echoed from the command
 }
 
 // ===== Relay Messages =====
 
 export type RelayMessage =
   | ConnectAck
+  | ConnectAccepted
   | ConnectError
   | Ping
-  | CommandRequest;
+  | ServerShutdown
+  | Subscribe
+  | SyncRequest
+  | CommandRequest
+  | UploadChunk
+  | CommandCancel
+  | ProtocolError;
 
 export type ExtensionMessage =
+  | ExtensionConnect
   | TabAttach
   | TabDetach
   | TabUpdate
+  | Sync
+  | WindowUpdate
   | Pong
+  | ConsoleEvent
+  | PageEvent
+  | DownloadEvent
+  | DownloadChunk
   | CommandResponse;
 
 // ===== Internal Chrome Message Types =====
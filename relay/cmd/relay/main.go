@@ -0,0 +1,895 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/backup"
+	"github.com/emreylmaz/owlrelay/relay/internal/cluster"
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/features"
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/replication"
+	"github.com/emreylmaz/owlrelay/relay/internal/server"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+var version = "0.1.0"
+
+func main() {
+	// Setup logging
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+
+	// --config works with every command; it stands in for OWLRELAY_CONFIG
+	os.Args = takeConfigFlag(os.Args)
+
+	// Parse command
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "serve":
+		runServer()
+	case "token":
+		handleTokenCommand(os.Args[2:])
+	case "backup":
+		runBackup()
+	case "config":
+		handleConfigCommand(os.Args[2:])
+	case "version":
+		fmt.Printf("owlrelay %s\n", version)
+	case "help", "-h", "--help":
+		printUsage()
+	default:
+		fmt.Printf("Unknown command: %s\n\n", os.Args[1])
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	fmt.Println(`🦉 OwlRelay - Browser Control Relay Server
+
+Usage:
+  relay serve              Start the relay server
+  relay config validate    Check the configuration and show where each
+                           non-default value came from
+  relay token create       Create a new token (--scopes read,command,...,
+                           --rate-limit N, --burst N, --debt N)
+  relay token list         List all tokens
+  relay token revoke <id>  Revoke a token by ID
+  relay token rotate <id> [--grace N]
+                           Issue a new secret; the old one works for N
+                           seconds (default: TOKEN_ROTATION_GRACE)
+  relay token policy <id> <list|allow|deny|remove> [pattern|ruleId]
+                           Manage a token's URL allow/deny rules
+  relay token defaults <id> [--timeout N] [--snapshot-format F]
+                           [--snapshot-max-depth N] [--snapshot-max-length N]
+                           [--screenshot-on-failure on|off]
+                           [--actionability on|off|default] [--reset]
+                           Show or change a token's action defaults
+  relay token features <id> [name=on|off|default ...]
+                           Show or override a token's experimental features
+  relay token limits <id> [--rate-limit N] [--burst N] [--debt N]
+                           Show or change a token's rate limits
+  relay backup             Back up the database once to the configured destination
+  relay version            Show version
+  relay help               Show this help
+
+Options:
+  --config <path>          Read settings from a YAML or TOML file as well;
+                           environment variables override it (also
+                           OWLRELAY_CONFIG)
+
+Environment Variables:
+  PORT            Server port (default: 3000)
+  HOST            Server host (default: 0.0.0.0)
+  LISTENERS       Listen addresses with optional route groups, overriding
+                  HOST/PORT (e.g. "0.0.0.0:3000=ws+api,127.0.0.1:3001=admin";
+                  "unix:/run/owlrelay.sock" for a Unix socket)
+  ADMIN_ADDR      Serve admin, /metrics, and /debug/pprof on this address only
+  TLS_CERT        PEM certificate chain; serve HTTPS/WSS (with TLS_KEY)
+  TLS_KEY         PEM private key for TLS_CERT
+  DOMAIN          Host names to obtain Let's Encrypt certificates for
+  ACME_EMAIL      Contact address for the ACME account
+  ACME_DIRECTORY  ACME directory URL (default: Let's Encrypt production)
+  ACME_CACHE_DIR  ACME account and certificate cache (default: ./data/acme)
+  ACME_HTTP_ADDR  Serve HTTP-01 challenges and HTTPS redirects here (e.g. :80)
+  DB_DRIVER       Database driver: sqlite or postgres (default: sqlite)
+  DB_PATH         SQLite database path (default: ./data/owlrelay.db)
+  DB_DSN          Postgres connection string (required for postgres)
+  SCREENSHOT_PATH Screenshot storage path (default: ./data/screenshots)
+  LOG_LEVEL       Log level: debug, info, warn, error (default: info)
+  ACCESS_LOG      Log one line per request (default: true)
+  ACCESS_LOG_FILE Access log file, or stdout, instead of the server log
+  CORS_ORIGINS    Origins browsers may call the API from (default: *)
+  
+  RATE_LIMIT_DEFAULT     Requests per window for new tokens (default: 100)
+  RATE_LIMIT_BURST       Burst for new tokens; 0 means the limit (default: 0)
+  RATE_LIMIT_WINDOW      Rate limit window in seconds (default: 60)
+  RATE_LIMIT_BACKEND     memory, or redis to share limits between relays (default: memory)
+  RATE_LIMIT_WARN_PERCENT Warn past this share of a token's bucket; 0 disables (default: 80)
+  RATE_LIMIT_DEBT        Requests new tokens may run past an empty bucket (default: 0)
+  REDIS_URL              redis://[[user]:password@]host:port[/db] for RATE_LIMIT_BACKEND=redis
+  SCREENSHOT_TTL         Screenshot TTL in seconds (default: 30)
+  SCREENSHOT_CONCURRENCY Screenshots captured at once; 0 for no limit (default: 4)
+  SCREENSHOT_QUEUE_TIMEOUT Milliseconds a screenshot waits for a turn (default: 10000)
+  SCREENSHOT_BURST_MAX  Most captures in one burst screenshot, 0 disables (default: 10)
+  TOKEN_DISPATCH_WORKERS Commands one token sends at once; 0 for no limit (default: 4)
+  TOKEN_ARTIFACT_WORKERS Screenshots one token captures at once; 0 for no limit (default: 2)
+  TOKEN_MAX_INFLIGHT     Commands one token may have awaiting a response; 0 for no limit (default: 0)
+  TOKEN_QUEUE_DEPTH      Commands waiting past TOKEN_MAX_INFLIGHT before QUEUE_FULL (default: 100)
+  TOKEN_QUEUE_TIMEOUT    Milliseconds a queued command waits (default: 30000)
+  TOKEN_ROTATION_GRACE   Seconds a rotated token's old secret works (default: 86400)
+  SCREENSHOT_HISTORY     Seconds to keep screenshot records (default: 86400)
+  SESSION_HISTORY        Seconds to keep ended sessions, 0 forever (default: 7776000)
+  SCHEDULE_HISTORY       Runs kept per schedule (default: 100)
+  SCHEDULE_SCREENSHOT_TTL Seconds a scheduled screenshot is kept (default: 86400)
+  SCREENCAST_FPS         Screencast frames per second (default: 2)
+  SCREENCAST_MAX_FPS     Highest screencast frame rate allowed (default: 5)
+  RECORDINGS_PATH        Recording archive storage path (default: ./data/recordings)
+  RECORDING_TTL          Seconds to keep recording archives (default: 86400)
+  RECORDING_MAX_DURATION Longest recording in seconds (default: 600)
+  DOWNLOADS_PATH         Downloaded file storage path (default: ./data/downloads)
+  DOWNLOAD_TTL           Seconds to keep downloaded files (default: 3600)
+  DOWNLOAD_MAX_SIZE      Largest downloaded file kept; 0 disables (default: 52428800)
+  SCRIPT_TTL             Seconds to keep a command recording once idle (default: 3600)
+  WEBHOOK_TIMEOUT        Seconds per webhook delivery attempt (default: 10)
+  WEBHOOK_MAX_ATTEMPTS   Attempts per webhook delivery before giving up (default: 8)
+  WEBHOOK_QUEUE_SIZE     Webhook deliveries queued before events are dropped (default: 1000)
+  CONSOLE_BUFFER_SIZE    Console messages kept per tab; 0 disables (default: 200)
+  UPLOAD_MAX_SIZE        Largest total size of the files in one upload (default: 10485760)
+  STORAGE_MAX_SIZE       Bytes of web storage read or written per request (default: 1048576)
+  EVALUATE_MAX_RESULT    Bytes of value returned by evaluate before it is cut (default: 1048576)
+  CANARY_VERSIONS        Extension versions whose sessions are canaries (e.g. 1.6.*)
+  CANARY_LABELS          Connect labels that make a session a canary (e.g. canary)
+  CANARY_PERCENT         Percentage of canary session commands in canary mode (default: 100)
+  FEATURES               Experimental features enabled for all tokens (e.g. screencast)
+  OTEL_EXPORTER_OTLP_ENDPOINT OTLP/HTTP collector URL; enables tracing
+  OTEL_EXPORTER_OTLP_HEADERS Headers sent with each export (key=value,...)
+  OTEL_SERVICE_NAME      service.name of exported spans (default: owlrelay)
+  OTEL_TRACES_SAMPLER_ARG Share of new traces recorded, 0 to 1 (default: 1)
+  COMMAND_TIMEOUT        Command timeout in ms (default: 30000)
+  COMMAND_ON_DISCONNECT  complete or cancel commands whose client leaves (default: complete)
+  COMMAND_RESULT_TTL     Seconds to keep results of those commands (default: 600)
+  PRIVILEGED_URLS        deny, flag or allow commands on chrome://, file:// and similar pages (default: deny)
+  HTTP_TIMEOUT_OVERHEAD  Seconds a command request may run past its timeout (default: 5)
+  HTTP_TIMEOUT_MAX       Hard ceiling on any HTTP request in seconds (default: 300)
+  MAX_REQUEST_BODY       Largest HTTP request body in bytes; 0 disables (default: 1048576)
+  
+  WS_PING_INTERVAL       WebSocket ping interval in seconds (default: 30)
+  WS_PONG_TIMEOUT        WebSocket pong timeout in seconds (default: 10)
+  WS_MAX_MESSAGE_SIZE    Largest inbound WebSocket message in bytes (default: 16777216)
+  WS_MIN_PROTOCOL_VERSION Lowest extension protocol version accepted (default: 1)
+  TAB_SYNC_INTERVAL      Seconds between tab list resyncs; 0 disables (default: 300)
+  TAB_TTL                Seconds an unreported tab is kept; 0 disables (default: 0)
+
+  RELAY_ROLE             primary or standby (default: primary)
+  PRIMARY_URL            Standby: base URL of the primary relay
+  REPLICATION_TOKEN      Standby: admin token issued by the primary
+  REPLICATION_INTERVAL   Standby: seconds between snapshots (default: 5)
+
+  CLUSTER_ENABLED        Share sessions with other relays through REDIS_URL
+  CLUSTER_NODE_ID        Name of this relay in the cluster (default: hostname)
+  CLUSTER_ADVERTISE_URL  Base URL other relays use to reach this one
+  CLUSTER_SECRET         Shared secret for forwarded commands
+  CLUSTER_HEARTBEAT      Seconds between registry refreshes (default: 5)
+
+  BACKUP_S3_BUCKET       Continuously back up SQLite to this S3 bucket
+  BACKUP_S3_PREFIX       Key prefix for the backup object
+  BACKUP_S3_REGION       S3 region (default: us-east-1)
+  BACKUP_S3_ENDPOINT     S3-compatible endpoint (MinIO, R2, ...)
+  BACKUP_HOOK            Command run after each snapshot; {file} is its path
+  BACKUP_INTERVAL        Seconds between backups (default: 60)
+
+Examples:
+  # Start server on default port
+  relay serve
+
+  # Create a token with custom name
+  relay token create my-agent
+
+  # Create a read-only token that can snapshot and screenshot but never click
+  relay token create observer --scopes read,screenshot
+
+  # Allow 600 requests per window in bursts of at most 20
+  relay token create crawler --rate-limit 600 --burst 20
+
+  # Let token 2 overdraw its bucket by 10 requests before getting 429s
+  relay token limits 2 --debt 10
+
+  # List all tokens
+  relay token list
+
+  # Revoke a token
+  relay token revoke 1
+
+  # Restrict token 2 to internal hosts
+  relay token policy 2 allow '*.internal.example.com'
+
+  # Give token 2 a 60s timeout and a screenshot of every failed command
+  relay token defaults 2 --timeout 60000 --screenshot-on-failure on
+
+  # Let token 2 try the screencast endpoint
+  relay token features 2 screencast=on`)
+}
+
+// takeConfigFlag removes --config <path> (or --config=<path>) from args and
+// exports the path as OWLRELAY_CONFIG
+func takeConfigFlag(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--config" && i+1 < len(args):
+			os.Setenv(config.FileEnv, args[i+1])
+			i++
+		case strings.HasPrefix(args[i], "--config="):
+			os.Setenv(config.FileEnv, strings.TrimPrefix(args[i], "--config="))
+		default:
+			out = append(out, args[i])
+		}
+	}
+	return out
+}
+
+func handleConfigCommand(args []string) {
+	if len(args) < 1 || args[0] != "validate" {
+		fmt.Println("Usage: relay config validate [--config <path>]")
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.File != "" {
+		fmt.Printf("Config file: %s\n", cfg.File)
+	}
+	for _, s := range cfg.Settings() {
+		if s.Source == config.SourceDefault {
+			continue
+		}
+		fmt.Printf("  %-28s %-8s %v\n", s.Name, s.Source, s.Value)
+	}
+	fmt.Println("Configuration is valid")
+}
+
+func runServer() {
+	// Load config
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load config")
+	}
+
+	// Set log level
+	zerolog.SetGlobalLevel(cfg.GetLogLevel())
+
+	// Initialize database
+	db, err := database.New(cfg.DBDriver, cfg.DatabaseDSN())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize database")
+	}
+	defer db.Close()
+
+	// Create stores
+	stores := store.New(db)
+	if n, err := stores.Tokens.UpgradeSecrets(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to upgrade token secrets")
+	} else if n > 0 {
+		log.Info().Int("tokens", n).Msg("Converted token secrets to argon2id")
+	}
+
+	// Create hub
+	h := hub.New(cfg, version)
+
+	// Replication role
+	node, err := replication.New(cfg, db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure replication")
+	}
+
+	// Share sessions with other relays, if clustered
+	clusterNode, err := cluster.New(cfg, h)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to join cluster")
+	}
+
+	// Create and start server
+	srv := server.New(cfg, h, stores, node, clusterNode, version)
+
+	// Setup graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle shutdown signals
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigCh
+		log.Info().Msg("Shutdown signal received")
+		cancel()
+	}()
+
+	// A standby copies state from its primary until promoted
+	go node.Run(ctx)
+
+	if clusterNode != nil {
+		go clusterNode.Run(ctx)
+	}
+
+	// Continuous backup, if configured
+	backups, err := backup.New(cfg, db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to configure backups")
+	}
+	backupDone := make(chan struct{})
+	if backups != nil {
+		go func() {
+			backups.Run(ctx)
+			close(backupDone)
+		}()
+	} else {
+		close(backupDone)
+	}
+
+	// Start server
+	if err := srv.Start(ctx); err != nil {
+		log.Fatal().Err(err).Msg("Server error")
+	}
+
+	// Let the final backup finish before the database is closed
+	<-backupDone
+
+	log.Info().Msg("Server stopped gracefully")
+}
+
+func runBackup() {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := database.New(cfg.DBDriver, cfg.DatabaseDSN())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	backups, err := backup.New(cfg, db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring backup: %v\n", err)
+		os.Exit(1)
+	}
+	if backups == nil {
+		fmt.Fprintln(os.Stderr, "No backup destination configured; set BACKUP_S3_BUCKET or BACKUP_HOOK")
+		os.Exit(1)
+	}
+
+	if err := backups.RunOnce(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("✅ Backup complete")
+}
+
+func handleTokenCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: relay token <create|list|revoke|policy|defaults|features|limits>")
+		os.Exit(1)
+	}
+
+	// Load config and initialize database
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	db, err := database.New(cfg.DBDriver, cfg.DatabaseDSN())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	tokenStore := store.NewTokenStore(db)
+
+	switch args[0] {
+	case "policy":
+		handlePolicyCommand(store.NewPolicyStore(db), args[1:])
+
+	case "defaults":
+		handleDefaultsCommand(cfg, tokenStore, args[1:])
+
+	case "features":
+		handleFeaturesCommand(cfg, tokenStore, args[1:])
+
+	case "limits":
+		handleLimitsCommand(tokenStore, args[1:])
+
+	case "create":
+		name := "default"
+		var scopes []string
+		rateLimit, rateBurst, rateDebt := cfg.RateLimitDefault, cfg.RateLimitBurst, cfg.RateLimitDebt
+		for i := 1; i < len(args); i++ {
+			switch {
+			case args[i] == "--scopes" && i+1 < len(args):
+				i++
+				scopes = strings.Split(args[i], ",")
+			case strings.HasPrefix(args[i], "--scopes="):
+				scopes = strings.Split(strings.TrimPrefix(args[i], "--scopes="), ",")
+			case args[i] == "--rate-limit" && i+1 < len(args):
+				i++
+				rateLimit = parseTokenFlag("--rate-limit", args[i])
+			case args[i] == "--burst" && i+1 < len(args):
+				i++
+				rateBurst = parseTokenFlag("--burst", args[i])
+			case args[i] == "--debt" && i+1 < len(args):
+				i++
+				rateDebt = parseTokenFlag("--debt", args[i])
+			default:
+				name = args[i]
+			}
+		}
+
+		token, err := tokenStore.Create(name, rateLimit, rateBurst, rateDebt, scopes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating token: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println()
+		fmt.Printf("✅ Token created successfully!\n\n")
+		fmt.Printf("Token: %s\n", token)
+		fmt.Printf("Name:  %s\n", name)
+		if scopes != nil {
+			fmt.Printf("Scopes: %s\n", strings.Join(scopes, ","))
+		}
+		fmt.Println()
+		fmt.Println("⚠️  Save this token securely. It won't be shown again.")
+		fmt.Println()
+		fmt.Println("To connect your extension, use:")
+		fmt.Printf("  Relay URL: http://localhost:%d\n", cfg.Port)
+		fmt.Printf("  Token:     %s\n", token)
+
+	case "list":
+		tokens, err := tokenStore.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing tokens: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(tokens) == 0 {
+			fmt.Println("No tokens found. Create one with: relay token create <name>")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tRATE LIMIT\tBURST\tDEBT\tSCOPES\tCREATED\tLAST USED\tSTATUS")
+		fmt.Fprintln(w, "--\t----\t----------\t-----\t----\t------\t-------\t---------\t------")
+
+		for _, t := range tokens {
+			lastUsed := "never"
+			if t.LastUsedAt != nil {
+				lastUsed = t.LastUsedAt.Format("2006-01-02 15:04")
+			}
+
+			status := "active"
+			switch {
+			case t.RevokedAt != nil:
+				status = "revoked"
+			case t.PreviousExpiresAt != nil:
+				status = "rotating until " + t.PreviousExpiresAt.Local().Format("2006-01-02 15:04")
+			}
+
+			burst := t.RateBurst
+			if burst <= 0 {
+				burst = t.RateLimit
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%d/%ds\t%d\t%d\t%s\t%s\t%s\t%s\n",
+				t.ID,
+				t.Name,
+				t.RateLimit,
+				cfg.RateLimitWindow,
+				burst,
+				t.RateDebt,
+				strings.Join(t.Scopes, ","),
+				t.CreatedAt.Format("2006-01-02"),
+				lastUsed,
+				status,
+			)
+		}
+		w.Flush()
+
+	case "rotate":
+		handleRotateCommand(cfg, tokenStore, args[1:])
+
+	case "revoke":
+		if len(args) < 2 {
+			fmt.Println("Usage: relay token revoke <id>")
+			os.Exit(1)
+		}
+
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[1])
+			os.Exit(1)
+		}
+
+		if err := tokenStore.Revoke(id); err != nil {
+			fmt.Fprintf(os.Stderr, "Error revoking token: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("✅ Token %d revoked successfully.\n", id)
+
+	default:
+		fmt.Printf("Unknown token command: %s\n", args[0])
+		fmt.Println("Usage: relay token <create|list|revoke|rotate|policy|defaults|features|limits>")
+		os.Exit(1)
+	}
+}
+
+func handleRotateCommand(cfg *config.Config, tokenStore *store.TokenStore, args []string) {
+	usage := "Usage: relay token rotate <id> [--grace SECONDS]"
+	if len(args) != 1 && !(len(args) == 3 && args[1] == "--grace") {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[0])
+		os.Exit(1)
+	}
+	grace := cfg.TokenRotationGrace
+	if len(args) == 3 {
+		grace = parseTokenFlag("--grace", args[2])
+	}
+
+	resp, err := tokenStore.Rotate(id, time.Duration(grace)*time.Second)
+	if errors.Is(err, sql.ErrNoRows) {
+		fmt.Fprintf(os.Stderr, "Token %d not found or revoked\n", id)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rotating token: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Printf("✅ Token %d (%s) rotated.\n\n", resp.ID, resp.Name)
+	fmt.Printf("Token: %s\n", resp.Token)
+	if grace > 0 {
+		fmt.Printf("The old token works until %s.\n", resp.PreviousExpiresAt.Local().Format("2006-01-02 15:04:05 MST"))
+	} else {
+		fmt.Println("The old token no longer works.")
+	}
+	fmt.Println()
+	fmt.Println("⚠️  Save this token securely. It won't be shown again.")
+}
+
+// parseTokenFlag parses a non-negative integer flag of token create
+func parseTokenFlag(name, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid %s: %s\n", name, value)
+		os.Exit(1)
+	}
+	return n
+}
+
+func handleLimitsCommand(tokenStore *store.TokenStore, args []string) {
+	usage := "Usage: relay token limits <id> [--rate-limit N] [--burst N] [--debt N]"
+	if len(args) < 1 || len(args)%2 == 0 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	tokenID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	limits, err := tokenStore.Limits(tokenID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading limits: %v\n", err)
+		os.Exit(1)
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		flag, value := args[i], args[i+1]
+		switch flag {
+		case "--rate-limit":
+			limits.RateLimit = parseTokenFlag(flag, value)
+		case "--burst":
+			limits.RateBurst = parseTokenFlag(flag, value)
+		case "--debt":
+			limits.RateDebt = parseTokenFlag(flag, value)
+		default:
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+	}
+
+	if len(args) > 1 {
+		if err := limits.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid limits: %v\n", err)
+			os.Exit(1)
+		}
+		if err := tokenStore.SetLimits(tokenID, limits); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving limits: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✅ Limits of token %d updated.\n", tokenID)
+	}
+
+	burst := limits.RateBurst
+	if burst == 0 {
+		burst = limits.RateLimit
+	}
+	fmt.Printf("Rate limit: %d per window\n", limits.RateLimit)
+	fmt.Printf("Burst:      %d\n", burst)
+	fmt.Printf("Debt:       %d\n", limits.RateDebt)
+}
+
+func handleDefaultsCommand(cfg *config.Config, tokenStore *store.TokenStore, args []string) {
+	usage := "Usage: relay token defaults <id> [--timeout N] [--snapshot-format html|simplified|markdown] [--snapshot-max-depth N] [--snapshot-max-length N] [--screenshot-on-failure on|off] [--actionability on|off|default] [--reset]"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	tokenID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	defaults, err := tokenStore.Defaults(tokenID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading defaults: %v\n", err)
+		os.Exit(1)
+	}
+
+	changed := false
+	for i := 1; i < len(args); i++ {
+		flag := args[i]
+		if flag == "--reset" {
+			defaults = models.TokenDefaults{}
+			changed = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		i++
+		value := args[i]
+		switch flag {
+		case "--timeout":
+			defaults.Timeout = parseTokenFlag(flag, value)
+		case "--snapshot-format":
+			defaults.SnapshotFormat = value
+		case "--snapshot-max-depth":
+			defaults.SnapshotMaxDepth = parseTokenFlag(flag, value)
+		case "--snapshot-max-length":
+			defaults.SnapshotMaxLength = parseTokenFlag(flag, value)
+		case "--screenshot-on-failure":
+			defaults.ScreenshotOnFailure = parseSwitchFlag(flag, value)
+		case "--actionability":
+			if value == "default" {
+				defaults.Actionability = nil
+			} else {
+				on := parseSwitchFlag(flag, value)
+				defaults.Actionability = &on
+			}
+		default:
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+		changed = true
+	}
+
+	if changed {
+		if err := defaults.Validate(cfg.MaxCommandTimeout()); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid defaults: %v\n", err)
+			os.Exit(1)
+		}
+		if err := tokenStore.SetDefaults(tokenID, defaults); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving defaults: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✅ Defaults of token %d updated.\n", tokenID)
+	}
+
+	actionability := "default"
+	if defaults.Actionability != nil && *defaults.Actionability {
+		actionability = "on"
+	} else if defaults.Actionability != nil {
+		actionability = "off"
+	}
+	orRelay := func(n int) string {
+		if n == 0 {
+			return "relay default"
+		}
+		return strconv.Itoa(n)
+	}
+	format := defaults.SnapshotFormat
+	if format == "" {
+		format = "relay default"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Timeout (ms)\t%s\n", orRelay(defaults.Timeout))
+	fmt.Fprintf(w, "Snapshot format\t%s\n", format)
+	fmt.Fprintf(w, "Snapshot max depth\t%s\n", orRelay(defaults.SnapshotMaxDepth))
+	fmt.Fprintf(w, "Snapshot max length\t%s\n", orRelay(defaults.SnapshotMaxLength))
+	fmt.Fprintf(w, "Screenshot on failure\t%t\n", defaults.ScreenshotOnFailure)
+	fmt.Fprintf(w, "Actionability checks\t%s\n", actionability)
+	w.Flush()
+}
+
+func handleFeaturesCommand(cfg *config.Config, tokenStore *store.TokenStore, args []string) {
+	usage := "Usage: relay token features <id> [name=on|off|default ...]"
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	tokenID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	overrides, err := tokenStore.Features(tokenID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading features: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(args) > 1 {
+		for _, arg := range args[1:] {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				fmt.Println(usage)
+				os.Exit(1)
+			}
+			if !features.Known(name) {
+				fmt.Fprintf(os.Stderr, "Unknown feature: %s\n", name)
+				os.Exit(1)
+			}
+			if value == "default" {
+				delete(overrides, name)
+			} else {
+				overrides[name] = parseSwitchFlag(name, value)
+			}
+		}
+		if err := tokenStore.SetFeatures(tokenID, overrides); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving features: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✅ Features of token %d updated.\n", tokenID)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FEATURE\tENABLED\tSOURCE\tDESCRIPTION")
+	fmt.Fprintln(w, "-------\t-------\t------\t-----------")
+	for _, f := range features.Flags {
+		on, source := features.Resolve(cfg.EnabledFeatures, overrides, f.Name)
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", f.Name, on, source, f.Description)
+	}
+	w.Flush()
+}
+
+// parseSwitchFlag parses an on/off flag
+func parseSwitchFlag(name, value string) bool {
+	switch value {
+	case "on", "true":
+		return true
+	case "off", "false":
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Invalid %s: %s (use on or off)\n", name, value)
+	os.Exit(1)
+	return false
+}
+
+func handlePolicyCommand(policyStore *store.PolicyStore, args []string) {
+	usage := "Usage: relay token policy <id> <list|allow|deny|remove> [pattern|ruleId]"
+	if len(args) < 2 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+
+	tokenID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid token ID: %s\n", args[0])
+		os.Exit(1)
+	}
+
+	switch args[1] {
+	case "list":
+		rules, err := policyStore.List(tokenID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing policies: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(rules) == 0 {
+			fmt.Printf("Token %d has no URL rules; all URLs are allowed.\n", tokenID)
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEFFECT\tPATTERN")
+		fmt.Fprintln(w, "--\t------\t-------")
+		for _, r := range rules {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", r.ID, r.Effect, r.Pattern)
+		}
+		w.Flush()
+
+	case "allow", "deny":
+		if len(args) < 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+
+		rule, err := policyStore.Add(tokenID, args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error adding policy: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("✅ Rule %d added: %s %s\n", rule.ID, rule.Effect, rule.Pattern)
+
+	case "remove":
+		if len(args) < 3 {
+			fmt.Println(usage)
+			os.Exit(1)
+		}
+
+		ruleID, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid rule ID: %s\n", args[2])
+			os.Exit(1)
+		}
+
+		if err := policyStore.Delete(tokenID, ruleID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing policy: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("✅ Rule %d removed.\n", ruleID)
+
+	default:
+		fmt.Printf("Unknown policy command: %s\n", args[1])
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
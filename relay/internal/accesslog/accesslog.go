@@ -0,0 +1,84 @@
+// Package accesslog writes one structured line per HTTP request. Code on
+// the request path adds what it learns (the token, the command sent) to the
+// Entry in its context; without one, adding does nothing.
+package accesslog
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Entry collects the request details only handlers know
+type Entry struct {
+	mu        sync.Mutex
+	token     string
+	commandID string
+	kind      string
+	tabID     string
+	result    string
+	commands  int
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that records into e
+func NewContext(ctx context.Context, e *Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, e)
+}
+
+// FromContext returns the request's Entry, or nil if it is not logged
+func FromContext(ctx context.Context) *Entry {
+	e, _ := ctx.Value(contextKey{}).(*Entry)
+	return e
+}
+
+// SetToken records the name of the token the request authenticated with
+func (e *Entry) SetToken(name string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.token = name
+	e.mu.Unlock()
+}
+
+// Command records a command the request sent and its result code, "OK"
+// when it succeeded. A request sending several (a batch, a macro) logs the
+// first command, the count, and the first failure.
+func (e *Entry) Command(id, kind, tabID, result string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands++
+	if e.commands == 1 {
+		e.commandID, e.kind, e.tabID, e.result = id, kind, tabID, result
+		return
+	}
+	if e.result == "OK" && result != "OK" {
+		e.result = result
+	}
+}
+
+// AppendTo adds what was recorded to the access log line
+func (e *Entry) AppendTo(ev *zerolog.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" {
+		ev.Str("token", e.token)
+	}
+	if e.commands == 0 {
+		return
+	}
+	ev.Str("action", e.kind).Str("command_id", e.commandID)
+	if e.tabID != "" {
+		ev.Str("tab_id", e.tabID)
+	}
+	ev.Str("result", e.result)
+	if e.commands > 1 {
+		ev.Int("commands", e.commands)
+	}
+}
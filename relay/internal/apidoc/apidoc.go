@@ -0,0 +1,485 @@
+// Package apidoc builds the OpenAPI 3 description of the relay's HTTP API
+// from the request and response models
+package apidoc
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// operation describes one route. Request and Response are zero values of
+// the body types, or nil when there is no JSON body. Form lists the fields
+// of a multipart/form-data body instead. OrResponse is a second shape the
+// route may answer with.
+type operation struct {
+	Method     string
+	Path       string
+	Summary    string
+	Tag        string
+	Scope      string // required token scope; empty for public routes
+	Query      []param
+	Request    any
+	Form       []param
+	Status     int
+	Response   any
+	OrResponse any
+}
+
+type param struct {
+	Name        string
+	Description string
+	File        bool // a file part of a form
+}
+
+// debugTiming is accepted by every /api/v1 route; it is listed on those
+// that report the breakdown
+var debugTiming = param{Name: "debugTiming", Description: "Set to 1 to break the request's latency down by phase"}
+
+var operations = []operation{
+	{Method: "GET", Path: "/health", Summary: "Health check and replication role", Tag: "health",
+		Status: 200, Response: models.HealthResponse{}},
+	{Method: "GET", Path: "/healthz", Summary: "Liveness probe", Tag: "health",
+		Status: 200, Response: models.LivenessResponse{}},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness probe with per-dependency checks; 503 when one fails", Tag: "health",
+		Status: 200, Response: models.ReadinessResponse{}},
+
+	{Method: "GET", Path: "/api/v1/features", Summary: "Experimental features and whether the token may use them", Tag: "api",
+		Status: 200, Response: models.FeaturesResponse{}},
+	{Method: "GET", Path: "/api/v1/status", Summary: "Connection status for the token", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.StatusResponse{}},
+	{Method: "GET", Path: "/api/v1/sessions/{id}", Summary: "One of the token's sessions in detail", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.SessionDetail{}},
+	{Method: "GET", Path: "/api/v1/tabs", Summary: "List attached tabs", Tag: "api", Scope: models.ScopeRead,
+		Query: []param{
+			{Name: "refresh", Description: "Set to 1 to ask extensions to resync their tabs first"},
+			{Name: "since", Description: "A cursor from an earlier response; returns only the tabs added, changed, or removed after it"},
+		},
+		Status: 200, Response: models.TabsResponse{}, OrResponse: models.TabChangesResponse{}},
+	{Method: "POST", Path: "/api/v1/tabs", Summary: "Open and attach a new tab", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.CreateTabRequest{}, Status: 201, Response: models.Tab{}},
+	{Method: "DELETE", Path: "/api/v1/tabs/{id}", Summary: "Close an attached tab", Tag: "api", Scope: models.ScopeCommand,
+		Status: 204},
+	{Method: "POST", Path: "/api/v1/command", Summary: "Execute a browser command", Tag: "api",
+		Scope:   "depends on action kind",
+		Query:   []param{debugTiming},
+		Request: models.CommandAPIRequest{}, Status: 200, Response: models.CommandAPIResponse{}},
+	{Method: "POST", Path: "/api/v1/screenshot", Summary: "Capture a screenshot", Tag: "api", Scope: models.ScopeScreenshot,
+		Query:   []param{{Name: "direct", Description: "Set to 1 to stream image bytes instead of returning a URL"}, debugTiming},
+		Request: models.ScreenshotRequest{}, Status: 200, Response: models.ScreenshotResponse{}, OrResponse: models.ScreenshotBurstResponse{}},
+	{Method: "GET", Path: "/api/v1/screenshots", Summary: "List recent screenshots, newest first", Tag: "api", Scope: models.ScopeRead,
+		Query: []param{
+			{Name: "tabId", Description: "Only screenshots of this tab"},
+			{Name: "commandId", Description: "Only the screenshot taken by this command"},
+			{Name: "since", Description: "Only screenshots taken at or after this RFC 3339 time"},
+			{Name: "until", Description: "Only screenshots taken before this RFC 3339 time"},
+			{Name: "limit", Description: "Maximum records to return (default 50, max 500)"},
+		},
+		Status: 200, Response: models.ScreenshotsResponse{}},
+	{Method: "GET", Path: "/api/v1/screenshots/{id}/image", Summary: "Image of one of the token's screenshots, until it expires", Tag: "api", Scope: models.ScopeRead,
+		Status: 200},
+	{Method: "GET", Path: "/api/v1/screencast", Summary: "Stream a tab as multipart MJPEG", Tag: "api", Scope: models.ScopeScreenshot,
+		Query: []param{
+			{Name: "tabId", Description: "Tab to watch (required)"},
+			{Name: "fps", Description: "Frames per second (default SCREENCAST_FPS, at most SCREENCAST_MAX_FPS)"},
+			{Name: "quality", Description: "JPEG quality 1-100 (default 60)"},
+		},
+		Status: 200},
+	{Method: "POST", Path: "/api/v1/recording/start", Summary: "Start recording a tab to a frame archive", Tag: "api", Scope: models.ScopeScreenshot,
+		Request: models.RecordingStartRequest{}, Status: 201, Response: models.Recording{}},
+	{Method: "POST", Path: "/api/v1/recording/stop", Summary: "Stop a recording and wait for its archive", Tag: "api", Scope: models.ScopeScreenshot,
+		Request: models.RecordingStopRequest{}, Status: 200, Response: models.Recording{}},
+	{Method: "GET", Path: "/api/v1/recording/{id}", Summary: "Get a recording", Tag: "api", Scope: models.ScopeScreenshot,
+		Status: 200, Response: models.Recording{}},
+	{Method: "POST", Path: "/api/v1/snapshot", Summary: "Capture a DOM snapshot", Tag: "api", Scope: models.ScopeRead,
+		Query:   []param{debugTiming},
+		Request: models.SnapshotRequest{}, Status: 200, Response: models.SnapshotResponse{}},
+	{Method: "POST", Path: "/api/v1/query", Summary: "Describe the elements matching a selector or XPath", Tag: "api", Scope: models.ScopeRead,
+		Request: models.QueryRequest{}, Status: 200, Response: models.QueryResponse{}},
+	{Method: "POST", Path: "/api/v1/evaluate", Summary: "Run JavaScript in a tab", Tag: "api", Scope: models.ScopeEvaluate,
+		Request: models.EvaluateRequest{}, Status: 200, Response: models.EvaluateResponse{}},
+	{Method: "GET", Path: "/api/v1/cookies", Summary: "Cookies of a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Query: []param{
+			{Name: "tabId", Description: "Tab whose origin to read (required)"},
+			{Name: "name", Description: "Only the cookie with this name"},
+		},
+		Status: 200, Response: models.CookiesResponse{}},
+	{Method: "POST", Path: "/api/v1/cookies", Summary: "Set cookies on a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.SetCookiesRequest{}, Status: 200, Response: models.CookiesResponse{}},
+	{Method: "DELETE", Path: "/api/v1/cookies", Summary: "Clear cookies of a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Query: []param{
+			{Name: "tabId", Description: "Tab whose origin to clear (required)"},
+			{Name: "name", Description: "Only the cookie with this name"},
+		},
+		Status: 200, Response: models.ClearCookiesResponse{}},
+	{Method: "GET", Path: "/api/v1/emulation", Summary: "What a tab emulates", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to read (required)"}},
+		Status: 200, Response: models.EmulationResponse{}},
+	{Method: "POST", Path: "/api/v1/emulation", Summary: "Emulate a geolocation, timezone, and language in a tab", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.SetEmulationRequest{}, Status: 200, Response: models.EmulationResponse{}},
+	{Method: "DELETE", Path: "/api/v1/emulation", Summary: "Stop emulating in a tab", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to reset (required)"}},
+		Status: 200, Response: models.EmulationResponse{}},
+	{Method: "GET", Path: "/api/v1/storage", Summary: "localStorage or sessionStorage items of a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Query: []param{
+			{Name: "tabId", Description: "Tab whose origin to read (required)"},
+			{Name: "area", Description: "local (default) or session"},
+			{Name: "key", Description: "Only these keys; repeat for several"},
+		},
+		Status: 200, Response: models.StorageResponse{}},
+	{Method: "POST", Path: "/api/v1/storage", Summary: "Write storage items of a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.SetStorageRequest{}, Status: 200, Response: models.StorageResponse{}},
+	{Method: "DELETE", Path: "/api/v1/storage", Summary: "Remove storage items of a tab's origin", Tag: "api", Scope: models.ScopeCommand,
+		Query: []param{
+			{Name: "tabId", Description: "Tab whose origin to change (required)"},
+			{Name: "area", Description: "local (default) or session"},
+			{Name: "key", Description: "Only these keys; repeat for several. Without any the area is cleared"},
+		},
+		Status: 200, Response: models.RemoveStorageResponse{}},
+	{Method: "POST", Path: "/api/v1/upload", Summary: "Set files on a file input", Tag: "api", Scope: models.ScopeCommand,
+		Form: []param{
+			{Name: "tabId", Description: "Tab to upload in (required)"},
+			{Name: "selector", Description: "The file input (required)"},
+			{Name: "file", Description: "A file to set; repeat for inputs that take several", File: true},
+		},
+		Status: 200, Response: models.UploadResponse{}},
+	{Method: "GET", Path: "/api/v1/request-rules", Summary: "Request rules in effect in a tab", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to read (required)"}},
+		Status: 200, Response: models.RequestRulesResponse{}},
+	{Method: "POST", Path: "/api/v1/request-rules", Summary: "Apply a stored rule set to a tab", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.ApplyRuleSetRequest{}, Status: 200, Response: models.RequestRulesResponse{}},
+	{Method: "DELETE", Path: "/api/v1/request-rules", Summary: "Remove a tab's request rules", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to reset (required)"}},
+		Status: 200, Response: models.RequestRulesResponse{}},
+	{Method: "GET", Path: "/api/v1/headers", Summary: "Extra headers a tab's requests get", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to read (required)"}},
+		Status: 200, Response: models.HeadersResponse{}},
+	{Method: "POST", Path: "/api/v1/headers", Summary: "Add headers to a tab's outgoing requests", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.SetHeadersRequest{}, Status: 200, Response: models.HeadersResponse{}},
+	{Method: "DELETE", Path: "/api/v1/headers", Summary: "Stop adding headers to a tab's requests", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to reset (required)"}},
+		Status: 200, Response: models.HeadersResponse{}},
+	{Method: "GET", Path: "/api/v1/credentials", Summary: "Origins a tab answers auth challenges for", Tag: "api", Scope: models.ScopeCommand,
+		Query:  []param{{Name: "tabId", Description: "Tab to read (required)"}},
+		Status: 200, Response: models.CredentialsResponse{}},
+	{Method: "POST", Path: "/api/v1/credentials", Summary: "Answer an origin's basic or digest auth challenges in a tab", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.SetCredentialRequest{}, Status: 200, Response: models.CredentialsResponse{}},
+	{Method: "DELETE", Path: "/api/v1/credentials", Summary: "Forget a tab's credentials", Tag: "api", Scope: models.ScopeCommand,
+		Query: []param{{Name: "tabId", Description: "Tab to reset (required)"},
+			{Name: "origin", Description: "Forget only this origin's credential"}},
+		Status: 200, Response: models.CredentialsResponse{}},
+	{Method: "POST", Path: "/api/v1/form", Summary: "Fill several form fields in one command, all or none", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.FormRequest{}, Status: 200, Response: models.FormResponse{}},
+	{Method: "GET", Path: "/api/v1/macros", Summary: "List the token's macros", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.MacrosResponse{}},
+	{Method: "POST", Path: "/api/v1/macros", Summary: "Store a macro, replacing one of the same name", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.MacroRequest{}, Status: 201, Response: models.Macro{}},
+	{Method: "GET", Path: "/api/v1/macros/{name}", Summary: "Get a macro", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.Macro{}},
+	{Method: "DELETE", Path: "/api/v1/macros/{name}", Summary: "Delete a macro", Tag: "api", Scope: models.ScopeCommand,
+		Status: 204},
+	{Method: "POST", Path: "/api/v1/macros/{name}/run", Summary: "Run a macro's steps against a tab", Tag: "api",
+		Scope:   "command, and the scope of each step's kind",
+		Request: models.MacroRunRequest{}, Status: 200, Response: models.MacroRunResponse{}},
+	{Method: "GET", Path: "/api/v1/schedules", Summary: "List the token's schedules", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.SchedulesResponse{}},
+	{Method: "POST", Path: "/api/v1/schedules", Summary: "Store a cron schedule, replacing one of the same name", Tag: "api",
+		Scope:   "command, and the scope of each command the job sends",
+		Request: models.ScheduleRequest{}, Status: 201, Response: models.Schedule{}},
+	{Method: "GET", Path: "/api/v1/schedules/{name}", Summary: "Get a schedule", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.Schedule{}},
+	{Method: "DELETE", Path: "/api/v1/schedules/{name}", Summary: "Delete a schedule and its run history", Tag: "api", Scope: models.ScopeCommand,
+		Status: 204},
+	{Method: "POST", Path: "/api/v1/schedules/{name}/run", Summary: "Run a schedule now", Tag: "api", Scope: models.ScopeCommand,
+		Status: 202, Response: models.ScheduleRun{}},
+	{Method: "GET", Path: "/api/v1/schedules/{name}/runs", Summary: "List a schedule's newest runs", Tag: "api", Scope: models.ScopeRead,
+		Query:  []param{{Name: "limit", Description: "Most runs to return (default 20, at most SCHEDULE_HISTORY)"}},
+		Status: 200, Response: models.ScheduleRunsResponse{}},
+	{Method: "GET", Path: "/api/v1/rulesets", Summary: "List the token's request rule sets", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.RuleSetsResponse{}},
+	{Method: "POST", Path: "/api/v1/rulesets", Summary: "Store a request rule set, replacing one of the same name", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.RuleSetRequest{}, Status: 201, Response: models.RuleSet{}},
+	{Method: "GET", Path: "/api/v1/rulesets/{name}", Summary: "Get a request rule set", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.RuleSet{}},
+	{Method: "DELETE", Path: "/api/v1/rulesets/{name}", Summary: "Delete a request rule set", Tag: "api", Scope: models.ScopeCommand,
+		Status: 204},
+	{Method: "GET", Path: "/api/v1/pipelines", Summary: "List the token's pipelines", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.PipelinesResponse{}},
+	{Method: "POST", Path: "/api/v1/pipelines", Summary: "Store a pipeline, replacing one of the same name", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.PipelineRequest{}, Status: 201, Response: models.Pipeline{}},
+	{Method: "GET", Path: "/api/v1/pipelines/{name}", Summary: "Get a pipeline", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.Pipeline{}},
+	{Method: "DELETE", Path: "/api/v1/pipelines/{name}", Summary: "Delete a pipeline", Tag: "api", Scope: models.ScopeCommand,
+		Status: 204},
+	{Method: "POST", Path: "/api/v1/pipelines/run", Summary: "Run a pipeline given in the request against a tab", Tag: "api",
+		Scope:   "command, and the scope of each step's kind",
+		Request: models.PipelineRunRequest{}, Status: 200, Response: models.PipelineRunResponse{}},
+	{Method: "POST", Path: "/api/v1/pipelines/{name}/run", Summary: "Run a stored pipeline against a tab", Tag: "api",
+		Scope:   "command, and the scope of each step's kind",
+		Request: models.PipelineRunRequest{}, Status: 200, Response: models.PipelineRunResponse{}},
+	{Method: "POST", Path: "/api/v1/scripts", Summary: "Start recording the commands sent to a tab", Tag: "api", Scope: models.ScopeCommand,
+		Request: models.ScriptRecordRequest{}, Status: 201, Response: models.Script{}},
+	{Method: "GET", Path: "/api/v1/scripts/{id}", Summary: "Get a recorded script", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.Script{}},
+	{Method: "POST", Path: "/api/v1/scripts/{id}/stop", Summary: "Stop recording and return the script", Tag: "api", Scope: models.ScopeCommand,
+		Status: 200, Response: models.Script{}},
+	{Method: "POST", Path: "/api/v1/replay", Summary: "Replay a recorded script against a tab", Tag: "api",
+		Scope:   "command, and the scope of each step's kind",
+		Request: models.ReplayRequest{}, Status: 200, Response: models.ReplayResponse{}},
+	{Method: "GET", Path: "/api/v1/console", Summary: "Recent console messages and page errors of a tab", Tag: "api", Scope: models.ScopeRead,
+		Query: []param{
+			{Name: "tabId", Description: "Tab to read (required)"},
+			{Name: "level", Description: "Minimum level: debug, log, info, warn or error"},
+			{Name: "after", Description: "Only entries with a greater seq, to poll for new ones"},
+			{Name: "limit", Description: "Return only the newest entries"},
+		},
+		Status: 200, Response: models.ConsoleResponse{}},
+	{Method: "GET", Path: "/api/v1/events", Summary: "Stream page events of the token's tabs as server-sent events", Tag: "api", Scope: models.ScopeRead,
+		Query: []param{
+			{Name: "tabId", Description: "Only this tab's events"},
+			{Name: "types", Description: "Comma-separated event types: url_changed, title_changed, navigation_completed, dialog_opened, dom_mutated"},
+		},
+		Status: 200},
+	{Method: "GET", Path: "/api/v1/downloads", Summary: "Files downloaded in the token's tabs, newest first", Tag: "api", Scope: models.ScopeRead,
+		Query:  []param{{Name: "tabId", Description: "Only downloads of this tab"}},
+		Status: 200, Response: models.DownloadsResponse{}},
+	{Method: "GET", Path: "/api/v1/downloads/{id}", Summary: "Content of a completed download", Tag: "api", Scope: models.ScopeRead,
+		Status: 200},
+	{Method: "POST", Path: "/api/v1/batch", Summary: "Run independent tasks across sessions", Tag: "api",
+		Scope:   "depends on action kinds",
+		Request: models.BatchRequest{}, Status: 202, Response: models.BatchResponse{}},
+	{Method: "GET", Path: "/api/v1/commands/{id}", Summary: "Result of a command whose client disconnected", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.CommandRecord{}},
+	{Method: "GET", Path: "/api/v1/batch/{id}", Summary: "Get batch results", Tag: "api", Scope: models.ScopeRead,
+		Status: 200, Response: models.BatchResponse{}},
+
+	{Method: "POST", Path: "/api/v1/jobs", Summary: "Enqueue a job", Tag: "jobs", Scope: models.ScopeCommand,
+		Request: models.EnqueueJobRequest{}, Status: 201, Response: models.Job{}},
+	{Method: "POST", Path: "/api/v1/jobs/lease", Summary: "Lease the next job; 204 when the queue is empty", Tag: "jobs", Scope: models.ScopeCommand,
+		Request: models.LeaseJobRequest{}, Status: 200, Response: models.Job{}},
+	{Method: "GET", Path: "/api/v1/jobs/{id}", Summary: "Get a job", Tag: "jobs", Scope: models.ScopeRead,
+		Status: 200, Response: models.Job{}},
+	{Method: "POST", Path: "/api/v1/jobs/{id}/ack", Summary: "Complete a leased job", Tag: "jobs", Scope: models.ScopeCommand,
+		Request: models.AckJobRequest{}, Status: 204},
+	{Method: "POST", Path: "/api/v1/jobs/{id}/nack", Summary: "Release or fail a leased job", Tag: "jobs", Scope: models.ScopeCommand,
+		Request: models.NackJobRequest{}, Status: 204},
+
+	{Method: "GET", Path: "/api/v1/admin/sessions", Summary: "All connected sessions", Tag: "admin", Scope: models.ScopeAdmin,
+		Query:  []param{{Name: "activity", Description: "Set to 1 to include per-second command concurrency and queue wait"}},
+		Status: 200, Response: models.AdminSessionsResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/sessions/history", Summary: "Past sessions with per-token uptime and disconnect reasons", Tag: "admin", Scope: models.ScopeAdmin,
+		Query: []param{
+			{Name: "since", Description: "Start of the window: an RFC 3339 time, or a duration before until like 24h; default 7 days before until"},
+			{Name: "until", Description: "End of the window as an RFC 3339 time; default now"},
+			{Name: "token", Description: "Only this token's sessions, by name"},
+		},
+		Status: 200, Response: models.SessionHistoryResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/stats", Summary: "Command throughput and recent errors", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.CommandStats{}},
+	{Method: "GET", Path: "/api/v1/admin/config", Summary: "Effective configuration and where each value came from", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.ConfigResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/reload", Summary: "Reload the configuration without dropping sessions", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.ReloadResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/tokens/{id}/rotate", Summary: "Issue a new secret, keeping the old one valid for a grace period", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: models.RotateTokenRequest{}, Status: 200, Response: models.RotateTokenResponse{}},
+	{Method: "GET", Path: "/api/v1/admin/tokens/{id}/policies", Summary: "List a token's URL rules", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.PoliciesResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/tokens/{id}/policies", Summary: "Add a URL rule", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: models.PolicyRequest{}, Status: 201, Response: models.URLRule{}},
+	{Method: "DELETE", Path: "/api/v1/admin/tokens/{id}/policies/{ruleId}", Summary: "Remove a URL rule", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 204},
+	{Method: "GET", Path: "/api/v1/admin/tokens/{id}/defaults", Summary: "Get a token's action defaults", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.TokenDefaults{}},
+	{Method: "PUT", Path: "/api/v1/admin/tokens/{id}/defaults", Summary: "Replace a token's action defaults", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: models.TokenDefaults{}, Status: 200, Response: models.TokenDefaults{}},
+	{Method: "GET", Path: "/api/v1/admin/tokens/{id}/features", Summary: "Get a token's feature flag overrides", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: map[string]bool{}},
+	{Method: "PUT", Path: "/api/v1/admin/tokens/{id}/features", Summary: "Replace a token's feature flag overrides", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: map[string]bool{}, Status: 200, Response: map[string]bool{}},
+	{Method: "GET", Path: "/api/v1/admin/tokens/{id}/limits", Summary: "Get a token's rate limits", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.TokenLimits{}},
+	{Method: "PUT", Path: "/api/v1/admin/tokens/{id}/limits", Summary: "Replace a token's rate limits", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: models.TokenLimits{}, Status: 200, Response: models.TokenLimits{}},
+	{Method: "GET", Path: "/api/v1/admin/webhooks", Summary: "List webhooks, without their secrets", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.WebhooksResponse{}},
+	{Method: "POST", Path: "/api/v1/admin/webhooks", Summary: "Register a URL for relay events", Tag: "admin", Scope: models.ScopeAdmin,
+		Request: models.WebhookRequest{}, Status: 201, Response: models.Webhook{}},
+	{Method: "DELETE", Path: "/api/v1/admin/webhooks/{id}", Summary: "Remove a webhook", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 204},
+	{Method: "GET", Path: "/api/v1/admin/replication", Summary: "Replication role and lag", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.ReplicationStatus{}},
+	{Method: "GET", Path: "/api/v1/admin/replication/snapshot", Summary: "Replicated tables for a standby", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.ReplicationSnapshot{}},
+	{Method: "POST", Path: "/api/v1/admin/replication/promote", Summary: "Promote a standby to primary", Tag: "admin", Scope: models.ScopeAdmin,
+		Status: 200, Response: models.ReplicationStatus{}},
+}
+
+// Spec builds the OpenAPI document
+func Spec(version string) map[string]any {
+	components := schemas{}
+	errorSchema := components.ref(reflect.TypeOf(models.APIError{}))
+
+	paths := map[string]any{}
+	for _, op := range operations {
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+
+		o := map[string]any{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": operationID(op),
+		}
+
+		var params []any
+		for _, name := range pathParams(op.Path) {
+			params = append(params, map[string]any{
+				"name": name, "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+
+		if op.Scope != "" {
+			o["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+			o["description"] = "Required scope: " + op.Scope
+		}
+
+		if op.Request != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{"schema": components.ref(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+		if len(op.Form) > 0 {
+			props := map[string]any{}
+			for _, f := range op.Form {
+				schema := map[string]any{"type": "string", "description": f.Description}
+				if f.File {
+					schema["format"] = "binary"
+				}
+				props[f.Name] = schema
+			}
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"multipart/form-data": map[string]any{"schema": map[string]any{"type": "object", "properties": props}},
+				},
+			}
+		}
+
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		if op.Response != nil {
+			schema := components.ref(reflect.TypeOf(op.Response))
+			if op.OrResponse != nil {
+				schema = map[string]any{"oneOf": []any{schema, components.ref(reflect.TypeOf(op.OrResponse))}}
+			}
+			success["content"] = map[string]any{
+				"application/json": map[string]any{"schema": schema},
+			}
+		}
+		o["responses"] = map[string]any{
+			strconv.Itoa(op.Status): success,
+			"default": map[string]any{
+				"description": "Error",
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+			},
+		}
+
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "OwlRelay API",
+			"version":     version,
+			"description": "Control browser tabs through the OwlRelay extension.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "owl_ token"},
+			},
+		},
+	}
+}
+
+// Handler serves the OpenAPI document as JSON
+func Handler(version string) http.Handler {
+	data, err := json.MarshalIndent(Spec(version), "", "  ")
+	if err != nil {
+		panic("apidoc: " + err.Error())
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+}
+
+// UIHandler serves Swagger UI pointed at /openapi.json
+func UIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(swaggerUI))
+	})
+}
+
+func pathParams(path string) []string {
+	var names []string
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			names = append(names, seg[1:len(seg)-1])
+		}
+	}
+	return names
+}
+
+// operationID derives a stable identifier such as "postApiV1JobsIdAck"
+func operationID(op operation) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(op.Method))
+	for _, seg := range strings.Split(op.Path, "/") {
+		seg = strings.Trim(seg, "{}")
+		if seg == "" {
+			continue
+		}
+		b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+	}
+	return b.String()
+}
+
+const swaggerUI = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>OwlRelay API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: '/openapi.json', dom_id: '#swagger-ui' });
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,113 @@
+package apidoc
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	commandResultType = reflect.TypeOf((*models.CommandResult)(nil)).Elem()
+)
+
+// commandResults are the documented shapes of models.CommandResult
+var commandResults = []any{
+	models.ClickResult{}, models.TypeResult{}, models.ScrollResult{}, models.ScrollToResult{}, models.NavigateResult{},
+	models.ScreenshotResult{}, models.SnapshotResult{}, models.EvaluateResult{},
+	models.TabCreateResult{}, models.TabCloseResult{}, models.SelectResult{},
+	models.QueryResult{},
+}
+
+// schemas collects component schemas for named struct types reached while
+// describing operations
+type schemas map[string]any
+
+// ref returns a schema for t, registering named structs as components
+func (s schemas) ref(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType, t.Implements(jsonMarshalerType):
+		// Arbitrary JSON
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.ref(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.ref(t.Elem())}
+	case reflect.Interface:
+		if t == commandResultType {
+			var oneOf []any
+			for _, r := range commandResults {
+				oneOf = append(oneOf, s.ref(reflect.TypeOf(r)))
+			}
+			return map[string]any{"oneOf": oneOf}
+		}
+		return map[string]any{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			s[t.Name()] = nil // placeholder breaks recursion
+			s[t.Name()] = s.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+// object describes a struct's exported, JSON-visible fields
+func (s schemas) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = s.ref(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	return obj
+}
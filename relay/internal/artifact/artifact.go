@@ -0,0 +1,251 @@
+// Package artifact stores captured files by content hash, so identical
+// captures (common when agents poll an unchanged page) use disk once.
+// Each token has a directory of its own, so captures are never shared
+// across tokens. Each file is reference counted in the blobs table and
+// removed when its last reference is released.
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+// Store keeps artifact files under dir, named <token ID>/<sha256>.<ext>
+type Store struct {
+	dir   string
+	blobs *store.BlobStore
+
+	// mu keeps a file and its reference count consistent, so a release
+	// cannot delete a file another capture is about to reference
+	mu sync.Mutex
+
+	dedupHits  atomic.Int64
+	bytesSaved atomic.Int64
+}
+
+// Stats describes deduplication since startup and the blobs on disk
+type Stats struct {
+	DedupHits  int64
+	BytesSaved int64
+	Blobs      int64
+	Bytes      int64
+}
+
+// New creates a Store writing to dir
+func New(dir string, blobs *store.BlobStore) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	return &Store{dir: dir, blobs: blobs}, nil
+}
+
+// Put stores data for a token unless the token already stored identical
+// content, and adds a reference to it. It returns the content hash and
+// whether the content was already present.
+func (s *Store) Put(tokenID int64, data []byte, ext string) (hash string, dedup bool, err error) {
+	sum := sha256.Sum256(data)
+	hash = hex.EncodeToString(sum[:])
+	path := s.Path(tokenID, hash, ext)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		if !os.IsNotExist(err) {
+			return "", false, fmt.Errorf("failed to stat artifact: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", false, fmt.Errorf("failed to create artifact directory: %w", err)
+		}
+		// Write then rename so a reader never sees a partial file
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+		if err != nil {
+			return "", false, fmt.Errorf("failed to create artifact: %w", err)
+		}
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(tmp.Name(), 0644)
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return "", false, fmt.Errorf("failed to write artifact: %w", err)
+		}
+	}
+
+	refs, err := s.blobs.Acquire(tokenID, hash, len(data))
+	if err != nil {
+		return "", false, err
+	}
+	if refs > 1 {
+		s.dedupHits.Add(1)
+		s.bytesSaved.Add(int64(len(data)))
+		dedup = true
+	}
+	return hash, dedup, nil
+}
+
+// Release drops a reference taken by Put, removing the file once nothing
+// references it
+func (s *Store) Release(tokenID int64, hash, ext string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refs, err := s.blobs.Release(tokenID, hash)
+	if err != nil {
+		return err
+	}
+	if refs == 0 {
+		if err := os.Remove(s.Path(tokenID, hash, ext)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove artifact: %w", err)
+		}
+	}
+	return nil
+}
+
+// RemoveOrphans deletes files no blob record names, and temporary files
+// left by an interrupted Put. Files stored before captures were kept per
+// token are first moved into the directory of each token holding them. It
+// returns how many files it removed and their combined size.
+func (s *Store) RemoveOrphans() (files int, bytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known, err := s.blobs.Hashes()
+	if err != nil {
+		return 0, 0, err
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to list artifacts: %w", err)
+	}
+	remove := func(path string, entry os.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove artifact: %w", err)
+		}
+		files++
+		bytes += info.Size()
+		return nil
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(s.dir, entry.Name())
+		if !entry.IsDir() {
+			s.adopt(path, entry.Name(), known)
+			if err := remove(path, entry); err != nil {
+				return files, bytes, err
+			}
+			continue
+		}
+		tokenID, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		tokenEntries, err := os.ReadDir(path)
+		if err != nil {
+			return files, bytes, fmt.Errorf("failed to list artifacts: %w", err)
+		}
+		for _, te := range tokenEntries {
+			hash, _, _ := strings.Cut(te.Name(), ".")
+			if te.IsDir() || (!strings.HasPrefix(te.Name(), ".tmp-") && known[tokenID][hash]) {
+				continue
+			}
+			if err := remove(filepath.Join(path, te.Name()), te); err != nil {
+				return files, bytes, err
+			}
+		}
+	}
+	return files, bytes, nil
+}
+
+// adopt copies a file from the shared directory of earlier versions into
+// the directory of each token with a blob of its hash
+func (s *Store) adopt(path, name string, known map[int64]map[string]bool) {
+	hash, ext, ok := strings.Cut(name, ".")
+	if !ok || strings.HasPrefix(name, ".tmp-") {
+		return
+	}
+	for tokenID, hashes := range known {
+		if !hashes[hash] {
+			continue
+		}
+		dst := s.Path(tokenID, hash, ext)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			continue
+		}
+		// A hard link costs no space; fall back to copying across devices
+		if os.Link(path, dst) != nil {
+			copyFile(path, dst)
+		}
+	}
+}
+
+// copyFile copies through a temporary file, like Put
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), ".tmp-"+filepath.Base(dst))
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Path returns where a token's artifact with the given hash is stored
+func (s *Store) Path(tokenID int64, hash, ext string) string {
+	return filepath.Join(s.dir, strconv.FormatInt(tokenID, 10), hash+"."+ext)
+}
+
+// CheckWritable creates and removes a file in the artifact directory
+func (s *Store) CheckWritable() error {
+	f, err := os.CreateTemp(s.dir, ".tmp-check-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Stats returns deduplication counters and blob totals
+func (s *Store) Stats() (Stats, error) {
+	count, bytes, err := s.blobs.Totals()
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{
+		DedupHits:  s.dedupHits.Load(),
+		BytesSaved: s.bytesSaved.Load(),
+		Blobs:      count,
+		Bytes:      bytes,
+	}, nil
+}
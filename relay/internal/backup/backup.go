@@ -0,0 +1,152 @@
+// Package backup continuously copies the SQLite database off the host
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+)
+
+// Manager periodically snapshots the database and ships the copy to S3
+// and/or a user-supplied hook command
+type Manager struct {
+	cfg      *config.Config
+	db       *database.DB
+	uploader *s3Uploader
+
+	lastHash string
+}
+
+// New creates a backup Manager. It returns nil if no destination is
+// configured.
+func New(cfg *config.Config, db *database.DB) (*Manager, error) {
+	if cfg.BackupS3Bucket == "" && cfg.BackupHook == "" {
+		return nil, nil
+	}
+	if db.Driver().Name() != "sqlite" {
+		return nil, fmt.Errorf("backups are only supported for sqlite; use your database's own tooling for %s", db.Driver().Name())
+	}
+
+	m := &Manager{cfg: cfg, db: db}
+	if cfg.BackupS3Bucket != "" {
+		if cfg.AWSAccessKeyID == "" || cfg.AWSSecretAccessKey == "" {
+			return nil, fmt.Errorf("BACKUP_S3_BUCKET requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		m.uploader = newS3Uploader(cfg)
+	}
+	return m, nil
+}
+
+// Run takes a backup every BACKUP_INTERVAL seconds until ctx is done, and
+// once more on the way out so the final state is captured
+func (m *Manager) Run(ctx context.Context) {
+	log.Info().
+		Str("bucket", m.cfg.BackupS3Bucket).
+		Bool("hook", m.cfg.BackupHook != "").
+		Int("interval", m.cfg.BackupInterval).
+		Msg("Continuous backup enabled")
+
+	ticker := time.NewTicker(time.Duration(m.cfg.BackupInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := m.RunOnce(shutdownCtx); err != nil {
+				log.Error().Err(err).Msg("Final backup failed")
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			if err := m.RunOnce(ctx); err != nil {
+				log.Error().Err(err).Msg("Backup failed")
+			}
+		}
+	}
+}
+
+// RunOnce snapshots the database and ships it. Unchanged snapshots are
+// skipped.
+func (m *Manager) RunOnce(ctx context.Context) error {
+	dir, err := os.MkdirTemp("", "owlrelay-backup-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// VACUUM INTO writes a consistent, compacted copy without blocking
+	// readers for long
+	path := filepath.Join(dir, "owlrelay.db")
+	if _, err := m.db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+
+	hash, size, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if hash == m.lastHash {
+		log.Debug().Msg("Database unchanged; skipping backup")
+		return nil
+	}
+
+	if m.uploader != nil {
+		if err := m.uploader.upload(ctx, path, hash, size); err != nil {
+			return err
+		}
+	}
+	if m.cfg.BackupHook != "" {
+		if err := m.runHook(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	m.lastHash = hash
+	log.Info().Int64("bytes", size).Msg("Database backed up")
+	return nil
+}
+
+// runHook executes BACKUP_HOOK with {file} replaced by the snapshot path.
+// It is run directly, not through a shell, so it works in scratch images.
+func (m *Manager) runHook(ctx context.Context, path string) error {
+	args := strings.Fields(m.cfg.BackupHook)
+	for i, arg := range args {
+		args[i] = strings.ReplaceAll(arg, "{file}", path)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "OWLRELAY_BACKUP_FILE="+path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("backup hook failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
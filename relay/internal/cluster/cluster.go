@@ -0,0 +1,447 @@
+// Package cluster lets several relays behind a load balancer act as one.
+// Each relay publishes the extension sessions connected to it in Redis; a
+// command for a session held by another relay is forwarded to it over HTTP
+// and the response routed back.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/redis"
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
+)
+
+const keyPrefix = "owlrelay:cluster:"
+
+// ErrNodeUnavailable is returned when the relay holding a session cannot be reached
+var ErrNodeUnavailable = &hub.HubError{Code: "NODE_UNAVAILABLE", Message: "Relay holding the session is unreachable"}
+
+// Node is this relay's membership in the cluster. It implements hub.Cluster.
+//
+// Registry layout, all entries expiring after three missed heartbeats:
+//
+//	owlrelay:cluster:node:<id>             advertised URL of a live relay
+//	owlrelay:cluster:sessions:<tokenHash>  hash of session ID -> session JSON
+type Node struct {
+	cfg    *config.Config
+	hub    *hub.Hub
+	redis  *redis.Client
+	client *http.Client
+	ttl    time.Duration
+
+	// Tokens whose sessions changed since they were last published
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+
+	// Session IDs this relay has in the registry, per token; owned by Run
+	published map[string]map[string]bool
+}
+
+// forwardRequest is the body of POST /internal/cluster/command
+type forwardRequest struct {
+	TokenHash string                 `json:"tokenHash"`
+	SessionID string                 `json:"sessionId"`
+	Command   *models.CommandRequest `json:"command"`
+}
+
+// New joins the cluster, or returns nil if CLUSTER_ENABLED is not set
+func New(cfg *config.Config, h *hub.Hub) (*Node, error) {
+	if !cfg.ClusterEnabled {
+		return nil, nil
+	}
+
+	client, err := redis.New(cfg.RedisURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+
+	n := &Node{
+		cfg:   cfg,
+		hub:   h,
+		redis: client,
+		// Commands carry their own deadline; this only catches a wedged peer
+		client:    &http.Client{Timeout: time.Duration(cfg.HTTPTimeoutMax) * time.Second},
+		ttl:       3 * time.Duration(cfg.ClusterHeartbeat) * time.Second,
+		pending:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		published: make(map[string]map[string]bool),
+	}
+	h.SetCluster(n)
+	return n, nil
+}
+
+// NodeID identifies this relay
+func (n *Node) NodeID() string {
+	return n.cfg.ClusterNodeID
+}
+
+// Changed queues the token's local sessions for publishing
+func (n *Node) Changed(tokenHash string) {
+	n.mu.Lock()
+	n.pending[tokenHash] = true
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes this relay and its sessions until ctx ends, then removes them
+func (n *Node) Run(ctx context.Context) {
+	log.Info().
+		Str("node", n.NodeID()).
+		Str("url", n.cfg.ClusterAdvertiseURL).
+		Msg("Joined cluster")
+
+	ticker := time.NewTicker(time.Duration(n.cfg.ClusterHeartbeat) * time.Second)
+	defer ticker.Stop()
+
+	n.heartbeat(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			n.leave()
+			return
+		case <-n.wake:
+			n.mu.Lock()
+			tokens := n.pending
+			n.pending = make(map[string]bool)
+			n.mu.Unlock()
+
+			for tokenHash := range tokens {
+				if err := n.publish(ctx, tokenHash); err != nil {
+					log.Warn().Err(err).Msg("Failed to publish cluster sessions")
+				}
+			}
+		case <-ticker.C:
+			n.heartbeat(ctx)
+		}
+	}
+}
+
+// heartbeat refreshes this relay's node key and republishes every token
+func (n *Node) heartbeat(ctx context.Context) {
+	if _, err := n.redis.Do(ctx, "SET", keyPrefix+"node:"+n.NodeID(), n.cfg.ClusterAdvertiseURL,
+		"PX", n.ttl.Milliseconds()); err != nil {
+		log.Warn().Err(err).Msg("Cluster heartbeat failed")
+		return
+	}
+
+	tokens := make(map[string]bool)
+	for _, tokenHash := range n.hub.LocalTokens() {
+		tokens[tokenHash] = true
+	}
+	for tokenHash := range n.published {
+		tokens[tokenHash] = true
+	}
+	for tokenHash := range tokens {
+		if err := n.publish(ctx, tokenHash); err != nil {
+			log.Warn().Err(err).Msg("Failed to publish cluster sessions")
+			return
+		}
+	}
+}
+
+// publish writes the token's local sessions to the registry and removes
+// the ones that have gone away
+func (n *Node) publish(ctx context.Context, tokenHash string) error {
+	key := keyPrefix + "sessions:" + tokenHash
+	previous := n.published[tokenHash]
+	current := make(map[string]bool)
+
+	hset := []any{"HSET", key}
+	for _, s := range n.hub.LocalSessions(tokenHash) {
+		data, err := json.Marshal(snapshot(s))
+		if err != nil {
+			return err
+		}
+		hset = append(hset, s.ID, data)
+		current[s.ID] = true
+	}
+
+	if len(current) > 0 {
+		if _, err := n.redis.Do(ctx, hset...); err != nil {
+			return err
+		}
+		if _, err := n.redis.Do(ctx, "PEXPIRE", key, n.ttl.Milliseconds()); err != nil {
+			return err
+		}
+	}
+
+	hdel := []any{"HDEL", key}
+	for id := range previous {
+		if !current[id] {
+			hdel = append(hdel, id)
+		}
+	}
+	if len(hdel) > 2 {
+		if _, err := n.redis.Do(ctx, hdel...); err != nil {
+			return err
+		}
+	}
+
+	if len(current) == 0 {
+		delete(n.published, tokenHash)
+	} else {
+		n.published[tokenHash] = current
+	}
+	return nil
+}
+
+// leave removes this relay from the registry so peers stop routing to it
+// without waiting for its entries to expire
+func (n *Node) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for tokenHash, ids := range n.published {
+		hdel := []any{"HDEL", keyPrefix + "sessions:" + tokenHash}
+		for id := range ids {
+			hdel = append(hdel, id)
+		}
+		n.redis.Do(ctx, hdel...)
+	}
+	n.redis.Do(ctx, "DEL", keyPrefix+"node:"+n.NodeID())
+	n.redis.Close()
+
+	log.Info().Str("node", n.NodeID()).Msg("Left cluster")
+}
+
+// snapshot copies a session for publishing without holding its tab lock
+// while marshalling
+func snapshot(s *models.Session) *models.Session {
+	tabs := make(map[string]*models.Tab)
+	for _, tab := range s.TabList() {
+		tabs[tab.ID] = tab
+	}
+	name, extensionVer, client := s.Info()
+	return &models.Session{
+		ID:           s.ID,
+		TokenName:    s.TokenName,
+		Tabs:         tabs,
+		ExtensionVer: extensionVer,
+		Name:         name,
+		Client:       client,
+		Window:       s.CurrentWindow(),
+		Canary:       s.IsCanary(),
+		ConnectedAt:  s.ConnectedAt,
+		LastPingAt:   s.LastPingAt,
+		Node:         s.Node,
+	}
+}
+
+// Sessions returns the token's sessions held by other live relays, oldest
+// first. Registry errors are logged and treated as no remote sessions.
+func (n *Node) Sessions(ctx context.Context, tokenHash string) []*models.Session {
+	sessions, err := n.remoteSessions(ctx, tokenHash)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read cluster sessions")
+		return nil
+	}
+
+	live := make([]*models.Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.url != "" {
+			live = append(live, s.Session)
+		}
+	}
+	return live
+}
+
+type remoteSession struct {
+	*models.Session
+	url string // empty if the holding relay is gone
+}
+
+func (n *Node) remoteSessions(ctx context.Context, tokenHash string) ([]remoteSession, error) {
+	reply, err := n.redis.Do(ctx, "HGETALL", keyPrefix+"sessions:"+tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := reply.([]any)
+
+	var sessions []remoteSession
+	nodes := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		data, _ := fields[i+1].(string)
+		var s models.Session
+		if err := json.Unmarshal([]byte(data), &s); err != nil || s.Node == "" || s.Node == n.NodeID() {
+			continue
+		}
+		s.TokenHash = tokenHash
+		sessions = append(sessions, remoteSession{Session: &s})
+		nodes[s.Node] = ""
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+
+	// Only sessions on relays that are still heartbeating count
+	mget := []any{"MGET"}
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		mget = append(mget, keyPrefix+"node:"+id)
+		ids = append(ids, id)
+	}
+	reply, err = n.redis.Do(ctx, mget...)
+	if err != nil {
+		return nil, err
+	}
+	urls, _ := reply.([]any)
+	for i, id := range ids {
+		if i < len(urls) {
+			nodes[id], _ = urls[i].(string)
+		}
+	}
+	for i := range sessions {
+		sessions[i].url = nodes[sessions[i].Node]
+	}
+	return sessions, nil
+}
+
+// Forward runs cmd on a session held by another relay
+func (n *Node) Forward(ctx context.Context, tokenHash, sessionID string, cmd *models.CommandRequest) (*models.CommandResponse, error) {
+	sessions, err := n.remoteSessions(ctx, tokenHash)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to read cluster sessions")
+		return nil, ErrNodeUnavailable
+	}
+	var target *remoteSession
+	for i := range sessions {
+		if sessions[i].ID == sessionID {
+			target = &sessions[i]
+			break
+		}
+	}
+	if target == nil || target.url == "" {
+		return nil, hub.ErrNotConnected
+	}
+
+	body, err := json.Marshal(forwardRequest{TokenHash: tokenHash, SessionID: sessionID, Command: cmd})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(target.url, "/")+"/internal/cluster/command", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.cfg.ClusterSecret)
+	req.Header.Set("Content-Type", "application/json")
+	if traceparent := tracing.FromContext(ctx).TraceParent(); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
+
+	httpResp, err := n.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Warn().Err(err).Str("node", target.Node).Msg("Failed to forward command")
+		return nil, ErrNodeUnavailable
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(httpResp.Body, 64<<10))
+		if json.Unmarshal(data, &apiErr) != nil || apiErr.Error.Code == "" {
+			log.Warn().Int("status", httpResp.StatusCode).Str("node", target.Node).Msg("Peer rejected forwarded command")
+			return nil, ErrNodeUnavailable
+		}
+		return nil, hubError(apiErr.Error.Code, apiErr.Error.Message)
+	}
+
+	var resp models.CommandResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", target.Node, err)
+	}
+	return &resp, nil
+}
+
+// hubError maps an error code from a peer back to the hub's sentinel
+// errors, so callers comparing against them keep working
+func hubError(code, message string) error {
+	for _, e := range []*hub.HubError{hub.ErrNotConnected, hub.ErrTimeout, hub.ErrShuttingDown, hub.ErrDuplicateID} {
+		if e.Code == code {
+			return e
+		}
+	}
+	return &hub.HubError{Code: code, Message: message}
+}
+
+// Handler serves commands forwarded by peer relays. Requests must carry
+// CLUSTER_SECRET as a bearer token.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /command", n.serveCommand)
+	return http.StripPrefix("/internal/cluster", mux)
+}
+
+func (n *Node) serveCommand(w http.ResponseWriter, r *http.Request) {
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(n.cfg.ClusterSecret)) != 1 {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid cluster secret")
+		return
+	}
+
+	// Forwarded uploads carry their files base64-encoded
+	if n.cfg.MaxRequestBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, n.cfg.MaxRequestBody+(n.cfg.UploadMaxSize+2)/3*4)
+	}
+
+	var req forwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Command == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid forwarded command")
+		return
+	}
+
+	resp, err := n.hub.SendLocal(r.Context(), req.TokenHash, req.SessionID, req.Command)
+	if err != nil {
+		if hubErr, ok := err.(*hub.HubError); ok {
+			status := http.StatusServiceUnavailable
+			if hubErr.Code == hub.ErrTimeout.Code {
+				status = http.StatusGatewayTimeout
+			}
+			writeError(w, status, hubErr.Code, hubErr.Message)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": code, "message": message}})
+}
@@ -2,64 +2,789 @@
 package config
 
 import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/features"
+	"github.com/emreylmaz/owlrelay/relay/internal/protocol"
 )
 
 // Config holds all configuration values
 type Config struct {
+	// The config file the values not set in the environment came from, if
+	// any (--config or OWLRELAY_CONFIG)
+	File string `ignored:"true"`
+
+	// Guards the settings Reload changes while the relay runs; see
+	// reloadable
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+	onReload []func(*Config)
+
 	// Server
 	Port     int    `envconfig:"PORT" default:"3000"`
 	Host     string `envconfig:"HOST" default:"0.0.0.0"`
 	LogLevel string `envconfig:"LOG_LEVEL" default:"info"`
 
+	// One JSON line per request, in the server log or, with
+	// ACCESS_LOG_FILE, a file of its own ("stdout" for standard output)
+	AccessLog     bool   `envconfig:"ACCESS_LOG" default:"true"`
+	AccessLogFile string `envconfig:"ACCESS_LOG_FILE"`
+
+	// Origins browsers may call the API from, comma-separated; "*" for any
+	CORSOrigins string `envconfig:"CORS_ORIGINS" default:"*"`
+
+	// Listeners overrides HOST/PORT with one or more addresses, each
+	// optionally limited to route groups: "0.0.0.0:3000,[::]:3000" or
+	// ":3000=ws+api,127.0.0.1:3001=admin". "unix:/run/owlrelay.sock" is a
+	// Unix domain socket, created with UNIX_SOCKET_MODE permissions.
+	Listeners       string      `envconfig:"LISTENERS"`
+	AdminAddr       string      `envconfig:"ADMIN_ADDR"` // moves admin, metrics, and debug routes to this address
+	UnixSocketMode  string      `envconfig:"UNIX_SOCKET_MODE" default:"0660"`
+	ParsedListeners []Listener  `ignored:"true"`
+	SocketMode      os.FileMode `ignored:"true"`
+
+	// TLS for every listener, from certificate files or obtained
+	// automatically over ACME for DOMAIN (one or the other)
+	TLSCert       string `envconfig:"TLS_CERT"` // PEM certificate chain
+	TLSKey        string `envconfig:"TLS_KEY"`  // PEM private key
+	Domain        string `envconfig:"DOMAIN"`   // comma-separated host names to request certificates for
+	ACMEEmail     string `envconfig:"ACME_EMAIL"`
+	ACMEDirectory string `envconfig:"ACME_DIRECTORY"` // defaults to Let's Encrypt production
+	ACMECacheDir  string `envconfig:"ACME_CACHE_DIR" default:"./data/acme"`
+	ACMEHTTPAddr  string `envconfig:"ACME_HTTP_ADDR"` // serves HTTP-01 challenges and redirects to HTTPS
+
 	// Database
-	DBPath string `envconfig:"DB_PATH" default:"./data/owlrelay.db"`
+	DBDriver string `envconfig:"DB_DRIVER" default:"sqlite"` // sqlite or postgres
+	DBPath   string `envconfig:"DB_PATH" default:"./data/owlrelay.db"`
+	DBDSN    string `envconfig:"DB_DSN" redact:"url"` // postgres connection string; overrides DB_PATH for sqlite
 
 	// Screenshots
 	ScreenshotPath    string `envconfig:"SCREENSHOT_PATH" default:"./data/screenshots"`
-	ScreenshotTTL     int    `envconfig:"SCREENSHOT_TTL" default:"30"`      // seconds
-	MaxScreenshotSize int    `envconfig:"MAX_SCREENSHOT_SIZE" default:"10"` // MB
+	ScreenshotTTL     int    `envconfig:"SCREENSHOT_TTL" default:"30"`        // seconds
+	ScreenshotHistory int    `envconfig:"SCREENSHOT_HISTORY" default:"86400"` // seconds to keep screenshot records
+	MaxScreenshotSize int    `envconfig:"MAX_SCREENSHOT_SIZE" default:"10"`   // MB
+
+	// Most disk saved screenshots may use, in MB (0 for no limit), and how
+	// often expired ones are released, in seconds
+	ScreenshotMaxDisk       int `envconfig:"SCREENSHOT_MAX_DISK" default:"0"`
+	ScreenshotSweepInterval int `envconfig:"SCREENSHOT_SWEEP_INTERVAL" default:"5"`
+
+	// Key signing screenshot URLs (random per start when unset), and
+	// whether each URL may be fetched only once
+	ScreenshotURLSecret    string `envconfig:"SCREENSHOT_URL_SECRET" redact:"true"`
+	ScreenshotURLSingleUse bool   `envconfig:"SCREENSHOT_URL_SINGLE_USE" default:"true"`
+
+	// Screenshots captured at once (0 for no limit), and how long others
+	// wait for a turn before failing with 503
+	ScreenshotConcurrency  int `envconfig:"SCREENSHOT_CONCURRENCY" default:"4"`
+	ScreenshotQueueTimeout int `envconfig:"SCREENSHOT_QUEUE_TIMEOUT" default:"10000"` // ms
+
+	// Most captures one burst screenshot may take; 0 disables bursts
+	ScreenshotBurstMax int `envconfig:"SCREENSHOT_BURST_MAX" default:"10"`
+
+	// Per-token worker pools, so one busy token cannot slow the others:
+	// commands one token may be sending to its extension at once (uploads
+	// included), and screenshots and frames it may be capturing and storing
+	// at once. 0 for no limit.
+	TokenDispatchWorkers int `envconfig:"TOKEN_DISPATCH_WORKERS" default:"4"`
+	TokenArtifactWorkers int `envconfig:"TOKEN_ARTIFACT_WORKERS" default:"2"`
+
+	// Commands one token may have awaiting a response (0 for no limit), and
+	// how many more may wait in line, for up to TOKEN_QUEUE_TIMEOUT ms,
+	// before failing with QUEUE_FULL
+	TokenMaxInflight  int `envconfig:"TOKEN_MAX_INFLIGHT" default:"0"`
+	TokenQueueDepth   int `envconfig:"TOKEN_QUEUE_DEPTH" default:"100"`
+	TokenQueueTimeout int `envconfig:"TOKEN_QUEUE_TIMEOUT" default:"30000"`
+
+	// Seconds a rotated token's old secret keeps working, unless the
+	// rotation asks for another grace period
+	TokenRotationGrace int `envconfig:"TOKEN_ROTATION_GRACE" default:"86400"`
+
+	// JWTs from an OIDC issuer, accepted on the REST API besides owl_
+	// tokens. Each acts as the token its OIDC_TOKEN_CLAIM names (or
+	// OIDC_DEFAULT_TOKEN), limited to the scopes in OIDC_SCOPE_CLAIM that
+	// carry OIDC_SCOPE_PREFIX.
+	OIDCIssuer       string `envconfig:"OIDC_ISSUER"`   // e.g. https://login.example.com
+	OIDCAudience     string `envconfig:"OIDC_AUDIENCE"` // required "aud" value
+	OIDCJWKSURL      string `envconfig:"OIDC_JWKS_URL"` // default: jwks_uri from the issuer's discovery document
+	OIDCTokenClaim   string `envconfig:"OIDC_TOKEN_CLAIM" default:"owlrelay_token"`
+	OIDCDefaultToken string `envconfig:"OIDC_DEFAULT_TOKEN"`
+	OIDCScopeClaim   string `envconfig:"OIDC_SCOPE_CLAIM" default:"scope"`
+	OIDCScopePrefix  string `envconfig:"OIDC_SCOPE_PREFIX" default:"owlrelay:"`
+
+	// Recordings
+	RecordingsPath       string `envconfig:"RECORDINGS_PATH" default:"./data/recordings"`
+	RecordingTTL         int    `envconfig:"RECORDING_TTL" default:"86400"`        // seconds to keep an archive after it is written
+	RecordingMaxDuration int    `envconfig:"RECORDING_MAX_DURATION" default:"600"` // seconds
+
+	// Screencast frame rate; capturing is slow in the browser, so keep it low
+	ScreencastFPS    float64 `envconfig:"SCREENCAST_FPS" default:"2"`     // frames per second without ?fps=
+	ScreencastMaxFPS float64 `envconfig:"SCREENCAST_MAX_FPS" default:"5"` // highest ?fps= allowed
 
 	// Rate Limiting
-	RateLimitDefault int `envconfig:"RATE_LIMIT_DEFAULT" default:"100"` // requests per minute
+	RateLimitDefault int    `envconfig:"RATE_LIMIT_DEFAULT" default:"100"`    // requests per window for new tokens
+	RateLimitBurst   int    `envconfig:"RATE_LIMIT_BURST" default:"0"`        // burst for new tokens; 0 means the limit
+	RateLimitWindow  int    `envconfig:"RATE_LIMIT_WINDOW" default:"60"`      // seconds
+	RateLimitBackend string `envconfig:"RATE_LIMIT_BACKEND" default:"memory"` // memory or redis
+	RedisURL         string `envconfig:"REDIS_URL" redact:"url"`              // redis://[[user]:password@]host:port[/db]
+
+	// Soft limits: warn past this share of a bucket (0 disables), and let
+	// new tokens overdraw an empty bucket by RATE_LIMIT_DEBT requests
+	RateLimitWarnPercent int `envconfig:"RATE_LIMIT_WARN_PERCENT" default:"80"`
+	RateLimitDebt        int `envconfig:"RATE_LIMIT_DEBT" default:"0"`
+
+	// Per-IP limits on the endpoints reachable without a token (/ws and
+	// the health endpoints): requests per minute with a burst (0 disables), and
+	// WebSocket handshakes in progress at once (0 disables)
+	IPRateLimit          int `envconfig:"IP_RATE_LIMIT" default:"120"`
+	IPRateBurst          int `envconfig:"IP_RATE_BURST" default:"30"`
+	WSMaxHandshakesPerIP int `envconfig:"WS_MAX_HANDSHAKES_PER_IP" default:"8"`
+
+	// Proxies, comma-separated addresses or CIDR ranges, whose
+	// X-Forwarded-For and X-Real-IP give the client address. Other peers'
+	// headers are ignored, so clients cannot pick the IP they are limited
+	// as.
+	TrustedProxies string `envconfig:"TRUSTED_PROXIES"`
 
 	// WebSocket
-	WSPingInterval    int `envconfig:"WS_PING_INTERVAL" default:"30"`    // seconds
-	WSPongTimeout     int `envconfig:"WS_PONG_TIMEOUT" default:"10"`     // seconds
-	WSWriteTimeout    int `envconfig:"WS_WRITE_TIMEOUT" default:"10"`    // seconds
+	WSPingInterval    int `envconfig:"WS_PING_INTERVAL" default:"30"` // seconds
+	WSPongTimeout     int `envconfig:"WS_PONG_TIMEOUT" default:"10"`  // seconds
+	WSWriteTimeout    int `envconfig:"WS_WRITE_TIMEOUT" default:"10"` // seconds
 	WSReadBufferSize  int `envconfig:"WS_READ_BUFFER_SIZE" default:"1024"`
 	WSWriteBufferSize int `envconfig:"WS_WRITE_BUFFER_SIZE" default:"1024"`
+	WSMaxMessageSize  int `envconfig:"WS_MAX_MESSAGE_SIZE" default:"16777216"` // bytes per inbound message, 16MB
+
+	// Extensions whose connect message cannot speak this protocol version
+	// are refused
+	WSMinProtocolVersion int `envconfig:"WS_MIN_PROTOCOL_VERSION" default:"1"`
+
+	// permessage-deflate for extensions that offer it; outbound messages
+	// smaller than the threshold are sent uncompressed
+	WSCompression          bool `envconfig:"WS_COMPRESSION" default:"false"`
+	WSCompressionLevel     int  `envconfig:"WS_COMPRESSION_LEVEL" default:"1"`        // -2 (Huffman only) to 9
+	WSCompressionThreshold int  `envconfig:"WS_COMPRESSION_THRESHOLD" default:"1024"` // bytes
+
+	// Whether extensions may negotiate binary frames in the connect handshake
+	WSBinaryFrames bool `envconfig:"WS_BINARY_FRAMES" default:"true"`
+
+	// How often each extension is asked to resend its tab list, and how long
+	// a tab it has not reported on is kept (0 disables either)
+	TabSyncInterval int `envconfig:"TAB_SYNC_INTERVAL" default:"300"` // seconds
+	TabTTL          int `envconfig:"TAB_TTL" default:"0"`             // seconds
+
+	// Inbound WebSocket limits per connection (0 disables)
+	WSMaxMessagesPerSec int `envconfig:"WS_MAX_MESSAGES_PER_SEC" default:"200"`
+	WSMaxBytesPerSec    int `envconfig:"WS_MAX_BYTES_PER_SEC" default:"16777216"` // 16MB
+	WSRateLimitStrikes  int `envconfig:"WS_RATE_LIMIT_STRIKES" default:"3"`       // consecutive seconds over limit before disconnect
+
+	// Files downloaded in attached tabs
+	DownloadsPath   string `envconfig:"DOWNLOADS_PATH" default:"./data/downloads"`
+	DownloadTTL     int    `envconfig:"DOWNLOAD_TTL" default:"3600"`          // seconds to keep a download
+	DownloadMaxSize int64  `envconfig:"DOWNLOAD_MAX_SIZE" default:"52428800"` // bytes per file, 50MB; 0 disables collection
+
+	// Seconds a command recording is kept after its last command or after
+	// it stops
+	ScriptTTL int `envconfig:"SCRIPT_TTL" default:"3600"`
+
+	// Webhook delivery: seconds per attempt, attempts before giving up, and
+	// deliveries waiting to be sent before new events are dropped
+	WebhookTimeout     int `envconfig:"WEBHOOK_TIMEOUT" default:"10"`
+	WebhookMaxAttempts int `envconfig:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+	WebhookQueueSize   int `envconfig:"WEBHOOK_QUEUE_SIZE" default:"1000"`
+
+	// Console messages kept per tab (0 disables console collection)
+	ConsoleBufferSize int `envconfig:"CONSOLE_BUFFER_SIZE" default:"200"`
+
+	// Most bytes of localStorage/sessionStorage keys and values read or
+	// written by one request
+	StorageMaxSize int `envconfig:"STORAGE_MAX_SIZE" default:"1048576"`
+
+	// Largest serialized value POST /api/v1/evaluate returns; larger ones
+	// are cut to a preview
+	EvaluateMaxResult int `envconfig:"EVALUATE_MAX_RESULT" default:"1048576"` // bytes
+
+	// Largest total size of the files in one POST /api/v1/upload
+	UploadMaxSize int64 `envconfig:"UPLOAD_MAX_SIZE" default:"10485760"` // 10MB
+
+	// HTTP request bodies
+	MaxRequestBody int64 `envconfig:"MAX_REQUEST_BODY" default:"1048576"` // bytes, 0 disables
+
+	// Sessions
+	MaxSessionsPerToken int `envconfig:"MAX_SESSIONS_PER_TOKEN" default:"1"`
+	SessionHistory      int `envconfig:"SESSION_HISTORY" default:"7776000"` // seconds to keep ended sessions, 0 forever
+
+	// Schedules
+	ScheduleHistory       int `envconfig:"SCHEDULE_HISTORY" default:"100"`          // runs kept per schedule
+	ScheduleScreenshotTTL int `envconfig:"SCHEDULE_SCREENSHOT_TTL" default:"86400"` // seconds a scheduled screenshot stays downloadable
 
 	// Command
-	CommandTimeout int `envconfig:"COMMAND_TIMEOUT" default:"30000"` // milliseconds
+	CommandTimeout      int    `envconfig:"COMMAND_TIMEOUT" default:"30000"`          // milliseconds
+	CommandOnDisconnect string `envconfig:"COMMAND_ON_DISCONNECT" default:"complete"` // cancel or complete
+	CommandResultTTL    int    `envconfig:"COMMAND_RESULT_TTL" default:"600"`         // seconds to keep results of disconnected commands
+
+	// Commands on browser-internal, extension, and file:// pages: deny,
+	// flag (run them but log a warning), or allow
+	PrivilegedURLs string `envconfig:"PRIVILEGED_URLS" default:"deny"`
+
+	// HTTP request deadlines. A command request may run for its command
+	// timeout plus the overhead; no request runs longer than the max.
+	HTTPTimeoutOverhead int `envconfig:"HTTP_TIMEOUT_OVERHEAD" default:"5"` // seconds
+	HTTPTimeoutMax      int `envconfig:"HTTP_TIMEOUT_MAX" default:"300"`    // seconds
+
+	// Shutdown
+	ShutdownDrainTimeout int `envconfig:"SHUTDOWN_DRAIN_TIMEOUT" default:"30"` // seconds to wait for in-flight commands
+
+	// Whether /readyz fails until at least one extension is connected
+	ReadyRequireExtension bool `envconfig:"READY_REQUIRE_EXTENSION"`
+
+	// Batch dispatch
+	BatchMaxTasks  int `envconfig:"BATCH_MAX_TASKS" default:"100"`
+	BatchResultTTL int `envconfig:"BATCH_RESULT_TTL" default:"3600"` // seconds
+
+	// Work queue
+	JobLeaseTimeout int `envconfig:"JOB_LEASE_TIMEOUT" default:"60"` // seconds
+	JobMaxAttempts  int `envconfig:"JOB_MAX_ATTEMPTS" default:"3"`
+	JobMaxWait      int `envconfig:"JOB_MAX_WAIT" default:"30"` // seconds, long-poll ceiling
+
+	// Replication
+	Role                string `envconfig:"RELAY_ROLE" default:"primary"`     // primary or standby
+	PrimaryURL          string `envconfig:"PRIMARY_URL"`                      // standby: base URL of the primary
+	ReplicationToken    string `envconfig:"REPLICATION_TOKEN" redact:"true"`  // standby: admin token on the primary
+	ReplicationInterval int    `envconfig:"REPLICATION_INTERVAL" default:"5"` // seconds
+
+	// Cluster mode: relays share session ownership through REDIS_URL and
+	// forward commands to the relay holding the extension
+	ClusterEnabled      bool   `envconfig:"CLUSTER_ENABLED"`
+	ClusterNodeID       string `envconfig:"CLUSTER_NODE_ID"`               // defaults to the hostname
+	ClusterAdvertiseURL string `envconfig:"CLUSTER_ADVERTISE_URL"`         // base URL peers reach this relay on
+	ClusterSecret       string `envconfig:"CLUSTER_SECRET" redact:"true"`  // shared by all relays
+	ClusterHeartbeat    int    `envconfig:"CLUSTER_HEARTBEAT" default:"5"` // seconds
+
+	// Continuous SQLite backup (enabled when a bucket or hook is set)
+	BackupInterval     int    `envconfig:"BACKUP_INTERVAL" default:"60"` // seconds
+	BackupS3Bucket     string `envconfig:"BACKUP_S3_BUCKET"`
+	BackupS3Prefix     string `envconfig:"BACKUP_S3_PREFIX"`
+	BackupS3Region     string `envconfig:"BACKUP_S3_REGION" default:"us-east-1"`
+	BackupS3Endpoint   string `envconfig:"BACKUP_S3_ENDPOINT"` // for S3-compatible stores
+	BackupHook         string `envconfig:"BACKUP_HOOK"`        // command run with {file} set to the snapshot
+	AWSAccessKeyID     string `envconfig:"AWS_ACCESS_KEY_ID"`
+	AWSSecretAccessKey string `envconfig:"AWS_SECRET_ACCESS_KEY" redact:"true"`
+	AWSSessionToken    string `envconfig:"AWS_SESSION_TOKEN" redact:"true"`
 
 	// Snapshot defaults
 	DefaultSnapshotMaxDepth  int `envconfig:"DEFAULT_SNAPSHOT_MAX_DEPTH" default:"10"`
 	DefaultSnapshotMaxLength int `envconfig:"DEFAULT_SNAPSHOT_MAX_LENGTH" default:"102400"` // 100KB
+
+	// Canary sessions: extension versions (comma-separated, a trailing *
+	// matches a prefix) or connect labels that mark a session as canary,
+	// and the percentage of its commands run with new protocol features
+	CanaryVersions string `envconfig:"CANARY_VERSIONS"`
+	CanaryLabels   string `envconfig:"CANARY_LABELS"`
+	CanaryPercent  int    `envconfig:"CANARY_PERCENT" default:"100"`
+
+	// Experimental features enabled for every token, comma-separated;
+	// tokens can override each one
+	Features        string          `envconfig:"FEATURES"`
+	EnabledFeatures map[string]bool `ignored:"true"`
+
+	// OpenTelemetry tracing, off unless an OTLP/HTTP collector is set:
+	// its base URL, headers sent with each export (key=value,...), and the
+	// share of new traces recorded
+	OTLPEndpoint      string            `envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT"` // e.g. http://collector:4318
+	OTLPHeaders       string            `envconfig:"OTEL_EXPORTER_OTLP_HEADERS" redact:"true"`
+	OTELServiceName   string            `envconfig:"OTEL_SERVICE_NAME" default:"owlrelay"`
+	OTELSampleRatio   float64           `envconfig:"OTEL_TRACES_SAMPLER_ARG" default:"1"`
+	ParsedOTLPHeaders map[string]string `ignored:"true"`
 }
 
-// Load reads configuration from environment variables
+// Load reads configuration from environment variables and the config file
+// OWLRELAY_CONFIG names, if any
 func Load() (*Config, error) {
-	cfg := &Config{}
+	return LoadFile(os.Getenv(FileEnv))
+}
+
+// LoadFile reads the configuration from a YAML or TOML file, or none for
+// "", with environment variables overriding it
+func LoadFile(path string) (*Config, error) {
+	if err := applyFile(path); err != nil {
+		return nil, err
+	}
+	cfg := &Config{File: path}
 	if err := envconfig.Process("", cfg); err != nil {
 		return nil, err
 	}
 
-	// Ensure directories exist
-	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0755); err != nil {
+	listeners, err := parseListeners(cfg.Listeners, cfg.Host, cfg.Port, cfg.AdminAddr)
+	if err != nil {
 		return nil, err
 	}
+	cfg.ParsedListeners = listeners
+	mode, err := strconv.ParseUint(cfg.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return nil, fmt.Errorf("UNIX_SOCKET_MODE must be an octal permission such as 0660, got %q", cfg.UnixSocketMode)
+	}
+	cfg.SocketMode = os.FileMode(mode)
+
+	if cfg.EnabledFeatures, err = features.Parse(cfg.Features); err != nil {
+		return nil, fmt.Errorf("invalid FEATURES: %w", err)
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		if u, err := url.Parse(cfg.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT must be an http or https URL, got %q", cfg.OTLPEndpoint)
+		}
+	}
+	cfg.ParsedOTLPHeaders = make(map[string]string)
+	for _, pair := range strings.Split(cfg.OTLPHeaders, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS must be key=value pairs separated by commas")
+		}
+		// Values may be percent-encoded, as in the OpenTelemetry SDKs
+		if unescaped, err := url.PathUnescape(strings.TrimSpace(v)); err == nil {
+			v = unescaped
+		}
+		cfg.ParsedOTLPHeaders[strings.TrimSpace(k)] = v
+	}
+	if cfg.OTELSampleRatio < 0 || cfg.OTELSampleRatio > 1 {
+		return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1, got %g", cfg.OTELSampleRatio)
+	}
+
+	if cfg.OIDCIssuer != "" {
+		if u, err := url.Parse(cfg.OIDCIssuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("OIDC_ISSUER must be an http or https URL, got %q", cfg.OIDCIssuer)
+		}
+		if cfg.OIDCAudience == "" {
+			return nil, fmt.Errorf("OIDC_AUDIENCE is required with OIDC_ISSUER")
+		}
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if cfg.TLSCert != "" && cfg.Domain != "" {
+		return nil, fmt.Errorf("set either TLS_CERT/TLS_KEY or DOMAIN, not both")
+	}
+	if cfg.ACMEHTTPAddr != "" {
+		if cfg.Domain == "" {
+			return nil, fmt.Errorf("ACME_HTTP_ADDR requires DOMAIN")
+		}
+		if _, _, err := net.SplitHostPort(cfg.ACMEHTTPAddr); err != nil {
+			return nil, fmt.Errorf("invalid ACME_HTTP_ADDR %q: %w", cfg.ACMEHTTPAddr, err)
+		}
+	}
+
+	if cfg.WSMinProtocolVersion < protocol.MinVersion || cfg.WSMinProtocolVersion > protocol.Version {
+		return nil, fmt.Errorf("WS_MIN_PROTOCOL_VERSION must be between %d and %d, got %d",
+			protocol.MinVersion, protocol.Version, cfg.WSMinProtocolVersion)
+	}
+	if cfg.WSCompressionLevel < -2 || cfg.WSCompressionLevel > 9 {
+		return nil, fmt.Errorf("WS_COMPRESSION_LEVEL must be between -2 and 9, got %d", cfg.WSCompressionLevel)
+	}
+	if cfg.WSMaxMessageSize <= 0 {
+		return nil, fmt.Errorf("WS_MAX_MESSAGE_SIZE must be positive, got %d", cfg.WSMaxMessageSize)
+	}
+	if cfg.WSMaxBytesPerSec > 0 && cfg.WSMaxBytesPerSec < cfg.WSMaxMessageSize {
+		// A single maximum-size message would always be dropped
+		return nil, fmt.Errorf("WS_MAX_BYTES_PER_SEC (%d) must be at least WS_MAX_MESSAGE_SIZE (%d)",
+			cfg.WSMaxBytesPerSec, cfg.WSMaxMessageSize)
+	}
+
+	if cfg.IPRateLimit < 0 || cfg.IPRateBurst < 0 || cfg.WSMaxHandshakesPerIP < 0 {
+		return nil, fmt.Errorf("IP_RATE_LIMIT, IP_RATE_BURST and WS_MAX_HANDSHAKES_PER_IP must not be negative")
+	}
+	if _, err := cfg.Proxies(); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimitWarnPercent < 0 || cfg.RateLimitWarnPercent > 100 {
+		return nil, fmt.Errorf("RATE_LIMIT_WARN_PERCENT must be between 0 and 100, got %d", cfg.RateLimitWarnPercent)
+	}
+	if cfg.RateLimitDebt < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_DEBT must not be negative, got %d", cfg.RateLimitDebt)
+	}
+
+	if cfg.ConsoleBufferSize < 0 {
+		return nil, fmt.Errorf("CONSOLE_BUFFER_SIZE must not be negative, got %d", cfg.ConsoleBufferSize)
+	}
+
+	if cfg.ScreenshotConcurrency < 0 || cfg.ScreenshotQueueTimeout < 0 {
+		return nil, fmt.Errorf("SCREENSHOT_CONCURRENCY and SCREENSHOT_QUEUE_TIMEOUT must not be negative, got %d and %d",
+			cfg.ScreenshotConcurrency, cfg.ScreenshotQueueTimeout)
+	}
+	if cfg.ScreenshotMaxDisk < 0 {
+		return nil, fmt.Errorf("SCREENSHOT_MAX_DISK must not be negative, got %d", cfg.ScreenshotMaxDisk)
+	}
+	if cfg.ScreenshotSweepInterval <= 0 {
+		return nil, fmt.Errorf("SCREENSHOT_SWEEP_INTERVAL must be positive, got %d", cfg.ScreenshotSweepInterval)
+	}
+	if cfg.ScreenshotBurstMax < 0 {
+		return nil, fmt.Errorf("SCREENSHOT_BURST_MAX must not be negative, got %d", cfg.ScreenshotBurstMax)
+	}
+	if cfg.TokenDispatchWorkers < 0 || cfg.TokenArtifactWorkers < 0 {
+		return nil, fmt.Errorf("TOKEN_DISPATCH_WORKERS and TOKEN_ARTIFACT_WORKERS must not be negative, got %d and %d",
+			cfg.TokenDispatchWorkers, cfg.TokenArtifactWorkers)
+	}
+	if cfg.TokenMaxInflight < 0 || cfg.TokenQueueDepth < 0 {
+		return nil, fmt.Errorf("TOKEN_MAX_INFLIGHT and TOKEN_QUEUE_DEPTH must not be negative, got %d and %d",
+			cfg.TokenMaxInflight, cfg.TokenQueueDepth)
+	}
+	if cfg.TabSyncInterval < 0 || cfg.TabTTL < 0 {
+		return nil, fmt.Errorf("TAB_SYNC_INTERVAL and TAB_TTL must not be negative, got %d and %d",
+			cfg.TabSyncInterval, cfg.TabTTL)
+	}
+	if cfg.TabTTL > 0 && (cfg.TabSyncInterval == 0 || cfg.TabSyncInterval >= cfg.TabTTL) {
+		return nil, fmt.Errorf("TAB_TTL (%ds) must be longer than TAB_SYNC_INTERVAL (%ds), or idle tabs expire between syncs",
+			cfg.TabTTL, cfg.TabSyncInterval)
+	}
+	if cfg.SessionHistory < 0 {
+		return nil, fmt.Errorf("SESSION_HISTORY must not be negative, got %d", cfg.SessionHistory)
+	}
+	if cfg.ScheduleHistory < 1 {
+		return nil, fmt.Errorf("SCHEDULE_HISTORY must be at least 1, got %d", cfg.ScheduleHistory)
+	}
+	if cfg.ScheduleScreenshotTTL < 1 {
+		return nil, fmt.Errorf("SCHEDULE_SCREENSHOT_TTL must be at least 1, got %d", cfg.ScheduleScreenshotTTL)
+	}
+	if cfg.TokenRotationGrace < 0 {
+		return nil, fmt.Errorf("TOKEN_ROTATION_GRACE must not be negative, got %d", cfg.TokenRotationGrace)
+	}
+	if cfg.TokenQueueTimeout <= 0 {
+		return nil, fmt.Errorf("TOKEN_QUEUE_TIMEOUT must be positive, got %d", cfg.TokenQueueTimeout)
+	}
+
+	if cfg.CanaryPercent < 0 || cfg.CanaryPercent > 100 {
+		return nil, fmt.Errorf("CANARY_PERCENT must be between 0 and 100, got %d", cfg.CanaryPercent)
+	}
+
+	if cfg.UploadMaxSize <= 0 {
+		return nil, fmt.Errorf("UPLOAD_MAX_SIZE must be positive, got %d", cfg.UploadMaxSize)
+	}
+	if cfg.StorageMaxSize <= 0 {
+		return nil, fmt.Errorf("STORAGE_MAX_SIZE must be positive, got %d", cfg.StorageMaxSize)
+	}
+	if cfg.ScriptTTL <= 0 {
+		return nil, fmt.Errorf("SCRIPT_TTL must be positive, got %d", cfg.ScriptTTL)
+	}
+	if cfg.WebhookTimeout <= 0 || cfg.WebhookMaxAttempts <= 0 || cfg.WebhookQueueSize <= 0 {
+		return nil, fmt.Errorf("WEBHOOK_TIMEOUT, WEBHOOK_MAX_ATTEMPTS and WEBHOOK_QUEUE_SIZE must be positive")
+	}
+	if cfg.EvaluateMaxResult <= 0 {
+		return nil, fmt.Errorf("EVALUATE_MAX_RESULT must be positive, got %d", cfg.EvaluateMaxResult)
+	}
+
+	if cfg.ScreencastFPS <= 0 || cfg.ScreencastMaxFPS < cfg.ScreencastFPS {
+		return nil, fmt.Errorf("SCREENCAST_FPS must be positive and at most SCREENCAST_MAX_FPS, got %g and %g",
+			cfg.ScreencastFPS, cfg.ScreencastMaxFPS)
+	}
+
+	if cfg.RecordingTTL <= 0 || cfg.RecordingMaxDuration <= 0 {
+		return nil, fmt.Errorf("RECORDING_TTL and RECORDING_MAX_DURATION must be positive")
+	}
+
+	if cfg.DownloadTTL <= 0 || cfg.DownloadMaxSize < 0 {
+		return nil, fmt.Errorf("DOWNLOAD_TTL must be positive and DOWNLOAD_MAX_SIZE must not be negative")
+	}
+
+	if cfg.CommandOnDisconnect != "cancel" && cfg.CommandOnDisconnect != "complete" {
+		return nil, fmt.Errorf("COMMAND_ON_DISCONNECT must be cancel or complete, got %q", cfg.CommandOnDisconnect)
+	}
+
+	switch cfg.PrivilegedURLs {
+	case "deny", "flag", "allow":
+	default:
+		return nil, fmt.Errorf("PRIVILEGED_URLS must be deny, flag or allow, got %q", cfg.PrivilegedURLs)
+	}
+
+	if cfg.RateLimitWindow <= 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_WINDOW must be positive, got %d", cfg.RateLimitWindow)
+	}
+
+	switch cfg.RateLimitBackend {
+	case "memory":
+	case "redis":
+		if cfg.RedisURL == "" {
+			return nil, fmt.Errorf("RATE_LIMIT_BACKEND=redis requires REDIS_URL")
+		}
+	default:
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND must be memory or redis, got %q", cfg.RateLimitBackend)
+	}
+
+	if cfg.ClusterEnabled {
+		if cfg.RedisURL == "" || cfg.ClusterAdvertiseURL == "" || cfg.ClusterSecret == "" {
+			return nil, fmt.Errorf("CLUSTER_ENABLED requires REDIS_URL, CLUSTER_ADVERTISE_URL and CLUSTER_SECRET")
+		}
+		// A URL signed by one relay may be fetched from another
+		if cfg.ScreenshotURLSecret == "" {
+			return nil, fmt.Errorf("CLUSTER_ENABLED requires SCREENSHOT_URL_SECRET, the same on every relay")
+		}
+		if cfg.ClusterNodeID == "" {
+			if cfg.ClusterNodeID, err = os.Hostname(); err != nil {
+				return nil, fmt.Errorf("CLUSTER_NODE_ID not set and hostname unavailable: %w", err)
+			}
+		}
+	}
+
+	if cfg.CommandTimeout > cfg.MaxCommandTimeout() {
+		return nil, fmt.Errorf("COMMAND_TIMEOUT %dms exceeds HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD (%dms)",
+			cfg.CommandTimeout, cfg.MaxCommandTimeout())
+	}
+
+	// Ensure directories exist
+	if cfg.DBDriver == "sqlite" && cfg.DBDSN == "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0755); err != nil {
+			return nil, err
+		}
+	}
 	if err := os.MkdirAll(cfg.ScreenshotPath, 0755); err != nil {
 		return nil, err
 	}
+	if err := os.MkdirAll(cfg.RecordingsPath, 0755); err != nil {
+		return nil, err
+	}
+	if cfg.DownloadMaxSize > 0 {
+		if err := os.MkdirAll(cfg.DownloadsPath, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Domain != "" {
+		// Holds account and certificate keys
+		if err := os.MkdirAll(cfg.ACMECacheDir, 0700); err != nil {
+			return nil, err
+		}
+	}
 
 	return cfg, nil
 }
 
+// MaxCommandTimeout is the longest command timeout, in milliseconds, that
+// still finishes within HTTP_TIMEOUT_MAX
+func (c *Config) MaxCommandTimeout() int {
+	return (c.HTTPTimeoutMax - c.HTTPTimeoutOverhead) * 1000
+}
+
+// RequestTimeout is how long an HTTP request running a command with the
+// given timeout (ms) may take
+func (c *Config) RequestTimeout(commandTimeout int) time.Duration {
+	d := time.Duration(commandTimeout)*time.Millisecond + time.Duration(c.HTTPTimeoutOverhead)*time.Second
+	return min(d, time.Duration(c.HTTPTimeoutMax)*time.Second)
+}
+
+// Route groups a listener can serve. /health, /healthz and /readyz are
+// served on every listener.
+const (
+	RoutesWS      = "ws"      // extension WebSocket endpoint
+	RoutesAPI     = "api"     // /api/v1 (except admin) and /screenshots
+	RoutesAdmin   = "admin"   // /api/v1/admin and /dashboard
+	RoutesMetrics = "metrics" // /metrics (unauthenticated)
+	RoutesDebug   = "debug"   // /debug/pprof (unauthenticated)
+	RoutesCluster = "cluster" // /internal/cluster, for peer relays (CLUSTER_SECRET)
+)
+
+// AllRoutes is the default route set for a listener. Metrics and debug are
+// unauthenticated, so they are only served where explicitly requested.
+var AllRoutes = []string{RoutesWS, RoutesAPI, RoutesAdmin, RoutesCluster}
+
+// AdminRoutes are served on ADMIN_ADDR
+var AdminRoutes = []string{RoutesAdmin, RoutesMetrics, RoutesDebug}
+
+// Listener is one address the server binds
+type Listener struct {
+	Addr   string
+	Routes []string
+}
+
+// Serves reports whether the listener exposes a route group
+func (l Listener) Serves(group string) bool {
+	for _, r := range l.Routes {
+		if r == group {
+			return true
+		}
+	}
+	return false
+}
+
+// unixPrefix marks a listener address as a Unix domain socket path
+const unixPrefix = "unix:"
+
+// SocketPath returns the path of a Unix domain socket listener
+func (l Listener) SocketPath() (string, bool) {
+	return strings.CutPrefix(l.Addr, unixPrefix)
+}
+
+// Network returns "tcp4" or "tcp6" for literal IP hosts so that 0.0.0.0 and
+// [::] on the same port can be bound side by side, "unix" for sockets, and
+// "tcp" otherwise
+func (l Listener) Network() string {
+	if _, ok := l.SocketPath(); ok {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+func parseListeners(spec, host string, port int, adminAddr string) ([]Listener, error) {
+	listeners, err := parseListenerSpec(spec, host, port)
+	if err != nil {
+		return nil, err
+	}
+	if adminAddr == "" {
+		return listeners, nil
+	}
+
+	if err := checkListenAddr(adminAddr); err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_ADDR %q: %w", adminAddr, err)
+	}
+
+	// Admin-only groups move off every other listener
+	for i, l := range listeners {
+		if l.Addr == adminAddr {
+			return nil, fmt.Errorf("ADMIN_ADDR %s is also a listener", adminAddr)
+		}
+		var routes []string
+		for _, r := range l.Routes {
+			if r != RoutesAdmin && r != RoutesMetrics && r != RoutesDebug {
+				routes = append(routes, r)
+			}
+		}
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("listener %s only serves admin routes; drop it or ADMIN_ADDR", l.Addr)
+		}
+		listeners[i].Routes = routes
+	}
+
+	return append(listeners, Listener{Addr: adminAddr, Routes: AdminRoutes}), nil
+}
+
+func parseListenerSpec(spec, host string, port int) ([]Listener, error) {
+	if strings.TrimSpace(spec) == "" {
+		return []Listener{{Addr: net.JoinHostPort(host, strconv.Itoa(port)), Routes: AllRoutes}}, nil
+	}
+
+	var listeners []Listener
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		addr, routes, hasRoutes := strings.Cut(entry, "=")
+		if err := checkListenAddr(addr); err != nil {
+			return nil, fmt.Errorf("invalid listener address %q: %w", addr, err)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate listener address %q", addr)
+		}
+		seen[addr] = true
+
+		l := Listener{Addr: addr, Routes: AllRoutes}
+		if hasRoutes {
+			l.Routes = nil
+			for _, group := range strings.Split(routes, "+") {
+				switch group {
+				case RoutesWS, RoutesAPI, RoutesAdmin, RoutesMetrics, RoutesDebug, RoutesCluster:
+					l.Routes = append(l.Routes, group)
+				default:
+					return nil, fmt.Errorf("unknown route group %q for listener %s", group, addr)
+				}
+			}
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("LISTENERS is set but contains no addresses")
+	}
+	return listeners, nil
+}
+
+// checkListenAddr accepts host:port and unix:/absolute/path
+func checkListenAddr(addr string) error {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("socket path must be absolute")
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// DatabaseDSN returns the connection string for the configured driver
+func (c *Config) DatabaseDSN() string {
+	if c.DBDSN != "" {
+		return c.DBDSN
+	}
+	return c.DBPath
+}
+
+// TLSEnabled reports whether listeners serve HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCert != "" || c.Domain != ""
+}
+
+// Domains returns the host names in DOMAIN
+func (c *Config) Domains() []string {
+	var domains []string
+	for _, d := range strings.Split(c.Domain, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// Proxies returns the ranges in TRUSTED_PROXIES; a bare address is a
+// range of one
+func (c *Config) Proxies() ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, p := range strings.Split(c.TrustedProxies, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: invalid address %q", p)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: invalid CIDR range %q", p)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
 // GetLogLevel returns the zerolog log level
 func (c *Config) GetLogLevel() zerolog.Level {
 	switch c.LogLevel {
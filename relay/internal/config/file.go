@@ -0,0 +1,420 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FileEnv names the config file when --config is not given
+const FileEnv = "OWLRELAY_CONFIG"
+
+// A config file sets the same settings as the environment, under the same
+// names in any case; sections join their names on with underscores, so
+//
+//	redis:
+//	  url: redis://cache:6379
+//
+// in YAML, or [redis] with url = "..." in TOML, sets REDIS_URL. Lists become
+// comma-separated values. Environment variables win over the file.
+
+// fromFile holds the variables the last loaded file set, unset again
+// before the next load so a value removed from the file does not linger
+var fromFile = map[string]bool{}
+
+// applyFile puts the file's settings into the environment, except where a
+// variable is already set there; "" applies no file
+func applyFile(path string) error {
+	var values map[string]string
+	if path != "" {
+		var err error
+		if values, err = ReadFile(path); err != nil {
+			return err
+		}
+	}
+
+	for key := range fromFile {
+		os.Unsetenv(key)
+	}
+	fromFile = map[string]bool{}
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, value)
+		fromFile[key] = true
+	}
+	return nil
+}
+
+// ReadFile parses a YAML (.yaml, .yml) or TOML (.toml) config file into
+// environment variable names and values, rejecting names the relay does
+// not know
+func ReadFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	case ".toml":
+		values, err = parseTOML(data)
+	default:
+		return nil, fmt.Errorf("config file %s must end in .yaml, .yml, or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s:%w", path, err)
+	}
+
+	known := envNames()
+	for key := range values {
+		if !known[key] {
+			return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+	}
+	return values, nil
+}
+
+// envNames returns the environment variables Config reads
+func envNames() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf((*Config)(nil)).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("envconfig"); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// settingName turns a key path into its environment variable name
+func settingName(path []string) string {
+	name := strings.Join(path, "_")
+	name = strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	return strings.ToUpper(name)
+}
+
+// lineError is a parse error at a line of the file
+func lineError(line int, format string, args ...any) error {
+	return fmt.Errorf("%d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// parseYAML reads the YAML the config file needs: nested mappings, scalars
+// (plain or quoted), and lists in either block or flow style. Anchors,
+// multi-line strings, and multiple documents are not supported.
+func parseYAML(data []byte) (map[string]string, error) {
+	type mapping struct {
+		indent int
+		path   []string
+	}
+	values := make(map[string]string)
+	stack := []mapping{{indent: 0}}
+
+	// A key with nothing after the colon opens a block list or mapping
+	var open []string
+	openIndent, openLine := 0, 0
+	var list []string
+	listIndent := -1
+	closeList := func() {
+		values[settingName(open)] = strings.Join(list, ",")
+		open, list, listIndent = nil, nil, -1
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		raw := strings.TrimRight(stripComment(scanner.Text()), " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" || (n == 1 && text == "---") {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, lineError(n, "indent with spaces, not tabs")
+		}
+		indent := len(raw) - len(text)
+
+		if text == "-" || strings.HasPrefix(text, "- ") {
+			if open == nil || indent < openIndent || (listIndent >= 0 && indent != listIndent) {
+				return nil, lineError(n, "unexpected list item")
+			}
+			item, err := yamlScalar(strings.TrimSpace(text[1:]), n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+			listIndent = indent
+			continue
+		}
+
+		switch {
+		case list != nil:
+			closeList()
+		case open != nil && indent > openIndent:
+			stack = append(stack, mapping{indent: indent, path: open})
+			open = nil
+		case open != nil:
+			return nil, lineError(openLine, "%s has no value", open[len(open)-1])
+		}
+		for indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, lineError(n, "inconsistent indentation")
+		}
+
+		key, value, ok := strings.Cut(text, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, lineError(n, "expected key: value")
+		}
+		key, err := yamlScalar(strings.TrimSpace(key), n)
+		if err != nil || key == "" {
+			return nil, lineError(n, "invalid key")
+		}
+		path := append(append([]string{}, stack[len(stack)-1].path...), key)
+		if _, dup := values[settingName(path)]; dup {
+			return nil, lineError(n, "%s is set twice", settingName(path))
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			open, openIndent, openLine = path, indent, n
+		case value[0] == '|' || value[0] == '>':
+			return nil, lineError(n, "multi-line strings are not supported")
+		case value[0] == '&' || value[0] == '*':
+			return nil, lineError(n, "anchors and aliases are not supported")
+		case value[0] == '{':
+			return nil, lineError(n, "flow mappings are not supported")
+		case value[0] == '[':
+			items, err := flowList(value, n, yamlScalar)
+			if err != nil {
+				return nil, err
+			}
+			values[settingName(path)] = strings.Join(items, ",")
+		default:
+			if values[settingName(path)], err = yamlScalar(value, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case list != nil:
+		closeList()
+	case open != nil:
+		return nil, lineError(openLine, "%s has no value", open[len(open)-1])
+	}
+	return values, nil
+}
+
+// yamlScalar unquotes a YAML scalar
+func yamlScalar(s string, line int) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", lineError(line, "invalid quoted string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", lineError(line, "invalid quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "~" || s == "null":
+		return "", nil
+	}
+	return s, nil
+}
+
+// parseTOML reads the TOML the config file needs: tables, dotted keys,
+// strings, numbers, booleans, and single-line arrays. Inline tables,
+// multi-line strings, and arrays of tables are not supported.
+func parseTOML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	var table []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "[") {
+			if strings.HasPrefix(text, "[[") {
+				return nil, lineError(n, "arrays of tables are not supported")
+			}
+			if !strings.HasSuffix(text, "]") {
+				return nil, lineError(n, "invalid table header")
+			}
+			var err error
+			if table, err = tomlKey(text[1:len(text)-1], n); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, lineError(n, "expected key = value")
+		}
+		path, err := tomlKey(key, n)
+		if err != nil {
+			return nil, err
+		}
+		name := settingName(append(append([]string{}, table...), path...))
+		if _, dup := values[name]; dup {
+			return nil, lineError(n, "%s is set twice", name)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, "{"):
+			return nil, lineError(n, "inline tables are not supported")
+		case strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''"):
+			return nil, lineError(n, "multi-line strings are not supported")
+		case strings.HasPrefix(value, "["):
+			items, err := flowList(value, n, tomlValue)
+			if err != nil {
+				return nil, err
+			}
+			values[name] = strings.Join(items, ",")
+		default:
+			if values[name], err = tomlValue(value, n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// tomlKey splits a possibly dotted, possibly quoted TOML key
+func tomlKey(s string, line int) ([]string, error) {
+	var path []string
+	for _, part := range splitOutsideQuotes(s, '.') {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, `"`) || strings.HasPrefix(part, "'") {
+			v, err := tomlValue(part, line)
+			if err != nil {
+				return nil, err
+			}
+			part = v
+		}
+		if part == "" {
+			return nil, lineError(line, "invalid key %q", strings.TrimSpace(s))
+		}
+		path = append(path, part)
+	}
+	return path, nil
+}
+
+// tomlValue converts a TOML string, number, or boolean to its text
+func tomlValue(s string, line int) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", lineError(line, "invalid string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") || strings.Contains(s[1:len(s)-1], "'") {
+			return "", lineError(line, "invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	// Numbers may use underscores between digits
+	number := strings.ReplaceAll(s, "_", "")
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		return "", lineError(line, "invalid value %s; quote strings", s)
+	}
+	return number, nil
+}
+
+// flowList parses a one-line [a, b] list, converting each item with scalar
+func flowList(s string, line int, scalar func(string, int) (string, error)) ([]string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, lineError(line, "lists must close on the line they open")
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	items := []string{}
+	if inner == "" {
+		return items, nil
+	}
+	for _, part := range splitOutsideQuotes(inner, ',') {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			// A trailing comma
+			continue
+		}
+		if strings.HasPrefix(part, "[") || strings.HasPrefix(part, "{") {
+			return nil, lineError(line, "nested lists are not supported")
+		}
+		item, err := scalar(part, line)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// splitOutsideQuotes splits s at each sep that is not inside quotes
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripComment removes a # comment that is not inside quotes
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
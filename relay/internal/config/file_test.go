@@ -0,0 +1,216 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "scalars",
+			input: "port: 4000\nlog_level: 'debug'\nhost: \"0.0.0.0\"\n",
+			want:  map[string]string{"PORT": "4000", "LOG_LEVEL": "debug", "HOST": "0.0.0.0"},
+		},
+		{
+			name:  "nested sections",
+			input: "---\nredis:\n  url: redis://cache:6379\ncluster:\n  node-id: a\n  heartbeat: 5\nport: 4000\n",
+			want:  map[string]string{"REDIS_URL": "redis://cache:6379", "CLUSTER_NODE_ID": "a", "CLUSTER_HEARTBEAT": "5", "PORT": "4000"},
+		},
+		{
+			name:  "deeper nesting",
+			input: "backup:\n  s3:\n    bucket: b\n    region: eu-west-1\n  interval: 30\n",
+			want:  map[string]string{"BACKUP_S3_BUCKET": "b", "BACKUP_S3_REGION": "eu-west-1", "BACKUP_INTERVAL": "30"},
+		},
+		{
+			name:  "block list",
+			input: "trusted_proxies:\n  - 10.0.0.0/8\n  - \"192.168.0.0/16\"\nport: 4000\n",
+			want:  map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,192.168.0.0/16", "PORT": "4000"},
+		},
+		{
+			name:  "block list at the key's indent",
+			input: "trusted_proxies:\n- 10.0.0.0/8\n- 172.16.0.0/12\n",
+			want:  map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,172.16.0.0/12"},
+		},
+		{
+			name:  "flow list",
+			input: "trusted_proxies: [10.0.0.0/8, '172.16.0.0/12', ]\nfeatures: []\n",
+			want:  map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,172.16.0.0/12", "FEATURES": ""},
+		},
+		{
+			name:  "comments",
+			input: "# relay settings\nport: 4000 # the API\nredis:\n  # shared cache\n  url: \"redis://h:6379/#0\"\nhost: a#b\n",
+			want:  map[string]string{"PORT": "4000", "REDIS_URL": "redis://h:6379/#0", "HOST": "a#b"},
+		},
+		{
+			name:  "null",
+			input: "redis_url: ~\n",
+			want:  map[string]string{"REDIS_URL": ""},
+		},
+		{name: "duplicate key", input: "port: 1\nport: 2\n", wantErr: "2: PORT is set twice"},
+		{name: "duplicate across spellings", input: "redis_url: a\nredis:\n  url: b\n", wantErr: "3: REDIS_URL is set twice"},
+		{name: "key without value", input: "redis:\nport: 1\n", wantErr: "1: redis has no value"},
+		{name: "key without value at the end", input: "port: 1\nredis:\n", wantErr: "2: redis has no value"},
+		{name: "tabs", input: "redis:\n\turl: a\n", wantErr: "2: indent with spaces"},
+		{name: "inconsistent indentation", input: "redis:\n    url: a\n  db: 1\n", wantErr: "3: inconsistent indentation"},
+		{name: "stray list item", input: "port: 1\n- a\n", wantErr: "2: unexpected list item"},
+		{name: "missing colon", input: "port 4000\n", wantErr: "1: expected key: value"},
+		{name: "multi-line string", input: "host: |\n  a\n", wantErr: "1: multi-line strings"},
+		{name: "anchor", input: "host: &h a\n", wantErr: "1: anchors and aliases"},
+		{name: "flow mapping", input: "redis: {url: a}\n", wantErr: "1: flow mappings"},
+		{name: "unclosed flow list", input: "features: [a,\n  b]\n", wantErr: "1: lists must close"},
+		{name: "nested flow list", input: "features: [[a]]\n", wantErr: "1: nested lists"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.input))
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:  "scalars",
+			input: "port = 4_000\nlog_level = 'debug'\nhost = \"0.0.0.0\"\ncluster_enabled = true\n",
+			want:  map[string]string{"PORT": "4000", "LOG_LEVEL": "debug", "HOST": "0.0.0.0", "CLUSTER_ENABLED": "true"},
+		},
+		{
+			name:  "tables",
+			input: "port = 4000\n[redis]\nurl = \"redis://cache:6379\"\n[backup.s3]\nbucket = \"b\"\n",
+			want:  map[string]string{"PORT": "4000", "REDIS_URL": "redis://cache:6379", "BACKUP_S3_BUCKET": "b"},
+		},
+		{
+			name:  "dotted and quoted keys",
+			input: "cluster.node-id = \"a\"\n\"otel\".service_name = \"relay\"\n",
+			want:  map[string]string{"CLUSTER_NODE_ID": "a", "OTEL_SERVICE_NAME": "relay"},
+		},
+		{
+			name:  "arrays",
+			input: "trusted_proxies = [\"10.0.0.0/8\", '172.16.0.0/12',]\nfeatures = []\n",
+			want:  map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,172.16.0.0/12", "FEATURES": ""},
+		},
+		{
+			name:  "comments",
+			input: "# relay settings\nport = 4000 # the API\n[redis] # shared cache\nurl = \"redis://h:6379/#0\"\n",
+			want:  map[string]string{"PORT": "4000", "REDIS_URL": "redis://h:6379/#0"},
+		},
+		{name: "duplicate key", input: "port = 1\nport = 2\n", wantErr: "2: PORT is set twice"},
+		{name: "duplicate across a table", input: "redis_url = \"a\"\n[redis]\nurl = \"b\"\n", wantErr: "3: REDIS_URL is set twice"},
+		{name: "bare string", input: "host = localhost\n", wantErr: "1: invalid value localhost; quote strings"},
+		{name: "missing equals", input: "port 4000\n", wantErr: "1: expected key = value"},
+		{name: "empty key", input: "redis. = 1\n", wantErr: "1: invalid key"},
+		{name: "invalid table header", input: "[redis\n", wantErr: "1: invalid table header"},
+		{name: "array of tables", input: "[[listeners]]\n", wantErr: "1: arrays of tables"},
+		{name: "inline table", input: "redis = { url = \"a\" }\n", wantErr: "1: inline tables"},
+		{name: "multi-line string", input: "host = \"\"\"a\n", wantErr: "1: multi-line strings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.input))
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func checkParse(t *testing.T, got map[string]string, err error, want map[string]string, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("got error %v, want one containing %q", err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "yaml", file: "relay.yaml", content: "port: 4000\n", want: map[string]string{"PORT": "4000"}},
+		{name: "yml", file: "relay.yml", content: "port: 4000\n", want: map[string]string{"PORT": "4000"}},
+		{name: "toml", file: "relay.TOML", content: "port = 4000\n", want: map[string]string{"PORT": "4000"}},
+		{name: "unknown key", file: "relay.yaml", content: "port: 4000\nprot: 1\n", wantErr: "unknown setting PROT"},
+		{name: "unknown section", file: "relay.toml", content: "[redis]\nhost = \"a\"\n", wantErr: "unknown setting REDIS_HOST"},
+		{name: "unknown extension", file: "relay.json", content: "{}", wantErr: "must end in .yaml, .yml, or .toml"},
+		{name: "parse error names the file", file: "relay.yaml", content: "port 4000\n", wantErr: "relay.yaml:1: expected key: value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadFile(path)
+			checkParse(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestLoadFileEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.yaml")
+	content := "port: 5000\nlog_level: debug\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PORT", "4000")
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "relay.db"))
+	os.Unsetenv("LOG_LEVEL")
+	t.Cleanup(func() { applyFile("") })
+
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if cfg.Port != 4000 {
+		t.Errorf("Port = %d, want 4000 from the environment", cfg.Port)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("LogLevel = %q, want debug from the file", cfg.LogLevel)
+	}
+
+	sources := map[string]string{}
+	for _, s := range cfg.Settings() {
+		sources[s.Name] = s.Source
+	}
+	for name, want := range map[string]string{"PORT": SourceEnv, "LOG_LEVEL": SourceFile, "HOST": SourceDefault} {
+		if sources[name] != want {
+			t.Errorf("%s source = %q, want %q", name, sources[name], want)
+		}
+	}
+
+	// A value removed from the file does not linger from the last load
+	if err := os.WriteFile(path, []byte("port: 5000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if cfg.LogLevel != "info" {
+		t.Errorf("LogLevel = %q after removing it from the file, want the default", cfg.LogLevel)
+	}
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// reloadable are the settings Reload applies to a running relay; the rest
+// take effect on restart
+var reloadable = map[string]bool{
+	"LOG_LEVEL":               true,
+	"COMMAND_TIMEOUT":         true,
+	"RATE_LIMIT_WINDOW":       true,
+	"RATE_LIMIT_WARN_PERCENT": true,
+	"CORS_ORIGINS":            true,
+}
+
+// OnReload has fn called with the configuration after each Reload that
+// changed a reloadable setting. Call it before the server starts.
+func (c *Config) OnReload(fn func(*Config)) {
+	c.onReload = append(c.onReload, fn)
+}
+
+// Reload reads the environment and config file again and applies the
+// reloadable settings that changed. Changed settings that need a restart
+// are reported but left alone. An invalid configuration changes nothing.
+func (c *Config) Reload() (*models.ReloadResponse, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	next, err := LoadFile(c.File)
+	if err != nil {
+		return nil, err
+	}
+	// Checked against the running HTTP_TIMEOUT_MAX, which needs a restart
+	if next.CommandTimeout > c.MaxCommandTimeout() {
+		return nil, fmt.Errorf("COMMAND_TIMEOUT (%dms) exceeds HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD (%dms)",
+			next.CommandTimeout, c.MaxCommandTimeout())
+	}
+
+	resp := &models.ReloadResponse{Applied: []string{}, RestartRequired: []string{}}
+	c.mu.RLock()
+	cur, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		name := cur.Type().Field(i).Tag.Get("envconfig")
+		if name == "" || reflect.DeepEqual(cur.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if reloadable[name] {
+			resp.Applied = append(resp.Applied, name)
+		} else {
+			resp.RestartRequired = append(resp.RestartRequired, name)
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(resp.Applied) > 0 {
+		c.mu.Lock()
+		c.LogLevel = next.LogLevel
+		c.CommandTimeout = next.CommandTimeout
+		c.RateLimitWindow = next.RateLimitWindow
+		c.RateLimitWarnPercent = next.RateLimitWarnPercent
+		c.CORSOrigins = next.CORSOrigins
+		c.mu.Unlock()
+
+		zerolog.SetGlobalLevel(next.GetLogLevel())
+		for _, fn := range c.onReload {
+			fn(c)
+		}
+	}
+
+	log.Info().
+		Strs("applied", resp.Applied).
+		Strs("restart_required", resp.RestartRequired).
+		Msg("Configuration reloaded")
+	return resp, nil
+}
+
+// DefaultCommandTimeout is COMMAND_TIMEOUT, in milliseconds, as of the last
+// reload
+func (c *Config) DefaultCommandTimeout() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.CommandTimeout
+}
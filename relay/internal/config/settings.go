@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Where a setting's value came from
+const (
+	SourceEnv     = "env"
+	SourceFile    = "file" // the config file
+	SourceDefault = "default"
+	SourceDerived = "derived" // filled in by Load, e.g. CLUSTER_NODE_ID from the hostname
+)
+
+// redactedValue replaces secrets in Settings
+const redactedValue = "[redacted]"
+
+// dsnPassword matches the password of a key=value connection string
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// Settings returns every environment setting with its effective value and
+// source. Fields tagged redact:"true" are hidden when set; redact:"url"
+// hides only the password of a URL or connection string.
+func (c *Config) Settings() []models.ConfigSetting {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	settings := make([]models.ConfigSetting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("envconfig")
+		if name == "" {
+			continue
+		}
+
+		s := models.ConfigSetting{
+			Name:    name,
+			Value:   v.Field(i).Interface(),
+			Default: field.Tag.Get("default"),
+			Source:  SourceDefault,
+		}
+		if fromFile[name] {
+			s.Source = SourceFile
+		} else if _, ok := os.LookupEnv(name); ok {
+			s.Source = SourceEnv
+		} else if current := fmtValue(v.Field(i)); current != s.Default {
+			s.Source = SourceDerived
+		}
+
+		if str, ok := s.Value.(string); ok && str != "" {
+			switch field.Tag.Get("redact") {
+			case "true":
+				s.Value, s.Redacted = redactedValue, true
+			case "url":
+				if redacted := redactURL(str); redacted != str {
+					s.Value, s.Redacted = redacted, true
+				}
+			}
+		}
+		settings = append(settings, s)
+	}
+	return settings
+}
+
+// fmtValue renders a field the way its default tag is written
+func fmtValue(v reflect.Value) string {
+	if v.Kind() == reflect.Bool && !v.Bool() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// redactURL hides the password in a URL or key=value connection string
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(s, "${1}"+redactedValue)
+}
@@ -0,0 +1,115 @@
+// Package contentproc turns page snapshots into text for language models.
+// It finds the main content of a page, the way reader modes do, and writes
+// it as Markdown, which takes a fraction of the tokens of the page's HTML.
+package contentproc
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// minArticleText is the least text, in bytes, the extracted content must
+// have; pages with less, such as forms and app shells, are converted whole
+const minArticleText = 200
+
+// Markdown converts a page to Markdown: its main content when one stands
+// out, else all of its body. pageURL resolves relative links and images.
+func Markdown(src, pageURL string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(src))
+	if err != nil {
+		return "", err
+	}
+	base, _ := url.Parse(pageURL)
+
+	root := findElement(doc, "body")
+	if root == nil {
+		root = doc
+	}
+	clean(root)
+	if article := extract(root); article != nil && len(textOf(article)) >= minArticleText {
+		prune(article)
+		root = article
+	}
+
+	c := &converter{base: base}
+	return c.document(root), nil
+}
+
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// document renders a node's blocks, separated by blank lines
+func (c *converter) document(n *html.Node) string {
+	md := strings.Join(c.blocks(n), "\n\n")
+	return strings.TrimSpace(blankLines.ReplaceAllString(md, "\n\n"))
+}
+
+func findElement(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, name string) bool {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// textOf returns the text of a node with whitespace collapsed
+func textOf(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// linkDensity is the share of a node's text inside links
+func linkDensity(n *html.Node) float64 {
+	text := len(textOf(n))
+	if text == 0 {
+		return 0
+	}
+	links := 0
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "a" {
+			links += len(textOf(n))
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return float64(links) / float64(text)
+}
@@ -0,0 +1,335 @@
+package contentproc
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// converter writes HTML as Markdown
+type converter struct {
+	base *url.URL // resolves relative links; nil leaves them as they are
+}
+
+// blockTags start a new block; other elements are inline
+var blockTags = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "dd": true, "details": true,
+	"div": true, "dl": true, "dt": true, "fieldset": true, "figcaption": true,
+	"figure": true, "form": true, "h1": true, "h2": true, "h3": true, "h4": true,
+	"h5": true, "h6": true, "header": true, "hr": true, "li": true, "main": true,
+	"ol": true, "p": true, "pre": true, "section": true, "summary": true,
+	"table": true, "ul": true,
+}
+
+// blocks renders the children of n as Markdown blocks. Inline content
+// between block elements becomes a paragraph.
+func (c *converter) blocks(n *html.Node) []string {
+	var out []string
+	var para strings.Builder
+	flush := func() {
+		if p := finishInline(para.String()); p != "" {
+			out = append(out, p)
+		}
+		para.Reset()
+	}
+
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || !blockTags[child.Data] {
+			para.WriteString(c.inline(child))
+			continue
+		}
+		flush()
+		out = append(out, c.block(child)...)
+	}
+	flush()
+	return out
+}
+
+// block renders a block element
+func (c *converter) block(n *html.Node) []string {
+	switch n.Data {
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		text := strings.ReplaceAll(finishInline(c.inlineChildren(n)), "  \n", " ")
+		if text == "" {
+			return nil
+		}
+		return []string{strings.Repeat("#", int(n.Data[1]-'0')) + " " + text}
+	case "p", "dt", "summary", "figcaption":
+		if text := finishInline(c.inlineChildren(n)); text != "" {
+			return []string{text}
+		}
+		return nil
+	case "hr":
+		return []string{"---"}
+	case "pre":
+		return []string{c.code(n)}
+	case "blockquote":
+		inner := strings.Join(c.blocks(n), "\n\n")
+		if inner == "" {
+			return nil
+		}
+		return []string{prefixLines(inner, "> ", "> ")}
+	case "ul", "ol":
+		if list := c.list(n); list != "" {
+			return []string{list}
+		}
+		return nil
+	case "table":
+		if table := c.table(n); table != "" {
+			return []string{table}
+		}
+		return nil
+	default:
+		return c.blocks(n)
+	}
+}
+
+// code renders a preformatted block as a fenced code block, taking the
+// language from a language-* or lang-* class
+func (c *converter) code(n *html.Node) string {
+	var lang string
+	for _, el := range []*html.Node{n, n.FirstChild} {
+		if el == nil || el.Type != html.ElementNode {
+			continue
+		}
+		for _, class := range strings.Fields(attr(el, "class")) {
+			if l, ok := strings.CutPrefix(class, "language-"); ok {
+				lang = l
+			} else if l, ok := strings.CutPrefix(class, "lang-"); ok {
+				lang = l
+			}
+		}
+	}
+
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+		case n.Type == html.ElementNode && n.Data == "br":
+			b.WriteByte('\n')
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	text := strings.Trim(b.String(), "\n")
+
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+	return fence + lang + "\n" + text + "\n" + fence
+}
+
+// list renders a list, indenting nested blocks under their item
+func (c *converter) list(n *html.Node) string {
+	var items []string
+	num := 1
+	if start := attr(n, "start"); start != "" {
+		fmt.Sscan(start, &num)
+	}
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.Data != "li" {
+			continue
+		}
+		body := strings.Join(c.blocks(li), "\n")
+		if body == "" {
+			continue
+		}
+		marker := "- "
+		if n.Data == "ol" {
+			marker = fmt.Sprintf("%d. ", num)
+			num++
+		}
+		items = append(items, prefixLines(body, marker, strings.Repeat(" ", len(marker))))
+	}
+	return strings.Join(items, "\n")
+}
+
+// table renders a table as a GitHub-flavored Markdown table; its first row
+// is the header
+func (c *converter) table(n *html.Node) string {
+	var rows [][]string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "tr" {
+			var row []string
+			for cell := n.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+					text := strings.ReplaceAll(finishInline(c.inlineChildren(cell)), "  \n", " ")
+					row = append(row, strings.ReplaceAll(text, "|", `\|`))
+				}
+			}
+			if len(row) > 0 {
+				rows = append(rows, row)
+			}
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode || child.Data != "table" {
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	if len(rows) == 0 {
+		return ""
+	}
+
+	cols := 0
+	for _, row := range rows {
+		cols = max(cols, len(row))
+	}
+	var b strings.Builder
+	for i, row := range rows {
+		for len(row) < cols {
+			row = append(row, "")
+		}
+		b.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			b.WriteString("|" + strings.Repeat(" --- |", cols) + "\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// inline renders an inline node. Line breaks come out as "\n" for
+// finishInline to turn into hard breaks.
+func (c *converter) inline(n *html.Node) string {
+	switch n.Type {
+	case html.TextNode:
+		return collapseSpace(n.Data)
+	case html.ElementNode:
+	default:
+		return ""
+	}
+
+	switch n.Data {
+	case "br":
+		return "\n"
+	case "img":
+		src := c.resolve(attr(n, "src"))
+		alt := strings.Join(strings.Fields(attr(n, "alt")), " ")
+		if src == "" || strings.HasPrefix(src, "data:") {
+			return alt
+		}
+		return "![" + escapeBrackets(alt) + "](" + src + ")"
+	case "a":
+		text := c.inlineChildren(n)
+		label := strings.TrimSpace(text)
+		href := attr(n, "href")
+		if label == "" || href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+			return text
+		}
+		return wrapInline(text, "[", "]("+c.resolve(href)+")")
+	case "strong", "b":
+		return wrapInline(c.inlineChildren(n), "**", "**")
+	case "em", "i", "cite":
+		return wrapInline(c.inlineChildren(n), "*", "*")
+	case "del", "s", "strike":
+		return wrapInline(c.inlineChildren(n), "~~", "~~")
+	case "code", "kbd", "samp":
+		text := textOf(n)
+		if text == "" {
+			return ""
+		}
+		fence := "`"
+		for strings.Contains(text, fence) {
+			fence += "`"
+		}
+		return fence + text + fence
+	}
+	if blockTags[n.Data] {
+		// A block inside inline content still ends a line
+		return "\n" + c.inlineChildren(n) + "\n"
+	}
+	return c.inlineChildren(n)
+}
+
+func (c *converter) inlineChildren(n *html.Node) string {
+	var b strings.Builder
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		b.WriteString(c.inline(child))
+	}
+	return b.String()
+}
+
+// resolve makes a link absolute against the page URL
+func (c *converter) resolve(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if c.base == nil || ref == "" {
+		return ref
+	}
+	u, err := c.base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(u.String(), "(", "%28"), ")", "%29")
+}
+
+// wrapInline puts markers around text, keeping its surrounding spaces
+// outside them so emphasis stays valid Markdown
+func wrapInline(text, open, close string) string {
+	inner := strings.TrimSpace(text)
+	if inner == "" {
+		return text
+	}
+	lead := text[:len(text)-len(strings.TrimLeft(text, " \n"))]
+	trail := text[len(strings.TrimRight(text, " \n")):]
+	return lead + open + inner + close + trail
+}
+
+// finishInline trims a paragraph's lines and joins them with hard breaks
+func finishInline(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "  \n")
+}
+
+func collapseSpace(s string) string {
+	if s == "" {
+		return ""
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return " "
+	}
+	out := strings.Join(fields, " ")
+	if strings.TrimLeft(s, " \t\r\n\f") != s {
+		out = " " + out
+	}
+	if strings.TrimRight(s, " \t\r\n\f") != s {
+		out += " "
+	}
+	return out
+}
+
+func escapeBrackets(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`).Replace(s)
+}
+
+// prefixLines prefixes the first line of text with first and the others
+// with rest
+func prefixLines(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			lines[i] = first + line
+		case line == "":
+			lines[i] = strings.TrimRight(rest, " ")
+		default:
+			lines[i] = rest + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
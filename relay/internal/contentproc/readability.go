@@ -0,0 +1,198 @@
+package contentproc
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Class and id patterns of page furniture and of content, after Arc90's
+// readability
+var (
+	unlikely = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|footer|gdpr|header|legends|menu|modal|nav|pager|pagination|popup|related|remark|replies|rss|share|shoutbox|sidebar|skip|social|sponsor|subscribe|supplemental|ad-break|agegate|promo|newsletter`)
+	maybe    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positive = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	negative = regexp.MustCompile(`(?i)hidden|banner|combx|comment|contact|foot|footer|footnote|masthead|media|meta|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|widget`)
+)
+
+// dropTags never hold readable content
+var dropTags = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "canvas": true, "iframe": true, "object": true, "embed": true,
+	"button": true, "input": true, "select": true, "textarea": true,
+	"nav": true, "aside": true, "footer": true, "dialog": true,
+}
+
+// dropRoles mark landmarks around the content
+var dropRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true,
+	"complementary": true, "dialog": true, "alertdialog": true, "menu": true,
+}
+
+// clean removes scripts, forms controls, navigation, and elements whose
+// class or id marks them as page furniture
+func clean(n *html.Node) {
+	var drop []*html.Node
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		switch {
+		case child.Type == html.CommentNode:
+			drop = append(drop, child)
+		case child.Type != html.ElementNode:
+		case dropTags[child.Data], dropRoles[attr(child, "role")],
+			hasAttr(child, "hidden"), attr(child, "aria-hidden") == "true",
+			isUnlikely(child):
+			drop = append(drop, child)
+		default:
+			clean(child)
+		}
+	}
+	for _, child := range drop {
+		n.RemoveChild(child)
+	}
+}
+
+func isUnlikely(n *html.Node) bool {
+	switch n.Data {
+	case "html", "body", "article", "main", "a":
+		return false
+	}
+	match := attr(n, "class") + " " + attr(n, "id")
+	return unlikely.MatchString(match) && !maybe.MatchString(match)
+}
+
+// extract returns the element holding the page's main content, joined with
+// siblings that continue it, or nil when no element scores
+func extract(root *html.Node) *html.Node {
+	scores := map[*html.Node]float64{}
+	var order []*html.Node // candidates in document order, for stable ties
+	add := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = initialScore(n)
+			order = append(order, n)
+		}
+		scores[n] += score
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "p", "pre", "td", "blockquote":
+				text := textOf(n)
+				if len(text) >= 25 {
+					score := 1 + float64(strings.Count(text, ",")) + min(float64(len(text))/100, 3)
+					add(n.Parent, score)
+					if n.Parent != nil {
+						add(n.Parent.Parent, score/2)
+					}
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	var top *html.Node
+	best := 0.0
+	for _, n := range order {
+		scores[n] *= 1 - linkDensity(n)
+		if scores[n] > best {
+			top, best = n, scores[n]
+		}
+	}
+	if top == nil || top == root {
+		return top
+	}
+	return withSiblings(top, best, scores)
+}
+
+// initialScore weighs a candidate by its tag, class, and id
+func initialScore(n *html.Node) float64 {
+	var score float64
+	switch n.Data {
+	case "article", "main":
+		score = 10
+	case "div":
+		score = 5
+	case "pre", "td", "blockquote":
+		score = 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score = -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score = -5
+	}
+	match := attr(n, "class") + " " + attr(n, "id")
+	if negative.MatchString(match) {
+		score -= 25
+	}
+	if positive.MatchString(match) {
+		score += 25
+	}
+	return score
+}
+
+// withSiblings wraps the top candidate with siblings that score close to
+// it, or are paragraphs of prose, as when an article is split into
+// several containers
+func withSiblings(top *html.Node, best float64, scores map[*html.Node]float64) *html.Node {
+	threshold := max(10, best*0.2)
+	var keep []*html.Node
+	for sib := top.Parent.FirstChild; sib != nil; sib = sib.NextSibling {
+		if sib == top {
+			keep = append(keep, sib)
+			continue
+		}
+		if sib.Type != html.ElementNode {
+			continue
+		}
+		if score, ok := scores[sib]; ok && score >= threshold {
+			keep = append(keep, sib)
+			continue
+		}
+		if sib.Data == "p" {
+			text := textOf(sib)
+			density := linkDensity(sib)
+			if (len(text) > 80 && density < 0.25) || (len(text) > 0 && density == 0 && strings.Contains(text, ". ")) {
+				keep = append(keep, sib)
+			}
+		}
+	}
+	if len(keep) == 1 {
+		return top
+	}
+
+	article := &html.Node{Type: html.ElementNode, Data: "div"}
+	for _, n := range keep {
+		n.Parent.RemoveChild(n)
+		article.AppendChild(n)
+	}
+	return article
+}
+
+// prune removes link lists and other link-heavy blocks within the content,
+// such as tag clouds and "read more" lists
+func prune(n *html.Node) {
+	var drop []*html.Node
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode {
+			continue
+		}
+		switch child.Data {
+		case "ul", "ol", "div", "section", "table":
+			if text := textOf(child); len(text) < 200 && linkDensity(child) > 0.5 {
+				drop = append(drop, child)
+				continue
+			}
+		}
+		prune(child)
+	}
+	for _, child := range drop {
+		n.RemoveChild(child)
+	}
+}
@@ -0,0 +1,139 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"too few fields", "* * * *"},
+		{"too many fields", "* * * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"day of month zero", "0 0 0 * *"},
+		{"weekday out of range", "0 0 * * 8"},
+		{"backwards range", "5-1 * * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"unknown name", "0 0 * foo *"},
+		{"unknown shortcut", "@fortnightly"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.expr); err == nil {
+				t.Errorf("Parse(%q) succeeded, want an error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	// 2026-01-01 is a Thursday
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", utc(2026, 1, 1, 0, 0), utc(2026, 1, 1, 0, 1)},
+		{"seconds are dropped", "* * * * *", utc(2026, 1, 1, 0, 0).Add(30 * time.Second), utc(2026, 1, 1, 0, 1)},
+		{"daily", "30 9 * * *", utc(2026, 1, 1, 10, 0), utc(2026, 1, 2, 9, 30)},
+		{"shortcut", "@monthly", utc(2026, 1, 1, 0, 0), utc(2026, 2, 1, 0, 0)},
+		{"month names", "0 0 1 mar-may *", utc(2026, 1, 1, 0, 0), utc(2026, 3, 1, 0, 0)},
+		{"value with step runs to the end", "0 20/2 * * *", utc(2026, 1, 1, 21, 0), utc(2026, 1, 1, 22, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(2026, 1, 1, 0, 0), utc(2026, 1, 4, 0, 0)},
+
+		// Vixie cron: both day fields restricted fires on either
+		{"weekday before day of month", "0 0 13 * fri", utc(2026, 1, 1, 0, 0), utc(2026, 1, 2, 0, 0)},
+		{"day of month before weekday", "0 0 13 * fri", utc(2026, 1, 10, 0, 0), utc(2026, 1, 13, 0, 0)},
+		{"day range or weekday", "0 0 1-7 * mon", utc(2026, 1, 1, 0, 0), utc(2026, 1, 2, 0, 0)},
+		// One of them * fires on the other alone
+		{"day of month only", "0 0 13 * *", utc(2026, 1, 1, 0, 0), utc(2026, 1, 13, 0, 0)},
+		{"weekday only", "0 0 * * mon", utc(2026, 1, 1, 0, 0), utc(2026, 1, 5, 0, 0)},
+		// A stepped * is still unrestricted, so both must match
+		{"stepped day of month and weekday", "0 0 */2 * mon", utc(2026, 1, 6, 0, 0), utc(2026, 1, 19, 0, 0)},
+		{"day of month and stepped weekday", "0 0 1 * */2", utc(2026, 1, 1, 0, 0), utc(2026, 2, 1, 0, 0)},
+
+		{"leap day", "0 0 29 2 *", utc(2026, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"february 30th never fires", "0 0 30 2 *", utc(2026, 1, 1, 0, 0), time.Time{}},
+		{"april 31st never fires", "0 0 31 4 *", utc(2026, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			if got := e.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, ny)
+	}
+	// Clocks go from 02:00 EST to 03:00 EDT on 2026-03-08, and from 02:00
+	// EDT back to 01:00 EST on 2026-11-01
+	edt, est := at(11, 1, 1, 30), at(11, 1, 1, 30).Add(time.Hour)
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"skipped time does not run", "30 2 * * *", at(3, 7, 3, 0), at(3, 9, 2, 30)},
+		{"steps continue after the gap", "*/30 * * * *", at(3, 8, 1, 45), at(3, 8, 3, 0)},
+		{"repeated time runs first in daylight time", "30 1 * * *", at(10, 31, 12, 0), edt},
+		{"repeated time runs again in standard time", "30 1 * * *", edt, est},
+		{"repeated time then the next day", "30 1 * * *", est, at(11, 2, 1, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			got := e.Next(tt.from)
+			if !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+			if got.Location() != ny {
+				t.Errorf("Next returned %v, want a time in %v", got.Location(), ny)
+			}
+		})
+	}
+}
+
+func TestNextAdvances(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	for _, expr := range []string{"*/15 * * * *", "30 1,2 * * *", "0 0 13 * fri"} {
+		e, err := Parse(expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", expr, err)
+		}
+		prev := time.Date(2026, 1, 1, 0, 0, 0, 0, ny)
+		for prev.Year() == 2026 {
+			next := e.Next(prev)
+			if !next.After(prev) {
+				t.Fatalf("%q: Next(%v) = %v, not after it", expr, prev, next)
+			}
+			prev = next
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Package dashboard serves the embedded operator dashboard
+package dashboard
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+// Handler serves the dashboard page. The page itself holds no data; it asks
+// for an admin token and reads everything from the admin API.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(indexHTML)
+	})
+}
@@ -1,61 +1,71 @@
-// Package database handles SQLite database operations
+// Package database handles SQL database operations
 package database
 
 import (
 	"database/sql"
 	"fmt"
-	"time"
 
 	"github.com/rs/zerolog/log"
-	_ "modernc.org/sqlite"
 )
 
 // DB wraps the SQL database connection
 type DB struct {
 	*sql.DB
+	driver Driver
 }
 
-// Schema for the database
-const schema = `
-CREATE TABLE IF NOT EXISTS tokens (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    hash TEXT NOT NULL UNIQUE,
-    name TEXT NOT NULL,
-    rate_limit INTEGER NOT NULL DEFAULT 100,
-    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    last_used_at TEXT,
-    revoked_at TEXT
-);
-
-CREATE INDEX IF NOT EXISTS idx_tokens_hash ON tokens(hash);
-CREATE INDEX IF NOT EXISTS idx_tokens_revoked ON tokens(revoked_at);
-`
-
-// New creates a new database connection
-func New(dbPath string) (*DB, error) {
-	db, err := sql.Open("sqlite", dbPath+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+// New opens a database using the named driver ("sqlite" or "postgres")
+// and applies any pending migrations
+func New(driverName, dsn string) (*DB, error) {
+	driver, ok := drivers[driverName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver: %s", driverName)
+	}
+
+	sqlDB, err := driver.Open(dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(1) // SQLite only supports one writer
-	db.SetMaxIdleConns(1)
-	db.SetConnMaxLifetime(time.Hour)
-
 	// Test connection
-	if err := db.Ping(); err != nil {
+	if err := sqlDB.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Apply schema
-	if _, err := db.Exec(schema); err != nil {
-		return nil, fmt.Errorf("failed to apply schema: %w", err)
+	db := &DB{DB: sqlDB, driver: driver}
+
+	if err := db.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to apply migrations: %w", err)
 	}
 
-	log.Debug().Str("path", dbPath).Msg("Database initialized")
+	log.Debug().Str("driver", driver.Name()).Msg("Database initialized")
+
+	return db, nil
+}
+
+// Driver returns the driver backing this database
+func (db *DB) Driver() Driver {
+	return db.driver
+}
+
+// SchemaVersion returns the migration version this binary expects
+func (db *DB) SchemaVersion() int {
+	return len(migrations)
+}
+
+// Exec executes a query written with ? placeholders
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.driver.Rebind(query), args...)
+}
+
+// Query runs a query written with ? placeholders
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.driver.Rebind(query), args...)
+}
 
-	return &DB{db}, nil
+// QueryRow runs a single-row query written with ? placeholders
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.driver.Rebind(query), args...)
 }
 
 // Close closes the database connection
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Driver abstracts the differences between supported SQL backends.
+// Stores write queries with ? placeholders and portable DDL; the driver
+// rewrites them for its dialect.
+type Driver interface {
+	// Name returns the driver identifier used in DB_DRIVER
+	Name() string
+	// Open opens and configures a connection pool for the DSN
+	Open(dsn string) (*sql.DB, error)
+	// Rebind converts ? placeholders into the driver's bind syntax
+	Rebind(query string) string
+	// Translate rewrites portable schema DDL into the driver's dialect
+	Translate(ddl string) string
+	// SkipLocked returns the row-locking clause used when claiming queue rows
+	SkipLocked() string
+	// MigrationLock returns the statement that serializes migrations across
+	// relays for the rest of a transaction, or "" when none is needed
+	MigrationLock() string
+}
+
+var drivers = map[string]Driver{
+	"sqlite":   sqliteDriver{},
+	"postgres": postgresDriver{},
+}
+
+type sqliteDriver struct{}
+
+func (sqliteDriver) Name() string { return "sqlite" }
+
+func (sqliteDriver) Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", dsn+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// Set connection pool settings
+	db.SetMaxOpenConns(1) // SQLite only supports one writer
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(time.Hour)
+
+	return db, nil
+}
+
+func (sqliteDriver) Rebind(query string) string { return query }
+
+func (sqliteDriver) Translate(ddl string) string { return ddl }
+
+// SQLite serializes writers, so no locking clause is needed
+func (sqliteDriver) SkipLocked() string { return "" }
+
+// SQLite is opened by one relay at a time
+func (sqliteDriver) MigrationLock() string { return "" }
+
+type postgresDriver struct{}
+
+func (postgresDriver) Name() string { return "postgres" }
+
+func (postgresDriver) Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(20)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(time.Hour)
+
+	return db, nil
+}
+
+// Rebind converts ? placeholders to $1, $2, ...
+func (postgresDriver) Rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(query[i])
+	}
+	return b.String()
+}
+
+func (postgresDriver) Translate(ddl string) string {
+	return strings.ReplaceAll(ddl, "INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY")
+}
+
+func (postgresDriver) SkipLocked() string { return " FOR UPDATE SKIP LOCKED" }
+
+// migrationLockKey is the advisory lock relays migrating one database share
+const migrationLockKey = 0x6f776c72656c6179 // "owlrelay"
+
+func (postgresDriver) MigrationLock() string {
+	return "SELECT pg_advisory_xact_lock(" + strconv.FormatInt(migrationLockKey, 10) + ")"
+}
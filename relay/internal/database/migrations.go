@@ -0,0 +1,314 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// migrations are applied in order and recorded in schema_migrations.
+// Append new entries; never edit one that has shipped. DDL is written
+// in SQLite syntax and translated by the driver.
+var migrations = []string{
+	// 1: tokens
+	`
+CREATE TABLE IF NOT EXISTS tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    hash TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    rate_limit INTEGER NOT NULL DEFAULT 100,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TEXT,
+    revoked_at TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_tokens_hash ON tokens(hash);
+CREATE INDEX IF NOT EXISTS idx_tokens_revoked ON tokens(revoked_at);
+`,
+	// 2: work queue
+	`
+CREATE TABLE IF NOT EXISTS jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    created_by INTEGER NOT NULL,
+    queue TEXT NOT NULL DEFAULT 'default',
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 3,
+    lease_until TEXT,
+    result TEXT,
+    error TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_lease ON jobs(token_id, queue, status);
+`,
+	// 3: token scopes
+	`
+ALTER TABLE tokens ADD COLUMN scopes TEXT NOT NULL DEFAULT 'read,command,screenshot,evaluate';
+`,
+	// 4: per-token URL policies
+	`
+CREATE TABLE IF NOT EXISTS url_policies (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    effect TEXT NOT NULL,
+    pattern TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_url_policies_token ON url_policies(token_id);
+`,
+	// 5: per-token rate limit burst
+	`
+ALTER TABLE tokens ADD COLUMN rate_burst INTEGER NOT NULL DEFAULT 0;
+`,
+	// 6: screenshot records
+	`
+CREATE TABLE IF NOT EXISTS screenshots (
+    id TEXT PRIMARY KEY,
+    token_id INTEGER NOT NULL,
+    tab_id TEXT NOT NULL,
+    command_id TEXT NOT NULL,
+    format TEXT NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    size INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_screenshots_token ON screenshots(token_id, created_at);
+`,
+	// 7: content-addressed artifact blobs
+	`
+CREATE TABLE IF NOT EXISTS blobs (
+    hash TEXT PRIMARY KEY,
+    size INTEGER NOT NULL,
+    refs INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL
+);
+
+ALTER TABLE screenshots ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+`,
+	// 8: per-token action defaults, as JSON
+	`
+ALTER TABLE tokens ADD COLUMN defaults TEXT NOT NULL DEFAULT '{}';
+`,
+	// 9: per-token feature flag overrides, as JSON
+	`
+ALTER TABLE tokens ADD COLUMN features TEXT NOT NULL DEFAULT '{}';
+`,
+	// 10: per-token burst debt
+	`
+ALTER TABLE tokens ADD COLUMN rate_debt INTEGER NOT NULL DEFAULT 0;
+`,
+	// 11: stored macros
+	`
+CREATE TABLE IF NOT EXISTS macros (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    params TEXT NOT NULL DEFAULT '[]',
+    steps TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    UNIQUE (token_id, name)
+);
+`,
+	// 12: webhooks
+	`
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL
+);
+`,
+	// 13: token rotation. hash stays the token's identity; secret_hash is
+	// the secret clients present, and previous_hash the one it replaced,
+	// valid until previous_expires_at
+	`
+ALTER TABLE tokens ADD COLUMN secret_hash TEXT NOT NULL DEFAULT '';
+UPDATE tokens SET secret_hash = hash;
+ALTER TABLE tokens ADD COLUMN previous_hash TEXT;
+ALTER TABLE tokens ADD COLUMN previous_expires_at TEXT;
+CREATE INDEX IF NOT EXISTS idx_tokens_secret_hash ON tokens(secret_hash);
+CREATE INDEX IF NOT EXISTS idx_tokens_previous_hash ON tokens(previous_hash);
+`,
+	// 14: stored pipelines
+	`
+CREATE TABLE IF NOT EXISTS pipelines (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    steps TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    UNIQUE (token_id, name)
+);
+`,
+	// 15: session history
+	`
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    token_hash TEXT NOT NULL,
+    token_name TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    extension_version TEXT NOT NULL DEFAULT '',
+    install_id TEXT NOT NULL DEFAULT '',
+    node TEXT NOT NULL DEFAULT '',
+    connected_at TEXT NOT NULL,
+    last_seen_at TEXT NOT NULL,
+    disconnected_at TEXT,
+    reason TEXT NOT NULL DEFAULT '',
+    close_code INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_connected_at ON sessions(connected_at);
+CREATE INDEX IF NOT EXISTS idx_sessions_disconnected_at ON sessions(disconnected_at);
+`,
+	// 16: secret lookup prefixes. secret_hash and previous_hash become
+	// argon2id hashes, converted at startup by TokenStore.UpgradeSecrets
+	`
+ALTER TABLE tokens ADD COLUMN secret_prefix TEXT;
+ALTER TABLE tokens ADD COLUMN previous_prefix TEXT;
+CREATE INDEX IF NOT EXISTS idx_tokens_secret_prefix ON tokens(secret_prefix);
+CREATE INDEX IF NOT EXISTS idx_tokens_previous_prefix ON tokens(previous_prefix);
+`,
+	// 17: when a screenshot's file reference was released, so the
+	// retention sweeper survives restarts
+	`
+ALTER TABLE screenshots ADD COLUMN released_at TEXT;
+CREATE INDEX IF NOT EXISTS idx_screenshots_retained ON screenshots(released_at, expires_at);
+`,
+	// 18: blobs per token, so tokens never share a file. References are
+	// split by the retained screenshots holding them; the files are moved
+	// into per-token directories by artifact.Store.RemoveOrphans
+	`
+CREATE TABLE token_blobs (
+    token_id INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    refs INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL,
+    PRIMARY KEY (token_id, hash)
+);
+INSERT INTO token_blobs (token_id, hash, size, refs, created_at)
+SELECT s.token_id, b.hash, b.size, COUNT(*), b.created_at
+FROM screenshots s JOIN blobs b ON b.hash = s.hash
+WHERE s.released_at IS NULL
+GROUP BY s.token_id, b.hash, b.size, b.created_at;
+DROP TABLE blobs;
+ALTER TABLE token_blobs RENAME TO blobs;
+`,
+	// 19: stored request rule sets
+	`
+CREATE TABLE IF NOT EXISTS rule_sets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    rules TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    UNIQUE (token_id, name)
+);
+`,
+	// 20: cron schedules and their run history
+	`
+CREATE TABLE IF NOT EXISTS schedules (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    cron TEXT NOT NULL,
+    timezone TEXT NOT NULL,
+    job TEXT NOT NULL,
+    paused INTEGER NOT NULL DEFAULT 0,
+    next_run_at TEXT,
+    created_at TEXT NOT NULL,
+    updated_at TEXT NOT NULL,
+    UNIQUE (token_id, name)
+);
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run ON schedules(next_run_at);
+CREATE TABLE IF NOT EXISTS schedule_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    schedule_id INTEGER NOT NULL,
+    status TEXT NOT NULL,
+    tab_id TEXT NOT NULL DEFAULT '',
+    error_code TEXT,
+    error_message TEXT,
+    result TEXT,
+    screenshot_id TEXT NOT NULL DEFAULT '',
+    started_at TEXT NOT NULL,
+    finished_at TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_schedule_runs_schedule ON schedule_runs(schedule_id, id);
+`,
+}
+
+// migrate applies pending migrations, one transaction each. Relays that
+// start together take the driver's migration lock and read the version
+// under it, so each migration runs once.
+func (db *DB) migrate() error {
+	for {
+		done, err := db.migrateNext()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// migrateNext applies the first pending migration, reporting true when
+// there was none
+func (db *DB) migrateNext() (bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if lock := db.driver.MigrationLock(); lock != "" {
+		if _, err := tx.Exec(lock); err != nil {
+			return false, fmt.Errorf("lock migrations: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at TEXT NOT NULL
+)`); err != nil {
+		return false, err
+	}
+
+	var current int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return false, err
+	}
+	if current >= len(migrations) {
+		return true, tx.Commit()
+	}
+
+	version := current + 1
+	if _, err := tx.Exec(db.driver.Translate(migrations[current])); err != nil {
+		return false, fmt.Errorf("migration %d: %w", version, err)
+	}
+	if _, err := tx.Exec(
+		db.driver.Rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"),
+		version, time.Now().UTC().Format(time.RFC3339),
+	); err != nil {
+		return false, fmt.Errorf("migration %d: %w", version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.Info().Int("version", version).Msg("Applied database migration")
+	return false, nil
+}
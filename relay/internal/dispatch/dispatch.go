@@ -0,0 +1,292 @@
+// Package dispatch distributes batches of independent tasks across sessions
+package dispatch
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Task statuses
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCompleted = "completed"
+)
+
+// CheckFunc vets an action against the current URL of the tab it targets,
+// returning a non-nil error to block it
+type CheckFunc func(tabURL string, action models.CommandAction) *models.CommandError
+
+// Dispatcher runs batches across all sessions of a token
+type Dispatcher struct {
+	cfg *config.Config
+	hub *hub.Hub
+
+	mu      sync.RWMutex
+	batches map[string]*batch
+}
+
+type batch struct {
+	mu          sync.Mutex
+	id          string
+	tokenHash   string
+	check       CheckFunc
+	createdAt   time.Time
+	completedAt time.Time
+	results     []models.BatchTaskResult
+}
+
+// New creates a new Dispatcher
+func New(cfg *config.Config, h *hub.Hub) *Dispatcher {
+	d := &Dispatcher{
+		cfg:     cfg,
+		hub:     h,
+		batches: make(map[string]*batch),
+	}
+	go d.cleanupLoop()
+	return d
+}
+
+// Start queues the tasks and runs them in the background, one worker per
+// session. Each worker runs its tasks sequentially on the session's oldest tab.
+// check, if set, is consulted before every step.
+func (d *Dispatcher) Start(tokenHash string, req *models.BatchRequest, check CheckFunc) (*models.BatchResponse, error) {
+	if d.hub.Draining() {
+		return nil, hub.ErrShuttingDown
+	}
+
+	sessions := d.hub.GetSessions(tokenHash)
+
+	// Only sessions with at least one attached tab can take work
+	type worker struct {
+		sessionID string
+		tabID     string
+	}
+	var workers []worker
+	for _, s := range sessions {
+		if tabs := s.TabList(); len(tabs) > 0 {
+			workers = append(workers, worker{sessionID: s.ID, tabID: tabs[0].ID})
+		}
+	}
+	if len(workers) == 0 {
+		return nil, hub.ErrNotConnected
+	}
+
+	b := &batch{
+		id:        uuid.New().String(),
+		tokenHash: tokenHash,
+		check:     check,
+		createdAt: time.Now().UTC(),
+		results:   make([]models.BatchTaskResult, len(req.Tasks)),
+	}
+	for i, task := range req.Tasks {
+		taskID := task.ID
+		if taskID == "" {
+			taskID = strconv.Itoa(i)
+		}
+		b.results[i] = models.BatchTaskResult{TaskID: taskID, Status: StatusPending}
+	}
+
+	d.mu.Lock()
+	d.batches[b.id] = b
+	d.mu.Unlock()
+
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = d.cfg.DefaultCommandTimeout()
+	}
+
+	queue := make(chan int, len(req.Tasks))
+	for i := range req.Tasks {
+		queue <- i
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(sessionID, tabID string) {
+			defer wg.Done()
+			for i := range queue {
+				d.runTask(b, i, &req.Tasks[i], sessionID, tabID, timeout)
+			}
+		}(w.sessionID, w.tabID)
+	}
+
+	go func() {
+		wg.Wait()
+		b.mu.Lock()
+		b.completedAt = time.Now().UTC()
+		b.mu.Unlock()
+		log.Debug().Str("batch_id", b.id).Msg("Batch completed")
+	}()
+
+	log.Info().
+		Str("batch_id", b.id).
+		Int("tasks", len(req.Tasks)).
+		Int("sessions", len(workers)).
+		Msg("Batch started")
+
+	return b.snapshot(), nil
+}
+
+// Get returns the current state of a batch owned by the token
+func (d *Dispatcher) Get(tokenHash, id string) *models.BatchResponse {
+	d.mu.RLock()
+	b, ok := d.batches[id]
+	d.mu.RUnlock()
+
+	if !ok || b.tokenHash != tokenHash {
+		return nil
+	}
+	return b.snapshot()
+}
+
+func (d *Dispatcher) runTask(b *batch, i int, task *models.BatchTask, sessionID, tabID string, timeout int) {
+	b.update(i, func(r *models.BatchTaskResult) {
+		r.Status = StatusRunning
+		r.SessionID = sessionID
+		r.TabID = tabID
+	})
+
+	actions := task.Actions
+	if task.URL != "" {
+		nav := models.CommandAction{Kind: "navigate", URL: task.URL}
+		actions = append([]models.CommandAction{nav}, actions...)
+	}
+
+	for _, action := range actions {
+		if b.check != nil {
+			tab, _ := d.hub.FindTab(b.tokenHash, tabID)
+			if err := b.check(tab.URL, action); err != nil {
+				b.update(i, func(r *models.BatchTaskResult) {
+					r.Steps = append(r.Steps, models.BatchStepResult{Kind: action.Kind, Error: err})
+					r.Status = StatusFailed
+					r.Error = err
+				})
+				return
+			}
+		}
+
+		step, err := d.runStep(b.tokenHash, sessionID, tabID, action, timeout)
+		b.update(i, func(r *models.BatchTaskResult) {
+			r.Steps = append(r.Steps, step)
+		})
+		if err != nil {
+			b.update(i, func(r *models.BatchTaskResult) {
+				r.Status = StatusFailed
+				r.Error = err
+			})
+			return
+		}
+	}
+
+	b.update(i, func(r *models.BatchTaskResult) {
+		r.Status = StatusSucceeded
+	})
+}
+
+func (d *Dispatcher) runStep(tokenHash, sessionID, tabID string, action models.CommandAction, timeout int) (models.BatchStepResult, *models.CommandError) {
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		Action:  action,
+		TabID:   tabID,
+		Timeout: timeout,
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	resp, err := d.hub.SendCommandToSession(ctx, tokenHash, sessionID, cmd)
+	step := models.BatchStepResult{
+		Kind:    action.Kind,
+		Elapsed: time.Since(start).Milliseconds(),
+	}
+
+	if err != nil {
+		cmdErr := &models.CommandError{Code: "INTERNAL_ERROR", Message: err.Error()}
+		if hubErr, ok := err.(*hub.HubError); ok {
+			cmdErr.Code = hubErr.Code
+		} else if ctx.Err() != nil {
+			cmdErr.Code = hub.ErrTimeout.Code
+		}
+		step.Error = cmdErr
+		return step, cmdErr
+	}
+
+	step.Success = resp.Success
+	step.Result = resp.Decoded
+	step.Error = resp.Error
+	if !resp.Success {
+		if resp.Error == nil {
+			return step, &models.CommandError{Code: "COMMAND_FAILED", Message: "Command failed"}
+		}
+		return step, resp.Error
+	}
+	return step, nil
+}
+
+func (d *Dispatcher) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		ttl := time.Duration(d.cfg.BatchResultTTL) * time.Second
+		d.mu.Lock()
+		for id, b := range d.batches {
+			b.mu.Lock()
+			expired := !b.completedAt.IsZero() && time.Since(b.completedAt) > ttl
+			b.mu.Unlock()
+			if expired {
+				delete(d.batches, id)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+func (b *batch) update(i int, fn func(r *models.BatchTaskResult)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn(&b.results[i])
+}
+
+func (b *batch) snapshot() *models.BatchResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	resp := &models.BatchResponse{
+		ID:        b.id,
+		Status:    StatusRunning,
+		Total:     len(b.results),
+		CreatedAt: b.createdAt.Format(time.RFC3339),
+		Results:   make([]models.BatchTaskResult, len(b.results)),
+	}
+	for i, r := range b.results {
+		r.Steps = append([]models.BatchStepResult(nil), r.Steps...)
+		resp.Results[i] = r
+		switch r.Status {
+		case StatusSucceeded:
+			resp.Completed++
+		case StatusFailed:
+			resp.Completed++
+			resp.Failed++
+		}
+	}
+	if !b.completedAt.IsZero() {
+		resp.Status = StatusCompleted
+		resp.CompletedAt = b.completedAt.Format(time.RFC3339)
+	}
+	return resp
+}
@@ -0,0 +1,252 @@
+// Package downloads keeps files downloaded in attached tabs. Extensions
+// report each completed download and stream its content to the relay,
+// which holds it for DOWNLOAD_TTL so a client can fetch it.
+package downloads
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Download statuses
+const (
+	StatusReceiving = "receiving"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Store holds downloads in DOWNLOADS_PATH, with their details in memory
+type Store struct {
+	cfg *config.Config
+
+	mu        sync.Mutex
+	downloads map[string]*download
+}
+
+type download struct {
+	info      models.Download
+	tokenHash string
+}
+
+// Writer receives the content of a download as it arrives
+type Writer struct {
+	store   *Store
+	id      string
+	file    *os.File
+	total   int
+	next    int
+	written int64
+}
+
+// New creates a Store. Files left from an earlier run are removed once
+// they are older than DOWNLOAD_TTL.
+func New(cfg *config.Config) *Store {
+	s := &Store{
+		cfg:       cfg,
+		downloads: make(map[string]*download),
+	}
+	go s.cleanupLoop()
+	return s
+}
+
+// Begin records a download reported by an extension. Its content is
+// written to the returned Writer; there is none when the download failed
+// in the browser, is too large, or is empty, which completes it at once.
+func (s *Store) Begin(tokenHash string, msg *models.DownloadMessage) *Writer {
+	now := time.Now().UTC()
+	d := &download{
+		info: models.Download{
+			ID:        uuid.New().String(),
+			TabID:     msg.TabID,
+			Filename:  filepath.Base(msg.Filename),
+			MimeType:  msg.MimeType,
+			SourceURL: msg.URL,
+			Size:      msg.Size,
+			Status:    StatusReceiving,
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Duration(s.cfg.DownloadTTL) * time.Second),
+		},
+		tokenHash: tokenHash,
+	}
+	s.mu.Lock()
+	s.downloads[d.info.ID] = d
+	s.mu.Unlock()
+
+	if msg.Error != "" {
+		s.fail(d.info.ID, msg.Error)
+		return nil
+	}
+	if msg.Size > s.cfg.DownloadMaxSize {
+		s.fail(d.info.ID, fmt.Sprintf("File exceeds %d bytes (DOWNLOAD_MAX_SIZE)", s.cfg.DownloadMaxSize))
+		return nil
+	}
+
+	file, err := os.Create(s.path(d.info.ID) + ".part")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create download")
+		s.fail(d.info.ID, "Failed to store the file")
+		return nil
+	}
+	w := &Writer{store: s, id: d.info.ID, file: file, total: msg.Total}
+	if msg.Total == 0 {
+		w.finish()
+		return nil
+	}
+	return w
+}
+
+// Write adds the next chunk of content. It returns true once the last
+// chunk is written and the download is completed; on error the download
+// has failed and the Writer must not be used again.
+func (w *Writer) Write(seq int, data []byte) (bool, error) {
+	var err error
+	switch {
+	case seq != w.next:
+		err = fmt.Errorf("chunk %d arrived, expected %d", seq, w.next)
+	case w.written+int64(len(data)) > w.store.cfg.DownloadMaxSize:
+		err = fmt.Errorf("file exceeds %d bytes (DOWNLOAD_MAX_SIZE)", w.store.cfg.DownloadMaxSize)
+	default:
+		_, err = w.file.Write(data)
+	}
+	if err != nil {
+		w.Abort(err.Error())
+		return false, err
+	}
+
+	w.written += int64(len(data))
+	w.next++
+	if w.next < w.total {
+		return false, nil
+	}
+	return true, w.finish()
+}
+
+// Abort fails a download whose content stopped arriving
+func (w *Writer) Abort(reason string) {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	w.store.fail(w.id, reason)
+}
+
+func (w *Writer) finish() error {
+	err := w.file.Close()
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.store.path(w.id))
+	}
+	if err != nil {
+		log.Error().Err(err).Str("download_id", w.id).Msg("Failed to write download")
+		os.Remove(w.file.Name())
+		w.store.fail(w.id, "Failed to store the file")
+		return err
+	}
+
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	if d := w.store.downloads[w.id]; d != nil {
+		now := time.Now().UTC()
+		d.info.Status = StatusCompleted
+		d.info.Size = w.written
+		d.info.CompletedAt = &now
+		d.info.URL = "/api/v1/downloads/" + w.id
+	}
+	return nil
+}
+
+func (s *Store) fail(id, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.downloads[id]; d != nil {
+		d.info.Status = StatusFailed
+		d.info.Error = reason
+	}
+}
+
+// List returns the token's downloads, newest first, optionally only those
+// of one tab
+func (s *Store) List(tokenHash, tabID string) []models.Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []models.Download{}
+	for _, d := range s.downloads {
+		if d.tokenHash == tokenHash && (tabID == "" || d.info.TabID == tabID) {
+			list = append(list, d.info)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Get returns a download of the token and, once it is completed, the path
+// of its content
+func (s *Store) Get(tokenHash, id string) (models.Download, string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.downloads[id]
+	if d == nil || d.tokenHash != tokenHash || time.Now().After(d.info.ExpiresAt) {
+		return models.Download{}, "", false
+	}
+	if d.info.Status != StatusCompleted {
+		return d.info, "", true
+	}
+	return d.info, s.path(id), true
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.cfg.DownloadsPath, id)
+}
+
+// cleanupLoop forgets expired downloads and removes their files
+func (s *Store) cleanupLoop() {
+	s.sweepFiles(true)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		s.mu.Lock()
+		for id, d := range s.downloads {
+			if now.After(d.info.ExpiresAt) && d.info.Status != StatusReceiving {
+				delete(s.downloads, id)
+			}
+		}
+		s.mu.Unlock()
+		s.sweepFiles(false)
+	}
+}
+
+// sweepFiles removes files older than DOWNLOAD_TTL, including those of an
+// earlier run, which are not tracked. At startup it also removes files
+// that run left unfinished.
+func (s *Store) sweepFiles(startup bool) {
+	entries, err := os.ReadDir(s.cfg.DownloadsPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list downloads")
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(s.cfg.DownloadTTL) * time.Second)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		unfinished := strings.HasSuffix(e.Name(), ".part")
+		if (startup && unfinished) || (!unfinished && info.ModTime().Before(cutoff)) {
+			if err := os.Remove(filepath.Join(s.cfg.DownloadsPath, e.Name())); err != nil && !os.IsNotExist(err) {
+				log.Error().Err(err).Str("file", e.Name()).Msg("Failed to remove download")
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package features lists the relay's experimental capabilities. Each is off
+// unless enabled relay-wide with FEATURES or for a single token, so new
+// endpoints and actions can ship dark and be turned on per customer.
+package features
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Flag names
+const (
+	Screencast = "screencast" // GET /api/v1/screencast
+	Recording  = "recording"  // /api/v1/recording/*
+)
+
+// Flag describes one experimental capability
+type Flag struct {
+	Name        string
+	Description string
+	Actions     []string // command action kinds the flag gates
+}
+
+// Flags are all known feature flags
+var Flags = []Flag{
+	{Name: Screencast, Description: "Live MJPEG stream of a tab (GET /api/v1/screencast)"},
+	{Name: Recording, Description: "Record a tab to a frame archive (/api/v1/recording)"},
+}
+
+// Known reports whether name is a feature flag
+func Known(name string) bool {
+	for _, f := range Flags {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ForAction returns the flag gating an action kind, or "" if it is not
+// experimental
+func ForAction(kind string) string {
+	for _, f := range Flags {
+		for _, a := range f.Actions {
+			if a == kind {
+				return f.Name
+			}
+		}
+	}
+	return ""
+}
+
+// Parse reads a comma-separated FEATURES list into the set of enabled flags
+func Parse(list string) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !Known(name) {
+			return nil, fmt.Errorf("unknown feature %q (known: %s)", name, strings.Join(names(), ", "))
+		}
+		enabled[name] = true
+	}
+	return enabled, nil
+}
+
+// Where a flag's state for a token comes from
+const (
+	SourceDefault = "default" // off
+	SourceRelay   = "relay"   // FEATURES
+	SourceToken   = "token"   // the token's override
+)
+
+// Resolve returns whether a flag is on for a token with the given
+// overrides, and where that came from. A token override wins over the
+// relay-wide setting.
+func Resolve(relay, overrides map[string]bool, name string) (bool, string) {
+	if on, ok := overrides[name]; ok {
+		return on, SourceToken
+	}
+	if relay[name] {
+		return true, SourceRelay
+	}
+	return false, SourceDefault
+}
+
+func names() []string {
+	out := make([]string, len(Flags))
+	for i, f := range Flags {
+		out[i] = f.Name
+	}
+	sort.Strings(out)
+	return out
+}
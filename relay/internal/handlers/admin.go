@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+// defaultHistoryWindow is the session history reported when since is not
+// given
+const defaultHistoryWindow = 7 * 24 * time.Hour
+
+// AdminSessions lists every connected session across all tokens. With
+// ?activity=1 each session includes its recent command concurrency.
+func (h *Handlers) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := h.hub.AllSessions()
+	var activity map[string]*models.SessionActivity
+	if r.URL.Query().Get("activity") == "1" {
+		activity = h.hub.Activity()
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+
+	offsets := h.hub.ClockOffsets()
+
+	resp := models.AdminSessionsResponse{Sessions: make([]models.AdminSession, 0, len(sessions))}
+	for _, s := range sessions {
+		name, extensionVer, client := s.Info()
+		var offset *int64
+		if o, ok := offsets[s.ID]; ok {
+			offset = &o
+		}
+		resp.Sessions = append(resp.Sessions, models.AdminSession{
+			ID:               s.ID,
+			Name:             name,
+			TokenName:        s.TokenName,
+			ExtensionVersion: extensionVer,
+			Client:           client,
+			Window:           s.CurrentWindow(),
+			ConnectedAt:      s.ConnectedAt,
+			LastPingAt:       s.LastPingAt,
+			ClockOffset:      offset,
+			Tabs:             s.TabList(),
+			Activity:         activity[s.ID],
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminSessionHistory lists the sessions connected between ?since= and
+// ?until= (RFC 3339 times; since may also be a duration before until,
+// like 24h), with each token's uptime over that window and why its
+// sessions disconnected. ?token= limits it to one token by name.
+func (h *Handlers) AdminSessionHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := time.Now().UTC().Truncate(time.Second)
+	until := now
+	if v := q.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "until must be an RFC 3339 time")
+			return
+		}
+		until = t.UTC()
+	}
+	since := until.Add(-defaultHistoryWindow)
+	if v := q.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			since = until.Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			since = t.UTC()
+		} else {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "since must be an RFC 3339 time or a duration like 24h")
+			return
+		}
+	}
+	if !since.Before(until) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "since must be before until")
+		return
+	}
+
+	records, err := h.stores.Sessions.Between(since, until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to read session history")
+		return
+	}
+
+	token := q.Get("token")
+	resp := models.SessionHistoryResponse{Since: since, Until: until, Tokens: []models.TokenUptime{}, Sessions: []*models.SessionRecord{}}
+	byToken := make(map[string][]*models.SessionRecord)
+	var order []string
+	for _, rec := range records {
+		if token != "" && rec.TokenName != token {
+			continue
+		}
+		end := now
+		if rec.DisconnectedAt != nil {
+			end = *rec.DisconnectedAt
+		}
+		rec.Duration = int64(end.Sub(rec.ConnectedAt).Seconds())
+		resp.Sessions = append(resp.Sessions, rec)
+		if _, ok := byToken[rec.TokenHash]; !ok {
+			order = append(order, rec.TokenHash)
+		}
+		byToken[rec.TokenHash] = append(byToken[rec.TokenHash], rec)
+	}
+	for _, hash := range order {
+		resp.Tokens = append(resp.Tokens, tokenUptime(byToken[hash], since, until, now))
+	}
+	sort.Slice(resp.Tokens, func(i, j int) bool {
+		return resp.Tokens[i].TokenName < resp.Tokens[j].TokenName
+	})
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// tokenUptime summarizes one token's sessions, newest first, over the
+// window from since to until. Sessions that overlap count once.
+func tokenUptime(records []*models.SessionRecord, since, until, now time.Time) models.TokenUptime {
+	u := models.TokenUptime{
+		TokenName: records[0].TokenName,
+		Sessions:  len(records),
+		Reasons:   map[string]int{},
+	}
+
+	type span struct{ start, end time.Time }
+	spans := make([]span, 0, len(records))
+	for _, rec := range records {
+		end := now
+		if rec.DisconnectedAt != nil {
+			end = *rec.DisconnectedAt
+			if !end.After(until) {
+				u.Disconnects++
+				u.Reasons[rec.Reason]++
+			}
+		}
+		start := rec.ConnectedAt
+		if start.Before(since) {
+			start = since
+		}
+		if end.After(until) {
+			end = until
+		}
+		if end.After(start) {
+			spans = append(spans, span{start, end})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.Before(spans[j].start) })
+
+	var connected time.Duration
+	var cur span
+	for i, s := range spans {
+		switch {
+		case i == 0:
+			cur = s
+		case s.start.After(cur.end):
+			connected += cur.end.Sub(cur.start)
+			cur = s
+		case s.end.After(cur.end):
+			cur.end = s.end
+		}
+	}
+	if len(spans) > 0 {
+		connected += cur.end.Sub(cur.start)
+	}
+
+	u.Connected = int64(connected.Seconds())
+	u.Uptime = math.Round(10000*connected.Seconds()/until.Sub(since).Seconds()) / 100
+	return u
+}
+
+// pruneSessions drops sessions that ended more than SESSION_HISTORY ago
+func pruneSessions(cfg *config.Config, sessions *store.SessionStore) {
+	ticker := time.NewTicker(time.Hour)
+	for range ticker.C {
+		cutoff := time.Now().Add(-time.Duration(cfg.SessionHistory) * time.Second)
+		if n, err := sessions.DeleteBefore(cutoff); err != nil {
+			log.Error().Err(err).Msg("Failed to prune session history")
+		} else if n > 0 {
+			log.Debug().Int64("sessions", n).Msg("Pruned session history")
+		}
+	}
+}
+
+// AdminConfig returns the effective configuration, with secrets redacted,
+// and where each value came from
+func (h *Handlers) AdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, models.ConfigResponse{Settings: h.cfg.Settings()})
+}
+
+// AdminReload reloads the configuration, as SIGHUP does, and reports which
+// changed settings were applied and which need a restart
+func (h *Handlers) AdminReload(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.cfg.Reload()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_CONFIG", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AdminStats returns command throughput and recent errors
+func (h *Handlers) AdminStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.hub.Stats())
+}
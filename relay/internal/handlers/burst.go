@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
+)
+
+// maxBurstInterval is the longest wait allowed between burst captures, in ms
+const maxBurstInterval = 10000
+
+// validBurst checks the burst options of a screenshot request
+func (h *Handlers) validBurst(w http.ResponseWriter, r *http.Request, req *models.ScreenshotRequest) bool {
+	max := h.cfg.ScreenshotBurstMax
+	switch {
+	case max == 0:
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Burst screenshots are disabled")
+	case req.Burst.Count < 1 || req.Burst.Count > max:
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("burst.count must be between 1 and %d", max))
+	case req.Burst.Interval < 0 || req.Burst.Interval > maxBurstInterval:
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("burst.interval must be between 0 and %d ms", maxBurstInterval))
+	case req.ReturnFormat == "inline" || r.URL.Query().Get("direct") == "1":
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Burst screenshots cannot be returned inline")
+	default:
+		return true
+	}
+	return false
+}
+
+// saveBurst stores each frame of a burst as a screenshot of its own and
+// writes the set
+func (h *Handlers) saveBurst(w http.ResponseWriter, r *http.Request, token *models.Token, tabID, commandID, format string, result *models.ScreenshotResult, queued time.Duration) {
+	frames := result.Frames
+	if len(frames) == 0 {
+		// An extension without burst support takes a single capture
+		frames = []models.ScreenshotResult{*result}
+	}
+
+	rec := timing.FromContext(r.Context())
+	resp := models.ScreenshotBurstResponse{
+		ID:     commandID,
+		TabID:  tabID,
+		Frames: make([]models.ScreenshotFrame, 0, len(frames)),
+	}
+	for i, frame := range frames {
+		start := time.Now()
+		decoded, err := decodeBase64Image(frame.Data, h.cfg.MaxScreenshotSize)
+		rec.Since(timing.Decode, start)
+		if err != nil {
+			if _, ok := err.(*FileSizeError); ok {
+				log.Warn().Int("maxMB", h.cfg.MaxScreenshotSize).Int("frame", i).Msg("Screenshot size exceeds limit")
+				writeError(w, http.StatusBadRequest, "FILE_TOO_LARGE", fmt.Sprintf("Frame %d exceeds maximum size limit", i))
+				return
+			}
+			log.Error().Err(err).Int("frame", i).Msg("Failed to decode screenshot")
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to decode screenshot")
+			return
+		}
+
+		start = time.Now()
+		shot, err := h.saveScreenshot(token, tabID, commandID, format, decoded, frame.Width, frame.Height)
+		rec.Since(timing.ArtifactWrite, start)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to save screenshot")
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save screenshot")
+			return
+		}
+		resp.Frames = append(resp.Frames, models.ScreenshotFrame{
+			ID:        shot.ID,
+			URL:       shot.URL,
+			Width:     shot.Width,
+			Height:    shot.Height,
+			Size:      shot.Size,
+			Offset:    frame.Offset,
+			ExpiresAt: shot.ExpiresAt,
+		})
+	}
+
+	resp.QueueTime = queued.Milliseconds()
+	resp.Timing = rec.Timing()
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Screenshots fail with this code when the browser refuses to capture
+// more often; it asks to be retried shortly
+const captureRateLimited = "CAPTURE_RATE_LIMITED"
+
+// captureRetryDelay is how long to wait before retrying a capture the
+// browser rate limited
+const captureRetryDelay = 500 * time.Millisecond
+
+// errCaptureBusy means no capture slot freed up within
+// SCREENSHOT_QUEUE_TIMEOUT
+var errCaptureBusy = errors.New("screenshot pipeline busy")
+
+// captureQueue bounds how many screenshots the relay captures, decodes, and
+// writes at once. Requests past the limit wait briefly for a slot instead
+// of piling onto the extension and the disk.
+type captureQueue struct {
+	slots    chan struct{} // nil when unlimited
+	waiting  atomic.Int64
+	timeouts atomic.Int64
+}
+
+func newCaptureQueue(size int) *captureQueue {
+	q := &captureQueue{}
+	if size > 0 {
+		q.slots = make(chan struct{}, size)
+	}
+	return q
+}
+
+// acquire waits up to maxWait for a slot; the returned func frees it
+func (q *captureQueue) acquire(ctx context.Context, maxWait time.Duration) (func(), error) {
+	if q.slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-q.slots }
+
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.waiting.Add(1)
+	defer q.waiting.Add(-1)
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		q.timeouts.Add(1)
+		return nil, errCaptureBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireArtifactWorker waits up to maxWait for one of the token's
+// artifact workers; the returned func frees it
+func (h *Handlers) acquireArtifactWorker(ctx context.Context, tokenHash string, maxWait time.Duration) (func(), error) {
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	release, err := h.artifactWorkers.Acquire(waitCtx, tokenHash)
+	if err != nil && ctx.Err() == nil {
+		h.captures.timeouts.Add(1)
+		return nil, errCaptureBusy
+	}
+	return release, err
+}
+
+// capture takes one of the token's artifact workers and then a capture
+// slot, and sends a screenshot command, retrying while the browser rate
+// limits captures, all within SCREENSHOT_QUEUE_TIMEOUT. It returns how
+// long the request was held back; the caller must call release once the
+// screenshot is stored.
+func (h *Handlers) capture(ctx context.Context, tokenHash string, cmd *models.CommandRequest) (resp *models.CommandResponse, queued time.Duration, release func(), err error) {
+	start := time.Now()
+	maxWait := time.Duration(h.cfg.ScreenshotQueueTimeout) * time.Millisecond
+	deadline := start.Add(maxWait)
+
+	freeWorker, err := h.acquireArtifactWorker(ctx, tokenHash, maxWait)
+	if err != nil {
+		return nil, time.Since(start), nil, err
+	}
+	freeSlot, err := h.captures.acquire(ctx, time.Until(deadline))
+	if err != nil {
+		freeWorker()
+		return nil, time.Since(start), nil, err
+	}
+	release = func() {
+		freeSlot()
+		freeWorker()
+	}
+	queued = time.Since(start)
+
+	for {
+		resp, err = h.hub.SendCommand(ctx, tokenHash, cmd)
+		if err != nil || resp.Success || resp.Error == nil || resp.Error.Code != captureRateLimited ||
+			time.Now().Add(captureRetryDelay).After(deadline) {
+			return resp, queued, release, err
+		}
+
+		wait := time.Now()
+		select {
+		case <-time.After(captureRetryDelay):
+		case <-ctx.Done():
+			release()
+			return nil, queued, nil, ctx.Err()
+		}
+		queued += time.Since(wait)
+	}
+}
+
+// writeCaptureBusy tells the client to come back in a second
+func writeCaptureBusy(w http.ResponseWriter) {
+	var body models.APIError
+	body.Error.Code = "SCREENSHOT_BUSY"
+	body.Error.Message = "Too many screenshots in progress; retry shortly"
+	body.Error.RetryAfter = 1
+	w.Header().Set("Retry-After", strconv.Itoa(body.Error.RetryAfter))
+	writeJSON(w, http.StatusServiceUnavailable, body)
+}
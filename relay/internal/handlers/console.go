@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Console returns a tab's recent console messages and page errors
+func (h *Handlers) Console(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	q := r.URL.Query()
+	tabID := q.Get("tabId")
+	if tabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+
+	query := hub.ConsoleQuery{Level: q.Get("level")}
+	if query.Level != "" && !hub.ValidConsoleLevel(query.Level) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "level must be debug, log, info, warn or error")
+		return
+	}
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "after must be a non-negative sequence number")
+			return
+		}
+		query.After = after
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be a positive number")
+			return
+		}
+		query.Limit = limit
+	}
+
+	if _, ok := h.hub.FindTab(tokenHash, tabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+
+	entries, dropped := h.hub.Console(tokenHash, tabID, query)
+	writeJSON(w, http.StatusOK, models.ConsoleResponse{
+		TabID:   tabID,
+		Entries: entries,
+		Dropped: dropped,
+	})
+}
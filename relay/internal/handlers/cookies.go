@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// maxCookiesPerRequest caps the cookies one POST /api/v1/cookies may set
+const maxCookiesPerRequest = 100
+
+// GetCookies returns the cookies of an attached tab's origin
+func (h *Handlers) GetCookies(w http.ResponseWriter, r *http.Request) {
+	tabID := r.URL.Query().Get("tabId")
+	resp, ok := h.tabCommand(w, r, tabID, models.CommandAction{
+		Kind: "cookies_get",
+		Name: r.URL.Query().Get("name"),
+	})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.CookiesResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.CookiesResponse{TabID: tabID, URL: result.URL, Cookies: result.Cookies})
+}
+
+// SetCookies sets cookies on an attached tab's origin, for reusing a
+// session signed in elsewhere
+func (h *Handlers) SetCookies(w http.ResponseWriter, r *http.Request) {
+	var req models.SetCookiesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Cookies) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "cookies is required")
+		return
+	}
+	if len(req.Cookies) > maxCookiesPerRequest {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("at most %d cookies can be set at once", maxCookiesPerRequest))
+		return
+	}
+	for _, c := range req.Cookies {
+		if err := c.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+	}
+
+	resp, ok := h.tabCommand(w, r, req.TabID, models.CommandAction{Kind: "cookies_set", Cookies: req.Cookies})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.CookiesResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.CookiesResponse{TabID: req.TabID, URL: result.URL, Cookies: result.Cookies})
+}
+
+// ClearCookies removes the cookies of an attached tab's origin, or only
+// the one named by ?name=
+func (h *Handlers) ClearCookies(w http.ResponseWriter, r *http.Request) {
+	tabID := r.URL.Query().Get("tabId")
+	resp, ok := h.tabCommand(w, r, tabID, models.CommandAction{
+		Kind: "cookies_clear",
+		Name: r.URL.Query().Get("name"),
+	})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.CookiesClearResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.ClearCookiesResponse{TabID: tabID, URL: result.URL, Removed: result.Removed})
+}
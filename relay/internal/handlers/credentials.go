@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetCredentials returns the origins an attached tab answers auth
+// challenges for, without their passwords
+func (h *Handlers) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	h.credentialsCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "credentials_get"})
+}
+
+// SetCredential gives an attached tab a username and password for an
+// origin's basic or digest auth, so navigating to it does not stop at the
+// browser's sign-in dialog. It replaces the origin's earlier credential.
+func (h *Handlers) SetCredential(w http.ResponseWriter, r *http.Request) {
+	var req models.SetCredentialRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Credential.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	h.credentialsCommand(w, r, req.TabID, models.CommandAction{Kind: "credentials_set", Credential: &req.Credential})
+}
+
+// ClearCredentials forgets an attached tab's credentials, or only those of
+// the origin given
+func (h *Handlers) ClearCredentials(w http.ResponseWriter, r *http.Request) {
+	origin := r.URL.Query().Get("origin")
+	if origin != "" {
+		var err error
+		if origin, err = models.NormalizeOrigin(origin); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+	}
+	h.credentialsCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "credentials_clear", Origin: origin})
+}
+
+func (h *Handlers) credentialsCommand(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction) {
+	resp, ok := h.tabCommand(w, r, tabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.CredentialsResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	credentials := make([]models.Credential, 0, len(result.Credentials))
+	for _, c := range result.Credentials {
+		credentials = append(credentials, models.Credential{Origin: c.Origin, Username: c.Username})
+	}
+	writeJSON(w, http.StatusOK, models.CredentialsResponse{TabID: tabID, Credentials: credentials})
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// commandTimeout picks a command's timeout in ms: the request's own, then
+// the token's default, then COMMAND_TIMEOUT
+func (h *Handlers) commandTimeout(token *models.Token, requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	if token.Defaults.Timeout > 0 {
+		return token.Defaults.Timeout
+	}
+	return h.cfg.DefaultCommandTimeout()
+}
+
+// applyDefaults fills the options an action leaves out from the token's
+// defaults
+func applyDefaults(d models.TokenDefaults, action *models.CommandAction) {
+	switch action.Kind {
+	case "snapshot":
+		if action.Format == "" {
+			action.Format = d.SnapshotFormat
+		}
+		if action.MaxDepth <= 0 {
+			action.MaxDepth = d.SnapshotMaxDepth
+		}
+		if action.MaxLength <= 0 {
+			action.MaxLength = d.SnapshotMaxLength
+		}
+	case "click", "doubleclick", "hover", "drag", "type", "press", "select":
+		if action.Actionability == nil {
+			action.Actionability = d.Actionability
+		}
+	}
+}
+
+// failureScreenshot captures a tab after a command on it failed. It returns
+// nil if the capture fails; the command's own error is what matters.
+func (h *Handlers) failureScreenshot(ctx context.Context, w http.ResponseWriter, token *models.Token, tokenHash, tabID string) *models.ScreenshotResponse {
+	if tabID == "" || !token.HasScope(models.ScopeScreenshot) {
+		return nil
+	}
+
+	timeout := h.commandTimeout(token, 0)
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   tabID,
+		Action:  models.CommandAction{Kind: "screenshot", Format: "png"},
+		Timeout: timeout,
+	}
+
+	ctx, cancel := h.commandContext(ctx, w, timeout)
+	defer cancel()
+
+	resp, _, release, err := h.capture(ctx, tokenHash, cmd)
+	if err == nil {
+		defer release()
+		if !resp.Success {
+			err = errors.New(resp.Error.Message)
+		}
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("tab_id", tabID).Msg("Failed to capture failure screenshot")
+		return nil
+	}
+
+	result, ok := resp.Decoded.(*models.ScreenshotResult)
+	if !ok {
+		return nil
+	}
+	decoded, err := decodeBase64Image(result.Data, h.cfg.MaxScreenshotSize)
+	if err != nil {
+		log.Debug().Err(err).Str("tab_id", tabID).Msg("Failed to decode failure screenshot")
+		return nil
+	}
+
+	shot, err := h.saveScreenshot(token, tabID, cmd.ID, "png", decoded, result.Width, result.Height)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save failure screenshot")
+		return nil
+	}
+	return shot
+}
+
+// GetTokenDefaults returns the action defaults of a token
+func (h *Handlers) GetTokenDefaults(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	defaults, err := h.stores.Tokens.Defaults(tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to load token defaults")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load token defaults")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, defaults)
+}
+
+// SetTokenDefaults replaces the action defaults of a token
+func (h *Handlers) SetTokenDefaults(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	var defaults models.TokenDefaults
+	if err := json.NewDecoder(r.Body).Decode(&defaults); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := defaults.Validate(h.cfg.MaxCommandTimeout()); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	if err := h.stores.Tokens.SetDefaults(tokenID, defaults); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update token defaults")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update token defaults")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, defaults)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/downloads"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ListDownloads returns the files downloaded in the token's tabs, newest
+// first; ?tabId= keeps those of one tab
+func (h *Handlers) ListDownloads(w http.ResponseWriter, r *http.Request) {
+	if h.downloads == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Downloads are not collected (DOWNLOAD_MAX_SIZE=0)")
+		return
+	}
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	writeJSON(w, http.StatusOK, models.DownloadsResponse{
+		Downloads: h.downloads.List(tokenHash, r.URL.Query().Get("tabId")),
+	})
+}
+
+// GetDownload serves the content of a completed download
+func (h *Handlers) GetDownload(w http.ResponseWriter, r *http.Request) {
+	if h.downloads == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Downloads are not collected (DOWNLOAD_MAX_SIZE=0)")
+		return
+	}
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	info, path, ok := h.downloads.Get(tokenHash, chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Download not found")
+		return
+	}
+	switch info.Status {
+	case downloads.StatusReceiving:
+		writeError(w, http.StatusConflict, "DOWNLOAD_IN_PROGRESS", "The extension is still sending the file")
+		return
+	case downloads.StatusFailed:
+		writeError(w, http.StatusConflict, "DOWNLOAD_FAILED", info.Error)
+		return
+	}
+
+	contentType := info.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Filename}))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeFile(w, r, path)
+}
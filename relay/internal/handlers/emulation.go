@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetEmulation returns the geolocation, timezone, and language an
+// attached tab emulates
+func (h *Handlers) GetEmulation(w http.ResponseWriter, r *http.Request) {
+	h.emulationCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "emulation_get"})
+}
+
+// SetEmulation makes an attached tab report another geolocation,
+// timezone, and language, for testing a site the way its users in other
+// places see it. It replaces whatever the tab emulated before.
+func (h *Handlers) SetEmulation(w http.ResponseWriter, r *http.Request) {
+	var req models.SetEmulationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Emulation.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	h.emulationCommand(w, r, req.TabID, models.CommandAction{Kind: "emulation_set", Emulation: &req.Emulation})
+}
+
+// ClearEmulation stops an attached tab emulating anything
+func (h *Handlers) ClearEmulation(w http.ResponseWriter, r *http.Request) {
+	h.emulationCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "emulation_clear"})
+}
+
+func (h *Handlers) emulationCommand(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction) {
+	resp, ok := h.tabCommand(w, r, tabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.EmulationResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.EmulationResponse{TabID: tabID, Emulation: result.Emulation})
+}
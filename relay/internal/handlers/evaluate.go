@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Evaluate runs JavaScript in a tab and returns its result. The script runs
+// in the page's own context, with the page's privileges, so it needs the
+// evaluate scope and is not accepted as a kind of POST /api/v1/command.
+func (h *Handlers) Evaluate(w http.ResponseWriter, r *http.Request) {
+	var req models.EvaluateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	action := models.CommandAction{
+		Kind:          "evaluate",
+		Script:        req.Script,
+		Args:          req.Args,
+		AwaitPromise:  req.AwaitPromise,
+		ReturnByValue: req.ReturnByValue,
+		MaxDepth:      req.MaxDepth,
+	}
+	if err := action.ValidateEvaluate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if action.MaxDepth == 0 {
+		action.MaxDepth = models.DefaultEvaluateDepth
+	}
+	maxSize := req.MaxSize
+	if maxSize < 0 || maxSize > h.cfg.EvaluateMaxResult {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("maxSize must be between 1 and %d (EVALUATE_MAX_RESULT)", h.cfg.EvaluateMaxResult))
+		return
+	}
+	if maxSize == 0 {
+		maxSize = h.cfg.EvaluateMaxResult
+	}
+
+	resp, ok := h.tabCommand(w, r, req.TabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.EvaluateResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	body := models.EvaluateResponse{
+		TabID:       req.TabID,
+		Value:       result.Value,
+		Type:        result.Type,
+		ClassName:   result.ClassName,
+		Description: result.Description,
+		Size:        len(result.Value),
+	}
+	if body.Size > maxSize {
+		body.Value = nil
+		body.Truncated = true
+		body.Preview = cutUTF8(string(result.Value), maxSize)
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// cutUTF8 returns at most n bytes of s without splitting a character
+func cutUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
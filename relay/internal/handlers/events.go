@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+)
+
+// How often an idle event stream sends a comment, so proxies and clients
+// do not take it for dead
+const eventsHeartbeat = 15 * time.Second
+
+// eventsWriteTimeout bounds each write to an event stream
+const eventsWriteTimeout = 10 * time.Second
+
+// Events streams the page events of the token's tabs as server-sent
+// events: URL and title changes, finished navigations, dialogs and DOM
+// mutations, so agents can react to a page instead of polling it. The
+// stream lasts until the client leaves or the request reaches
+// HTTP_TIMEOUT_MAX.
+func (h *Handlers) Events(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	query := r.URL.Query()
+	tabID := query.Get("tabId")
+	if tabID != "" {
+		if _, ok := h.hub.FindTab(tokenHash, tabID); !ok {
+			writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+			return
+		}
+	}
+
+	var types []string
+	if v := query.Get("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.TrimSpace(t)
+			if !hub.ValidPageEvent(t) {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+					fmt.Sprintf("unknown event type %q; use url_changed, title_changed, navigation_completed, dialog_opened or dom_mutated", t))
+				return
+			}
+			types = append(types, t)
+		}
+	}
+
+	sub := h.hub.SubscribePageEvents(tokenHash, tabID, types)
+	defer h.hub.UnsubscribePageEvents(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, ": connected\n\n"); err != nil || rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	var id int64
+	for {
+		var frame string
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			frame = ": ping\n\n"
+		case e := <-sub.Events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			id++
+			frame = fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", id, e.Type, data)
+		}
+		// Tell the client about events it missed by falling behind
+		if n := sub.Dropped(); n > 0 {
+			frame = fmt.Sprintf("event: dropped\ndata: {\"dropped\":%d}\n\n", n) + frame
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if _, err := fmt.Fprint(w, frame); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
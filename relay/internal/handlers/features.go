@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/features"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Features lists the experimental features and which the token may use
+func (h *Handlers) Features(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+
+	resp := models.FeaturesResponse{Features: make([]models.Feature, 0, len(features.Flags))}
+	for _, f := range features.Flags {
+		on, source := features.Resolve(h.cfg.EnabledFeatures, token.Features, f.Name)
+		resp.Features = append(resp.Features, models.Feature{
+			Name:        f.Name,
+			Description: f.Description,
+			Enabled:     on,
+			Source:      source,
+			Actions:     f.Actions,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// checkActionFeature writes FEATURE_DISABLED and returns false if an action
+// kind is experimental and not enabled for the token
+func (h *Handlers) checkActionFeature(w http.ResponseWriter, token *models.Token, kind string) bool {
+	name := features.ForAction(kind)
+	if name == "" {
+		return true
+	}
+	if on, _ := features.Resolve(h.cfg.EnabledFeatures, token.Features, name); !on {
+		middleware.WriteFeatureDisabled(w, name)
+		return false
+	}
+	return true
+}
+
+// GetTokenFeatures returns the feature flag overrides of a token
+func (h *Handlers) GetTokenFeatures(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	overrides, err := h.stores.Tokens.Features(tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to load token features")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load token features")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, overrides)
+}
+
+// SetTokenFeatures replaces the feature flag overrides of a token. Flags
+// left out follow FEATURES.
+func (h *Handlers) SetTokenFeatures(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	var overrides map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	for name := range overrides {
+		if !features.Known(name) {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Unknown feature: "+name)
+			return
+		}
+	}
+	if overrides == nil {
+		overrides = map[string]bool{}
+	}
+
+	if err := h.stores.Tokens.SetFeatures(tokenID, overrides); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update token features")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update token features")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, overrides)
+}
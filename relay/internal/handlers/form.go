@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// maxFormFields is the most fields one fill_form may set
+const maxFormFields = 200
+
+// FillForm sets many fields of a tab's form in one command. The extension
+// checks every field before changing any, so a form is either filled
+// entirely or left untouched.
+func (h *Handlers) FillForm(w http.ResponseWriter, r *http.Request) {
+	var req models.FormRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if !checkFormFields(w, req.Fields) {
+		return
+	}
+
+	resp, ok := h.tabCommand(w, r, req.TabID, models.CommandAction{
+		Kind:          "fill_form",
+		Fields:        req.Fields,
+		Actionability: req.Actionability,
+	})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.FillFormResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	body := models.FormResponse{TabID: req.TabID, Filled: result.Filled, Fields: result.Fields}
+	if result.Filled {
+		writeJSON(w, http.StatusOK, body)
+		return
+	}
+
+	// The per-field results say which fields to fix
+	failed := 0
+	for _, f := range result.Fields {
+		if !f.Success {
+			failed++
+		}
+	}
+	var apiErr models.APIError
+	apiErr.Error.Code = "FORM_NOT_FILLED"
+	apiErr.Error.Message = fmt.Sprintf("%d of %d fields cannot be filled; nothing was changed", failed, len(result.Fields))
+	writeJSON(w, http.StatusUnprocessableEntity, struct {
+		models.APIError
+		models.FormResponse
+	}{apiErr, body})
+}
+
+// checkFormFields writes an error response and returns false unless each
+// field has a selector and a value fill_form can set
+func checkFormFields(w http.ResponseWriter, fields map[string]any) bool {
+	if len(fields) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "fields is required")
+		return false
+	}
+	if len(fields) > maxFormFields {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("At most %d fields can be filled at once", maxFormFields))
+		return false
+	}
+	for selector, value := range fields {
+		if selector == "" {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "field selectors must not be empty")
+			return false
+		}
+		if !validFormValue(value) {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+				fmt.Sprintf("fields[%q] must be a string, number, boolean, or list of strings", selector))
+			return false
+		}
+	}
+	return true
+}
+
+func validFormValue(value any) bool {
+	switch v := value.(type) {
+	case string, float64, bool:
+		return true
+	case []any:
+		for _, option := range v {
+			if _, ok := option.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -5,41 +5,117 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
+	"github.com/emreylmaz/owlrelay/relay/internal/apidoc"
+	"github.com/emreylmaz/owlrelay/relay/internal/artifact"
 	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/contentproc"
+	"github.com/emreylmaz/owlrelay/relay/internal/dashboard"
+	"github.com/emreylmaz/owlrelay/relay/internal/dispatch"
+	"github.com/emreylmaz/owlrelay/relay/internal/downloads"
+	"github.com/emreylmaz/owlrelay/relay/internal/features"
 	"github.com/emreylmaz/owlrelay/relay/internal/hub"
 	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
 	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/oidc"
+	"github.com/emreylmaz/owlrelay/relay/internal/recording"
+	"github.com/emreylmaz/owlrelay/relay/internal/replication"
+	"github.com/emreylmaz/owlrelay/relay/internal/retention"
+	"github.com/emreylmaz/owlrelay/relay/internal/scheduler"
+	"github.com/emreylmaz/owlrelay/relay/internal/scripts"
 	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
+	"github.com/emreylmaz/owlrelay/relay/internal/webhooks"
+	"github.com/emreylmaz/owlrelay/relay/internal/workers"
 )
 
+// tabSyncTimeout bounds how long GET /tabs?refresh=1 waits for extensions
+const tabSyncTimeout = 2 * time.Second
+
 // Handlers contains all HTTP handlers
 type Handlers struct {
 	cfg        *config.Config
 	hub        *hub.Hub
-	tokenStore *store.TokenStore
+	dispatcher *dispatch.Dispatcher
+	stores     *store.Stores
+	node       *replication.Node
+	limiter    middleware.Limiter
+	ipLimits   *middleware.IPLimits
+	artifacts  *artifact.Store
+	retention  *retention.Manager
+	results    *commandResults
+	recorder   *recording.Recorder
+	downloads  *downloads.Store // nil when downloads are not collected
+	scripts    *scripts.Recorder
+	webhooks   *webhooks.Notifier
+	scheduler  *scheduler.Scheduler
+	oidc       *oidc.Verifier // nil unless OIDC_ISSUER is set
+	captures   *captureQueue
+	shotURLs   *screenshotURLs
 	version    string
 	startTime  time.Time
+
+	// Per-token slots for capturing, decoding, and storing screenshots
+	artifactWorkers *workers.Pools
+
+	screencasts atomic.Int64 // streams in progress
 }
 
-// New creates a new Handlers instance
-func New(cfg *config.Config, h *hub.Hub, tokenStore *store.TokenStore, version string) *Handlers {
-	return &Handlers{
+// New creates a new Handlers instance. Schedules fire until ctx ends.
+func New(ctx context.Context, cfg *config.Config, h *hub.Hub, stores *store.Stores, node *replication.Node, limiter middleware.Limiter, ipLimits *middleware.IPLimits, artifacts *artifact.Store, version string) *Handlers {
+	hs := &Handlers{
 		cfg:        cfg,
 		hub:        h,
-		tokenStore: tokenStore,
+		dispatcher: dispatch.New(cfg, h),
+		stores:     stores,
+		node:       node,
+		limiter:    limiter,
+		ipLimits:   ipLimits,
+		artifacts:  artifacts,
+		retention:  retention.New(cfg, stores, artifacts),
+		results:    newCommandResults(cfg),
+		captures:   newCaptureQueue(cfg.ScreenshotConcurrency),
+		shotURLs:   newScreenshotURLs(cfg),
 		version:    version,
 		startTime:  time.Now(),
+
+		artifactWorkers: workers.New(cfg.TokenArtifactWorkers),
 	}
+	hs.recorder = recording.New(cfg, h, hs.captureFrame)
+	hs.scripts = scripts.New(cfg)
+	h.SetScripts(hs.scripts)
+	hs.oidc = oidc.New(cfg)
+	hs.webhooks = webhooks.New(cfg, stores.Webhooks)
+	h.SetWebhooks(hs.webhooks)
+	h.SetSessionHistory(stores.Sessions)
+	if cfg.SessionHistory > 0 {
+		go pruneSessions(cfg, stores.Sessions)
+	}
+	limiter.OnLimited(hs.webhooks.RateLimited)
+	hs.scheduler = scheduler.New(ctx, cfg, stores, node, hs.webhooks, hs.runSchedule)
+	if cfg.DownloadMaxSize > 0 {
+		hs.downloads = downloads.New(cfg)
+		h.SetDownloads(hs.downloads)
+	}
+	return hs
+}
+
+// Drain waits for schedule runs in progress until ctx ends, then cancels
+// the rest
+func (h *Handlers) Drain(ctx context.Context) {
+	h.scheduler.Drain(ctx)
 }
 
 // Health returns server health status
@@ -48,6 +124,8 @@ func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
 		Status:  "ok",
 		Version: h.version,
 		Uptime:  int64(time.Since(h.startTime).Seconds()),
+		Role:    h.node.Role(),
+		Primary: h.node.PrimaryURL(),
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
@@ -62,16 +140,32 @@ func (h *Handlers) Status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := h.hub.GetSession(tokenHash)
+	sessions := h.hub.GetSessions(tokenHash)
 
 	resp := models.StatusResponse{
-		Connected: session != nil,
+		Connected:    len(sessions) > 0,
+		SessionCount: len(sessions),
 	}
 
-	if session != nil {
+	if len(sessions) > 0 {
+		session := sessions[len(sessions)-1]
 		resp.LastSeen = session.LastPingAt.Format(time.RFC3339)
-		resp.ExtensionVersion = session.ExtensionVer
-		resp.TabCount = len(session.Tabs)
+		resp.SessionName, resp.ExtensionVersion, _ = session.Info()
+		for _, s := range sessions {
+			name, extensionVer, client := s.Info()
+			tabs := s.TabCount()
+			resp.TabCount += tabs
+			resp.Sessions = append(resp.Sessions, models.SessionSummary{
+				ID:               s.ID,
+				Name:             name,
+				ExtensionVersion: extensionVer,
+				Client:           client,
+				Window:           s.CurrentWindow(),
+				TabCount:         tabs,
+				ConnectedAt:      s.ConnectedAt,
+				Node:             s.Node,
+			})
+		}
 	}
 
 	writeJSON(w, http.StatusOK, resp)
@@ -87,18 +181,31 @@ func (h *Handlers) Tabs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := h.hub.GetSession(tokenHash)
-	if session == nil {
+	sessions := h.hub.GetSessions(tokenHash)
+	if len(sessions) == 0 {
 		writeError(w, http.StatusServiceUnavailable, "EXTENSION_OFFLINE", "Extension is not connected")
 		return
 	}
 
-	tabs := make([]*models.Tab, 0, len(session.Tabs))
-	for _, tab := range session.Tabs {
-		tabs = append(tabs, tab)
+	// Ask extensions for their full tab list before answering
+	if r.URL.Query().Get("refresh") == "1" {
+		ctx, cancel := context.WithTimeout(r.Context(), tabSyncTimeout)
+		h.hub.RequestSync(ctx, tokenHash)
+		cancel()
+	}
+
+	tabs := make([]*models.Tab, 0)
+	for _, session := range sessions {
+		tabs = append(tabs, session.TabList()...)
 	}
 
-	writeJSON(w, http.StatusOK, models.TabsResponse{Tabs: tabs})
+	since := r.URL.Query().Get("since")
+	changes := h.hub.TabChanges(tokenHash, tabs, since)
+	if since != "" {
+		writeJSON(w, http.StatusOK, changes)
+		return
+	}
+	writeJSON(w, http.StatusOK, models.TabsResponse{Tabs: tabs, Cursor: changes.Cursor})
 }
 
 // Command executes a command on the browser
@@ -114,11 +221,11 @@ func (h *Handlers) Command(w http.ResponseWriter, r *http.Request) {
 	var req models.CommandAPIRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Debug().Err(err).Msg("Failed to decode command request")
-		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		writeBodyError(w, err)
 		return
 	}
 
-	if req.TabID == "" {
+	if req.TabID == "" && req.Action.Kind != "tab_create" {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
 		return
 	}
@@ -128,31 +235,121 @@ func (h *Handlers) Command(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	timeout := req.Timeout
-	if timeout <= 0 {
-		timeout = h.cfg.CommandTimeout
+	if !h.checkAction(w, &req.Action) {
+		return
+	}
+
+	if scope := models.ScopeForAction(req.Action.Kind); !token.HasScope(scope) {
+		writeError(w, http.StatusForbidden, "FORBIDDEN", "Token lacks required scope: "+scope)
+		return
+	}
+
+	if !h.checkActionFeature(w, token, req.Action.Kind) {
+		return
+	}
+
+	if !h.checkURLPolicy(w, token, tokenHash, req.TabID, req.Action) {
+		return
+	}
+
+	applyDefaults(token.Defaults, &req.Action)
+	timeout := h.commandTimeout(token, req.Timeout)
+	if timeout > h.cfg.MaxCommandTimeout() {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("timeout must be at most %dms (HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD)", h.cfg.MaxCommandTimeout()))
+		return
+	}
+
+	switch req.Priority {
+	case "", models.PriorityHigh, models.PriorityNormal, models.PriorityLow:
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "priority must be high, normal, or low")
+		return
+	}
+
+	onDisconnect := req.OnDisconnect
+	if onDisconnect == "" {
+		onDisconnect = h.cfg.CommandOnDisconnect
+	}
+	if onDisconnect != models.OnDisconnectCancel && onDisconnect != models.OnDisconnectComplete {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "onDisconnect must be cancel or complete")
+		return
+	}
+
+	id := req.ID
+	if id == "" {
+		id = uuid.New().String()
+	} else if len(id) > 128 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "id must be at most 128 characters")
+		return
 	}
 
 	cmd := &models.CommandRequest{
 		Type:    "command",
-		ID:      uuid.New().String(),
+		ID:      id,
 		Action:  req.Action,
 		TabID:   req.TabID,
 		Timeout: timeout,
+
+		Priority:         req.Priority,
+		CanaryPreference: req.Canary,
 	}
 
+	// In complete mode the command outlives the request; if the client goes
+	// away its result is kept for GET /api/v1/commands/{id}
+	parent := r.Context()
+	stored := make(chan struct{})
+	stopStoring := func() bool { return true }
 	start := time.Now()
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Millisecond)
+	if onDisconnect == models.OnDisconnectComplete {
+		parent = context.WithoutCancel(parent)
+		stopStoring = context.AfterFunc(r.Context(), func() {
+			h.results.start(tokenHash, cmd.ID, start.UTC())
+			close(stored)
+		})
+	}
+
+	ctx, cancel := h.commandContext(parent, w, timeout)
 	defer cancel()
 
 	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
-	elapsed := time.Since(start).Milliseconds()
+
+	apiResp := models.CommandAPIResponse{ID: cmd.ID}
+	apiResp.Timing.Total = time.Since(start).Milliseconds()
+	apiResp.Timing.Phases = timing.FromContext(r.Context()).Phases()
+	if err == nil {
+		apiResp.Canary = resp.Canary
+		if resp.Timing != nil {
+			apiResp.Timing.Received, apiResp.Timing.Completed = resp.Timing.Received, resp.Timing.Completed
+		}
+	}
+
+	if !stopStoring() {
+		<-stored
+		if err != nil {
+			apiResp.Error = &models.CommandError{Code: "INTERNAL_ERROR", Message: err.Error()}
+			if hubErr, ok := err.(*hub.HubError); ok {
+				apiResp.Error.Code = hubErr.Code
+			}
+		} else {
+			apiResp.Success, apiResp.Result, apiResp.Error = resp.Success, resp.Decoded, resp.Error
+		}
+		h.results.complete(cmd.ID, &apiResp)
+		return
+	}
 
 	if err != nil {
 		if hubErr, ok := err.(*hub.HubError); ok {
 			statusCode := http.StatusServiceUnavailable
-			if hubErr.Code == "TIMEOUT" {
+			switch hubErr.Code {
+			case "TIMEOUT":
 				statusCode = http.StatusGatewayTimeout
+			case "DUPLICATE_ID":
+				statusCode = http.StatusConflict
+			case "QUEUE_FULL", "QUEUE_TIMEOUT":
+				statusCode = http.StatusTooManyRequests
+			case "UNSUPPORTED_ACTION":
+				statusCode = http.StatusUnprocessableEntity
 			}
 			writeError(w, statusCode, hubErr.Code, hubErr.Message)
 			return
@@ -161,16 +358,147 @@ func (h *Handlers) Command(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiResp := models.CommandAPIResponse{
-		Success: resp.Success,
-		Result:  resp.Result,
-		Error:   resp.Error,
+	apiResp.Success = resp.Success
+	apiResp.Result = resp.Decoded
+	apiResp.Error = resp.Error
+
+	screenshotOnFailure := token.Defaults.ScreenshotOnFailure
+	if req.ScreenshotOnFailure != nil {
+		screenshotOnFailure = *req.ScreenshotOnFailure
+	}
+	if !resp.Success && screenshotOnFailure && req.Action.Kind != "tab_close" {
+		apiResp.FailureScreenshot = h.failureScreenshot(r.Context(), w, token, tokenHash, req.TabID)
 	}
-	apiResp.Timing.Total = elapsed
 
 	writeJSON(w, http.StatusOK, apiResp)
 }
 
+// checkAction writes an error response and returns false unless the
+// action is valid for its kind. Defaults the relay fills in are set on it.
+func (h *Handlers) checkAction(w http.ResponseWriter, action *models.CommandAction) bool {
+	if err := action.ValidateSelectorEngine(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return false
+	}
+	switch action.Kind {
+	case "cookies_set":
+		for _, c := range action.Cookies {
+			if err := c.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return false
+			}
+		}
+	case "storage_get", "storage_set", "storage_remove":
+		if !h.checkStorageAction(w, action) {
+			return false
+		}
+	case "upload":
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "upload carries files; use POST /api/v1/upload")
+		return false
+	case "evaluate":
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "use POST /api/v1/evaluate to run JavaScript")
+		return false
+	case "fill_form":
+		if !checkFormFields(w, action.Fields) {
+			return false
+		}
+	case "emulation_set":
+		if action.Emulation == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "emulation is required")
+			return false
+		}
+		if err := action.Emulation.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "set_viewport":
+		if action.Viewport != nil {
+			if err := action.Viewport.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return false
+			}
+		}
+	case "set_network_conditions":
+		if action.NetworkConditions != nil {
+			if err := action.NetworkConditions.Validate(); err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return false
+			}
+			action.NetworkConditions.ApplyPreset()
+		}
+	case "request_rules_set":
+		if action.RequestRules == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "requestRules is required")
+			return false
+		}
+		if err := models.ValidateRequestRules(action.RequestRules.Rules); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "headers_set":
+		if action.ExtraHeaders == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "extraHeaders is required")
+			return false
+		}
+		if err := action.ExtraHeaders.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "credentials_set":
+		if action.Credential == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "credential is required")
+			return false
+		}
+		if err := action.Credential.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "credentials_clear":
+		if action.Origin != "" {
+			origin, err := models.NormalizeOrigin(action.Origin)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return false
+			}
+			action.Origin = origin
+		}
+	case "press":
+		if err := models.ValidateKeyCombo(action.Key); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "hover", "doubleclick", "drag":
+		if err := action.ValidatePointer(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "select":
+		if err := action.ValidateSelect(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "scroll_to":
+		if err := action.ValidateScrollTo(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "screenshot":
+		if err := action.ValidateCapture(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+	case "query":
+		if err := action.ValidateQuery(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return false
+		}
+		if action.Limit == 0 {
+			action.Limit = models.DefaultQueryLimit
+		}
+	}
+	return true
+}
+
 // Screenshot captures a screenshot
 func (h *Handlers) Screenshot(w http.ResponseWriter, r *http.Request) {
 	token := middleware.TokenFromContext(r.Context())
@@ -184,7 +512,7 @@ func (h *Handlers) Screenshot(w http.ResponseWriter, r *http.Request) {
 	var req models.ScreenshotRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Debug().Err(err).Msg("Failed to decode screenshot request")
-		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		writeBodyError(w, err)
 		return
 	}
 
@@ -197,6 +525,13 @@ func (h *Handlers) Screenshot(w http.ResponseWriter, r *http.Request) {
 	if format == "" {
 		format = "png"
 	}
+	if format != "png" && format != "jpeg" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "format must be png or jpeg")
+		return
+	}
+	if req.Burst != nil && !h.validBurst(w, r, &req) {
+		return
+	}
 
 	cmd := &models.CommandRequest{
 		Type:  "command",
@@ -207,15 +542,43 @@ func (h *Handlers) Screenshot(w http.ResponseWriter, r *http.Request) {
 			FullPage: req.FullPage,
 			Format:   format,
 			Quality:  req.Quality,
+			Selector: req.Selector,
+			Clip:     req.Clip,
+
+			SelectorEngine: req.SelectorEngine,
 		},
-		Timeout: h.cfg.CommandTimeout,
+		Timeout: h.commandTimeout(token, 0),
+	}
+	if err := cmd.Action.ValidateCapture(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if err := cmd.Action.ValidateSelectorEngine(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if req.Burst != nil {
+		// The command runs for as long as the burst takes on top
+		cmd.Action.Count = req.Burst.Count
+		cmd.Action.Interval = req.Burst.Interval
+		cmd.Timeout += (req.Burst.Count - 1) * req.Burst.Interval
+	}
+
+	if !h.checkURLPolicy(w, token, tokenHash, req.TabID, cmd.Action) {
+		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.cfg.CommandTimeout)*time.Millisecond)
+	// The queue wait comes on top of the command timeout
+	ctx, cancel := h.commandContext(r.Context(), w, cmd.Timeout+h.cfg.ScreenshotQueueTimeout)
 	defer cancel()
 
-	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
+	resp, queued, release, err := h.capture(ctx, tokenHash, cmd)
+	timing.FromContext(r.Context()).Add(timing.Queue, queued)
 	if err != nil {
+		if errors.Is(err, errCaptureBusy) {
+			writeCaptureBusy(w)
+			return
+		}
 		if hubErr, ok := err.(*hub.HubError); ok {
 			writeError(w, http.StatusServiceUnavailable, hubErr.Code, hubErr.Message)
 			return
@@ -223,62 +586,126 @@ func (h *Handlers) Screenshot(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
 		return
 	}
+	defer release()
 
 	if !resp.Success {
+		if resp.Error.Code == captureRateLimited {
+			writeCaptureBusy(w)
+			return
+		}
 		writeError(w, http.StatusBadRequest, resp.Error.Code, resp.Error.Message)
 		return
 	}
 
-	// Extract base64 data from result
-	result, ok := resp.Result.(map[string]interface{})
+	result, ok := resp.Decoded.(*models.ScreenshotResult)
 	if !ok {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
 		return
 	}
+	if req.Burst != nil {
+		h.saveBurst(w, r, token, req.TabID, cmd.ID, format, result, queued)
+		return
+	}
 
-	data, _ := result["data"].(string)
-	width, _ := result["width"].(float64)
-	height, _ := result["height"].(float64)
-
-	// Save to file
-	filename := uuid.New().String() + "." + format
-	filePath := filepath.Join(h.cfg.ScreenshotPath, filename)
-
-	// Decode base64 and save (with size validation)
-	if err := saveBase64ToFile(data, filePath, h.cfg.MaxScreenshotSize); err != nil {
+	// Decode base64 (with size validation)
+	rec := timing.FromContext(r.Context())
+	start := time.Now()
+	decoded, err := decodeBase64Image(result.Data, h.cfg.MaxScreenshotSize)
+	rec.Since(timing.Decode, start)
+	if err != nil {
 		if _, ok := err.(*FileSizeError); ok {
 			log.Warn().Int("maxMB", h.cfg.MaxScreenshotSize).Msg("Screenshot size exceeds limit")
 			writeError(w, http.StatusBadRequest, "FILE_TOO_LARGE", "Screenshot exceeds maximum size limit")
 			return
 		}
+		log.Error().Err(err).Msg("Failed to decode screenshot")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to decode screenshot")
+		return
+	}
+
+	// Stream the image straight back instead of going through disk
+	if req.ReturnFormat == "inline" || r.URL.Query().Get("direct") == "1" {
+		if rec != nil {
+			w.Header().Set("Server-Timing", rec.ServerTiming())
+		}
+		w.Header().Set("Content-Type", "image/"+format)
+		w.Header().Set("Content-Length", strconv.Itoa(len(decoded)))
+		w.Header().Set("X-Screenshot-Width", strconv.Itoa(result.Width))
+		w.Header().Set("X-Screenshot-Height", strconv.Itoa(result.Height))
+		w.Header().Set("X-Screenshot-Queue-Time", strconv.FormatInt(queued.Milliseconds(), 10))
+		w.WriteHeader(http.StatusOK)
+		w.Write(decoded)
+		return
+	}
+
+	start = time.Now()
+	shot, err := h.saveScreenshot(token, req.TabID, cmd.ID, format, decoded, result.Width, result.Height)
+	rec.Since(timing.ArtifactWrite, start)
+	if err != nil {
 		log.Error().Err(err).Msg("Failed to save screenshot")
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save screenshot")
 		return
 	}
 
-	fileInfo, _ := os.Stat(filePath)
-	fileSize := 0
-	if fileInfo != nil {
-		fileSize = int(fileInfo.Size())
-	}
+	shot.QueueTime = queued.Milliseconds()
+	shot.Timing = rec.Timing()
+	writeJSON(w, http.StatusOK, shot)
+}
 
-	expiresAt := time.Now().Add(time.Duration(h.cfg.ScreenshotTTL) * time.Second)
+// saveScreenshot stores a capture, sharing the file with identical earlier
+// captures, and records it. The retention manager releases the file after
+// SCREENSHOT_TTL, or earlier to stay under SCREENSHOT_MAX_DISK.
+func (h *Handlers) saveScreenshot(token *models.Token, tabID, commandID, format string, decoded []byte, width, height int) (*models.ScreenshotResponse, error) {
+	ttl := time.Duration(h.cfg.ScreenshotTTL) * time.Second
+	return h.keepScreenshot(token, tabID, commandID, format, decoded, width, height, ttl)
+}
 
-	// Schedule cleanup
-	go func() {
-		time.Sleep(time.Duration(h.cfg.ScreenshotTTL) * time.Second)
-		os.Remove(filePath)
-	}()
+// keepScreenshot is saveScreenshot with the file kept for ttl
+func (h *Handlers) keepScreenshot(token *models.Token, tabID, commandID, format string, decoded []byte, width, height int, ttl time.Duration) (*models.ScreenshotResponse, error) {
+	id := uuid.New().String()
+	hash, _, err := h.artifacts.Put(token.ID, decoded, format)
+	if err != nil {
+		return nil, err
+	}
+	fileSize := len(decoded)
+
+	createdAt := time.Now()
+	expiresAt := createdAt.Add(ttl)
+
+	if err := h.stores.Screenshots.Create(&models.Screenshot{
+		ID:        id,
+		TokenID:   token.ID,
+		TabID:     tabID,
+		CommandID: commandID,
+		Format:    format,
+		Width:     width,
+		Height:    height,
+		Size:      fileSize,
+		Hash:      hash,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		// The record is what the URL resolves through
+		h.artifacts.Release(token.ID, hash, format)
+		return nil, err
+	}
+
+	h.retention.Enforce(id)
 
-	writeJSON(w, http.StatusOK, models.ScreenshotResponse{
-		URL:       "/screenshots/" + filename,
-		Width:     int(width),
-		Height:    int(height),
+	return &models.ScreenshotResponse{
+		ID:        id,
+		URL:       h.shotURLs.sign(token.ID, id, format, expiresAt),
+		Width:     width,
+		Height:    height,
 		Size:      fileSize,
 		ExpiresAt: expiresAt.Format(time.RFC3339),
-	})
+	}, nil
 }
 
+// markdownSnapshotDepth is the least maxDepth of a markdown snapshot that
+// does not ask for one
+const markdownSnapshotDepth = 40
+
 // Snapshot captures a DOM snapshot
 func (h *Handlers) Snapshot(w http.ResponseWriter, r *http.Request) {
 	token := middleware.TokenFromContext(r.Context())
@@ -292,7 +719,7 @@ func (h *Handlers) Snapshot(w http.ResponseWriter, r *http.Request) {
 	var req models.SnapshotRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Debug().Err(err).Msg("Failed to decode snapshot request")
-		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+		writeBodyError(w, err)
 		return
 	}
 
@@ -301,29 +728,50 @@ func (h *Handlers) Snapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	maxDepth := req.MaxDepth
-	if maxDepth <= 0 {
-		maxDepth = h.cfg.DefaultSnapshotMaxDepth
+	if req.Format != "" && !models.ValidSnapshotFormat(req.Format) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "format must be html, simplified, or markdown")
+		return
 	}
 
-	maxLength := req.MaxLength
-	if maxLength <= 0 {
-		maxLength = h.cfg.DefaultSnapshotMaxLength
+	action := models.CommandAction{
+		Kind:        "snapshot",
+		Format:      req.Format,
+		MaxDepth:    req.MaxDepth,
+		MaxLength:   req.MaxLength,
+		Interactive: req.Interactive,
+
+		SelectorEngine: req.SelectorEngine,
+	}
+	if err := action.ValidateSelectorEngine(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	applyDefaults(token.Defaults, &action)
+	if action.MaxDepth <= 0 {
+		action.MaxDepth = h.cfg.DefaultSnapshotMaxDepth
+	}
+	if action.MaxLength <= 0 {
+		action.MaxLength = h.cfg.DefaultSnapshotMaxLength
+	}
+	if action.Format == "markdown" && req.MaxDepth <= 0 {
+		// Articles sit deeper in the page than a glance at its structure
+		// needs
+		action.MaxDepth = max(action.MaxDepth, markdownSnapshotDepth)
 	}
 
 	cmd := &models.CommandRequest{
-		Type:  "command",
-		ID:    uuid.New().String(),
-		TabID: req.TabID,
-		Action: models.CommandAction{
-			Kind:      "snapshot",
-			MaxDepth:  maxDepth,
-			MaxLength: maxLength,
-		},
-		Timeout: h.cfg.CommandTimeout,
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   req.TabID,
+		Action:  action,
+		Timeout: h.commandTimeout(token, 0),
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(h.cfg.CommandTimeout)*time.Millisecond)
+	if !h.checkURLPolicy(w, token, tokenHash, req.TabID, cmd.Action) {
+		return
+	}
+
+	ctx, cancel := h.commandContext(r.Context(), w, cmd.Timeout)
 	defer cancel()
 
 	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
@@ -341,39 +789,239 @@ func (h *Handlers) Snapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse result
-	result, ok := resp.Result.(map[string]interface{})
+	result, ok := resp.Decoded.(*models.SnapshotResult)
 	if !ok {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
 		return
 	}
 
-	html, _ := result["html"].(string)
-	url, _ := result["url"].(string)
-	title, _ := result["title"].(string)
-	truncated, _ := result["truncated"].(bool)
+	if action.Format == "markdown" {
+		md, err := contentproc.Markdown(result.HTML, result.URL)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to convert the page to Markdown")
+			return
+		}
+		writeJSON(w, http.StatusOK, models.SnapshotResponse{
+			Markdown:            md,
+			URL:                 result.URL,
+			Title:               result.Title,
+			Truncated:           result.Truncated,
+			InteractiveElements: result.Elements,
+			ElementsTruncated:   result.ElementsTruncated,
+			Timing:              timing.FromContext(r.Context()).Timing(),
+		})
+		return
+	}
 
 	writeJSON(w, http.StatusOK, models.SnapshotResponse{
-		HTML:      html,
-		URL:       url,
-		Title:     title,
-		Truncated: truncated,
+		HTML:                result.HTML,
+		URL:                 result.URL,
+		Title:               result.Title,
+		Truncated:           result.Truncated,
+		InteractiveElements: result.Elements,
+		ElementsTruncated:   result.ElementsTruncated,
+		Timing:              timing.FromContext(r.Context()).Timing(),
 	})
 }
 
-// ServeScreenshots serves screenshot files
+// StartBatch distributes independent tasks across the token's sessions
+func (h *Handlers) StartBatch(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if token == nil || tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Debug().Err(err).Msg("Failed to decode batch request")
+		writeBodyError(w, err)
+		return
+	}
+
+	if len(req.Tasks) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tasks is required")
+		return
+	}
+	if len(req.Tasks) > h.cfg.BatchMaxTasks {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Too many tasks in batch")
+		return
+	}
+	for _, task := range req.Tasks {
+		if task.URL == "" && len(task.Actions) == 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Each task needs a url or actions")
+			return
+		}
+		if task.URL != "" && !token.HasScope(models.ScopeCommand) {
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Token lacks required scope: "+models.ScopeCommand)
+			return
+		}
+		for _, action := range task.Actions {
+			if action.Kind == "" {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "action.kind is required")
+				return
+			}
+			if action.Kind == "upload" {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "upload carries files; use POST /api/v1/upload")
+				return
+			}
+			if action.Kind == "evaluate" {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "use POST /api/v1/evaluate to run JavaScript")
+				return
+			}
+			if scope := models.ScopeForAction(action.Kind); !token.HasScope(scope) {
+				writeError(w, http.StatusForbidden, "FORBIDDEN", "Token lacks required scope: "+scope)
+				return
+			}
+			if err := action.ValidateSelectorEngine(); err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return
+			}
+			if !h.checkActionFeature(w, token, action.Kind) {
+				return
+			}
+		}
+	}
+
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+
+	req.Timeout = h.commandTimeout(token, req.Timeout)
+	for i := range req.Tasks {
+		for j := range req.Tasks[i].Actions {
+			applyDefaults(token.Defaults, &req.Tasks[i].Actions[j])
+		}
+	}
+
+	resp, err := h.dispatcher.Start(tokenHash, &req, check)
+	if err != nil {
+		if hubErr, ok := err.(*hub.HubError); ok {
+			message := hubErr.Message
+			if hubErr == hub.ErrNotConnected {
+				message = "No connected session has an attached tab"
+			}
+			writeError(w, http.StatusServiceUnavailable, hubErr.Code, message)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// GetBatch returns aggregated results for a batch
+func (h *Handlers) GetBatch(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	resp := h.dispatcher.Get(tokenHash, chi.URLParam(r, "id"))
+	if resp == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Batch not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ServeScreenshots serves screenshot files on the signed URLs handed out
+// for them; anything else is 404, so IDs cannot be probed. A URL names the
+// screenshot, which is resolved to the content-addressed file it shares
+// with identical captures of the same token. The content hash is the ETag,
+// so pollers can revalidate with If-None-Match on single-use URLs too;
+// a used URL otherwise only serves a Range starting where the last
+// response on it stopped.
 func (h *Handlers) ServeScreenshots() http.Handler {
-	return http.StripPrefix("/screenshots/", http.FileServer(http.Dir(h.cfg.ScreenshotPath)))
+	return http.StripPrefix("/screenshots/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, format, ok := strings.Cut(r.URL.Path, ".")
+		if !ok || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("sig") == "" {
+			http.NotFound(w, r)
+			return
+		}
+		shot, err := h.stores.Screenshots.Get(id)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to look up screenshot")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if shot == nil || shot.Format != format || shot.Hash == "" || !time.Now().Before(shot.ExpiresAt) {
+			http.NotFound(w, r)
+			return
+		}
+		// Signed for the screenshot's owner, or it is not found
+		sig, urlExpires, ok := h.shotURLs.verify(shot.TokenID, r.URL.Path, r.URL.Query())
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// The file never changes while the URL is valid
+		etag := `"` + shot.Hash + `"`
+		maxAge := int(time.Until(shot.ExpiresAt).Seconds())
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		path := h.artifacts.Path(shot.TokenID, shot.Hash, shot.Format)
+		if r.Method == http.MethodHead {
+			http.ServeFile(w, r, path)
+			return
+		}
+		if revalidates(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		from := resumeFrom(r)
+		if !h.shotURLs.claim(r.Context(), sig, urlExpires, from) {
+			http.Error(w, "Screenshot URL already used", http.StatusGone)
+			return
+		}
+		// A resume gets the range it asked for or nothing, never the
+		// whole image
+		r.Header.Del("If-Range")
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		http.ServeFile(ww, r, path)
+		h.shotURLs.served(context.WithoutCancel(r.Context()), sig, urlExpires, servedOffset(from, ww.Status(), ww.BytesWritten()))
+	}))
 }
 
 // Helper functions
 
+// commandContext bounds a command to its timeout (ms) and sets the
+// response's write deadline to the timeout plus HTTP_TIMEOUT_OVERHEAD, so
+// the result can still be delivered after a command that runs long
+func (h *Handlers) commandContext(parent context.Context, w http.ResponseWriter, timeout int) (context.Context, context.CancelFunc) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(h.cfg.RequestTimeout(timeout)))
+	return context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+}
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(v)
 }
 
+// writeBodyError reports a request body that could not be decoded
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE",
+			fmt.Sprintf("Request body exceeds %d bytes (MAX_REQUEST_BODY)", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid JSON body")
+}
+
 func writeError(w http.ResponseWriter, status int, code, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -389,11 +1037,11 @@ func writeError(w http.ResponseWriter, status int, code, message string) {
 	})
 }
 
-func saveBase64ToFile(base64Data, filePath string, maxSizeMB int) error {
+func decodeBase64Image(base64Data string, maxSizeMB int) ([]byte, error) {
 	// Check base64 size before decoding (rough estimate: base64 is ~4/3 of original)
 	maxBase64Size := maxSizeMB * 1024 * 1024 * 4 / 3
 	if len(base64Data) > maxBase64Size {
-		return &FileSizeError{MaxMB: maxSizeMB, ActualBytes: len(base64Data) * 3 / 4}
+		return nil, &FileSizeError{MaxMB: maxSizeMB, ActualBytes: len(base64Data) * 3 / 4}
 	}
 
 	// Remove data URL prefix if present
@@ -408,15 +1056,15 @@ func saveBase64ToFile(base64Data, filePath string, maxSizeMB int) error {
 	// Decode base64
 	decoded, err := base64.StdEncoding.DecodeString(base64Data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Final size check after decoding
 	if len(decoded) > maxSizeMB*1024*1024 {
-		return &FileSizeError{MaxMB: maxSizeMB, ActualBytes: len(decoded)}
+		return nil, &FileSizeError{MaxMB: maxSizeMB, ActualBytes: len(decoded)}
 	}
 
-	return os.WriteFile(filePath, decoded, 0644)
+	return decoded, nil
 }
 
 // FileSizeError indicates the file exceeds maximum allowed size
@@ -429,22 +1077,169 @@ func (e *FileSizeError) Error() string {
 	return "file size exceeds maximum allowed"
 }
 
-// RegisterRoutes registers all API routes
-func (h *Handlers) RegisterRoutes(r chi.Router, tokenStore *store.TokenStore) {
+// RegisterRoutes registers the route groups the listener serves. The rate
+// limiter is shared, so a token's budget spans every listener.
+func (h *Handlers) RegisterRoutes(r chi.Router, tokenStore *store.TokenStore, l config.Listener) {
 	r.Get("/health", h.Health)
-	r.Handle("/screenshots/*", h.ServeScreenshots())
+	r.Get("/healthz", h.Liveness)
+	r.Get("/readyz", h.Readiness)
+	if l.Serves(config.RoutesAPI) {
+		r.Handle("/screenshots/*", h.ServeScreenshots())
+		r.Handle("/recordings/*", h.ServeRecordings())
+		r.Handle("/openapi.json", apidoc.Handler(h.version))
+		r.Handle("/docs", apidoc.UIHandler())
+	}
+	if l.Serves(config.RoutesAdmin) {
+		r.Handle("/dashboard", dashboard.Handler())
+	}
+	if l.Serves(config.RoutesMetrics) {
+		r.Get("/metrics", h.Metrics)
+	}
+	if l.Serves(config.RoutesDebug) {
+		r.Mount("/debug", chimiddleware.Profiler())
+	}
+	if !l.Serves(config.RoutesAPI) && !l.Serves(config.RoutesAdmin) {
+		return
+	}
 
 	r.Route("/api/v1", func(r chi.Router) {
+		r.Use(middleware.DebugTiming)
+
 		// These routes require authentication
-		r.Use(middleware.Auth(tokenStore))
+		r.Use(middleware.Auth(tokenStore, h.oidc))
+		r.Use(h.limiter.RateLimit(tokenStore))
 
-		rateLimiter := middleware.NewRateLimiter()
-		r.Use(rateLimiter.RateLimit(tokenStore))
+		read := middleware.RequireScope(models.ScopeRead)
+		command := middleware.RequireScope(models.ScopeCommand)
+		feature := func(name string) func(http.Handler) http.Handler {
+			return middleware.RequireFeature(h.cfg.EnabledFeatures, name)
+		}
 
-		r.Get("/status", h.Status)
-		r.Get("/tabs", h.Tabs)
-		r.Post("/command", h.Command)
-		r.Post("/screenshot", h.Screenshot)
-		r.Post("/snapshot", h.Snapshot)
+		// A standby serves only health and replication admin endpoints
+		if l.Serves(config.RoutesAPI) {
+			r.Group(func(r chi.Router) {
+				r.Use(h.requirePrimary)
+
+				r.Get("/features", h.Features)
+				r.With(read).Get("/status", h.Status)
+				r.With(read).Get("/sessions/{id}", h.GetSession)
+				r.With(read).Get("/tabs", h.Tabs)
+				r.With(command).Post("/tabs", h.CreateTab)
+				r.With(command).Delete("/tabs/{id}", h.CloseTab)
+				// Scope depends on action kind, checked in the handlers
+				r.Post("/command", h.Command)
+				r.Post("/batch", h.StartBatch)
+				r.With(read).Get("/batch/{id}", h.GetBatch)
+				r.With(read).Get("/commands/{id}", h.GetCommand)
+				r.With(middleware.RequireScope(models.ScopeScreenshot)).Post("/screenshot", h.Screenshot)
+				r.With(read).Get("/screenshots", h.ListScreenshots)
+				r.With(read).Get("/screenshots/{id}/image", h.ScreenshotImage)
+				r.With(read).Post("/snapshot", h.Snapshot)
+				r.With(read).Post("/query", h.Query)
+				r.With(middleware.RequireScope(models.ScopeEvaluate)).Post("/evaluate", h.Evaluate)
+				r.With(read).Get("/console", h.Console)
+				r.With(read).Get("/events", h.Events)
+				r.With(read).Get("/downloads", h.ListDownloads)
+				r.With(read).Get("/downloads/{id}", h.GetDownload)
+				r.With(command).Get("/cookies", h.GetCookies)
+				r.With(command).Post("/cookies", h.SetCookies)
+				r.With(command).Delete("/cookies", h.ClearCookies)
+				r.With(command).Get("/storage", h.GetStorage)
+				r.With(command).Post("/storage", h.SetStorage)
+				r.With(command).Delete("/storage", h.RemoveStorage)
+				r.With(command).Get("/emulation", h.GetEmulation)
+				r.With(command).Post("/emulation", h.SetEmulation)
+				r.With(command).Delete("/emulation", h.ClearEmulation)
+				r.With(command).Get("/request-rules", h.GetRequestRules)
+				r.With(command).Post("/request-rules", h.ApplyRequestRules)
+				r.With(command).Delete("/request-rules", h.ClearRequestRules)
+				r.With(command).Get("/headers", h.GetHeaders)
+				r.With(command).Post("/headers", h.SetHeaders)
+				r.With(command).Delete("/headers", h.ClearHeaders)
+				r.With(command).Get("/credentials", h.GetCredentials)
+				r.With(command).Post("/credentials", h.SetCredential)
+				r.With(command).Delete("/credentials", h.ClearCredentials)
+				r.With(command).Post("/upload", h.Upload)
+				r.With(command).Post("/form", h.FillForm)
+				r.With(read).Get("/macros", h.ListMacros)
+				r.With(command).Post("/macros", h.SaveMacro)
+				r.With(read).Get("/macros/{name}", h.GetMacro)
+				r.With(command).Delete("/macros/{name}", h.DeleteMacro)
+				// Each step is also checked for the scope of its kind
+				r.With(command).Post("/macros/{name}/run", h.RunMacro)
+				r.With(read).Get("/pipelines", h.ListPipelines)
+				r.With(command).Post("/pipelines", h.SavePipeline)
+				r.With(read).Get("/pipelines/{name}", h.GetPipeline)
+				r.With(command).Delete("/pipelines/{name}", h.DeletePipeline)
+				// Each step is also checked for the scope of its kind
+				r.With(command).Post("/pipelines/run", h.RunInlinePipeline)
+				r.With(command).Post("/pipelines/{name}/run", h.RunPipeline)
+				r.With(read).Get("/schedules", h.ListSchedules)
+				r.With(command).Post("/schedules", h.SaveSchedule)
+				r.With(read).Get("/schedules/{name}", h.GetSchedule)
+				r.With(command).Delete("/schedules/{name}", h.DeleteSchedule)
+				r.With(command).Post("/schedules/{name}/run", h.RunSchedule)
+				r.With(read).Get("/schedules/{name}/runs", h.ScheduleRuns)
+				r.With(read).Get("/rulesets", h.ListRuleSets)
+				r.With(command).Post("/rulesets", h.SaveRuleSet)
+				r.With(read).Get("/rulesets/{name}", h.GetRuleSet)
+				r.With(command).Delete("/rulesets/{name}", h.DeleteRuleSet)
+				r.With(command).Post("/scripts", h.RecordScript)
+				r.With(read).Get("/scripts/{id}", h.GetScript)
+				r.With(command).Post("/scripts/{id}/stop", h.StopScript)
+				// Each step is also checked for the scope of its kind
+				r.With(command).Post("/replay", h.Replay)
+				r.With(middleware.RequireScope(models.ScopeScreenshot), feature(features.Screencast)).Get("/screencast", h.Screencast)
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequireScope(models.ScopeScreenshot), feature(features.Recording))
+					r.Post("/recording/start", h.StartRecording)
+					r.Post("/recording/stop", h.StopRecording)
+					r.Get("/recording/{id}", h.GetRecording)
+				})
+
+				r.With(command).Post("/jobs", h.EnqueueJob)
+				r.With(command).Post("/jobs/lease", h.LeaseJob)
+				r.With(read).Get("/jobs/{id}", h.GetJob)
+				r.With(command).Post("/jobs/{id}/ack", h.AckJob)
+				r.With(command).Post("/jobs/{id}/nack", h.NackJob)
+			})
+		}
+
+		if !l.Serves(config.RoutesAdmin) {
+			return
+		}
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(middleware.RequireScope(models.ScopeAdmin))
+
+			r.Get("/replication", h.ReplicationStatus)
+			r.Post("/replication/promote", h.Promote)
+			r.Get("/config", h.AdminConfig)
+			r.Post("/reload", h.AdminReload)
+
+			r.Group(func(r chi.Router) {
+				r.Use(h.requirePrimary)
+
+				r.Get("/replication/snapshot", h.ReplicationSnapshot)
+
+				r.Get("/sessions", h.AdminSessions)
+				r.Get("/sessions/history", h.AdminSessionHistory)
+				r.Get("/stats", h.AdminStats)
+
+				r.Get("/tokens/{id}/policies", h.ListPolicies)
+				r.Post("/tokens/{id}/policies", h.AddPolicy)
+				r.Delete("/tokens/{id}/policies/{ruleId}", h.DeletePolicy)
+				r.Get("/tokens/{id}/defaults", h.GetTokenDefaults)
+				r.Put("/tokens/{id}/defaults", h.SetTokenDefaults)
+				r.Get("/tokens/{id}/features", h.GetTokenFeatures)
+				r.Put("/tokens/{id}/features", h.SetTokenFeatures)
+				r.Get("/tokens/{id}/limits", h.GetTokenLimits)
+				r.Put("/tokens/{id}/limits", h.SetTokenLimits)
+				r.Post("/tokens/{id}/rotate", h.RotateToken)
+
+				r.Get("/webhooks", h.ListWebhooks)
+				r.Post("/webhooks", h.CreateWebhook)
+				r.Delete("/webhooks/{id}", h.DeleteWebhook)
+			})
+		})
 	})
 }
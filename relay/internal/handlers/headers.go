@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetHeaders returns the extra headers an attached tab's requests get
+func (h *Handlers) GetHeaders(w http.ResponseWriter, r *http.Request) {
+	h.headersCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "headers_get"})
+}
+
+// SetHeaders adds headers to an attached tab's outgoing requests, such as
+// a test run ID, so backends can tell relay-driven traffic apart. It
+// replaces the headers the tab had.
+func (h *Handlers) SetHeaders(w http.ResponseWriter, r *http.Request) {
+	var req models.SetHeadersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	extra := models.ExtraHeaders{Headers: req.Headers, Domains: req.Domains}
+	if err := extra.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	h.headersCommand(w, r, req.TabID, models.CommandAction{Kind: "headers_set", ExtraHeaders: &extra})
+}
+
+// ClearHeaders stops adding headers to an attached tab's requests
+func (h *Handlers) ClearHeaders(w http.ResponseWriter, r *http.Request) {
+	h.headersCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "headers_clear"})
+}
+
+func (h *Handlers) headersCommand(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction) {
+	resp, ok := h.tabCommand(w, r, tabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.HeadersResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	headers := result.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, models.HeadersResponse{TabID: tabID, Headers: headers, Domains: result.Domains})
+}
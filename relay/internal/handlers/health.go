@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// readyCheckTimeout bounds the database check of /readyz
+const readyCheckTimeout = 2 * time.Second
+
+var errDraining = errors.New("relay is draining for shutdown")
+
+// Liveness answers as long as the process serves HTTP, for Kubernetes
+// liveness probes. It checks nothing else, so a failing dependency never
+// gets the relay restarted.
+func (h *Handlers) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, models.LivenessResponse{
+		Status:  models.CheckOK,
+		Version: h.version,
+		Uptime:  int64(time.Since(h.startTime).Seconds()),
+	})
+}
+
+// Readiness checks the relay's dependencies, for Kubernetes readiness
+// probes: the database answers, the screenshot directory is writable, the
+// relay is not draining for shutdown and, with READY_REQUIRE_EXTENSION, an
+// extension is connected. It answers 503 when any check fails.
+func (h *Handlers) Readiness(w http.ResponseWriter, r *http.Request) {
+	resp := models.ReadinessResponse{
+		Status: models.CheckOK,
+		Role:   h.node.Role(),
+		Checks: map[string]*models.HealthCheck{
+			"database": runCheck(func() error {
+				ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+				defer cancel()
+				return h.stores.Ping(ctx)
+			}),
+			"screenshots": runCheck(h.artifacts.CheckWritable),
+			"shutdown": runCheck(func() error {
+				if h.hub.Draining() {
+					return errDraining
+				}
+				return nil
+			}),
+		},
+	}
+
+	sessions := len(h.hub.AllSessions())
+	extension := &models.HealthCheck{Status: models.CheckSkip, Sessions: &sessions}
+	if h.cfg.ReadyRequireExtension {
+		extension.Status = models.CheckOK
+		if sessions == 0 {
+			extension.Status = models.CheckFail
+			extension.Error = "no extension is connected"
+		}
+	}
+	resp.Checks["extension"] = extension
+
+	status := http.StatusOK
+	for _, check := range resp.Checks {
+		if check.Status == models.CheckFail {
+			resp.Status = models.CheckFail
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
+
+// runCheck times a check and records its outcome
+func runCheck(check func() error) *models.HealthCheck {
+	start := time.Now()
+	err := check()
+	result := &models.HealthCheck{
+		Status:   models.CheckOK,
+		Duration: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = models.CheckFail
+		result.Error = err.Error()
+	}
+	return result
+}
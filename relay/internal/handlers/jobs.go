@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+// jobPollInterval is how often a long-polling lease re-checks the queue
+const jobPollInterval = 500 * time.Millisecond
+
+// EnqueueJob adds a job to a token's queue
+func (h *Handlers) EnqueueJob(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.EnqueueJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Debug().Err(err).Msg("Failed to decode enqueue request")
+		writeBodyError(w, err)
+		return
+	}
+
+	if len(req.Payload) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "payload is required")
+		return
+	}
+
+	// Only admins may fill another token's queue, and only a live token's
+	target := req.TargetTokenID
+	if target == 0 {
+		target = token.ID
+	}
+	if target != token.ID {
+		if !token.HasScope(models.ScopeAdmin) {
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Token lacks required scope: "+models.ScopeAdmin)
+			return
+		}
+		targetToken, err := h.stores.Tokens.ByID(target)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to look up job target token")
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to enqueue job")
+			return
+		}
+		if targetToken == nil {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Target token not found or revoked")
+			return
+		}
+	}
+	queue := req.Queue
+	if queue == "" {
+		queue = "default"
+	}
+	maxAttempts := req.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = h.cfg.JobMaxAttempts
+	}
+
+	job, err := h.stores.Jobs.Enqueue(target, token.ID, queue, req.Payload, maxAttempts)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to enqueue job")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to enqueue job")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, job)
+}
+
+// LeaseJob claims the next job for the caller, optionally long-polling
+func (h *Handlers) LeaseJob(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.LeaseJobRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Debug().Err(err).Msg("Failed to decode lease request")
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	queue := req.Queue
+	if queue == "" {
+		queue = "default"
+	}
+	lease := time.Duration(req.LeaseSeconds) * time.Second
+	if lease <= 0 {
+		lease = time.Duration(h.cfg.JobLeaseTimeout) * time.Second
+	}
+	wait := time.Duration(min(req.Wait, h.cfg.JobMaxWait)) * time.Second
+	deadline := time.Now().Add(wait)
+
+	for {
+		job, err := h.stores.Jobs.Lease(token.ID, queue, lease)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to lease job")
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to lease job")
+			return
+		}
+		if job != nil {
+			writeJSON(w, http.StatusOK, job)
+			return
+		}
+		if time.Now().After(deadline) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// GetJob returns a job visible to the caller (as producer or consumer)
+func (h *Handlers) GetJob(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid job ID")
+		return
+	}
+
+	job, err := h.stores.Jobs.Get(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get job")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to get job")
+		return
+	}
+	if job == nil || (job.TokenID != token.ID && job.CreatedBy != token.ID) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Job not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// AckJob marks a leased job as done
+func (h *Handlers) AckJob(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid job ID")
+		return
+	}
+
+	var req models.AckJobRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	if err := h.stores.Jobs.Ack(id, token.ID, req.Result); err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// NackJob releases a leased job for retry or marks it failed
+func (h *Handlers) NackJob(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid job ID")
+		return
+	}
+
+	var req models.NackJobRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	retry := req.Retry == nil || *req.Retry
+	if err := h.stores.Jobs.Nack(id, token.ID, req.Error, retry); err != nil {
+		writeJobError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJobError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrJobNotLeased) {
+		writeError(w, http.StatusConflict, "JOB_NOT_LEASED", err.Error())
+		return
+	}
+	log.Error().Err(err).Msg("Failed to update job")
+	writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update job")
+}
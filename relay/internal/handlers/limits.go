@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetTokenLimits returns the rate limit settings of a token
+func (h *Handlers) GetTokenLimits(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	limits, err := h.stores.Tokens.Limits(tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to load token limits")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load token limits")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, limits)
+}
+
+// SetTokenLimits replaces the rate limit settings of a token. They apply
+// from the token's next request.
+func (h *Handlers) SetTokenLimits(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	var limits models.TokenLimits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := limits.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	if err := h.stores.Tokens.SetLimits(tokenID, limits); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to update token limits")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update token limits")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, limits)
+}
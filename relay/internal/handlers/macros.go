@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ListMacros returns the token's stored macros
+func (h *Handlers) ListMacros(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	macros, err := h.stores.Macros.List(token.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list macros")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list macros")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.MacrosResponse{Macros: macros})
+}
+
+// GetMacro returns one of the token's macros
+func (h *Handlers) GetMacro(w http.ResponseWriter, r *http.Request) {
+	macro, ok := h.loadMacro(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, macro)
+}
+
+// SaveMacro stores a macro for the token, replacing one of the same name
+func (h *Handlers) SaveMacro(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.MacroRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	macro, created, err := h.stores.Macros.Save(token.ID, &req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save macro")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save macro")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, macro)
+}
+
+// DeleteMacro removes one of the token's macros
+func (h *Handlers) DeleteMacro(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	if err := h.stores.Macros.Delete(token.ID, chi.URLParam(r, "name")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Macro not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete macro")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete macro")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunMacro runs a macro's steps in order against a tab, with its params
+// filled in. Every step is checked like a command before the first runs;
+// the run stops at the first step that fails unless continueOnError is set.
+func (h *Handlers) RunMacro(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if token == nil || tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.MacroRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+
+	macro, ok := h.loadMacro(w, r)
+	if !ok {
+		return
+	}
+	actions, err := macro.Expand(req.Params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	for i, action := range actions {
+		// A param may have supplied the kind
+		switch action.Kind {
+		case "upload", "evaluate", "tab_create":
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("step %d: %s cannot be part of a macro", i, action.Kind))
+			return
+		}
+	}
+	if !h.checkSteps(w, token, actions) {
+		return
+	}
+
+	timeout := h.commandTimeout(token, req.Timeout)
+	if timeout > h.cfg.MaxCommandTimeout() {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("timeout must be at most %dms (HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD)", h.cfg.MaxCommandTimeout()))
+		return
+	}
+	if _, ok := h.hub.FindTab(tokenHash, req.TabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+
+	start := time.Now()
+	resp := models.MacroRunResponse{
+		Macro:   macro.Name,
+		TabID:   req.TabID,
+		Success: true,
+		Steps:   make([]models.BatchStepResult, 0, len(actions)),
+	}
+	for _, action := range actions {
+		// Earlier steps may have navigated, so the policy sees the page as
+		// it is now
+		tab, _ := h.hub.FindTab(tokenHash, req.TabID)
+		step := models.BatchStepResult{Kind: action.Kind}
+		if cmdErr := check(tab.URL, action); cmdErr != nil {
+			step.Error = cmdErr
+		} else {
+			step = h.runStep(w, r, tokenHash, req.TabID, action, timeout)
+		}
+		resp.Steps = append(resp.Steps, step)
+		if !step.Success {
+			resp.Success = false
+			if !req.ContinueOnError {
+				break
+			}
+		}
+	}
+	resp.Elapsed = time.Since(start).Milliseconds()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// checkSteps writes an error response and returns false unless each action
+// of a macro or script may run as POST /api/v1/command would run it. The
+// token's defaults are applied to them.
+func (h *Handlers) checkSteps(w http.ResponseWriter, token *models.Token, actions []models.CommandAction) bool {
+	for i := range actions {
+		action := &actions[i]
+		switch action.Kind {
+		case "":
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("step %d: kind is required", i))
+			return false
+		case "evaluate":
+			// Scripts may hold what POST /api/v1/evaluate ran
+			if err := action.ValidateEvaluate(); err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("step %d: %s", i, err))
+				return false
+			}
+		default:
+			if !h.checkAction(w, action) {
+				return false
+			}
+		}
+		if scope := models.ScopeForAction(action.Kind); !token.HasScope(scope) {
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Token lacks required scope: "+scope)
+			return false
+		}
+		if !h.checkActionFeature(w, token, action.Kind) {
+			return false
+		}
+		applyDefaults(token.Defaults, action)
+	}
+	return true
+}
+
+// runStep sends one step of a macro or script to the tab and reports its
+// outcome
+func (h *Handlers) runStep(w http.ResponseWriter, r *http.Request, tokenHash, tabID string, action models.CommandAction, timeout int) models.BatchStepResult {
+	ctx, cancel := h.commandContext(r.Context(), w, timeout)
+	defer cancel()
+	return h.sendStep(ctx, tokenHash, tabID, action, timeout)
+}
+
+// sendStep is runStep for callers outside a request, such as schedules
+func (h *Handlers) sendStep(ctx context.Context, tokenHash, tabID string, action models.CommandAction, timeout int) models.BatchStepResult {
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   tabID,
+		Action:  action,
+		Timeout: timeout,
+	}
+
+	start := time.Now()
+	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
+	step := models.BatchStepResult{
+		Kind:    action.Kind,
+		Elapsed: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		step.Error = &models.CommandError{Code: "INTERNAL_ERROR", Message: err.Error()}
+		if hubErr, ok := err.(*hub.HubError); ok {
+			step.Error.Code = hubErr.Code
+		}
+		return step
+	}
+	step.Success = resp.Success
+	step.Result = resp.Decoded
+	step.Error = resp.Error
+	return step
+}
+
+// loadMacro returns the token's macro named in the URL, writing an error
+// response if there is none
+func (h *Handlers) loadMacro(w http.ResponseWriter, r *http.Request) (*models.Macro, bool) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return nil, false
+	}
+
+	macro, err := h.stores.Macros.Get(token.ID, chi.URLParam(r, "name"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load macro")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load macro")
+		return nil, false
+	}
+	if macro == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Macro not found")
+		return nil, false
+	}
+	return macro, true
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/workers"
+)
+
+// Metrics exposes relay counters in the Prometheus text format
+func (h *Handlers) Metrics(w http.ResponseWriter, r *http.Request) {
+	sessions := h.hub.AllSessions()
+	tabs := 0
+	for _, s := range sessions {
+		tabs += s.TabCount()
+	}
+	stats := h.hub.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("owlrelay_build_info", "gauge", "Relay version and replication role.")
+	fmt.Fprintf(w, "owlrelay_build_info{version=%q,role=%q} 1\n", h.version, h.node.Role())
+
+	metric("owlrelay_uptime_seconds", "gauge", "Seconds since the relay started.")
+	fmt.Fprintf(w, "owlrelay_uptime_seconds %d\n", int64(time.Since(h.startTime).Seconds()))
+
+	metric("owlrelay_sessions", "gauge", "Connected extension sessions.")
+	fmt.Fprintf(w, "owlrelay_sessions %d\n", len(sessions))
+
+	metric("owlrelay_tabs", "gauge", "Attached tabs across all sessions.")
+	fmt.Fprintf(w, "owlrelay_tabs %d\n", tabs)
+
+	metric("owlrelay_commands_total", "counter", "Completed commands by outcome.")
+	fmt.Fprintf(w, "owlrelay_commands_total{outcome=\"succeeded\"} %d\n", stats.Succeeded)
+	fmt.Fprintf(w, "owlrelay_commands_total{outcome=\"failed\"} %d\n", stats.Failed)
+
+	metric("owlrelay_commands_in_flight", "gauge", "Commands awaiting a response.")
+	fmt.Fprintf(w, "owlrelay_commands_in_flight %d\n", stats.InFlight)
+
+	metric("owlrelay_cohort_commands_total", "counter", "Completed commands by canary mode and outcome.")
+	fmt.Fprintf(w, "owlrelay_cohort_commands_total{cohort=\"canary\",outcome=\"succeeded\"} %d\n", stats.Canary.Succeeded)
+	fmt.Fprintf(w, "owlrelay_cohort_commands_total{cohort=\"canary\",outcome=\"failed\"} %d\n", stats.Canary.Failed)
+	fmt.Fprintf(w, "owlrelay_cohort_commands_total{cohort=\"stable\",outcome=\"succeeded\"} %d\n", stats.Stable.Succeeded)
+	fmt.Fprintf(w, "owlrelay_cohort_commands_total{cohort=\"stable\",outcome=\"failed\"} %d\n", stats.Stable.Failed)
+
+	metric("owlrelay_cohort_command_seconds_total", "counter", "Time from send to response of completed commands by canary mode.")
+	fmt.Fprintf(w, "owlrelay_cohort_command_seconds_total{cohort=\"canary\"} %g\n", float64(stats.Canary.DurationMs)/1000)
+	fmt.Fprintf(w, "owlrelay_cohort_command_seconds_total{cohort=\"stable\"} %g\n", float64(stats.Stable.DurationMs)/1000)
+
+	metric("owlrelay_protocol_errors_total", "counter", "Extension messages rejected by schema validation.")
+	for _, p := range stats.ProtocolErrors {
+		fmt.Fprintf(w, "owlrelay_protocol_errors_total{type=%q,code=%q} %d\n", p.Type, p.Code, p.Count)
+	}
+
+	limits := h.limiter.Stats()
+	metric("owlrelay_rate_limit_requests_total", "counter", "Requests past the soft limit, on burst debt, or rejected.")
+	fmt.Fprintf(w, "owlrelay_rate_limit_requests_total{outcome=\"warned\"} %d\n", limits.Warned)
+	fmt.Fprintf(w, "owlrelay_rate_limit_requests_total{outcome=\"debt\"} %d\n", limits.Debt)
+	fmt.Fprintf(w, "owlrelay_rate_limit_requests_total{outcome=\"limited\"} %d\n", limits.Limited)
+
+	ipLimits := h.ipLimits.Stats()
+	metric("owlrelay_ip_limit_requests_total", "counter", "Unauthenticated requests turned away by per-IP limits.")
+	fmt.Fprintf(w, "owlrelay_ip_limit_requests_total{limit=\"rate\"} %d\n", ipLimits.Limited)
+	fmt.Fprintf(w, "owlrelay_ip_limit_requests_total{limit=\"handshakes\"} %d\n", ipLimits.Refused)
+
+	deliveries := h.webhooks.Stats()
+	metric("owlrelay_webhook_deliveries_total", "counter", "Webhook delivery attempts by outcome.")
+	fmt.Fprintf(w, "owlrelay_webhook_deliveries_total{outcome=\"delivered\"} %d\n", deliveries.Delivered)
+	fmt.Fprintf(w, "owlrelay_webhook_deliveries_total{outcome=\"retried\"} %d\n", deliveries.Retried)
+	fmt.Fprintf(w, "owlrelay_webhook_deliveries_total{outcome=\"failed\"} %d\n", deliveries.Failed)
+	fmt.Fprintf(w, "owlrelay_webhook_deliveries_total{outcome=\"dropped\"} %d\n", deliveries.Dropped)
+
+	metric("owlrelay_screencasts", "gauge", "Screencast streams in progress.")
+	fmt.Fprintf(w, "owlrelay_screencasts %d\n", h.screencasts.Load())
+	metric("owlrelay_recordings", "gauge", "Tab recordings in progress.")
+	fmt.Fprintf(w, "owlrelay_recordings %d\n", h.recorder.Active())
+
+	metric("owlrelay_screenshot_queue_waiting", "gauge", "Screenshot requests waiting for a capture slot.")
+	fmt.Fprintf(w, "owlrelay_screenshot_queue_waiting %d\n", h.captures.waiting.Load())
+	metric("owlrelay_screenshot_queue_timeouts_total", "counter", "Screenshot requests that gave up waiting for a capture slot.")
+	fmt.Fprintf(w, "owlrelay_screenshot_queue_timeouts_total %d\n", h.captures.timeouts.Load())
+
+	queue := h.hub.CommandQueue()
+	metric("owlrelay_command_queue_waiting", "gauge", "Commands waiting for one of their token's TOKEN_MAX_INFLIGHT slots.")
+	fmt.Fprintf(w, "owlrelay_command_queue_waiting %d\n", queue.Queued)
+	metric("owlrelay_command_queue_rejections_total", "counter", "Commands rejected because their token's queue was full or they waited too long.")
+	fmt.Fprintf(w, "owlrelay_command_queue_rejections_total{reason=\"full\"} %d\n", queue.Full)
+	fmt.Fprintf(w, "owlrelay_command_queue_rejections_total{reason=\"timeout\"} %d\n", queue.TimedOut)
+
+	pools := map[string]workers.Stats{
+		"dispatch": h.hub.DispatchWorkers(),
+		"artifact": h.artifactWorkers.Stats(),
+	}
+	metric("owlrelay_token_workers_busy", "gauge", "Per-token worker slots in use.")
+	for _, name := range []string{"dispatch", "artifact"} {
+		fmt.Fprintf(w, "owlrelay_token_workers_busy{pool=%q} %d\n", name, pools[name].Busy)
+	}
+	metric("owlrelay_token_workers_waiting", "gauge", "Requests waiting for a worker of their token.")
+	for _, name := range []string{"dispatch", "artifact"} {
+		fmt.Fprintf(w, "owlrelay_token_workers_waiting{pool=%q} %d\n", name, pools[name].Waiting)
+	}
+	metric("owlrelay_token_workers_waits_total", "counter", "Requests that had to wait for a worker of their token.")
+	for _, name := range []string{"dispatch", "artifact"} {
+		fmt.Fprintf(w, "owlrelay_token_workers_waits_total{pool=%q} %d\n", name, pools[name].Waited)
+	}
+
+	artifacts, err := h.artifacts.Stats()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read artifact stats")
+		return
+	}
+
+	metric("owlrelay_artifact_dedup_hits_total", "counter", "Captures stored as a reference to identical existing content.")
+	fmt.Fprintf(w, "owlrelay_artifact_dedup_hits_total %d\n", artifacts.DedupHits)
+
+	metric("owlrelay_artifact_dedup_bytes_saved_total", "counter", "Bytes not written to disk thanks to deduplication.")
+	fmt.Fprintf(w, "owlrelay_artifact_dedup_bytes_saved_total %d\n", artifacts.BytesSaved)
+
+	metric("owlrelay_artifact_blobs", "gauge", "Distinct artifact files on disk.")
+	fmt.Fprintf(w, "owlrelay_artifact_blobs %d\n", artifacts.Blobs)
+
+	metric("owlrelay_artifact_bytes", "gauge", "Bytes of artifact files on disk.")
+	fmt.Fprintf(w, "owlrelay_artifact_bytes %d\n", artifacts.Bytes)
+
+	released := h.retention.Stats()
+	metric("owlrelay_screenshots_released_total", "counter", "Screenshot files released, by reason.")
+	fmt.Fprintf(w, "owlrelay_screenshots_released_total{reason=\"expired\"} %d\n", released.Expired)
+	fmt.Fprintf(w, "owlrelay_screenshots_released_total{reason=\"evicted\"} %d\n", released.Evicted)
+}
@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/dispatch"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// How often a wait step looks for its element again
+const waitPollInterval = 250 * time.Millisecond
+
+// ListPipelines returns the token's stored pipelines
+func (h *Handlers) ListPipelines(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	pipelines, err := h.stores.Pipelines.List(token.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list pipelines")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list pipelines")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.PipelinesResponse{Pipelines: pipelines})
+}
+
+// GetPipeline returns one of the token's pipelines
+func (h *Handlers) GetPipeline(w http.ResponseWriter, r *http.Request) {
+	pipeline, ok := h.loadPipeline(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, pipeline)
+}
+
+// SavePipeline stores a pipeline for the token, replacing one of the same
+// name
+func (h *Handlers) SavePipeline(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.PipelineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Validate(true); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	pipeline, created, err := h.stores.Pipelines.Save(token.ID, &req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save pipeline")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save pipeline")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, pipeline)
+}
+
+// DeletePipeline removes one of the token's pipelines
+func (h *Handlers) DeletePipeline(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	if err := h.stores.Pipelines.Delete(token.ID, chi.URLParam(r, "name")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Pipeline not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete pipeline")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete pipeline")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunPipeline runs one of the token's stored pipelines against a tab
+func (h *Handlers) RunPipeline(w http.ResponseWriter, r *http.Request) {
+	var req models.PipelineRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Pipeline != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "pipeline is only taken by POST /api/v1/pipelines/run")
+		return
+	}
+
+	pipeline, ok := h.loadPipeline(w, r)
+	if !ok {
+		return
+	}
+	h.runPipeline(w, r, &req, pipeline.Name, pipeline.Steps)
+}
+
+// RunInlinePipeline runs the pipeline given in the request without storing
+// it
+func (h *Handlers) RunInlinePipeline(w http.ResponseWriter, r *http.Request) {
+	var req models.PipelineRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Pipeline == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "pipeline is required")
+		return
+	}
+	if err := req.Pipeline.Validate(false); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	h.runPipeline(w, r, &req, req.Pipeline.Name, req.Pipeline.Steps)
+}
+
+// runPipeline checks every command a pipeline's steps may send as
+// POST /api/v1/command would, then runs the steps from the first, following
+// each one's branch, and writes the execution report
+func (h *Handlers) runPipeline(w http.ResponseWriter, r *http.Request, req *models.PipelineRunRequest, name string, steps []models.PipelineStep) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if token == nil || tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+	if req.TabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+
+	// Assertions and waits on elements query the page, which needs the
+	// scope query does
+	commands := make([]models.CommandAction, 0, len(steps))
+	actionAt := make(map[int]int) // step → its action in commands
+	for i, step := range steps {
+		switch {
+		case step.Action != nil:
+			actionAt[i] = len(commands)
+			commands = append(commands, *step.Action)
+		case step.Assert != nil && (step.Assert.Selector != "" || step.Assert.XPath != ""):
+			commands = append(commands, elementQuery(step.Assert.Selector, step.Assert.XPath))
+		case step.Wait != nil && (step.Wait.Selector != "" || step.Wait.XPath != ""):
+			commands = append(commands, elementQuery(step.Wait.Selector, step.Wait.XPath))
+		}
+	}
+	if !h.checkSteps(w, token, commands) {
+		return
+	}
+	// Steps run their actions with the token's defaults applied
+	steps = append([]models.PipelineStep(nil), steps...)
+	for i, c := range actionAt {
+		steps[i].Action = &commands[c]
+	}
+
+	timeout := h.commandTimeout(token, req.Timeout)
+	if timeout > h.cfg.MaxCommandTimeout() {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("timeout must be at most %dms (HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD)", h.cfg.MaxCommandTimeout()))
+		return
+	}
+	if _, ok := h.hub.FindTab(tokenHash, req.TabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+
+	ids := make(map[string]int)
+	for i, step := range steps {
+		if step.ID != "" {
+			ids[step.ID] = i
+		}
+	}
+	run := &pipelineRun{h: h, w: w, r: r, tokenHash: tokenHash, tabID: req.TabID, timeout: timeout, check: check}
+
+	start := time.Now()
+	resp := models.PipelineRunResponse{
+		Pipeline: name,
+		TabID:    req.TabID,
+		Success:  true,
+		Steps:    []models.PipelineStepResult{},
+	}
+	for i := 0; i < len(steps); {
+		if len(resp.Steps) == models.MaxPipelineRunSteps {
+			resp.Success = false
+			resp.Error = &models.CommandError{Code: "STEP_LIMIT",
+				Message: fmt.Sprintf("Pipeline ran %d steps without finishing", models.MaxPipelineRunSteps)}
+			break
+		}
+		if r.Context().Err() != nil {
+			resp.Success = false
+			resp.Error = &models.CommandError{Code: "TIMEOUT", Message: "Pipeline ran out of time"}
+			break
+		}
+
+		step := &steps[i]
+		result := run.step(step)
+		result.Index, result.ID = i, step.ID
+		result.Next = step.OnSuccess
+		if result.Next == "" {
+			result.Next = models.PipelineNext
+		}
+		if !result.Success {
+			result.Next = step.OnFailure
+			if result.Next == "" {
+				result.Next = models.PipelineFail
+			}
+		}
+		resp.Steps = append(resp.Steps, result)
+
+		switch result.Next {
+		case models.PipelineNext:
+			i++
+			continue
+		case models.PipelineEnd:
+		case models.PipelineFail:
+			resp.Success = false
+			resp.Error = result.Error
+			if result.Success || resp.Error == nil {
+				resp.Error = &models.CommandError{Code: "PIPELINE_FAILED", Message: fmt.Sprintf("Step %d branched to fail", i)}
+			}
+		default:
+			i = ids[result.Next]
+			continue
+		}
+		break
+	}
+	resp.Elapsed = time.Since(start).Milliseconds()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pipelineRun is the state a pipeline's steps run with
+type pipelineRun struct {
+	h         *Handlers
+	w         http.ResponseWriter
+	r         *http.Request
+	tokenHash string
+	tabID     string
+	timeout   int // per command, ms
+	check     dispatch.CheckFunc
+}
+
+// step runs a step, trying it again after a failure as often as it allows
+func (p *pipelineRun) step(step *models.PipelineStep) models.PipelineStepResult {
+	start := time.Now()
+	var result models.PipelineStepResult
+	for attempt := 1; ; attempt++ {
+		switch {
+		case step.Action != nil:
+			result = p.action(*step.Action)
+		case step.Assert != nil:
+			result = p.assert(step.Assert)
+		default:
+			result = p.wait(step.Wait)
+		}
+		result.Attempts = attempt
+		if result.Success || attempt > step.Retries || !p.pause(time.Duration(step.RetryDelay)*time.Millisecond) {
+			break
+		}
+	}
+	result.Type = step.Type()
+	result.Elapsed = time.Since(start).Milliseconds()
+	return result
+}
+
+// action sends a command to the tab, checked against the URL policy for the
+// page as it is now
+func (p *pipelineRun) action(action models.CommandAction) models.PipelineStepResult {
+	result := models.PipelineStepResult{Kind: action.Kind}
+	tab, _ := p.h.hub.FindTab(p.tokenHash, p.tabID)
+	if cmdErr := p.check(tab.URL, action); cmdErr != nil {
+		result.Error = cmdErr
+		return result
+	}
+	step := p.h.runStep(p.w, p.r, p.tokenHash, p.tabID, action, p.timeout)
+	result.Success, result.Result, result.Error = step.Success, step.Result, step.Error
+	return result
+}
+
+// query describes the elements matching a selector or XPath in the tab
+func (p *pipelineRun) query(selector, xpath string) (*models.QueryResult, *models.CommandError) {
+	result := p.action(elementQuery(selector, xpath))
+	if !result.Success {
+		return nil, result.Error
+	}
+	qr, ok := result.Result.(*models.QueryResult)
+	if !ok {
+		return nil, &models.CommandError{Code: "INTERNAL_ERROR", Message: "Extension returned an unexpected query result"}
+	}
+	return qr, nil
+}
+
+// assert checks the tab's URL and elements against the step's conditions
+func (p *pipelineRun) assert(a *models.PipelineAssert) models.PipelineStepResult {
+	var result models.PipelineStepResult
+	tab, ok := p.h.hub.FindTab(p.tokenHash, p.tabID)
+	if !ok {
+		result.Error = &models.CommandError{Code: "TAB_NOT_FOUND", Message: "Tab is not attached"}
+		return result
+	}
+	checked := &models.AssertResult{URL: tab.URL}
+	result.Result = checked
+
+	var failures []string
+	switch {
+	case a.URL != "" && tab.URL != a.URL:
+		failures = append(failures, fmt.Sprintf("URL is %q, not %q", tab.URL, a.URL))
+	case a.URLContains != "" && !strings.Contains(tab.URL, a.URLContains):
+		failures = append(failures, fmt.Sprintf("URL %q does not contain %q", tab.URL, a.URLContains))
+	case a.URLMatches != "" && !regexp.MustCompile(a.URLMatches).MatchString(tab.URL):
+		failures = append(failures, fmt.Sprintf("URL %q does not match %q", tab.URL, a.URLMatches))
+	}
+
+	if a.Selector != "" || a.XPath != "" {
+		qr, cmdErr := p.query(a.Selector, a.XPath)
+		if cmdErr != nil {
+			result.Error = cmdErr
+			return result
+		}
+		count := qr.Count
+		checked.Count = &count
+		if len(qr.Elements) > 0 {
+			checked.Text = qr.Elements[0].Text
+		}
+		target := a.Selector
+		if target == "" {
+			target = a.XPath
+		}
+
+		exists := a.Exists
+		if exists == nil && a.Count == nil {
+			matched := true
+			exists = &matched
+		}
+		switch {
+		case exists != nil && *exists && count == 0:
+			failures = append(failures, fmt.Sprintf("Nothing matches %s", target))
+		case exists != nil && !*exists && count > 0:
+			failures = append(failures, fmt.Sprintf("%d elements match %s", count, target))
+		case a.Count != nil && count != *a.Count:
+			failures = append(failures, fmt.Sprintf("%d elements match %s, not %d", count, target, *a.Count))
+		case a.TextEquals != "" && checked.Text != a.TextEquals:
+			failures = append(failures, fmt.Sprintf("Text of %s is %q, not %q", target, checked.Text, a.TextEquals))
+		case a.TextContains != "" && !strings.Contains(checked.Text, a.TextContains):
+			failures = append(failures, fmt.Sprintf("Text of %s does not contain %q", target, a.TextContains))
+		case a.TextMatches != "" && !regexp.MustCompile(a.TextMatches).MatchString(checked.Text):
+			failures = append(failures, fmt.Sprintf("Text of %s does not match %q", target, a.TextMatches))
+		}
+	}
+
+	if len(failures) > 0 {
+		result.Error = &models.CommandError{Code: "ASSERTION_FAILED", Message: strings.Join(failures, "; ")}
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// wait pauses for a time, or until an element appears (or is gone)
+func (p *pipelineRun) wait(wt *models.PipelineWait) models.PipelineStepResult {
+	var result models.PipelineStepResult
+	if wt.Ms > 0 {
+		result.Success = p.pause(time.Duration(wt.Ms) * time.Millisecond)
+		if !result.Success {
+			result.Error = &models.CommandError{Code: "TIMEOUT", Message: "Pipeline ran out of time"}
+		}
+		return result
+	}
+
+	timeout := wt.Timeout
+	if timeout == 0 {
+		timeout = p.timeout
+	}
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	for {
+		qr, cmdErr := p.query(wt.Selector, wt.XPath)
+		if cmdErr != nil {
+			result.Error = cmdErr
+			return result
+		}
+		count := qr.Count
+		result.Result = &models.AssertResult{Count: &count}
+		if (count > 0) != wt.Gone {
+			result.Success = true
+			return result
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 || !p.pause(min(remaining, waitPollInterval)) {
+			break
+		}
+	}
+
+	target := wt.Selector
+	if target == "" {
+		target = wt.XPath
+	}
+	message := fmt.Sprintf("Nothing matched %s within %dms", target, timeout)
+	if wt.Gone {
+		message = fmt.Sprintf("%s still matched after %dms", target, timeout)
+	}
+	result.Error = &models.CommandError{Code: "WAIT_TIMEOUT", Message: message}
+	return result
+}
+
+// pause waits d, keeping the response writable past it, and reports
+// whether the request was still running at the end
+func (p *pipelineRun) pause(d time.Duration) bool {
+	if d <= 0 {
+		return p.r.Context().Err() == nil
+	}
+	http.NewResponseController(p.w).SetWriteDeadline(time.Now().Add(p.h.cfg.RequestTimeout(int(d.Milliseconds()))))
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.r.Context().Done():
+		return false
+	}
+}
+
+// elementQuery is the query an assertion or wait sends for its element
+func elementQuery(selector, xpath string) models.CommandAction {
+	return models.CommandAction{Kind: "query", Selector: selector, XPath: xpath, Limit: 1}
+}
+
+// loadPipeline returns the token's pipeline named in the URL, writing an
+// error response if there is none
+func (h *Handlers) loadPipeline(w http.ResponseWriter, r *http.Request) (*models.Pipeline, bool) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return nil, false
+	}
+
+	pipeline, err := h.stores.Pipelines.Get(token.ID, chi.URLParam(r, "name"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load pipeline")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load pipeline")
+		return nil, false
+	}
+	if pipeline == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Pipeline not found")
+		return nil, false
+	}
+	return pipeline, true
+}
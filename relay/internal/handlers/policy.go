@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/dispatch"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/policy"
+)
+
+// urlPolicy loads the token's URL rules and returns a checker for commands
+func (h *Handlers) urlPolicy(token *models.Token) (dispatch.CheckFunc, error) {
+	rules, err := h.stores.Policies.List(token.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(tabURL string, action models.CommandAction) *models.CommandError {
+		if cmdErr := h.checkPrivileged(token, tabURL, action); cmdErr != nil {
+			return cmdErr
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		// A new tab has no page yet; only its target matters
+		if action.Kind == "tab_create" {
+			if action.URL != "" && !policy.Allowed(rules, action.URL) {
+				return &models.CommandError{Code: "POLICY_DENIED", Message: "New tab URL is not permitted by token policy"}
+			}
+			return nil
+		}
+		// Fail closed when the tab's page is unknown
+		if tabURL == "" || !policy.Allowed(rules, tabURL) {
+			return &models.CommandError{Code: "POLICY_DENIED", Message: "Tab URL is not permitted by token policy"}
+		}
+		if action.Kind == "navigate" && !policy.Allowed(rules, action.URL) {
+			return &models.CommandError{Code: "POLICY_DENIED", Message: "Navigation target is not permitted by token policy"}
+		}
+		if action.Kind == "credentials_set" && action.Credential != nil && !policy.Allowed(rules, action.Credential.Origin+"/") {
+			return &models.CommandError{Code: "POLICY_DENIED", Message: "Credential origin is not permitted by token policy"}
+		}
+		if action.Kind == "request_rules_set" && action.RequestRules != nil {
+			for _, rule := range action.RequestRules.Rules {
+				// Where a substitution leads is only known per request
+				if rule.RegexSubstitution != "" || (rule.RedirectURL != "" && !policy.Allowed(rules, rule.RedirectURL)) {
+					return &models.CommandError{Code: "POLICY_DENIED", Message: "Redirect target is not permitted by token policy"}
+				}
+			}
+		}
+		return nil
+	}, nil
+}
+
+// checkPrivileged applies PRIVILEGED_URLS to the page a command touches:
+// the target of tab_create and navigate, which lead away from the tab's
+// page, and otherwise the tab's page. Closing a tab is always allowed.
+func (h *Handlers) checkPrivileged(token *models.Token, tabURL string, action models.CommandAction) *models.CommandError {
+	if h.cfg.PrivilegedURLs == "allow" {
+		return nil
+	}
+
+	var target string
+	switch action.Kind {
+	case "tab_close":
+	case "tab_create", "navigate":
+		target = action.URL
+	default:
+		target = tabURL
+	}
+	if target == "" || !policy.Privileged(target) {
+		return nil
+	}
+
+	if h.cfg.PrivilegedURLs == "flag" {
+		log.Warn().Int64("token_id", token.ID).Str("kind", action.Kind).Str("url", policy.Normalize(target)).
+			Msg("Command on a privileged page")
+		return nil
+	}
+	return &models.CommandError{Code: "PRIVILEGED_URL",
+		Message: "Commands on browser-internal, extension, and file pages are not permitted: " + policy.Normalize(target)}
+}
+
+// checkURLPolicy writes a POLICY_DENIED or PRIVILEGED_URL error and returns
+// false if the command's tab or navigation target is outside the token's
+// URL policy or a privileged page
+func (h *Handlers) checkURLPolicy(w http.ResponseWriter, token *models.Token, tokenHash, tabID string, action models.CommandAction) bool {
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return false
+	}
+
+	tab, _ := h.hub.FindTab(tokenHash, tabID)
+	if cmdErr := check(tab.URL, action); cmdErr != nil {
+		writeError(w, http.StatusForbidden, cmdErr.Code, cmdErr.Message)
+		return false
+	}
+	return true
+}
+
+// ListPolicies returns the URL rules of a token
+func (h *Handlers) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	rules, err := h.stores.Policies.List(tokenID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list policies")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list policies")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.PoliciesResponse{Rules: rules})
+}
+
+// AddPolicy adds an allow or deny rule to a token
+func (h *Handlers) AddPolicy(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	var req models.PolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	rule, err := h.stores.Policies.Add(tokenID, req.Effect, req.Pattern)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+// DeletePolicy removes a rule from a token
+func (h *Handlers) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "ruleId"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid rule ID")
+		return
+	}
+
+	if err := h.stores.Policies.Delete(tokenID, ruleID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Rule not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete policy")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
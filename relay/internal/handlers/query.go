@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Query describes the elements of a tab matching a selector or XPath
+// expression: their tag, text, attributes, visibility, and position. It is
+// a cheap look at a few elements where a snapshot would serialize the page.
+func (h *Handlers) Query(w http.ResponseWriter, r *http.Request) {
+	var req models.QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	action := models.CommandAction{
+		Kind:     "query",
+		Selector: req.Selector,
+		XPath:    req.XPath,
+		Limit:    req.Limit,
+
+		SelectorEngine: req.SelectorEngine,
+	}
+	if err := action.ValidateQuery(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if err := action.ValidateSelectorEngine(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if action.Limit == 0 {
+		action.Limit = models.DefaultQueryLimit
+	}
+
+	resp, ok := h.tabCommand(w, r, req.TabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.QueryResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.QueryResponse{
+		TabID:     req.TabID,
+		Count:     result.Count,
+		Elements:  result.Elements,
+		Truncated: result.Count > len(result.Elements),
+	})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/recording"
+)
+
+// StartRecording begins recording a tab to a frame archive
+func (h *Handlers) StartRecording(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	var req models.RecordingStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+	if req.FPS == 0 {
+		req.FPS = h.cfg.ScreencastFPS
+	}
+	if req.FPS < 0 || req.FPS > h.cfg.ScreencastMaxFPS {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("fps must be greater than 0 and at most %g (SCREENCAST_MAX_FPS)", h.cfg.ScreencastMaxFPS))
+		return
+	}
+	if req.Quality == 0 {
+		req.Quality = 60
+	}
+	if req.Quality < 1 || req.Quality > 100 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "quality must be between 1 and 100")
+		return
+	}
+	if req.MaxDuration == 0 {
+		req.MaxDuration = h.cfg.RecordingMaxDuration
+	}
+	if req.MaxDuration < 0 || req.MaxDuration > h.cfg.RecordingMaxDuration {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("maxDuration must be greater than 0 and at most %d (RECORDING_MAX_DURATION)", h.cfg.RecordingMaxDuration))
+		return
+	}
+
+	tab, ok := h.hub.FindTab(tokenHash, req.TabID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+	if cmdErr := check(tab.URL, models.CommandAction{Kind: "screenshot"}); cmdErr != nil {
+		writeError(w, http.StatusForbidden, cmdErr.Code, cmdErr.Message)
+		return
+	}
+
+	rec, err := h.recorder.Start(tokenHash, recording.Options{
+		TabID:       req.TabID,
+		FPS:         req.FPS,
+		Quality:     req.Quality,
+		MaxDuration: time.Duration(req.MaxDuration) * time.Second,
+		Timeout:     h.commandTimeout(token, 0),
+		Check:       check,
+	})
+	if err != nil {
+		if errors.Is(err, recording.ErrInProgress) {
+			writeError(w, http.StatusConflict, "RECORDING_IN_PROGRESS", err.Error())
+			return
+		}
+		var hubErr *hub.HubError
+		if errors.As(err, &hubErr) {
+			writeError(w, http.StatusServiceUnavailable, hubErr.Code, hubErr.Message)
+			return
+		}
+		log.Error().Err(err).Msg("Failed to start recording")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start recording")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// StopRecording ends a recording and returns it once its archive is written
+func (h *Handlers) StopRecording(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	var req models.RecordingStopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.ID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "id is required")
+		return
+	}
+
+	rec, ok := h.recorder.Stop(tokenHash, req.ID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Recording not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// GetRecording returns the state of a recording
+func (h *Handlers) GetRecording(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	rec, ok := h.recorder.Get(tokenHash, chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Recording not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// ServeRecordings serves recording archives. Unlike screenshot URLs, which
+// are signed, the random recording ID in the URL is the credential.
+func (h *Handlers) ServeRecordings() http.Handler {
+	return http.StripPrefix("/recordings/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := strings.CutSuffix(r.URL.Path, ".zip")
+		if !ok || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		path, ok := h.recorder.File(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="recording-`+id+`.zip"`)
+		w.Header().Set("Cache-Control", "private, no-cache")
+		http.ServeFile(w, r, path)
+	}))
+}
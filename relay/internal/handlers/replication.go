@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/replication"
+)
+
+// requirePrimary rejects requests on a standby, pointing callers at the primary
+func (h *Handlers) requirePrimary(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.node.IsPrimary() {
+			if primary := h.node.PrimaryURL(); primary != "" {
+				w.Header().Set("X-Owlrelay-Primary", primary)
+			}
+			writeError(w, http.StatusServiceUnavailable, "STANDBY", "This relay is a standby; send requests to the primary")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReplicationStatus reports this relay's role and replication lag
+func (h *Handlers) ReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.node.Status())
+}
+
+// ReplicationSnapshot returns the replicated tables for a standby to copy
+func (h *Handlers) ReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	snap, err := h.node.Snapshot(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to take replication snapshot")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to take snapshot")
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// Promote turns a standby into the primary
+func (h *Handlers) Promote(w http.ResponseWriter, r *http.Request) {
+	if err := h.node.Promote(); err != nil {
+		if errors.Is(err, replication.ErrNotStandby) {
+			writeError(w, http.StatusConflict, "NOT_STANDBY", "Relay is already primary")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, h.node.Status())
+}
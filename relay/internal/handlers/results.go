@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// commandResults keeps the outcome of commands that kept running after
+// their HTTP client disconnected, so it can be fetched by command ID
+type commandResults struct {
+	cfg *config.Config
+
+	mu      sync.Mutex
+	records map[string]*commandRecord
+}
+
+type commandRecord struct {
+	tokenHash string
+	record    models.CommandRecord
+}
+
+func newCommandResults(cfg *config.Config) *commandResults {
+	cr := &commandResults{cfg: cfg, records: make(map[string]*commandRecord)}
+	go cr.cleanupLoop()
+	return cr
+}
+
+// start records a command as running
+func (cr *commandResults) start(tokenHash, id string, createdAt time.Time) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.records[id] = &commandRecord{
+		tokenHash: tokenHash,
+		record:    models.CommandRecord{ID: id, Status: "running", CreatedAt: createdAt},
+	}
+}
+
+// complete stores the response of a command previously passed to start
+func (cr *commandResults) complete(id string, resp *models.CommandAPIResponse) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	rec, ok := cr.records[id]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	rec.record.Status = "completed"
+	rec.record.CompletedAt = &now
+	rec.record.Response = resp
+}
+
+// get returns a copy of the record if it belongs to the token
+func (cr *commandResults) get(tokenHash, id string) (models.CommandRecord, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	rec, ok := cr.records[id]
+	if !ok || rec.tokenHash != tokenHash {
+		return models.CommandRecord{}, false
+	}
+	return rec.record, true
+}
+
+func (cr *commandResults) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		ttl := time.Duration(cr.cfg.CommandResultTTL) * time.Second
+		cr.mu.Lock()
+		for id, rec := range cr.records {
+			if done := rec.record.CompletedAt; done != nil && time.Since(*done) > ttl {
+				delete(cr.records, id)
+			}
+		}
+		cr.mu.Unlock()
+	}
+}
+
+// GetCommand returns the result of a command whose client disconnected
+func (h *Handlers) GetCommand(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	rec, ok := h.results.get(tokenHash, chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "No stored result for this command")
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
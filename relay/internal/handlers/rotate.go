@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// RotateToken issues a new secret for a token. The old one keeps working
+// for the grace period, so extensions can move over without downtime;
+// sessions and everything else keyed to the token carry on.
+func (h *Handlers) RotateToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid token ID")
+		return
+	}
+
+	var req models.RotateTokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+	grace := h.cfg.TokenRotationGrace
+	if req.GracePeriod != nil {
+		if *req.GracePeriod < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "gracePeriod must not be negative")
+			return
+		}
+		grace = *req.GracePeriod
+	}
+
+	resp, err := h.stores.Tokens.Rotate(tokenID, time.Duration(grace)*time.Second)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Token not found or revoked")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to rotate token")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to rotate token")
+		return
+	}
+
+	log.Info().
+		Int64("token_id", tokenID).
+		Time("previous_expires_at", resp.PreviousExpiresAt).
+		Msg("Token rotated")
+	writeJSON(w, http.StatusOK, resp)
+}
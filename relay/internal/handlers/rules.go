@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ListRuleSets returns the token's stored request rule sets
+func (h *Handlers) ListRuleSets(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	sets, err := h.stores.RuleSets.List(token.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list rule sets")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list rule sets")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.RuleSetsResponse{RuleSets: sets})
+}
+
+// GetRuleSet returns one of the token's rule sets
+func (h *Handlers) GetRuleSet(w http.ResponseWriter, r *http.Request) {
+	set, ok := h.loadRuleSet(w, r, chi.URLParam(r, "name"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, set)
+}
+
+// SaveRuleSet stores a rule set for the token, replacing one of the same
+// name. Tabs it was applied to keep the rules they were given.
+func (h *Handlers) SaveRuleSet(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.RuleSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	set, created, err := h.stores.RuleSets.Save(token.ID, &req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save rule set")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save rule set")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, set)
+}
+
+// DeleteRuleSet removes one of the token's rule sets. Tabs it was applied
+// to keep its rules until they are cleared.
+func (h *Handlers) DeleteRuleSet(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	if err := h.stores.RuleSets.Delete(token.ID, chi.URLParam(r, "name")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Rule set not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete rule set")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete rule set")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetRequestRules returns the request rules in effect in an attached tab
+func (h *Handlers) GetRequestRules(w http.ResponseWriter, r *http.Request) {
+	h.requestRulesCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "request_rules_get"})
+}
+
+// ApplyRequestRules pushes one of the token's rule sets to an attached
+// tab, replacing the rules it had, so ads, trackers, and other noise stay
+// out of automation runs
+func (h *Handlers) ApplyRequestRules(w http.ResponseWriter, r *http.Request) {
+	var req models.ApplyRuleSetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.RuleSet == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "ruleSet is required")
+		return
+	}
+
+	set, ok := h.loadRuleSet(w, r, req.RuleSet)
+	if !ok {
+		return
+	}
+	h.requestRulesCommand(w, r, req.TabID, models.CommandAction{
+		Kind:         "request_rules_set",
+		RequestRules: &models.RequestRules{RuleSet: set.Name, Rules: set.Rules},
+	})
+}
+
+// ClearRequestRules removes the request rules of an attached tab
+func (h *Handlers) ClearRequestRules(w http.ResponseWriter, r *http.Request) {
+	h.requestRulesCommand(w, r, r.URL.Query().Get("tabId"), models.CommandAction{Kind: "request_rules_clear"})
+}
+
+func (h *Handlers) requestRulesCommand(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction) {
+	resp, ok := h.tabCommand(w, r, tabID, action)
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.RequestRulesResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	rules := result.Rules
+	if rules == nil {
+		rules = []models.RequestRule{}
+	}
+	writeJSON(w, http.StatusOK, models.RequestRulesResponse{TabID: tabID, RuleSet: result.RuleSet, Rules: rules})
+}
+
+// loadRuleSet writes an error response and returns false unless the token
+// has a rule set by that name
+func (h *Handlers) loadRuleSet(w http.ResponseWriter, r *http.Request, name string) (*models.RuleSet, bool) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return nil, false
+	}
+
+	set, err := h.stores.RuleSets.Get(token.ID, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load rule set")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load rule set")
+		return nil, false
+	}
+	if set == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Rule set not found")
+		return nil, false
+	}
+	return set, true
+}
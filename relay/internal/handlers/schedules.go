@@ -0,0 +1,505 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/contentproc"
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/scheduler"
+)
+
+// Runs returned by GET /api/v1/schedules/{name}/runs unless ?limit= says
+// otherwise
+const defaultScheduleRuns = 20
+
+// ListSchedules returns the token's schedules
+func (h *Handlers) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	schedules, err := h.stores.Schedules.List(token.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list schedules")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list schedules")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.SchedulesResponse{Schedules: schedules})
+}
+
+// GetSchedule returns one of the token's schedules
+func (h *Handlers) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	sched, ok := h.loadSchedule(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, sched)
+}
+
+// SaveSchedule stores a schedule for the token, replacing one of the same
+// name. Its job is checked as it would be when it runs, so a schedule the
+// token could not run is refused now rather than failing at every run.
+func (h *Handlers) SaveSchedule(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if _, ok := h.scheduleActions(w, token, &req.ScheduleJob); !ok {
+		return
+	}
+	if timeout := h.commandTimeout(token, req.Timeout); timeout > h.cfg.MaxCommandTimeout() {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("timeout must be at most %dms (HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD)", h.cfg.MaxCommandTimeout()))
+		return
+	}
+
+	existing, err := h.stores.Schedules.Get(token.ID, req.Name)
+	if err == nil && existing == nil {
+		var n int
+		if n, err = h.stores.Schedules.Count(token.ID); err == nil && n >= models.MaxSchedules {
+			writeError(w, http.StatusConflict, "LIMIT_REACHED", fmt.Sprintf("A token may have at most %d schedules", models.MaxSchedules))
+			return
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load schedules")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save schedule")
+		return
+	}
+
+	next := (&models.Schedule{Cron: req.Cron, Timezone: req.Timezone, Paused: req.Paused}).NextRun(time.Now())
+	if next == nil && !req.Paused {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "cron never fires")
+		return
+	}
+	sched, created, err := h.stores.Schedules.Save(token.ID, &req, next)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save schedule")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save schedule")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, sched)
+}
+
+// DeleteSchedule removes one of the token's schedules and its run history
+func (h *Handlers) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	if err := h.stores.Schedules.Delete(token.ID, chi.URLParam(r, "name")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Schedule not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete schedule")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete schedule")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunSchedule runs one of the token's schedules now, paused or not, and
+// returns the run it started; its outcome is in the run history
+func (h *Handlers) RunSchedule(w http.ResponseWriter, r *http.Request) {
+	sched, ok := h.loadSchedule(w, r)
+	if !ok {
+		return
+	}
+	if !h.node.IsPrimary() {
+		writeError(w, http.StatusServiceUnavailable, "NOT_PRIMARY", "Schedules run on the primary")
+		return
+	}
+
+	run, err := h.scheduler.Fire(sched)
+	if errors.Is(err, scheduler.ErrStopped) {
+		writeError(w, http.StatusServiceUnavailable, hub.ErrShuttingDown.Code, hub.ErrShuttingDown.Message)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to start schedule run")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start schedule run")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+// ScheduleRuns returns a schedule's newest runs. Screenshots a run took
+// come with a URL until they expire.
+func (h *Handlers) ScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	sched, ok := h.loadSchedule(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultScheduleRuns
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be a positive integer")
+			return
+		}
+		limit = min(n, h.cfg.ScheduleHistory)
+	}
+
+	runs, err := h.stores.Schedules.Runs(sched.ID, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list schedule runs")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list schedule runs")
+		return
+	}
+
+	now := time.Now()
+	for _, run := range runs {
+		if run.ScreenshotID == "" {
+			continue
+		}
+		shot, err := h.stores.Screenshots.Get(run.ScreenshotID)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load scheduled screenshot")
+			continue
+		}
+		// Gone once past SCREENSHOT_HISTORY
+		if shot == nil || shot.TokenID != sched.TokenID {
+			continue
+		}
+		shot.Expired = !now.Before(shot.ExpiresAt)
+		if !shot.Expired {
+			shot.URL = h.shotURLs.sign(shot.TokenID, shot.ID, shot.Format, shot.ExpiresAt)
+		}
+		run.Screenshot = shot
+	}
+	writeJSON(w, http.StatusOK, models.ScheduleRunsResponse{Schedule: sched.Name, Runs: runs})
+}
+
+// loadSchedule returns the token's schedule named in the URL, writing an
+// error response if there is none
+func (h *Handlers) loadSchedule(w http.ResponseWriter, r *http.Request) (*models.Schedule, bool) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return nil, false
+	}
+
+	sched, err := h.stores.Schedules.Get(token.ID, chi.URLParam(r, "name"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load schedule")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load schedule")
+		return nil, false
+	}
+	if sched == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Schedule not found")
+		return nil, false
+	}
+	return sched, true
+}
+
+// scheduleActions returns the commands a schedule's job sends, the
+// navigation first and the capture, if any, last. They are checked like
+// the steps of a macro, writing an error response if one may not run.
+func (h *Handlers) scheduleActions(w http.ResponseWriter, token *models.Token, job *models.ScheduleJob) ([]models.CommandAction, bool) {
+	var actions []models.CommandAction
+	if job.URL != "" {
+		actions = append(actions, models.CommandAction{Kind: "navigate", URL: job.URL})
+	}
+
+	switch job.Kind {
+	case models.ScheduleMacro:
+		macro, err := h.stores.Macros.Get(token.ID, job.Macro)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load macro")
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load macro")
+			return nil, false
+		}
+		if macro == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("macro %q not found", job.Macro))
+			return nil, false
+		}
+		steps, err := macro.Expand(job.Params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return nil, false
+		}
+		for i, action := range steps {
+			switch action.Kind {
+			case "upload", "evaluate", "tab_create":
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("step %d: %s cannot be part of a macro", i, action.Kind))
+				return nil, false
+			}
+		}
+		actions = append(actions, steps...)
+	case models.ScheduleScreenshot:
+		format := job.Format
+		if format == "" {
+			format = "png"
+		}
+		action := models.CommandAction{
+			Kind:     "screenshot",
+			FullPage: job.FullPage,
+			Format:   format,
+			Quality:  job.Quality,
+			Selector: job.Selector,
+		}
+		if err := action.ValidateCapture(); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return nil, false
+		}
+		actions = append(actions, action)
+	case models.ScheduleSnapshot:
+		actions = append(actions, models.CommandAction{Kind: "snapshot", Format: job.Format})
+	}
+
+	if !h.checkSteps(w, token, actions) {
+		return nil, false
+	}
+	if job.Kind == models.ScheduleSnapshot {
+		action := &actions[len(actions)-1]
+		if action.MaxDepth <= 0 {
+			action.MaxDepth = h.cfg.DefaultSnapshotMaxDepth
+		}
+		if action.MaxLength <= 0 {
+			action.MaxLength = h.cfg.DefaultSnapshotMaxLength
+		}
+		if action.Format == "markdown" {
+			action.MaxDepth = max(action.MaxDepth, markdownSnapshotDepth)
+		}
+	}
+	return actions, true
+}
+
+// runSchedule runs a schedule's job for the scheduler: it checks the job
+// again, as the token, its macro, or its URL policy may have changed, then
+// sends each command to the tab with the URL policy applied to the page as
+// it is at that step
+func (h *Handlers) runSchedule(ctx context.Context, token *models.Token, sched *models.Schedule) (*scheduler.Outcome, *models.CommandError) {
+	outcome := &scheduler.Outcome{TabID: sched.TabID}
+	if outcome.TabID == "" {
+		// Like a batch, the oldest session's first tab
+		for _, s := range h.hub.GetSessions(token.Hash) {
+			if tabs := s.TabList(); len(tabs) > 0 {
+				outcome.TabID = tabs[0].ID
+				break
+			}
+		}
+		if outcome.TabID == "" {
+			return outcome, &models.CommandError{Code: hub.ErrNotConnected.Code, Message: "No extension session has an attached tab"}
+		}
+	} else if _, ok := h.hub.FindTab(token.Hash, outcome.TabID); !ok {
+		return outcome, &models.CommandError{Code: "TAB_NOT_FOUND", Message: "Tab is not attached"}
+	}
+
+	var rec checkRecorder
+	actions, ok := h.scheduleActions(&rec, token, &sched.ScheduleJob)
+	if !ok {
+		return outcome, rec.commandError()
+	}
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		return outcome, &models.CommandError{Code: "INTERNAL_ERROR", Message: "Failed to load URL policy"}
+	}
+
+	timeout := h.commandTimeout(token, sched.Timeout)
+	last := len(actions) - 1
+	if sched.Kind == models.ScheduleMacro {
+		last = len(actions)
+	}
+
+	// Everything up to the capture: the navigation and a macro's steps
+	start := time.Now()
+	var steps []models.BatchStepResult
+	var failed *models.CommandError
+	for _, action := range actions[:last] {
+		tab, _ := h.hub.FindTab(token.Hash, outcome.TabID)
+		step := models.BatchStepResult{Kind: action.Kind}
+		if cmdErr := check(tab.URL, action); cmdErr != nil {
+			step.Error = cmdErr
+		} else {
+			stepCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+			step = h.sendStep(stepCtx, token.Hash, outcome.TabID, action, timeout)
+			cancel()
+		}
+		steps = append(steps, step)
+		if !step.Success {
+			failed = step.Error
+			if failed == nil {
+				failed = &models.CommandError{Code: "INTERNAL_ERROR", Message: "Step failed"}
+			}
+			break
+		}
+	}
+
+	if sched.Kind == models.ScheduleMacro {
+		outcome.Result, _ = json.Marshal(models.MacroRunResponse{
+			Macro:   sched.Macro,
+			TabID:   outcome.TabID,
+			Success: failed == nil,
+			Steps:   steps,
+			Elapsed: time.Since(start).Milliseconds(),
+		})
+		return outcome, failed
+	}
+	if failed != nil {
+		return outcome, failed
+	}
+
+	capture := actions[last]
+	tab, _ := h.hub.FindTab(token.Hash, outcome.TabID)
+	if cmdErr := check(tab.URL, capture); cmdErr != nil {
+		return outcome, cmdErr
+	}
+	if sched.Kind == models.ScheduleScreenshot {
+		return outcome, h.scheduledScreenshot(ctx, token, outcome, capture, timeout)
+	}
+	return outcome, h.scheduledSnapshot(ctx, token, outcome, capture, timeout)
+}
+
+// scheduledScreenshot captures and keeps a screenshot for
+// SCHEDULE_SCREENSHOT_TTL, which is usually longer than SCREENSHOT_TTL, as
+// no client is waiting to download it
+func (h *Handlers) scheduledScreenshot(ctx context.Context, token *models.Token, outcome *scheduler.Outcome, action models.CommandAction, timeout int) *models.CommandError {
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   outcome.TabID,
+		Action:  action,
+		Timeout: timeout,
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout+h.cfg.ScreenshotQueueTimeout)*time.Millisecond)
+	defer cancel()
+
+	resp, _, release, err := h.capture(ctx, token.Hash, cmd)
+	if err != nil {
+		return scheduleError(err)
+	}
+	defer release()
+	if !resp.Success {
+		return resp.Error
+	}
+	result, ok := resp.Decoded.(*models.ScreenshotResult)
+	if !ok {
+		return &models.CommandError{Code: "INTERNAL_ERROR", Message: "Invalid response format"}
+	}
+	decoded, err := decodeBase64Image(result.Data, h.cfg.MaxScreenshotSize)
+	if err != nil {
+		if _, ok := err.(*FileSizeError); ok {
+			return &models.CommandError{Code: "FILE_TOO_LARGE", Message: "Screenshot exceeds maximum size limit"}
+		}
+		return &models.CommandError{Code: "INTERNAL_ERROR", Message: "Failed to decode screenshot"}
+	}
+
+	ttl := time.Duration(h.cfg.ScheduleScreenshotTTL) * time.Second
+	shot, err := h.keepScreenshot(token, outcome.TabID, cmd.ID, action.Format, decoded, result.Width, result.Height, ttl)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save scheduled screenshot")
+		return &models.CommandError{Code: "INTERNAL_ERROR", Message: "Failed to save screenshot"}
+	}
+	outcome.ScreenshotID = shot.ID
+	return nil
+}
+
+// scheduledSnapshot takes a snapshot and keeps it as the run's result, in
+// the form POST /api/v1/snapshot returns it
+func (h *Handlers) scheduledSnapshot(ctx context.Context, token *models.Token, outcome *scheduler.Outcome, action models.CommandAction, timeout int) *models.CommandError {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	step := h.sendStep(ctx, token.Hash, outcome.TabID, action, timeout)
+	if !step.Success {
+		return step.Error
+	}
+	result, ok := step.Result.(*models.SnapshotResult)
+	if !ok {
+		return &models.CommandError{Code: "INTERNAL_ERROR", Message: "Invalid response format"}
+	}
+
+	snapshot := models.SnapshotResponse{
+		HTML:                result.HTML,
+		URL:                 result.URL,
+		Title:               result.Title,
+		Truncated:           result.Truncated,
+		InteractiveElements: result.Elements,
+		ElementsTruncated:   result.ElementsTruncated,
+	}
+	if action.Format == "markdown" {
+		md, err := contentproc.Markdown(result.HTML, result.URL)
+		if err != nil {
+			return &models.CommandError{Code: "INTERNAL_ERROR", Message: "Failed to convert the page to Markdown"}
+		}
+		snapshot.HTML = ""
+		snapshot.Markdown = md
+	}
+	outcome.Result, _ = json.Marshal(snapshot)
+	return nil
+}
+
+// scheduleError turns an error sending a command into a run's error
+func scheduleError(err error) *models.CommandError {
+	if errors.Is(err, errCaptureBusy) {
+		return &models.CommandError{Code: "SCREENSHOT_BUSY", Message: "Too many screenshots in progress"}
+	}
+	if hubErr, ok := err.(*hub.HubError); ok {
+		return &models.CommandError{Code: hubErr.Code, Message: hubErr.Message}
+	}
+	return &models.CommandError{Code: "INTERNAL_ERROR", Message: err.Error()}
+}
+
+// checkRecorder takes the error response a check writes, for checks run
+// outside a request
+type checkRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (c *checkRecorder) Header() http.Header {
+	if c.header == nil {
+		c.header = http.Header{}
+	}
+	return c.header
+}
+
+func (c *checkRecorder) Write(b []byte) (int, error) { return c.body.Write(b) }
+
+func (c *checkRecorder) WriteHeader(int) {}
+
+// commandError returns the recorded error response as a command error
+func (c *checkRecorder) commandError() *models.CommandError {
+	var body models.APIError
+	if err := json.Unmarshal(c.body.Bytes(), &body); err != nil || body.Error.Code == "" {
+		return &models.CommandError{Code: "INTERNAL_ERROR", Message: "The schedule's job was refused"}
+	}
+	return &models.CommandError{Code: body.Error.Code, Message: body.Error.Message}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// screencastBoundary separates the frames of a screencast response
+const screencastBoundary = "owlrelay-frame"
+
+// Screencast streams a tab as multipart MJPEG, capturing a JPEG screenshot
+// at the requested rate until the client leaves, the tab goes away, or the
+// request reaches HTTP_TIMEOUT_MAX
+func (h *Handlers) Screencast(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	query := r.URL.Query()
+	tabID := query.Get("tabId")
+	if tabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+
+	fps := h.cfg.ScreencastFPS
+	if v := query.Get("fps"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil || parsed <= 0 || parsed > h.cfg.ScreencastMaxFPS {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+				fmt.Sprintf("fps must be greater than 0 and at most %g (SCREENCAST_MAX_FPS)", h.cfg.ScreencastMaxFPS))
+			return
+		}
+		fps = parsed
+	}
+
+	quality := 60
+	if v := query.Get("quality"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > 100 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "quality must be between 1 and 100")
+			return
+		}
+		quality = parsed
+	}
+
+	tab, ok := h.hub.FindTab(tokenHash, tabID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+
+	action := models.CommandAction{Kind: "screenshot", Format: "jpeg", Quality: quality}
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+	if cmdErr := check(tab.URL, action); cmdErr != nil {
+		writeError(w, http.StatusForbidden, cmdErr.Code, cmdErr.Message)
+		return
+	}
+
+	h.screencasts.Add(1)
+	defer h.screencasts.Add(-1)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+screencastBoundary)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	interval := time.Duration(float64(time.Second) / fps)
+	timeout := h.commandTimeout(token, 0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	frames := 0
+	started := time.Now()
+	defer func() {
+		log.Debug().
+			Str("tab_id", tabID).
+			Int("frames", frames).
+			Dur("duration", time.Since(started)).
+			Msg("Screencast ended")
+	}()
+
+	for {
+		// Stop once the tab is gone or has navigated somewhere the token
+		// may not see
+		tab, ok := h.hub.FindTab(tokenHash, tabID)
+		if !ok || check(tab.URL, action) != nil {
+			return
+		}
+
+		frame, err := h.captureFrame(r.Context(), tokenHash, tabID, quality, timeout)
+		if err != nil {
+			if hubErr, ok := err.(*hub.HubError); ok && hubErr.Code != "TIMEOUT" {
+				// The tab or its extension is gone
+				return
+			}
+			if r.Context().Err() != nil {
+				return
+			}
+			log.Debug().Err(err).Str("tab_id", tabID).Msg("Skipped screencast frame")
+		} else {
+			rc.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+			_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+				screencastBoundary, len(frame))
+			if err == nil {
+				_, err = w.Write(append(frame, '\r', '\n'))
+			}
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+			frames++
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// captureFrame captures one JPEG frame of a tab for a screencast or
+// recording
+func (h *Handlers) captureFrame(ctx context.Context, tokenHash, tabID string, quality, timeout int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	release, err := h.artifactWorkers.Acquire(ctx, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := h.hub.SendCommand(ctx, tokenHash, &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   tabID,
+		Action:  models.CommandAction{Kind: "screenshot", Format: "jpeg", Quality: quality},
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, fmt.Errorf("%s: %s", resp.Error.Code, resp.Error.Message)
+	}
+
+	result, ok := resp.Decoded.(*models.ScreenshotResult)
+	if !ok {
+		return nil, fmt.Errorf("invalid response format")
+	}
+	return decodeBase64Image(result.Data, h.cfg.MaxScreenshotSize)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+const (
+	defaultScreenshotLimit = 50
+	maxScreenshotLimit     = 500
+)
+
+// ListScreenshots returns the token's recent screenshots, newest first.
+// Query filters: tabId, commandId, since and until (RFC 3339), limit.
+func (h *Handlers) ListScreenshots(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := store.ScreenshotFilter{
+		TabID:     q.Get("tabId"),
+		CommandID: q.Get("commandId"),
+		Limit:     defaultScreenshotLimit,
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "INVALID_REQUEST", name+" must be an RFC 3339 timestamp")
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxScreenshotLimit {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "limit must be between 1 and "+strconv.Itoa(maxScreenshotLimit))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	shots, err := h.stores.Screenshots.List(token.ID, filter)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list screenshots")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list screenshots")
+		return
+	}
+
+	now := time.Now()
+	for _, shot := range shots {
+		shot.Expired = !now.Before(shot.ExpiresAt)
+		if !shot.Expired {
+			shot.URL = h.shotURLs.sign(token.ID, shot.ID, shot.Format, shot.ExpiresAt)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, models.ScreenshotsResponse{Screenshots: shots})
+}
+
+// ScreenshotImage serves the file of one of the token's screenshots until
+// it expires. Screenshots of other tokens are not found.
+func (h *Handlers) ScreenshotImage(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	if token == nil {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	shot, err := h.stores.Screenshots.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up screenshot")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to look up screenshot")
+		return
+	}
+	if shot == nil || shot.TokenID != token.ID || shot.Hash == "" {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Screenshot not found")
+		return
+	}
+	if !time.Now().Before(shot.ExpiresAt) {
+		writeError(w, http.StatusGone, "EXPIRED", "Screenshot file has expired")
+		return
+	}
+
+	w.Header().Set("ETag", `"`+shot.Hash+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeFile(w, r, h.artifacts.Path(shot.TokenID, shot.Hash, shot.Format))
+}
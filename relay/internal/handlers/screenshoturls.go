@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/redis"
+)
+
+// usedURLPrefix keys the URLs served in Redis when relays are clustered
+const usedURLPrefix = "owlrelay:shoturl:"
+
+// screenshotURLs signs the URLs screenshots are served on. A URL carries
+// its expiry, a nonce, and an HMAC of both with the screenshot's name and
+// owning token, so only URLs the relay handed out resolve, and only to the
+// owner's screenshot: knowing or guessing a screenshot ID is not enough.
+// With SCREENSHOT_URL_SINGLE_USE each URL is served once, across the
+// cluster when relays are clustered; a download cut short can be resumed
+// from the byte where it stopped, and from nowhere else.
+type screenshotURLs struct {
+	key       []byte
+	singleUse bool
+	redis     *redis.Client // nil unless clustered
+
+	mu        sync.Mutex
+	used      map[string]usedURL // by signature
+	lastPrune time.Time
+}
+
+// usedURL is a URL that was served, and the offset a resume must start at
+type usedURL struct {
+	expires time.Time
+	offset  int64
+}
+
+func newScreenshotURLs(cfg *config.Config) *screenshotURLs {
+	key := []byte(cfg.ScreenshotURLSecret)
+	if len(key) == 0 {
+		// URLs handed out before a restart stop working, as do most of
+		// the screenshots they name
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	u := &screenshotURLs{
+		key:       key,
+		singleUse: cfg.ScreenshotURLSingleUse,
+		used:      make(map[string]usedURL),
+	}
+	if cfg.ClusterEnabled && u.singleUse {
+		client, err := redis.New(cfg.RedisURL)
+		if err != nil {
+			log.Error().Err(err).Msg("Single-use screenshot URLs are tracked per relay")
+		}
+		u.redis = client
+	}
+	return u
+}
+
+// sign returns a URL for a token's screenshot file "<id>.<format>" that
+// works until expires
+func (u *screenshotURLs) sign(tokenID int64, id, format string, expires time.Time) string {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	n := base64.RawURLEncoding.EncodeToString(nonce)
+	return "/screenshots/" + id + "." + format + "?" + url.Values{
+		"expires": {exp},
+		"n":       {n},
+		"sig":     {u.mac(tokenID, id+"."+format, exp, n)},
+	}.Encode()
+}
+
+// verify checks a request's signature for a token's screenshot file name.
+// It returns the signature, which identifies the URL, and whether it is
+// valid and unexpired.
+func (u *screenshotURLs) verify(tokenID int64, name string, q url.Values) (string, time.Time, bool) {
+	exp, n, sig := q.Get("expires"), q.Get("n"), q.Get("sig")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || sig == "" {
+		return "", time.Time{}, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(u.mac(tokenID, name, exp, n))) {
+		return "", time.Time{}, false
+	}
+	expires := time.Unix(unix, 0)
+	if !time.Now().Before(expires) {
+		return "", time.Time{}, false
+	}
+	return sig, expires, true
+}
+
+// noResume is the offset of a used URL no request may resume: one being
+// served, or one whose response cannot be resumed
+const noResume = -1
+
+// claimScript claims a URL in Redis for a request starting at ARGV[1]
+// (-1 for none) and marks it being served until served records where it
+// stopped. KEYS[1] URL; ARGV from, TTL (ms). Returns 1 if claimed.
+var claimScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur and (tonumber(ARGV[1]) < 0 or cur ~= ARGV[1]) then
+  return 0
+end
+redis.call('SET', KEYS[1], '-1', 'PX', ARGV[2])
+return 1
+`)
+
+// claim marks a URL used for a request whose body starts at byte from, or
+// noResume for one that is not an open-ended range. It reports false when
+// single-use URLs are on and the URL was already served, unless from is
+// exactly where the last response on it stopped: that resumes an
+// interrupted download without serving any byte twice.
+func (u *screenshotURLs) claim(ctx context.Context, sig string, expires time.Time, from int64) bool {
+	if !u.singleUse {
+		return true
+	}
+	if u.redis != nil {
+		ttl := max(time.Until(expires).Milliseconds(), 1)
+		reply, err := claimScript.Run(ctx, u.redis, []string{usedURLPrefix + sig}, from, ttl)
+		if err == nil {
+			return reply == int64(1)
+		}
+		// Served at most once per relay until Redis is back
+		log.Warn().Err(err).Msg("Failed to mark screenshot URL used in redis")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(u.lastPrune) >= time.Minute {
+		for s, used := range u.used {
+			if !now.Before(used.expires) {
+				delete(u.used, s)
+			}
+		}
+		u.lastPrune = now
+	}
+	if used, ok := u.used[sig]; ok && (from < 0 || used.offset != from) {
+		return false
+	}
+	u.used[sig] = usedURL{expires: expires, offset: noResume}
+	return true
+}
+
+// served records the offset a claimed URL's response stopped at, which is
+// where the next request on it must start
+func (u *screenshotURLs) served(ctx context.Context, sig string, expires time.Time, offset int64) {
+	if !u.singleUse {
+		return
+	}
+	if u.redis != nil {
+		ttl := max(time.Until(expires).Milliseconds(), 1)
+		_, err := u.redis.Do(ctx, "SET", usedURLPrefix+sig, offset, "XX", "PX", ttl)
+		if err == nil {
+			return
+		}
+		log.Warn().Err(err).Msg("Failed to record screenshot URL offset in redis")
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.used[sig] = usedURL{expires: expires, offset: offset}
+}
+
+// resumeFrom returns the first byte a request asks for: 0 without a Range,
+// N for "bytes=N-", and noResume for any other range
+func resumeFrom(r *http.Request) int64 {
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		return 0
+	}
+	start, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return noResume
+	}
+	start, ok = strings.CutSuffix(start, "-")
+	if !ok {
+		return noResume
+	}
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || n < 0 {
+		return noResume
+	}
+	return n
+}
+
+// servedOffset returns where a response starting at byte from stopped,
+// counting only the bytes written to the client
+func servedOffset(from int64, status, written int) int64 {
+	switch {
+	case status == http.StatusOK:
+		return int64(written)
+	case status == http.StatusPartialContent && from >= 0:
+		return from + int64(written)
+	case written == 0:
+		return from
+	}
+	return noResume
+}
+
+// revalidates reports whether a request names the image's ETag in
+// If-None-Match, as a client polling an image it already has does. It is
+// answered 304 with no body, so it does not use the URL.
+func revalidates(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *screenshotURLs) mac(tokenID int64, name, exp, nonce string) string {
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write([]byte(strconv.FormatInt(tokenID, 10) + "/" + name + "." + exp + "." + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/scripts"
+)
+
+// RecordScript starts recording the commands sent to a tab. Every command
+// that succeeds in it, from any API, becomes a step of the script until
+// the recording is stopped.
+func (h *Handlers) RecordScript(w http.ResponseWriter, r *http.Request) {
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.ScriptRecordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+	tab, ok := h.hub.FindTab(tokenHash, req.TabID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+
+	script, err := h.scripts.Start(tokenHash, req.TabID, tab.URL)
+	if errors.Is(err, scripts.ErrAlreadyRecording) {
+		writeError(w, http.StatusConflict, "ALREADY_RECORDING", "The tab is already being recorded")
+		return
+	}
+	writeJSON(w, http.StatusCreated, script)
+}
+
+// GetScript returns a recording's script so far
+func (h *Handlers) GetScript(w http.ResponseWriter, r *http.Request) {
+	script, ok := h.scripts.Get(middleware.TokenHashFromContext(r.Context()), chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Script not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, script)
+}
+
+// StopScript ends a recording and returns its script
+func (h *Handlers) StopScript(w http.ResponseWriter, r *http.Request) {
+	script, ok := h.scripts.Stop(middleware.TokenHashFromContext(r.Context()), chi.URLParam(r, "id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Script not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, script)
+}
+
+// Replay runs a recorded script against a tab, first opening the page the
+// recording started on. Steps keep their recorded spacing, scaled by
+// speed. Like a macro, every step is checked before the first runs and the
+// replay stops at the first failure unless continueOnError is set.
+func (h *Handlers) Replay(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	if token == nil || tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	var req models.ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return
+	}
+	if err := req.Script.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	speed := req.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	if speed < models.MinReplaySpeed || speed > models.MaxReplaySpeed {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("speed must be between %g and %g", models.MinReplaySpeed, models.MaxReplaySpeed))
+		return
+	}
+
+	steps := req.Script.Steps
+	offsets := make([]time.Duration, len(steps))
+	actions := make([]models.CommandAction, len(steps))
+	for i, step := range steps {
+		if step.Action.Kind == "upload" || step.Action.Kind == "tab_create" {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("step %d: %s cannot be replayed", i, step.Action.Kind))
+			return
+		}
+		actions[i] = step.Action
+		if !req.IgnoreTiming {
+			offsets[i] = time.Duration(float64(step.Offset)/speed) * time.Millisecond
+		}
+	}
+	if req.Script.URL != "" && (req.Navigate == nil || *req.Navigate) {
+		actions = append([]models.CommandAction{{Kind: "navigate", URL: req.Script.URL}}, actions...)
+		offsets = append([]time.Duration{0}, offsets...)
+	}
+	if !h.checkSteps(w, token, actions) {
+		return
+	}
+
+	timeout := h.commandTimeout(token, req.Timeout)
+	if timeout > h.cfg.MaxCommandTimeout() {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("timeout must be at most %dms (HTTP_TIMEOUT_MAX minus HTTP_TIMEOUT_OVERHEAD)", h.cfg.MaxCommandTimeout()))
+		return
+	}
+	if last := offsets[len(offsets)-1]; last > time.Duration(h.cfg.MaxCommandTimeout())*time.Millisecond {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST",
+			fmt.Sprintf("The script takes %s at this speed, longer than a request may run; raise speed or set ignoreTiming", last.Round(time.Second)))
+		return
+	}
+	if _, ok := h.hub.FindTab(tokenHash, req.TabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+	check, err := h.urlPolicy(token)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load URL policy")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load URL policy")
+		return
+	}
+
+	start := time.Now()
+	resp := models.ReplayResponse{
+		TabID:   req.TabID,
+		Success: true,
+		Steps:   make([]models.BatchStepResult, 0, len(actions)),
+	}
+	for i, action := range actions {
+		// A step starts at its recorded offset, or when the one before it
+		// ends if that took longer
+		if wait := offsets[i] - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+			}
+		}
+
+		tab, _ := h.hub.FindTab(tokenHash, req.TabID)
+		step := models.BatchStepResult{Kind: action.Kind}
+		if cmdErr := check(tab.URL, action); cmdErr != nil {
+			step.Error = cmdErr
+		} else {
+			step = h.runStep(w, r, tokenHash, req.TabID, action, timeout)
+		}
+		resp.Steps = append(resp.Steps, step)
+		if !step.Success {
+			resp.Success = false
+			if !req.ContinueOnError {
+				break
+			}
+		}
+	}
+	resp.Elapsed = time.Since(start).Milliseconds()
+	writeJSON(w, http.StatusOK, resp)
+}
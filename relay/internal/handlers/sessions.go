@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetSession returns one of the token's sessions in detail: how long it has
+// been connected, its last ping, browser and extension, tabs, and its
+// in-flight and recently failed commands, so clients can pick a session to
+// send work to
+func (h *Handlers) GetSession(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	if token == nil || tokenHash == "" {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	var session *models.Session
+	for _, s := range h.hub.GetSessions(tokenHash) {
+		if s.ID == id {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		writeError(w, http.StatusNotFound, "SESSION_NOT_FOUND", "Session is not connected")
+		return
+	}
+
+	name, extensionVer, client := session.Info()
+	writeJSON(w, http.StatusOK, models.SessionDetail{
+		ID:               session.ID,
+		Name:             name,
+		TokenName:        session.TokenName,
+		ExtensionVersion: extensionVer,
+		Client:           client,
+		Window:           session.CurrentWindow(),
+		Canary:           session.IsCanary(),
+		Node:             session.Node,
+		ConnectedAt:      session.ConnectedAt,
+		ConnectedFor:     int64(time.Since(session.ConnectedAt).Seconds()),
+		LastPingAt:       session.LastPingAt,
+		Tabs:             session.TabList(),
+		Commands:         h.hub.SessionCommands(tokenHash, session.ID),
+	})
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// GetStorage returns localStorage or sessionStorage items of a tab's
+// origin: those named by ?key=, or all of them
+func (h *Handlers) GetStorage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	area, ok := storageArea(w, q.Get("area"))
+	if !ok {
+		return
+	}
+
+	tabID := q.Get("tabId")
+	resp, ok := h.tabCommand(w, r, tabID, models.CommandAction{
+		Kind:      "storage_get",
+		Area:      area,
+		Keys:      q["key"],
+		MaxLength: h.cfg.StorageMaxSize,
+	})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.StorageResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.StorageResponse{
+		TabID:     tabID,
+		URL:       result.URL,
+		Area:      area,
+		Items:     result.Items,
+		Truncated: result.Truncated,
+	})
+}
+
+// SetStorage writes localStorage or sessionStorage items of a tab's origin,
+// so tests can seed application state directly
+func (h *Handlers) SetStorage(w http.ResponseWriter, r *http.Request) {
+	var req models.SetStorageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	area, ok := storageArea(w, req.Area)
+	if !ok {
+		return
+	}
+	if !h.checkStorageItems(w, req.Items) {
+		return
+	}
+
+	resp, ok := h.tabCommand(w, r, req.TabID, models.CommandAction{Kind: "storage_set", Area: area, Items: req.Items})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.StorageResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.StorageResponse{TabID: req.TabID, URL: result.URL, Area: area, Items: result.Items})
+}
+
+// RemoveStorage removes the items named by ?key= from a tab's storage,
+// or clears it without any
+func (h *Handlers) RemoveStorage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	area, ok := storageArea(w, q.Get("area"))
+	if !ok {
+		return
+	}
+
+	tabID := q.Get("tabId")
+	resp, ok := h.tabCommand(w, r, tabID, models.CommandAction{Kind: "storage_remove", Area: area, Keys: q["key"]})
+	if !ok {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.StorageRemoveResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+	writeJSON(w, http.StatusOK, models.RemoveStorageResponse{TabID: tabID, URL: result.URL, Area: area, Removed: result.Removed})
+}
+
+// checkStorageAction validates a storage_* action sent through
+// POST /api/v1/command and fills in its defaults
+func (h *Handlers) checkStorageAction(w http.ResponseWriter, action *models.CommandAction) bool {
+	area, ok := storageArea(w, action.Area)
+	if !ok {
+		return false
+	}
+	action.Area = area
+	switch action.Kind {
+	case "storage_get":
+		if action.MaxLength <= 0 || action.MaxLength > h.cfg.StorageMaxSize {
+			action.MaxLength = h.cfg.StorageMaxSize
+		}
+	case "storage_set":
+		return h.checkStorageItems(w, action.Items)
+	}
+	return true
+}
+
+// checkStorageItems writes an error response and returns false unless
+// items may be written
+func (h *Handlers) checkStorageItems(w http.ResponseWriter, items map[string]string) bool {
+	if len(items) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "items is required")
+		return false
+	}
+	size := 0
+	for k, v := range items {
+		if k == "" {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "item keys must not be empty")
+			return false
+		}
+		size += len(k) + len(v)
+	}
+	if size > h.cfg.StorageMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE",
+			fmt.Sprintf("Items exceed %d bytes (STORAGE_MAX_SIZE)", h.cfg.StorageMaxSize))
+		return false
+	}
+	return true
+}
+
+// storageArea validates a storage area, defaulting to local
+func storageArea(w http.ResponseWriter, area string) (string, bool) {
+	switch area {
+	case "":
+		return models.StorageLocal, true
+	case models.StorageLocal, models.StorageSession:
+		return area, true
+	}
+	writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "area must be local or session")
+	return "", false
+}
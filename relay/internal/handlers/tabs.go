@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// CreateTab asks an extension to open and attach a new tab
+func (h *Handlers) CreateTab(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	var req models.CreateTabRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Debug().Err(err).Msg("Failed to decode create tab request")
+			writeBodyError(w, err)
+			return
+		}
+	}
+
+	timeout := h.commandTimeout(token, req.Timeout)
+	if timeout > h.cfg.MaxCommandTimeout() {
+		timeout = h.cfg.MaxCommandTimeout()
+	}
+
+	cmd := &models.CommandRequest{
+		Type: "command",
+		ID:   uuid.New().String(),
+		Action: models.CommandAction{
+			Kind:       "tab_create",
+			URL:        req.URL,
+			Background: req.Background,
+		},
+		Timeout: timeout,
+	}
+
+	if !h.checkURLPolicy(w, token, tokenHash, "", cmd.Action) {
+		return
+	}
+
+	ctx, cancel := h.commandContext(r.Context(), w, timeout)
+	defer cancel()
+
+	var resp *models.CommandResponse
+	var err error
+	if req.SessionID != "" {
+		resp, err = h.hub.SendCommandToSession(ctx, tokenHash, req.SessionID, cmd)
+	} else {
+		resp, err = h.hub.SendCommand(ctx, tokenHash, cmd)
+	}
+	if !h.commandSucceeded(w, resp, err) {
+		return
+	}
+
+	result, ok := resp.Decoded.(*models.TabCreateResult)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Invalid response format")
+		return
+	}
+
+	tab, ok := h.hub.FindTab(tokenHash, result.TabID)
+	if !ok {
+		// Closed again before we got here; report what the extension said
+		tab = models.Tab{ID: result.TabID, URL: result.URL, Title: result.Title}
+	}
+	writeJSON(w, http.StatusCreated, tab)
+}
+
+// CloseTab asks the owning extension to close an attached tab
+func (h *Handlers) CloseTab(w http.ResponseWriter, r *http.Request) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+	tabID := chi.URLParam(r, "id")
+
+	if _, ok := h.hub.FindTab(tokenHash, tabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return
+	}
+
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   tabID,
+		Action:  models.CommandAction{Kind: "tab_close"},
+		Timeout: h.commandTimeout(token, 0),
+	}
+
+	if !h.checkURLPolicy(w, token, tokenHash, tabID, cmd.Action) {
+		return
+	}
+
+	ctx, cancel := h.commandContext(r.Context(), w, cmd.Timeout)
+	defer cancel()
+
+	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
+	if !h.commandSucceeded(w, resp, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tabCommand runs an action in an attached tab, writing an error response
+// and returning false if it did not succeed
+func (h *Handlers) tabCommand(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction) (*models.CommandResponse, bool) {
+	return h.tabCommandFiles(w, r, tabID, action, nil)
+}
+
+// tabCommandFiles is tabCommand for an "upload" action, streaming the
+// contents of its files to the extension ahead of it
+func (h *Handlers) tabCommandFiles(w http.ResponseWriter, r *http.Request, tabID string, action models.CommandAction, uploads [][]byte) (*models.CommandResponse, bool) {
+	token := middleware.TokenFromContext(r.Context())
+	tokenHash := middleware.TokenHashFromContext(r.Context())
+
+	if tabID == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "tabId is required")
+		return nil, false
+	}
+	if _, ok := h.hub.FindTab(tokenHash, tabID); !ok {
+		writeError(w, http.StatusNotFound, "TAB_NOT_FOUND", "Tab is not attached")
+		return nil, false
+	}
+
+	cmd := &models.CommandRequest{
+		Type:    "command",
+		ID:      uuid.New().String(),
+		TabID:   tabID,
+		Action:  action,
+		Timeout: h.commandTimeout(token, 0),
+		Uploads: uploads,
+	}
+
+	if !h.checkURLPolicy(w, token, tokenHash, tabID, cmd.Action) {
+		return nil, false
+	}
+
+	ctx, cancel := h.commandContext(r.Context(), w, cmd.Timeout)
+	defer cancel()
+
+	resp, err := h.hub.SendCommand(ctx, tokenHash, cmd)
+	if !h.commandSucceeded(w, resp, err) {
+		return nil, false
+	}
+	return resp, true
+}
+
+// commandSucceeded writes an error response and returns false unless the
+// command ran and the extension reported success
+func (h *Handlers) commandSucceeded(w http.ResponseWriter, resp *models.CommandResponse, err error) bool {
+	if err != nil {
+		if hubErr, ok := err.(*hub.HubError); ok {
+			statusCode := http.StatusServiceUnavailable
+			switch hubErr.Code {
+			case "TIMEOUT":
+				statusCode = http.StatusGatewayTimeout
+			case "QUEUE_FULL", "QUEUE_TIMEOUT":
+				statusCode = http.StatusTooManyRequests
+			case "UNSUPPORTED_ACTION":
+				statusCode = http.StatusUnprocessableEntity
+			}
+			writeError(w, statusCode, hubErr.Code, hubErr.Message)
+			return false
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return false
+	}
+
+	if !resp.Success {
+		writeError(w, http.StatusBadRequest, resp.Error.Code, resp.Error.Message)
+		return false
+	}
+	return true
+}
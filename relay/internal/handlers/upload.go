@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+const (
+	// uploadFormOverhead allows for the multipart framing and form fields
+	// around the files of an upload
+	uploadFormOverhead = 64 << 10
+
+	// uploadMemory is how much of an upload is held in memory while the
+	// form is parsed; the rest is spooled to temporary files
+	uploadMemory = 1 << 20
+)
+
+// Upload sets files on a file input. The multipart form carries tabId,
+// selector and one or more "file" parts, which the relay stores until the
+// extension has them.
+func (h *Handlers) Upload(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, h.cfg.UploadMaxSize+uploadFormOverhead)
+	if err := r.ParseMultipartForm(uploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadTooLarge(w, h.cfg.UploadMaxSize)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Expected a multipart/form-data body")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	tabID := r.FormValue("tabId")
+	selector := r.FormValue("selector")
+	if selector == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "selector is required")
+		return
+	}
+	parts := r.MultipartForm.File["file"]
+	if len(parts) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "file is required")
+		return
+	}
+
+	var size int64
+	files := make([]models.UploadFile, len(parts))
+	uploads := make([][]byte, len(parts))
+	for i, part := range parts {
+		size += part.Size
+		if size > h.cfg.UploadMaxSize {
+			writeUploadTooLarge(w, h.cfg.UploadMaxSize)
+			return
+		}
+		f, err := part.Open()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to read uploaded file")
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to read uploaded file")
+			return
+		}
+		files[i] = models.UploadFile{
+			Name:     part.Filename,
+			MimeType: part.Header.Get("Content-Type"),
+			Size:     int64(len(data)),
+		}
+		uploads[i] = data
+	}
+
+	if _, ok := h.tabCommandFiles(w, r, tabID, models.CommandAction{
+		Kind:     "upload",
+		Selector: selector,
+		Files:    files,
+	}, uploads); !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, models.UploadResponse{TabID: tabID, Selector: selector, Files: files})
+}
+
+func writeUploadTooLarge(w http.ResponseWriter, max int64) {
+	writeError(w, http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE",
+		fmt.Sprintf("Files exceed %d bytes (UPLOAD_MAX_SIZE)", max))
+}
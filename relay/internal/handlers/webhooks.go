@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ListWebhooks returns the registered webhooks, without their secrets
+func (h *Handlers) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := h.stores.Webhooks.List()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list webhooks")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list webhooks")
+		return
+	}
+	for _, wh := range hooks {
+		wh.Secret = ""
+	}
+	writeJSON(w, http.StatusOK, models.WebhooksResponse{Webhooks: hooks})
+}
+
+// CreateWebhook registers a URL for events. The response is the only one
+// that includes the secret deliveries are signed with.
+func (h *Handlers) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req models.WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	wh, err := h.stores.Webhooks.Create(&req)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create webhook")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create webhook")
+		return
+	}
+	h.reloadWebhooks()
+	writeJSON(w, http.StatusCreated, wh)
+}
+
+// DeleteWebhook removes a webhook; deliveries already queued are still sent
+func (h *Handlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid webhook ID")
+		return
+	}
+
+	if err := h.stores.Webhooks.Delete(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Webhook not found")
+			return
+		}
+		log.Error().Err(err).Msg("Failed to delete webhook")
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete webhook")
+		return
+	}
+	h.reloadWebhooks()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadWebhooks applies a change right away; other relays pick it up
+// within 30 seconds
+func (h *Handlers) reloadWebhooks() {
+	if err := h.webhooks.Reload(); err != nil {
+		log.Warn().Err(err).Msg("Failed to reload webhooks")
+	}
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// activityWindow is how many one-second activity samples each session keeps
+const activityWindow = 300
+
+// outbound is a message waiting in a connection's send queue. Commands
+// carry the time they were queued so the write pump can measure the wait.
+type outbound struct {
+	data     []byte
+	queued   time.Time        // zero for messages other than commands
+	written  chan<- time.Time // if set, gets the time the message was written
+	encoding string           // if set, later messages are written in this encoding
+}
+
+// activity records a session's command concurrency, send queue wait and
+// failures for the admin and session APIs, in a ring of one-second buckets
+type activity struct {
+	mu       sync.Mutex
+	inFlight int
+
+	// Ring indexed by unix second % activityWindow
+	buckets [activityWindow]activityBucket
+}
+
+type activityBucket struct {
+	second  int64
+	start   int // in-flight commands when the second's first event happened
+	peak    int
+	started int
+	waits   int
+	waitSum time.Duration
+	waitMax time.Duration
+	failed  map[string]int // by error code; nil until a command fails
+}
+
+// bucket returns the current second's bucket; the caller holds mu
+func (a *activity) bucket(now time.Time) *activityBucket {
+	second := now.Unix()
+	b := &a.buckets[second%activityWindow]
+	if b.second != second {
+		*b = activityBucket{second: second, start: a.inFlight, peak: a.inFlight}
+	}
+	return b
+}
+
+func (a *activity) begin() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := a.bucket(time.Now())
+	a.inFlight++
+	b.started++
+	b.peak = max(b.peak, a.inFlight)
+}
+
+// end records a command's completion, and its error when it failed
+func (a *activity) end(cmdErr *models.CommandError) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := a.bucket(time.Now())
+	a.inFlight--
+	if cmdErr != nil {
+		if b.failed == nil {
+			b.failed = make(map[string]int)
+		}
+		b.failed[cmdErr.Code]++
+	}
+}
+
+// dequeued records how long a command waited in the send queue
+func (a *activity) dequeued(wait time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	b := a.bucket(time.Now())
+	b.waits++
+	b.waitSum += wait
+	b.waitMax = max(b.waitMax, wait)
+}
+
+func (a *activity) snapshot() *models.SessionActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := &models.SessionActivity{
+		InFlight: a.inFlight,
+		Samples:  make([]models.ActivitySample, activityWindow),
+	}
+
+	// Walk back from now: a quiet second kept the in-flight count the next
+	// busy second started with
+	now := time.Now().Unix()
+	level := a.inFlight
+	for i := 0; i < activityWindow; i++ {
+		second := now - int64(i)
+		s := models.ActivitySample{Time: time.Unix(second, 0).UTC(), InFlight: level}
+		if b := a.buckets[second%activityWindow]; b.second == second {
+			s.InFlight = b.peak
+			s.Started = b.started
+			if b.waits > 0 {
+				s.QueueWaitAvg = durationMs(b.waitSum / time.Duration(b.waits))
+				s.QueueWaitMax = durationMs(b.waitMax)
+			}
+			level = b.start
+		}
+		// Oldest first
+		out.Samples[activityWindow-1-i] = s
+	}
+	return out
+}
+
+// commands sums the commands started and failed within the window
+func (a *activity) commands() *models.SessionCommands {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := &models.SessionCommands{
+		InFlight: a.inFlight,
+		Window:   activityWindow,
+		Errors:   map[string]int{},
+	}
+	now := time.Now().Unix()
+	for _, b := range a.buckets {
+		if b.second <= now-activityWindow {
+			continue
+		}
+		out.Started += b.started
+		for code, n := range b.failed {
+			out.Failed += n
+			out.Errors[code] += n
+		}
+	}
+	return out
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// SessionCommands returns the in-flight commands and recent failures of a
+// token's session connected to this relay, or nil if there is none
+func (h *Hub) SessionCommands(tokenHash, sessionID string) *models.SessionCommands {
+	c := h.connectionByID(tokenHash, sessionID)
+	if c == nil {
+		return nil
+	}
+	return c.activity.commands()
+}
+
+// Activity returns the recent command concurrency and queue wait of each
+// session connected to this relay, keyed by session ID
+func (h *Hub) Activity() map[string]*models.SessionActivity {
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+
+	out := make(map[string]*models.SessionActivity)
+	for _, conns := range h.sessions {
+		for _, c := range conns {
+			out[c.Session.ID] = c.activity.snapshot()
+		}
+	}
+	return out
+}
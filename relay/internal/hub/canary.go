@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"math/rand/v2"
+	"strings"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// canaryRule picks the sessions that may run commands with new protocol
+// features: those whose extension version matches CANARY_VERSIONS (a
+// trailing * matches a prefix) or that carry a label in CANARY_LABELS
+type canaryRule struct {
+	versions []string
+	labels   []string
+	percent  int
+}
+
+func newCanaryRule(cfg *config.Config) canaryRule {
+	return canaryRule{
+		versions: splitList(cfg.CanaryVersions),
+		labels:   splitList(cfg.CanaryLabels),
+		percent:  cfg.CanaryPercent,
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// matches reports whether a session with this extension version and these
+// labels is a canary
+func (r canaryRule) matches(version string, labels []string) bool {
+	for _, v := range r.versions {
+		if prefix, ok := strings.CutSuffix(v, "*"); ok {
+			if version != "" && strings.HasPrefix(version, prefix) {
+				return true
+			}
+		} else if version == v {
+			return true
+		}
+	}
+	for _, want := range r.labels {
+		for _, l := range labels {
+			if l == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decide sets whether a command sent on c runs in canary mode. Only canary
+// sessions run canary commands: CANARY_PERCENT of them, or those the
+// client asked for with "canary".
+func (r canaryRule) decide(c *Connection, cmd *models.CommandRequest) {
+	pref := cmd.CanaryPreference
+	cmd.CanaryPreference = nil
+
+	switch {
+	case !c.Session.IsCanary():
+		cmd.Canary = false
+	case pref != nil:
+		cmd.Canary = *pref
+	default:
+		cmd.Canary = rand.IntN(100) < r.percent
+	}
+}
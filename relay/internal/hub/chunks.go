@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/protocol"
+)
+
+// maxChunks bounds how many pieces one result may be split into
+const maxChunks = 4096
+
+// chunkedKinds are the action kinds whose result "data" may arrive in
+// screenshot_chunk messages ahead of the command_response
+var chunkedKinds = map[string]bool{
+	"screenshot": true,
+}
+
+// chunkBuffer reassembles the data of one command's result
+type chunkBuffer struct {
+	parts    []string
+	received int
+	bytes    int
+	err      *models.CommandError // set once a chunk is rejected
+}
+
+// chunkBuffers holds the partial results of a connection's commands
+type chunkBuffers struct {
+	mu      sync.Mutex
+	buffers map[string]*chunkBuffer
+}
+
+// take removes and returns the buffer for a command, if any
+func (b *chunkBuffers) take(id string) *chunkBuffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := b.buffers[id]
+	delete(b.buffers, id)
+	return buf
+}
+
+// handleChunk stores one piece of a pending command's result data. Chunks
+// for unknown commands are rejected; a bad chunk fails its command when the
+// command_response arrives.
+func (c *Connection) handleChunk(chunk *models.ScreenshotChunk) {
+	c.hub.pendingMu.Lock()
+	p, ok := c.hub.pending[chunk.ID]
+	c.hub.pendingMu.Unlock()
+	if !ok || p.conn != c || !chunkedKinds[p.kind] {
+		c.rejectChunk(chunk, "No pending command accepts chunks with this id")
+		return
+	}
+
+	maxBytes := c.hub.cfg.MaxScreenshotSize*1024*1024*4/3 + 1024 // base64 plus a data URL prefix
+
+	c.chunks.mu.Lock()
+	defer c.chunks.mu.Unlock()
+
+	if c.chunks.buffers == nil {
+		c.chunks.buffers = make(map[string]*chunkBuffer)
+	}
+	buf := c.chunks.buffers[chunk.ID]
+	if buf == nil {
+		if chunk.Total > maxChunks {
+			buf = &chunkBuffer{err: &models.CommandError{Code: "INVALID_CHUNK",
+				Message: fmt.Sprintf("Result split into %d chunks; at most %d are allowed", chunk.Total, maxChunks)}}
+		} else {
+			buf = &chunkBuffer{parts: make([]string, chunk.Total)}
+		}
+		c.chunks.buffers[chunk.ID] = buf
+	}
+	if buf.err != nil {
+		return
+	}
+
+	switch {
+	case chunk.Total != len(buf.parts):
+		buf.err = &models.CommandError{Code: "INVALID_CHUNK",
+			Message: fmt.Sprintf("Chunk %d gives total %d, earlier chunks gave %d", chunk.Seq, chunk.Total, len(buf.parts))}
+	case chunk.Seq >= chunk.Total:
+		buf.err = &models.CommandError{Code: "INVALID_CHUNK",
+			Message: fmt.Sprintf("Chunk %d is out of range for %d chunks", chunk.Seq, chunk.Total)}
+	case buf.parts[chunk.Seq] != "":
+		buf.err = &models.CommandError{Code: "INVALID_CHUNK",
+			Message: fmt.Sprintf("Chunk %d was sent twice", chunk.Seq)}
+	case buf.bytes+len(chunk.Data) > maxBytes:
+		buf.err = &models.CommandError{Code: "RESPONSE_TOO_LARGE",
+			Message: fmt.Sprintf("Chunked result exceeds %d bytes (MAX_SCREENSHOT_SIZE)", maxBytes)}
+	default:
+		buf.parts[chunk.Seq] = chunk.Data
+		buf.received++
+		buf.bytes += len(chunk.Data)
+		return
+	}
+
+	// Free what was received; only the error is kept
+	buf.parts = nil
+	c.rejectChunk(chunk, buf.err.Message)
+}
+
+// rejectChunk reports a bad chunk back to the extension
+func (c *Connection) rejectChunk(chunk *models.ScreenshotChunk, message string) {
+	c.hub.stats.protocolError("screenshot_chunk", protocol.CodeInvalidChunk)
+	log.Warn().
+		Str("session_id", c.Session.ID).
+		Str("command_id", chunk.ID).
+		Int("seq", chunk.Seq).
+		Int("total", chunk.Total).
+		Msg("Rejected screenshot chunk: " + message)
+
+	c.sendMessage(models.ProtocolError{
+		Type:        "protocol_error",
+		Code:        protocol.CodeInvalidChunk,
+		Message:     message,
+		MessageType: "screenshot_chunk",
+	})
+}
+
+// assemble puts the reassembled data into a result sent without it
+func (buf *chunkBuffer) assemble(result json.RawMessage) (json.RawMessage, *models.CommandError) {
+	if buf.err != nil {
+		return nil, buf.err
+	}
+	if buf.received != len(buf.parts) {
+		return nil, &models.CommandError{Code: "INCOMPLETE_CHUNKS",
+			Message: fmt.Sprintf("Received %d of %d chunks", buf.received, len(buf.parts))}
+	}
+
+	fields := map[string]json.RawMessage{}
+	if len(result) > 0 {
+		if err := json.Unmarshal(result, &fields); err != nil {
+			return nil, &models.CommandError{Code: "INVALID_RESULT", Message: "Chunked result is not an object"}
+		}
+	}
+	data, err := json.Marshal(strings.Join(buf.parts, ""))
+	if err != nil {
+		return nil, &models.CommandError{Code: "INVALID_RESULT", Message: err.Error()}
+	}
+	fields["data"] = data
+
+	assembled, err := json.Marshal(fields)
+	if err != nil {
+		return nil, &models.CommandError{Code: "INVALID_RESULT", Message: err.Error()}
+	}
+	return assembled, nil
+}
@@ -0,0 +1,102 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// clockSamples is how many recent offset samples a connection keeps; the
+// one with the shortest round trip is trusted
+const clockSamples = 8
+
+// clockSample is one estimate of the browser's clock offset
+type clockSample struct {
+	offset time.Duration // browser clock minus relay clock
+	rtt    time.Duration
+}
+
+// clockOffset estimates how far an extension's clock is from the relay's,
+// from pongs answering the connect ack and JSON pings. Each pong echoes
+// the relay time it answers and carries the browser's time on receipt,
+// which is taken to be halfway through the round trip.
+type clockOffset struct {
+	mu      sync.Mutex
+	samples []clockSample
+	next    int
+}
+
+// observe records a pong answering a message sent at sent (relay clock)
+// that the browser received at clientTime (browser clock, unix ms)
+func (o *clockOffset) observe(sent time.Time, clientTime int64, now time.Time) {
+	rtt := now.Sub(sent)
+	if rtt < 0 || rtt > time.Minute {
+		return
+	}
+	sample := clockSample{
+		offset: time.UnixMilli(clientTime).Sub(sent.Add(rtt / 2)),
+		rtt:    rtt,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.samples) < clockSamples {
+		o.samples = append(o.samples, sample)
+		return
+	}
+	o.samples[o.next] = sample
+	o.next = (o.next + 1) % clockSamples
+}
+
+// get returns the current estimate, if there is one
+func (o *clockOffset) get() (time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.samples) == 0 {
+		return 0, false
+	}
+	best := o.samples[0]
+	for _, s := range o.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	return best.offset, true
+}
+
+// toServer converts a browser timestamp (unix ms) to relay time
+func (o *clockOffset) toServer(ms int64) int64 {
+	offset, _ := o.get()
+	return ms - offset.Milliseconds()
+}
+
+// normalize converts a command's timing to relay time. The command cannot
+// have been received before it was sent or completed after its response
+// arrived, so the result is kept within that window.
+func (o *clockOffset) normalize(t *models.CommandTiming, sent, arrived time.Time) {
+	if t == nil || t.Received <= 0 || t.Completed < t.Received {
+		return
+	}
+	lo, hi := sent.UnixMilli(), arrived.UnixMilli()
+	t.Received = min(max(o.toServer(t.Received), lo), hi)
+	t.Completed = min(max(o.toServer(t.Completed), t.Received), hi)
+}
+
+// ClockOffsets returns, by session ID, how many milliseconds each
+// extension's clock is ahead of the relay's, for sessions with an estimate
+func (h *Hub) ClockOffsets() map[string]int64 {
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+
+	out := make(map[string]int64)
+	for _, conns := range h.sessions {
+		for _, c := range conns {
+			if offset, ok := c.clock.get(); ok {
+				out[c.Session.ID] = offset.Milliseconds()
+			}
+		}
+	}
+	return out
+}
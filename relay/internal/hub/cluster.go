@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
+)
+
+// clusterLookupTimeout bounds registry lookups made while serving a request
+const clusterLookupTimeout = 2 * time.Second
+
+// Cluster shares session ownership with other relays, so a command can
+// reach an extension connected to any of them (see package cluster)
+type Cluster interface {
+	// NodeID identifies this relay
+	NodeID() string
+	// Sessions returns the token's sessions held by other relays
+	Sessions(ctx context.Context, tokenHash string) []*models.Session
+	// Forward runs cmd on a session held by another relay
+	Forward(ctx context.Context, tokenHash, sessionID string, cmd *models.CommandRequest) (*models.CommandResponse, error)
+	// Changed is called when the token's local sessions or tabs change
+	Changed(tokenHash string)
+}
+
+// SetCluster enables cluster mode. Call it before the server starts.
+func (h *Hub) SetCluster(c Cluster) {
+	h.cluster = c
+}
+
+// LocalSessions returns the sessions for a token hash connected to this
+// relay, oldest first
+func (h *Hub) LocalSessions(tokenHash string) []*models.Session {
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+
+	conns := h.sessions[tokenHash]
+	sessions := make([]*models.Session, 0, len(conns))
+	for _, c := range conns {
+		sessions = append(sessions, c.Session)
+	}
+	return sessions
+}
+
+// LocalTokens returns the token hashes with a session on this relay
+func (h *Hub) LocalTokens() []string {
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+
+	tokens := make([]string, 0, len(h.sessions))
+	for tokenHash := range h.sessions {
+		tokens = append(tokens, tokenHash)
+	}
+	return tokens
+}
+
+// SendLocal runs a command on a session of this relay only, never
+// forwarding it. It serves commands forwarded by other relays. Without a
+// session ID the command is routed by its tab as in SendCommand.
+func (h *Hub) SendLocal(ctx context.Context, tokenHash, sessionID string, cmd *models.CommandRequest) (*models.CommandResponse, error) {
+	var c *Connection
+	if sessionID != "" {
+		c = h.connectionByID(tokenHash, sessionID)
+	} else {
+		c = h.route(tokenHash, cmd.TabID)
+	}
+	if c == nil {
+		return nil, ErrNotConnected
+	}
+	return h.send(ctx, c, cmd)
+}
+
+// remoteSessions returns the token's sessions on other relays, if clustered
+func (h *Hub) remoteSessions(tokenHash string) []*models.Session {
+	if h.cluster == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterLookupTimeout)
+	defer cancel()
+	return h.cluster.Sessions(ctx, tokenHash)
+}
+
+// forward runs cmd on a remote session and decodes its result the same
+// way HandleResponse does for local ones
+func (h *Hub) forward(ctx context.Context, tokenHash, sessionID string, cmd *models.CommandRequest) (*models.CommandResponse, error) {
+	if !h.acquire() {
+		return nil, ErrShuttingDown
+	}
+	defer h.release()
+
+	ctx, span := tracing.Start(ctx, "cluster.forward", tracing.KindClient)
+	span.SetAttr("owlrelay.command.id", cmd.ID)
+	span.SetAttr("owlrelay.session_id", sessionID)
+	defer span.End()
+
+	start := time.Now()
+	resp, err := h.cluster.Forward(ctx, tokenHash, sessionID, cmd)
+	timing.FromContext(ctx).Since(timing.ClusterForward, start)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+
+	if resp.Success {
+		decoded, err := models.DecodeResult(cmd.Action.Kind, resp.Result)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("session_id", sessionID).
+				Str("command_id", cmd.ID).
+				Msg("Rejecting malformed forwarded command result")
+			resp.Success = false
+			resp.Error = &models.CommandError{Code: "INVALID_RESULT", Message: err.Error()}
+		} else {
+			resp.Decoded = decoded
+		}
+	}
+	return resp, nil
+}
+
+// changed tells the cluster the token's local sessions or tabs changed
+func (h *Hub) changed(tokenHash string) {
+	if h.cluster != nil {
+		h.cluster.Changed(tokenHash)
+	}
+}
+
+// sortSessions orders sessions oldest first
+func sortSessions(sessions []*models.Session) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+}
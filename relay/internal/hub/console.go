@@ -0,0 +1,169 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Longest console message and stack kept, in bytes; longer ones are cut
+const (
+	maxConsoleMessage = 4096
+	maxConsoleStack   = 8192
+)
+
+// consoleLevels orders console levels by severity for ?level= filtering
+var consoleLevels = map[string]int{
+	"debug": 0,
+	"log":   1,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+// ValidConsoleLevel reports whether level names a console level
+func ValidConsoleLevel(level string) bool {
+	_, ok := consoleLevels[level]
+	return ok
+}
+
+// consoleRing holds a tab's most recent console entries
+type consoleRing struct {
+	entries []models.ConsoleEntry // oldest first once full, starting at next
+	next    int
+	seq     int64 // seq of the newest entry
+}
+
+func (r *consoleRing) add(e models.ConsoleEntry, size int) {
+	r.seq++
+	e.Seq = r.seq
+	if len(r.entries) < size {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % size
+}
+
+// dropped returns how many entries have been pushed out of the ring
+func (r *consoleRing) dropped() int64 {
+	return r.seq - int64(len(r.entries))
+}
+
+// consoleBuffers holds the console entries of a connection's tabs
+type consoleBuffers struct {
+	mu    sync.Mutex
+	rings map[string]*consoleRing
+}
+
+// add buffers an entry for a tab, keeping at most size per tab
+func (b *consoleBuffers) add(tabID string, e models.ConsoleEntry, size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rings == nil {
+		b.rings = make(map[string]*consoleRing)
+	}
+	ring := b.rings[tabID]
+	if ring == nil {
+		ring = &consoleRing{}
+		b.rings[tabID] = ring
+	}
+	ring.add(e, size)
+}
+
+// forget drops the entries of tabs for which keep returns false
+func (b *consoleBuffers) forget(keep func(tabID string) bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for tabID := range b.rings {
+		if !keep(tabID) {
+			delete(b.rings, tabID)
+		}
+	}
+}
+
+// handleConsole buffers a console message from an attached tab
+func (c *Connection) handleConsole(msg *models.ConsoleMessage) {
+	size := c.hub.cfg.ConsoleBufferSize
+	if size <= 0 {
+		return
+	}
+	if _, ok := c.Session.GetTab(msg.TabID); !ok {
+		return
+	}
+
+	source := msg.Source
+	if source == "" {
+		source = "console"
+	}
+	ts := time.Now().UTC()
+	if msg.Timestamp > 0 {
+		ts = time.UnixMilli(c.clock.toServer(msg.Timestamp)).UTC()
+	}
+	c.console.add(msg.TabID, models.ConsoleEntry{
+		Level:     msg.Level,
+		Source:    source,
+		Message:   truncate(msg.Message, maxConsoleMessage),
+		URL:       msg.URL,
+		Line:      msg.Line,
+		Column:    msg.Column,
+		Stack:     truncate(msg.Stack, maxConsoleStack),
+		Timestamp: ts,
+	}, size)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+// ConsoleQuery selects buffered console entries
+type ConsoleQuery struct {
+	Level string // minimum level; "" for all
+	After int64  // only entries with a greater seq
+	Limit int    // newest entries to return; 0 for all
+}
+
+// Console returns a tab's buffered console entries, oldest first, and how
+// many were dropped from its buffer. Entries are kept by the relay the
+// extension is connected to, so a tab on another cluster node has none.
+func (h *Hub) Console(tokenHash, tabID string, q ConsoleQuery) ([]models.ConsoleEntry, int64) {
+	h.sessionsMu.RLock()
+	var owner *Connection
+	for _, c := range h.sessions[tokenHash] {
+		if _, ok := c.Session.GetTab(tabID); ok {
+			owner = c
+			break
+		}
+	}
+	h.sessionsMu.RUnlock()
+
+	entries := []models.ConsoleEntry{}
+	if owner == nil {
+		return entries, 0
+	}
+
+	owner.console.mu.Lock()
+	defer owner.console.mu.Unlock()
+
+	ring := owner.console.rings[tabID]
+	if ring == nil {
+		return entries, 0
+	}
+	minLevel := consoleLevels[q.Level]
+	for i := range ring.entries {
+		e := ring.entries[(ring.next+i)%len(ring.entries)]
+		if e.Seq > q.After && consoleLevels[e.Level] >= minLevel {
+			entries = append(entries, e)
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return entries, ring.dropped()
+}
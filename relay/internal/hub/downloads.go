@@ -0,0 +1,100 @@
+package hub
+
+import (
+	"encoding/base64"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/downloads"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/protocol"
+)
+
+// SetDownloads enables download collection: sessions are asked to report
+// downloads, which are kept in s. Call it before the server starts.
+func (h *Hub) SetDownloads(s *downloads.Store) {
+	h.downloads = s
+}
+
+// downloadWriters holds the downloads a connection is still streaming
+type downloadWriters struct {
+	mu      sync.Mutex
+	writers map[string]*downloads.Writer // by the extension's download ID
+}
+
+// handleDownload records a download reported by the extension
+func (c *Connection) handleDownload(msg *models.DownloadMessage) {
+	if c.hub.downloads == nil {
+		return
+	}
+	if _, ok := c.Session.GetTab(msg.TabID); !ok {
+		return
+	}
+
+	w := c.hub.downloads.Begin(c.Session.TokenHash, msg)
+	log.Debug().Str("tab_id", msg.TabID).Str("filename", msg.Filename).Int64("size", msg.Size).Msg("Download reported")
+	if w == nil {
+		return
+	}
+
+	c.downloads.mu.Lock()
+	defer c.downloads.mu.Unlock()
+	if c.downloads.writers == nil {
+		c.downloads.writers = make(map[string]*downloads.Writer)
+	}
+	if old := c.downloads.writers[msg.ID]; old != nil {
+		old.Abort("Download was reported again before its content arrived")
+	}
+	c.downloads.writers[msg.ID] = w
+}
+
+// handleDownloadChunk writes a piece of a download's content
+func (c *Connection) handleDownloadChunk(chunk *models.DownloadChunk) {
+	c.downloads.mu.Lock()
+	defer c.downloads.mu.Unlock()
+
+	w := c.downloads.writers[chunk.ID]
+	if w == nil {
+		c.rejectDownloadChunk("No download is receiving content with this id")
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(chunk.Data)
+	if err != nil {
+		w.Abort("Content is not valid base64")
+		delete(c.downloads.writers, chunk.ID)
+		c.rejectDownloadChunk("data is not valid base64")
+		return
+	}
+	done, err := w.Write(chunk.Seq, data)
+	if err != nil {
+		c.rejectDownloadChunk(err.Error())
+	}
+	if done || err != nil {
+		delete(c.downloads.writers, chunk.ID)
+	}
+}
+
+// abortDownloads fails the downloads still streaming when the connection
+// closes
+func (c *Connection) abortDownloads() {
+	c.downloads.mu.Lock()
+	defer c.downloads.mu.Unlock()
+	for id, w := range c.downloads.writers {
+		w.Abort("Extension disconnected before the content arrived")
+		delete(c.downloads.writers, id)
+	}
+}
+
+// rejectDownloadChunk reports a bad chunk back to the extension
+func (c *Connection) rejectDownloadChunk(message string) {
+	c.hub.stats.protocolError("download_chunk", protocol.CodeInvalidChunk)
+	log.Warn().Str("session_id", c.Session.ID).Msg("Rejected download chunk: " + message)
+
+	c.sendMessage(models.ProtocolError{
+		Type:        "protocol_error",
+		Code:        protocol.CodeInvalidChunk,
+		Message:     message,
+		MessageType: "download_chunk",
+	})
+}
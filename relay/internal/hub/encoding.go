@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/protocol"
+)
+
+// Connections start out exchanging JSON text frames. An extension that
+// lists "binary" among its encodings in the connect message is switched to
+// binary frames (see protocol.EncodingBinary) when WS_BINARY_FRAMES allows:
+// the connect_accepted answer is the last text frame the relay writes, and
+// the extension may send binary frames once it has read it.
+
+// negotiateEncoding picks the frame encoding for an extension's connect
+// message
+func (c *Connection) negotiateEncoding(hello *models.ExtensionConnect) string {
+	if !c.hub.cfg.WSBinaryFrames {
+		return protocol.EncodingJSON
+	}
+	for _, encoding := range hello.Encodings {
+		if encoding == protocol.EncodingBinary {
+			return protocol.EncodingBinary
+		}
+	}
+	return protocol.EncodingJSON
+}
+
+// accept answers a handshake with the negotiated version and encoding, and
+// has the write pump switch encodings once the answer is written
+func (c *Connection) accept(version int, encoding string) {
+	c.binaryIn = encoding == protocol.EncodingBinary
+	data, err := json.Marshal(models.ConnectAccepted{
+		Type:            "connect_accepted",
+		ProtocolVersion: version,
+		Encoding:        encoding,
+	})
+	if err != nil {
+		return
+	}
+	// Unlike other replies this is not dropped on a full queue, since later
+	// frames would be in an encoding the extension was never told about
+	select {
+	case c.lanes[laneNormal] <- outbound{data: data, encoding: encoding}:
+	case <-c.done:
+	}
+}
+
+// write sends a queued message and applies any encoding switch it carries;
+// only the write pump calls it
+func (c *Connection) write(message outbound) error {
+	if err := c.writeData(message.data); err != nil {
+		return err
+	}
+	if message.encoding != "" {
+		c.binaryOut = message.encoding == protocol.EncodingBinary
+	}
+	return nil
+}
+
+// writeData sends one JSON message in the connection's current encoding,
+// compressed when permessage-deflate was negotiated and the message is
+// large enough to benefit
+func (c *Connection) writeData(data []byte) error {
+	c.Conn.EnableWriteCompression(len(data) >= c.hub.cfg.WSCompressionThreshold)
+	if c.binaryOut {
+		return c.Conn.WriteMessage(websocket.BinaryMessage, protocol.EncodeFrame(data))
+	}
+	return c.Conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// decode returns the JSON message of an inbound frame. Binary frames are
+// refused unless the handshake switched the connection to them.
+func (c *Connection) decode(messageType int, data []byte) ([]byte, *protocol.Violation) {
+	if messageType != websocket.BinaryMessage {
+		return data, nil
+	}
+	if !c.binaryIn {
+		return nil, &protocol.Violation{Code: protocol.CodeMalformed,
+			Details: []string{"binary frame before binary encoding was negotiated"}}
+	}
+	return protocol.DecodeFrame(data)
+}
@@ -0,0 +1,107 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+// seenInterval is how often a connected session's last-seen time is
+// stored, which bounds the uptime lost when the relay stops uncleanly
+const seenInterval = time.Minute
+
+// disconnect is why a connection ended
+type disconnect struct {
+	reason string
+	code   int // the extension's close code, if it sent one
+}
+
+// SetSessionHistory has sessions recorded in s as they connect and
+// disconnect, after ending those this relay left open when it last
+// stopped. Call it before the server starts.
+func (h *Hub) SetSessionHistory(s *store.SessionStore) {
+	h.history = s
+
+	var node string
+	if h.cluster != nil {
+		node = h.cluster.NodeID()
+	}
+	if n, err := s.CloseStale(node); err != nil {
+		log.Error().Err(err).Msg("Failed to close stale sessions")
+	} else if n > 0 {
+		log.Info().Int64("sessions", n).Msg("Closed sessions left open by the last run")
+	}
+}
+
+// disconnected records why the connection is ending; the first reason
+// given is kept
+func (c *Connection) disconnected(reason string, code int) {
+	c.ended.CompareAndSwap(nil, &disconnect{reason: reason, code: code})
+}
+
+// readError records why reading from the connection failed
+func (c *Connection) readError(err error) {
+	var closeErr *websocket.CloseError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		c.disconnected(models.DisconnectTooLarge, 0)
+	case errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure:
+		c.disconnected(models.DisconnectClosed, closeErr.Code)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.disconnected(models.DisconnectPingTimeout, 0)
+	default:
+		c.disconnected(models.DisconnectLost, 0)
+	}
+}
+
+func (h *Hub) recordConnected(s *models.Session) {
+	if h.history == nil {
+		return
+	}
+	if err := h.history.Open(s); err != nil {
+		log.Error().Err(err).Str("session_id", s.ID).Msg("Failed to record session")
+	}
+}
+
+func (h *Hub) recordIdentified(s *models.Session) {
+	if h.history == nil {
+		return
+	}
+	if err := h.history.Identify(s); err != nil {
+		log.Error().Err(err).Str("session_id", s.ID).Msg("Failed to record session")
+	}
+}
+
+// recordSeen stores that the session is still connected, at most once
+// per seenInterval; only the read pump calls it
+func (c *Connection) recordSeen(now time.Time) {
+	if c.hub.history == nil || now.Sub(c.lastSeen) < seenInterval {
+		return
+	}
+	c.lastSeen = now
+	if err := c.hub.history.Seen(c.Session.ID, now); err != nil {
+		log.Error().Err(err).Str("session_id", c.Session.ID).Msg("Failed to record session")
+	}
+}
+
+// recordDisconnected ends the session in the history; later calls do
+// nothing
+func (h *Hub) recordDisconnected(c *Connection) {
+	if h.history == nil {
+		return
+	}
+	d := c.ended.Load()
+	if d == nil {
+		d = &disconnect{reason: models.DisconnectUnknownReason}
+	}
+	if err := h.history.Close(c.Session.ID, d.reason, d.code, time.Now()); err != nil {
+		log.Error().Err(err).Str("session_id", c.Session.ID).Msg("Failed to record session")
+	}
+}
@@ -2,51 +2,150 @@
 package hub
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 
+	"github.com/emreylmaz/owlrelay/relay/internal/accesslog"
 	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/downloads"
 	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/protocol"
+	"github.com/emreylmaz/owlrelay/relay/internal/scripts"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
+	"github.com/emreylmaz/owlrelay/relay/internal/webhooks"
+	"github.com/emreylmaz/owlrelay/relay/internal/workers"
 )
 
+// wsHardLimitFactor times WS_MAX_MESSAGE_SIZE is the largest message the
+// relay drains and rejects without closing the connection
+const wsHardLimitFactor = 4
+
 // Hub manages all WebSocket connections
 type Hub struct {
 	cfg *config.Config
 
-	// Connections indexed by token hash
-	sessions   map[string]*Connection
+	// Connections indexed by token hash, oldest first
+	sessions   map[string][]*Connection
 	sessionsMu sync.RWMutex
 
 	// Pending commands waiting for response
-	pending   map[string]chan *models.CommandResponse
-	pendingMu sync.RWMutex
+	pending   map[string]*pendingCommand
+	pendingMu sync.Mutex
+
+	// Sequence number assigned to each outgoing command
+	seq atomic.Uint64
+
+	// In-flight command tracking for graceful shutdown
+	inflightMu sync.Mutex
+	inflight   int
+	draining   bool
+	drained    chan struct{} // closed when inflight reaches zero while draining
+
+	// Command outcome counters for the admin API
+	stats commandStats
+
+	// Other relays sharing sessions; nil unless clustered
+	cluster Cluster
 
 	// Server version for handshake
 	version string
+
+	// Which sessions run commands in canary mode
+	canary canaryRule
+
+	// Where reported downloads are kept; nil when not collected
+	downloads *downloads.Store
+
+	// Command recordings of tabs; nil when not set
+	scripts *scripts.Recorder
+
+	// Where connection and command failure events go; nil when not set
+	webhooks *webhooks.Notifier
+
+	// Session history; nil when not set
+	history *store.SessionStore
+
+	// Tab list changes for GET /api/v1/tabs?since=
+	tabLogs tabLogs
+
+	// Clients streaming page events, by token; see pageevents.go
+	pageEvents pageEventSubs
+
+	// Per-token slots for sending commands, so one token's large uploads
+	// do not hold up other tokens' commands
+	dispatch *workers.Pools
+
+	// Per-token cap on commands awaiting a response, with their queue
+	commandLimits *inflightLimits
+}
+
+// pendingCommand tracks a command awaiting its response
+type pendingCommand struct {
+	seq  uint64
+	kind string      // action kind, selects the result schema
+	conn *Connection // connection the command was sent on
+	resp chan *models.CommandResponse
 }
 
 // Connection represents a WebSocket connection from an extension
 type Connection struct {
-	Session *models.Session
-	Conn    *websocket.Conn
-	Send    chan []byte
-	hub     *Hub
-	done    chan struct{}
+	Session   *models.Session
+	Conn      *websocket.Conn
+	lanes     [laneCount]chan outbound // by priority; see lanes.go
+	hub       *Hub
+	done      chan struct{}
+	closeOnce sync.Once
+	limiter   *inboundLimiter
+	activity  activity
+	chunks    chunkBuffers
+	console   consoleBuffers
+	clock     clockOffset
+	downloads downloadWriters
+
+	// Final message written by the write pump before it closes the socket
+	finalMsg chan finalMessage
+
+	// Why the connection ended, for the session history; see history.go
+	ended    atomic.Pointer[disconnect]
+	lastSeen time.Time
+
+	// Whether frames are binary rather than JSON text, per direction; each
+	// is touched only by its pump. See encoding.go.
+	binaryIn  bool
+	binaryOut bool
+
+	// Waiters notified when the next tab sync arrives
+	syncWaiters   []chan struct{}
+	syncWaitersMu sync.Mutex
 }
 
 // New creates a new Hub
 func New(cfg *config.Config, version string) *Hub {
 	return &Hub{
 		cfg:      cfg,
-		sessions: make(map[string]*Connection),
-		pending:  make(map[string]chan *models.CommandResponse),
+		sessions: make(map[string][]*Connection),
+		pending:  make(map[string]*pendingCommand),
 		version:  version,
+		canary:   newCanaryRule(cfg),
+		dispatch: workers.New(cfg.TokenDispatchWorkers),
+
+		commandLimits: newInflightLimits(cfg.TokenMaxInflight, cfg.TokenQueueDepth,
+			time.Duration(cfg.TokenQueueTimeout)*time.Millisecond),
 	}
 }
 
@@ -60,23 +159,41 @@ func (h *Hub) Register(conn *websocket.Conn, tokenHash, tokenName string) *Conne
 		ConnectedAt: time.Now().UTC(),
 		LastPingAt:  time.Now().UTC(),
 	}
+	if h.cluster != nil {
+		session.Node = h.cluster.NodeID()
+	}
 
 	c := &Connection{
 		Session: session,
 		Conn:    conn,
-		Send:    make(chan []byte, 256),
 		hub:     h,
 		done:    make(chan struct{}),
+		limiter: newInboundLimiter(h.cfg.WSMaxMessagesPerSec, h.cfg.WSMaxBytesPerSec),
+
+		finalMsg: make(chan finalMessage, 1),
+		lastSeen: session.ConnectedAt,
+	}
+	for i := range c.lanes {
+		c.lanes[i] = make(chan outbound, 256)
+	}
+
+	maxSessions := h.cfg.MaxSessionsPerToken
+	if maxSessions <= 0 {
+		maxSessions = 1
 	}
 
 	h.sessionsMu.Lock()
-	// Close existing connection for this token if any
-	if existing, ok := h.sessions[tokenHash]; ok {
-		close(existing.done)
-		existing.Conn.Close()
+	conns := append(h.sessions[tokenHash], c)
+	// Close the oldest connections for this token beyond the limit
+	for len(conns) > maxSessions {
+		conns[0].disconnected(models.DisconnectReplaced, 0)
+		conns[0].close()
+		conns = conns[1:]
 	}
-	h.sessions[tokenHash] = c
+	h.sessions[tokenHash] = conns
 	h.sessionsMu.Unlock()
+	h.changed(tokenHash)
+	h.recordConnected(session)
 
 	log.Info().
 		Str("session_id", session.ID).
@@ -85,13 +202,21 @@ func (h *Hub) Register(conn *websocket.Conn, tokenHash, tokenName string) *Conne
 
 	// Send connect ack
 	ack := models.ConnectAck{
-		Type:          "connect_ack",
-		SessionID:     session.ID,
-		ServerTime:    time.Now().UnixMilli(),
-		ServerVersion: h.version,
+		Type:               "connect_ack",
+		SessionID:          session.ID,
+		ServerTime:         time.Now().UnixMilli(),
+		ServerVersion:      h.version,
+		ProtocolVersion:    protocol.Version,
+		MinProtocolVersion: h.cfg.WSMinProtocolVersion,
 	}
 	if data, err := json.Marshal(ack); err == nil {
-		c.Send <- data
+		c.lanes[laneNormal] <- outbound{data: data}
+	}
+	if events := h.subscriptions(tokenHash); len(events) > 0 {
+		sub := models.Subscribe{Type: "subscribe", Events: events}
+		if data, err := json.Marshal(sub); err == nil {
+			c.lanes[laneNormal] <- outbound{data: data}
+		}
 	}
 
 	return c
@@ -100,201 +225,942 @@ func (h *Hub) Register(conn *websocket.Conn, tokenHash, tokenName string) *Conne
 // Unregister removes a connection
 func (h *Hub) Unregister(c *Connection) {
 	h.sessionsMu.Lock()
-	if existing, ok := h.sessions[c.Session.TokenHash]; ok && existing == c {
+	conns := h.sessions[c.Session.TokenHash]
+	for i, existing := range conns {
+		if existing == c {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
 		delete(h.sessions, c.Session.TokenHash)
+	} else {
+		h.sessions[c.Session.TokenHash] = conns
 	}
 	h.sessionsMu.Unlock()
+	h.changed(c.Session.TokenHash)
 
-	close(c.done)
-	c.Conn.Close()
+	c.close()
+	c.abortDownloads()
+	h.recordDisconnected(c)
 
 	log.Info().
 		Str("session_id", c.Session.ID).
 		Str("token_name", c.Session.TokenName).
 		Msg("Extension disconnected")
+	h.notifySession(models.WebhookExtensionDisconnected, c.Session)
 }
 
-// GetSession returns the session for a token hash
+// close shuts down the connection; safe to call more than once
+func (c *Connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+}
+
+// GetSession returns the most recently connected session for a token hash
 func (h *Hub) GetSession(tokenHash string) *models.Session {
+	if c := h.GetConnection(tokenHash); c != nil {
+		return c.Session
+	}
+	return nil
+}
+
+// GetSessions returns all sessions for a token hash, oldest first. In
+// cluster mode this includes sessions held by other relays.
+func (h *Hub) GetSessions(tokenHash string) []*models.Session {
+	sessions := h.LocalSessions(tokenHash)
+	if remote := h.remoteSessions(tokenHash); len(remote) > 0 {
+		sessions = append(sessions, remote...)
+		sortSessions(sessions)
+	}
+	return sessions
+}
+
+// AllSessions returns every session connected to this relay across all tokens
+func (h *Hub) AllSessions() []*models.Session {
 	h.sessionsMu.RLock()
 	defer h.sessionsMu.RUnlock()
 
-	if c, ok := h.sessions[tokenHash]; ok {
-		return c.Session
+	var sessions []*models.Session
+	for _, conns := range h.sessions {
+		for _, c := range conns {
+			sessions = append(sessions, c.Session)
+		}
 	}
-	return nil
+	return sessions
+}
+
+// Stats returns command throughput and recent errors
+func (h *Hub) Stats() models.CommandStats {
+	return h.stats.snapshot()
+}
+
+// DispatchWorkers returns usage of the per-token dispatch workers
+func (h *Hub) DispatchWorkers() workers.Stats {
+	return h.dispatch.Stats()
 }
 
-// GetConnection returns the connection for a token hash
+// GetConnection returns the most recently connected connection for a token hash
 func (h *Hub) GetConnection(tokenHash string) *Connection {
 	h.sessionsMu.RLock()
 	defer h.sessionsMu.RUnlock()
-	return h.sessions[tokenHash]
+
+	conns := h.sessions[tokenHash]
+	if len(conns) == 0 {
+		return nil
+	}
+	return conns[len(conns)-1]
 }
 
-// SendCommand sends a command to the extension and waits for response
-func (h *Hub) SendCommand(ctx context.Context, tokenHash string, cmd *models.CommandRequest) (*models.CommandResponse, error) {
+// route picks the connection owning tabID, falling back to the newest one
+func (h *Hub) route(tokenHash, tabID string) *Connection {
+	if c := h.routeTab(tokenHash, tabID); c != nil {
+		return c
+	}
+	return h.GetConnection(tokenHash)
+}
+
+// routeTab returns the local connection owning tabID, if any
+func (h *Hub) routeTab(tokenHash, tabID string) *Connection {
+	if tabID == "" {
+		return nil
+	}
+
 	h.sessionsMu.RLock()
-	c, ok := h.sessions[tokenHash]
+	defer h.sessionsMu.RUnlock()
+
+	for _, c := range h.sessions[tokenHash] {
+		if c.Session.HasTab(tabID) {
+			return c
+		}
+	}
+	return nil
+}
+
+// FindTab returns a tab attached to any session of the token, on any relay
+func (h *Hub) FindTab(tokenHash, tabID string) (models.Tab, bool) {
+	h.sessionsMu.RLock()
+	for _, c := range h.sessions[tokenHash] {
+		if tab, ok := c.Session.GetTab(tabID); ok {
+			h.sessionsMu.RUnlock()
+			return tab, true
+		}
+	}
 	h.sessionsMu.RUnlock()
 
-	if !ok || c == nil {
-		return nil, ErrNotConnected
+	for _, s := range h.remoteSessions(tokenHash) {
+		if tab, ok := s.GetTab(tabID); ok {
+			return tab, true
+		}
+	}
+	return models.Tab{}, false
+}
+
+// connectionByID returns the connection with the given session ID
+func (h *Hub) connectionByID(tokenHash, sessionID string) *Connection {
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+
+	for _, c := range h.sessions[tokenHash] {
+		if c.Session.ID == sessionID {
+			return c
+		}
+	}
+	return nil
+}
+
+// SendCommand sends a command to the extension owning the command's tab and
+// waits for response. Without an owner it goes to the newest local session,
+// and in cluster mode then to the newest session on another relay.
+func (h *Hub) SendCommand(ctx context.Context, tokenHash string, cmd *models.CommandRequest) (resp *models.CommandResponse, err error) {
+	defer func() { logCommand(ctx, cmd, resp, err) }()
+	if c := h.routeTab(tokenHash, cmd.TabID); c != nil {
+		return h.send(ctx, c, cmd)
+	}
+
+	var remote []*models.Session
+	if h.cluster != nil {
+		remote = h.remoteSessions(tokenHash)
+		if cmd.TabID != "" {
+			for _, s := range remote {
+				if s.HasTab(cmd.TabID) {
+					return h.forward(ctx, tokenHash, s.ID, cmd)
+				}
+			}
+		}
 	}
 
+	if c := h.GetConnection(tokenHash); c != nil {
+		return h.send(ctx, c, cmd)
+	}
+	if len(remote) > 0 {
+		return h.forward(ctx, tokenHash, remote[len(remote)-1].ID, cmd)
+	}
+	return nil, ErrNotConnected
+}
+
+// SendCommandToSession sends a command to a specific session, on any relay,
+// and waits for response
+func (h *Hub) SendCommandToSession(ctx context.Context, tokenHash, sessionID string, cmd *models.CommandRequest) (resp *models.CommandResponse, err error) {
+	defer func() { logCommand(ctx, cmd, resp, err) }()
+	if c := h.connectionByID(tokenHash, sessionID); c != nil {
+		return h.send(ctx, c, cmd)
+	}
+	for _, s := range h.remoteSessions(tokenHash) {
+		if s.ID == sessionID {
+			return h.forward(ctx, tokenHash, sessionID, cmd)
+		}
+	}
+	return nil, ErrNotConnected
+}
+
+// commandError describes how a command failed, or returns nil if it
+// succeeded
+func commandError(resp *models.CommandResponse, err error) *models.CommandError {
+	switch {
+	case err != nil:
+		cmdErr := &models.CommandError{Code: "INTERNAL_ERROR", Message: err.Error()}
+		if hubErr, ok := err.(*HubError); ok {
+			cmdErr.Code = hubErr.Code
+		}
+		return cmdErr
+	case !resp.Success:
+		if resp.Error == nil {
+			return &models.CommandError{Code: "COMMAND_FAILED", Message: "Command failed"}
+		}
+		return resp.Error
+	}
+	return nil
+}
+
+// logCommand adds a command to the request's access log line
+func logCommand(ctx context.Context, cmd *models.CommandRequest, resp *models.CommandResponse, err error) {
+	entry := accesslog.FromContext(ctx)
+	if entry == nil {
+		return
+	}
+	result := "OK"
+	if cmdErr := commandError(resp, err); cmdErr != nil {
+		result = cmdErr.Code
+	}
+	entry.Command(cmd.ID, cmd.Action.Kind, cmd.TabID, result)
+}
+
+func (h *Hub) send(ctx context.Context, c *Connection, cmd *models.CommandRequest) (resp *models.CommandResponse, err error) {
+	ctx, span := tracing.Start(ctx, "command "+cmd.Action.Kind, tracing.KindInternal)
+	defer func() { endCommandSpan(span, resp, err) }()
+	span.SetAttr("owlrelay.command.id", cmd.ID)
+	span.SetAttr("owlrelay.command.kind", cmd.Action.Kind)
+	span.SetAttr("owlrelay.tab_id", cmd.TabID)
+	span.SetAttr("owlrelay.session_id", c.Session.ID)
+	if !c.Session.SupportsAction(cmd.Action.Kind) {
+		return nil, unsupportedAction(cmd.Action.Kind)
+	}
+	// The extension echoes it back, and may continue the trace
+	cmd.TraceParent = span.TraceParent()
+	_, dispatchSpan := tracing.Start(ctx, "hub.dispatch", tracing.KindInternal)
+	defer dispatchSpan.End()
+
+	// Held until the response arrives; queued commands do not count as in
+	// flight, so a drain does not wait for them
+	queueStart := time.Now()
+	freeSlot, err := h.commandLimits.acquire(ctx, c.Session.TokenHash, laneFor(cmd.Priority))
+	dispatchSpan.SetAttr("owlrelay.queue_ms", time.Since(queueStart).Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer freeSlot()
+
+	if !h.acquire() {
+		return nil, ErrShuttingDown
+	}
+	defer h.release()
+
+	start := time.Now()
+	h.stats.begin()
+	c.activity.begin()
+	defer func() { c.activity.end(commandError(resp, err)) }()
+	defer func() {
+		cmdErr := commandError(resp, err)
+		if cmdErr == nil && h.scripts != nil {
+			h.scripts.Observe(c.Session.TokenHash, cmd)
+		}
+		elapsed := time.Since(start)
+		h.stats.end(c, cmd, cmdErr, elapsed)
+		if cmdErr != nil && h.webhooks != nil {
+			h.webhooks.Notify(models.WebhookCommandFailed, models.WebhookCommand{
+				SessionID: c.Session.ID,
+				TokenName: c.Session.TokenName,
+				CommandID: cmd.ID,
+				TabID:     cmd.TabID,
+				Kind:      cmd.Action.Kind,
+				Error:     cmdErr,
+				Elapsed:   elapsed.Milliseconds(),
+			})
+		}
+	}()
+
 	// Create response channel
+	cmd.Seq = h.seq.Add(1)
 	respChan := make(chan *models.CommandResponse, 1)
 	h.pendingMu.Lock()
-	h.pending[cmd.ID] = respChan
+	if _, exists := h.pending[cmd.ID]; exists {
+		h.pendingMu.Unlock()
+		return nil, ErrDuplicateID
+	}
+	h.pending[cmd.ID] = &pendingCommand{seq: cmd.Seq, kind: cmd.Action.Kind, conn: c, resp: respChan}
 	h.pendingMu.Unlock()
 
 	defer func() {
 		h.pendingMu.Lock()
 		delete(h.pending, cmd.ID)
 		h.pendingMu.Unlock()
+		c.chunks.take(cmd.ID)
 	}()
 
-	// Send command
+	// Send command, on one of the token's dispatch workers until it is
+	// queued on the socket
+	freeWorker, err := h.dispatch.Acquire(ctx, c.Session.TokenHash)
+	if err != nil {
+		return nil, err
+	}
+	defer freeWorker()
+
+	h.canary.decide(c, cmd)
+	uploads := cmd.Uploads
+	cmd.Uploads = nil
 	data, err := json.Marshal(cmd)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.streamUploads(ctx, cmd.ID, c.lane(cmd.Priority), uploads); err != nil {
+		return nil, err
+	}
+
+	// With ?debugTiming=1, split the wait at the moment the command hits
+	// the socket
+	rec := timing.FromContext(ctx)
+	var written chan time.Time
+	if rec != nil || span != nil {
+		written = make(chan time.Time, 1)
+	}
+	queued := time.Now()
 
 	select {
-	case c.Send <- data:
+	case c.lane(cmd.Priority) <- outbound{data: data, queued: queued, written: written}:
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case <-c.done:
 		return nil, ErrNotConnected
 	}
+	freeWorker()
+
+	// When the write pump put the command on the socket; zero until known
+	var writtenAt time.Time
+	wroteAt := func() time.Time {
+		if writtenAt.IsZero() && written != nil {
+			select {
+			case writtenAt = <-written:
+			default:
+			}
+		}
+		return writtenAt
+	}
+	defer func() { traceExtension(ctx, dispatchSpan, queued, wroteAt(), resp, err) }()
 
 	// Wait for response
 	timeout := time.Duration(cmd.Timeout) * time.Millisecond
 	if timeout == 0 {
-		timeout = time.Duration(h.cfg.CommandTimeout) * time.Millisecond
+		timeout = time.Duration(h.cfg.DefaultCommandTimeout()) * time.Millisecond
 	}
 
 	select {
 	case resp := <-respChan:
+		c.clock.normalize(resp.Timing, queued, time.Now())
+		resp.Canary = cmd.Canary
+		if rec != nil {
+			recordTiming(rec, queued, wroteAt(), resp)
+		}
 		return resp, nil
 	case <-time.After(timeout):
 		return nil, ErrTimeout
 	case <-ctx.Done():
+		// The caller gave up early; let the extension stop working on it
+		if errors.Is(ctx.Err(), context.Canceled) {
+			c.sendMessage(models.CommandCancel{Type: "command_cancel", ID: cmd.ID, Reason: "client disconnected"})
+		}
 		return nil, ctx.Err()
 	case <-c.done:
 		return nil, ErrNotConnected
 	}
 }
 
-// HandleResponse handles a command response from the extension
-func (h *Hub) HandleResponse(resp *models.CommandResponse) {
-	h.pendingMu.RLock()
-	ch, ok := h.pending[resp.ID]
-	h.pendingMu.RUnlock()
+// recordTiming splits a command's round trip into hub dispatch, the time
+// the relay spent getting it onto the socket, and the extension's share.
+// written is zero if the write time is unknown.
+func recordTiming(rec *timing.Recorder, queued, written time.Time, resp *models.CommandResponse) {
+	if !written.IsZero() {
+		rec.Add(timing.HubDispatch, written.Sub(queued))
+		rec.Since(timing.Extension, written)
+	} else {
+		rec.Since(timing.HubDispatch, queued)
+	}
+	if t := resp.Timing; t != nil && t.Completed >= t.Received && t.Received > 0 {
+		rec.Add(timing.ExtensionExecution, time.Duration(t.Completed-t.Received)*time.Millisecond)
+	}
+}
+
+// acquire registers an in-flight command; it fails once draining has begun
+func (h *Hub) acquire() bool {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+
+	if h.draining {
+		return false
+	}
+	h.inflight++
+	return true
+}
+
+func (h *Hub) release() {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+
+	h.inflight--
+	if h.inflight == 0 && h.drained != nil {
+		close(h.drained)
+		h.drained = nil
+	}
+}
+
+// Draining reports whether the hub has stopped accepting commands
+func (h *Hub) Draining() bool {
+	h.inflightMu.Lock()
+	defer h.inflightMu.Unlock()
+	return h.draining
+}
+
+// Drain stops accepting new commands and waits for in-flight ones to finish
+// or for ctx to end. Extensions stay connected so pending responses arrive.
+func (h *Hub) Drain(ctx context.Context) {
+	h.inflightMu.Lock()
+	h.draining = true
+	inflight := h.inflight
+	var drained chan struct{}
+	if inflight > 0 {
+		drained = make(chan struct{})
+		h.drained = drained
+	}
+	h.inflightMu.Unlock()
+
+	if drained == nil {
+		return
+	}
+
+	log.Info().Int("inflight", inflight).Msg("Draining in-flight commands")
+	select {
+	case <-drained:
+		log.Info().Msg("All in-flight commands completed")
+	case <-ctx.Done():
+		h.inflightMu.Lock()
+		remaining := h.inflight
+		h.inflightMu.Unlock()
+		log.Warn().Int("inflight", remaining).Msg("Drain timeout reached; abandoning in-flight commands")
+	}
+}
+
+// Shutdown tells every extension the server is going away and closes
+// their connections, waiting up to the write timeout for each to flush
+func (h *Hub) Shutdown(reason string) {
+	h.sessionsMu.RLock()
+	var conns []*Connection
+	for _, cs := range h.sessions {
+		conns = append(conns, cs...)
+	}
+	h.sessionsMu.RUnlock()
 
-	if ok {
+	data, _ := json.Marshal(models.ServerShutdown{Type: "server_shutdown", Reason: reason})
+	for _, c := range conns {
+		c.disconnected(models.DisconnectShutdown, 0)
+		c.closeWith(finalMessage{data: data, code: websocket.CloseGoingAway, reason: "server shutdown"})
+	}
+
+	timeout := time.After(time.Duration(h.cfg.WSWriteTimeout) * time.Second)
+	for _, c := range conns {
 		select {
-		case ch <- resp:
-		default:
+		case <-c.done:
+		case <-timeout:
+			c.close()
 		}
+		// Before the database closes, which may be before the read pump
+		// unregisters the connection
+		h.recordDisconnected(c)
 	}
+
+	log.Info().Int("sessions", len(conns)).Msg("Closed extension connections")
+}
+
+// HandleResponse handles a command response received on connection c.
+// Each response is delivered at most once; duplicates, responses for
+// commands that were not sent on c, and responses whose sequence number
+// does not match the pending command are dropped.
+func (h *Hub) HandleResponse(c *Connection, resp *models.CommandResponse) {
+	// Only extensions that predate protocol version 2 may leave out seq
+	if resp.Seq == 0 && c.Session.ProtocolVersion() >= 2 {
+		c.rejectMessage(&protocol.Violation{
+			Code:    protocol.CodeInvalid,
+			Type:    "command_response",
+			Details: []string{"/seq: required from extensions speaking protocol version 2"},
+		})
+		return
+	}
+
+	h.pendingMu.Lock()
+	p, ok := h.pending[resp.ID]
+	if !ok {
+		h.pendingMu.Unlock()
+		log.Warn().
+			Str("session_id", c.Session.ID).
+			Str("command_id", resp.ID).
+			Uint64("seq", resp.Seq).
+			Msg("Dropping response for unknown or already completed command")
+		return
+	}
+
+	// Only the connection a command was sent on may answer it
+	if p.conn != c {
+		h.pendingMu.Unlock()
+		log.Warn().
+			Str("session_id", c.Session.ID).
+			Str("owner_session_id", p.conn.Session.ID).
+			Str("command_id", resp.ID).
+			Msg("Dropping cross-session command response")
+		return
+	}
+
+	// Extensions that predate sequence numbers send seq 0
+	if resp.Seq != 0 && resp.Seq != p.seq {
+		h.pendingMu.Unlock()
+		log.Warn().
+			Str("session_id", c.Session.ID).
+			Str("command_id", resp.ID).
+			Uint64("seq", resp.Seq).
+			Uint64("expected_seq", p.seq).
+			Msg("Dropping stale command response")
+		return
+	}
+
+	delete(h.pending, resp.ID)
+	h.pendingMu.Unlock()
+
+	// Data sent ahead in screenshot_chunk messages completes the result
+	if buf := c.chunks.take(resp.ID); buf != nil && resp.Success {
+		if result, cmdErr := buf.assemble(resp.Result); cmdErr != nil {
+			resp.Success = false
+			resp.Error = cmdErr
+		} else {
+			resp.Result = result
+		}
+	}
+
+	// Results that do not match their kind's schema fail the command
+	if resp.Success {
+		decoded, err := models.DecodeResult(p.kind, resp.Result)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("session_id", c.Session.ID).
+				Str("command_id", resp.ID).
+				Msg("Rejecting malformed command result")
+			resp.Success = false
+			resp.Error = &models.CommandError{Code: "INVALID_RESULT", Message: err.Error()}
+		} else {
+			resp.Decoded = decoded
+			if c.applyTabResult(decoded) {
+				h.changed(c.Session.TokenHash)
+			}
+		}
+	}
+
+	p.resp <- resp
+}
+
+// applyTabResult updates the tab registry for tabs the relay opened or
+// closed, so they are usable before the extension's own tab_attach or
+// tab_detach arrives. It reports whether the registry changed.
+func (c *Connection) applyTabResult(result models.CommandResult) bool {
+	switch r := result.(type) {
+	case *models.TabCreateResult:
+		if !c.Session.HasTab(r.TabID) {
+			c.Session.SetTab(&models.Tab{
+				ID:         r.TabID,
+				URL:        r.URL,
+				Title:      r.Title,
+				SessionID:  c.Session.ID,
+				AttachedAt: time.Now().UTC(),
+				ReportedAt: time.Now().UTC(),
+			})
+			return true
+		}
+	case *models.TabCloseResult:
+		if r.TabID != "" && c.Session.HasTab(r.TabID) {
+			c.Session.RemoveTab(r.TabID)
+			return true
+		}
+	}
+	return false
 }
 
 // Run starts the read and write pumps for a connection
 func (c *Connection) Run(ctx context.Context) {
 	go c.writePump(ctx)
+	go c.tabPump(ctx)
 	c.readPump(ctx)
 }
 
 func (c *Connection) readPump(ctx context.Context) {
 	defer c.hub.Unregister(c)
 
-	c.Conn.SetReadLimit(512 * 1024) // 512KB max message size
+	// Oversized messages are drained and rejected up to the hard limit;
+	// beyond it the connection is closed with 1009 (message too big)
+	limit := int64(c.hub.cfg.WSMaxMessageSize)
+	c.Conn.SetReadLimit(limit * wsHardLimitFactor)
 	c.Conn.SetReadDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSPingInterval+c.hub.cfg.WSPongTimeout) * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSPingInterval+c.hub.cfg.WSPongTimeout) * time.Second))
 		c.Session.LastPingAt = time.Now().UTC()
+		c.recordSeen(c.Session.LastPingAt)
 		return nil
 	})
 
 	for {
 		select {
 		case <-ctx.Done():
+			c.disconnected(models.DisconnectShutdown, 0)
 			return
 		case <-c.done:
 			return
 		default:
 		}
 
-		_, message, err := c.Conn.ReadMessage()
+		messageType, message, size, err := c.readMessage(limit)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			c.readError(err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				log.Warn().
+					Str("session_id", c.Session.ID).
+					Int64("limit", limit*wsHardLimitFactor).
+					Msg("Disconnecting extension for oversized message")
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Warn().Err(err).Str("session_id", c.Session.ID).Msg("WebSocket read error")
 			}
 			return
 		}
 
+		if ok, newStrike := c.limiter.allow(int(size), time.Now()); !ok {
+			if newStrike && c.rateLimited() {
+				return
+			}
+			continue
+		}
+
+		if size > limit {
+			if messageType == websocket.BinaryMessage && len(message) > 4 {
+				message = message[4:] // past the length prefix, to read the type and id
+			}
+			c.rejectTooLarge(message, size, limit)
+			continue
+		}
+		message, violation := c.decode(messageType, message)
+		if violation != nil {
+			c.rejectMessage(violation)
+			continue
+		}
 		c.handleMessage(message)
 	}
 }
 
+// rateLimited warns the extension about exceeding inbound limits, or closes
+// the connection once too many consecutive windows were exceeded. It reports
+// whether the connection was closed.
+func (c *Connection) rateLimited() bool {
+	maxStrikes := c.hub.cfg.WSRateLimitStrikes
+	strikes := c.limiter.strikes
+
+	if maxStrikes > 0 && strikes >= maxStrikes {
+		c.disconnected(models.DisconnectRateLimited, 0)
+		log.Warn().
+			Str("session_id", c.Session.ID).
+			Int("strikes", strikes).
+			Msg("Disconnecting extension for exceeding inbound rate limit")
+		c.Conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "inbound rate limit exceeded"),
+			time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout)*time.Second))
+		return true
+	}
+
+	log.Warn().
+		Str("session_id", c.Session.ID).
+		Int("strikes", strikes).
+		Msg("Extension exceeded inbound rate limit")
+	c.sendMessage(models.RateLimitWarning{
+		Type:              "rate_limit_warning",
+		Message:           "Inbound message rate exceeded; excess messages are being dropped",
+		MaxMessagesPerSec: c.hub.cfg.WSMaxMessagesPerSec,
+		MaxBytesPerSec:    c.hub.cfg.WSMaxBytesPerSec,
+		Strikes:           strikes,
+		MaxStrikes:        maxStrikes,
+	})
+	return false
+}
+
+// sendMessage queues a message without blocking; it is dropped if the send buffer is full
+func (c *Connection) sendMessage(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	select {
+	case c.lanes[laneNormal] <- outbound{data: data}:
+	default:
+		log.Warn().Str("session_id", c.Session.ID).Msg("Send buffer full, dropping message")
+	}
+}
+
 func (c *Connection) writePump(ctx context.Context) {
 	ticker := time.NewTicker(time.Duration(c.hub.cfg.WSPingInterval) * time.Second)
 	defer ticker.Stop()
 
 	for {
+		// Pings and closing are not held up by a busy send queue
 		select {
 		case <-ctx.Done():
 			return
 		case <-c.done:
 			return
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout) * time.Second))
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-ticker.C:
+			if !c.ping() {
 				return
 			}
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Warn().Err(err).Str("session_id", c.Session.ID).Msg("WebSocket write error")
+		case message := <-c.finalMsg:
+			c.writeFinal(message)
+			return
+		default:
+		}
+
+		message, ok := c.nextQueued()
+		if !ok {
+			// Nothing queued, so whichever lane gets a message first holds
+			// the only one
+			select {
+			case <-ctx.Done():
 				return
-			}
-		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout) * time.Second))
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			case <-c.done:
+				return
+			case message = <-c.lanes[laneHigh]:
+			case message = <-c.lanes[laneNormal]:
+			case message = <-c.lanes[laneLow]:
+			case <-ticker.C:
+				if !c.ping() {
+					return
+				}
+				continue
+			case message := <-c.finalMsg:
+				c.writeFinal(message)
 				return
 			}
 		}
+
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout) * time.Second))
+		if !message.queued.IsZero() {
+			c.activity.dequeued(time.Since(message.queued))
+		}
+		if err := c.write(message); err != nil {
+			c.disconnected(models.DisconnectWriteFailed, 0)
+			log.Warn().Err(err).Str("session_id", c.Session.ID).Msg("WebSocket write error")
+			return
+		}
+		if message.written != nil {
+			message.written <- time.Now()
+		}
+	}
+}
+
+// ping sends a WebSocket ping and a JSON ping, reporting whether both were
+// written
+func (c *Connection) ping() bool {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout) * time.Second))
+	if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+		c.disconnected(models.DisconnectWriteFailed, 0)
+		return false
+	}
+	// The extension answers JSON pings, which keeps its clock offset
+	// estimate current
+	if data, err := json.Marshal(models.Ping{Type: "ping", Timestamp: time.Now().UnixMilli()}); err == nil {
+		if err := c.writeData(data); err != nil {
+			c.disconnected(models.DisconnectWriteFailed, 0)
+			return false
+		}
+	}
+	return true
+}
+
+// finalMessage is the last message written to an extension, after those
+// already queued, before the socket is closed with code
+type finalMessage struct {
+	data   []byte
+	code   int
+	reason string
+}
+
+// closeWith has the write pump send a final message and close the socket;
+// it does nothing if a final message is already pending
+func (c *Connection) closeWith(m finalMessage) {
+	select {
+	case c.finalMsg <- m:
+	default:
+	}
+}
+
+// writeFinal flushes queued messages, sends the final message, and closes
+// the socket
+func (c *Connection) writeFinal(message finalMessage) {
+	defer c.close()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Duration(c.hub.cfg.WSWriteTimeout) * time.Second))
+	for {
+		queued, ok := c.nextQueued()
+		if !ok {
+			break
+		}
+		if err := c.write(queued); err != nil {
+			return
+		}
 	}
+
+	if err := c.writeData(message.data); err != nil {
+		return
+	}
+	c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(message.code, message.reason))
 }
 
 func (c *Connection) handleMessage(data []byte) {
-	var msg models.WSMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Warn().Err(err).Str("session_id", c.Session.ID).Msg("Failed to parse message")
+	msgType, violation := protocol.Validate(data)
+	if violation != nil {
+		c.rejectMessage(violation)
 		return
 	}
 
-	switch msg.Type {
+	switch msgType {
+	case "connect":
+		var hello models.ExtensionConnect
+		if err := json.Unmarshal(data, &hello); err != nil {
+			return
+		}
+		version, ok := protocol.Negotiate(hello.MinProtocolVersion, hello.ProtocolVersion, c.hub.cfg.WSMinProtocolVersion)
+		if !ok {
+			c.refuseProtocol(&hello)
+			return
+		}
+		// Binary frames need the answer that announces them
+		encoding := protocol.EncodingJSON
+		if hello.ProtocolVersion > 0 {
+			encoding = c.negotiateEncoding(&hello)
+		}
+		c.Session.SetClient(hello.ExtensionVersion, &models.ClientInfo{
+			Browser:         hello.Browser,
+			BrowserVersion:  hello.BrowserVersion,
+			OS:              hello.OS,
+			InstallID:       hello.InstallID,
+			DeviceName:      hello.DeviceName,
+			Labels:          hello.Labels,
+			ProtocolVersion: version,
+			Capabilities:    hello.Capabilities,
+			Actions:         hello.Actions,
+			Encoding:        encoding,
+		})
+		if hello.Window != nil {
+			hello.Window.UpdatedAt = time.Now().UTC()
+			c.Session.SetWindow(hello.Window)
+		}
+		// Extensions from before the handshake do not expect an answer
+		if hello.ProtocolVersion > 0 {
+			c.accept(version, encoding)
+		}
+		canary := c.hub.canary.matches(hello.ExtensionVersion, hello.Labels)
+		c.Session.SetCanary(canary)
+		c.hub.changed(c.Session.TokenHash)
+		name, _, _ := c.Session.Info()
+		log.Info().
+			Str("session_id", c.Session.ID).
+			Str("name", name).
+			Str("extension_version", hello.ExtensionVersion).
+			Int("protocol_version", version).
+			Strs("capabilities", hello.Capabilities).
+			Str("encoding", encoding).
+			Str("install_id", hello.InstallID).
+			Bool("canary", canary).
+			Msg("Extension identified")
+		c.hub.recordIdentified(c.Session)
+		c.hub.notifySession(models.WebhookExtensionConnected, c.Session)
+
 	case "tab_attach":
 		var attach models.TabAttach
 		if err := json.Unmarshal(data, &attach); err != nil {
 			return
 		}
-		c.Session.Tabs[attach.TabID] = &models.Tab{
+		c.Session.SetTab(&models.Tab{
 			ID:         attach.TabID,
 			URL:        attach.URL,
 			Title:      attach.Title,
-			FavIconURL: attach.FavIconURL,
+			FavIconURL: favIconURL(attach.FavIconURL),
+			SessionID:  c.Session.ID,
 			AttachedAt: time.Now().UTC(),
-		}
+			ReportedAt: time.Now().UTC(),
+		})
+		c.hub.changed(c.Session.TokenHash)
 		log.Debug().Str("tab_id", attach.TabID).Str("url", attach.URL).Msg("Tab attached")
 
+	case "sync":
+		var tabSync models.TabSync
+		if err := json.Unmarshal(data, &tabSync); err != nil {
+			return
+		}
+		now := time.Now().UTC()
+		tabs := make([]*models.Tab, 0, len(tabSync.Tabs))
+		for _, t := range tabSync.Tabs {
+			if t.TabID == "" {
+				continue
+			}
+			tabs = append(tabs, &models.Tab{
+				ID:         t.TabID,
+				URL:        t.URL,
+				Title:      t.Title,
+				FavIconURL: favIconURL(t.FavIconURL),
+				SessionID:  c.Session.ID,
+				AttachedAt: now,
+				ReportedAt: now,
+			})
+		}
+		c.Session.ReplaceTabs(tabs)
+		c.console.forget(func(tabID string) bool {
+			_, ok := c.Session.GetTab(tabID)
+			return ok
+		})
+		c.notifySynced()
+		c.hub.changed(c.Session.TokenHash)
+		log.Debug().Str("session_id", c.Session.ID).Int("tabs", len(tabs)).Msg("Tabs synced")
+
 	case "tab_detach":
 		var detach models.TabDetach
 		if err := json.Unmarshal(data, &detach); err != nil {
 			return
 		}
-		delete(c.Session.Tabs, detach.TabID)
+		c.Session.RemoveTab(detach.TabID)
+		c.console.forget(func(tabID string) bool { return tabID != detach.TabID })
+		c.hub.changed(c.Session.TokenHash)
 		log.Debug().Str("tab_id", detach.TabID).Msg("Tab detached")
 
 	case "tab_update":
@@ -302,14 +1168,30 @@ func (c *Connection) handleMessage(data []byte) {
 		if err := json.Unmarshal(data, &update); err != nil {
 			return
 		}
-		if tab, ok := c.Session.Tabs[update.TabID]; ok {
+		var oldURL, oldTitle, url, title string
+		if c.Session.UpdateTab(update.TabID, func(tab *models.Tab) {
+			oldURL, oldTitle = tab.URL, tab.Title
+			tab.ReportedAt = time.Now().UTC()
 			if update.URL != "" {
 				tab.URL = update.URL
 			}
 			if update.Title != "" {
 				tab.Title = update.Title
 			}
+			url, title = tab.URL, tab.Title
+		}) {
+			c.hub.changed(c.Session.TokenHash)
+			c.tabChanged(update.TabID, oldURL, oldTitle, url, title)
+		}
+
+	case "window_update":
+		var update models.WindowUpdate
+		if err := json.Unmarshal(data, &update); err != nil {
+			return
 		}
+		update.Window.UpdatedAt = time.Now().UTC()
+		c.Session.SetWindow(&update.Window)
+		c.hub.changed(c.Session.TokenHash)
 
 	case "pong":
 		var pong models.Pong
@@ -317,23 +1199,258 @@ func (c *Connection) handleMessage(data []byte) {
 			return
 		}
 		c.Session.LastPingAt = time.Now().UTC()
+		// Pongs answering the relay carry the browser's time of receipt;
+		// the extension's own heartbeats do not
+		if pong.ClientTime > 0 {
+			c.clock.observe(time.UnixMilli(pong.Timestamp), pong.ClientTime, time.Now())
+		}
+
+	case "screenshot_chunk":
+		var chunk models.ScreenshotChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return
+		}
+		c.handleChunk(&chunk)
+
+	case "console":
+		var msg models.ConsoleMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		c.handleConsole(&msg)
+
+	case "page_event":
+		var msg models.PageEventMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		c.handlePageEvent(&msg)
+
+	case "download":
+		var msg models.DownloadMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return
+		}
+		c.handleDownload(&msg)
+
+	case "download_chunk":
+		var chunk models.DownloadChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return
+		}
+		c.handleDownloadChunk(&chunk)
 
 	case "command_response":
 		var resp models.CommandResponse
 		if err := json.Unmarshal(data, &resp); err != nil {
 			return
 		}
-		c.hub.HandleResponse(&resp)
+		c.hub.HandleResponse(c, &resp)
 
-	default:
-		log.Debug().Str("type", msg.Type).Msg("Unknown message type")
 	}
 }
 
+// rejectMessage reports a message that failed validation back to the
+// extension and counts it
+func (c *Connection) rejectMessage(v *protocol.Violation) {
+	c.hub.stats.protocolError(v.Type, v.Code)
+
+	_, extensionVer, _ := c.Session.Info()
+	log.Warn().
+		Str("session_id", c.Session.ID).
+		Str("extension_version", extensionVer).
+		Str("type", v.Type).
+		Str("code", v.Code).
+		Strs("details", v.Details).
+		Msg("Rejected extension message")
+
+	message := "Message does not match the protocol schema"
+	switch v.Code {
+	case protocol.CodeMalformed:
+		message = "Message is not a JSON object with a string type"
+	case protocol.CodeUnknownType:
+		message = "Unknown message type " + strconv.Quote(v.Type)
+	}
+	c.sendMessage(models.ProtocolError{
+		Type:        "protocol_error",
+		Code:        v.Code,
+		Message:     message,
+		MessageType: v.Type,
+		Details:     v.Details,
+	})
+}
+
+// refuseProtocol answers a connect message whose protocol versions the
+// relay does not accept with connect_error, and closes the connection
+func (c *Connection) refuseProtocol(hello *models.ExtensionConnect) {
+	lowest, highest := hello.MinProtocolVersion, hello.ProtocolVersion
+	if highest == 0 {
+		highest = protocol.MinVersion
+	}
+	if lowest == 0 {
+		lowest = protocol.MinVersion
+	}
+	log.Warn().
+		Str("session_id", c.Session.ID).
+		Str("extension_version", hello.ExtensionVersion).
+		Int("min_protocol_version", lowest).
+		Int("protocol_version", highest).
+		Msg("Refusing extension with unsupported protocol version")
+
+	data, err := json.Marshal(models.ConnectError{
+		Type: "connect_error",
+		Code: "UNSUPPORTED_PROTOCOL",
+		Message: fmt.Sprintf("Extension speaks protocol versions %d to %d; the relay accepts %d to %d",
+			lowest, highest, c.hub.cfg.WSMinProtocolVersion, protocol.Version),
+		ProtocolVersion:    protocol.Version,
+		MinProtocolVersion: c.hub.cfg.WSMinProtocolVersion,
+	})
+	if err != nil {
+		return
+	}
+	c.disconnected(models.DisconnectProtocol, 0)
+	c.closeWith(finalMessage{data: data, code: websocket.CloseProtocolError, reason: "unsupported protocol version"})
+}
+
+// readMessage reads the next message and its frame type. One longer than limit is drained and
+// returned truncated to limit along with its full size.
+func (c *Connection) readMessage(limit int64) (int, []byte, int64, error) {
+	messageType, r, err := c.Conn.NextReader()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	size := int64(len(data))
+	if size <= limit {
+		return messageType, data, size, nil
+	}
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return messageType, data[:limit], size + n, nil
+}
+
+// rejectTooLarge answers a message over WS_MAX_MESSAGE_SIZE with a
+// protocol_error. If it was a command response, the command fails with
+// RESPONSE_TOO_LARGE instead of waiting for its timeout.
+func (c *Connection) rejectTooLarge(prefix []byte, size, limit int64) {
+	msgType, id := peekEnvelope(prefix)
+	c.hub.stats.protocolError(msgType, protocol.CodeTooLarge)
+
+	log.Warn().
+		Str("session_id", c.Session.ID).
+		Str("type", msgType).
+		Str("command_id", id).
+		Int64("size", size).
+		Int64("limit", limit).
+		Msg("Rejected oversized extension message")
+
+	message := fmt.Sprintf("Message of %d bytes exceeds the %d byte limit", size, limit)
+	c.sendMessage(models.ProtocolError{
+		Type:        "protocol_error",
+		Code:        protocol.CodeTooLarge,
+		Message:     message,
+		MessageType: msgType,
+	})
+
+	// The type may come after the field that made the message too large;
+	// an id is enough, as only responses to pending commands are applied
+	if id != "" && (msgType == "command_response" || msgType == "") {
+		c.hub.HandleResponse(c, &models.CommandResponse{
+			Type:  "command_response",
+			ID:    id,
+			Error: &models.CommandError{Code: "RESPONSE_TOO_LARGE", Message: message},
+		})
+	}
+}
+
+// favIconURL keeps a favicon the extension reported only if it is a web or
+// inline image, as pages control it and the dashboard shows it
+func favIconURL(u string) string {
+	lower := strings.ToLower(u)
+	if strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "data:image/") {
+		return u
+	}
+	return ""
+}
+
+// peekEnvelope reads the top-level "type" and "id" of a possibly truncated
+// message, as far as they appear before anything unreadable
+func peekEnvelope(data []byte) (msgType, id string) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", ""
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return
+		}
+		switch key {
+		case "type":
+			json.Unmarshal(value, &msgType)
+		case "id":
+			json.Unmarshal(value, &id)
+		}
+		if msgType != "" && id != "" {
+			return
+		}
+	}
+	return
+}
+
+// RequestSync asks every session of the token to resend its full tab list
+// and waits until each has replied or ctx is done
+func (h *Hub) RequestSync(ctx context.Context, tokenHash string) {
+	h.sessionsMu.RLock()
+	conns := append([]*Connection(nil), h.sessions[tokenHash]...)
+	h.sessionsMu.RUnlock()
+
+	waiters := make([]chan struct{}, 0, len(conns))
+	for _, c := range conns {
+		ch := make(chan struct{})
+		c.syncWaitersMu.Lock()
+		c.syncWaiters = append(c.syncWaiters, ch)
+		c.syncWaitersMu.Unlock()
+		c.sendMessage(models.SyncRequest{Type: "sync_request"})
+		waiters = append(waiters, ch)
+	}
+
+	for i, ch := range waiters {
+		select {
+		case <-ch:
+		case <-conns[i].done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Connection) notifySynced() {
+	c.syncWaitersMu.Lock()
+	defer c.syncWaitersMu.Unlock()
+	for _, ch := range c.syncWaiters {
+		close(ch)
+	}
+	c.syncWaiters = nil
+}
+
 // Errors
 var (
 	ErrNotConnected = &HubError{Code: "EXTENSION_OFFLINE", Message: "Extension is not connected"}
 	ErrTimeout      = &HubError{Code: "TIMEOUT", Message: "Command timed out"}
+	ErrShuttingDown = &HubError{Code: "SHUTTING_DOWN", Message: "Relay is shutting down"}
+	ErrDuplicateID  = &HubError{Code: "DUPLICATE_ID", Message: "A command with this ID is already running"}
+	ErrQueueFull    = &HubError{Code: "QUEUE_FULL", Message: "Too many commands in flight for this token"}
+	ErrQueueTimeout = &HubError{Code: "QUEUE_TIMEOUT", Message: "Command waited too long behind the token's other commands"}
 )
 
 // HubError represents a hub-related error
@@ -345,3 +1462,9 @@ type HubError struct {
 func (e *HubError) Error() string {
 	return e.Message
 }
+
+// unsupportedAction is the error for a command whose kind the session's
+// extension did not list among its actions
+func unsupportedAction(kind string) *HubError {
+	return &HubError{Code: "UNSUPPORTED_ACTION", Message: fmt.Sprintf("The extension does not support %q commands", kind)}
+}
@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightLimits caps the commands each token has awaiting a response, so
+// a runaway client cannot bury its extension in parallel work. Commands
+// past the cap wait their turn in order, in a queue of bounded depth.
+type inflightLimits struct {
+	max     int // per token; 0 for no limit
+	depth   int // commands waiting per token
+	timeout time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*tokenInflight
+
+	queued   atomic.Int64
+	full     atomic.Int64
+	timedOut atomic.Int64
+}
+
+// tokenInflight exists only while the token has commands running or queued
+type tokenInflight struct {
+	running int
+	queue   []*waiter // by lane, then in arrival order
+}
+
+// waiter is a queued command
+type waiter struct {
+	ready chan struct{} // closed when the waiter is handed a slot
+	lane  int
+}
+
+// QueueStats is a snapshot of the per-token command queues
+type QueueStats struct {
+	Queued   int64 // commands waiting for a slot now
+	Full     int64 // commands rejected with QUEUE_FULL, since start
+	TimedOut int64 // commands that gave up waiting with QUEUE_TIMEOUT, since start
+}
+
+func newInflightLimits(max, depth int, timeout time.Duration) *inflightLimits {
+	return &inflightLimits{
+		max:     max,
+		depth:   depth,
+		timeout: timeout,
+		tokens:  make(map[string]*tokenInflight),
+	}
+}
+
+// acquire takes one of the token's slots, queueing behind earlier commands
+// of the same or a higher lane when they are all in use; the returned func
+// frees it
+func (l *inflightLimits) acquire(ctx context.Context, tokenHash string, lane int) (func(), error) {
+	if l.max <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	t := l.tokens[tokenHash]
+	if t == nil {
+		t = &tokenInflight{}
+		l.tokens[tokenHash] = t
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { l.release(tokenHash, t) }) }
+	if t.running < l.max && len(t.queue) == 0 {
+		t.running++
+		l.mu.Unlock()
+		return release, nil
+	}
+	if len(t.queue) >= l.depth {
+		l.mu.Unlock()
+		l.full.Add(1)
+		return nil, ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{}), lane: lane}
+	at := len(t.queue)
+	for at > 0 && t.queue[at-1].lane > lane {
+		at--
+	}
+	t.queue = slices.Insert(t.queue, at, w)
+	l.mu.Unlock()
+
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	waiting := false
+	if i := slices.Index(t.queue, w); i >= 0 {
+		t.queue = slices.Delete(t.queue, i, i+1)
+		waiting = true
+	}
+	l.mu.Unlock()
+	if !waiting {
+		// Handed a slot while giving up; pass it on
+		release()
+	}
+	if err == ErrQueueTimeout {
+		l.timedOut.Add(1)
+	}
+	return nil, err
+}
+
+// release hands a freed slot to the oldest queued command, if any
+func (l *inflightLimits) release(tokenHash string, t *tokenInflight) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(t.queue) > 0 {
+		close(t.queue[0].ready)
+		t.queue = t.queue[1:]
+		return
+	}
+	t.running--
+	if t.running == 0 && l.tokens[tokenHash] == t {
+		delete(l.tokens, tokenHash)
+	}
+}
+
+func (l *inflightLimits) stats() QueueStats {
+	return QueueStats{
+		Queued:   l.queued.Load(),
+		Full:     l.full.Load(),
+		TimedOut: l.timedOut.Load(),
+	}
+}
+
+// CommandQueue returns the per-token command queue counts
+func (h *Hub) CommandQueue() QueueStats {
+	return h.commandLimits.stats()
+}
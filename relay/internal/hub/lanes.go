@@ -0,0 +1,44 @@
+package hub
+
+import (
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Outbound messages wait in one of three lanes per connection. The write
+// pump always takes the oldest message of the highest lane holding one, so
+// a high priority command is not stuck behind a long upload. Messages other
+// than commands use the normal lane.
+const (
+	laneHigh = iota
+	laneNormal
+	laneLow
+	laneCount
+)
+
+// laneFor returns the lane of a command priority; "" is normal
+func laneFor(priority string) int {
+	switch priority {
+	case models.PriorityHigh:
+		return laneHigh
+	case models.PriorityLow:
+		return laneLow
+	}
+	return laneNormal
+}
+
+// lane returns the send queue for a command priority
+func (c *Connection) lane(priority string) chan outbound {
+	return c.lanes[laneFor(priority)]
+}
+
+// nextQueued takes the oldest message of the highest lane holding one
+func (c *Connection) nextQueued() (outbound, bool) {
+	for _, lane := range c.lanes {
+		select {
+		case message := <-lane:
+			return message, true
+		default:
+		}
+	}
+	return outbound{}, false
+}
@@ -0,0 +1,224 @@
+package hub
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// pageEventBuffer is how far a subscriber may fall behind before newer
+// events are dropped for it
+const pageEventBuffer = 256
+
+// Longest dialog message kept, in bytes; longer ones are cut
+const maxDialogMessage = 4096
+
+// pageEventTypes are the page events a client can subscribe to
+var pageEventTypes = map[string]bool{
+	models.PageEventURLChanged:          true,
+	models.PageEventTitleChanged:        true,
+	models.PageEventNavigationCompleted: true,
+	models.PageEventDialogOpened:        true,
+	models.PageEventDOMMutated:          true,
+}
+
+// ValidPageEvent reports whether t names a page event type
+func ValidPageEvent(t string) bool {
+	return pageEventTypes[t]
+}
+
+// PageEventSubscription receives the page events of a token's tabs until
+// it is cancelled
+type PageEventSubscription struct {
+	Events <-chan models.PageEvent
+
+	events    chan models.PageEvent
+	tokenHash string
+	tabID     string          // "" for all tabs
+	types     map[string]bool // nil for all types
+	dropped   atomic.Int64
+}
+
+// Dropped returns how many events were dropped because the subscriber fell
+// behind, since it was last called
+func (s *PageEventSubscription) Dropped() int64 {
+	return s.dropped.Swap(0)
+}
+
+func (s *PageEventSubscription) wants(e *models.PageEvent) bool {
+	if s.tabID != "" && s.tabID != e.TabID {
+		return false
+	}
+	return s.types == nil || s.types[e.Type]
+}
+
+// pageEventSubs holds the page event subscriptions of each token
+type pageEventSubs struct {
+	mu   sync.Mutex
+	subs map[string]map[*PageEventSubscription]bool
+}
+
+func (p *pageEventSubs) any(tokenHash string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.subs[tokenHash]) > 0
+}
+
+// SubscribePageEvents starts streaming the page events of a token's tabs,
+// only tabID's unless empty and only the given types unless none. The
+// token's extensions forward events while it has a subscription. Only
+// sessions connected to this relay are covered.
+func (h *Hub) SubscribePageEvents(tokenHash, tabID string, types []string) *PageEventSubscription {
+	events := make(chan models.PageEvent, pageEventBuffer)
+	sub := &PageEventSubscription{
+		Events:    events,
+		events:    events,
+		tokenHash: tokenHash,
+		tabID:     tabID,
+	}
+	if len(types) > 0 {
+		sub.types = make(map[string]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	h.pageEvents.mu.Lock()
+	if h.pageEvents.subs == nil {
+		h.pageEvents.subs = make(map[string]map[*PageEventSubscription]bool)
+	}
+	subs := h.pageEvents.subs[tokenHash]
+	if subs == nil {
+		subs = make(map[*PageEventSubscription]bool)
+		h.pageEvents.subs[tokenHash] = subs
+	}
+	subs[sub] = true
+	first := len(subs) == 1
+	h.pageEvents.mu.Unlock()
+
+	if first {
+		h.resubscribe(tokenHash)
+	}
+	return sub
+}
+
+// UnsubscribePageEvents ends a subscription. The token's extensions stop
+// forwarding events when it was the last one.
+func (h *Hub) UnsubscribePageEvents(sub *PageEventSubscription) {
+	h.pageEvents.mu.Lock()
+	subs := h.pageEvents.subs[sub.tokenHash]
+	delete(subs, sub)
+	last := subs != nil && len(subs) == 0
+	if last {
+		delete(h.pageEvents.subs, sub.tokenHash)
+	}
+	h.pageEvents.mu.Unlock()
+
+	if last {
+		h.resubscribe(sub.tokenHash)
+	}
+}
+
+// publishPageEvent hands an event to the token's subscribers, dropping it
+// for those that are behind
+func (h *Hub) publishPageEvent(tokenHash string, e models.PageEvent) {
+	h.pageEvents.mu.Lock()
+	defer h.pageEvents.mu.Unlock()
+
+	for sub := range h.pageEvents.subs[tokenHash] {
+		if !sub.wants(&e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// subscriptions returns the events a token's extensions should forward
+func (h *Hub) subscriptions(tokenHash string) []string {
+	events := []string{}
+	if h.cfg.ConsoleBufferSize > 0 {
+		events = append(events, "console")
+	}
+	if h.downloads != nil {
+		events = append(events, "downloads")
+	}
+	if h.pageEvents.any(tokenHash) {
+		events = append(events, "page_events")
+	}
+	return events
+}
+
+// resubscribe sends the token's connections their current subscriptions
+func (h *Hub) resubscribe(tokenHash string) {
+	sub := models.Subscribe{Type: "subscribe", Events: h.subscriptions(tokenHash)}
+
+	h.sessionsMu.RLock()
+	defer h.sessionsMu.RUnlock()
+	for _, c := range h.sessions[tokenHash] {
+		c.sendMessage(sub)
+	}
+}
+
+// handlePageEvent publishes an event the extension reported for an
+// attached tab
+func (c *Connection) handlePageEvent(msg *models.PageEventMessage) {
+	tab, ok := c.Session.GetTab(msg.TabID)
+	if !ok {
+		return
+	}
+	ts := time.Now().UTC()
+	if msg.Timestamp > 0 {
+		ts = time.UnixMilli(c.clock.toServer(msg.Timestamp)).UTC()
+	}
+	e := models.PageEvent{
+		Type:      msg.Event,
+		SessionID: c.Session.ID,
+		TabID:     msg.TabID,
+		URL:       msg.URL,
+		Title:     msg.Title,
+		Mutations: msg.Mutations,
+		Timestamp: ts,
+	}
+	if e.URL == "" {
+		e.URL = tab.URL
+	}
+	if msg.Dialog != nil {
+		e.Dialog = &models.PageDialog{
+			Type:    msg.Dialog.Type,
+			Message: truncate(msg.Dialog.Message, maxDialogMessage),
+		}
+	}
+	c.hub.publishPageEvent(c.Session.TokenHash, e)
+}
+
+// tabChanged publishes url_changed and title_changed for a tab_update that
+// changed them. Extensions report these without a subscription.
+func (c *Connection) tabChanged(tabID, oldURL, oldTitle, url, title string) {
+	now := time.Now().UTC()
+	if url != oldURL {
+		c.hub.publishPageEvent(c.Session.TokenHash, models.PageEvent{
+			Type:      models.PageEventURLChanged,
+			SessionID: c.Session.ID,
+			TabID:     tabID,
+			URL:       url,
+			Title:     title,
+			Timestamp: now,
+		})
+	}
+	if title != oldTitle {
+		c.hub.publishPageEvent(c.Session.TokenHash, models.PageEvent{
+			Type:      models.PageEventTitleChanged,
+			SessionID: c.Session.ID,
+			TabID:     tabID,
+			URL:       url,
+			Title:     title,
+			Timestamp: now,
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package hub
+
+import "time"
+
+// inboundLimiter caps messages and bytes received per second on a connection.
+// Each one-second window that exceeds a limit counts as a strike; a window
+// within limits clears them.
+type inboundLimiter struct {
+	maxMessages int // per second, 0 = unlimited
+	maxBytes    int // per second, 0 = unlimited
+
+	windowStart time.Time
+	messages    int
+	bytes       int
+	exceeded    bool // current window has exceeded a limit
+	strikes     int  // consecutive windows that exceeded a limit
+}
+
+func newInboundLimiter(maxMessages, maxBytes int) *inboundLimiter {
+	return &inboundLimiter{
+		maxMessages: maxMessages,
+		maxBytes:    maxBytes,
+		windowStart: time.Now(),
+	}
+}
+
+// allow records a message of n bytes. It reports whether the message is within
+// limits and whether this message started a new strike.
+func (l *inboundLimiter) allow(n int, now time.Time) (ok bool, newStrike bool) {
+	if now.Sub(l.windowStart) >= time.Second {
+		if !l.exceeded {
+			l.strikes = 0
+		}
+		l.windowStart = now
+		l.messages = 0
+		l.bytes = 0
+		l.exceeded = false
+	}
+
+	l.messages++
+	l.bytes += n
+
+	over := (l.maxMessages > 0 && l.messages > l.maxMessages) ||
+		(l.maxBytes > 0 && l.bytes > l.maxBytes)
+	if !over {
+		return true, false
+	}
+
+	if !l.exceeded {
+		l.exceeded = true
+		l.strikes++
+		return false, true
+	}
+	return false, false
+}
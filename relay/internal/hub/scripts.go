@@ -0,0 +1,9 @@
+package hub
+
+import "github.com/emreylmaz/owlrelay/relay/internal/scripts"
+
+// SetScripts has commands that succeed added to the recordings of their
+// tabs in r. Call it before the server starts.
+func (h *Hub) SetScripts(r *scripts.Recorder) {
+	h.scripts = r
+}
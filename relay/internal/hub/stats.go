@@ -0,0 +1,164 @@
+package hub
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+const (
+	// statsWindow is how many one-minute throughput buckets are kept
+	statsWindow = 60
+	// maxRecentErrors is how many failed commands are remembered
+	maxRecentErrors = 50
+)
+
+// commandStats aggregates command outcomes for the admin API
+type commandStats struct {
+	mu sync.Mutex
+
+	total     int64
+	succeeded int64
+	failed    int64
+	inFlight  int
+
+	// Ring of per-minute buckets indexed by minute % statsWindow
+	buckets [statsWindow]models.ThroughputBucket
+
+	// Ring of the most recent failures, oldest overwritten first
+	errors    [maxRecentErrors]models.RecentError
+	errorsLen int
+	errorsPos int
+
+	// Rejected extension messages by message type and violation code
+	protocolErrors map[[2]string]int64
+
+	// Outcomes of commands run in canary mode and of the rest, to compare
+	canary, stable cohortStats
+}
+
+// cohortStats counts the outcomes and latency of a group of commands
+type cohortStats struct {
+	succeeded, failed int64
+	duration          time.Duration
+}
+
+func (c cohortStats) snapshot() models.CohortStats {
+	out := models.CohortStats{Succeeded: c.succeeded, Failed: c.failed, DurationMs: c.duration.Milliseconds()}
+	if n := c.succeeded + c.failed; n > 0 {
+		out.AvgMs = c.duration.Milliseconds() / n
+	}
+	return out
+}
+
+func (s *commandStats) begin() {
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+}
+
+// end records the outcome of a command; cmdErr is nil on success
+func (s *commandStats) end(c *Connection, cmd *models.CommandRequest, cmdErr *models.CommandError, elapsed time.Duration) {
+	now := time.Now().UTC()
+	minute := now.Truncate(time.Minute)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inFlight--
+	s.total++
+
+	b := &s.buckets[(minute.Unix()/60)%statsWindow]
+	if !b.Time.Equal(minute) {
+		*b = models.ThroughputBucket{Time: minute}
+	}
+
+	cohort := &s.stable
+	if cmd.Canary {
+		cohort = &s.canary
+	}
+	cohort.duration += elapsed
+
+	if cmdErr == nil {
+		s.succeeded++
+		b.Succeeded++
+		cohort.succeeded++
+		return
+	}
+
+	s.failed++
+	b.Failed++
+	cohort.failed++
+
+	s.errors[s.errorsPos] = models.RecentError{
+		Time:      now,
+		SessionID: c.Session.ID,
+		TokenName: c.Session.TokenName,
+		CommandID: cmd.ID,
+		Kind:      cmd.Action.Kind,
+		Code:      cmdErr.Code,
+		Message:   cmdErr.Message,
+	}
+	s.errorsPos = (s.errorsPos + 1) % maxRecentErrors
+	if s.errorsLen < maxRecentErrors {
+		s.errorsLen++
+	}
+}
+
+// protocolError counts a message rejected by schema validation
+func (s *commandStats) protocolError(msgType, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.protocolErrors == nil {
+		s.protocolErrors = make(map[[2]string]int64)
+	}
+	s.protocolErrors[[2]string{msgType, code}]++
+}
+
+func (s *commandStats) snapshot() models.CommandStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := models.CommandStats{
+		Total:          s.total,
+		Succeeded:      s.succeeded,
+		Failed:         s.failed,
+		InFlight:       s.inFlight,
+		PerMinute:      make([]models.ThroughputBucket, 0, statsWindow),
+		RecentErrors:   make([]models.RecentError, 0, s.errorsLen),
+		ProtocolErrors: make([]models.ProtocolErrorCount, 0, len(s.protocolErrors)),
+		Canary:         s.canary.snapshot(),
+		Stable:         s.stable.snapshot(),
+	}
+
+	// Oldest minute first, empty minutes included so charts stay continuous
+	now := time.Now().UTC().Truncate(time.Minute)
+	for i := statsWindow - 1; i >= 0; i-- {
+		minute := now.Add(-time.Duration(i) * time.Minute)
+		b := s.buckets[(minute.Unix()/60)%statsWindow]
+		if !b.Time.Equal(minute) {
+			b = models.ThroughputBucket{Time: minute}
+		}
+		out.PerMinute = append(out.PerMinute, b)
+	}
+
+	// Newest error first
+	for i := 1; i <= s.errorsLen; i++ {
+		out.RecentErrors = append(out.RecentErrors, s.errors[(s.errorsPos-i+maxRecentErrors)%maxRecentErrors])
+	}
+
+	for key, count := range s.protocolErrors {
+		out.ProtocolErrors = append(out.ProtocolErrors, models.ProtocolErrorCount{Type: key[0], Code: key[1], Count: count})
+	}
+	sort.Slice(out.ProtocolErrors, func(i, j int) bool {
+		a, b := out.ProtocolErrors[i], out.ProtocolErrors[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Code < b.Code
+	})
+
+	return out
+}
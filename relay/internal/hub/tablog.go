@@ -0,0 +1,147 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// tabLogSize is how many tab events are kept per token; cursors older
+// than that get the full list again
+const tabLogSize = 1024
+
+// tabLogs records how each token's tabs change between reads of the tab
+// list, so pollers can ask for only what changed since their last read
+type tabLogs struct {
+	mu   sync.Mutex
+	logs map[string]*tabLog
+}
+
+// tabLog is one token's tab events, numbered by seq. Events are derived by
+// comparing each tab list read with the one before it.
+type tabLog struct {
+	epoch  int64 // tells cursors of an earlier log (or relay run) apart
+	seq    int64
+	known  map[string]models.Tab
+	events []tabEvent // oldest first, at most tabLogSize
+}
+
+type tabEvent struct {
+	seq     int64
+	tabID   string
+	existed bool // the tab was in the list before this event
+}
+
+// TabChanges records the token's current tabs and returns a cursor for
+// them. With a since cursor it also returns the tabs added, changed, and
+// removed after it; a cursor the log no longer covers returns every tab as
+// added, with Full set.
+func (h *Hub) TabChanges(tokenHash string, tabs []*models.Tab, since string) models.TabChangesResponse {
+	h.tabLogs.mu.Lock()
+	defer h.tabLogs.mu.Unlock()
+
+	if h.tabLogs.logs == nil {
+		h.tabLogs.logs = make(map[string]*tabLog)
+	}
+	l := h.tabLogs.logs[tokenHash]
+	if l == nil {
+		l = &tabLog{epoch: time.Now().UnixNano(), known: make(map[string]models.Tab)}
+		h.tabLogs.logs[tokenHash] = l
+	}
+	l.record(tabs)
+
+	resp := models.TabChangesResponse{
+		Cursor:  l.cursor(),
+		Added:   []*models.Tab{},
+		Changed: []*models.Tab{},
+		Removed: []string{},
+	}
+	if since == "" {
+		return resp
+	}
+
+	from, ok := l.parseCursor(since)
+	if !ok {
+		resp.Full = true
+		resp.Added = tabs
+		return resp
+	}
+
+	// A tab's first event after the cursor tells whether the client knew it
+	seen := make(map[string]bool)
+	for _, e := range l.events {
+		if e.seq <= from || seen[e.tabID] {
+			continue
+		}
+		seen[e.tabID] = true
+
+		known := e.existed
+		tab, exists := l.known[e.tabID]
+		switch {
+		case exists && known:
+			t := tab
+			resp.Changed = append(resp.Changed, &t)
+		case exists:
+			t := tab
+			resp.Added = append(resp.Added, &t)
+		case known:
+			resp.Removed = append(resp.Removed, e.tabID)
+		}
+	}
+	return resp
+}
+
+// record compares tabs with the last list and logs the differences
+func (l *tabLog) record(tabs []*models.Tab) {
+	current := make(map[string]models.Tab, len(tabs))
+	for _, tab := range tabs {
+		current[tab.ID] = *tab
+		if old, ok := l.known[tab.ID]; !ok || tabChanged(old, *tab) {
+			l.add(tabEvent{tabID: tab.ID, existed: ok})
+		}
+	}
+	for id := range l.known {
+		if _, ok := current[id]; !ok {
+			l.add(tabEvent{tabID: id, existed: true})
+		}
+	}
+	l.known = current
+}
+
+func (l *tabLog) add(e tabEvent) {
+	l.seq++
+	e.seq = l.seq
+	if len(l.events) == tabLogSize {
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+	l.events = append(l.events, e)
+}
+
+func tabChanged(a, b models.Tab) bool {
+	return a.URL != b.URL || a.Title != b.Title || a.FavIconURL != b.FavIconURL || a.SessionID != b.SessionID
+}
+
+func (l *tabLog) cursor() string {
+	return fmt.Sprintf("%x.%d", l.epoch, l.seq)
+}
+
+// parseCursor returns the seq of a cursor this log still covers: every
+// event after it is kept, or none were dropped since
+func (l *tabLog) parseCursor(cursor string) (int64, bool) {
+	epoch, seq, ok := strings.Cut(cursor, ".")
+	if !ok || epoch != strconv.FormatInt(l.epoch, 16) {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil || n < 0 || n > l.seq {
+		return 0, false
+	}
+	if len(l.events) > 0 && n < l.events[0].seq-1 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// tabPump asks the extension for its tab list every TAB_SYNC_INTERVAL, so
+// tabs that went away without a tab_detach are dropped, and expires tabs
+// not reported on within TAB_TTL
+func (c *Connection) tabPump(ctx context.Context) {
+	var syncTick, expireTick <-chan time.Time
+	if c.hub.cfg.TabSyncInterval > 0 {
+		ticker := time.NewTicker(time.Duration(c.hub.cfg.TabSyncInterval) * time.Second)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	ttl := time.Duration(c.hub.cfg.TabTTL) * time.Second
+	if ttl > 0 {
+		// Checked often enough that a tab outlives its TTL by at most a tenth
+		ticker := time.NewTicker(max(ttl/10, time.Second))
+		defer ticker.Stop()
+		expireTick = ticker.C
+	}
+	if syncTick == nil && expireTick == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-syncTick:
+			c.sendMessage(models.SyncRequest{Type: "sync_request"})
+		case now := <-expireTick:
+			c.expireTabs(now.Add(-ttl))
+		}
+	}
+}
+
+// expireTabs drops the tabs last reported before t
+func (c *Connection) expireTabs(t time.Time) {
+	expired := c.Session.ExpireTabs(t)
+	if len(expired) == 0 {
+		return
+	}
+	gone := make(map[string]bool, len(expired))
+	for _, id := range expired {
+		gone[id] = true
+	}
+	c.console.forget(func(tabID string) bool { return !gone[tabID] })
+	c.hub.changed(c.Session.TokenHash)
+	log.Info().
+		Str("session_id", c.Session.ID).
+		Strs("tab_ids", expired).
+		Msg("Expired tabs the extension stopped reporting")
+}
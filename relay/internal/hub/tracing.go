@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
+)
+
+// endCommandSpan records how a command ended and finishes its span
+func endCommandSpan(span *tracing.Span, resp *models.CommandResponse, err error) {
+	if span == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		code := "INTERNAL_ERROR"
+		if hubErr, ok := err.(*HubError); ok {
+			code = hubErr.Code
+		}
+		span.SetAttr("owlrelay.error.code", code)
+		span.SetError(err.Error())
+	case !resp.Success:
+		if resp.Error != nil {
+			span.SetAttr("owlrelay.error.code", resp.Error.Code)
+			span.SetError(resp.Error.Message)
+		} else {
+			span.SetError("Command failed")
+		}
+	}
+	if resp != nil && resp.Canary {
+		span.SetAttr("owlrelay.canary", true)
+	}
+	span.End()
+}
+
+// traceExtension ends the dispatch span when the command reached the
+// socket, and records the rest of the round trip as the extension's, with
+// the execution time it reported, in relay time, as a child
+func traceExtension(ctx context.Context, dispatch *tracing.Span, queued, written time.Time, resp *models.CommandResponse, err error) {
+	if dispatch == nil {
+		return
+	}
+	if written.IsZero() {
+		written = queued
+	}
+	dispatch.EndAt(written)
+
+	ctx, span := tracing.StartAt(ctx, "extension", tracing.KindClient, written)
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	if resp != nil {
+		if t := resp.Timing; t != nil && t.Received > 0 && t.Completed >= t.Received {
+			_, exec := tracing.StartAt(ctx, "extension.execute", tracing.KindInternal, time.UnixMilli(t.Received))
+			exec.EndAt(time.UnixMilli(t.Completed))
+		}
+	}
+	span.End()
+}
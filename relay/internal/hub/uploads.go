@@ -0,0 +1,43 @@
+package hub
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// uploadChunkSize is the most file bytes carried by one upload_chunk
+const uploadChunkSize = 256 << 10
+
+// streamUploads queues the files of an upload command as upload_chunk
+// messages. The extension collects them by command ID, so the command
+// itself must be queued after them, in the same lane.
+func (c *Connection) streamUploads(ctx context.Context, id string, lane chan outbound, files [][]byte) error {
+	for i, data := range files {
+		total := max(1, (len(data)+uploadChunkSize-1)/uploadChunkSize)
+		for seq := 0; seq < total; seq++ {
+			part := data[min(seq*uploadChunkSize, len(data)):min((seq+1)*uploadChunkSize, len(data))]
+			msg, err := json.Marshal(models.UploadChunk{
+				Type:  "upload_chunk",
+				ID:    id,
+				File:  i,
+				Seq:   seq,
+				Total: total,
+				Data:  base64.StdEncoding.EncodeToString(part),
+			})
+			if err != nil {
+				return err
+			}
+			select {
+			case lane <- outbound{data: msg}:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-c.done:
+				return ErrNotConnected
+			}
+		}
+	}
+	return nil
+}
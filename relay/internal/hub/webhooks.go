@@ -0,0 +1,29 @@
+package hub
+
+import (
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/webhooks"
+)
+
+// SetWebhooks has extensions identifying themselves, disconnecting, and
+// failed commands reported to n. Call it before the server starts.
+func (h *Hub) SetWebhooks(n *webhooks.Notifier) {
+	h.webhooks = n
+}
+
+// notifySession sends extension_connected or extension_disconnected
+func (h *Hub) notifySession(event string, s *models.Session) {
+	if h.webhooks == nil {
+		return
+	}
+	name, extensionVer, client := s.Info()
+	h.webhooks.Notify(event, models.WebhookSession{
+		SessionID:        s.ID,
+		TokenName:        s.TokenName,
+		Name:             name,
+		ExtensionVersion: extensionVer,
+		Client:           client,
+		ConnectedAt:      s.ConnectedAt,
+		Node:             s.Node,
+	})
+}
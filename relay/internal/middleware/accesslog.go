@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/accesslog"
+)
+
+// AccessLog writes one line per request to logger at level, with the token
+// and command details the handlers record along the way
+func AccessLog(logger zerolog.Logger, level zerolog.Level) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			entry := &accesslog.Entry{}
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				ev := logger.WithLevel(level).
+					Str("method", r.Method).
+					Str("path", r.URL.Path)
+				if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+					ev.Str("route", rc.RoutePattern())
+				}
+				ev.Int("status", status).
+					Int("bytes", ww.BytesWritten()).
+					Float64("latency_ms", float64(time.Since(start).Microseconds())/1000).
+					Str("remote_ip", r.RemoteAddr).
+					Str("request_id", chimiddleware.GetReqID(r.Context()))
+				if ua := r.UserAgent(); ua != "" {
+					ev.Str("user_agent", ua)
+				}
+				// Set by Trace, which runs inside this middleware
+				if id := ww.Header().Get("X-Trace-Id"); id != "" {
+					ev.Str("trace_id", id)
+				}
+				entry.AppendTo(ev)
+				ev.Msg("request")
+			}()
+			next.ServeHTTP(ww, r.WithContext(accesslog.NewContext(r.Context(), entry)))
+		})
+	}
+}
@@ -5,9 +5,15 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/accesslog"
 	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/oidc"
 	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
 )
 
 // Context keys
@@ -34,10 +40,13 @@ func TokenHashFromContext(ctx context.Context) string {
 	return ""
 }
 
-// Auth creates an authentication middleware
-func Auth(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
+// Auth creates an authentication middleware. With verifier set, JWTs from
+// the OIDC issuer are accepted as well as owl_ tokens.
+func Auth(tokenStore *store.TokenStore, verifier *oidc.Verifier) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
 			// Extract token from Authorization header
 			authHeader := r.Header.Get("Authorization")
 			if authHeader == "" {
@@ -53,13 +62,17 @@ func Auth(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
 			}
 
 			tokenString := parts[1]
-			if !strings.HasPrefix(tokenString, "owl_") {
+			var token *models.Token
+			var err error
+			switch {
+			case strings.HasPrefix(tokenString, "owl_"):
+				token, err = tokenStore.Validate(tokenString)
+			case verifier != nil && oidc.LooksLikeJWT(tokenString):
+				token, err = jwtToken(r.Context(), tokenStore, verifier, tokenString)
+			default:
 				writeAuthError(w, "Invalid token format")
 				return
 			}
-
-			// Validate token
-			token, err := tokenStore.Validate(tokenString)
 			if err != nil {
 				writeAuthError(w, "Token validation failed")
 				return
@@ -69,8 +82,16 @@ func Auth(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
 				return
 			}
 
-			// Compute hash for hub lookup
-			tokenHash := store.HashToken(tokenString)
+			// The hub knows the token by its identity, which a rotation
+			// does not change
+			tokenHash := token.Hash
+
+			timing.FromContext(r.Context()).Since(timing.Auth, start)
+			if token.Subject != "" {
+				accesslog.FromContext(r.Context()).SetToken(token.Name + " (" + token.Subject + ")")
+			} else {
+				accesslog.FromContext(r.Context()).SetToken(token.Name)
+			}
 
 			// Add token and hash to context
 			ctx := context.WithValue(r.Context(), TokenContextKey, token)
@@ -80,6 +101,56 @@ func Auth(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
 	}
 }
 
+// jwtToken verifies a JWT and returns the token it acts as, limited to the
+// scopes both grant, or nil if the JWT is not accepted
+func jwtToken(ctx context.Context, tokenStore *store.TokenStore, verifier *oidc.Verifier, raw string) (*models.Token, error) {
+	claims, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		log.Debug().Err(err).Msg("Rejected OIDC token")
+		return nil, nil
+	}
+	name := verifier.TokenName(claims)
+	if name == "" {
+		log.Debug().Str("sub", claims.Subject).Msg("OIDC token names no relay token")
+		return nil, nil
+	}
+	token, err := tokenStore.ByName(name)
+	if err != nil || token == nil {
+		return nil, err
+	}
+
+	var scopes []string
+	for _, scope := range verifier.Scopes(claims) {
+		if models.IsValidScope(scope) && token.HasScope(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	token.Scopes = scopes
+	token.Subject = claims.Subject
+	return token, nil
+}
+
+// RequireScope rejects requests whose token lacks the given scope
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := TokenFromContext(r.Context())
+			if token == nil || !token.HasScope(scope) {
+				WriteForbidden(w, "Token lacks required scope: "+scope)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WriteForbidden writes a 403 scope violation error
+func WriteForbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`{"error":{"code":"FORBIDDEN","message":"` + message + `"}}`))
+}
+
 func writeAuthError(w http.ResponseWriter, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusUnauthorized)
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// MaxBody caps request bodies at max bytes (MAX_REQUEST_BODY). Requests
+// declaring a larger Content-Length are answered 413 REQUEST_TOO_LARGE
+// up front; bodies that turn out larger fail to read with
+// *http.MaxBytesError, which handlers report the same way. Requests to the
+// exempt paths, which carry files, are left to their handlers to limit.
+func MaxBody(max int64, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if max <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength > max {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte(`{"error":{"code":"REQUEST_TOO_LARGE","message":"Request body exceeds ` +
+					strconv.FormatInt(max, 10) + ` bytes (MAX_REQUEST_BODY)"}}`))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
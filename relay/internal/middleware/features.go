@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/features"
+)
+
+// RequireFeature hides a route unless the feature flag is on for the
+// request's token, either relay-wide or through the token's override
+func RequireFeature(enabled map[string]bool, name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := TokenFromContext(r.Context())
+			if token == nil {
+				writeAuthError(w, "Invalid token")
+				return
+			}
+			if on, _ := features.Resolve(enabled, token.Features, name); !on {
+				WriteFeatureDisabled(w, name)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WriteFeatureDisabled writes a 404 for a feature the token cannot use
+func WriteFeatureDisabled(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"error":{"code":"FEATURE_DISABLED","message":"Feature ` + name + ` is not enabled for this token"}}`))
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+)
+
+// IPLimits throttles the endpoints reachable without a token, per client
+// IP: a request rate for the paths given to RateLimit, and a cap on
+// WebSocket handshakes in progress. Without them a client could guess
+// tokens or hold sockets open without ever authenticating.
+type IPLimits struct {
+	buckets *RateLimiter // nil when IP_RATE_LIMIT is 0
+	limit   int
+	burst   int
+
+	maxHandshakes int // 0 disables
+	mu            sync.Mutex
+	handshakes    map[string]int // IP → handshakes in progress
+
+	limited, refused atomic.Int64
+}
+
+// IPLimitStats counts requests turned away by the per-IP limits
+type IPLimitStats struct {
+	Limited int64 // rejected with 429 by IP_RATE_LIMIT
+	Refused int64 // WebSocket handshakes over WS_MAX_HANDSHAKES_PER_IP
+}
+
+// NewIPLimits creates the per-IP limits from IP_RATE_LIMIT, IP_RATE_BURST
+// and WS_MAX_HANDSHAKES_PER_IP
+func NewIPLimits(cfg *config.Config) *IPLimits {
+	l := &IPLimits{
+		limit:         cfg.IPRateLimit,
+		burst:         cfg.IPRateBurst,
+		maxHandshakes: cfg.WSMaxHandshakesPerIP,
+		handshakes:    make(map[string]int),
+	}
+	if l.burst <= 0 {
+		l.burst = l.limit
+	}
+	if l.limit > 0 {
+		l.buckets = NewRateLimiter(time.Minute, 0)
+	}
+	return l
+}
+
+// ClientIP returns the address a request came from: the one RealIP found
+// in the headers of a trusted proxy, else the socket's
+func ClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// RateLimit answers requests to the given paths with 429 RATE_LIMITED once
+// their IP has used up its bucket
+func (l *IPLimits) RateLimit(paths ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l.buckets == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(paths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			d := l.buckets.take(ClientIP(r), l.limit, l.burst, 0)
+			if !d.allowed {
+				l.limited.Add(1)
+				retryAfter := max(ceilSeconds(d.retryAfter), 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"error":{"code":"RATE_LIMITED","message":"Too many requests from this address","retryAfter":` + strconv.Itoa(retryAfter) + `}}`))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BeginHandshake counts a WebSocket handshake from the request's IP. It
+// reports false when the IP already has WS_MAX_HANDSHAKES_PER_IP in
+// progress; otherwise release must be called once the upgrade is done or
+// abandoned, and may be called more than once.
+func (l *IPLimits) BeginHandshake(r *http.Request) (release func(), ok bool) {
+	if l.maxHandshakes <= 0 {
+		return func() {}, true
+	}
+	ip := ClientIP(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.handshakes[ip] >= l.maxHandshakes {
+		l.refused.Add(1)
+		return nil, false
+	}
+	l.handshakes[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.handshakes[ip]--; l.handshakes[ip] <= 0 {
+				delete(l.handshakes, ip)
+			}
+		})
+	}, true
+}
+
+// Stats returns how many requests the limits turned away
+func (l *IPLimits) Stats() IPLimitStats {
+	return IPLimitStats{Limited: l.limited.Load(), Refused: l.refused.Load()}
+}
@@ -1,39 +1,165 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
 	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
 )
 
-// RateLimiter implements in-memory rate limiting
+// Limiter is per-token rate limiting middleware, in memory or shared
+// through Redis (RATE_LIMIT_BACKEND)
+type Limiter interface {
+	RateLimit(tokenStore *store.TokenStore) func(http.Handler) http.Handler
+	Stats() RateLimitStats
+	// OnLimited has fn called for each request rejected with 429. Call it
+	// before the server starts.
+	OnLimited(fn LimitedFunc)
+	// Configure changes RATE_LIMIT_WINDOW and RATE_LIMIT_WARN_PERCENT on a
+	// config reload; buckets keep their contents
+	Configure(window time.Duration, warnAt int)
+}
+
+// LimitedFunc is told the token of a rejected request, its limit, and the
+// seconds until it may retry
+type LimitedFunc func(token *models.Token, limit, retryAfter int)
+
+// RateLimitStats counts requests by how the rate limit treated them
+type RateLimitStats struct {
+	Warned  int64 // let through past RATE_LIMIT_WARN_PERCENT of the bucket
+	Debt    int64 // let through on burst debt
+	Limited int64 // rejected with 429
+}
+
+type rateCounters struct {
+	warned, debt, limited atomic.Int64
+
+	onLimited LimitedFunc // nil when not set
+}
+
+func (c *rateCounters) stats() RateLimitStats {
+	return RateLimitStats{Warned: c.warned.Load(), Debt: c.debt.Load(), Limited: c.limited.Load()}
+}
+
+// rateSettings are the limiter's settings a config reload may change
+type rateSettings struct {
+	window atomic.Int64 // nanoseconds
+	warnAt atomic.Int64 // percent of the bucket; 0 disables warnings
+}
+
+func (s *rateSettings) set(window time.Duration, warnAt int) {
+	s.window.Store(int64(window))
+	s.warnAt.Store(int64(warnAt))
+}
+
+func (s *rateSettings) windowDuration() time.Duration {
+	return time.Duration(s.window.Load())
+}
+
+// NewLimiter creates the Limiter selected by RATE_LIMIT_BACKEND, following
+// config reloads
+func NewLimiter(cfg *config.Config) (Limiter, error) {
+	window := time.Duration(cfg.RateLimitWindow) * time.Second
+	var l Limiter
+	var err error
+	switch cfg.RateLimitBackend {
+	case "memory":
+		l = NewRateLimiter(window, cfg.RateLimitWarnPercent)
+	case "redis":
+		if l, err = NewRedisRateLimiter(cfg.RedisURL, window, cfg.RateLimitWarnPercent); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND: %s", cfg.RateLimitBackend)
+	}
+	cfg.OnReload(func(c *config.Config) {
+		l.Configure(time.Duration(c.RateLimitWindow)*time.Second, c.RateLimitWarnPercent)
+	})
+	return l, nil
+}
+
+// RateLimiter implements in-memory token-bucket rate limiting. Each token
+// refills at RateLimit requests per window and holds at most RateBurst, so
+// clients that hit the limit are let back in one request at a time rather
+// than all at once when a fixed window resets. A token with RateDebt may
+// overdraw its empty bucket by that many requests, which the refill pays
+// back before the bucket counts as having room again.
 type RateLimiter struct {
-	mu       sync.RWMutex
-	limits   map[string]*tokenLimit
+	mu       sync.Mutex
+	buckets  map[string]*bucket
 	cleanup  time.Duration
+	settings rateSettings
+	counts   rateCounters
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	fullAt  time.Time
 }
 
-type tokenLimit struct {
-	count    int
-	resetAt  time.Time
+// rateDecision is the outcome of taking one request from a bucket
+type rateDecision struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	owed       int           // requests of debt the bucket is below empty
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next request is allowed
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter() *RateLimiter {
+// NewRateLimiter creates a new rate limiter whose limits apply per window.
+// Responses warn once warnAt percent of a bucket is used (0 disables).
+func NewRateLimiter(window time.Duration, warnAt int) *RateLimiter {
 	rl := &RateLimiter{
-		limits:  make(map[string]*tokenLimit),
+		buckets: make(map[string]*bucket),
 		cleanup: time.Minute * 5,
 	}
+	rl.settings.set(window, warnAt)
 	go rl.cleanupLoop()
 	return rl
 }
 
-// RateLimit creates a rate limiting middleware
+// RateLimit creates a rate limiting middleware. Every response carries
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset.
 func (rl *RateLimiter) RateLimit(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
 	_ = tokenStore // Reserved for future use
+	return rateLimitBy(&rl.settings, &rl.counts, func(_ context.Context, key string, limit, burst, debt int) (rateDecision, error) {
+		return rl.take(key, limit, burst, debt), nil
+	})
+}
+
+// Stats returns the limiter's request counts
+func (rl *RateLimiter) Stats() RateLimitStats {
+	return rl.counts.stats()
+}
+
+// OnLimited has fn called for each request rejected with 429
+func (rl *RateLimiter) OnLimited(fn LimitedFunc) {
+	rl.counts.onLimited = fn
+}
+
+// Configure changes the window and warning threshold
+func (rl *RateLimiter) Configure(window time.Duration, warnAt int) {
+	rl.settings.set(window, warnAt)
+}
+
+// rateLimitBy builds the middleware shared by every Limiter around its
+// bucket operation. Requests let through past the warning percentage of the
+// bucket, or on debt, carry X-RateLimit-Warning so clients can slow down
+// before they are rejected.
+func rateLimitBy(settings *rateSettings, counts *rateCounters, take func(ctx context.Context, key string, limit, burst, debt int) (rateDecision, error)) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			token := TokenFromContext(r.Context())
@@ -50,56 +176,100 @@ func (rl *RateLimiter) RateLimit(tokenStore *store.TokenStore) func(http.Handler
 			if limit <= 0 {
 				limit = 100 // Default
 			}
+			burst := token.RateBurst
+			if burst <= 0 {
+				burst = limit
+			}
 
-			if !rl.allow(key, limit) {
-				retryAfter := rl.getRetryAfter(key)
+			start := time.Now()
+			d, err := take(r.Context(), key, limit, burst, max(token.RateDebt, 0))
+			timing.FromContext(r.Context()).Since(timing.RateLimit, start)
+			if err != nil {
+				// Fail open: an unreachable backend must not take the API down
+				log.Warn().Err(err).Str("token", key).Msg("Rate limiter unavailable")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(d.limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+
+			if d.owed > 0 {
+				w.Header().Set("X-RateLimit-Debt", strconv.Itoa(d.owed))
+			}
+
+			if !d.allowed {
+				counts.limited.Add(1)
+				retryAfter := max(ceilSeconds(d.retryAfter), 1)
 				w.Header().Set("Content-Type", "application/json")
 				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 				w.WriteHeader(http.StatusTooManyRequests)
 				w.Write([]byte(`{"error":{"code":"RATE_LIMITED","message":"Too many requests","retryAfter":` + strconv.Itoa(retryAfter) + `}}`))
+				if counts.onLimited != nil {
+					counts.onLimited(token, d.limit, retryAfter)
+				}
 				return
 			}
 
+			warnAt := int(settings.warnAt.Load())
+			switch {
+			case d.owed > 0:
+				counts.debt.Add(1)
+				w.Header().Set("X-RateLimit-Warning", fmt.Sprintf(
+					"Rate limit exceeded; running on burst debt (%d of %d requests owed)", d.owed, max(token.RateDebt, 0)))
+			case warnAt > 0 && (burst-d.remaining)*100 >= burst*warnAt:
+				counts.warned.Add(1)
+				w.Header().Set("X-RateLimit-Warning", fmt.Sprintf(
+					"%d%% of the rate limit used; slow down to avoid 429s", (burst-d.remaining)*100/burst))
+			}
+
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func (rl *RateLimiter) allow(key string, limit int) bool {
+func (rl *RateLimiter) take(key string, limit, burst, debt int) rateDecision {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
 	now := time.Now()
-	windowDuration := time.Minute
+	perSecond := float64(limit) / rl.settings.windowDuration().Seconds()
 
-	tl, exists := rl.limits[key]
-	if !exists || tl.resetAt.Before(now) {
-		rl.limits[key] = &tokenLimit{
-			count:   1,
-			resetAt: now.Add(windowDuration),
-		}
-		return true
+	b, exists := rl.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(burst), updated: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+		b.updated = now
 	}
 
-	if tl.count >= limit {
-		return false
+	// The bucket may go down to -debt
+	floor := 1 - float64(debt)
+	d := rateDecision{limit: limit}
+	if b.tokens >= floor {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = secondsToDuration((floor - b.tokens) / perSecond)
 	}
 
-	tl.count++
-	return true
+	d.remaining = max(int(math.Floor(b.tokens)), 0)
+	if b.tokens < 0 {
+		d.owed = int(math.Ceil(-b.tokens))
+	}
+	d.reset = secondsToDuration((float64(burst) - b.tokens) / perSecond)
+	b.fullAt = now.Add(d.reset)
+	return d
 }
 
-func (rl *RateLimiter) getRetryAfter(key string) int {
-	rl.mu.RLock()
-	defer rl.mu.RUnlock()
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
 
-	if tl, exists := rl.limits[key]; exists {
-		remaining := time.Until(tl.resetAt)
-		if remaining > 0 {
-			return int(remaining.Seconds()) + 1
-		}
-	}
-	return 1
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
 
 func (rl *RateLimiter) cleanupLoop() {
@@ -107,9 +277,10 @@ func (rl *RateLimiter) cleanupLoop() {
 	for range ticker.C {
 		rl.mu.Lock()
 		now := time.Now()
-		for key, tl := range rl.limits {
-			if tl.resetAt.Before(now) {
-				delete(rl.limits, key)
+		for key, b := range rl.buckets {
+			// A full bucket is the same as no bucket
+			if b.fullAt.Before(now) {
+				delete(rl.buckets, key)
 			}
 		}
 		rl.mu.Unlock()
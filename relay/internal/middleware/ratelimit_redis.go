@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/redis"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+// redisBucketTTLGrace keeps a bucket key around a little past the moment it
+// would be full again, after which a missing key means the same thing
+const redisBucketTTLGrace = time.Second
+
+// takeScript is the token bucket of RateLimiter run atomically in Redis,
+// using the server clock so every relay sees the same time.
+// KEYS[1] bucket; ARGV limit, burst, window (ms), TTL grace (ms), debt.
+// Returns {allowed, remaining, reset ms, retry-after ms, owed}.
+var takeScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local rate = limit / tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local floor = 1 - tonumber(ARGV[5])
+local allowed, retry = 0, 0
+if tokens >= floor then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((floor - tokens) / rate)
+end
+local reset = math.ceil((burst - tokens) / rate)
+local owed = 0
+if tokens < 0 then
+  owed = math.ceil(-tokens)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], reset + tonumber(ARGV[4]))
+return {allowed, math.max(math.floor(tokens), 0), reset, retry, owed}
+`)
+
+// RedisRateLimiter enforces the same token buckets as RateLimiter, kept in
+// Redis so every relay behind a load balancer shares them
+type RedisRateLimiter struct {
+	client   *redis.Client
+	prefix   string
+	settings rateSettings
+	counts   rateCounters
+}
+
+// NewRedisRateLimiter creates a limiter backed by the Redis at redisURL.
+// Responses warn once warnAt percent of a bucket is used (0 disables).
+func NewRedisRateLimiter(redisURL string, window time.Duration, warnAt int) (*RedisRateLimiter, error) {
+	if redisURL == "" {
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND=redis requires REDIS_URL")
+	}
+	client, err := redis.New(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail startup on a bad address or credentials rather than on the first request
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Do(ctx, "PING"); err != nil {
+		return nil, fmt.Errorf("failed to reach redis: %w", err)
+	}
+
+	rl := &RedisRateLimiter{client: client, prefix: "owlrelay:ratelimit:"}
+	rl.settings.set(window, warnAt)
+	return rl, nil
+}
+
+// RateLimit creates a rate limiting middleware. Every response carries
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset. Requests
+// are let through, with a warning logged, while Redis is unreachable.
+func (rl *RedisRateLimiter) RateLimit(tokenStore *store.TokenStore) func(http.Handler) http.Handler {
+	_ = tokenStore // Reserved for future use
+	return rateLimitBy(&rl.settings, &rl.counts, rl.take)
+}
+
+// Stats returns this relay's request counts; other relays keep their own
+func (rl *RedisRateLimiter) Stats() RateLimitStats {
+	return rl.counts.stats()
+}
+
+// OnLimited has fn called for each request this relay rejects with 429
+func (rl *RedisRateLimiter) OnLimited(fn LimitedFunc) {
+	rl.counts.onLimited = fn
+}
+
+// Configure changes the window and warning threshold
+func (rl *RedisRateLimiter) Configure(window time.Duration, warnAt int) {
+	rl.settings.set(window, warnAt)
+}
+
+func (rl *RedisRateLimiter) take(ctx context.Context, key string, limit, burst, debt int) (rateDecision, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	reply, err := takeScript.Run(ctx, rl.client, []string{rl.prefix + key},
+		limit, burst, rl.settings.windowDuration().Milliseconds(), redisBucketTTLGrace.Milliseconds(), debt)
+	if err != nil {
+		return rateDecision{}, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 5 {
+		return rateDecision{}, fmt.Errorf("unexpected rate limit reply: %v", reply)
+	}
+	n := make([]int64, 5)
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return rateDecision{}, fmt.Errorf("unexpected rate limit reply: %v", reply)
+		}
+	}
+
+	return rateDecision{
+		allowed:    n[0] == 1,
+		limit:      limit,
+		remaining:  int(n[1]),
+		owed:       int(n[4]),
+		reset:      time.Duration(n[2]) * time.Millisecond,
+		retryAfter: time.Duration(n[3]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RealIP sets a request's remote address to the client behind the trusted
+// proxies in TRUSTED_PROXIES. Only requests whose socket peer is one of
+// them are changed. X-Forwarded-For is read from the right, where each
+// proxy appends the address it saw, skipping the trusted proxies, so a
+// client cannot prepend an address of its choosing; X-Real-IP is used
+// when there is no X-Forwarded-For. With no trusted proxies the headers
+// are ignored.
+func RealIP(proxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(proxies) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peer, ok := parseIP(ClientIP(r)); ok && trusted(proxies, peer) {
+				if ip := forwardedFor(r, proxies); ip != "" {
+					r.RemoteAddr = net.JoinHostPort(ip, "0")
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor returns the address the nearest untrusted hop connected
+// from, or "" when the headers name none
+func forwardedFor(r *http.Request, proxies []netip.Prefix) string {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		return forwardedHop(strings.Split(strings.Join(xff, ","), ","), proxies)
+	}
+	if ip, ok := parseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ok {
+		return ip.String()
+	}
+	return ""
+}
+
+// forwardedHop walks X-Forwarded-For from the right past the trusted
+// proxies
+func forwardedHop(hops []string, proxies []netip.Prefix) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseIP(strings.TrimSpace(hops[i]))
+		if !ok {
+			// Anything left of a hop we cannot read is the client's to forge
+			return ""
+		}
+		if !trusted(proxies, ip) || i == 0 {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func parseIP(s string) (netip.Addr, bool) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+func trusted(proxies []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestForwardedHop(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name string
+		xff  string
+		want string
+	}{
+		{"single client", "203.0.113.7", "203.0.113.7"},
+		{"client behind trusted hops", "203.0.113.7, 10.0.0.2, 10.0.0.3", "203.0.113.7"},
+		{"forged entries left of the client", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"every hop trusted", "10.0.0.9, 10.0.0.2", "10.0.0.9"},
+		{"unparsable hop", "203.0.113.7, unknown, 10.0.0.2", ""},
+		{"unparsable hop left of the client", "garbage, 203.0.113.7", "203.0.113.7"},
+		{"empty hop", "203.0.113.7,,10.0.0.2", ""},
+		{"ipv4-mapped hop", "::ffff:203.0.113.7, ::ffff:10.0.0.2", "203.0.113.7"},
+		{"ipv6 client", "2001:db8::1, 10.0.0.2", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwardedHop(strings.Split(tt.xff, ","), proxies); got != tt.want {
+				t.Errorf("forwardedHop(%q) = %q, want %q", tt.xff, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	tests := []struct {
+		name    string
+		proxies []netip.Prefix
+		peer    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:    "no trusted proxies",
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			want:    "10.0.0.1:5000",
+		},
+		{
+			name:    "untrusted peer with a forged header",
+			proxies: proxies,
+			peer:    "198.51.100.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Real-Ip": {"203.0.113.8"}},
+			want:    "198.51.100.1:5000",
+		},
+		{
+			name:    "trusted peer",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			name:    "multiple trusted hops across headers",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1, 203.0.113.7", "10.0.0.3"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			name:    "unparsable hop",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7, unknown"}},
+			want:    "10.0.0.1:5000",
+		},
+		{
+			name:    "x-real-ip without x-forwarded-for",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Real-Ip": {" 203.0.113.8 "}},
+			want:    "203.0.113.8:0",
+		},
+		{
+			name:    "x-forwarded-for wins over x-real-ip",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}, "X-Real-Ip": {"203.0.113.8"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			name:    "unparsable x-real-ip",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			headers: map[string][]string{"X-Real-Ip": {"localhost"}},
+			want:    "10.0.0.1:5000",
+		},
+		{
+			name:    "no headers",
+			proxies: proxies,
+			peer:    "10.0.0.1:5000",
+			want:    "10.0.0.1:5000",
+		},
+		{
+			name:    "ipv4-mapped trusted peer",
+			proxies: proxies,
+			peer:    "[::ffff:10.0.0.1]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			want:    "203.0.113.7:0",
+		},
+		{
+			name:    "ipv4-mapped untrusted peer",
+			proxies: proxies,
+			peer:    "[::ffff:198.51.100.1]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.7"}},
+			want:    "[::ffff:198.51.100.1]:5000",
+		},
+		{
+			name:    "ipv6 proxy and client",
+			proxies: proxies,
+			peer:    "[fd00::1]:5000",
+			headers: map[string][]string{"X-Forwarded-For": {"2001:db8::1"}},
+			want:    "[2001:db8::1]:0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := RealIP(tt.proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = tt.peer
+			for name, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(name, v)
+				}
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+)
+
+// timeoutGrace leaves room to write the timeout response after the request
+// deadline passes
+const timeoutGrace = time.Second
+
+// Timeout is the hard ceiling on any HTTP request. It cancels the request
+// context after max and, if the handler has not written anything by then,
+// answers 504 with a REQUEST_TIMEOUT error.
+//
+// It also lifts the server's default write deadline to max, so handlers can
+// shorten it to match their own work (see handlers' commandContext).
+func Timeout(max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), max)
+			defer cancel()
+
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(max + timeoutGrace))
+
+			ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if ctx.Err() == context.DeadlineExceeded && ww.Status() == 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusGatewayTimeout)
+				w.Write([]byte(`{"error":{"code":"REQUEST_TIMEOUT","message":"Request exceeded the ` +
+					strconv.Itoa(int(max.Seconds())) + `s limit (HTTP_TIMEOUT_MAX)"}}`))
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/timing"
+)
+
+// DebugTiming records where the request's time goes when it carries
+// ?debugTiming=1. It runs before Auth so that phase is included.
+func DebugTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("debugTiming") != "1" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := timing.NewContext(r.Context(), timing.New())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	chimiddleware "github.com/go-chi/chi/v5/middleware"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
+)
+
+// Trace records each request as a server span, continuing the trace of an
+// incoming traceparent header. Traced responses carry X-Trace-Id.
+func Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.ContextWithTraceParent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := tracing.Start(ctx, r.Method, tracing.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Trace-Id", span.TraceID())
+
+		ww := chimiddleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		defer func() {
+			// Named by route rather than path, so IDs do not make every
+			// request a span name of its own
+			if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rc.RoutePattern())
+				span.SetAttr("http.route", rc.RoutePattern())
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttr("http.request.method", r.Method)
+			span.SetAttr("url.path", r.URL.Path)
+			span.SetAttr("http.response.status_code", status)
+			if status >= 500 {
+				span.SetError(http.StatusText(status))
+			}
+			span.End()
+		}()
+		next.ServeHTTP(ww, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,19 @@
+package models
+
+import "fmt"
+
+// ValidateCapture checks what part of the tab a screenshot keeps: one
+// element, or a clip of the viewport, but not both, and neither with a full
+// page capture
+func (a *CommandAction) ValidateCapture() error {
+	if a.Selector != "" && a.Clip != nil {
+		return fmt.Errorf("set selector or clip, not both")
+	}
+	if a.FullPage && (a.Selector != "" || a.Clip != nil) {
+		return fmt.Errorf("fullPage cannot be combined with selector or clip")
+	}
+	if c := a.Clip; c != nil && (c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0) {
+		return fmt.Errorf("clip needs a non-negative x and y and a positive width and height")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// maxCredentialField bounds the length of a username or password
+const maxCredentialField = 1024
+
+// Credential answers the HTTP basic and digest auth challenges of one
+// origin in a tab, in place of the browser's sign-in dialog
+type Credential struct {
+	Origin   string `json:"origin"` // scheme://host[:port]
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"` // never returned
+}
+
+// SetCredentialRequest for POST /api/v1/credentials
+type SetCredentialRequest struct {
+	TabID string `json:"tabId"`
+	Credential
+}
+
+// CredentialsResponse for /api/v1/credentials: the origins the tab has
+// credentials for, without their passwords
+type CredentialsResponse struct {
+	TabID       string       `json:"tabId"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// Validate checks a credential and reduces its origin to scheme://host
+func (c *Credential) Validate() error {
+	origin, err := NormalizeOrigin(c.Origin)
+	if err != nil {
+		return err
+	}
+	c.Origin = origin
+	switch {
+	case c.Username == "":
+		return fmt.Errorf("username is required")
+	case len(c.Username) > maxCredentialField || len(c.Password) > maxCredentialField:
+		return fmt.Errorf("username and password must be at most %d characters", maxCredentialField)
+	case strings.Contains(c.Username, ":"):
+		// Basic auth joins them with a colon
+		return fmt.Errorf("username must not contain a colon")
+	}
+	return nil
+}
+
+// NormalizeOrigin returns an http or https origin as scheme://host[:port],
+// lowercased, without a default port
+func NormalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" ||
+		u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("origin must be an http or https origin such as https://intranet.example.com")
+	}
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		host = strings.ToLower(u.Hostname())
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	return u.Scheme + "://" + host, nil
+}
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Emulation is what a tab reports about where and in which language its
+// user is. Each field left out is not emulated.
+type Emulation struct {
+	Geolocation *Geolocation `json:"geolocation,omitempty"`
+	Timezone    string       `json:"timezone,omitempty"` // IANA time zone, e.g. "Europe/Istanbul"
+	Locale      string       `json:"locale,omitempty"`   // BCP 47 language tag, e.g. "tr-TR"
+	// AcceptLanguage is sent as the Accept-Language header and read as
+	// navigator.languages; without it, it is derived from Locale
+	AcceptLanguage string `json:"acceptLanguage,omitempty"`
+}
+
+// Geolocation is the position a tab reports to the Geolocation API
+type Geolocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  float64 `json:"accuracy,omitempty"` // meters; default 100
+}
+
+var (
+	timezonePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+-]*(/[A-Za-z0-9_+-]+){0,2}$`)
+	localePattern   = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+)
+
+// Validate checks the shape of each emulated value; the browser decides
+// whether it knows the timezone or locale
+func (e *Emulation) Validate() error {
+	if g := e.Geolocation; g != nil {
+		switch {
+		case g.Latitude < -90 || g.Latitude > 90:
+			return fmt.Errorf("geolocation latitude must be between -90 and 90")
+		case g.Longitude < -180 || g.Longitude > 180:
+			return fmt.Errorf("geolocation longitude must be between -180 and 180")
+		case g.Accuracy < 0:
+			return fmt.Errorf("geolocation accuracy must not be negative")
+		}
+	}
+	if e.Timezone != "" && !timezonePattern.MatchString(e.Timezone) {
+		return fmt.Errorf("timezone must be an IANA time zone such as Europe/Istanbul")
+	}
+	if e.Locale != "" && !localePattern.MatchString(e.Locale) {
+		return fmt.Errorf("locale must be a language tag such as tr-TR")
+	}
+	if len(e.AcceptLanguage) > 256 || strings.ContainsAny(e.AcceptLanguage, "\r\n") {
+		return fmt.Errorf("acceptLanguage must be a single line of at most 256 characters")
+	}
+	return nil
+}
+
+// Viewport is the screen a tab lays its pages out for, as a device would
+// report it
+type Viewport struct {
+	Width             int     `json:"width"`                       // CSS pixels
+	Height            int     `json:"height"`                      // CSS pixels
+	DeviceScaleFactor float64 `json:"deviceScaleFactor,omitempty"` // 0 keeps the display's own
+	Mobile            bool    `json:"mobile,omitempty"`            // mobile layout and touch input
+	UserAgent         string  `json:"userAgent,omitempty"`
+}
+
+// MaxViewportSize bounds a viewport's width and height
+const MaxViewportSize = 10000
+
+// Validate checks a viewport to be set
+func (v *Viewport) Validate() error {
+	switch {
+	case v.Width < 1 || v.Width > MaxViewportSize || v.Height < 1 || v.Height > MaxViewportSize:
+		return fmt.Errorf("viewport width and height must be between 1 and %d", MaxViewportSize)
+	case v.DeviceScaleFactor < 0 || v.DeviceScaleFactor > 10:
+		return fmt.Errorf("viewport deviceScaleFactor must be between 0 and 10")
+	case len(v.UserAgent) > 1024 || strings.ContainsAny(v.UserAgent, "\r\n"):
+		return fmt.Errorf("viewport userAgent must be a single line of at most 1024 characters")
+	}
+	return nil
+}
+
+// NetworkConditions is the connection a tab's requests get. A Preset
+// fills in the fields left zero.
+type NetworkConditions struct {
+	Preset             string `json:"preset,omitempty"` // offline, slow_3g, fast_3g, fast_4g
+	Offline            bool   `json:"offline,omitempty"`
+	Latency            int    `json:"latency,omitempty"`            // ms added to each request
+	DownloadThroughput int    `json:"downloadThroughput,omitempty"` // bytes/s; 0 is unlimited
+	UploadThroughput   int    `json:"uploadThroughput,omitempty"`   // bytes/s; 0 is unlimited
+}
+
+// MaxNetworkLatency bounds the latency added to each request, in ms
+const MaxNetworkLatency = 60000
+
+// networkPresets are the connections DevTools throttles to
+var networkPresets = map[string]NetworkConditions{
+	"offline": {Offline: true},
+	"slow_3g": {Latency: 2000, DownloadThroughput: 50000, UploadThroughput: 50000},
+	"fast_3g": {Latency: 563, DownloadThroughput: 180000, UploadThroughput: 84375},
+	"fast_4g": {Latency: 165, DownloadThroughput: 1012500, UploadThroughput: 168750},
+}
+
+// Validate checks network conditions to be set
+func (n *NetworkConditions) Validate() error {
+	if _, ok := networkPresets[n.Preset]; n.Preset != "" && !ok {
+		return fmt.Errorf("networkConditions preset must be offline, slow_3g, fast_3g, or fast_4g")
+	}
+	switch {
+	case n.Latency < 0 || n.Latency > MaxNetworkLatency:
+		return fmt.Errorf("networkConditions latency must be between 0 and %d", MaxNetworkLatency)
+	case n.DownloadThroughput < 0 || n.UploadThroughput < 0:
+		return fmt.Errorf("networkConditions throughput must not be negative")
+	}
+	return nil
+}
+
+// ApplyPreset fills in the fields its Preset sets and n leaves zero
+func (n *NetworkConditions) ApplyPreset() {
+	preset, ok := networkPresets[n.Preset]
+	if !ok {
+		return
+	}
+	n.Offline = n.Offline || preset.Offline
+	if n.Latency == 0 {
+		n.Latency = preset.Latency
+	}
+	if n.DownloadThroughput == 0 {
+		n.DownloadThroughput = preset.DownloadThroughput
+	}
+	if n.UploadThroughput == 0 {
+		n.UploadThroughput = preset.UploadThroughput
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+import "fmt"
+
+// How deep an evaluated value is serialized when the request does not say,
+// and the deepest it may ask for
+const (
+	DefaultEvaluateDepth = 10
+	MaxEvaluateDepth     = 32
+)
+
+// ValidateEvaluate checks an evaluate action: a script, and a depth within
+// MaxEvaluateDepth
+func (a *CommandAction) ValidateEvaluate() error {
+	if a.Script == "" {
+		return fmt.Errorf("script is required")
+	}
+	if a.MaxDepth < 0 || a.MaxDepth > MaxEvaluateDepth {
+		return fmt.Errorf("maxDepth must be between 1 and %d", MaxEvaluateDepth)
+	}
+	return nil
+}
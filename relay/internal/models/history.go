@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// Why a session ended, as recorded in the session history
+const (
+	DisconnectClosed        = "closed"               // the extension closed the connection
+	DisconnectLost          = "connection_lost"      // the connection dropped without a close
+	DisconnectPingTimeout   = "ping_timeout"         // no pong within WS_PONG_TIMEOUT
+	DisconnectWriteFailed   = "write_failed"         // a message could not be written
+	DisconnectReplaced      = "replaced"             // a newer session went over MAX_SESSIONS_PER_TOKEN
+	DisconnectRateLimited   = "rate_limited"         // WS_RATE_LIMIT_STRIKES reached
+	DisconnectTooLarge      = "message_too_big"      // a message over the hard size limit
+	DisconnectProtocol      = "unsupported_protocol" // refused in the connect handshake
+	DisconnectShutdown      = "server_shutdown"      // the relay shut down
+	DisconnectRelayStopped  = "relay_stopped"        // the relay stopped without closing the session
+	DisconnectUnknownReason = "unknown"
+)
+
+// SessionRecord is one extension connection in the session history
+type SessionRecord struct {
+	ID               string     `json:"id"`
+	TokenName        string     `json:"tokenName"`
+	Name             string     `json:"name,omitempty"`
+	ExtensionVersion string     `json:"extensionVersion,omitempty"`
+	InstallID        string     `json:"installId,omitempty"`
+	Node             string     `json:"node,omitempty"`
+	ConnectedAt      time.Time  `json:"connectedAt"`
+	DisconnectedAt   *time.Time `json:"disconnectedAt,omitempty"` // nil while connected
+	Reason           string     `json:"reason,omitempty"`
+	CloseCode        int        `json:"closeCode,omitempty"` // from the extension's close frame
+	Duration         int64      `json:"duration"`            // seconds, up to now while connected
+
+	// Last time the session was known to be connected; ends a session a
+	// stopped relay left open
+	LastSeenAt time.Time `json:"-"`
+
+	TokenHash string `json:"-"`
+}
+
+// SessionHistoryResponse for GET /api/v1/admin/sessions/history
+type SessionHistoryResponse struct {
+	Since    time.Time        `json:"since"`
+	Until    time.Time        `json:"until"`
+	Tokens   []TokenUptime    `json:"tokens"`
+	Sessions []*SessionRecord `json:"sessions"` // overlapping the window, newest first
+}
+
+// TokenUptime summarizes a token's sessions over the history window
+type TokenUptime struct {
+	TokenName   string         `json:"tokenName"`
+	Sessions    int            `json:"sessions"`
+	Connected   int64          `json:"connected"`   // seconds at least one session was connected
+	Uptime      float64        `json:"uptime"`      // percent of the window
+	Disconnects int            `json:"disconnects"` // sessions that ended within the window
+	Reasons     map[string]int `json:"reasons"`     // disconnects by reason
+}
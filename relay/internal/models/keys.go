@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// keyModifiers are the modifier keys a "press" combination may hold down
+var keyModifiers = map[string]bool{
+	"Control": true,
+	"Shift":   true,
+	"Alt":     true,
+	"Meta":    true,
+}
+
+// namedKeys are the keys other than single characters that "press"
+// accepts, by their KeyboardEvent.key names
+var namedKeys = map[string]bool{
+	"Enter": true, "Tab": true, "Escape": true, "Backspace": true, "Delete": true, "Insert": true,
+	"ArrowUp": true, "ArrowDown": true, "ArrowLeft": true, "ArrowRight": true,
+	"Home": true, "End": true, "PageUp": true, "PageDown": true, "Space": true,
+	"F1": true, "F2": true, "F3": true, "F4": true, "F5": true, "F6": true,
+	"F7": true, "F8": true, "F9": true, "F10": true, "F11": true, "F12": true,
+	"Control": true, "Shift": true, "Alt": true, "Meta": true,
+}
+
+// ValidateKeyCombo checks a "press" key: modifiers joined by "+" and then
+// one key, such as "Control+Shift+K". A lone "+" is the plus key.
+func ValidateKeyCombo(combo string) error {
+	if combo == "" {
+		return fmt.Errorf("key is required")
+	}
+	parts := splitKeyCombo(combo)
+	for _, mod := range parts[:len(parts)-1] {
+		if !keyModifiers[mod] {
+			return fmt.Errorf("%q is not a modifier; use Control, Shift, Alt, or Meta", mod)
+		}
+	}
+	key := parts[len(parts)-1]
+	if !namedKeys[key] && utf8.RuneCountInString(key) != 1 {
+		return fmt.Errorf("%q is not a key; use a single character or a name such as Enter, Tab, or ArrowDown", key)
+	}
+	return nil
+}
+
+// splitKeyCombo splits a combination into its keys, the last being the
+// key pressed while the others are held
+func splitKeyCombo(combo string) []string {
+	switch {
+	case combo == "+":
+		return []string{"+"}
+	case strings.HasSuffix(combo, "++"):
+		return append(strings.Split(strings.TrimSuffix(combo, "++"), "+"), "+")
+	}
+	return strings.Split(combo, "+")
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxMacroSteps is the most steps one macro may hold
+const MaxMacroSteps = 100
+
+var (
+	macroName   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	paramName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+	placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+)
+
+// Macro is a named sequence of actions stored for a token, run against a
+// tab with POST /api/v1/macros/{name}/run. String values in its steps may
+// hold {{param}} placeholders, filled in from the run's params.
+type Macro struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      []MacroParam      `json:"params"`
+	Steps       []json.RawMessage `json:"steps"` // actions, as in POST /api/v1/command
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// MacroParam declares a value a macro's steps refer to
+type MacroParam struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Default     json.RawMessage `json:"default,omitempty"` // params without one are required
+}
+
+// MacroRequest for POST /api/v1/macros. Saving a name the token already
+// uses replaces that macro.
+type MacroRequest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Params      []MacroParam      `json:"params,omitempty"`
+	Steps       []json.RawMessage `json:"steps"`
+}
+
+// MacrosResponse for GET /api/v1/macros
+type MacrosResponse struct {
+	Macros []*Macro `json:"macros"`
+}
+
+// MacroRunRequest for POST /api/v1/macros/{name}/run
+type MacroRunRequest struct {
+	TabID           string                     `json:"tabId"`
+	Params          map[string]json.RawMessage `json:"params,omitempty"`
+	Timeout         int                        `json:"timeout,omitempty"`         // per step, ms
+	ContinueOnError bool                       `json:"continueOnError,omitempty"` // run the remaining steps after one fails
+}
+
+// MacroRunResponse for POST /api/v1/macros/{name}/run
+type MacroRunResponse struct {
+	Macro   string            `json:"macro"`
+	TabID   string            `json:"tabId"`
+	Success bool              `json:"success"` // every step succeeded
+	Steps   []BatchStepResult `json:"steps"`   // steps run, in order
+	Elapsed int64             `json:"elapsed"` // ms
+}
+
+// Validate checks a macro before it is stored: a usable name, declared
+// params, and steps that are actions whose placeholders name those params
+func (m *MacroRequest) Validate() error {
+	if !macroName.MatchString(m.Name) {
+		return fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_', or '-', starting with a letter or digit")
+	}
+	declared := make(map[string]bool, len(m.Params))
+	for _, p := range m.Params {
+		if !paramName.MatchString(p.Name) {
+			return fmt.Errorf("param name %q must be letters, digits, or '_', not starting with a digit", p.Name)
+		}
+		if declared[p.Name] {
+			return fmt.Errorf("param %q is declared twice", p.Name)
+		}
+		if len(p.Default) > 0 && !json.Valid(p.Default) {
+			return fmt.Errorf("param %q has an invalid default", p.Name)
+		}
+		declared[p.Name] = true
+	}
+
+	if len(m.Steps) == 0 {
+		return fmt.Errorf("steps is required")
+	}
+	if len(m.Steps) > MaxMacroSteps {
+		return fmt.Errorf("a macro has at most %d steps", MaxMacroSteps)
+	}
+	for i, step := range m.Steps {
+		var action struct {
+			Kind string `json:"kind"`
+		}
+		if err := json.Unmarshal(step, &action); err != nil {
+			return fmt.Errorf("step %d is not an action object", i)
+		}
+		switch action.Kind {
+		case "":
+			return fmt.Errorf("step %d: kind is required", i)
+		case "upload", "evaluate", "tab_create":
+			return fmt.Errorf("step %d: %s cannot be part of a macro", i, action.Kind)
+		}
+		for _, match := range placeholder.FindAllSubmatch(step, -1) {
+			if name := string(match[1]); !declared[name] {
+				return fmt.Errorf("step %d refers to undeclared param %q", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Expand fills in the placeholders of the macro's steps and decodes them
+// into actions. A string that is only a placeholder takes the param's JSON
+// value, so numbers and objects keep their type; a placeholder within a
+// longer string takes the param's text.
+func (m *Macro) Expand(params map[string]json.RawMessage) ([]CommandAction, error) {
+	values := make(map[string]json.RawMessage, len(m.Params))
+	for _, p := range m.Params {
+		if v, ok := params[p.Name]; ok {
+			values[p.Name] = v
+		} else if len(p.Default) > 0 {
+			values[p.Name] = p.Default
+		} else {
+			return nil, fmt.Errorf("param %q is required", p.Name)
+		}
+	}
+	for name := range params {
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("macro has no param %q", name)
+		}
+	}
+
+	actions := make([]CommandAction, len(m.Steps))
+	for i, step := range m.Steps {
+		dec := json.NewDecoder(bytes.NewReader(step))
+		dec.UseNumber()
+		var tree any
+		if err := dec.Decode(&tree); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		tree, err := substitute(tree, values)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		expanded, err := json.Marshal(tree)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		if err := json.Unmarshal(expanded, &actions[i]); err != nil {
+			return nil, fmt.Errorf("step %d is not a valid action once its params are filled in: %w", i, err)
+		}
+	}
+	return actions, nil
+}
+
+// substitute replaces placeholders in the strings of a decoded JSON value
+func substitute(v any, values map[string]json.RawMessage) (any, error) {
+	switch v := v.(type) {
+	case string:
+		if m := placeholder.FindStringSubmatch(v); m != nil && m[0] == v {
+			return json.RawMessage(values[m[1]]), nil
+		}
+		var err error
+		out := placeholder.ReplaceAllStringFunc(v, func(s string) string {
+			name := placeholder.FindStringSubmatch(s)[1]
+			text, textErr := paramText(values[name])
+			if textErr != nil && err == nil {
+				err = fmt.Errorf("param %q: %w", name, textErr)
+			}
+			return text
+		})
+		return out, err
+	case map[string]any:
+		for k, item := range v {
+			sub, err := substitute(item, values)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = sub
+		}
+	case []any:
+		for i, item := range v {
+			sub, err := substitute(item, values)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = sub
+		}
+	}
+	return v, nil
+}
+
+// paramText is a param's value as it reads inside a longer string
+func paramText(raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, nil
+	}
+	text := strings.TrimSpace(string(raw))
+	if strings.HasPrefix(text, "{") || strings.HasPrefix(text, "[") {
+		return "", fmt.Errorf("an object or array cannot be part of a string")
+	}
+	return text, nil
+}
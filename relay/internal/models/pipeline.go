@@ -0,0 +1,263 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// MaxPipelineSteps is the most steps one pipeline may hold
+	MaxPipelineSteps = 100
+	// MaxPipelineRunSteps bounds the steps one run executes, counting each
+	// time a branch comes back to a step, so a loop cannot run forever
+	MaxPipelineRunSteps = 1000
+	// MaxPipelineRetries is the most times a step may be retried
+	MaxPipelineRetries = 10
+)
+
+// Where a pipeline goes after a step. Any other target is a step's id.
+const (
+	PipelineNext = "next" // the following step; the default on success
+	PipelineFail = "fail" // stop, the run failed; the default on failure
+	PipelineEnd  = "end"  // stop, the run succeeded
+)
+
+var stepID = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]{0,63}$`)
+
+// Pipeline is a named workflow stored for a token, run against a tab with
+// POST /api/v1/pipelines/{name}/run. Its steps run commands, assert on the
+// page, or wait, and choose the step that follows by their outcome.
+type Pipeline struct {
+	ID          int64          `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Steps       []PipelineStep `json:"steps"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+}
+
+// PipelineStep does exactly one of Action, Assert, or Wait. A failed step
+// is tried again Retries times, RetryDelay ms apart, before OnFailure is
+// followed.
+type PipelineStep struct {
+	ID         string          `json:"id,omitempty"` // for branches to refer to
+	Action     *CommandAction  `json:"action,omitempty"`
+	Assert     *PipelineAssert `json:"assert,omitempty"`
+	Wait       *PipelineWait   `json:"wait,omitempty"`
+	Retries    int             `json:"retries,omitempty"`
+	RetryDelay int             `json:"retryDelay,omitempty"` // ms
+	OnSuccess  string          `json:"onSuccess,omitempty"`  // next (default), fail, end, or a step id
+	OnFailure  string          `json:"onFailure,omitempty"`  // fail (default), next, end, or a step id
+}
+
+// PipelineAssert checks the tab's URL, the elements matched by Selector or
+// XPath, or both; every condition set must hold. Text conditions apply to
+// the first element matched. With a selector and no other condition, an
+// element must match.
+type PipelineAssert struct {
+	URL          string `json:"url,omitempty"`         // exact match
+	URLContains  string `json:"urlContains,omitempty"` // substring
+	URLMatches   string `json:"urlMatches,omitempty"`  // regular expression
+	Selector     string `json:"selector,omitempty"`
+	XPath        string `json:"xpath,omitempty"`
+	Exists       *bool  `json:"exists,omitempty"` // false: nothing may match
+	Count        *int   `json:"count,omitempty"`  // exactly this many match
+	TextEquals   string `json:"textEquals,omitempty"`
+	TextContains string `json:"textContains,omitempty"`
+	TextMatches  string `json:"textMatches,omitempty"` // regular expression
+}
+
+// PipelineWait pauses for Ms, or until an element matches Selector or
+// XPath (or, with Gone, until none does), for at most Timeout ms
+type PipelineWait struct {
+	Ms       int    `json:"ms,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	XPath    string `json:"xpath,omitempty"`
+	Gone     bool   `json:"gone,omitempty"`
+	Timeout  int    `json:"timeout,omitempty"` // ms; defaults to the run's timeout
+}
+
+// PipelineRequest for POST /api/v1/pipelines. Saving a name the token
+// already uses replaces that pipeline.
+type PipelineRequest struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Steps       []PipelineStep `json:"steps"`
+}
+
+// PipelinesResponse for GET /api/v1/pipelines
+type PipelinesResponse struct {
+	Pipelines []*Pipeline `json:"pipelines"`
+}
+
+// PipelineRunRequest for POST /api/v1/pipelines/{name}/run, and for
+// POST /api/v1/pipelines/run with the pipeline given inline
+type PipelineRunRequest struct {
+	TabID    string           `json:"tabId"`
+	Timeout  int              `json:"timeout,omitempty"`  // per command, ms
+	Pipeline *PipelineRequest `json:"pipeline,omitempty"` // inline only; its name may be empty
+}
+
+// PipelineRunResponse is the execution report of a pipeline run
+type PipelineRunResponse struct {
+	Pipeline string               `json:"pipeline,omitempty"`
+	TabID    string               `json:"tabId"`
+	Success  bool                 `json:"success"` // the run ended without reaching fail
+	Error    *CommandError        `json:"error,omitempty"`
+	Steps    []PipelineStepResult `json:"steps"`   // steps executed, in order, repeating any a branch came back to
+	Elapsed  int64                `json:"elapsed"` // ms
+}
+
+// PipelineStepResult reports one execution of a step
+type PipelineStepResult struct {
+	Index    int           `json:"index"`
+	ID       string        `json:"id,omitempty"`
+	Type     string        `json:"type"`           // action, assert, or wait
+	Kind     string        `json:"kind,omitempty"` // the action's kind
+	Success  bool          `json:"success"`
+	Attempts int           `json:"attempts"`
+	Result   any           `json:"result,omitempty"`
+	Error    *CommandError `json:"error,omitempty"`
+	Next     string        `json:"next"`    // the branch taken: next, fail, end, or a step id
+	Elapsed  int64         `json:"elapsed"` // ms, across attempts
+}
+
+// AssertResult is the result of an assert step: what was checked against
+type AssertResult struct {
+	URL   string `json:"url,omitempty"`
+	Count *int   `json:"count,omitempty"` // elements matched
+	Text  string `json:"text,omitempty"`  // of the first element matched
+}
+
+// Type names what the step does
+func (s *PipelineStep) Type() string {
+	switch {
+	case s.Action != nil:
+		return "action"
+	case s.Assert != nil:
+		return "assert"
+	default:
+		return "wait"
+	}
+}
+
+// Validate checks a pipeline before it is stored or run. An inline
+// pipeline passes named false and needs no name.
+func (p *PipelineRequest) Validate(named bool) error {
+	if (named || p.Name != "") && !macroName.MatchString(p.Name) {
+		return fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_', or '-', starting with a letter or digit")
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("steps is required")
+	}
+	if len(p.Steps) > MaxPipelineSteps {
+		return fmt.Errorf("a pipeline has at most %d steps", MaxPipelineSteps)
+	}
+
+	ids := make(map[string]bool)
+	for i, step := range p.Steps {
+		if step.ID == "" {
+			continue
+		}
+		if !stepID.MatchString(step.ID) {
+			return fmt.Errorf("step %d: id must be letters, digits, '_', or '-', starting with a letter or '_'", i)
+		}
+		switch step.ID {
+		case PipelineNext, PipelineFail, PipelineEnd:
+			return fmt.Errorf("step %d: id %q is reserved", i, step.ID)
+		}
+		if ids[step.ID] {
+			return fmt.Errorf("step %d: id %q is used twice", i, step.ID)
+		}
+		ids[step.ID] = true
+	}
+
+	for i, step := range p.Steps {
+		if err := step.validate(ids); err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *PipelineStep) validate(ids map[string]bool) error {
+	set := 0
+	for _, ok := range []bool{s.Action != nil, s.Assert != nil, s.Wait != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("needs exactly one of action, assert, or wait")
+	}
+	if s.Retries < 0 || s.Retries > MaxPipelineRetries {
+		return fmt.Errorf("retries must be between 0 and %d", MaxPipelineRetries)
+	}
+	if s.RetryDelay < 0 {
+		return fmt.Errorf("retryDelay must not be negative")
+	}
+	for _, target := range []string{s.OnSuccess, s.OnFailure} {
+		switch target {
+		case "", PipelineNext, PipelineFail, PipelineEnd:
+		default:
+			if !ids[target] {
+				return fmt.Errorf("no step has id %q", target)
+			}
+		}
+	}
+
+	switch {
+	case s.Action != nil:
+		switch s.Action.Kind {
+		case "":
+			return fmt.Errorf("kind is required")
+		case "upload", "tab_create":
+			return fmt.Errorf("%s cannot be part of a pipeline", s.Action.Kind)
+		case "evaluate":
+			return s.Action.ValidateEvaluate()
+		}
+	case s.Assert != nil:
+		return s.Assert.validate()
+	case s.Wait != nil:
+		return s.Wait.validate()
+	}
+	return nil
+}
+
+func (a *PipelineAssert) validate() error {
+	if a.Selector != "" && a.XPath != "" {
+		return fmt.Errorf("assert takes a selector or an xpath, not both")
+	}
+	element := a.Selector != "" || a.XPath != ""
+	if !element && (a.Exists != nil || a.Count != nil || a.TextEquals != "" || a.TextContains != "" || a.TextMatches != "") {
+		return fmt.Errorf("assert needs a selector or xpath to check elements")
+	}
+	if !element && a.URL == "" && a.URLContains == "" && a.URLMatches == "" {
+		return fmt.Errorf("assert needs a url or element condition")
+	}
+	if a.Count != nil && *a.Count < 0 {
+		return fmt.Errorf("count must not be negative")
+	}
+	for _, pattern := range []string{a.URLMatches, a.TextMatches} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regular expression %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (w *PipelineWait) validate() error {
+	element := w.Selector != "" || w.XPath != ""
+	switch {
+	case w.Selector != "" && w.XPath != "":
+		return fmt.Errorf("wait takes a selector or an xpath, not both")
+	case element == (w.Ms > 0):
+		return fmt.Errorf("wait needs either ms or a selector or xpath")
+	case w.Ms < 0 || w.Timeout < 0:
+		return fmt.Errorf("wait times must not be negative")
+	case w.Gone && !element:
+		return fmt.Errorf("gone needs a selector or xpath")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package models
+
+import "fmt"
+
+// Limits of a drag's pointer moves
+const (
+	MaxDragSteps = 200
+	MaxDragDelay = 1000 // ms between moves
+)
+
+// ValidatePointer checks a hover, doubleclick, or drag action: each needs
+// a selector or coordinates to act on, and a drag also needs where to end
+func (a *CommandAction) ValidatePointer() error {
+	if a.Selector == "" && a.Coordinates == nil {
+		return fmt.Errorf("%s needs a selector or coordinates", a.Kind)
+	}
+	if a.Kind != "drag" {
+		return nil
+	}
+	if a.ToSelector == "" && a.ToCoordinates == nil {
+		return fmt.Errorf("drag needs a toSelector or toCoordinates")
+	}
+	if a.Steps < 0 || a.Steps > MaxDragSteps {
+		return fmt.Errorf("steps must be between 1 and %d", MaxDragSteps)
+	}
+	if a.Delay < 0 || a.Delay > MaxDragDelay {
+		return fmt.Errorf("delay must be between 0 and %d ms", MaxDragDelay)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package models
+
+import "fmt"
+
+// Elements a query describes when it does not ask for a number, and the
+// most it may ask for
+const (
+	DefaultQueryLimit = 50
+	MaxQueryLimit     = 500
+)
+
+// ValidateQuery checks a query action: exactly one of a selector and an
+// XPath expression, and a limit within MaxQueryLimit
+func (a *CommandAction) ValidateQuery() error {
+	if (a.Selector == "") == (a.XPath == "") {
+		return fmt.Errorf("query needs exactly one of selector or xpath")
+	}
+	if a.Limit < 0 || a.Limit > MaxQueryLimit {
+		return fmt.Errorf("limit must be between 1 and %d", MaxQueryLimit)
+	}
+	return nil
+}
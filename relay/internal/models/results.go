@@ -0,0 +1,393 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// CommandResult is the typed result of a successful command. The hub decodes
+// each response into the struct for its command kind.
+type CommandResult interface {
+	isCommandResult()
+}
+
+// ClickResult is returned by "click"
+type ClickResult struct {
+	Selector string `json:"selector,omitempty"`
+}
+
+// TypeResult is returned by "type"
+type TypeResult struct {
+	Selector string `json:"selector,omitempty"`
+	Length   int    `json:"length,omitempty"` // characters typed
+}
+
+// ScrollResult is returned by "scroll"
+type ScrollResult struct {
+	ScrollX int `json:"scrollX,omitempty"`
+	ScrollY int `json:"scrollY,omitempty"`
+}
+
+// ScrollToResult is returned by "scroll_to", with the page's scroll
+// offsets once scrolling ends
+type ScrollToResult struct {
+	ScrollX int `json:"scrollX"`
+	ScrollY int `json:"scrollY"`
+	// selector: whether the element is entirely within the viewport
+	InView *bool `json:"inView,omitempty"`
+}
+
+// NavigateResult is returned by "navigate"
+type NavigateResult struct {
+	URL string `json:"url,omitempty"`
+}
+
+// ScreenshotResult is returned by "screenshot". A burst returns its
+// captures in Frames instead of Data.
+type ScreenshotResult struct {
+	Data   string             `json:"data"` // base64 image, without data URL prefix
+	Width  int                `json:"width"`
+	Height int                `json:"height"`
+	Format string             `json:"format,omitempty"`
+	Frames []ScreenshotResult `json:"frames,omitempty"`
+	Offset int64              `json:"offset,omitempty"` // frames: ms after the first
+}
+
+// SnapshotResult is returned by "snapshot"
+type SnapshotResult struct {
+	HTML     string               `json:"html"`
+	Elements []InteractiveElement `json:"elements,omitempty"`
+	// More interactive elements than the extension lists were found
+	ElementsTruncated bool   `json:"elementsTruncated,omitempty"`
+	URL               string `json:"url,omitempty"`
+	Title             string `json:"title,omitempty"`
+	Truncated         bool   `json:"truncated"`
+}
+
+// EvaluateResult is returned by "evaluate"
+type EvaluateResult struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Type  string          `json:"type,omitempty"` // typeof the value
+	// returnByValue false, or a value that cannot be serialized: the
+	// constructor name and a short description, in place of the value
+	ClassName   string `json:"className,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// TabCreateResult is returned by "tab_create". The new tab is attached to
+// the session that created it.
+type TabCreateResult struct {
+	TabID string `json:"tabId"`
+	URL   string `json:"url,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// TabCloseResult is returned by "tab_close"
+type TabCloseResult struct {
+	TabID string `json:"tabId,omitempty"`
+}
+
+// CookiesResult is returned by "cookies_get" and "cookies_set", with the
+// cookies as the browser stored them
+type CookiesResult struct {
+	URL     string   `json:"url,omitempty"`
+	Cookies []Cookie `json:"cookies"`
+}
+
+// CookiesClearResult is returned by "cookies_clear"
+type CookiesClearResult struct {
+	URL     string `json:"url,omitempty"`
+	Removed int    `json:"removed"`
+}
+
+// StorageResult is returned by "storage_get" and "storage_set"; for
+// storage_set, Items holds what was written
+type StorageResult struct {
+	URL       string            `json:"url,omitempty"`
+	Items     map[string]string `json:"items"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// StorageRemoveResult is returned by "storage_remove"
+type StorageRemoveResult struct {
+	URL     string `json:"url,omitempty"`
+	Removed int    `json:"removed"`
+}
+
+// EmulationResult is returned by "emulation_get", "emulation_set", and
+// "emulation_clear"
+type EmulationResult struct {
+	Emulation Emulation `json:"emulation"`
+}
+
+// ViewportResult is returned by "set_viewport": the viewport the tab
+// emulates now, nil for the window's own
+type ViewportResult struct {
+	Viewport *Viewport `json:"viewport,omitempty"`
+}
+
+// NetworkResult is returned by "set_network_conditions": the
+// connection the tab emulates now, nil for the real one
+type NetworkResult struct {
+	NetworkConditions *NetworkConditions `json:"networkConditions,omitempty"`
+}
+
+// RequestRulesResult is returned by "request_rules_get",
+// "request_rules_set", and "request_rules_clear"
+type RequestRulesResult struct {
+	RequestRules
+}
+
+// HeadersResult is returned by "headers_get", "headers_set", and
+// "headers_clear"
+type HeadersResult struct {
+	ExtraHeaders
+}
+
+// CredentialsResult is returned by "credentials_get", "credentials_set",
+// and "credentials_clear", without passwords
+type CredentialsResult struct {
+	Credentials []Credential `json:"credentials"`
+}
+
+// UploadResult is returned by "upload"
+type UploadResult struct {
+	Files int `json:"files"` // files the input holds afterwards
+}
+
+// FillFormResult is returned by "fill_form". Fields are checked before any
+// is changed: Filled is false, and nothing was filled, when one failed.
+type FillFormResult struct {
+	Filled bool              `json:"filled"`
+	Fields []FormFieldResult `json:"fields"`
+}
+
+// FormFieldResult is the outcome of one field of a fill_form, in document
+// order
+type FormFieldResult struct {
+	Selector string `json:"selector"`
+	Success  bool   `json:"success"`
+	Value    any    `json:"value,omitempty"` // the field's value afterwards
+	Error    string `json:"error,omitempty"`
+}
+
+// QueryResult is returned by "query"
+type QueryResult struct {
+	Count    int            `json:"count"` // elements matched, not only those described
+	Elements []QueryElement `json:"elements"`
+}
+
+// QueryElement describes an element matched by a query, in document order
+type QueryElement struct {
+	Tag        string            `json:"tag"`
+	Text       string            `json:"text,omitempty"` // visible text, cut to 500 characters
+	Attributes map[string]string `json:"attributes"`
+	Visible    bool              `json:"visible"`
+	Rect       Rect              `json:"rect"` // CSS pixels, relative to the viewport
+}
+
+// SelectResult is returned by "select", with the option now chosen
+type SelectResult struct {
+	Selector string `json:"selector,omitempty"`
+	Value    string `json:"value"`
+	Label    string `json:"label"`
+	Index    int    `json:"index"`
+	Changed  bool   `json:"changed"` // false when it was already chosen
+}
+
+// normalize strips a data URL prefix from Data, taking the format from it
+// when the extension did not report one
+func (r *ScreenshotResult) normalize() {
+	if header, data, ok := strings.Cut(r.Data, ","); ok && strings.HasPrefix(header, "data:") {
+		r.Data = data
+		if r.Format == "" {
+			mime, _, _ := strings.Cut(strings.TrimPrefix(header, "data:"), ";")
+			r.Format = strings.TrimPrefix(mime, "image/")
+		}
+	}
+	if r.Format == "jpg" {
+		r.Format = "jpeg"
+	}
+	if r.Format == "" {
+		r.Format = "png"
+	}
+}
+
+// normalize fills in Type from the value when the extension omitted it,
+// using JavaScript typeof names
+func (r *EvaluateResult) normalize() {
+	if r.Type != "" {
+		return
+	}
+	value := bytes.TrimSpace(r.Value)
+	switch {
+	case len(value) == 0:
+		r.Type = "undefined"
+	case value[0] == '"':
+		r.Type = "string"
+	case value[0] == 't', value[0] == 'f':
+		r.Type = "boolean"
+	case value[0] == 'n', value[0] == '{', value[0] == '[':
+		r.Type = "object"
+	default:
+		r.Type = "number"
+	}
+}
+
+// RawResult passes through results of kinds the relay has no schema for
+type RawResult json.RawMessage
+
+// MarshalJSON returns the raw result unchanged
+func (r RawResult) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (*ClickResult) isCommandResult()         {}
+func (*TypeResult) isCommandResult()          {}
+func (*ScrollResult) isCommandResult()        {}
+func (*ScrollToResult) isCommandResult()      {}
+func (*NavigateResult) isCommandResult()      {}
+func (*ScreenshotResult) isCommandResult()    {}
+func (*SnapshotResult) isCommandResult()      {}
+func (*EvaluateResult) isCommandResult()      {}
+func (*TabCreateResult) isCommandResult()     {}
+func (*TabCloseResult) isCommandResult()      {}
+func (*CookiesResult) isCommandResult()       {}
+func (*CookiesClearResult) isCommandResult()  {}
+func (*StorageResult) isCommandResult()       {}
+func (*StorageRemoveResult) isCommandResult() {}
+func (*EmulationResult) isCommandResult()     {}
+func (*ViewportResult) isCommandResult()      {}
+func (*NetworkResult) isCommandResult()       {}
+func (*RequestRulesResult) isCommandResult()  {}
+func (*HeadersResult) isCommandResult()       {}
+func (*CredentialsResult) isCommandResult()   {}
+func (*UploadResult) isCommandResult()        {}
+func (*FillFormResult) isCommandResult()      {}
+func (*SelectResult) isCommandResult()        {}
+func (*QueryResult) isCommandResult()         {}
+func (RawResult) isCommandResult()            {}
+
+// DecodeResult parses a raw result for the given command kind and checks
+// that required fields are present
+func DecodeResult(kind string, raw json.RawMessage) (CommandResult, error) {
+	var result CommandResult
+	switch kind {
+	case "click":
+		result = &ClickResult{}
+	case "type":
+		result = &TypeResult{}
+	case "scroll":
+		result = &ScrollResult{}
+	case "scroll_to":
+		result = &ScrollToResult{}
+	case "navigate":
+		result = &NavigateResult{}
+	case "screenshot":
+		result = &ScreenshotResult{}
+	case "snapshot":
+		result = &SnapshotResult{}
+	case "evaluate":
+		result = &EvaluateResult{}
+	case "tab_create":
+		result = &TabCreateResult{}
+	case "tab_close":
+		result = &TabCloseResult{}
+	case "cookies_get", "cookies_set":
+		result = &CookiesResult{}
+	case "cookies_clear":
+		result = &CookiesClearResult{}
+	case "storage_get", "storage_set":
+		result = &StorageResult{}
+	case "storage_remove":
+		result = &StorageRemoveResult{}
+	case "emulation_get", "emulation_set", "emulation_clear":
+		result = &EmulationResult{}
+	case "set_viewport":
+		result = &ViewportResult{}
+	case "set_network_conditions":
+		result = &NetworkResult{}
+	case "request_rules_get", "request_rules_set", "request_rules_clear":
+		result = &RequestRulesResult{}
+	case "headers_get", "headers_set", "headers_clear":
+		result = &HeadersResult{}
+	case "credentials_get", "credentials_set", "credentials_clear":
+		result = &CredentialsResult{}
+	case "upload":
+		result = &UploadResult{}
+	case "fill_form":
+		result = &FillFormResult{}
+	case "select":
+		result = &SelectResult{}
+	case "query":
+		result = &QueryResult{}
+	default:
+		return RawResult(raw), nil
+	}
+
+	empty := len(raw) == 0 || bytes.Equal(raw, []byte("null"))
+	if !empty {
+		if err := json.Unmarshal(raw, result); err != nil {
+			return nil, fmt.Errorf("invalid %s result: %w", kind, err)
+		}
+	}
+
+	switch r := result.(type) {
+	case *ScreenshotResult:
+		if len(r.Frames) > 0 {
+			for i := range r.Frames {
+				r.Frames[i].normalize()
+				if r.Frames[i].Data == "" {
+					return nil, fmt.Errorf("invalid screenshot result: frame %d has no data", i)
+				}
+			}
+			break
+		}
+		r.normalize()
+		if r.Data == "" {
+			return nil, fmt.Errorf("invalid screenshot result: data is required")
+		}
+	case *EvaluateResult:
+		r.normalize()
+	case *SnapshotResult:
+		if empty {
+			return nil, fmt.Errorf("invalid snapshot result: html is required")
+		}
+	case *TabCreateResult:
+		if r.TabID == "" {
+			return nil, fmt.Errorf("invalid tab_create result: tabId is required")
+		}
+	case *CookiesResult:
+		if r.Cookies == nil {
+			r.Cookies = []Cookie{}
+		}
+	case *StorageResult:
+		if r.Items == nil {
+			r.Items = map[string]string{}
+		}
+	case *FillFormResult:
+		if len(r.Fields) == 0 {
+			return nil, fmt.Errorf("invalid fill_form result: fields is required")
+		}
+	case *QueryResult:
+		if r.Elements == nil {
+			r.Elements = []QueryElement{}
+		}
+		for i := range r.Elements {
+			if r.Elements[i].Attributes == nil {
+				r.Elements[i].Attributes = map[string]string{}
+			}
+		}
+	case *SelectResult:
+		if empty || r.Index < 0 {
+			return nil, fmt.Errorf("invalid select result: index is required")
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,236 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// MaxRequestRules is the most rules one rule set may hold
+const MaxRequestRules = 100
+
+// maxRuleFilter bounds the length of a rule's URL or regex filter
+const maxRuleFilter = 2000
+
+// MaxExtraHeaders is the most headers a tab's requests may be given
+const MaxExtraHeaders = 50
+
+// maxExtraHeaderValue bounds the length of one extra header's value
+const maxExtraHeaderValue = 8192
+
+// reservedHeaders describe the connection rather than the request, and
+// cannot be set
+var reservedHeaders = []string{
+	"host", "content-length", "connection", "keep-alive", "transfer-encoding",
+	"te", "trailer", "upgrade", "proxy-connection", "proxy-authorization",
+}
+
+// Request rule actions
+const (
+	RuleBlock    = "block"
+	RuleAllow    = "allow"
+	RuleRedirect = "redirect"
+)
+
+// ruleResourceTypes are the kinds of request a rule can be limited to, as
+// the browser names them
+var ruleResourceTypes = []string{
+	"main_frame", "sub_frame", "stylesheet", "script", "image", "font", "object",
+	"xmlhttprequest", "ping", "csp_report", "media", "websocket", "webtransport", "webbundle", "other",
+}
+
+var ruleDomain = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// RuleSet is a named list of request rules stored for a token, applied to
+// a tab with POST /api/v1/request-rules
+type RuleSet struct {
+	ID          int64         `json:"id"`
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Rules       []RequestRule `json:"rules"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+}
+
+// RequestRule blocks, allows, or redirects the requests of a tab whose URL
+// matches URLFilter or RegexFilter and whose host is one of Domains. An
+// allow rule exempts requests from the rule set's block and redirect rules.
+type RequestRule struct {
+	Action string `json:"action"` // block, allow, redirect
+	// URLFilter is a pattern in the browser's declarativeNetRequest syntax,
+	// e.g. "||ads.example.com^"; RegexFilter a regular expression instead
+	URLFilter   string   `json:"urlFilter,omitempty"`
+	RegexFilter string   `json:"regexFilter,omitempty"`
+	Domains     []string `json:"domains,omitempty"` // request hosts, subdomains included
+	// ResourceTypes limits the rule to these kinds of request; without it,
+	// every kind but main_frame is matched
+	ResourceTypes []string `json:"resourceTypes,omitempty"`
+	// redirect: the URL to load instead, or RegexFilter's substitution
+	// with \1 to \9 for its groups
+	RedirectURL       string `json:"redirectUrl,omitempty"`
+	RegexSubstitution string `json:"regexSubstitution,omitempty"`
+}
+
+// RuleSetRequest for POST /api/v1/rulesets. Saving a name the token
+// already uses replaces that rule set.
+type RuleSetRequest struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description,omitempty"`
+	Rules       []RequestRule `json:"rules"`
+}
+
+// RuleSetsResponse for GET /api/v1/rulesets
+type RuleSetsResponse struct {
+	RuleSets []*RuleSet `json:"ruleSets"`
+}
+
+// RequestRules are the rules in effect in a tab, and the rule set they
+// came from
+type RequestRules struct {
+	RuleSet string        `json:"ruleSet,omitempty"`
+	Rules   []RequestRule `json:"rules"`
+}
+
+// ApplyRuleSetRequest for POST /api/v1/request-rules
+type ApplyRuleSetRequest struct {
+	TabID   string `json:"tabId"`
+	RuleSet string `json:"ruleSet"`
+}
+
+// RequestRulesResponse for /api/v1/request-rules: the rules in effect in
+// the tab now
+type RequestRulesResponse struct {
+	TabID   string        `json:"tabId"`
+	RuleSet string        `json:"ruleSet,omitempty"`
+	Rules   []RequestRule `json:"rules"`
+}
+
+// Validate checks a rule set before it is stored
+func (s *RuleSetRequest) Validate() error {
+	if !macroName.MatchString(s.Name) {
+		return fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_', or '-', starting with a letter or digit")
+	}
+	return ValidateRequestRules(s.Rules)
+}
+
+// ValidateRequestRules checks the rules of a rule set
+func ValidateRequestRules(rules []RequestRule) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("rules is required")
+	}
+	if len(rules) > MaxRequestRules {
+		return fmt.Errorf("a rule set has at most %d rules", MaxRequestRules)
+	}
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a request rule
+func (r *RequestRule) Validate() error {
+	switch {
+	case r.URLFilter == "" && r.RegexFilter == "" && len(r.Domains) == 0:
+		return fmt.Errorf("urlFilter, regexFilter, or domains is required")
+	case r.URLFilter != "" && r.RegexFilter != "":
+		return fmt.Errorf("urlFilter and regexFilter cannot both be set")
+	case len(r.URLFilter) > maxRuleFilter || len(r.RegexFilter) > maxRuleFilter:
+		return fmt.Errorf("filters are at most %d characters", maxRuleFilter)
+	}
+	if r.RegexFilter != "" {
+		if _, err := regexp.Compile(r.RegexFilter); err != nil {
+			return fmt.Errorf("invalid regexFilter: %w", err)
+		}
+	}
+	for _, d := range r.Domains {
+		if !ruleDomain.MatchString(d) {
+			return fmt.Errorf("domain %q must be a lowercase host name such as ads.example.com", d)
+		}
+	}
+	for _, t := range r.ResourceTypes {
+		if !slices.Contains(ruleResourceTypes, t) {
+			return fmt.Errorf("unknown resource type %q", t)
+		}
+	}
+
+	switch r.Action {
+	case RuleBlock, RuleAllow:
+		if r.RedirectURL != "" || r.RegexSubstitution != "" {
+			return fmt.Errorf("only redirect rules take redirectUrl or regexSubstitution")
+		}
+	case RuleRedirect:
+		switch {
+		case r.RedirectURL == "" && r.RegexSubstitution == "":
+			return fmt.Errorf("redirect needs redirectUrl or regexSubstitution")
+		case r.RedirectURL != "" && r.RegexSubstitution != "":
+			return fmt.Errorf("redirectUrl and regexSubstitution cannot both be set")
+		case r.RegexSubstitution != "" && r.RegexFilter == "":
+			return fmt.Errorf("regexSubstitution needs a regexFilter")
+		}
+		if r.RedirectURL != "" {
+			u, err := url.Parse(r.RedirectURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("redirectUrl must be an absolute http or https URL")
+			}
+		}
+	default:
+		return fmt.Errorf("action must be block, allow, or redirect")
+	}
+	return nil
+}
+
+// ExtraHeaders are headers added to a tab's outgoing requests, replacing
+// those of the same name. Without Domains, every request of the tab gets
+// them, third-party ones included.
+type ExtraHeaders struct {
+	Headers map[string]string `json:"headers"`
+	Domains []string          `json:"domains,omitempty"` // request hosts, subdomains included
+}
+
+// SetHeadersRequest for POST /api/v1/headers
+type SetHeadersRequest struct {
+	TabID   string            `json:"tabId"`
+	Headers map[string]string `json:"headers"`
+	Domains []string          `json:"domains,omitempty"`
+}
+
+// HeadersResponse for /api/v1/headers: the headers the tab's requests get
+// now
+type HeadersResponse struct {
+	TabID   string            `json:"tabId"`
+	Headers map[string]string `json:"headers"`
+	Domains []string          `json:"domains,omitempty"`
+}
+
+// Validate checks headers to be added to a tab's requests
+func (e *ExtraHeaders) Validate() error {
+	if len(e.Headers) == 0 {
+		return fmt.Errorf("headers is required")
+	}
+	if len(e.Headers) > MaxExtraHeaders {
+		return fmt.Errorf("at most %d headers can be set", MaxExtraHeaders)
+	}
+	for name, value := range e.Headers {
+		switch {
+		case !httpguts.ValidHeaderFieldName(name):
+			return fmt.Errorf("invalid header name %q", name)
+		case slices.Contains(reservedHeaders, strings.ToLower(name)):
+			return fmt.Errorf("header %s cannot be set", name)
+		case !httpguts.ValidHeaderFieldValue(value) || len(value) > maxExtraHeaderValue:
+			return fmt.Errorf("header %s must be a single line of at most %d characters", name, maxExtraHeaderValue)
+		}
+	}
+	for _, d := range e.Domains {
+		if !ruleDomain.MatchString(d) {
+			return fmt.Errorf("domain %q must be a lowercase host name such as api.example.com", d)
+		}
+	}
+	return nil
+}
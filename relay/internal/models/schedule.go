@@ -0,0 +1,179 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+	_ "time/tzdata" // schedule timezones; the release image has no zoneinfo
+
+	"github.com/emreylmaz/owlrelay/relay/internal/cron"
+)
+
+// MaxSchedules is the most schedules one token may hold
+const MaxSchedules = 100
+
+// What a schedule runs
+const (
+	ScheduleMacro      = "macro"
+	ScheduleScreenshot = "screenshot"
+	ScheduleSnapshot   = "snapshot"
+)
+
+// Schedule run statuses
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunSkipped   = "skipped" // the previous run had not finished
+)
+
+// Schedule is a job stored for a token that the relay runs on a cron
+// schedule: a macro, a screenshot, or a snapshot of a tab, optionally
+// after navigating it to a URL
+type Schedule struct {
+	ID          int64  `json:"id"`
+	TokenID     int64  `json:"-"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Cron        string `json:"cron"`
+	Timezone    string `json:"timezone"` // IANA name the cron fields are read in
+	ScheduleJob
+	Paused    bool       `json:"paused"`
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"` // unset while paused
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// ScheduleJob is what a schedule does each time it fires
+type ScheduleJob struct {
+	Kind  string `json:"kind"`            // macro, screenshot, or snapshot
+	TabID string `json:"tabId,omitempty"` // default: the first tab of the token's oldest session
+	URL   string `json:"url,omitempty"`   // navigated to first
+
+	// kind macro
+	Macro  string                     `json:"macro,omitempty"`
+	Params map[string]json.RawMessage `json:"params,omitempty"`
+
+	// kind screenshot: png or jpeg; kind snapshot: html, simplified, or
+	// markdown
+	Format   string `json:"format,omitempty"`
+	FullPage bool   `json:"fullPage,omitempty"`
+	Quality  int    `json:"quality,omitempty"`
+	Selector string `json:"selector,omitempty"` // screenshot of one element
+
+	Timeout int `json:"timeout,omitempty"` // per command, ms
+}
+
+// ScheduleRequest for POST /api/v1/schedules. Saving a name the token
+// already uses replaces that schedule.
+type ScheduleRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Cron        string `json:"cron"`
+	Timezone    string `json:"timezone,omitempty"` // default UTC
+	ScheduleJob
+	Paused bool `json:"paused,omitempty"`
+}
+
+// SchedulesResponse for GET /api/v1/schedules
+type SchedulesResponse struct {
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// ScheduleRun is one time a schedule fired
+type ScheduleRun struct {
+	ID           int64           `json:"id"`
+	ScheduleID   int64           `json:"scheduleId"`
+	Status       string          `json:"status"`
+	TabID        string          `json:"tabId,omitempty"`
+	Error        *CommandError   `json:"error,omitempty"`
+	Result       json.RawMessage `json:"result,omitempty"` // the macro run or snapshot
+	ScreenshotID string          `json:"screenshotId,omitempty"`
+	Screenshot   *Screenshot     `json:"screenshot,omitempty"` // with a URL until it expires
+	StartedAt    time.Time       `json:"startedAt"`
+	FinishedAt   *time.Time      `json:"finishedAt,omitempty"`
+}
+
+// ScheduleRunsResponse for GET /api/v1/schedules/{name}/runs, newest first
+type ScheduleRunsResponse struct {
+	Schedule string         `json:"schedule"`
+	Runs     []*ScheduleRun `json:"runs"`
+}
+
+// Validate checks a schedule before it is stored and fills in its
+// timezone. The macro's steps are checked when it is saved and when it
+// runs.
+func (r *ScheduleRequest) Validate() error {
+	if !macroName.MatchString(r.Name) {
+		return fmt.Errorf("name must be 1 to 64 letters, digits, '.', '_', or '-', starting with a letter or digit")
+	}
+	if _, err := cron.Parse(r.Cron); err != nil {
+		return fmt.Errorf("cron: %w", err)
+	}
+	if r.Timezone == "" {
+		r.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", r.Timezone)
+	}
+	if r.URL != "" {
+		if u, err := url.Parse(r.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an absolute http or https URL")
+		}
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+
+	switch r.Kind {
+	case ScheduleMacro:
+		if r.Macro == "" {
+			return fmt.Errorf("macro is required")
+		}
+	case ScheduleScreenshot:
+		if r.Format != "" && r.Format != "png" && r.Format != "jpeg" {
+			return fmt.Errorf("format must be png or jpeg")
+		}
+		if r.Quality < 0 || r.Quality > 100 {
+			return fmt.Errorf("quality must be between 0 and 100")
+		}
+	case ScheduleSnapshot:
+		if r.Format != "" && !ValidSnapshotFormat(r.Format) {
+			return fmt.Errorf("format must be html, simplified, or markdown")
+		}
+	case "":
+		return fmt.Errorf("kind is required")
+	default:
+		return fmt.Errorf("kind must be macro, screenshot, or snapshot")
+	}
+	if r.Kind != ScheduleMacro && (r.Macro != "" || len(r.Params) > 0) {
+		return fmt.Errorf("macro and params are only for kind macro")
+	}
+	if r.Kind != ScheduleScreenshot && (r.FullPage || r.Quality != 0 || r.Selector != "") {
+		return fmt.Errorf("fullPage, quality, and selector are only for kind screenshot")
+	}
+	return nil
+}
+
+// NextRun returns when a schedule next fires after t, or nil if it is
+// paused or never fires
+func (s *Schedule) NextRun(t time.Time) *time.Time {
+	if s.Paused {
+		return nil
+	}
+	expr, err := cron.Parse(s.Cron)
+	if err != nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil
+	}
+	next := expr.Next(t.In(loc))
+	if next.IsZero() {
+		return nil
+	}
+	next = next.UTC()
+	return &next
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ScriptVersion is the format of scripts the relay records and replays
+const ScriptVersion = 1
+
+// MaxScriptSteps is the most steps a script holds
+const MaxScriptSteps = 1000
+
+// Most a replay may speed a script up or slow it down
+const (
+	MinReplaySpeed = 0.1
+	MaxReplaySpeed = 100.0
+)
+
+// Script is a recording of the commands sent to a tab, replayable with
+// POST /api/v1/replay
+type Script struct {
+	Version   int          `json:"version"`
+	ID        string       `json:"id,omitempty"`
+	TabID     string       `json:"tabId,omitempty"` // the tab recorded
+	URL       string       `json:"url,omitempty"`   // the tab's page when recording started
+	StartedAt time.Time    `json:"startedAt"`
+	StoppedAt *time.Time   `json:"stoppedAt,omitempty"` // nil while recording
+	Steps     []ScriptStep `json:"steps"`
+	Skipped   int          `json:"skipped,omitempty"`   // uploads and secret-bearing commands left out
+	Truncated bool         `json:"truncated,omitempty"` // commands after MaxScriptSteps were left out
+}
+
+// ScriptStep is one recorded command
+type ScriptStep struct {
+	Offset int64         `json:"offset"` // ms after the recording started
+	Action CommandAction `json:"action"`
+}
+
+// ScriptRecordRequest for POST /api/v1/scripts
+type ScriptRecordRequest struct {
+	TabID string `json:"tabId"`
+}
+
+// ReplayRequest for POST /api/v1/replay
+type ReplayRequest struct {
+	TabID  string `json:"tabId"`
+	Script Script `json:"script"`
+	// Pace relative to the recording: 2 replays twice as fast. With
+	// IgnoreTiming each step starts as soon as the previous one ends.
+	Speed        float64 `json:"speed,omitempty"` // default 1
+	IgnoreTiming bool    `json:"ignoreTiming,omitempty"`
+	Navigate     *bool   `json:"navigate,omitempty"` // open the script's url first; default true
+	Timeout      int     `json:"timeout,omitempty"`  // per step, ms
+	// Run the remaining steps after one fails
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+}
+
+// ReplayResponse for POST /api/v1/replay
+type ReplayResponse struct {
+	TabID   string            `json:"tabId"`
+	Success bool              `json:"success"` // every step succeeded
+	Steps   []BatchStepResult `json:"steps"`   // steps run, in order
+	Elapsed int64             `json:"elapsed"` // ms
+}
+
+// Validate checks a script given to replay
+func (s *Script) Validate() error {
+	if s.Version != ScriptVersion {
+		return fmt.Errorf("script version must be %d", ScriptVersion)
+	}
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("script has no steps")
+	}
+	if len(s.Steps) > MaxScriptSteps {
+		return fmt.Errorf("a script has at most %d steps", MaxScriptSteps)
+	}
+	var last int64
+	for i, step := range s.Steps {
+		if step.Offset < last {
+			return fmt.Errorf("step %d: offsets must not decrease", i)
+		}
+		last = step.Offset
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package models
+
+import "fmt"
+
+// ValidateScrollTo checks a scroll_to action: an element to bring into view
+// or a page position to scroll to, and how
+func (a *CommandAction) ValidateScrollTo() error {
+	if (a.Selector == "") == (a.Position == nil) {
+		return fmt.Errorf("scroll_to needs exactly one of selector or position")
+	}
+	if p := a.Position; p != nil && (p.X < 0 || p.Y < 0) {
+		return fmt.Errorf("position must not be negative")
+	}
+	switch a.Behavior {
+	case "", "instant", "smooth":
+	default:
+		return fmt.Errorf("behavior must be instant or smooth")
+	}
+	switch a.Block {
+	case "", "start", "center", "end", "nearest":
+	default:
+		return fmt.Errorf("block must be start, center, end, or nearest")
+	}
+	if a.Block != "" && a.Selector == "" {
+		return fmt.Errorf("block applies only with a selector")
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package models
+
+import "fmt"
+
+// ValidateSelect checks a select action: it needs the <select> and
+// exactly one way to pick the option
+func (a *CommandAction) ValidateSelect() error {
+	if a.Selector == "" {
+		return fmt.Errorf("select needs a selector")
+	}
+	set := 0
+	for _, ok := range []bool{a.Value != nil, a.Label != nil, a.Index != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("select needs exactly one of value, label, or index")
+	}
+	if a.Index != nil && *a.Index < 0 {
+		return fmt.Errorf("index must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import "fmt"
+
+// Selector engines of CommandAction.SelectorEngine. A selector may also
+// name its engine itself, as in "text=Sign in", which takes precedence.
+const (
+	SelectorCSS    = "css"    // document.querySelector; the default
+	SelectorXPath  = "xpath"  // an XPath expression
+	SelectorText   = "text"   // the innermost elements containing the text
+	SelectorPierce = "pierce" // CSS matched inside open shadow roots too
+)
+
+// selectorKinds are the action kinds whose selectors an engine applies to
+var selectorKinds = map[string]bool{
+	"click": true, "doubleclick": true, "hover": true, "drag": true,
+	"type": true, "press": true, "select": true, "query": true,
+	"scroll": true, "scroll_to": true, "screenshot": true, "fill_form": true,
+}
+
+// ValidateSelectorEngine checks an action's selector engine: a known one,
+// on an action that takes selectors. A snapshot takes only pierce, which
+// includes open shadow roots in it.
+func (a *CommandAction) ValidateSelectorEngine() error {
+	switch a.SelectorEngine {
+	case "":
+		return nil
+	case SelectorCSS, SelectorXPath, SelectorText, SelectorPierce:
+	default:
+		return fmt.Errorf("selectorEngine must be css, xpath, text, or pierce")
+	}
+	if a.Kind == "snapshot" {
+		if a.SelectorEngine != SelectorPierce {
+			return fmt.Errorf("snapshot takes only the pierce selectorEngine")
+		}
+		return nil
+	}
+	if !selectorKinds[a.Kind] {
+		return fmt.Errorf("%s takes no selectorEngine", a.Kind)
+	}
+	if a.XPath != "" {
+		return fmt.Errorf("selectorEngine applies to selector, not xpath")
+	}
+	return nil
+}
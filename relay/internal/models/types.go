@@ -1,17 +1,175 @@
 // Package models defines shared data structures
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 // Token represents an API token stored in the database
 type Token struct {
-	ID         int64      `json:"id"`
-	Hash       string     `json:"-"` // SHA-256 hash, never exposed
-	Name       string     `json:"name"`
-	RateLimit  int        `json:"rateLimit"`
-	CreatedAt  time.Time  `json:"createdAt"`
-	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
-	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	ID         int64           `json:"id"`
+	Hash       string          `json:"-"` // random identity that survives rotations, never exposed
+	Name       string          `json:"name"`
+	RateLimit  int             `json:"rateLimit"` // requests per RATE_LIMIT_WINDOW
+	RateBurst  int             `json:"rateBurst"` // bucket capacity; 0 means RateLimit
+	RateDebt   int             `json:"rateDebt"`  // requests allowed past an empty bucket before 429s
+	Scopes     []string        `json:"scopes"`
+	Defaults   TokenDefaults   `json:"defaults"`
+	Features   map[string]bool `json:"features,omitempty"` // feature flag overrides
+	CreatedAt  time.Time       `json:"createdAt"`
+	LastUsedAt *time.Time      `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time      `json:"revokedAt,omitempty"`
+	// Until when the secret replaced by the last rotation still works
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt,omitempty"`
+	// The OIDC subject acting as this token, for requests that presented
+	// a JWT; see OIDC_ISSUER
+	Subject string `json:"-"`
+}
+
+// RotateTokenRequest for POST /api/v1/admin/tokens/{id}/rotate
+type RotateTokenRequest struct {
+	GracePeriod *int `json:"gracePeriod,omitempty"` // seconds the old secret keeps working; default TOKEN_ROTATION_GRACE
+}
+
+// RotateTokenResponse carries a token's new secret, shown only once
+type RotateTokenResponse struct {
+	ID                int64     `json:"id"`
+	Name              string    `json:"name"`
+	Token             string    `json:"token"`
+	PreviousExpiresAt time.Time `json:"previousExpiresAt"` // when the old secret stops working
+}
+
+// TokenLimits are a token's rate limit settings, for the admin API
+type TokenLimits struct {
+	RateLimit int `json:"rateLimit"`
+	RateBurst int `json:"rateBurst"`
+	RateDebt  int `json:"rateDebt"`
+}
+
+// Validate checks the limits are in range
+func (l TokenLimits) Validate() error {
+	if l.RateLimit <= 0 {
+		return fmt.Errorf("rateLimit must be positive")
+	}
+	if l.RateBurst < 0 || l.RateDebt < 0 {
+		return fmt.Errorf("rateBurst and rateDebt must not be negative")
+	}
+	return nil
+}
+
+// TokenDefaults are action options stored with a token and applied to its
+// requests that leave them out. Zero values fall back to the relay's own
+// defaults.
+type TokenDefaults struct {
+	Timeout             int    `json:"timeout,omitempty"`             // ms; default COMMAND_TIMEOUT
+	SnapshotFormat      string `json:"snapshotFormat,omitempty"`      // html, simplified, or markdown
+	SnapshotMaxDepth    int    `json:"snapshotMaxDepth,omitempty"`    // default DEFAULT_SNAPSHOT_MAX_DEPTH
+	SnapshotMaxLength   int    `json:"snapshotMaxLength,omitempty"`   // default DEFAULT_SNAPSHOT_MAX_LENGTH
+	ScreenshotOnFailure bool   `json:"screenshotOnFailure,omitempty"` // capture the tab when a command fails
+	Actionability       *bool  `json:"actionability,omitempty"`       // false skips the extension's actionability checks
+}
+
+// Validate checks the defaults against the longest timeout a command may
+// be given
+func (d TokenDefaults) Validate(maxTimeout int) error {
+	switch {
+	case d.Timeout < 0 || d.Timeout > maxTimeout:
+		return fmt.Errorf("timeout must be between 0 and %dms", maxTimeout)
+	case d.SnapshotFormat != "" && !ValidSnapshotFormat(d.SnapshotFormat):
+		return fmt.Errorf("snapshotFormat must be html, simplified, or markdown")
+	case d.SnapshotMaxDepth < 0:
+		return fmt.Errorf("snapshotMaxDepth must not be negative")
+	case d.SnapshotMaxLength < 0:
+		return fmt.Errorf("snapshotMaxLength must not be negative")
+	}
+	return nil
+}
+
+// Token scopes
+const (
+	ScopeRead       = "read"       // status, tabs, snapshots
+	ScopeCommand    = "command"    // page interaction: click, type, navigate, ...
+	ScopeScreenshot = "screenshot" // screenshot capture
+	ScopeEvaluate   = "evaluate"   // arbitrary JavaScript execution
+	ScopeAdmin      = "admin"      // everything, including admin endpoints
+)
+
+// AllScopes lists every valid scope
+var AllScopes = []string{ScopeRead, ScopeCommand, ScopeScreenshot, ScopeEvaluate, ScopeAdmin}
+
+// DefaultScopes are granted to tokens created without explicit scopes
+var DefaultScopes = []string{ScopeRead, ScopeCommand, ScopeScreenshot, ScopeEvaluate}
+
+// IsValidScope reports whether s is a known scope
+func IsValidScope(s string) bool {
+	for _, scope := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeForAction returns the scope required to run an action kind
+func ScopeForAction(kind string) string {
+	switch kind {
+	case "snapshot", "query":
+		return ScopeRead
+	case "screenshot":
+		return ScopeScreenshot
+	case "evaluate":
+		return ScopeEvaluate
+	default:
+		return ScopeCommand
+	}
+}
+
+// HasScope reports whether the token grants scope; admin grants all scopes
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// URL policy effects
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// URLRule is an allow or deny glob restricting which pages a token may touch
+type URLRule struct {
+	ID        int64     `json:"id"`
+	TokenID   int64     `json:"tokenId"`
+	Effect    string    `json:"effect"`  // allow or deny
+	Pattern   string    `json:"pattern"` // host glob, or full-URL glob if it contains "://"
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Job represents a queued unit of work for an agent token
+type Job struct {
+	ID          int64           `json:"id"`
+	TokenID     int64           `json:"tokenId"`
+	CreatedBy   int64           `json:"createdBy"`
+	Queue       string          `json:"queue"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"` // queued, leased, done, failed
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	LeaseUntil  *time.Time      `json:"leaseUntil,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
 }
 
 // Tab represents a browser tab connected via the extension
@@ -20,18 +178,262 @@ type Tab struct {
 	URL        string    `json:"url"`
 	Title      string    `json:"title"`
 	FavIconURL string    `json:"favIconUrl,omitempty"`
+	SessionID  string    `json:"sessionId,omitempty"`
 	AttachedAt time.Time `json:"attachedAt"`
+	ReportedAt time.Time `json:"reportedAt"` // last attach, update, or sync from the extension
 }
 
 // Session represents an extension connection
 type Session struct {
-	ID             string    `json:"id"`
-	TokenHash      string    `json:"-"`
-	TokenName      string    `json:"tokenName"`
-	Tabs           map[string]*Tab `json:"tabs"`
-	ExtensionVer   string    `json:"extensionVersion,omitempty"`
-	ConnectedAt    time.Time `json:"connectedAt"`
-	LastPingAt     time.Time `json:"lastPingAt"`
+	ID           string          `json:"id"`
+	TokenHash    string          `json:"-"`
+	TokenName    string          `json:"tokenName"`
+	Tabs         map[string]*Tab `json:"tabs"`
+	ExtensionVer string          `json:"extensionVersion,omitempty"`
+	Name         string          `json:"name,omitempty"`   // e.g. "Chrome 126 on macOS — work laptop"
+	Client       *ClientInfo     `json:"client,omitempty"` // from the extension's connect message
+	Window       *WindowState    `json:"window,omitempty"` // as the extension last reported it
+	Canary       bool            `json:"canary,omitempty"` // matched CANARY_VERSIONS or CANARY_LABELS
+	ConnectedAt  time.Time       `json:"connectedAt"`
+	LastPingAt   time.Time       `json:"lastPingAt"`
+	Node         string          `json:"node,omitempty"` // relay holding the connection, in cluster mode
+
+	// Guards Tabs, which is written by the read pump and read by handlers
+	tabsMu sync.RWMutex
+	// Guards ExtensionVer, Name, Client and Canary, set by the connect
+	// message, and Window
+	infoMu sync.RWMutex
+}
+
+// ClientInfo identifies the browser an extension runs in
+type ClientInfo struct {
+	Browser        string   `json:"browser,omitempty"`        // e.g. "Chrome"
+	BrowserVersion string   `json:"browserVersion,omitempty"` // e.g. "126.0.6478.127"
+	OS             string   `json:"os,omitempty"`             // e.g. "macOS"
+	InstallID      string   `json:"installId,omitempty"`      // stable across restarts of one install
+	DeviceName     string   `json:"deviceName,omitempty"`     // chosen by the user, e.g. "work laptop"
+	Labels         []string `json:"labels,omitempty"`         // rollout labels, e.g. "canary"
+
+	// Negotiated in the connect handshake; 1 for extensions that predate it
+	ProtocolVersion int      `json:"protocolVersion"`
+	Capabilities    []string `json:"capabilities,omitempty"` // optional features the extension supports
+	Actions         []string `json:"actions,omitempty"`      // command kinds it runs; nil when it did not say
+	Encoding        string   `json:"encoding,omitempty"`     // frame encoding, "json" or "binary"
+}
+
+// SetClient records the extension version and browser from a connect
+// message and names the session after them
+func (s *Session) SetClient(extensionVersion string, client *ClientInfo) {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.ExtensionVer = extensionVersion
+	s.Client = client
+	s.Name = client.Label()
+}
+
+// WindowState describes the browser window the extension last saw
+// focused, so a scheduler can pick a session with a visible window
+type WindowState struct {
+	Width   int    `json:"width"` // outer size, CSS pixels
+	Height  int    `json:"height"`
+	State   string `json:"state"`   // normal, minimized, maximized, or fullscreen
+	Focused bool   `json:"focused"` // the browser is the active application
+	Windows int    `json:"windows"` // normal windows open
+	// When the relay received it
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SetWindow records the window state the extension reported
+func (s *Session) SetWindow(window *WindowState) {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.Window = window
+}
+
+// CurrentWindow returns the window state last reported, or nil. It is
+// shared and must not be modified.
+func (s *Session) CurrentWindow() *WindowState {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.Window
+}
+
+// SetCanary marks whether the session runs commands with new protocol
+// features
+func (s *Session) SetCanary(canary bool) {
+	s.infoMu.Lock()
+	defer s.infoMu.Unlock()
+	s.Canary = canary
+}
+
+// HasCapability reports whether the session's extension advertised a
+// capability in its connect message
+func (s *Session) HasCapability(name string) bool {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.Client != nil && slices.Contains(s.Client.Capabilities, name)
+}
+
+// SupportsAction reports whether the session's extension runs commands of
+// a kind. One that did not list its actions is assumed to run them all.
+func (s *Session) SupportsAction(kind string) bool {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.Client == nil || s.Client.Actions == nil || slices.Contains(s.Client.Actions, kind)
+}
+
+// ProtocolVersion returns the protocol version negotiated with the
+// session's extension, 1 until it sends connect
+func (s *Session) ProtocolVersion() int {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	if s.Client == nil || s.Client.ProtocolVersion == 0 {
+		return 1
+	}
+	return s.Client.ProtocolVersion
+}
+
+// IsCanary reports whether the session is a canary
+func (s *Session) IsCanary() bool {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.Canary
+}
+
+// Info returns the session's name, extension version and client. The
+// client is shared and must not be modified.
+func (s *Session) Info() (name, extensionVersion string, client *ClientInfo) {
+	s.infoMu.RLock()
+	defer s.infoMu.RUnlock()
+	return s.Name, s.ExtensionVer, s.Client
+}
+
+// Label names a session after its browser, e.g. "Chrome 126 on macOS —
+// work laptop". Without a device name the start of the install ID tells
+// installs apart.
+func (c *ClientInfo) Label() string {
+	var b strings.Builder
+	if c.Browser != "" {
+		b.WriteString(c.Browser)
+		if major, _, _ := strings.Cut(c.BrowserVersion, "."); major != "" {
+			b.WriteString(" " + major)
+		}
+	}
+	if c.OS != "" {
+		if b.Len() > 0 {
+			b.WriteString(" on ")
+		}
+		b.WriteString(c.OS)
+	}
+
+	suffix := c.DeviceName
+	if suffix == "" && c.InstallID != "" {
+		suffix = c.InstallID[:min(len(c.InstallID), 8)]
+	}
+	if suffix != "" {
+		if b.Len() > 0 {
+			b.WriteString(" — ")
+		}
+		b.WriteString(suffix)
+	}
+	return b.String()
+}
+
+// SetTab adds or replaces a tab
+func (s *Session) SetTab(tab *Tab) {
+	s.tabsMu.Lock()
+	defer s.tabsMu.Unlock()
+	s.Tabs[tab.ID] = tab
+}
+
+// RemoveTab removes a tab by ID
+func (s *Session) RemoveTab(tabID string) {
+	s.tabsMu.Lock()
+	defer s.tabsMu.Unlock()
+	delete(s.Tabs, tabID)
+}
+
+// UpdateTab applies fn to the tab with the given ID, if present
+func (s *Session) UpdateTab(tabID string, fn func(tab *Tab)) bool {
+	s.tabsMu.Lock()
+	defer s.tabsMu.Unlock()
+	tab, ok := s.Tabs[tabID]
+	if ok {
+		fn(tab)
+	}
+	return ok
+}
+
+// ReplaceTabs reconciles the tab registry with a full tab list, keeping the
+// original attach time of tabs that were already known
+func (s *Session) ReplaceTabs(tabs []*Tab) {
+	s.tabsMu.Lock()
+	defer s.tabsMu.Unlock()
+
+	next := make(map[string]*Tab, len(tabs))
+	for _, tab := range tabs {
+		if existing, ok := s.Tabs[tab.ID]; ok {
+			tab.AttachedAt = existing.AttachedAt
+		}
+		next[tab.ID] = tab
+	}
+	s.Tabs = next
+}
+
+// ExpireTabs removes the tabs last reported before t and returns their IDs
+func (s *Session) ExpireTabs(t time.Time) []string {
+	s.tabsMu.Lock()
+	defer s.tabsMu.Unlock()
+
+	var expired []string
+	for id, tab := range s.Tabs {
+		if tab.ReportedAt.Before(t) {
+			delete(s.Tabs, id)
+			expired = append(expired, id)
+		}
+	}
+	return expired
+}
+
+// GetTab returns a copy of the tab with the given ID
+func (s *Session) GetTab(tabID string) (Tab, bool) {
+	s.tabsMu.RLock()
+	defer s.tabsMu.RUnlock()
+	if tab, ok := s.Tabs[tabID]; ok {
+		return *tab, true
+	}
+	return Tab{}, false
+}
+
+// HasTab reports whether the tab is attached to this session
+func (s *Session) HasTab(tabID string) bool {
+	s.tabsMu.RLock()
+	defer s.tabsMu.RUnlock()
+	_, ok := s.Tabs[tabID]
+	return ok
+}
+
+// TabList returns copies of all tabs, oldest attachment first
+func (s *Session) TabList() []*Tab {
+	s.tabsMu.RLock()
+	tabs := make([]*Tab, 0, len(s.Tabs))
+	for _, tab := range s.Tabs {
+		t := *tab
+		tabs = append(tabs, &t)
+	}
+	s.tabsMu.RUnlock()
+
+	sort.Slice(tabs, func(i, j int) bool {
+		return tabs[i].AttachedAt.Before(tabs[j].AttachedAt)
+	})
+	return tabs
+}
+
+// TabCount returns the number of attached tabs
+func (s *Session) TabCount() int {
+	s.tabsMu.RLock()
+	defer s.tabsMu.RUnlock()
+	return len(s.Tabs)
 }
 
 // --- WebSocket Messages ---
@@ -41,19 +443,86 @@ type WSMessage struct {
 	Type string `json:"type"`
 }
 
-// ConnectAck is sent after successful connection
+// ConnectAck is sent after successful connection, with the protocol
+// versions the relay accepts
 type ConnectAck struct {
-	Type          string `json:"type"` // "connect_ack"
-	SessionID     string `json:"sessionId"`
-	ServerTime    int64  `json:"serverTime"`
-	ServerVersion string `json:"serverVersion"`
+	Type               string `json:"type"` // "connect_ack"
+	SessionID          string `json:"sessionId"`
+	ServerTime         int64  `json:"serverTime"`
+	ServerVersion      string `json:"serverVersion"`
+	ProtocolVersion    int    `json:"protocolVersion"`
+	MinProtocolVersion int    `json:"minProtocolVersion"`
 }
 
-// ConnectError is sent when connection fails
+// ConnectAccepted answers a connect message that gave a protocolVersion,
+// with the version both sides now speak
+type ConnectAccepted struct {
+	Type            string `json:"type"` // "connect_accepted"
+	ProtocolVersion int    `json:"protocolVersion"`
+	// Frame encoding for every later message in both directions
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// ConnectError is sent when connection fails. For UNSUPPORTED_PROTOCOL it
+// carries the versions the relay accepts, and the socket is then closed.
 type ConnectError struct {
-	Type    string `json:"type"` // "connect_error"
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Type               string `json:"type"` // "connect_error"
+	Code               string `json:"code"`
+	Message            string `json:"message"`
+	ProtocolVersion    int    `json:"protocolVersion,omitempty"`
+	MinProtocolVersion int    `json:"minProtocolVersion,omitempty"`
+}
+
+// RateLimitWarning is sent when an extension exceeds inbound message limits.
+// The connection is closed once Strikes reaches MaxStrikes.
+type RateLimitWarning struct {
+	Type              string `json:"type"` // "rate_limit_warning"
+	Message           string `json:"message"`
+	MaxMessagesPerSec int    `json:"maxMessagesPerSec"`
+	MaxBytesPerSec    int    `json:"maxBytesPerSec"`
+	Strikes           int    `json:"strikes"`
+	MaxStrikes        int    `json:"maxStrikes"`
+}
+
+// ExtensionConnect is received once after connecting and identifies the
+// extension and its browser
+type ExtensionConnect struct {
+	Type             string `json:"type"` // "connect"
+	ExtensionVersion string `json:"extensionVersion,omitempty"`
+	Browser          string `json:"browser,omitempty"`
+	BrowserVersion   string `json:"browserVersion,omitempty"`
+	OS               string `json:"os,omitempty"`
+	InstallID        string `json:"installId,omitempty"`
+	DeviceName       string `json:"deviceName,omitempty"`
+	// Rollout labels, e.g. "canary"; matched against CANARY_LABELS
+	Labels []string `json:"labels,omitempty"`
+	// The browser window it sees focused; later changes arrive as
+	// window_update messages
+	Window *WindowState `json:"window,omitempty"`
+	// The protocol versions the extension speaks, from MinProtocolVersion
+	// (default 1) to ProtocolVersion (default 1), and the optional features
+	// it supports
+	ProtocolVersion    int      `json:"protocolVersion,omitempty"`
+	MinProtocolVersion int      `json:"minProtocolVersion,omitempty"`
+	Capabilities       []string `json:"capabilities,omitempty"`
+	// The command kinds it runs; commands of other kinds are refused with
+	// UNSUPPORTED_ACTION. Without the list every kind is sent.
+	Actions []string `json:"actions,omitempty"`
+
+	// Frame encodings it can read and write, e.g. "binary"; JSON text
+	// frames are always understood
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// ScreenshotChunk carries one piece of a command result's base64 "data",
+// for results too large for one message. Chunks are sent before the
+// command_response, which then omits "data".
+type ScreenshotChunk struct {
+	Type  string `json:"type"` // "screenshot_chunk"
+	ID    string `json:"id"`   // command ID
+	Seq   int    `json:"seq"`  // 0-based position
+	Total int    `json:"total"`
+	Data  string `json:"data"`
 }
 
 // TabAttach is received when a tab is attached
@@ -65,6 +534,49 @@ type TabAttach struct {
 	FavIconURL string `json:"favIconUrl,omitempty"`
 }
 
+// TabSync is received with the extension's full tab list, right after
+// connecting or in reply to a SyncRequest
+type TabSync struct {
+	Type string    `json:"type"` // "sync"
+	Tabs []SyncTab `json:"tabs"`
+}
+
+// SyncTab is one entry of a TabSync
+type SyncTab struct {
+	TabID      string `json:"tabId"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	FavIconURL string `json:"favIconUrl,omitempty"`
+}
+
+// SyncRequest asks the extension to send a TabSync
+type SyncRequest struct {
+	Type string `json:"type"` // "sync_request"
+}
+
+// ProtocolError is sent when an extension message fails validation. The
+// message is otherwise ignored.
+type ProtocolError struct {
+	Type        string   `json:"type"` // "protocol_error"
+	Code        string   `json:"code"` // MALFORMED_MESSAGE, UNKNOWN_TYPE, INVALID_MESSAGE, MESSAGE_TOO_LARGE, INVALID_CHUNK
+	Message     string   `json:"message"`
+	MessageType string   `json:"messageType,omitempty"`
+	Details     []string `json:"details,omitempty"`
+}
+
+// CommandCancel tells the extension the relay stopped waiting for a command
+type CommandCancel struct {
+	Type   string `json:"type"` // "command_cancel"
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// ServerShutdown is sent before the relay closes connections on shutdown
+type ServerShutdown struct {
+	Type   string `json:"type"` // "server_shutdown"
+	Reason string `json:"reason"`
+}
+
 // TabDetach is received when a tab is detached
 type TabDetach struct {
 	Type  string `json:"type"` // "tab_detach"
@@ -79,6 +591,79 @@ type TabUpdate struct {
 	Title string `json:"title,omitempty"`
 }
 
+// WindowUpdate is received when the window the extension sees focused
+// changes size, state, or focus
+type WindowUpdate struct {
+	Type   string      `json:"type"` // "window_update"
+	Window WindowState `json:"window"`
+}
+
+// Subscribe is sent after connect_ack to name the page events the relay
+// wants forwarded
+type Subscribe struct {
+	Type   string   `json:"type"`   // "subscribe"
+	Events []string `json:"events"` // "console", "downloads", "page_events"
+}
+
+// ConsoleMessage is received for a console call or uncaught error in an
+// attached tab, while the relay subscribes to "console"
+type ConsoleMessage struct {
+	Type      string `json:"type"` // "console"
+	TabID     string `json:"tabId"`
+	Level     string `json:"level"`            // debug, log, info, warn, error
+	Source    string `json:"source,omitempty"` // console, exception, rejection
+	Message   string `json:"message"`
+	URL       string `json:"url,omitempty"` // script the entry came from
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+	Stack     string `json:"stack,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // unix ms in the browser
+}
+
+// PageEventMessage is received when something happens in an attached tab
+// that clients may be waiting for, while the relay subscribes to
+// "page_events"
+type PageEventMessage struct {
+	Type      string      `json:"type"` // "page_event"
+	TabID     string      `json:"tabId"`
+	Event     string      `json:"event"` // navigation_completed, dialog_opened, dom_mutated
+	URL       string      `json:"url,omitempty"`
+	Title     string      `json:"title,omitempty"`
+	Dialog    *PageDialog `json:"dialog,omitempty"`    // dialog_opened
+	Mutations int         `json:"mutations,omitempty"` // dom_mutated: changes since the last one
+	Timestamp int64       `json:"timestamp,omitempty"` // unix ms in the browser
+}
+
+// PageDialog describes a JavaScript dialog a page opened
+type PageDialog struct {
+	Type    string `json:"type"` // alert, confirm, prompt
+	Message string `json:"message"`
+}
+
+// DownloadMessage is received when a download started in an attached tab
+// completes, while the relay subscribes to "downloads". Its content follows
+// in Total download_chunk messages; with none the file is empty, or could
+// not be read if Error is set.
+type DownloadMessage struct {
+	Type     string `json:"type"` // "download"
+	ID       string `json:"id"`   // the extension's; unique per connection
+	TabID    string `json:"tabId"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mimeType,omitempty"`
+	URL      string `json:"url,omitempty"` // where the file was downloaded from
+	Size     int64  `json:"size"`          // bytes
+	Total    int    `json:"total"`         // chunks to follow
+	Error    string `json:"error,omitempty"`
+}
+
+// DownloadChunk is received with a piece of a download's content, in order
+type DownloadChunk struct {
+	Type string `json:"type"` // "download_chunk"
+	ID   string `json:"id"`
+	Seq  int    `json:"seq"`
+	Data string `json:"data"` // base64
+}
+
 // Ping is sent to check connection health
 type Ping struct {
 	Type      string `json:"type"` // "ping"
@@ -87,41 +672,178 @@ type Ping struct {
 
 // Pong is received in response to ping
 type Pong struct {
-	Type      string `json:"type"` // "pong"
-	Timestamp int64  `json:"timestamp"`
-	TabCount  int    `json:"tabCount"`
+	Type       string `json:"type"`                 // "pong"
+	Timestamp  int64  `json:"timestamp"`            // relay time echoed from the ping or connect ack; browser time in heartbeats
+	ClientTime int64  `json:"clientTime,omitempty"` // browser time (unix ms) the ping or ack was received
+	TabCount   int    `json:"tabCount"`
 }
 
 // CommandRequest is sent to execute a command
 type CommandRequest struct {
 	Type    string        `json:"type"` // "command"
 	ID      string        `json:"id"`
+	Seq     uint64        `json:"seq"` // Monotonic per relay; echoed in the response
 	Action  CommandAction `json:"action"`
 	TabID   string        `json:"tabId"`
 	Timeout int           `json:"timeout"` // ms
+	// Canary asks a canary session's extension to use new protocol
+	// features. The hub decides it when sending, from CanaryPreference
+	// (the client's explicit choice, kept while the command is forwarded
+	// between relays) or CANARY_PERCENT.
+	Canary           bool  `json:"canary,omitempty"`
+	CanaryPreference *bool `json:"canaryPreference,omitempty"`
+	// Priority is high, normal, or low (default normal). Higher commands
+	// go first to the socket and past the token's queued commands; the
+	// extension may use it to order its own work.
+	Priority string `json:"priority,omitempty"`
+	// TraceParent is the W3C trace context of the command's span when it
+	// is traced; the extension echoes it in its response
+	TraceParent string `json:"traceparent,omitempty"`
+	// Uploads holds the contents of an "upload" action's files, in the
+	// order of Action.Files. The hub streams them to the extension as
+	// upload_chunk messages ahead of the command and never sends this field.
+	Uploads [][]byte `json:"uploads,omitempty"`
+}
+
+// UploadChunk is sent ahead of an "upload" command with a piece of one of
+// its files
+type UploadChunk struct {
+	Type  string `json:"type"` // "upload_chunk"
+	ID    string `json:"id"`   // the upload command's ID
+	File  int    `json:"file"` // index into the action's files
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+	Data  string `json:"data"` // base64
 }
 
 // CommandAction defines the action to perform
 type CommandAction struct {
-	Kind        string   `json:"kind"` // click, type, scroll, screenshot, snapshot, navigate, evaluate
-	Selector    string   `json:"selector,omitempty"`
-	Coordinates *Point   `json:"coordinates,omitempty"`
-	Button      string   `json:"button,omitempty"`
-	Modifiers   []string `json:"modifiers,omitempty"`
-	Text        string   `json:"text,omitempty"`
-	Clear       bool     `json:"clear,omitempty"`
-	Delay       int      `json:"delay,omitempty"`
-	Direction   string   `json:"direction,omitempty"`
-	Amount      int      `json:"amount,omitempty"`
-	FullPage    bool     `json:"fullPage,omitempty"`
-	Clip        *Rect    `json:"clip,omitempty"`
-	Quality     int      `json:"quality,omitempty"`
-	Format      string   `json:"format,omitempty"`
-	MaxDepth    int      `json:"maxDepth,omitempty"`
-	MaxLength   int      `json:"maxLength,omitempty"`
-	URL         string   `json:"url,omitempty"`
-	WaitUntil   string   `json:"waitUntil,omitempty"`
-	Script      string   `json:"script,omitempty"`
+	Kind        string `json:"kind"` // click, type, scroll, screenshot, snapshot, navigate, evaluate, tab_create, tab_close, cookies_get, cookies_set, cookies_clear, storage_get, storage_set, storage_remove, upload, fill_form, press, hover, drag, doubleclick, select, query, scroll_to, emulation_get, emulation_set, emulation_clear, set_viewport, set_network_conditions, request_rules_get, request_rules_set, request_rules_clear, headers_get, headers_set, headers_clear, credentials_get, credentials_set, credentials_clear
+	Selector    string `json:"selector,omitempty"`
+	Coordinates *Point `json:"coordinates,omitempty"`
+	// drag: where the drag ends, and the pointer moves (Steps, Delay ms
+	// apart) on the way there
+	ToSelector    string   `json:"toSelector,omitempty"`
+	ToCoordinates *Point   `json:"toCoordinates,omitempty"`
+	Steps         int      `json:"steps,omitempty"`
+	Button        string   `json:"button,omitempty"`
+	Modifiers     []string `json:"modifiers,omitempty"`
+	Text          string   `json:"text,omitempty"`
+	Key           string   `json:"key,omitempty"` // press: a key or combination such as "Enter" or "Control+A"
+	Clear         bool     `json:"clear,omitempty"`
+	Delay         int      `json:"delay,omitempty"`
+	Direction     string   `json:"direction,omitempty"`
+	Amount        int      `json:"amount,omitempty"`
+	FullPage      bool     `json:"fullPage,omitempty"`
+	Clip          *Rect    `json:"clip,omitempty"`
+	Quality       int      `json:"quality,omitempty"`
+	Format        string   `json:"format,omitempty"`
+	MaxDepth      int      `json:"maxDepth,omitempty"`
+	MaxLength     int      `json:"maxLength,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	WaitUntil     string   `json:"waitUntil,omitempty"`
+	Script        string   `json:"script,omitempty"`
+	Background    bool     `json:"background,omitempty"` // tab_create: open without focusing the tab
+	Name          string   `json:"name,omitempty"`       // cookies_get, cookies_clear: only this cookie
+	Cookies       []Cookie `json:"cookies,omitempty"`    // cookies_set
+	// scroll_to: the page offset to scroll to, when not the element
+	// matched by Selector; "instant" (default) or "smooth"; and where the
+	// element ends up in the viewport
+	Position *Point `json:"position,omitempty"`
+	Behavior string `json:"behavior,omitempty"`
+	Block    string `json:"block,omitempty"`
+	// evaluate: values passed to Script as args; whether a returned
+	// promise is awaited, and whether the value is serialized or only
+	// described (both default to true). MaxDepth bounds serialization.
+	Args          []json.RawMessage `json:"args,omitempty"`
+	AwaitPromise  *bool             `json:"awaitPromise,omitempty"`
+	ReturnByValue *bool             `json:"returnByValue,omitempty"`
+	// storage_*: "local" or "session"; keys to read or remove (all when
+	// empty); items to write
+	Area  string            `json:"area,omitempty"`
+	Keys  []string          `json:"keys,omitempty"`
+	Items map[string]string `json:"items,omitempty"`
+	// screenshot: captures to take, Interval ms apart, for a burst
+	Count    int `json:"count,omitempty"`
+	Interval int `json:"interval,omitempty"`
+	// fill_form: selector to value, as in FormRequest
+	Fields map[string]any `json:"fields,omitempty"`
+	// select: the option of the <select> matched by Selector to choose, by
+	// value, visible label, or index; exactly one is set
+	Value *string `json:"value,omitempty"`
+	Label *string `json:"label,omitempty"`
+	Index *int    `json:"index,omitempty"`
+	// snapshot: list the page's interactive elements
+	Interactive bool `json:"interactive,omitempty"`
+	// query: elements to describe, matched by Selector or XPath, and how
+	// many to return
+	XPath string `json:"xpath,omitempty"`
+	Limit int    `json:"limit,omitempty"`
+	// upload: the files to set on the file input matched by Selector
+	Files []UploadFile `json:"files,omitempty"`
+	// emulation_set: what the tab emulates from now on
+	Emulation *Emulation `json:"emulation,omitempty"`
+	// set_viewport: the screen the tab lays out for from now on; nil
+	// restores the browser window's own
+	Viewport *Viewport `json:"viewport,omitempty"`
+	// set_network_conditions: the connection the tab's requests get from
+	// now on; nil restores the real one
+	NetworkConditions *NetworkConditions `json:"networkConditions,omitempty"`
+	// request_rules_set: the rules the tab's requests get from now on
+	RequestRules *RequestRules `json:"requestRules,omitempty"`
+	// headers_set: the headers the tab's requests get from now on
+	ExtraHeaders *ExtraHeaders `json:"extraHeaders,omitempty"`
+	// credentials_set: the credential to answer an origin's auth
+	// challenges with, replacing one for the same origin
+	Credential *Credential `json:"credential,omitempty"`
+	// credentials_clear: only this origin's credential
+	Origin string `json:"origin,omitempty"`
+	// SelectorEngine matches Selector, ToSelector and the Fields of
+	// fill_form as css (default), xpath, text, or pierce; see selector.go
+	SelectorEngine string `json:"selectorEngine,omitempty"`
+	// Actionability false skips checking that the target of click,
+	// doubleclick, hover, drag, type, press, select, and fill_form is
+	// visible and enabled; nil leaves the check on
+	Actionability *bool `json:"actionability,omitempty"`
+}
+
+// Cookie is a cookie of a tab's origin. Domain and Path default to the
+// tab's URL; an Expires of 0 makes a session cookie.
+type Cookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Domain   string `json:"domain,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	SameSite string `json:"sameSite,omitempty"` // strict, lax, none
+	Expires  int64  `json:"expires,omitempty"`  // unix seconds
+}
+
+// Validate checks a cookie to be set
+func (c Cookie) Validate() error {
+	switch {
+	case c.Name == "":
+		return fmt.Errorf("cookie name is required")
+	case strings.ContainsAny(c.Name, "=; \t\r\n"):
+		return fmt.Errorf("cookie %q: name must not contain '=', ';' or whitespace", c.Name)
+	case strings.ContainsAny(c.Value, ";\r\n"):
+		return fmt.Errorf("cookie %q: value must not contain ';' or line breaks", c.Name)
+	case c.SameSite != "" && c.SameSite != "strict" && c.SameSite != "lax" && c.SameSite != "none":
+		return fmt.Errorf("cookie %q: sameSite must be strict, lax or none", c.Name)
+	case c.SameSite == "none" && !c.Secure:
+		return fmt.Errorf("cookie %q: sameSite none requires secure", c.Name)
+	case c.Expires < 0:
+		return fmt.Errorf("cookie %q: expires must not be negative", c.Name)
+	}
+	return nil
+}
+
+// UploadFile describes a file set on a file input by "upload"
+type UploadFile struct {
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType,omitempty"`
+	Size     int64  `json:"size"`
 }
 
 // Point represents x,y coordinates
@@ -140,12 +862,18 @@ type Rect struct {
 
 // CommandResponse is received after command execution
 type CommandResponse struct {
-	Type    string         `json:"type"` // "command_response"
-	ID      string         `json:"id"`
-	Success bool           `json:"success"`
-	Result  interface{}    `json:"result,omitempty"`
-	Error   *CommandError  `json:"error,omitempty"`
-	Timing  *CommandTiming `json:"timing,omitempty"`
+	Type    string          `json:"type"` // "command_response"
+	ID      string          `json:"id"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result,omitempty"` // as sent by the extension
+	Decoded CommandResult   `json:"-"`                // typed Result, set by the hub
+	Error   *CommandError   `json:"error,omitempty"`
+	Timing  *CommandTiming  `json:"timing,omitempty"`
+	Canary  bool            `json:"canary,omitempty"` // ran in canary mode; set by the hub
+	// TraceParent echoes the command's, so extension logs can be matched
+	// to the relay's trace
+	TraceParent string `json:"traceparent,omitempty"`
 }
 
 // CommandError contains error details
@@ -164,56 +892,409 @@ type CommandTiming struct {
 
 // HealthResponse for GET /health
 type HealthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Uptime  int64  `json:"uptime"`            // seconds
+	Role    string `json:"role"`              // primary or standby
+	Primary string `json:"primary,omitempty"` // set on a standby; where extensions should connect
+}
+
+// Health check statuses
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+	CheckSkip = "skipped"
+)
+
+// LivenessResponse for GET /healthz
+type LivenessResponse struct {
 	Status  string `json:"status"`
 	Version string `json:"version"`
 	Uptime  int64  `json:"uptime"` // seconds
 }
 
+// ReadinessResponse for GET /readyz. Status is "fail" when any check failed.
+type ReadinessResponse struct {
+	Status string                  `json:"status"`
+	Role   string                  `json:"role"` // primary or standby
+	Checks map[string]*HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of one readiness check
+type HealthCheck struct {
+	Status   string `json:"status"` // ok, fail, or skipped
+	Duration int64  `json:"durationMs"`
+	Error    string `json:"error,omitempty"`
+	Sessions *int   `json:"sessions,omitempty"` // extension check: connected sessions
+}
+
 // StatusResponse for GET /api/v1/status
 type StatusResponse struct {
 	Connected        bool   `json:"connected"`
 	LastSeen         string `json:"lastSeen,omitempty"`
 	ExtensionVersion string `json:"extensionVersion,omitempty"`
+	SessionName      string `json:"sessionName,omitempty"`
 	TabCount         int    `json:"tabCount,omitempty"`
+	SessionCount     int    `json:"sessionCount,omitempty"`
+
+	// Every session, oldest first
+	Sessions []SessionSummary `json:"sessions,omitempty"`
+}
+
+// SessionSummary describes one of the token's sessions in StatusResponse
+type SessionSummary struct {
+	ID               string       `json:"id"`
+	Name             string       `json:"name,omitempty"`
+	ExtensionVersion string       `json:"extensionVersion,omitempty"`
+	Client           *ClientInfo  `json:"client,omitempty"`
+	Window           *WindowState `json:"window,omitempty"`
+	TabCount         int          `json:"tabCount"`
+	ConnectedAt      time.Time    `json:"connectedAt"`
+	Node             string       `json:"node,omitempty"`
+}
+
+// SessionDetail for GET /api/v1/sessions/{id}
+type SessionDetail struct {
+	ID               string       `json:"id"`
+	Name             string       `json:"name,omitempty"`
+	TokenName        string       `json:"tokenName"`
+	ExtensionVersion string       `json:"extensionVersion,omitempty"`
+	Client           *ClientInfo  `json:"client,omitempty"` // browser, OS, and negotiated protocol
+	Window           *WindowState `json:"window,omitempty"`
+	Canary           bool         `json:"canary,omitempty"`
+	Node             string       `json:"node,omitempty"`
+	ConnectedAt      time.Time    `json:"connectedAt"`
+	ConnectedFor     int64        `json:"connectedFor"` // seconds
+	LastPingAt       time.Time    `json:"lastPingAt"`
+	Tabs             []*Tab       `json:"tabs"`
+
+	// Unknown for sessions held by another relay in cluster mode
+	Commands *SessionCommands `json:"commands,omitempty"`
+}
+
+// SessionCommands describes a session's in-flight commands and those
+// started in the last Window seconds
+type SessionCommands struct {
+	InFlight int            `json:"inFlight"`
+	Window   int            `json:"window"` // seconds
+	Started  int            `json:"started"`
+	Failed   int            `json:"failed"`
+	Errors   map[string]int `json:"errors"` // failures by error code
 }
 
 // TabsResponse for GET /api/v1/tabs
 type TabsResponse struct {
-	Tabs []*Tab `json:"tabs"`
+	Tabs   []*Tab `json:"tabs"`
+	Cursor string `json:"cursor"` // pass as ?since= to get only later changes
+}
+
+// TabChangesResponse for GET /api/v1/tabs?since=. Full is set when the
+// cursor is unknown or too old; Added then holds every tab and the client
+// should drop the tabs it had.
+type TabChangesResponse struct {
+	Cursor  string   `json:"cursor"`
+	Full    bool     `json:"full,omitempty"`
+	Added   []*Tab   `json:"added"`
+	Changed []*Tab   `json:"changed"`
+	Removed []string `json:"removed"` // tab IDs
+}
+
+// CreateTabRequest for POST /api/v1/tabs
+type CreateTabRequest struct {
+	URL        string `json:"url,omitempty"`        // Default about:blank
+	Background bool   `json:"background,omitempty"` // open without focusing
+	SessionID  string `json:"sessionId,omitempty"`  // Default: newest session
+	Timeout    int    `json:"timeout,omitempty"`    // ms
+}
+
+// SetCookiesRequest for POST /api/v1/cookies
+type SetCookiesRequest struct {
+	TabID   string   `json:"tabId"`
+	Cookies []Cookie `json:"cookies"`
+}
+
+// CookiesResponse for GET and POST /api/v1/cookies
+type CookiesResponse struct {
+	TabID   string   `json:"tabId"`
+	URL     string   `json:"url"` // the URL the cookies were read or set for
+	Cookies []Cookie `json:"cookies"`
+}
+
+// ClearCookiesResponse for DELETE /api/v1/cookies
+type ClearCookiesResponse struct {
+	TabID   string `json:"tabId"`
+	URL     string `json:"url"`
+	Removed int    `json:"removed"`
+}
+
+// SetEmulationRequest for POST /api/v1/emulation
+type SetEmulationRequest struct {
+	TabID     string    `json:"tabId"`
+	Emulation Emulation `json:"emulation"`
+}
+
+// EmulationResponse for /api/v1/emulation: what the tab emulates now
+type EmulationResponse struct {
+	TabID     string    `json:"tabId"`
+	Emulation Emulation `json:"emulation"`
+}
+
+// Web storage areas
+const (
+	StorageLocal   = "local"
+	StorageSession = "session"
+)
+
+// SetStorageRequest for POST /api/v1/storage
+type SetStorageRequest struct {
+	TabID string            `json:"tabId"`
+	Area  string            `json:"area,omitempty"` // local (default) or session
+	Items map[string]string `json:"items"`
+}
+
+// StorageResponse for GET and POST /api/v1/storage
+type StorageResponse struct {
+	TabID     string            `json:"tabId"`
+	URL       string            `json:"url"` // the page whose origin's storage this is
+	Area      string            `json:"area"`
+	Items     map[string]string `json:"items"`
+	Truncated bool              `json:"truncated,omitempty"` // more items than STORAGE_MAX_SIZE allows
+}
+
+// RemoveStorageResponse for DELETE /api/v1/storage
+type RemoveStorageResponse struct {
+	TabID   string `json:"tabId"`
+	URL     string `json:"url"`
+	Area    string `json:"area"`
+	Removed int    `json:"removed"`
+}
+
+// UploadResponse for POST /api/v1/upload
+type UploadResponse struct {
+	TabID    string       `json:"tabId"`
+	Selector string       `json:"selector"`
+	Files    []UploadFile `json:"files"`
+}
+
+// FormRequest for POST /api/v1/form. Each value is text for inputs and
+// textareas, an option value or label for selects, a boolean for
+// checkboxes and radio buttons, or a list of options for multiple selects.
+type FormRequest struct {
+	TabID         string         `json:"tabId"`
+	Fields        map[string]any `json:"fields"` // selector to value
+	Actionability *bool          `json:"actionability,omitempty"`
+}
+
+// FormResponse for POST /api/v1/form
+type FormResponse struct {
+	TabID  string            `json:"tabId"`
+	Filled bool              `json:"filled"` // false when any field failed and none were changed
+	Fields []FormFieldResult `json:"fields"`
+}
+
+// QueryRequest for POST /api/v1/query. Exactly one of Selector and XPath
+// is set.
+type QueryRequest struct {
+	TabID    string `json:"tabId"`
+	Selector string `json:"selector,omitempty"`
+	XPath    string `json:"xpath,omitempty"`
+	Limit    int    `json:"limit,omitempty"` // elements to describe; default 50, at most 500
+	// SelectorEngine matches Selector as css (default), xpath, text, or
+	// pierce
+	SelectorEngine string `json:"selectorEngine,omitempty"`
+}
+
+// EvaluateRequest for POST /api/v1/evaluate. Script is the body of a
+// function run in the page with Args as its args parameter; what it
+// returns is the result.
+type EvaluateRequest struct {
+	TabID         string            `json:"tabId"`
+	Script        string            `json:"script"`
+	Args          []json.RawMessage `json:"args,omitempty"`
+	AwaitPromise  *bool             `json:"awaitPromise,omitempty"`  // default true
+	ReturnByValue *bool             `json:"returnByValue,omitempty"` // default true; false only describes the value
+	MaxDepth      int               `json:"maxDepth,omitempty"`      // default 10, at most 32
+	MaxSize       int               `json:"maxSize,omitempty"`       // bytes of serialized value; default and at most EVALUATE_MAX_RESULT
+}
+
+// EvaluateResponse for POST /api/v1/evaluate. A value larger than MaxSize
+// is left out; Preview holds its first MaxSize bytes instead.
+type EvaluateResponse struct {
+	TabID       string          `json:"tabId"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	Type        string          `json:"type"`
+	ClassName   string          `json:"className,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Size        int             `json:"size"` // bytes of the serialized value
+	Truncated   bool            `json:"truncated"`
+	Preview     string          `json:"preview,omitempty"`
+}
+
+// QueryResponse for POST /api/v1/query
+type QueryResponse struct {
+	TabID     string         `json:"tabId"`
+	Count     int            `json:"count"` // elements matched
+	Elements  []QueryElement `json:"elements"`
+	Truncated bool           `json:"truncated"` // more matched than Limit
 }
 
 // CommandAPIRequest for POST /api/v1/command
 type CommandAPIRequest struct {
-	TabID   string        `json:"tabId"`
+	ID      string        `json:"id,omitempty"` // Default: generated; lets a client look up the result after disconnecting
+	TabID   string        `json:"tabId"`        // optional for tab_create
 	Action  CommandAction `json:"action"`
 	Timeout int           `json:"timeout,omitempty"` // Default 5000ms
+	// OnDisconnect is "cancel" or "complete"; default COMMAND_ON_DISCONNECT
+	OnDisconnect string `json:"onDisconnect,omitempty"`
+	// ScreenshotOnFailure captures the tab if the command fails; default
+	// from the token's defaults
+	ScreenshotOnFailure *bool `json:"screenshotOnFailure,omitempty"`
+	// Canary runs the command with new protocol features (true) or without
+	// (false) if it lands on a canary session; default CANARY_PERCENT
+	Canary *bool `json:"canary,omitempty"`
+	// Priority is high, normal, or low; default normal
+	Priority string `json:"priority,omitempty"`
 }
 
+// Command priorities
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// What happens to a command whose HTTP client goes away
+const (
+	OnDisconnectCancel   = "cancel"   // tell the extension to abandon it
+	OnDisconnectComplete = "complete" // let it finish and keep the result for GET /api/v1/commands/{id}
+)
+
 // CommandAPIResponse for POST /api/v1/command
 type CommandAPIResponse struct {
+	ID      string        `json:"id"`
 	Success bool          `json:"success"`
-	Result  interface{}   `json:"result,omitempty"`
+	Result  CommandResult `json:"result,omitempty"`
 	Error   *CommandError `json:"error,omitempty"`
+	Canary  bool          `json:"canary,omitempty"` // ran in canary mode
 	Timing  struct {
 		Total int64 `json:"total"` // ms
+		// When the extension received and completed the command, in the
+		// relay's clock (unix ms), corrected for the browser's clock offset
+		Received  int64         `json:"received,omitempty"`
+		Completed int64         `json:"completed,omitempty"`
+		Phases    []TimingPhase `json:"phases,omitempty"` // with ?debugTiming=1
 	} `json:"timing,omitempty"`
+	// FailureScreenshot is the tab as it was when the command failed
+	FailureScreenshot *ScreenshotResponse `json:"failureScreenshot,omitempty"`
+}
+
+// TimingPhase is the time one phase of a request took
+type TimingPhase struct {
+	Name string  `json:"name"` // auth, rate_limit, queue, hub_dispatch, extension, extension_execution, cluster_forward, decode, artifact_write
+	Ms   float64 `json:"ms"`
+}
+
+// RequestTiming breaks a request's latency down by phase, returned with
+// ?debugTiming=1
+type RequestTiming struct {
+	Total  int64         `json:"total"` // ms
+	Phases []TimingPhase `json:"phases"`
+}
+
+// CommandRecord for GET /api/v1/commands/{id}. It is kept for commands
+// that outlived their HTTP request.
+type CommandRecord struct {
+	ID          string              `json:"id"`
+	Status      string              `json:"status"` // running, completed
+	CreatedAt   time.Time           `json:"createdAt"`
+	CompletedAt *time.Time          `json:"completedAt,omitempty"`
+	Response    *CommandAPIResponse `json:"response,omitempty"`
 }
 
 // ScreenshotRequest for POST /api/v1/screenshot
 type ScreenshotRequest struct {
 	TabID    string `json:"tabId"`
 	FullPage bool   `json:"fullPage,omitempty"`
-	Format   string `json:"format,omitempty"` // png or jpeg
+	Format   string `json:"format,omitempty"`  // png or jpeg
 	Quality  int    `json:"quality,omitempty"` // 0-100 for jpeg
+	// ReturnFormat "inline" streams the image bytes in the response body
+	// instead of returning a temporary URL
+	ReturnFormat string `json:"returnFormat,omitempty"`
+	// Burst takes several captures in one command
+	Burst *BurstOptions `json:"burst,omitempty"`
+	// Capture only the element matching Selector, scrolled into view, or
+	// only Clip, in CSS pixels of the viewport
+	Selector string `json:"selector,omitempty"`
+	Clip     *Rect  `json:"clip,omitempty"`
+	// SelectorEngine matches Selector as css (default), xpath, text, or
+	// pierce
+	SelectorEngine string `json:"selectorEngine,omitempty"`
+}
+
+// BurstOptions asks for Count captures taken Interval ms apart. The
+// browser allows about two captures a second, so shorter intervals are
+// stretched.
+type BurstOptions struct {
+	Count    int `json:"count"`
+	Interval int `json:"interval,omitempty"` // ms
 }
 
 // ScreenshotResponse for POST /api/v1/screenshot
 type ScreenshotResponse struct {
+	ID        string `json:"id"`
 	URL       string `json:"url"`
 	Width     int    `json:"width"`
 	Height    int    `json:"height"`
 	Size      int    `json:"size"` // bytes
 	ExpiresAt string `json:"expiresAt"`
+	QueueTime int64  `json:"queueTime,omitempty"` // ms waited for a capture slot or browser rate limits
+
+	Timing *RequestTiming `json:"timing,omitempty"` // with ?debugTiming=1
+}
+
+// ScreenshotBurstResponse for POST /api/v1/screenshot with burst. Each
+// frame is a screenshot of its own, with its own URL.
+type ScreenshotBurstResponse struct {
+	ID        string            `json:"id"` // the command that took the frames
+	TabID     string            `json:"tabId"`
+	Frames    []ScreenshotFrame `json:"frames"`
+	QueueTime int64             `json:"queueTime,omitempty"`
+
+	Timing *RequestTiming `json:"timing,omitempty"`
+}
+
+// ScreenshotFrame is one capture of a burst
+type ScreenshotFrame struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Size      int    `json:"size"`
+	Offset    int64  `json:"offset"` // ms after the first frame was taken
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// Screenshot is the record of a screenshot saved to disk. The file is
+// removed at ExpiresAt; the record is kept for SCREENSHOT_HISTORY.
+type Screenshot struct {
+	ID        string    `json:"id"`
+	TokenID   int64     `json:"tokenId"`
+	TabID     string    `json:"tabId"`
+	CommandID string    `json:"commandId"`
+	Format    string    `json:"format"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int       `json:"size"`          // bytes
+	Hash      string    `json:"hash"`          // SHA-256 of the image; equal for identical captures
+	URL       string    `json:"url,omitempty"` // until the file expires
+	Expired   bool      `json:"expired"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ScreenshotsResponse for GET /api/v1/screenshots
+type ScreenshotsResponse struct {
+	Screenshots []*Screenshot `json:"screenshots"`
 }
 
 // SnapshotRequest for POST /api/v1/snapshot
@@ -221,24 +1302,364 @@ type SnapshotRequest struct {
 	TabID     string `json:"tabId"`
 	MaxDepth  int    `json:"maxDepth,omitempty"`  // Default 10
 	MaxLength int    `json:"maxLength,omitempty"` // Default 100KB
-	Format    string `json:"format,omitempty"`    // html or simplified
+	Format    string `json:"format,omitempty"`    // html, simplified, or markdown
+	// List the page's interactive elements in InteractiveElements
+	Interactive bool `json:"interactive,omitempty"`
+	// SelectorEngine "pierce" includes open shadow roots, and lists their
+	// interactive elements with pierce= selectors
+	SelectorEngine string `json:"selectorEngine,omitempty"`
+}
+
+// ValidSnapshotFormat reports whether format names a snapshot format
+func ValidSnapshotFormat(format string) bool {
+	return format == "html" || format == "simplified" || format == "markdown"
 }
 
 // SnapshotResponse for POST /api/v1/snapshot
 type SnapshotResponse struct {
-	HTML                string               `json:"html"`
+	HTML                string               `json:"html,omitempty"`
+	Markdown            string               `json:"markdown,omitempty"` // format markdown: the main content, instead of html
 	URL                 string               `json:"url"`
 	Title               string               `json:"title"`
 	Truncated           bool                 `json:"truncated"`
 	InteractiveElements []InteractiveElement `json:"interactiveElements,omitempty"`
+	ElementsTruncated   bool                 `json:"elementsTruncated,omitempty"` // more than 500 were found
+	Timing              *RequestTiming       `json:"timing,omitempty"`            // with ?debugTiming=1
 }
 
-// InteractiveElement represents a clickable/interactive element
+// InteractiveElement represents a clickable/interactive element. Selector
+// matches only this element when the snapshot is taken.
 type InteractiveElement struct {
 	Selector    string `json:"selector"`
-	Type        string `json:"type"` // button, link, input, select
+	Type        string `json:"type"` // button, link, input, select, textarea
 	Text        string `json:"text,omitempty"`
+	Label       string `json:"label,omitempty"` // accessible name, when it differs from Text
 	Placeholder string `json:"placeholder,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Href        string `json:"href,omitempty"`      // links
+	InputType   string `json:"inputType,omitempty"` // inputs: text, email, checkbox, ...
+	Disabled    bool   `json:"disabled,omitempty"`
+}
+
+// BatchRequest for POST /api/v1/batch
+type BatchRequest struct {
+	Tasks   []BatchTask `json:"tasks"`
+	Timeout int         `json:"timeout,omitempty"` // per action, ms
+}
+
+// BatchTask is an independent unit of work run on a single session.
+// If URL is set the tab is navigated there before Actions run.
+type BatchTask struct {
+	ID      string          `json:"id,omitempty"`
+	URL     string          `json:"url,omitempty"`
+	Actions []CommandAction `json:"actions"`
+}
+
+// BatchResponse for POST /api/v1/batch and GET /api/v1/batch/{id}
+type BatchResponse struct {
+	ID          string            `json:"id"`
+	Status      string            `json:"status"` // running, completed
+	Total       int               `json:"total"`
+	Completed   int               `json:"completed"`
+	Failed      int               `json:"failed"`
+	CreatedAt   string            `json:"createdAt"`
+	CompletedAt string            `json:"completedAt,omitempty"`
+	Results     []BatchTaskResult `json:"results"`
+}
+
+// RecordingStartRequest for POST /api/v1/recording/start
+type RecordingStartRequest struct {
+	TabID       string  `json:"tabId"`
+	FPS         float64 `json:"fps,omitempty"`         // Default SCREENCAST_FPS
+	Quality     int     `json:"quality,omitempty"`     // JPEG quality 1-100, default 60
+	MaxDuration int     `json:"maxDuration,omitempty"` // seconds, default RECORDING_MAX_DURATION
+}
+
+// RecordingStopRequest for POST /api/v1/recording/stop
+type RecordingStopRequest struct {
+	ID string `json:"id"`
+}
+
+// Recording for the recording endpoints. URL is set once the archive is
+// written and is valid until ExpiresAt.
+type Recording struct {
+	ID         string     `json:"id"`
+	TabID      string     `json:"tabId"`
+	Status     string     `json:"status"`               // recording, completed, failed
+	StopReason string     `json:"stopReason,omitempty"` // stopped, max_duration, tab_detached, policy_denied, extension_offline, shutdown
+	FPS        float64    `json:"fps"`
+	Frames     int        `json:"frames"`
+	Size       int64      `json:"size"` // archive bytes
+	URL        string     `json:"url,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	StoppedAt  *time.Time `json:"stoppedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Download is a file downloaded in an attached tab and kept by the relay
+type Download struct {
+	ID          string     `json:"id"`
+	TabID       string     `json:"tabId"`
+	Filename    string     `json:"filename"`
+	MimeType    string     `json:"mimeType,omitempty"`
+	SourceURL   string     `json:"sourceUrl,omitempty"`
+	Size        int64      `json:"size"`
+	Status      string     `json:"status"` // receiving, completed, failed
+	Error       string     `json:"error,omitempty"`
+	URL         string     `json:"url,omitempty"` // fetch the content here once completed
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+}
+
+// DownloadsResponse for GET /api/v1/downloads
+type DownloadsResponse struct {
+	Downloads []Download `json:"downloads"`
+}
+
+// ConsoleEntry is one buffered console message or page error
+type ConsoleEntry struct {
+	Seq       int64     `json:"seq"` // increases per tab; pass as ?after= to poll
+	Level     string    `json:"level"`
+	Source    string    `json:"source"`
+	Message   string    `json:"message"`
+	URL       string    `json:"url,omitempty"`
+	Line      int       `json:"line,omitempty"`
+	Column    int       `json:"column,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Page event types streamed by GET /api/v1/events
+const (
+	PageEventURLChanged          = "url_changed"
+	PageEventTitleChanged        = "title_changed"
+	PageEventNavigationCompleted = "navigation_completed"
+	PageEventDialogOpened        = "dialog_opened"
+	PageEventDOMMutated          = "dom_mutated"
+)
+
+// PageEvent is one event of GET /api/v1/events
+type PageEvent struct {
+	Type      string      `json:"type"`
+	SessionID string      `json:"sessionId"`
+	TabID     string      `json:"tabId"`
+	URL       string      `json:"url,omitempty"`
+	Title     string      `json:"title,omitempty"`
+	Dialog    *PageDialog `json:"dialog,omitempty"`
+	Mutations int         `json:"mutations,omitempty"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// ConsoleResponse for GET /api/v1/console
+type ConsoleResponse struct {
+	TabID   string         `json:"tabId"`
+	Entries []ConsoleEntry `json:"entries"`
+	Dropped int64          `json:"dropped"` // entries pushed out of the buffer so far
+}
+
+// BatchTaskResult holds the aggregated outcome of one task
+type BatchTaskResult struct {
+	TaskID    string            `json:"taskId"`
+	Status    string            `json:"status"` // pending, running, succeeded, failed
+	SessionID string            `json:"sessionId,omitempty"`
+	TabID     string            `json:"tabId,omitempty"`
+	Steps     []BatchStepResult `json:"steps,omitempty"`
+	Error     *CommandError     `json:"error,omitempty"`
+}
+
+// BatchStepResult holds the outcome of one action within a task
+type BatchStepResult struct {
+	Kind    string        `json:"kind"`
+	Success bool          `json:"success"`
+	Result  CommandResult `json:"result,omitempty"`
+	Error   *CommandError `json:"error,omitempty"`
+	Elapsed int64         `json:"elapsed"` // ms
+}
+
+// EnqueueJobRequest for POST /api/v1/jobs
+type EnqueueJobRequest struct {
+	TargetTokenID int64           `json:"targetTokenId,omitempty"` // Default: caller's token
+	Queue         string          `json:"queue,omitempty"`         // Default "default"
+	Payload       json.RawMessage `json:"payload"`
+	MaxAttempts   int             `json:"maxAttempts,omitempty"`
+}
+
+// LeaseJobRequest for POST /api/v1/jobs/lease
+type LeaseJobRequest struct {
+	Queue        string `json:"queue,omitempty"`
+	LeaseSeconds int    `json:"leaseSeconds,omitempty"`
+	Wait         int    `json:"wait,omitempty"` // seconds to long-poll for a job
+}
+
+// AckJobRequest for POST /api/v1/jobs/{id}/ack
+type AckJobRequest struct {
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// NackJobRequest for POST /api/v1/jobs/{id}/nack
+type NackJobRequest struct {
+	Error string `json:"error,omitempty"`
+	Retry *bool  `json:"retry,omitempty"` // Default true
+}
+
+// ConfigSetting is one configuration value of the running relay
+type ConfigSetting struct {
+	Name     string `json:"name"`
+	Value    any    `json:"value"`
+	Default  string `json:"default,omitempty"`
+	Source   string `json:"source"`             // env, file, default, or derived
+	Redacted bool   `json:"redacted,omitempty"` // the value hides a secret
+}
+
+// ReloadResponse for POST /api/v1/admin/reload: the changed settings that
+// were applied, and those that take effect on restart
+type ReloadResponse struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// ConfigResponse for GET /api/v1/admin/config
+type ConfigResponse struct {
+	Settings []ConfigSetting `json:"settings"`
+}
+
+// AdminSessionsResponse for GET /api/v1/admin/sessions
+type AdminSessionsResponse struct {
+	Sessions []AdminSession `json:"sessions"`
+}
+
+// AdminSession describes a connected extension across all tokens
+type AdminSession struct {
+	ID               string       `json:"id"`
+	Name             string       `json:"name,omitempty"`
+	TokenName        string       `json:"tokenName"`
+	ExtensionVersion string       `json:"extensionVersion,omitempty"`
+	Client           *ClientInfo  `json:"client,omitempty"`
+	Window           *WindowState `json:"window,omitempty"`
+	ConnectedAt      time.Time    `json:"connectedAt"`
+	LastPingAt       time.Time    `json:"lastPingAt"`
+	ClockOffset      *int64       `json:"clockOffset,omitempty"` // ms the browser's clock is ahead of the relay's, once estimated
+	Tabs             []*Tab       `json:"tabs"`
+
+	// Set with ?activity=1
+	Activity *SessionActivity `json:"activity,omitempty"`
+}
+
+// SessionActivity is a session's recent command concurrency, one sample
+// per second, oldest first
+type SessionActivity struct {
+	InFlight int              `json:"inFlight"`
+	Samples  []ActivitySample `json:"samples"`
+}
+
+// ActivitySample covers one second of a session's commands
+type ActivitySample struct {
+	Time         time.Time `json:"time"`
+	InFlight     int       `json:"inFlight"`       // peak commands awaiting a response
+	Started      int       `json:"started"`        // commands sent
+	QueueWaitAvg float64   `json:"queueWaitAvgMs"` // time commands waited in the send queue
+	QueueWaitMax float64   `json:"queueWaitMaxMs"`
+}
+
+// CommandStats for GET /api/v1/admin/stats
+type CommandStats struct {
+	Total        int64              `json:"total"`
+	Succeeded    int64              `json:"succeeded"`
+	Failed       int64              `json:"failed"`
+	InFlight     int                `json:"inFlight"`
+	PerMinute    []ThroughputBucket `json:"perMinute"` // last hour, oldest first
+	RecentErrors []RecentError      `json:"recentErrors"`
+	// Extension messages rejected by schema validation
+	ProtocolErrors []ProtocolErrorCount `json:"protocolErrors"`
+	// Commands run in canary mode and the rest, for comparing a rollout
+	Canary CohortStats `json:"canary"`
+	Stable CohortStats `json:"stable"`
+}
+
+// CohortStats counts the outcomes and latency of a group of commands
+type CohortStats struct {
+	Succeeded  int64 `json:"succeeded"`
+	Failed     int64 `json:"failed"`
+	DurationMs int64 `json:"durationMs"` // total time from send to response
+	AvgMs      int64 `json:"avgMs"`
+}
+
+// ProtocolErrorCount counts rejected extension messages
+type ProtocolErrorCount struct {
+	Type  string `json:"type"` // message type; empty if unreadable
+	Code  string `json:"code"`
+	Count int64  `json:"count"`
+}
+
+// ThroughputBucket counts command outcomes within one minute
+type ThroughputBucket struct {
+	Time      time.Time `json:"time"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+}
+
+// RecentError describes a failed command
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"sessionId"`
+	TokenName string    `json:"tokenName"`
+	CommandID string    `json:"commandId"`
+	Kind      string    `json:"kind"`
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+}
+
+// PolicyRequest for POST /api/v1/admin/tokens/{id}/policies
+type PolicyRequest struct {
+	Effect  string `json:"effect"`
+	Pattern string `json:"pattern"`
+}
+
+// PoliciesResponse for GET /api/v1/admin/tokens/{id}/policies
+type PoliciesResponse struct {
+	Rules []*URLRule `json:"rules"`
+}
+
+// Feature is an experimental capability and whether the token may use it
+type Feature struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Enabled     bool     `json:"enabled"`
+	Source      string   `json:"source"` // default, relay (FEATURES), or token
+	Actions     []string `json:"actions,omitempty"`
+}
+
+// FeaturesResponse for GET /api/v1/features
+type FeaturesResponse struct {
+	Features []Feature `json:"features"`
+}
+
+// ReplicationSnapshot for GET /api/v1/admin/replication/snapshot. It holds
+// every row of the replicated tables as of TakenAt.
+type ReplicationSnapshot struct {
+	SchemaVersion int                          `json:"schemaVersion"`
+	TakenAt       time.Time                    `json:"takenAt"`
+	Tables        map[string]*ReplicationTable `json:"tables"`
+}
+
+// ReplicationTable is the contents of one table in a snapshot
+type ReplicationTable struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// ReplicationStatus for GET /api/v1/admin/replication
+type ReplicationStatus struct {
+	Role       string     `json:"role"`
+	PrimaryURL string     `json:"primaryUrl,omitempty"`
+	LastSyncAt *time.Time `json:"lastSyncAt,omitempty"`
+	LagSeconds int64      `json:"lagSeconds,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	PromotedAt *time.Time `json:"promotedAt,omitempty"`
 }
 
 // APIError represents an API error response
@@ -0,0 +1,134 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Webhook events
+const (
+	WebhookExtensionConnected    = "extension_connected"
+	WebhookExtensionDisconnected = "extension_disconnected"
+	WebhookCommandFailed         = "command_failed"
+	WebhookRateLimited           = "rate_limited"
+	WebhookScheduleFailed        = "schedule_failed"
+)
+
+// WebhookEvents lists every event a webhook may subscribe to
+var WebhookEvents = []string{
+	WebhookExtensionConnected,
+	WebhookExtensionDisconnected,
+	WebhookCommandFailed,
+	WebhookRateLimited,
+	WebhookScheduleFailed,
+}
+
+// Webhook is a URL the relay POSTs events to, signed with its secret
+type Webhook struct {
+	ID          int64     `json:"id"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events"`
+	Secret      string    `json:"secret,omitempty"` // only in the response that creates it
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Subscribes reports whether the webhook receives an event
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookRequest for POST /api/v1/admin/webhooks
+type WebhookRequest struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"` // generated when empty
+	Description string   `json:"description,omitempty"`
+}
+
+// Validate checks a webhook before it is stored
+func (r *WebhookRequest) Validate() error {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if len(r.Events) == 0 {
+		return fmt.Errorf("events is required")
+	}
+	for _, event := range r.Events {
+		known := false
+		for _, e := range WebhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	if r.Secret != "" && len(r.Secret) < 16 {
+		return fmt.Errorf("secret must be at least 16 characters")
+	}
+	return nil
+}
+
+// WebhooksResponse for GET /api/v1/admin/webhooks
+type WebhooksResponse struct {
+	Webhooks []*Webhook `json:"webhooks"`
+}
+
+// WebhookPayload is the body of a webhook delivery. ID stays the same
+// across retries of one delivery, so receivers can drop duplicates.
+type WebhookPayload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      any       `json:"data"`
+}
+
+// WebhookSession is the data of extension_connected and
+// extension_disconnected
+type WebhookSession struct {
+	SessionID        string      `json:"sessionId"`
+	TokenName        string      `json:"tokenName"`
+	Name             string      `json:"name,omitempty"`
+	ExtensionVersion string      `json:"extensionVersion,omitempty"`
+	Client           *ClientInfo `json:"client,omitempty"`
+	ConnectedAt      time.Time   `json:"connectedAt"`
+	Node             string      `json:"node,omitempty"`
+}
+
+// WebhookCommand is the data of command_failed
+type WebhookCommand struct {
+	SessionID string        `json:"sessionId"`
+	TokenName string        `json:"tokenName"`
+	CommandID string        `json:"commandId"`
+	TabID     string        `json:"tabId"`
+	Kind      string        `json:"kind"`
+	Error     *CommandError `json:"error"`
+	Elapsed   int64         `json:"elapsed"` // ms
+}
+
+// WebhookRateLimit is the data of rate_limited
+type WebhookRateLimit struct {
+	TokenID    int64  `json:"tokenId"`
+	TokenName  string `json:"tokenName"`
+	Limit      int    `json:"limit"`      // requests per RATE_LIMIT_WINDOW
+	RetryAfter int    `json:"retryAfter"` // seconds
+}
+
+// WebhookScheduleRun is the data of schedule_failed
+type WebhookScheduleRun struct {
+	TokenID   int64         `json:"tokenId"`
+	TokenName string        `json:"tokenName"`
+	Schedule  string        `json:"schedule"`
+	Kind      string        `json:"kind"`
+	RunID     int64         `json:"runId"`
+	TabID     string        `json:"tabId,omitempty"`
+	Error     *CommandError `json:"error"`
+	StartedAt time.Time     `json:"startedAt"`
+}
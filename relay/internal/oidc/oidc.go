@@ -0,0 +1,436 @@
+// Package oidc verifies JWTs issued by an OpenID Connect provider, so REST
+// clients can authenticate with their organisation's identity provider
+// instead of an owl_ token. Signing keys come from the issuer's JWKS and
+// are refetched when a token names a key the relay has not seen.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+)
+
+const (
+	// Keys are refetched this often even when every kid is known
+	keysTTL = time.Hour
+
+	// An unknown kid triggers a refetch at most this often
+	refetchInterval = time.Minute
+
+	// Allowed clock difference for exp and nbf
+	leeway = time.Minute
+)
+
+// Claims are the verified claims of a JWT
+type Claims struct {
+	Subject string
+	raw     map[string]any
+}
+
+// String returns a string claim, or ""
+func (c *Claims) String(name string) string {
+	s, _ := c.raw[name].(string)
+	return s
+}
+
+// Strings returns a claim holding a space-separated string or an array of
+// strings, as "scope" and "scp" are commonly issued
+func (c *Claims) Strings(name string) []string {
+	switch v := c.raw[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Verifier checks JWT signatures, issuer, audience and lifetime
+type Verifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	client   *http.Client
+
+	tokenClaim, defaultToken string
+	scopeClaim, scopePrefix  string
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // by kid
+	fetchedAt time.Time                   // last successful fetch
+	triedAt   time.Time                   // last fetch, successful or not
+	fetchErr  error                       // of the last fetch
+	refresh   chan struct{}               // closed when the fetch in flight ends; nil if none
+}
+
+// New returns a verifier for OIDC_ISSUER, or nil when OIDC is not configured
+func New(cfg *config.Config) *Verifier {
+	if cfg.OIDCIssuer == "" {
+		return nil
+	}
+	return &Verifier{
+		issuer:   strings.TrimSuffix(cfg.OIDCIssuer, "/"),
+		audience: cfg.OIDCAudience,
+		jwksURL:  cfg.OIDCJWKSURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+
+		tokenClaim:   cfg.OIDCTokenClaim,
+		defaultToken: cfg.OIDCDefaultToken,
+		scopeClaim:   cfg.OIDCScopeClaim,
+		scopePrefix:  cfg.OIDCScopePrefix,
+	}
+}
+
+// TokenName returns the name of the owl_ token the caller acts as: whose
+// extension sessions, rate limits and defaults it uses
+func (v *Verifier) TokenName(c *Claims) string {
+	if name := c.String(v.tokenClaim); name != "" {
+		return name
+	}
+	return v.defaultToken
+}
+
+// Scopes returns the relay scopes the claims ask for, without their prefix
+func (v *Verifier) Scopes(c *Claims) []string {
+	var scopes []string
+	for _, s := range c.Strings(v.scopeClaim) {
+		if scope, ok := strings.CutPrefix(s, v.scopePrefix); ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// LooksLikeJWT reports whether a bearer credential has the three
+// dot-separated parts of a compact JWT
+func LooksLikeJWT(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// header is the JOSE header of a compact JWT
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks a compact JWT and returns its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a compact JWT")
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	key, err := v.key(ctx, h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(h.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	claims := &Claims{raw: raw}
+	claims.Subject = claims.String("sub")
+
+	if iss := strings.TrimSuffix(claims.String("iss"), "/"); iss != v.issuer {
+		return nil, fmt.Errorf("issuer %q is not %q", iss, v.issuer)
+	}
+	audience := claims.Strings("aud")
+	if !contains(audience, v.audience) {
+		return nil, fmt.Errorf("audience %v does not include %q", audience, v.audience)
+	}
+	now := time.Now()
+	exp, ok := raw["exp"].(float64)
+	if !ok {
+		return nil, errors.New("missing exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing sub")
+	}
+	return claims, nil
+}
+
+// key returns the signing key with the given kid, fetching the JWKS when
+// it is stale or does not hold the kid. An empty kid matches the only key.
+// One fetch runs at a time and at most every refetchInterval, failed or
+// not; callers with a cached key keep using it meanwhile, the rest wait
+// for it.
+func (v *Verifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.lookup(kid)
+	if ok && time.Since(v.fetchedAt) < keysTTL {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if v.refresh == nil && time.Since(v.triedAt) >= refetchInterval {
+		v.triedAt = time.Now()
+		v.refresh = make(chan struct{})
+		go v.refreshKeys(v.refresh)
+	}
+	done, fetchErr := v.refresh, v.fetchErr
+	v.mu.Unlock()
+
+	if ok {
+		// Keep verifying with the keys we have until the JWKS is back
+		return key, nil
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		v.mu.Lock()
+		key, ok = v.lookup(kid)
+		fetchErr = v.fetchErr
+		v.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// refreshKeys fetches the JWKS outside v.mu and closes done when the keys
+// are replaced, or kept after a failure. It does not use a caller's
+// context, since every caller waiting on done depends on it.
+func (v *Verifier) refreshKeys(done chan struct{}) {
+	keys, err := v.fetchKeys(context.Background())
+
+	v.mu.Lock()
+	if err == nil {
+		v.keys = keys
+		v.fetchedAt = time.Now()
+	}
+	v.fetchErr = err
+	v.refresh = nil
+	v.mu.Unlock()
+	close(done)
+}
+
+// lookup finds a cached key; the caller holds v.mu
+func (v *Verifier) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// fetchKeys downloads the JWKS, discovering its URL from the issuer first
+// unless OIDC_JWKS_URL is set
+func (v *Verifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwksURL := v.jwksURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped, not fatal
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (v *Verifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jwk is one RSA or EC key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent out of range")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks an RS* or ES* signature; "none" and HMAC
+// algorithms are refused
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("algorithm %s does not match an RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, sig); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			return fmt.Errorf("algorithm %s does not match an EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+func decodeSegment(segment string, out any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
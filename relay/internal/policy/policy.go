@@ -0,0 +1,83 @@
+// Package policy evaluates per-token URL allow/deny rules
+package policy
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Allowed reports whether rawURL is permitted by rules. Deny rules always
+// win; if any allow rules exist the URL must match at least one of them.
+// With no rules everything is allowed.
+func Allowed(rules []*models.URLRule, rawURL string) bool {
+	hasAllow := false
+	allowed := false
+
+	for _, rule := range rules {
+		matched := Match(rule.Pattern, rawURL)
+		switch rule.Effect {
+		case models.PolicyDeny:
+			if matched {
+				return false
+			}
+		case models.PolicyAllow:
+			hasAllow = true
+			if matched {
+				allowed = true
+			}
+		}
+	}
+
+	return !hasAllow || allowed
+}
+
+// Match reports whether rawURL, once normalized, matches a glob pattern.
+// Patterns containing "://" are matched against the whole URL; anything
+// else is matched against the host only, so "*.internal.example.com"
+// covers every subdomain. "*" matches any run of characters.
+func Match(pattern, rawURL string) bool {
+	pattern = strings.ToLower(pattern)
+
+	rawURL = Normalize(rawURL)
+	if strings.Contains(pattern, "://") {
+		return glob(pattern, strings.ToLower(rawURL))
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	return glob(pattern, strings.ToLower(u.Hostname()))
+}
+
+// glob matches s against pattern where '*' matches any sequence
+func glob(pattern, s string) bool {
+	// Iterative matcher with single-star backtracking
+	p, i := 0, 0
+	star, mark := -1, 0
+
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star = p
+			mark = i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
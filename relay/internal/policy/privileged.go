@@ -0,0 +1,102 @@
+package policy
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// privilegedSchemes are those of browser internals, extension pages, and
+// local files. view-source: is included since it wraps any of them.
+var privilegedSchemes = map[string]bool{
+	"about":                true,
+	"chrome":               true,
+	"chrome-extension":     true,
+	"chrome-untrusted":     true,
+	"chrome-search":        true,
+	"devtools":             true,
+	"edge":                 true,
+	"brave":                true,
+	"opera":                true,
+	"vivaldi":              true,
+	"moz-extension":        true,
+	"safari-web-extension": true,
+	"file":                 true,
+	"filesystem":           true,
+	"view-source":          true,
+}
+
+// Blank pages are harmless; new tabs start on them
+var blankPages = map[string]bool{
+	"about:blank":  true,
+	"about:srcdoc": true,
+}
+
+// Privileged reports whether rawURL is a browser-internal, extension, or
+// local file page. A URL that cannot be parsed counts as privileged.
+func Privileged(rawURL string) bool {
+	normalized := Normalize(rawURL)
+	if blankPages[normalized] {
+		return false
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return true
+	}
+	return privilegedSchemes[u.Scheme]
+}
+
+// Normalize returns rawURL in a canonical form for matching: the scheme
+// and host lowercased, surrounding whitespace, default ports, a trailing
+// dot on the host, and the fragment removed, and dot segments resolved.
+// A URL that cannot be parsed is returned trimmed and lowercased.
+func Normalize(rawURL string) string {
+	trimmed := strings.TrimSpace(rawURL)
+	u, err := url.Parse(trimmed)
+	if err != nil {
+		return strings.ToLower(trimmed)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Opaque != "" {
+		// about:blank, javascript:..., and the like
+		if u.Scheme == "about" {
+			u.Opaque = strings.ToLower(u.Opaque)
+		}
+		return u.String()
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = host
+	if u.Path != "" {
+		u.Path = resolveDots(u.Path)
+		u.RawPath = ""
+	}
+	return u.String()
+}
+
+// resolveDots removes "." and ".." segments from an absolute path,
+// keeping a trailing slash
+func resolveDots(p string) string {
+	if !strings.Contains(p, "/.") {
+		return p
+	}
+	cleaned := path.Clean(p)
+	last := p[strings.LastIndex(p, "/")+1:]
+	if cleaned != "/" && (last == "" || last == "." || last == "..") {
+		cleaned += "/"
+	}
+	return cleaned
+}
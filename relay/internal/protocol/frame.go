@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// Frame encodings negotiated in the connect handshake. JSON sends each
+// message as a text frame. Binary sends each as a binary frame holding a
+// 4-byte big-endian length, that many bytes of the JSON message, and an
+// optional attachment: raw bytes standing for the base64 of the message's
+// "data" field, appended to any "data" string the JSON itself carries.
+const (
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+)
+
+// frameHeaderSize is the length prefix of a binary frame
+const frameHeaderSize = 4
+
+// EncodeFrame wraps a JSON message in a binary frame without attachment
+func EncodeFrame(message []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[frameHeaderSize:], message)
+	return frame
+}
+
+// DecodeFrame returns the JSON message of a binary frame, with its
+// attachment folded into "data" as base64
+func DecodeFrame(frame []byte) ([]byte, *Violation) {
+	if len(frame) < frameHeaderSize {
+		return nil, &Violation{Code: CodeMalformed, Details: []string{"binary frame shorter than its length prefix"}}
+	}
+	n := binary.BigEndian.Uint32(frame)
+	if uint64(n) > uint64(len(frame)-frameHeaderSize) {
+		return nil, &Violation{Code: CodeMalformed, Details: []string{
+			fmt.Sprintf("binary frame declares %d bytes of JSON but holds %d", n, len(frame)-frameHeaderSize)}}
+	}
+	message := frame[frameHeaderSize : frameHeaderSize+int(n)]
+	attachment := frame[frameHeaderSize+int(n):]
+	if len(attachment) == 0 {
+		return message, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, &Violation{Code: CodeMalformed}
+	}
+	var prefix string
+	if raw, ok := fields["data"]; ok {
+		if err := json.Unmarshal(raw, &prefix); err != nil {
+			return nil, &Violation{Code: CodeInvalid, Type: peekType(fields),
+				Details: []string{"/data: must be a string when the frame has an attachment"}}
+		}
+	}
+	data, err := json.Marshal(prefix + base64.StdEncoding.EncodeToString(attachment))
+	if err != nil {
+		return nil, &Violation{Code: CodeMalformed}
+	}
+	fields["data"] = data
+	message, err = json.Marshal(fields)
+	if err != nil {
+		return nil, &Violation{Code: CodeMalformed}
+	}
+	return message, nil
+}
+
+// peekType returns the "type" of a decoded message, or ""
+func peekType(fields map[string]json.RawMessage) string {
+	var msgType string
+	json.Unmarshal(fields["type"], &msgType)
+	return msgType
+}
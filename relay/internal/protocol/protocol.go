@@ -0,0 +1,201 @@
+// Package protocol validates messages from extensions against the JSON
+// Schemas embedded in schemas/, one per message type
+package protocol
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// Violation codes
+const (
+	CodeMalformed   = "MALFORMED_MESSAGE" // not a JSON object with a string "type"
+	CodeUnknownType = "UNKNOWN_TYPE"      // no schema for the type
+	CodeInvalid     = "INVALID_MESSAGE"   // fails its type's schema
+	CodeTooLarge    = "MESSAGE_TOO_LARGE" // exceeds WS_MAX_MESSAGE_SIZE
+
+	CodeInvalidChunk = "INVALID_CHUNK" // screenshot_chunk or download_chunk that does not fit its command or download
+)
+
+// Violation describes why a message was rejected
+type Violation struct {
+	Code    string
+	Type    string   // message type, if it could be read
+	Details []string // one entry per failed constraint, prefixed by JSON pointer
+}
+
+func (v *Violation) Error() string {
+	if len(v.Details) == 0 {
+		return v.Code
+	}
+	return v.Code + ": " + strings.Join(v.Details, "; ")
+}
+
+// schema is the subset of JSON Schema the message schemas use
+type schema struct {
+	Type       string             `json:"type"`
+	Properties map[string]*schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *schema            `json:"items"`
+	MaxItems   *int               `json:"maxItems"`
+	Enum       []any              `json:"enum"`
+	MinLength  *int               `json:"minLength"`
+	MaxLength  *int               `json:"maxLength"`
+	Minimum    *float64           `json:"minimum"`
+}
+
+var schemas = mustLoad()
+
+func mustLoad() map[string]*schema {
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic("protocol: " + err.Error())
+	}
+
+	loaded := make(map[string]*schema, len(entries))
+	for _, e := range entries {
+		data, err := schemaFiles.ReadFile("schemas/" + e.Name())
+		if err != nil {
+			panic("protocol: " + err.Error())
+		}
+		var s schema
+		if err := json.Unmarshal(data, &s); err != nil {
+			panic(fmt.Sprintf("protocol: invalid schema %s: %v", e.Name(), err))
+		}
+		loaded[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = &s
+	}
+	return loaded
+}
+
+// Validate checks a raw message and returns its type, or a Violation
+func Validate(data []byte) (string, *Violation) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return "", &Violation{Code: CodeMalformed, Details: []string{err.Error()}}
+	}
+
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return "", &Violation{Code: CodeMalformed, Details: []string{"message must be a JSON object"}}
+	}
+	msgType, ok := obj["type"].(string)
+	if !ok {
+		return "", &Violation{Code: CodeMalformed, Details: []string{"/type: must be a string"}}
+	}
+
+	s, ok := schemas[msgType]
+	if !ok {
+		return msgType, &Violation{Code: CodeUnknownType, Type: msgType}
+	}
+
+	var details []string
+	s.validate("", doc, &details)
+	if len(details) > 0 {
+		return msgType, &Violation{Code: CodeInvalid, Type: msgType, Details: details}
+	}
+	return msgType, nil
+}
+
+func (s *schema) validate(ptr string, v any, details *[]string) {
+	fail := func(format string, args ...any) {
+		at := ptr
+		if at == "" {
+			at = "/"
+		}
+		*details = append(*details, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Enum) > 0 && !containsValue(s.Enum, v) {
+		fail("must be one of %v", s.Enum)
+		return
+	}
+
+	switch s.Type {
+	case "":
+		// Any value
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				*details = append(*details, ptr+"/"+name+": is required")
+			}
+		}
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if pv, ok := obj[name]; ok {
+				s.Properties[name].validate(ptr+"/"+name, pv, details)
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range arr {
+				s.Items.validate(fmt.Sprintf("%s/%d", ptr, i), item, details)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(str) > *s.MaxLength {
+			fail("must be at most %d characters", *s.MaxLength)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+		}
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("must be a %s", s.Type)
+			return
+		}
+		f, err := n.Float64()
+		if err != nil || (s.Type == "integer" && f != float64(int64(f))) {
+			fail("must be an integer")
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		}
+	}
+}
+
+func containsValue(enum []any, v any) bool {
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
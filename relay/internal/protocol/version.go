@@ -0,0 +1,28 @@
+package protocol
+
+// Protocol versions the relay speaks. Version 1 is the protocol of
+// extensions that send no protocolVersion in their connect message;
+// version 2 adds the negotiated handshake and capabilities, and requires
+// command responses to echo the command's seq.
+const (
+	MinVersion = 1
+	Version    = 2
+)
+
+// Negotiate picks the protocol version for an extension that speaks
+// versions lowest to highest (0 for either when the connect message did
+// not say), with the relay accepting no version below floor. It reports
+// false when the ranges do not overlap.
+func Negotiate(lowest, highest, floor int) (int, bool) {
+	if highest == 0 {
+		highest = MinVersion
+	}
+	if lowest == 0 {
+		lowest = MinVersion
+	}
+	version := min(highest, Version)
+	if version < lowest || version < max(floor, MinVersion) {
+		return 0, false
+	}
+	return version, true
+}
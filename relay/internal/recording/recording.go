@@ -0,0 +1,444 @@
+// Package recording captures a tab as a sequence of JPEG frames and writes
+// them to a zip archive with a timing manifest and a small HTML player, so
+// an automation run can be replayed afterwards.
+package recording
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/dispatch"
+	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Recording statuses
+const (
+	StatusRecording = "recording"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Why a recording stopped
+const (
+	ReasonStopped          = "stopped"
+	ReasonMaxDuration      = "max_duration"
+	ReasonTabDetached      = "tab_detached"
+	ReasonPolicyDenied     = "policy_denied"
+	ReasonExtensionOffline = "extension_offline"
+	ReasonShutdown         = "shutdown"
+)
+
+// ErrInProgress is returned when the tab is already being recorded
+var ErrInProgress = errors.New("tab is already being recorded")
+
+// CaptureFunc takes one JPEG frame of a tab
+type CaptureFunc func(ctx context.Context, tokenHash, tabID string, quality, timeout int) ([]byte, error)
+
+// Options of one recording
+type Options struct {
+	TabID       string
+	FPS         float64
+	Quality     int
+	MaxDuration time.Duration
+	Timeout     int // per frame, ms
+	Check       dispatch.CheckFunc
+}
+
+// Recorder runs recordings and keeps their archives for RECORDING_TTL
+type Recorder struct {
+	cfg     *config.Config
+	hub     *hub.Hub
+	capture CaptureFunc
+
+	mu         sync.Mutex
+	recordings map[string]*recording
+}
+
+type recording struct {
+	mu        sync.Mutex
+	info      models.Recording
+	tokenHash string
+	stop      context.CancelFunc
+	done      chan struct{}
+}
+
+// manifest describes an archive's frames
+type manifest struct {
+	ID        string          `json:"id"`
+	TabID     string          `json:"tabId"`
+	FPS       float64         `json:"fps"`
+	StartedAt time.Time       `json:"startedAt"`
+	StoppedAt time.Time       `json:"stoppedAt"`
+	Frames    []manifestFrame `json:"frames"`
+}
+
+type manifestFrame struct {
+	File     string `json:"file"`
+	OffsetMs int64  `json:"offsetMs"`
+	URL      string `json:"url,omitempty"`
+}
+
+// New creates a Recorder writing to RECORDINGS_PATH. Archives left from an
+// earlier run are removed once they are older than RECORDING_TTL.
+func New(cfg *config.Config, h *hub.Hub, capture CaptureFunc) *Recorder {
+	r := &Recorder{
+		cfg:        cfg,
+		hub:        h,
+		capture:    capture,
+		recordings: make(map[string]*recording),
+	}
+	go r.cleanupLoop()
+	return r
+}
+
+// Start begins recording a tab in the background
+func (r *Recorder) Start(tokenHash string, opts Options) (*models.Recording, error) {
+	if r.hub.Draining() {
+		return nil, hub.ErrShuttingDown
+	}
+
+	id := uuid.New().String()
+	path := r.path(id) + ".part"
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), opts.MaxDuration)
+	rec := &recording{
+		info: models.Recording{
+			ID:        id,
+			TabID:     opts.TabID,
+			Status:    StatusRecording,
+			FPS:       opts.FPS,
+			StartedAt: time.Now().UTC(),
+		},
+		tokenHash: tokenHash,
+		stop:      stop,
+		done:      make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	for _, other := range r.recordings {
+		other.mu.Lock()
+		busy := other.tokenHash == tokenHash && other.info.TabID == opts.TabID && other.info.Status == StatusRecording
+		other.mu.Unlock()
+		if busy {
+			r.mu.Unlock()
+			stop()
+			file.Close()
+			os.Remove(path)
+			return nil, ErrInProgress
+		}
+	}
+	r.recordings[id] = rec
+	r.mu.Unlock()
+
+	go r.run(ctx, rec, file, opts)
+
+	info := rec.snapshot()
+	return &info, nil
+}
+
+// Stop ends a recording and waits for its archive to be written
+func (r *Recorder) Stop(tokenHash, id string) (*models.Recording, bool) {
+	rec := r.find(tokenHash, id)
+	if rec == nil {
+		return nil, false
+	}
+	rec.stop()
+	<-rec.done
+	info := rec.snapshot()
+	return &info, true
+}
+
+// Get returns a recording of the token
+func (r *Recorder) Get(tokenHash, id string) (*models.Recording, bool) {
+	rec := r.find(tokenHash, id)
+	if rec == nil {
+		return nil, false
+	}
+	info := rec.snapshot()
+	return &info, true
+}
+
+// File returns the archive of a completed, unexpired recording
+func (r *Recorder) File(id string) (string, bool) {
+	r.mu.Lock()
+	rec := r.recordings[id]
+	r.mu.Unlock()
+	if rec == nil {
+		return "", false
+	}
+	info := rec.snapshot()
+	if info.Status != StatusCompleted || info.ExpiresAt == nil || !time.Now().Before(*info.ExpiresAt) {
+		return "", false
+	}
+	return r.path(id), true
+}
+
+// Active returns how many recordings are in progress
+func (r *Recorder) Active() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, rec := range r.recordings {
+		rec.mu.Lock()
+		if rec.info.Status == StatusRecording {
+			n++
+		}
+		rec.mu.Unlock()
+	}
+	return n
+}
+
+func (r *Recorder) find(tokenHash, id string) *recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := r.recordings[id]
+	if rec == nil || rec.tokenHash != tokenHash {
+		return nil
+	}
+	return rec
+}
+
+func (r *Recorder) path(id string) string {
+	return filepath.Join(r.cfg.RecordingsPath, id+".zip")
+}
+
+// run captures frames until the recording is stopped, then writes the
+// manifest and player and publishes the archive
+func (r *Recorder) run(ctx context.Context, rec *recording, file *os.File, opts Options) {
+	defer close(rec.done)
+	defer rec.stop()
+
+	archive := zip.NewWriter(file)
+	m := manifest{ID: rec.info.ID, TabID: opts.TabID, FPS: opts.FPS, StartedAt: rec.info.StartedAt, Frames: []manifestFrame{}}
+	action := models.CommandAction{Kind: "screenshot", Format: "jpeg", Quality: opts.Quality}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.FPS))
+	defer ticker.Stop()
+
+	reason, writeErr := r.record(ctx, rec, archive, &m, opts, action, ticker)
+
+	stoppedAt := time.Now().UTC()
+	m.StoppedAt = stoppedAt
+	if writeErr == nil {
+		writeErr = writeJSON(archive, "manifest.json", m)
+	}
+	if writeErr == nil {
+		writeErr = writePlayer(archive, m)
+	}
+	if err := archive.Close(); writeErr == nil {
+		writeErr = err
+	}
+	if err := file.Close(); writeErr == nil {
+		writeErr = err
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(file.Name(), r.path(rec.info.ID))
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.info.StopReason = reason
+	rec.info.StoppedAt = &stoppedAt
+	expiresAt := stoppedAt.Add(time.Duration(r.cfg.RecordingTTL) * time.Second)
+	rec.info.ExpiresAt = &expiresAt
+	if writeErr != nil {
+		log.Error().Err(writeErr).Str("recording_id", rec.info.ID).Msg("Failed to write recording")
+		os.Remove(file.Name())
+		rec.info.Status = StatusFailed
+		rec.info.Error = writeErr.Error()
+		return
+	}
+	if stat, err := os.Stat(r.path(rec.info.ID)); err == nil {
+		rec.info.Size = stat.Size()
+	}
+	rec.info.Status = StatusCompleted
+	rec.info.URL = "/recordings/" + rec.info.ID + ".zip"
+
+	log.Info().
+		Str("recording_id", rec.info.ID).
+		Str("tab_id", opts.TabID).
+		Int("frames", rec.info.Frames).
+		Str("reason", reason).
+		Msg("Recording completed")
+}
+
+// record adds frames to the archive until the context ends or the tab can
+// no longer be recorded. It returns the stop reason and any write error.
+func (r *Recorder) record(ctx context.Context, rec *recording, archive *zip.Writer, m *manifest,
+	opts Options, action models.CommandAction, ticker *time.Ticker) (string, error) {
+	for {
+		tab, ok := r.hub.FindTab(rec.tokenHash, opts.TabID)
+		if !ok {
+			return ReasonTabDetached, nil
+		}
+		if opts.Check != nil && opts.Check(tab.URL, action) != nil {
+			return ReasonPolicyDenied, nil
+		}
+
+		at := time.Now()
+		frame, err := r.captureFrame(ctx, rec.tokenHash, opts)
+		if err != nil {
+			var hubErr *hub.HubError
+			if errors.As(err, &hubErr) {
+				switch hubErr.Code {
+				case hub.ErrTimeout.Code:
+				case hub.ErrShuttingDown.Code:
+					return ReasonShutdown, nil
+				default:
+					return ReasonExtensionOffline, nil
+				}
+			}
+			if ctx.Err() == nil {
+				log.Debug().Err(err).Str("recording_id", rec.info.ID).Msg("Skipped recording frame")
+			}
+		} else {
+			rec.mu.Lock()
+			n := rec.info.Frames + 1
+			rec.mu.Unlock()
+
+			name := fmt.Sprintf("frames/%06d.jpg", n)
+			w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: at})
+			if err == nil {
+				_, err = w.Write(frame)
+			}
+			if err != nil {
+				return ReasonStopped, err
+			}
+			m.Frames = append(m.Frames, manifestFrame{
+				File:     name,
+				OffsetMs: at.Sub(m.StartedAt).Milliseconds(),
+				URL:      tab.URL,
+			})
+
+			rec.mu.Lock()
+			rec.info.Frames = n
+			rec.mu.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ReasonMaxDuration, nil
+			}
+			return ReasonStopped, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// captureFrame takes one frame; a stop during the capture abandons it
+func (r *Recorder) captureFrame(ctx context.Context, tokenHash string, opts Options) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r.capture(ctx, tokenHash, opts.TabID, opts.Quality, opts.Timeout)
+}
+
+func (rec *recording) snapshot() models.Recording {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.info
+}
+
+func writeJSON(archive *zip.Writer, name string, v any) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writePlayer adds an HTML page that plays the extracted frames with their
+// original timing
+func writePlayer(archive *zip.Writer, m manifest) error {
+	frames, err := json.Marshal(m.Frames)
+	if err != nil {
+		return err
+	}
+	w, err := archive.Create("player.html")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(strings.Replace(playerHTML, "{{frames}}", string(frames), 1)))
+	return err
+}
+
+const playerHTML = `<!DOCTYPE html>
+<meta charset="utf-8">
+<title>OwlRelay recording</title>
+<style>body{margin:0;background:#111;color:#ccc;font:13px sans-serif}img{display:block;max-width:100%}p{margin:8px}</style>
+<img id="frame"><p id="info"></p>
+<script>
+const frames = {{frames}};
+const img = document.getElementById('frame'), info = document.getElementById('info');
+function show(i) {
+  if (i >= frames.length) return;
+  img.src = frames[i].file;
+  info.textContent = (frames[i].offsetMs / 1000).toFixed(1) + 's  ' + (frames[i].url || '');
+  if (i + 1 < frames.length) setTimeout(() => show(i + 1), frames[i + 1].offsetMs - frames[i].offsetMs);
+}
+show(0);
+</script>
+`
+
+// cleanupLoop forgets expired recordings and removes their archives
+func (r *Recorder) cleanupLoop() {
+	r.sweepFiles(true)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		r.mu.Lock()
+		for id, rec := range r.recordings {
+			if info := rec.snapshot(); info.ExpiresAt != nil && now.After(*info.ExpiresAt) {
+				delete(r.recordings, id)
+			}
+		}
+		r.mu.Unlock()
+		r.sweepFiles(false)
+	}
+}
+
+// sweepFiles removes archives older than RECORDING_TTL, including those of
+// an earlier run, which are not tracked. At startup it also removes
+// archives that run left unfinished.
+func (r *Recorder) sweepFiles(startup bool) {
+	entries, err := os.ReadDir(r.cfg.RecordingsPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list recordings")
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(r.cfg.RecordingTTL) * time.Second)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		unfinished := strings.HasSuffix(e.Name(), ".part")
+		if (startup && unfinished) || (!unfinished && info.ModTime().Before(cutoff)) {
+			if err := os.Remove(filepath.Join(r.cfg.RecordingsPath, e.Name())); err != nil && !os.IsNotExist(err) {
+				log.Error().Err(err).Str("file", e.Name()).Msg("Failed to remove recording")
+			}
+		}
+	}
+}
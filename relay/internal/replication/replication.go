@@ -0,0 +1,354 @@
+// Package replication keeps a warm-standby relay in sync with its primary
+package replication
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Roles
+const (
+	RolePrimary = "primary"
+	RoleStandby = "standby"
+)
+
+// ErrNotStandby is returned when promoting a node that is already primary
+var ErrNotStandby = errors.New("relay is not a standby")
+
+// tables are copied from the primary in this order
+var tables = []string{"tokens", "jobs", "url_policies", "macros", "pipelines", "rule_sets", "schedules", "webhooks"}
+
+var columnName = regexp.MustCompile(`^[a-z_]+$`)
+
+// Node tracks this relay's replication role. A standby pulls snapshots of
+// token state and queued jobs from its primary until it is promoted.
+type Node struct {
+	cfg    *config.Config
+	db     *database.DB
+	client *http.Client
+
+	// syncMu is held while a snapshot is pulled and applied so promotion
+	// never races a half-applied copy
+	syncMu sync.Mutex
+
+	mu         sync.RWMutex
+	role       string
+	lastSyncAt time.Time
+	lastError  string
+	promotedAt time.Time
+	stop       chan struct{}
+}
+
+// New creates a Node for the configured role
+func New(cfg *config.Config, db *database.DB) (*Node, error) {
+	switch cfg.Role {
+	case RolePrimary:
+	case RoleStandby:
+		if cfg.PrimaryURL == "" || cfg.ReplicationToken == "" {
+			return nil, fmt.Errorf("standby requires PRIMARY_URL and REPLICATION_TOKEN")
+		}
+	default:
+		return nil, fmt.Errorf("unknown RELAY_ROLE: %s", cfg.Role)
+	}
+
+	return &Node{
+		cfg:    cfg,
+		db:     db,
+		client: &http.Client{Timeout: 30 * time.Second},
+		role:   cfg.Role,
+		stop:   make(chan struct{}),
+	}, nil
+}
+
+// Role returns the current role
+func (n *Node) Role() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.role
+}
+
+// IsPrimary reports whether this relay accepts extensions and API traffic
+func (n *Node) IsPrimary() bool {
+	return n.Role() == RolePrimary
+}
+
+// PrimaryURL returns where a standby's clients should go instead
+func (n *Node) PrimaryURL() string {
+	if n.IsPrimary() {
+		return ""
+	}
+	return n.cfg.PrimaryURL
+}
+
+// Status describes the replication state
+func (n *Node) Status() models.ReplicationStatus {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	status := models.ReplicationStatus{
+		Role:      n.role,
+		LastError: n.lastError,
+	}
+	if n.role == RoleStandby {
+		status.PrimaryURL = n.cfg.PrimaryURL
+	}
+	if !n.lastSyncAt.IsZero() {
+		t := n.lastSyncAt
+		status.LastSyncAt = &t
+		if n.role == RoleStandby {
+			status.LagSeconds = int64(time.Since(t).Seconds())
+		}
+	}
+	if !n.promotedAt.IsZero() {
+		t := n.promotedAt
+		status.PromotedAt = &t
+	}
+	return status
+}
+
+// Promote turns a standby into the primary. Replication stops and the
+// relay starts accepting extensions with whatever state it last copied.
+func (n *Node) Promote() error {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role != RoleStandby {
+		return ErrNotStandby
+	}
+	n.role = RolePrimary
+	n.promotedAt = time.Now().UTC()
+	close(n.stop)
+
+	log.Warn().Time("last_sync", n.lastSyncAt).Msg("Standby promoted to primary")
+	return nil
+}
+
+// Run pulls snapshots from the primary until the context ends or the node
+// is promoted. It returns immediately on a primary.
+func (n *Node) Run(ctx context.Context) {
+	if n.IsPrimary() {
+		return
+	}
+
+	log.Info().Str("primary", n.cfg.PrimaryURL).Msg("Running as standby")
+
+	ticker := time.NewTicker(time.Duration(n.cfg.ReplicationInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		n.syncOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) syncOnce(ctx context.Context) {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+
+	if n.IsPrimary() {
+		return
+	}
+	err := n.pull(ctx)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err != nil {
+		if n.lastError != err.Error() {
+			log.Error().Err(err).Msg("Replication failed")
+		}
+		n.lastError = err.Error()
+		return
+	}
+	if n.lastError != "" {
+		log.Info().Msg("Replication recovered")
+	}
+	n.lastError = ""
+	n.lastSyncAt = time.Now().UTC()
+}
+
+func (n *Node) pull(ctx context.Context) error {
+	url := strings.TrimSuffix(n.cfg.PrimaryURL, "/") + "/api/v1/admin/replication/snapshot"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.cfg.ReplicationToken)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach primary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	var snap models.ReplicationSnapshot
+	if err := dec.Decode(&snap); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	return n.apply(&snap)
+}
+
+// Snapshot reads every replicated table in a single transaction
+func (n *Node) Snapshot(ctx context.Context) (*models.ReplicationSnapshot, error) {
+	var opts *sql.TxOptions
+	if n.db.Driver().Name() == "postgres" {
+		opts = &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	tx, err := n.db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	snap := &models.ReplicationSnapshot{
+		SchemaVersion: n.db.SchemaVersion(),
+		TakenAt:       time.Now().UTC(),
+		Tables:        make(map[string]*models.ReplicationTable, len(tables)),
+	}
+
+	for _, table := range tables {
+		t, err := dumpTable(ctx, tx, table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", table, err)
+		}
+		snap.Tables[table] = t
+	}
+
+	return snap, nil
+}
+
+func dumpTable(ctx context.Context, tx *sql.Tx, table string) (*models.ReplicationTable, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+table+" ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &models.ReplicationTable{Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		t.Rows = append(t.Rows, values)
+	}
+
+	return t, rows.Err()
+}
+
+// apply replaces the local contents of every replicated table with the
+// snapshot's
+func (n *Node) apply(snap *models.ReplicationSnapshot) error {
+	if snap.SchemaVersion != n.db.SchemaVersion() {
+		return fmt.Errorf("schema version mismatch: primary %d, standby %d", snap.SchemaVersion, n.db.SchemaVersion())
+	}
+
+	driver := n.db.Driver()
+	tx, err := n.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		t, ok := snap.Tables[table]
+		if !ok {
+			return fmt.Errorf("snapshot is missing table %s", table)
+		}
+		for _, col := range t.Columns {
+			if !columnName.MatchString(col) {
+				return fmt.Errorf("invalid column name in %s: %q", table, col)
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %w", table, err)
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(t.Columns)), ", ")
+		insert := driver.Rebind(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+			table, strings.Join(t.Columns, ", "), placeholders))
+		for _, row := range t.Rows {
+			if len(row) != len(t.Columns) {
+				return fmt.Errorf("malformed row in %s", table)
+			}
+			for i, v := range row {
+				row[i] = fromJSON(v)
+			}
+			if _, err := tx.Exec(insert, row...); err != nil {
+				return fmt.Errorf("failed to copy %s: %w", table, err)
+			}
+		}
+
+		// Keep sequences ahead of copied IDs so inserts after promotion work
+		if driver.Name() == "postgres" {
+			if _, err := tx.Exec(fmt.Sprintf(
+				"SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)",
+				table, table)); err != nil {
+				return fmt.Errorf("failed to reset %s sequence: %w", table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// fromJSON converts decoded JSON numbers back into integer column values
+func fromJSON(v any) any {
+	num, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := num.Int64(); err == nil {
+		return i
+	}
+	f, _ := num.Float64()
+	return f
+}
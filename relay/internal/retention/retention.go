@@ -0,0 +1,197 @@
+// Package retention decides how long saved screenshots stay on disk. The
+// screenshot records hold each file reference; a sweeper releases the
+// references of expired screenshots, evicts the oldest when the files
+// outgrow SCREENSHOT_MAX_DISK, and prunes records past SCREENSHOT_HISTORY.
+// Because the state lives in the database, references a stopped relay
+// never released are reclaimed at the next startup.
+package retention
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/artifact"
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+const (
+	// Screenshots released per query while sweeping or evicting
+	batchSize = 100
+
+	// How often records past SCREENSHOT_HISTORY are deleted
+	pruneInterval = time.Hour
+)
+
+// Manager releases screenshot files once they expire or disk runs short
+type Manager struct {
+	cfg         *config.Config
+	screenshots *store.ScreenshotStore
+	blobs       *store.BlobStore
+	artifacts   *artifact.Store
+
+	// evictMu keeps concurrent saves from evicting for the same overflow
+	evictMu sync.Mutex
+
+	expired, evicted atomic.Int64
+}
+
+// Stats counts screenshots released since startup
+type Stats struct {
+	Expired int64 // released after SCREENSHOT_TTL
+	Evicted int64 // released early to stay under SCREENSHOT_MAX_DISK
+}
+
+// New reconciles the artifact directory with the screenshot records, then
+// starts the sweeper
+func New(cfg *config.Config, stores *store.Stores, artifacts *artifact.Store) *Manager {
+	m := &Manager{
+		cfg:         cfg,
+		screenshots: stores.Screenshots,
+		blobs:       stores.Blobs,
+		artifacts:   artifacts,
+	}
+	m.reconcile()
+	go m.sweepLoop()
+	return m
+}
+
+// reconcile releases what expired while the relay was down, recounts blob
+// references from the screenshots still retained, and removes files no
+// blob names: those of dropped references, and partial writes
+func (m *Manager) reconcile() {
+	released, err := m.screenshots.ReleaseExpired(time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to release expired screenshots")
+		return
+	}
+	blobs, err := m.blobs.Recount()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to recount screenshot blobs")
+		return
+	}
+	files, bytes, err := m.artifacts.RemoveOrphans()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to remove orphaned screenshot files")
+	}
+	if released > 0 || blobs > 0 || files > 0 {
+		log.Info().
+			Int64("released", released).
+			Int64("blobs", blobs).
+			Int("files", files).
+			Int64("bytes", bytes).
+			Msg("Reclaimed screenshots left by an earlier run")
+	}
+	m.Enforce("")
+}
+
+func (m *Manager) sweepLoop() {
+	ticker := time.NewTicker(time.Duration(m.cfg.ScreenshotSweepInterval) * time.Second)
+	defer ticker.Stop()
+
+	lastPrune := time.Now()
+	for range ticker.C {
+		m.sweep()
+		if time.Since(lastPrune) >= pruneInterval {
+			m.prune()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+// sweep releases every screenshot that has expired
+func (m *Manager) sweep() {
+	for {
+		shots, err := m.screenshots.Retained(time.Now(), batchSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to find expired screenshots")
+			return
+		}
+		for _, shot := range shots {
+			if m.release(shot) {
+				m.expired.Add(1)
+			}
+		}
+		if len(shots) < batchSize {
+			return
+		}
+	}
+}
+
+// prune drops screenshot records older than SCREENSHOT_HISTORY
+func (m *Manager) prune() {
+	cutoff := time.Now().Add(-time.Duration(m.cfg.ScreenshotHistory) * time.Second)
+	if n, err := m.screenshots.DeleteBefore(cutoff); err != nil {
+		log.Error().Err(err).Msg("Failed to prune screenshot records")
+	} else if n > 0 {
+		log.Debug().Int64("records", n).Msg("Pruned screenshot records")
+	}
+}
+
+// Enforce releases the oldest screenshots until the stored files fit in
+// SCREENSHOT_MAX_DISK. The screenshot with ID keep, just saved, is never
+// evicted, so a single capture larger than the cap is still served.
+func (m *Manager) Enforce(keep string) {
+	limit := int64(m.cfg.ScreenshotMaxDisk) << 20
+	if limit == 0 {
+		return
+	}
+	m.evictMu.Lock()
+	defer m.evictMu.Unlock()
+
+	for {
+		_, bytes, err := m.blobs.Totals()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to sum screenshot files")
+			return
+		}
+		if bytes <= limit {
+			return
+		}
+		shots, err := m.screenshots.Retained(time.Time{}, batchSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to find screenshots to evict")
+			return
+		}
+		evicted := false
+		for _, shot := range shots {
+			if shot.ID == keep {
+				continue
+			}
+			if m.release(shot) {
+				m.evicted.Add(1)
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			return
+		}
+	}
+}
+
+// release drops a screenshot's file reference, once. It reports whether
+// this call released it.
+func (m *Manager) release(shot *models.Screenshot) bool {
+	ok, err := m.screenshots.MarkReleased(shot.ID, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str("screenshot", shot.ID).Msg("Failed to release screenshot")
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := m.artifacts.Release(shot.TokenID, shot.Hash, shot.Format); err != nil {
+		log.Error().Err(err).Str("hash", shot.Hash).Msg("Failed to release screenshot file")
+	}
+	return true
+}
+
+// Stats returns how many screenshots were released since startup
+func (m *Manager) Stats() Stats {
+	return Stats{Expired: m.expired.Load(), Evicted: m.evicted.Load()}
+}
@@ -0,0 +1,290 @@
+// Package scheduler runs the stored cron schedules. Each tick it claims
+// the schedules that are due, moving them on to their next run in the
+// same update, so relays sharing a database never run one twice. Runs are
+// recorded with their outcome, and failures are sent to schedule_failed
+// webhooks.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/replication"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/webhooks"
+)
+
+const (
+	// How often due schedules are looked for; cron's resolution is a
+	// minute
+	tickInterval = 15 * time.Second
+
+	// Schedules claimed per tick
+	batchSize = 100
+)
+
+// ErrStopped is returned by Fire once the relay is shutting down
+var ErrStopped = errors.New("scheduler stopped")
+
+// RunFunc runs a schedule's job as its token, returning what it left
+// behind even when it failed partway
+type RunFunc func(ctx context.Context, token *models.Token, sched *models.Schedule) (*Outcome, *models.CommandError)
+
+// Outcome is what a successful or failed run left behind
+type Outcome struct {
+	TabID        string
+	Result       json.RawMessage
+	ScreenshotID string
+}
+
+// Scheduler fires schedules as they come due
+type Scheduler struct {
+	cfg       *config.Config
+	schedules *store.ScheduleStore
+	tokens    *store.TokenStore
+	node      *replication.Node
+	webhooks  *webhooks.Notifier
+	run       RunFunc
+
+	// Parent of every run's context, cancelled by Drain once its wait is
+	// over
+	runCtx     context.Context
+	cancelRuns context.CancelFunc
+
+	mu      sync.Mutex
+	running map[int64]bool // schedule IDs with a run in progress
+	stopped bool           // set by Drain; no run starts after it
+	runs    sync.WaitGroup // runs in progress
+}
+
+// New fails the runs a stopped relay left unfinished, then fires
+// schedules until ctx ends
+func New(ctx context.Context, cfg *config.Config, stores *store.Stores, node *replication.Node, notifier *webhooks.Notifier, run RunFunc) *Scheduler {
+	s := &Scheduler{
+		cfg:       cfg,
+		schedules: stores.Schedules,
+		tokens:    stores.Tokens,
+		node:      node,
+		webhooks:  notifier,
+		run:       run,
+		running:   make(map[int64]bool),
+	}
+	s.runCtx, s.cancelRuns = context.WithCancel(context.Background())
+	// Another relay may still be running what it started recently
+	cutoff := time.Now().Add(-s.maxRunTime() - time.Minute)
+	if n, err := s.schedules.AbandonRuns(cutoff); err != nil {
+		log.Error().Err(err).Msg("Failed to fail interrupted schedule runs")
+	} else if n > 0 {
+		log.Info().Int64("runs", n).Msg("Failed interrupted schedule runs")
+	}
+	go s.loop(ctx)
+	return s
+}
+
+func (s *Scheduler) loop(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// A standby's copy of the schedules is the primary's to run
+			if !s.node.IsPrimary() {
+				continue
+			}
+			s.tick(now)
+		}
+	}
+}
+
+// Drain stops runs from starting and waits for those in progress until
+// ctx ends, then cancels the rest and waits for them to be recorded
+func (s *Scheduler) Drain(ctx context.Context) {
+	s.mu.Lock()
+	s.stopped = true
+	inProgress := len(s.running)
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(done)
+	}()
+	if inProgress > 0 {
+		log.Info().Int("runs", inProgress).Msg("Draining schedule runs")
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Msg("Drain timeout reached; cancelling schedule runs")
+	}
+	s.cancelRuns()
+	<-done
+}
+
+// tick starts every schedule due by now. A schedule that came due more
+// than once while no relay was running fires once, then resumes its
+// cadence.
+func (s *Scheduler) tick(now time.Time) {
+	due, err := s.schedules.Due(now, batchSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to find due schedules")
+		return
+	}
+	for _, sched := range due {
+		claimed, err := s.schedules.Claim(sched, sched.NextRun(now))
+		if err != nil {
+			log.Error().Err(err).Int64("schedule_id", sched.ID).Msg("Failed to claim schedule")
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		go s.fire(sched)
+	}
+}
+
+// Fire runs a schedule now, outside its cadence, and returns the run
+// once it is recorded
+func (s *Scheduler) Fire(sched *models.Schedule) (*models.ScheduleRun, error) {
+	run, err := s.start(sched)
+	if err != nil {
+		return nil, err
+	}
+	if run.Status == models.RunRunning {
+		go s.execute(sched, run)
+	}
+	return run, nil
+}
+
+func (s *Scheduler) fire(sched *models.Schedule) {
+	run, err := s.start(sched)
+	if err != nil {
+		log.Error().Err(err).Str("schedule", sched.Name).Msg("Failed to start schedule run")
+		return
+	}
+	if run.Status == models.RunRunning {
+		s.execute(sched, run)
+	}
+}
+
+// start records a run, skipped if the schedule's previous run on this
+// relay has not finished
+func (s *Scheduler) start(sched *models.Schedule) (*models.ScheduleRun, error) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, ErrStopped
+	}
+	busy := s.running[sched.ID]
+	if !busy {
+		s.running[sched.ID] = true
+		s.runs.Add(1)
+	}
+	s.mu.Unlock()
+
+	if busy {
+		run, err := s.schedules.StartRun(sched.ID, models.RunSkipped, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		run.Error = &models.CommandError{Code: "RUN_IN_PROGRESS", Message: "The previous run had not finished"}
+		finishedAt := run.StartedAt
+		run.FinishedAt = &finishedAt
+		if err := s.schedules.FinishRun(run); err != nil {
+			return nil, err
+		}
+		log.Warn().Str("schedule", sched.Name).Msg("Skipped schedule run; the previous one is still running")
+		return run, nil
+	}
+
+	run, err := s.schedules.StartRun(sched.ID, models.RunRunning, time.Now())
+	if err != nil {
+		s.done(sched.ID)
+		return nil, err
+	}
+	return run, nil
+}
+
+func (s *Scheduler) done(id int64) {
+	s.mu.Lock()
+	delete(s.running, id)
+	s.mu.Unlock()
+	s.runs.Done()
+}
+
+// execute runs the job as the schedule's token and records how it went
+func (s *Scheduler) execute(sched *models.Schedule, run *models.ScheduleRun) {
+	defer s.done(sched.ID)
+
+	token, err := s.tokens.ByID(sched.TokenID)
+	if err != nil {
+		log.Error().Err(err).Str("schedule", sched.Name).Msg("Failed to load schedule token")
+	}
+
+	var cmdErr *models.CommandError
+	if token == nil {
+		cmdErr = &models.CommandError{Code: "UNAUTHORIZED", Message: "The schedule's token is revoked"}
+	} else {
+		ctx, cancel := context.WithTimeout(s.runCtx, s.maxRunTime())
+		var outcome *Outcome
+		outcome, cmdErr = s.run(ctx, token, sched)
+		cancel()
+		if outcome != nil {
+			run.TabID = outcome.TabID
+			run.Result = outcome.Result
+			run.ScreenshotID = outcome.ScreenshotID
+		}
+	}
+
+	run.Status = models.RunSucceeded
+	if cmdErr != nil {
+		run.Status = models.RunFailed
+		run.Error = cmdErr
+	}
+	if err := s.schedules.FinishRun(run); err != nil {
+		log.Error().Err(err).Str("schedule", sched.Name).Msg("Failed to record schedule run")
+	}
+	if _, err := s.schedules.PruneRuns(sched.ID, s.cfg.ScheduleHistory); err != nil {
+		log.Error().Err(err).Str("schedule", sched.Name).Msg("Failed to prune schedule runs")
+	}
+
+	if cmdErr == nil {
+		log.Debug().Str("schedule", sched.Name).Int64("run_id", run.ID).Msg("Schedule ran")
+		return
+	}
+	log.Warn().
+		Str("schedule", sched.Name).
+		Int64("run_id", run.ID).
+		Str("code", cmdErr.Code).
+		Str("error", cmdErr.Message).
+		Msg("Schedule run failed")
+
+	data := models.WebhookScheduleRun{
+		TokenID:   sched.TokenID,
+		Schedule:  sched.Name,
+		Kind:      sched.Kind,
+		RunID:     run.ID,
+		TabID:     run.TabID,
+		Error:     cmdErr,
+		StartedAt: run.StartedAt,
+	}
+	if token != nil {
+		data.TokenName = token.Name
+	}
+	s.webhooks.Notify(models.WebhookScheduleFailed, data)
+}
+
+// maxRunTime bounds a run as HTTP_TIMEOUT_MAX bounds a macro run
+// requested over the API
+func (s *Scheduler) maxRunTime() time.Duration {
+	return time.Duration(s.cfg.HTTPTimeoutMax) * time.Second
+}
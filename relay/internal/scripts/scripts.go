@@ -0,0 +1,164 @@
+// Package scripts records the commands sent to a tab as a replayable
+// script. A recording keeps each successful command with its offset from
+// the start, so a replay can repeat an agent's run at the same pace.
+package scripts
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ErrAlreadyRecording is returned when the tab is being recorded already
+var ErrAlreadyRecording = errors.New("tab is already being recorded")
+
+// secretKinds are the actions that carry credentials or session state,
+// which are never recorded
+var secretKinds = map[string]bool{
+	"credentials_set": true,
+	"headers_set":     true,
+	"cookies_set":     true,
+	"storage_set":     true,
+}
+
+// Recorder holds the token's recordings in memory, in progress and for
+// SCRIPT_TTL after they stop
+type Recorder struct {
+	cfg *config.Config
+
+	mu         sync.Mutex
+	recordings map[string]*recording
+}
+
+type recording struct {
+	tokenHash string
+	started   time.Time
+	touched   time.Time // last command recorded, or when it stopped
+	script    models.Script
+}
+
+// New creates a Recorder
+func New(cfg *config.Config) *Recorder {
+	r := &Recorder{cfg: cfg, recordings: make(map[string]*recording)}
+	go r.cleanupLoop()
+	return r
+}
+
+// Start begins recording the commands sent to a tab; url is the page the
+// tab shows, where a replay starts
+func (r *Recorder) Start(tokenHash, tabID, url string) (*models.Script, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rec := range r.recordings {
+		if rec.tokenHash == tokenHash && rec.script.TabID == tabID && rec.script.StoppedAt == nil {
+			return nil, ErrAlreadyRecording
+		}
+	}
+	now := time.Now()
+	rec := &recording{
+		tokenHash: tokenHash,
+		started:   now,
+		touched:   now,
+		script: models.Script{
+			Version:   models.ScriptVersion,
+			ID:        uuid.New().String(),
+			TabID:     tabID,
+			URL:       url,
+			StartedAt: now.UTC(),
+			Steps:     []models.ScriptStep{},
+		},
+	}
+	r.recordings[rec.script.ID] = rec
+	return rec.copy(), nil
+}
+
+// Observe adds a command that succeeded to the recording of its tab, if
+// there is one
+func (r *Recorder) Observe(tokenHash string, cmd *models.CommandRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rec := range r.recordings {
+		if rec.tokenHash != tokenHash || rec.script.TabID != cmd.TabID || rec.script.StoppedAt != nil {
+			continue
+		}
+		s := &rec.script
+		switch {
+		case cmd.Action.Kind == "upload":
+			// The files are not kept, so the step could not be repeated
+			s.Skipped++
+		case secretKinds[cmd.Action.Kind]:
+			// A script is handed back and stored by clients; it must not
+			// carry passwords, auth headers, or session state
+			s.Skipped++
+		case len(s.Steps) >= models.MaxScriptSteps:
+			s.Truncated = true
+		default:
+			action := cmd.Action
+			action.Files = nil
+			s.Steps = append(s.Steps, models.ScriptStep{
+				Offset: time.Since(rec.started).Milliseconds(),
+				Action: action,
+			})
+		}
+		rec.touched = time.Now()
+	}
+}
+
+// Stop ends a recording and returns its script
+func (r *Recorder) Stop(tokenHash, id string) (*models.Script, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.recordings[id]
+	if rec == nil || rec.tokenHash != tokenHash {
+		return nil, false
+	}
+	if rec.script.StoppedAt == nil {
+		now := time.Now()
+		stopped := now.UTC()
+		rec.script.StoppedAt = &stopped
+		rec.touched = now
+	}
+	return rec.copy(), true
+}
+
+// Get returns a recording's script so far
+func (r *Recorder) Get(tokenHash, id string) (*models.Script, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.recordings[id]
+	if rec == nil || rec.tokenHash != tokenHash {
+		return nil, false
+	}
+	return rec.copy(), true
+}
+
+func (rec *recording) copy() *models.Script {
+	s := rec.script
+	s.Steps = append([]models.ScriptStep{}, s.Steps...)
+	return &s
+}
+
+// cleanupLoop forgets recordings idle for SCRIPT_TTL
+func (r *Recorder) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		ttl := time.Duration(r.cfg.ScriptTTL) * time.Second
+		r.mu.Lock()
+		for id, rec := range r.recordings {
+			if time.Since(rec.touched) > ttl {
+				delete(r.recordings, id)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
@@ -6,108 +6,330 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimiddleware "github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
 	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/emreylmaz/owlrelay/relay/internal/artifact"
+	"github.com/emreylmaz/owlrelay/relay/internal/cluster"
 	"github.com/emreylmaz/owlrelay/relay/internal/config"
 	"github.com/emreylmaz/owlrelay/relay/internal/handlers"
 	"github.com/emreylmaz/owlrelay/relay/internal/hub"
+	"github.com/emreylmaz/owlrelay/relay/internal/middleware"
+	"github.com/emreylmaz/owlrelay/relay/internal/replication"
 	"github.com/emreylmaz/owlrelay/relay/internal/store"
+	"github.com/emreylmaz/owlrelay/relay/internal/tracing"
 )
 
 // Server represents the HTTP server
 type Server struct {
-	cfg        *config.Config
-	httpServer *http.Server
-	hub        *hub.Hub
-	tokenStore *store.TokenStore
-	version    string
+	cfg         *config.Config
+	httpServers []*http.Server
+	hub         *hub.Hub
+	stores      *store.Stores
+	node        *replication.Node
+	cluster     *cluster.Node // nil unless clustered
+	version     string
+
+	accessLog   zerolog.Logger
+	accessLevel zerolog.Level
+	accessFile  *os.File // nil unless ACCESS_LOG_FILE names a file
+
+	cors atomic.Pointer[cors.Cors]
+
+	// Per-IP limits on /ws and the health endpoints
+	ipLimits *middleware.IPLimits
+
+	// TRUSTED_PROXIES, whose headers give the client address
+	proxies []netip.Prefix
+
+	handlers *handlers.Handlers
 }
 
-// New creates a new Server
-func New(cfg *config.Config, h *hub.Hub, tokenStore *store.TokenStore, version string) *Server {
+// New creates a new Server. clusterNode may be nil.
+func New(cfg *config.Config, h *hub.Hub, stores *store.Stores, node *replication.Node, clusterNode *cluster.Node, version string) *Server {
 	return &Server{
-		cfg:        cfg,
-		hub:        h,
-		tokenStore: tokenStore,
-		version:    version,
+		cfg:     cfg,
+		hub:     h,
+		stores:  stores,
+		node:    node,
+		cluster: clusterNode,
+		version: version,
 	}
 }
 
-// Start starts the HTTP server
+// Start binds every configured listener and serves until ctx is done
 func (s *Server) Start(ctx context.Context) error {
+	tracing.Setup(s.cfg, s.version)
+	if err := s.openAccessLog(); err != nil {
+		return err
+	}
+	s.cors.Store(newCORS(s.cfg.CORSOrigins))
+	s.cfg.OnReload(func(c *config.Config) {
+		s.cors.Store(newCORS(c.CORSOrigins))
+	})
+
+	limiter, err := middleware.NewLimiter(s.cfg)
+	if err != nil {
+		return err
+	}
+	artifacts, err := artifact.New(filepath.Join(s.cfg.ScreenshotPath, "blobs"), s.stores.Blobs)
+	if err != nil {
+		return err
+	}
+	s.ipLimits = middleware.NewIPLimits(s.cfg)
+	if s.proxies, err = s.cfg.Proxies(); err != nil {
+		return err
+	}
+	h := handlers.New(ctx, s.cfg, s.hub, s.stores, s.node, limiter, s.ipLimits, artifacts, s.version)
+	s.handlers = h
+
+	// Requests outlive the shutdown signal so in-flight commands can drain;
+	// the base context is cancelled once draining is over
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	tlsCfg, acmeHandler, err := tlsSetup(s.cfg)
+	if err != nil {
+		return err
+	}
+
+	// Bind everything first so a bad address fails startup cleanly
+	listeners := make([]net.Listener, 0, len(s.cfg.ParsedListeners))
+	for _, l := range s.cfg.ParsedListeners {
+		ln, err := listen(l, s.cfg.SocketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", l.Addr, err)
+		}
+		listeners = append(listeners, ln)
+
+		s.httpServers = append(s.httpServers, &http.Server{
+			Addr:         l.Addr,
+			Handler:      s.router(h, l),
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second, // raised per request by middleware.Timeout
+			IdleTimeout:  60 * time.Second,
+			BaseContext:  func(net.Listener) context.Context { return baseCtx },
+			TLSConfig:    tlsCfg,
+		})
+	}
+
+	var acmeServer *http.Server
+	var acmeListener net.Listener
+	if acmeHandler != nil && s.cfg.ACMEHTTPAddr != "" {
+		acmeListener, err = net.Listen("tcp", s.cfg.ACMEHTTPAddr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", s.cfg.ACMEHTTPAddr, err)
+		}
+		acmeServer = &http.Server{
+			Addr:         s.cfg.ACMEHTTPAddr,
+			Handler:      acmeHandler,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+		}
+	}
+
+	errCh := make(chan error, len(listeners)+1)
+	for i, ln := range listeners {
+		srv := s.httpServers[i]
+		// Unix sockets are local to the host, so they skip TLS
+		_, local := s.cfg.ParsedListeners[i].SocketPath()
+		useTLS := tlsCfg != nil && !local
+		log.Info().
+			Str("addr", ln.Addr().String()).
+			Strs("routes", s.cfg.ParsedListeners[i].Routes).
+			Bool("tls", useTLS).
+			Str("version", s.version).
+			Msg("Starting server")
+
+		go func() {
+			var err error
+			if useTLS {
+				// Certificates come from srv.TLSConfig
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				errCh <- err
+			}
+		}()
+	}
+
+	if acmeServer != nil {
+		s.httpServers = append(s.httpServers, acmeServer)
+		log.Info().
+			Str("addr", acmeListener.Addr().String()).
+			Strs("domains", s.cfg.Domains()).
+			Msg("Serving ACME challenges and HTTPS redirects")
+
+		go func() {
+			if err := acmeServer.Serve(acmeListener); err != nil && err != http.ErrServerClosed {
+				errCh <- err
+			}
+		}()
+	}
+
+	// SIGHUP reloads the settings that can change without dropping sessions
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// Wait for shutdown signal or error
+	for {
+		select {
+		case <-hup:
+			log.Info().Msg("SIGHUP received, reloading configuration")
+			if _, err := s.cfg.Reload(); err != nil {
+				log.Error().Err(err).Msg("Configuration reload failed; keeping the running configuration")
+			}
+		case <-ctx.Done():
+			return s.shutdown()
+		case err := <-errCh:
+			s.shutdown()
+			return err
+		}
+	}
+}
+
+// router builds the handler for one listener
+func (s *Server) router(h *handlers.Handlers, l config.Listener) http.Handler {
 	r := chi.NewRouter()
 
 	// Middleware
 	r.Use(chimiddleware.RequestID)
-	r.Use(chimiddleware.RealIP)
-	r.Use(chimiddleware.Logger)
+	r.Use(middleware.RealIP(s.proxies))
+	if s.cfg.AccessLog {
+		r.Use(middleware.AccessLog(s.accessLog, s.accessLevel))
+	}
 	r.Use(chimiddleware.Recoverer)
-	r.Use(chimiddleware.Timeout(60 * time.Second))
+	r.Use(middleware.Trace)
+	r.Use(middleware.Timeout(time.Duration(s.cfg.HTTPTimeoutMax) * time.Second))
+	// Uploads, and commands forwarded with them, have UPLOAD_MAX_SIZE
+	r.Use(middleware.MaxBody(s.cfg.MaxRequestBody, "/api/v1/upload", "/internal/cluster/command"))
+	// Endpoints open to anyone, before a token is checked
+	r.Use(s.ipLimits.RateLimit("/ws", "/health", "/healthz", "/readyz"))
 
-	// CORS
-	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"*"}, // In production, restrict this
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	// CORS, following CORS_ORIGINS across reloads
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.cors.Load().Handler(next).ServeHTTP(w, r)
+		})
+	})
 
 	// WebSocket endpoint
-	r.Get("/ws", s.handleWebSocket)
+	if l.Serves(config.RoutesWS) {
+		r.Get("/ws", s.handleWebSocket)
+	}
+
+	// Commands forwarded by peer relays
+	if l.Serves(config.RoutesCluster) && s.cluster != nil {
+		r.Mount("/internal/cluster", s.cluster.Handler())
+	}
 
 	// Register HTTP handlers
-	h := handlers.New(s.cfg, s.hub, s.tokenStore, s.version)
-	h.RegisterRoutes(r, s.tokenStore)
-
-	// Create HTTP server
-	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
-	s.httpServer = &http.Server{
-		Addr:         addr,
-		Handler:      r,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
-		BaseContext:  func(l net.Listener) context.Context { return ctx },
-	}
-
-	log.Info().
-		Str("addr", addr).
-		Str("version", s.version).
-		Msg("Starting server")
-
-	// Start server in goroutine
-	errCh := make(chan error, 1)
-	go func() {
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errCh <- err
-		}
-	}()
+	h.RegisterRoutes(r, s.stores.Tokens, l)
 
-	// Wait for shutdown signal or error
-	select {
-	case <-ctx.Done():
-		return s.shutdown()
-	case err := <-errCh:
-		return err
-	}
+	return r
 }
 
+// shutdown stops accepting requests and commands, waits up to the drain
+// timeout for in-flight ones, then tells extensions the server is going away
 func (s *Server) shutdown() error {
 	log.Info().Msg("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownDrainTimeout)*time.Second)
 	defer cancel()
 
-	return s.httpServer.Shutdown(ctx)
+	// Closing the listeners and draining the hub run together: HTTP handlers
+	// blocked on commands finish as the hub's in-flight commands complete
+	errCh := make(chan error, len(s.httpServers))
+	for _, srv := range s.httpServers {
+		go func(srv *http.Server) {
+			errCh <- srv.Shutdown(ctx)
+		}(srv)
+	}
+
+	s.hub.Drain(ctx)
+	s.handlers.Drain(ctx)
+	var err error
+	for range s.httpServers {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	s.hub.Shutdown("server shutdown")
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	tracing.Shutdown(flushCtx)
+
+	if s.accessFile != nil {
+		s.accessFile.Close()
+	}
+	return err
+}
+
+// newCORS builds the CORS handler for a CORS_ORIGINS value
+func newCORS(origins string) *cors.Cors {
+	var allowed []string
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowed = append(allowed, origin)
+		}
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins:   allowed,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "traceparent"},
+		ExposedHeaders:   []string{"Link", "X-Trace-Id"},
+		AllowCredentials: true,
+		MaxAge:           300,
+	})
+}
+
+// openAccessLog picks where request lines go: the server log at info
+// level, or JSON in ACCESS_LOG_FILE regardless of LOG_LEVEL
+func (s *Server) openAccessLog() error {
+	switch s.cfg.AccessLogFile {
+	case "":
+		s.accessLog, s.accessLevel = log.Logger, zerolog.InfoLevel
+		return nil
+	case "stdout":
+		s.accessLog = zerolog.New(os.Stdout)
+	default:
+		f, err := os.OpenFile(s.cfg.AccessLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return fmt.Errorf("failed to open access log: %w", err)
+		}
+		s.accessFile = f
+		s.accessLog = zerolog.New(f)
+	}
+	// RFC 3339 rather than the server log's Unix seconds, for ingestion
+	s.accessLog = s.accessLog.Hook(zerolog.HookFunc(func(e *zerolog.Event, _ zerolog.Level, _ string) {
+		e.Str("time", time.Now().UTC().Format(time.RFC3339Nano))
+	}))
+	s.accessLevel = zerolog.NoLevel
+	return nil
 }
 
 // WebSocket upgrader
@@ -120,6 +342,24 @@ var upgrader = websocket.Upgrader{
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Extensions must connect to the primary; 503 sends them back to probing
+	if !s.node.IsPrimary() {
+		primary := s.node.PrimaryURL()
+		w.Header().Set("X-Owlrelay-Primary", primary)
+		http.Error(w, `{"type":"connect_error","code":"STANDBY","message":"Relay is a standby","primary":"`+primary+`"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	// Handshakes from one address in progress at once are capped, since
+	// each costs a token check and a socket
+	release, ok := s.ipLimits.BeginHandshake(r)
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"type":"connect_error","code":"TOO_MANY_HANDSHAKES","message":"Too many connection attempts from this address"}`, http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
 	// Extract token from query parameter
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -136,22 +376,27 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate token
-	tokenData, err := s.tokenStore.Validate(token)
+	tokenData, err := s.stores.Tokens.Validate(token)
 	if err != nil || tokenData == nil {
 		http.Error(w, `{"type":"connect_error","code":"INVALID_TOKEN","message":"Invalid or expired token"}`, http.StatusUnauthorized)
 		return
 	}
 
-	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Upgrade to WebSocket, with permessage-deflate if enabled and offered
+	u := upgrader
+	u.EnableCompression = s.cfg.WSCompression
+	conn, err := u.Upgrade(w, r, nil)
+	release()
 	if err != nil {
 		log.Error().Err(err).Msg("WebSocket upgrade failed")
 		return
 	}
+	if s.cfg.WSCompression {
+		conn.SetCompressionLevel(s.cfg.WSCompressionLevel)
+	}
 
 	// Register connection with hub
-	tokenHash := store.HashToken(token)
-	c := s.hub.Register(conn, tokenHash, tokenData.Name)
+	c := s.hub.Register(conn, tokenData.Hash, tokenData.Name)
 
 	// Run connection pumps
 	c.Run(r.Context())
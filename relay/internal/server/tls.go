@@ -0,0 +1,54 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+)
+
+// tlsSetup returns the TLS configuration shared by every listener, or nil
+// when TLS is disabled. With DOMAIN set it also returns the handler for
+// ACME_HTTP_ADDR, which answers HTTP-01 challenges and redirects everything
+// else to HTTPS.
+func tlsSetup(cfg *config.Config) (*tls.Config, http.Handler, error) {
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil, nil
+	}
+
+	if cfg.Domain == "" {
+		return nil, nil, nil
+	}
+
+	domains := cfg.Domains()
+	if len(domains) == 0 {
+		return nil, nil, fmt.Errorf("DOMAIN contains no host names")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	}
+
+	// TLSConfig also answers TLS-ALPN-01 challenges, which works when the
+	// relay is reachable on port 443
+	tlsCfg := m.TLSConfig()
+	tlsCfg.MinVersion = tls.VersionTLS12
+	return tlsCfg, m.HTTPHandler(nil), nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+)
+
+// BlobStore reference-counts content-addressed artifact files. Each token
+// has its own blobs, so identical captures are shared within a token only.
+type BlobStore struct {
+	db *database.DB
+}
+
+// NewBlobStore creates a new BlobStore
+func NewBlobStore(db *database.DB) *BlobStore {
+	return &BlobStore{db: db}
+}
+
+// Acquire adds a reference to a token's blob, creating its record on first
+// use, and returns the new reference count
+func (s *BlobStore) Acquire(tokenID int64, hash string, size int) (int, error) {
+	var refs int
+	err := s.db.QueryRow(
+		`INSERT INTO blobs (token_id, hash, size, refs, created_at) VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT (token_id, hash) DO UPDATE SET refs = blobs.refs + 1 RETURNING refs`,
+		tokenID, hash, size, time.Now().UTC().Format(time.RFC3339),
+	).Scan(&refs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to acquire blob: %w", err)
+	}
+	return refs, nil
+}
+
+// Release drops a reference to a token's blob and returns the remaining
+// count. The record is deleted when none remain.
+func (s *BlobStore) Release(tokenID int64, hash string) (int, error) {
+	var refs int
+	err := s.db.QueryRow(
+		"UPDATE blobs SET refs = refs - 1 WHERE token_id = ? AND hash = ? AND refs > 0 RETURNING refs",
+		tokenID, hash,
+	).Scan(&refs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release blob: %w", err)
+	}
+	if refs == 0 {
+		if _, err := s.db.Exec("DELETE FROM blobs WHERE token_id = ? AND hash = ? AND refs = 0", tokenID, hash); err != nil {
+			return 0, fmt.Errorf("failed to delete blob: %w", err)
+		}
+	}
+	return refs, nil
+}
+
+// Totals returns the number of stored blobs and their combined size
+func (s *BlobStore) Totals() (count, bytes int64, err error) {
+	err = s.db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").Scan(&count, &bytes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to sum blobs: %w", err)
+	}
+	return count, bytes, nil
+}
+
+// Recount sets each blob's reference count to the screenshots still
+// holding it, the only references Put hands out, and deletes blobs nothing
+// holds. It repairs counts left behind when the relay stopped before
+// releasing them.
+func (s *BlobStore) Recount() (int64, error) {
+	if _, err := s.db.Exec(
+		`UPDATE blobs SET refs = (SELECT COUNT(*) FROM screenshots
+		WHERE screenshots.token_id = blobs.token_id AND screenshots.hash = blobs.hash
+		AND screenshots.released_at IS NULL)`,
+	); err != nil {
+		return 0, fmt.Errorf("failed to recount blobs: %w", err)
+	}
+	result, err := s.db.Exec("DELETE FROM blobs WHERE refs = 0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete blobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// Hashes returns the hashes of every stored blob, by token
+func (s *BlobStore) Hashes() (map[int64]map[string]bool, error) {
+	rows, err := s.db.Query("SELECT token_id, hash FROM blobs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query blobs: %w", err)
+	}
+	defer rows.Close()
+
+	hashes := make(map[int64]map[string]bool)
+	for rows.Next() {
+		var tokenID int64
+		var hash string
+		if err := rows.Scan(&tokenID, &hash); err != nil {
+			return nil, fmt.Errorf("failed to scan blob: %w", err)
+		}
+		if hashes[tokenID] == nil {
+			hashes[tokenID] = make(map[string]bool)
+		}
+		hashes[tokenID][hash] = true
+	}
+	return hashes, rows.Err()
+}
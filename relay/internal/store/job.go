@@ -0,0 +1,177 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Job statuses
+const (
+	JobQueued = "queued"
+	JobLeased = "leased"
+	JobDone   = "done"
+	JobFailed = "failed"
+)
+
+// ErrJobNotLeased is returned when acking a job the caller does not hold
+var ErrJobNotLeased = errors.New("job not found or not leased by this token")
+
+// JobStore handles work queue database operations
+type JobStore struct {
+	db *database.DB
+}
+
+// NewJobStore creates a new JobStore
+func NewJobStore(db *database.DB) *JobStore {
+	return &JobStore{db: db}
+}
+
+const jobColumns = "id, token_id, created_by, queue, payload, status, attempts, max_attempts, lease_until, result, error, created_at, updated_at"
+
+// Enqueue adds a job for the target token
+func (s *JobStore) Enqueue(tokenID, createdBy int64, queue string, payload json.RawMessage, maxAttempts int) (*models.Job, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	row := s.db.QueryRow(
+		"INSERT INTO jobs (token_id, created_by, queue, payload, status, max_attempts, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING "+jobColumns,
+		tokenID, createdBy, queue, string(payload), JobQueued, maxAttempts, now, now,
+	)
+	job, err := scanJob(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert job: %w", err)
+	}
+	return job, nil
+}
+
+// Lease claims the oldest available job in a queue for the token. Jobs whose
+// lease has expired are handed out again. Returns nil if the queue is empty.
+func (s *JobStore) Lease(tokenID int64, queue string, lease time.Duration) (*models.Job, error) {
+	now := time.Now().UTC()
+
+	row := s.db.QueryRow(
+		`UPDATE jobs SET status = ?, attempts = attempts + 1, lease_until = ?, updated_at = ?
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE token_id = ? AND queue = ?
+			  AND (status = ? OR (status = ? AND lease_until < ?))
+			ORDER BY id LIMIT 1`+s.db.Driver().SkipLocked()+`
+		) RETURNING `+jobColumns,
+		JobLeased, now.Add(lease).Format(time.RFC3339), now.Format(time.RFC3339),
+		tokenID, queue, JobQueued, JobLeased, now.Format(time.RFC3339),
+	)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease job: %w", err)
+	}
+
+	// A job that outlived its lease on the final attempt is not retried
+	if job.Attempts > job.MaxAttempts {
+		if err := s.finish(job.ID, tokenID, JobFailed, nil, "lease expired after max attempts"); err != nil {
+			return nil, err
+		}
+		return s.Lease(tokenID, queue, lease)
+	}
+
+	return job, nil
+}
+
+// Ack marks a leased job as done with an optional result
+func (s *JobStore) Ack(id, tokenID int64, result json.RawMessage) error {
+	return s.finish(id, tokenID, JobDone, result, "")
+}
+
+// Nack releases a leased job. It is requeued if retry is set and attempts
+// remain, otherwise it is marked failed.
+func (s *JobStore) Nack(id, tokenID int64, errMsg string, retry bool) error {
+	job, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.TokenID != tokenID || job.Status != JobLeased {
+		return ErrJobNotLeased
+	}
+
+	if retry && job.Attempts < job.MaxAttempts {
+		res, err := s.db.Exec(
+			"UPDATE jobs SET status = ?, lease_until = NULL, error = ?, updated_at = ? WHERE id = ? AND status = ?",
+			JobQueued, errMsg, time.Now().UTC().Format(time.RFC3339), id, JobLeased,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to requeue job: %w", err)
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			return ErrJobNotLeased
+		}
+		return nil
+	}
+
+	return s.finish(id, tokenID, JobFailed, nil, errMsg)
+}
+
+func (s *JobStore) finish(id, tokenID int64, status string, result json.RawMessage, errMsg string) error {
+	var resultStr sql.NullString
+	if len(result) > 0 {
+		resultStr = sql.NullString{String: string(result), Valid: true}
+	}
+
+	res, err := s.db.Exec(
+		"UPDATE jobs SET status = ?, lease_until = NULL, result = ?, error = ?, updated_at = ? WHERE id = ? AND token_id = ? AND status = ?",
+		status, resultStr, errMsg, time.Now().UTC().Format(time.RFC3339), id, tokenID, JobLeased,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update job: %w", err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrJobNotLeased
+	}
+	return nil
+}
+
+// Get returns a job by ID, or nil if it does not exist
+func (s *JobStore) Get(id int64) (*models.Job, error) {
+	row := s.db.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id)
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+	return job, nil
+}
+
+func scanJob(row *sql.Row) (*models.Job, error) {
+	var j models.Job
+	var payload string
+	var leaseUntil, result, errMsg sql.NullString
+	var createdAt, updatedAt string
+
+	err := row.Scan(&j.ID, &j.TokenID, &j.CreatedBy, &j.Queue, &payload, &j.Status, &j.Attempts, &j.MaxAttempts,
+		&leaseUntil, &result, &errMsg, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	j.Payload = json.RawMessage(payload)
+	if leaseUntil.Valid {
+		parsed, _ := time.Parse(time.RFC3339, leaseUntil.String)
+		j.LeaseUntil = &parsed
+	}
+	if result.Valid {
+		j.Result = json.RawMessage(result.String)
+	}
+	j.Error = errMsg.String
+	j.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	j.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+
+	return &j, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// MacroStore handles stored macros, which belong to a token
+type MacroStore struct {
+	db *database.DB
+}
+
+// NewMacroStore creates a new MacroStore
+func NewMacroStore(db *database.DB) *MacroStore {
+	return &MacroStore{db: db}
+}
+
+const macroColumns = "id, name, description, params, steps, created_at, updated_at"
+
+// List returns a token's macros by name
+func (s *MacroStore) List(tokenID int64) ([]*models.Macro, error) {
+	rows, err := s.db.Query("SELECT "+macroColumns+" FROM macros WHERE token_id = ? ORDER BY name", tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query macros: %w", err)
+	}
+	defer rows.Close()
+
+	macros := []*models.Macro{}
+	for rows.Next() {
+		m, err := scanMacro(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan macro: %w", err)
+		}
+		macros = append(macros, m)
+	}
+	return macros, rows.Err()
+}
+
+// Get returns a token's macro by name, or nil if it has none by that name
+func (s *MacroStore) Get(tokenID int64, name string) (*models.Macro, error) {
+	row := s.db.QueryRow("SELECT "+macroColumns+" FROM macros WHERE token_id = ? AND name = ?", tokenID, name)
+	m, err := scanMacro(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query macro: %w", err)
+	}
+	return m, nil
+}
+
+// Save stores a macro for a token, replacing one of the same name, and
+// reports whether it is new
+func (s *MacroStore) Save(tokenID int64, req *models.MacroRequest) (*models.Macro, bool, error) {
+	params := req.Params
+	if params == nil {
+		params = []models.MacroParam{}
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, false, err
+	}
+	stepsJSON, err := json.Marshal(req.Steps)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	row := s.db.QueryRow(
+		`INSERT INTO macros (token_id, name, description, params, steps, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token_id, name) DO UPDATE SET description = excluded.description, params = excluded.params,
+		steps = excluded.steps, updated_at = excluded.updated_at
+		RETURNING `+macroColumns,
+		tokenID, req.Name, req.Description, string(paramsJSON), string(stepsJSON), now, now,
+	)
+	m, err := scanMacro(row)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save macro: %w", err)
+	}
+	return m, m.CreatedAt.Equal(m.UpdatedAt), nil
+}
+
+// Delete removes a token's macro
+func (s *MacroStore) Delete(tokenID int64, name string) error {
+	result, err := s.db.Exec("DELETE FROM macros WHERE token_id = ? AND name = ?", tokenID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete macro: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanMacro(row interface{ Scan(...any) error }) (*models.Macro, error) {
+	var m models.Macro
+	var params, steps, createdAt, updatedAt string
+	if err := row.Scan(&m.ID, &m.Name, &m.Description, &params, &steps, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &m.Params); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(steps), &m.Steps); err != nil {
+		return nil, err
+	}
+	m.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	m.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+	return &m, nil
+}
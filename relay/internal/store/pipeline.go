@@ -0,0 +1,107 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// PipelineStore handles stored pipelines, which belong to a token
+type PipelineStore struct {
+	db *database.DB
+}
+
+// NewPipelineStore creates a new PipelineStore
+func NewPipelineStore(db *database.DB) *PipelineStore {
+	return &PipelineStore{db: db}
+}
+
+const pipelineColumns = "id, name, description, steps, created_at, updated_at"
+
+// List returns a token's pipelines by name
+func (s *PipelineStore) List(tokenID int64) ([]*models.Pipeline, error) {
+	rows, err := s.db.Query("SELECT "+pipelineColumns+" FROM pipelines WHERE token_id = ? ORDER BY name", tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pipelines: %w", err)
+	}
+	defer rows.Close()
+
+	pipelines := []*models.Pipeline{}
+	for rows.Next() {
+		p, err := scanPipeline(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan pipeline: %w", err)
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, rows.Err()
+}
+
+// Get returns a token's pipeline by name, or nil if it has none by that name
+func (s *PipelineStore) Get(tokenID int64, name string) (*models.Pipeline, error) {
+	row := s.db.QueryRow("SELECT "+pipelineColumns+" FROM pipelines WHERE token_id = ? AND name = ?", tokenID, name)
+	p, err := scanPipeline(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pipeline: %w", err)
+	}
+	return p, nil
+}
+
+// Save stores a pipeline for a token, replacing one of the same name, and
+// reports whether it is new
+func (s *PipelineStore) Save(tokenID int64, req *models.PipelineRequest) (*models.Pipeline, bool, error) {
+	stepsJSON, err := json.Marshal(req.Steps)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	row := s.db.QueryRow(
+		`INSERT INTO pipelines (token_id, name, description, steps, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token_id, name) DO UPDATE SET description = excluded.description,
+		steps = excluded.steps, updated_at = excluded.updated_at
+		RETURNING `+pipelineColumns,
+		tokenID, req.Name, req.Description, string(stepsJSON), now, now,
+	)
+	p, err := scanPipeline(row)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save pipeline: %w", err)
+	}
+	return p, p.CreatedAt.Equal(p.UpdatedAt), nil
+}
+
+// Delete removes a token's pipeline
+func (s *PipelineStore) Delete(tokenID int64, name string) error {
+	result, err := s.db.Exec("DELETE FROM pipelines WHERE token_id = ? AND name = ?", tokenID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete pipeline: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanPipeline(row interface{ Scan(...any) error }) (*models.Pipeline, error) {
+	var p models.Pipeline
+	var steps, createdAt, updatedAt string
+	if err := row.Scan(&p.ID, &p.Name, &p.Description, &steps, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(steps), &p.Steps); err != nil {
+		return nil, err
+	}
+	p.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	p.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+	return &p, nil
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// PolicyStore handles per-token URL policy rules
+type PolicyStore struct {
+	db *database.DB
+}
+
+// NewPolicyStore creates a new PolicyStore
+func NewPolicyStore(db *database.DB) *PolicyStore {
+	return &PolicyStore{db: db}
+}
+
+// List returns all rules for a token
+func (s *PolicyStore) List(tokenID int64) ([]*models.URLRule, error) {
+	rows, err := s.db.Query(
+		"SELECT id, token_id, effect, pattern, created_at FROM url_policies WHERE token_id = ? ORDER BY id",
+		tokenID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query policies: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []*models.URLRule{}
+	for rows.Next() {
+		var r models.URLRule
+		var createdAt string
+		if err := rows.Scan(&r.ID, &r.TokenID, &r.Effect, &r.Pattern, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan policy: %w", err)
+		}
+		r.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		rules = append(rules, &r)
+	}
+
+	return rules, rows.Err()
+}
+
+// Add creates a rule for a token
+func (s *PolicyStore) Add(tokenID int64, effect, pattern string) (*models.URLRule, error) {
+	if effect != models.PolicyAllow && effect != models.PolicyDeny {
+		return nil, fmt.Errorf("effect must be %q or %q", models.PolicyAllow, models.PolicyDeny)
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("pattern is required")
+	}
+
+	now := time.Now().UTC()
+	r := &models.URLRule{TokenID: tokenID, Effect: effect, Pattern: pattern, CreatedAt: now.Truncate(time.Second)}
+
+	err := s.db.QueryRow(
+		"INSERT INTO url_policies (token_id, effect, pattern, created_at) VALUES (?, ?, ?, ?) RETURNING id",
+		tokenID, effect, pattern, now.Format(time.RFC3339),
+	).Scan(&r.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert policy: %w", err)
+	}
+
+	return r, nil
+}
+
+// Delete removes a rule belonging to a token
+func (s *PolicyStore) Delete(tokenID, id int64) error {
+	result, err := s.db.Exec("DELETE FROM url_policies WHERE id = ? AND token_id = ?", id, tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to delete policy: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
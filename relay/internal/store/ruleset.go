@@ -0,0 +1,108 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// RuleSetStore handles stored request rule sets, which belong to a token
+type RuleSetStore struct {
+	db *database.DB
+}
+
+// NewRuleSetStore creates a new RuleSetStore
+func NewRuleSetStore(db *database.DB) *RuleSetStore {
+	return &RuleSetStore{db: db}
+}
+
+const ruleSetColumns = "id, name, description, rules, created_at, updated_at"
+
+// List returns a token's rule sets by name
+func (s *RuleSetStore) List(tokenID int64) ([]*models.RuleSet, error) {
+	rows, err := s.db.Query("SELECT "+ruleSetColumns+" FROM rule_sets WHERE token_id = ? ORDER BY name", tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rule sets: %w", err)
+	}
+	defer rows.Close()
+
+	sets := []*models.RuleSet{}
+	for rows.Next() {
+		rs, err := scanRuleSet(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rule set: %w", err)
+		}
+		sets = append(sets, rs)
+	}
+	return sets, rows.Err()
+}
+
+// Get returns a token's rule set by name, or nil if it has none by that
+// name
+func (s *RuleSetStore) Get(tokenID int64, name string) (*models.RuleSet, error) {
+	row := s.db.QueryRow("SELECT "+ruleSetColumns+" FROM rule_sets WHERE token_id = ? AND name = ?", tokenID, name)
+	rs, err := scanRuleSet(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query rule set: %w", err)
+	}
+	return rs, nil
+}
+
+// Save stores a rule set for a token, replacing one of the same name, and
+// reports whether it is new
+func (s *RuleSetStore) Save(tokenID int64, req *models.RuleSetRequest) (*models.RuleSet, bool, error) {
+	rulesJSON, err := json.Marshal(req.Rules)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	row := s.db.QueryRow(
+		`INSERT INTO rule_sets (token_id, name, description, rules, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token_id, name) DO UPDATE SET description = excluded.description, rules = excluded.rules,
+		updated_at = excluded.updated_at
+		RETURNING `+ruleSetColumns,
+		tokenID, req.Name, req.Description, string(rulesJSON), now, now,
+	)
+	rs, err := scanRuleSet(row)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save rule set: %w", err)
+	}
+	return rs, rs.CreatedAt.Equal(rs.UpdatedAt), nil
+}
+
+// Delete removes a token's rule set
+func (s *RuleSetStore) Delete(tokenID int64, name string) error {
+	result, err := s.db.Exec("DELETE FROM rule_sets WHERE token_id = ? AND name = ?", tokenID, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete rule set: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func scanRuleSet(row interface{ Scan(...any) error }) (*models.RuleSet, error) {
+	var rs models.RuleSet
+	var rules, createdAt, updatedAt string
+	if err := row.Scan(&rs.ID, &rs.Name, &rs.Description, &rules, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(rules), &rs.Rules); err != nil {
+		return nil, err
+	}
+	rs.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	rs.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+	return &rs, nil
+}
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ScheduleStore handles cron schedules, which belong to a token, and the
+// history of their runs
+type ScheduleStore struct {
+	db *database.DB
+}
+
+// NewScheduleStore creates a new ScheduleStore
+func NewScheduleStore(db *database.DB) *ScheduleStore {
+	return &ScheduleStore{db: db}
+}
+
+const scheduleColumns = "id, token_id, name, description, cron, timezone, job, paused, next_run_at, created_at, updated_at"
+
+const scheduleRunColumns = "id, schedule_id, status, tab_id, error_code, error_message, result, screenshot_id, started_at, finished_at"
+
+// List returns a token's schedules by name
+func (s *ScheduleStore) List(tokenID int64) ([]*models.Schedule, error) {
+	rows, err := s.db.Query("SELECT "+scheduleColumns+" FROM schedules WHERE token_id = ? ORDER BY name", tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedules: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := []*models.Schedule{}
+	for rows.Next() {
+		sched, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, sched)
+	}
+	return schedules, rows.Err()
+}
+
+// Get returns a token's schedule by name, or nil if it has none by that
+// name
+func (s *ScheduleStore) Get(tokenID int64, name string) (*models.Schedule, error) {
+	row := s.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE token_id = ? AND name = ?", tokenID, name)
+	sched, err := scanSchedule(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedule: %w", err)
+	}
+	return sched, nil
+}
+
+// Count returns how many schedules a token has
+func (s *ScheduleStore) Count(tokenID int64) (int, error) {
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM schedules WHERE token_id = ?", tokenID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count schedules: %w", err)
+	}
+	return n, nil
+}
+
+// Save stores a schedule for a token, replacing one of the same name, to
+// fire next at nextRunAt, and reports whether it is new
+func (s *ScheduleStore) Save(tokenID int64, req *models.ScheduleRequest, nextRunAt *time.Time) (*models.Schedule, bool, error) {
+	jobJSON, err := json.Marshal(req.ScheduleJob)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	row := s.db.QueryRow(
+		`INSERT INTO schedules (token_id, name, description, cron, timezone, job, paused, next_run_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (token_id, name) DO UPDATE SET description = excluded.description, cron = excluded.cron,
+		timezone = excluded.timezone, job = excluded.job, paused = excluded.paused, next_run_at = excluded.next_run_at,
+		updated_at = excluded.updated_at
+		RETURNING `+scheduleColumns,
+		tokenID, req.Name, req.Description, req.Cron, req.Timezone, string(jobJSON), boolInt(req.Paused),
+		formatRunAt(nextRunAt), now, now,
+	)
+	sched, err := scanSchedule(row)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return sched, sched.CreatedAt.Equal(sched.UpdatedAt), nil
+}
+
+// Delete removes a token's schedule and its run history
+func (s *ScheduleStore) Delete(tokenID int64, name string) error {
+	sched, err := s.Get(tokenID, name)
+	if err != nil {
+		return err
+	}
+	if sched == nil {
+		return sql.ErrNoRows
+	}
+	if _, err := s.db.Exec("DELETE FROM schedules WHERE id = ?", sched.ID); err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM schedule_runs WHERE schedule_id = ?", sched.ID); err != nil {
+		return fmt.Errorf("failed to delete schedule runs: %w", err)
+	}
+	return nil
+}
+
+// Due returns up to limit schedules that were to fire by t, soonest first
+func (s *ScheduleStore) Due(t time.Time, limit int) ([]*models.Schedule, error) {
+	rows, err := s.db.Query(
+		"SELECT "+scheduleColumns+" FROM schedules WHERE next_run_at IS NOT NULL AND next_run_at <= ? ORDER BY next_run_at LIMIT ?",
+		formatRunAt(&t), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query due schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []*models.Schedule
+	for rows.Next() {
+		sched, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, sched)
+	}
+	return schedules, rows.Err()
+}
+
+// Claim moves a due schedule on to its next run, and reports whether this
+// caller did so. Relays sharing the database race for each run; only the
+// one whose update still sees the old time runs it.
+func (s *ScheduleStore) Claim(sched *models.Schedule, next *time.Time) (bool, error) {
+	result, err := s.db.Exec(
+		"UPDATE schedules SET next_run_at = ? WHERE id = ? AND next_run_at = ?",
+		formatRunAt(next), sched.ID, formatRunAt(sched.NextRunAt),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim schedule: %w", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1, nil
+}
+
+// StartRun records a run of a schedule in the given status
+func (s *ScheduleStore) StartRun(scheduleID int64, status string, startedAt time.Time) (*models.ScheduleRun, error) {
+	row := s.db.QueryRow(
+		"INSERT INTO schedule_runs (schedule_id, status, started_at) VALUES (?, ?, ?) RETURNING "+scheduleRunColumns,
+		scheduleID, status, startedAt.UTC().Format(time.RFC3339Nano),
+	)
+	run, err := scanScheduleRun(row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record schedule run: %w", err)
+	}
+	return run, nil
+}
+
+// FinishRun records how a run ended
+func (s *ScheduleStore) FinishRun(run *models.ScheduleRun) error {
+	var code, message, result sql.NullString
+	if run.Error != nil {
+		code = sql.NullString{String: run.Error.Code, Valid: true}
+		message = sql.NullString{String: run.Error.Message, Valid: true}
+	}
+	if len(run.Result) > 0 {
+		result = sql.NullString{String: string(run.Result), Valid: true}
+	}
+	finishedAt := time.Now().UTC()
+	if run.FinishedAt != nil {
+		finishedAt = run.FinishedAt.UTC()
+	}
+
+	_, err := s.db.Exec(
+		`UPDATE schedule_runs SET status = ?, tab_id = ?, error_code = ?, error_message = ?, result = ?,
+		screenshot_id = ?, finished_at = ? WHERE id = ?`,
+		run.Status, run.TabID, code, message, result, run.ScreenshotID, finishedAt.Format(time.RFC3339Nano), run.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to finish schedule run: %w", err)
+	}
+	return nil
+}
+
+// Runs returns a schedule's newest runs, up to limit
+func (s *ScheduleStore) Runs(scheduleID int64, limit int) ([]*models.ScheduleRun, error) {
+	rows, err := s.db.Query(
+		"SELECT "+scheduleRunColumns+" FROM schedule_runs WHERE schedule_id = ? ORDER BY id DESC LIMIT ?",
+		scheduleID, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schedule runs: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []*models.ScheduleRun{}
+	for rows.Next() {
+		run, err := scanScheduleRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan schedule run: %w", err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// PruneRuns drops all but a schedule's newest keep runs
+func (s *ScheduleStore) PruneRuns(scheduleID int64, keep int) (int64, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM schedule_runs WHERE schedule_id = ? AND id NOT IN
+		(SELECT id FROM schedule_runs WHERE schedule_id = ? ORDER BY id DESC LIMIT ?)`,
+		scheduleID, scheduleID, keep,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune schedule runs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// AbandonRuns fails the runs started before t that never finished, left
+// behind by a relay that stopped mid-run
+func (s *ScheduleStore) AbandonRuns(t time.Time) (int64, error) {
+	result, err := s.db.Exec(
+		`UPDATE schedule_runs SET status = ?, error_code = ?, error_message = ?, finished_at = ?
+		WHERE status = ? AND started_at < ?`,
+		models.RunFailed, "INTERRUPTED", "The relay stopped before the run finished",
+		time.Now().UTC().Format(time.RFC3339Nano), models.RunRunning, t.UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to abandon schedule runs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func scanSchedule(row interface{ Scan(...any) error }) (*models.Schedule, error) {
+	var sched models.Schedule
+	var job, createdAt, updatedAt string
+	var paused int
+	var nextRunAt sql.NullString
+	if err := row.Scan(&sched.ID, &sched.TokenID, &sched.Name, &sched.Description, &sched.Cron, &sched.Timezone,
+		&job, &paused, &nextRunAt, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(job), &sched.ScheduleJob); err != nil {
+		return nil, err
+	}
+	sched.Paused = paused != 0
+	if nextRunAt.Valid {
+		t, _ := time.Parse(time.RFC3339, nextRunAt.String)
+		sched.NextRunAt = &t
+	}
+	sched.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+	sched.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+	return &sched, nil
+}
+
+func scanScheduleRun(row interface{ Scan(...any) error }) (*models.ScheduleRun, error) {
+	var run models.ScheduleRun
+	var code, message, result, finishedAt sql.NullString
+	var startedAt string
+	if err := row.Scan(&run.ID, &run.ScheduleID, &run.Status, &run.TabID, &code, &message, &result,
+		&run.ScreenshotID, &startedAt, &finishedAt); err != nil {
+		return nil, err
+	}
+	if code.Valid {
+		run.Error = &models.CommandError{Code: code.String, Message: message.String}
+	}
+	if result.Valid {
+		run.Result = json.RawMessage(result.String)
+	}
+	run.StartedAt, _ = time.Parse(time.RFC3339Nano, startedAt)
+	if finishedAt.Valid {
+		t, _ := time.Parse(time.RFC3339Nano, finishedAt.String)
+		run.FinishedAt = &t
+	}
+	return &run, nil
+}
+
+// formatRunAt stores run times to the second, so they compare as text
+func formatRunAt(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(time.RFC3339), Valid: true}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
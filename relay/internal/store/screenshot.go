@@ -0,0 +1,179 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// ScreenshotStore handles screenshot records
+type ScreenshotStore struct {
+	db *database.DB
+}
+
+// NewScreenshotStore creates a new ScreenshotStore
+func NewScreenshotStore(db *database.DB) *ScreenshotStore {
+	return &ScreenshotStore{db: db}
+}
+
+// ScreenshotFilter narrows List. Zero fields match everything.
+type ScreenshotFilter struct {
+	TabID     string
+	CommandID string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+const screenshotColumns = "id, token_id, tab_id, command_id, format, width, height, size, hash, created_at, expires_at"
+
+// Create stores a screenshot record
+func (s *ScreenshotStore) Create(shot *models.Screenshot) error {
+	_, err := s.db.Exec(
+		"INSERT INTO screenshots ("+screenshotColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		shot.ID, shot.TokenID, shot.TabID, shot.CommandID, shot.Format, shot.Width, shot.Height, shot.Size, shot.Hash,
+		shot.CreatedAt.UTC().Format(time.RFC3339), shot.ExpiresAt.UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert screenshot: %w", err)
+	}
+	return nil
+}
+
+// List returns a token's screenshots, newest first
+func (s *ScreenshotStore) List(tokenID int64, f ScreenshotFilter) ([]*models.Screenshot, error) {
+	query := "SELECT " + screenshotColumns + " FROM screenshots WHERE token_id = ?"
+	args := []any{tokenID}
+	if f.TabID != "" {
+		query += " AND tab_id = ?"
+		args = append(args, f.TabID)
+	}
+	if f.CommandID != "" {
+		query += " AND command_id = ?"
+		args = append(args, f.CommandID)
+	}
+	if !f.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, f.Since.UTC().Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, f.Until.UTC().Format(time.RFC3339))
+	}
+	query += " ORDER BY created_at DESC, id LIMIT ?"
+	args = append(args, f.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query screenshots: %w", err)
+	}
+	defer rows.Close()
+
+	shots := []*models.Screenshot{}
+	for rows.Next() {
+		shot, err := scanScreenshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan screenshot: %w", err)
+		}
+		shots = append(shots, shot)
+	}
+
+	return shots, rows.Err()
+}
+
+// Get returns a screenshot by ID, or nil if there is none
+func (s *ScreenshotStore) Get(id string) (*models.Screenshot, error) {
+	shot, err := scanScreenshot(s.db.QueryRow("SELECT "+screenshotColumns+" FROM screenshots WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query screenshot: %w", err)
+	}
+	return shot, nil
+}
+
+func scanScreenshot(row interface{ Scan(...any) error }) (*models.Screenshot, error) {
+	var shot models.Screenshot
+	var createdAt, expiresAt string
+	if err := row.Scan(&shot.ID, &shot.TokenID, &shot.TabID, &shot.CommandID, &shot.Format,
+		&shot.Width, &shot.Height, &shot.Size, &shot.Hash, &createdAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	shot.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	shot.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	return &shot, nil
+}
+
+// Retained returns up to limit screenshots whose file is still referenced,
+// oldest first. With a non-zero before, only those expiring by then.
+func (s *ScreenshotStore) Retained(before time.Time, limit int) ([]*models.Screenshot, error) {
+	query := "SELECT " + screenshotColumns + " FROM screenshots WHERE released_at IS NULL"
+	var args []any
+	if !before.IsZero() {
+		query += " AND expires_at <= ?"
+		args = append(args, before.UTC().Format(time.RFC3339))
+	}
+	query += " ORDER BY created_at, id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query retained screenshots: %w", err)
+	}
+	defer rows.Close()
+
+	var shots []*models.Screenshot
+	for rows.Next() {
+		shot, err := scanScreenshot(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan screenshot: %w", err)
+		}
+		shots = append(shots, shot)
+	}
+	return shots, rows.Err()
+}
+
+// MarkReleased records that a screenshot's file reference was dropped at
+// t, ending its URL then if it had not expired yet. It reports false when
+// the screenshot was already released.
+func (s *ScreenshotStore) MarkReleased(id string, t time.Time) (bool, error) {
+	at := t.UTC().Format(time.RFC3339)
+	result, err := s.db.Exec(
+		`UPDATE screenshots SET released_at = ?, expires_at = CASE WHEN expires_at > ? THEN ? ELSE expires_at END
+		WHERE id = ? AND released_at IS NULL`,
+		at, at, at, id,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to release screenshot: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseExpired marks every screenshot expired by t as released, without
+// touching blob references. Used at startup, before the references are
+// recounted from the screenshots still retained.
+func (s *ScreenshotStore) ReleaseExpired(t time.Time) (int64, error) {
+	at := t.UTC().Format(time.RFC3339)
+	result, err := s.db.Exec(
+		"UPDATE screenshots SET released_at = ? WHERE released_at IS NULL AND expires_at <= ?", at, at)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release screenshots: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// DeleteBefore removes released records created before t. Records still
+// holding a file reference are kept until the retention sweeper drops it.
+func (s *ScreenshotStore) DeleteBefore(t time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM screenshots WHERE created_at < ? AND released_at IS NOT NULL", t.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete screenshots: %w", err)
+	}
+	return result.RowsAffected()
+}
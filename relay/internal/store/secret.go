@@ -0,0 +1,145 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Token secrets are stored as argon2id hashes of their SHA-256, so rows
+// written before argon2id was used could be converted without knowing the
+// secret. Each row also keeps a short prefix of its secret, which narrows
+// validation to the one row worth hashing against.
+
+// argon2id parameters: the OWASP minimum, about 20ms per verification
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024 // KiB
+	argonThreads = 1
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// secretPrefixLen is how much of a secret after "owl_" is stored in the
+// clear for lookup: 32 of its 192 random bits
+const secretPrefixLen = 8
+
+// argonPrefix starts every argon2id hash in PHC string format
+const argonPrefix = "$argon2id$"
+
+// legacyPrefix is the lookup prefix UpgradeSecrets gives a converted row,
+// which only ever held the secret's SHA-256 hex digest: the start of that
+// digest, marked so it cannot be mistaken for a secret prefix. It keeps
+// invalid secrets from being hashed against every converted row. Validate
+// replaces it with the secret prefix once the secret is presented.
+func legacyPrefix(digest string) string {
+	if len(digest) < secretPrefixLen {
+		return "sha256:" + digest
+	}
+	return "sha256:" + digest[:secretPrefixLen]
+}
+
+// secretPrefix returns the lookup prefix of a secret
+func secretPrefix(token string) string {
+	rest := strings.TrimPrefix(token, "owl_")
+	if len(rest) < secretPrefixLen {
+		return rest
+	}
+	return rest[:secretPrefixLen]
+}
+
+// hashSecret returns the stored form of a secret
+func hashSecret(token string) (string, error) {
+	return argonHash(HashToken(token))
+}
+
+// argonHash hashes a secret's SHA-256 hex digest with a fresh salt
+func argonHash(digest string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(digest), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argonPrefix, argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkSecret reports whether a secret's SHA-256 hex digest matches a
+// stored hash. Rows not yet converted hold the bare digest.
+func checkSecret(digest, stored string) bool {
+	if !strings.HasPrefix(stored, argonPrefix) {
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(stored)) == 1
+	}
+
+	var version, memory, time int
+	var threads uint8
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(digest), salt, uint32(time), uint32(memory), threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// newIdentity returns a random token identity. Identities used to be the
+// SHA-256 of the first secret; they are no longer derived from it.
+func newIdentity() (string, error) {
+	b := make([]byte, sha256.Size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// maxVerified bounds the verified secret cache; it is emptied when full
+const maxVerified = 10000
+
+// verifiedSecrets remembers which stored hash each recently presented
+// secret matched, keyed by the secret's SHA-256, so only the first request
+// with a secret pays for argon2id. A rotation or revocation changes or
+// removes the stored hash, so stale entries never match.
+type verifiedSecrets struct {
+	mu      sync.Mutex
+	matched map[string]string // digest → stored hash
+}
+
+func (v *verifiedSecrets) check(digest, stored string) bool {
+	v.mu.Lock()
+	hit := v.matched[digest] == stored
+	v.mu.Unlock()
+	if hit {
+		return true
+	}
+	if !checkSecret(digest, stored) {
+		return false
+	}
+
+	v.mu.Lock()
+	if v.matched == nil || len(v.matched) >= maxVerified {
+		v.matched = make(map[string]string)
+	}
+	v.matched[digest] = stored
+	v.mu.Unlock()
+	return true
+}
@@ -0,0 +1,133 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// SessionStore keeps the history of extension sessions: when each
+// connected, when and why it disconnected
+type SessionStore struct {
+	db *database.DB
+}
+
+// NewSessionStore creates a new SessionStore
+func NewSessionStore(db *database.DB) *SessionStore {
+	return &SessionStore{db: db}
+}
+
+const sessionColumns = `id, token_hash, token_name, name, extension_version, install_id, node,
+	connected_at, last_seen_at, disconnected_at, reason, close_code`
+
+// Open records a session that just connected
+func (s *SessionStore) Open(session *models.Session) error {
+	now := formatTime(session.ConnectedAt)
+	_, err := s.db.Exec(
+		`INSERT INTO sessions (id, token_hash, token_name, node, connected_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		session.ID, session.TokenHash, session.TokenName, session.Node, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record session: %w", err)
+	}
+	return nil
+}
+
+// Identify records what a session's connect message said about it
+func (s *SessionStore) Identify(session *models.Session) error {
+	name, extensionVer, client := session.Info()
+	var installID string
+	if client != nil {
+		installID = client.InstallID
+	}
+	_, err := s.db.Exec("UPDATE sessions SET name = ?, extension_version = ?, install_id = ? WHERE id = ?",
+		name, extensionVer, installID, session.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+// Seen records that a session was still connected at t
+func (s *SessionStore) Seen(id string, t time.Time) error {
+	if _, err := s.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ? AND disconnected_at IS NULL", formatTime(t), id); err != nil {
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+	return nil
+}
+
+// Close records that a session disconnected at t; a session already closed
+// keeps its first reason
+func (s *SessionStore) Close(id, reason string, closeCode int, t time.Time) error {
+	at := formatTime(t)
+	_, err := s.db.Exec(
+		"UPDATE sessions SET disconnected_at = ?, last_seen_at = ?, reason = ?, close_code = ? WHERE id = ? AND disconnected_at IS NULL",
+		at, at, reason, closeCode, id,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to close session: %w", err)
+	}
+	return nil
+}
+
+// CloseStale ends the sessions a relay node left open when it stopped,
+// at the time each was last seen
+func (s *SessionStore) CloseStale(node string) (int64, error) {
+	result, err := s.db.Exec(
+		"UPDATE sessions SET disconnected_at = last_seen_at, reason = ? WHERE node = ? AND disconnected_at IS NULL",
+		models.DisconnectRelayStopped, node,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to close stale sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// Between returns the sessions connected at any time from since to until,
+// newest first
+func (s *SessionStore) Between(since, until time.Time) ([]*models.SessionRecord, error) {
+	rows, err := s.db.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE connected_at < ? AND (disconnected_at IS NULL OR disconnected_at >= ?) ORDER BY connected_at DESC",
+		formatTime(until), formatTime(since),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	records := []*models.SessionRecord{}
+	for rows.Next() {
+		var r models.SessionRecord
+		var connectedAt, lastSeenAt string
+		var disconnectedAt sql.NullString
+		if err := rows.Scan(&r.ID, &r.TokenHash, &r.TokenName, &r.Name, &r.ExtensionVersion, &r.InstallID, &r.Node,
+			&connectedAt, &lastSeenAt, &disconnectedAt, &r.Reason, &r.CloseCode); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		r.ConnectedAt, _ = time.Parse(time.RFC3339, connectedAt)
+		r.LastSeenAt, _ = time.Parse(time.RFC3339, lastSeenAt)
+		if disconnectedAt.Valid {
+			t, _ := time.Parse(time.RFC3339, disconnectedAt.String)
+			r.DisconnectedAt = &t
+		}
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
+
+// DeleteBefore removes sessions that disconnected before t
+func (s *SessionStore) DeleteBefore(t time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE disconnected_at < ?", formatTime(t))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// formatTime formats t so that stored times sort as text
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,49 @@
+package store
+
+import (
+	"context"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+)
+
+// Stores groups all data access layers
+type Stores struct {
+	Tokens      *TokenStore
+	Jobs        *JobStore
+	Policies    *PolicyStore
+	Screenshots *ScreenshotStore
+	Blobs       *BlobStore
+	Macros      *MacroStore
+	RuleSets    *RuleSetStore
+	Pipelines   *PipelineStore
+	Schedules   *ScheduleStore
+	Webhooks    *WebhookStore
+	Sessions    *SessionStore
+
+	db *database.DB
+}
+
+// New creates all stores for a database
+func New(db *database.DB) *Stores {
+	return &Stores{
+		Tokens:      NewTokenStore(db),
+		Jobs:        NewJobStore(db),
+		Policies:    NewPolicyStore(db),
+		Screenshots: NewScreenshotStore(db),
+		Blobs:       NewBlobStore(db),
+		Macros:      NewMacroStore(db),
+		RuleSets:    NewRuleSetStore(db),
+		Pipelines:   NewPipelineStore(db),
+		Schedules:   NewScheduleStore(db),
+		Webhooks:    NewWebhookStore(db),
+		Sessions:    NewSessionStore(db),
+
+		db: db,
+	}
+}
+
+// Ping checks that the database answers a query
+func (s *Stores) Ping(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
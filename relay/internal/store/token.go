@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/emreylmaz/owlrelay/relay/internal/database"
@@ -16,7 +18,8 @@ import (
 
 // TokenStore handles token-related database operations
 type TokenStore struct {
-	db *database.DB
+	db       *database.DB
+	verified verifiedSecrets
 }
 
 // NewTokenStore creates a new TokenStore
@@ -39,18 +42,35 @@ func HashToken(token string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-// Create stores a new token in the database
-func (s *TokenStore) Create(name string, rateLimit int) (string, error) {
+// Create stores a new token in the database. Nil scopes grants DefaultScopes.
+// A rateBurst of 0 lets the token burst up to rateLimit.
+func (s *TokenStore) Create(name string, rateLimit, rateBurst, rateDebt int, scopes []string) (string, error) {
+	if scopes == nil {
+		scopes = models.DefaultScopes
+	}
+	for _, scope := range scopes {
+		if !models.IsValidScope(scope) {
+			return "", fmt.Errorf("unknown scope: %s", scope)
+		}
+	}
+
 	token, err := GenerateToken()
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
 
-	hash := HashToken(token)
+	identity, err := newIdentity()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	secretHash, err := hashSecret(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash token: %w", err)
+	}
 
 	_, err = s.db.Exec(
-		"INSERT INTO tokens (hash, name, rate_limit, created_at) VALUES (?, ?, ?, ?)",
-		hash, name, rateLimit, time.Now().UTC().Format(time.RFC3339),
+		"INSERT INTO tokens (hash, secret_hash, secret_prefix, name, rate_limit, rate_burst, rate_debt, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		identity, secretHash, secretPrefix(token), name, rateLimit, rateBurst, rateDebt, strings.Join(scopes, ","), time.Now().UTC().Format(time.RFC3339),
 	)
 	if err != nil {
 		return "", fmt.Errorf("failed to insert token: %w", err)
@@ -59,17 +79,105 @@ func (s *TokenStore) Create(name string, rateLimit int) (string, error) {
 	return token, nil
 }
 
-// Validate checks if a token is valid and returns its metadata
+// Validate checks if a token is valid and returns its metadata. A secret
+// replaced by Rotate stays valid until its grace period ends. The returned
+// Hash identifies the token whichever of its secrets was presented.
 func (s *TokenStore) Validate(token string) (*models.Token, error) {
-	hash := HashToken(token)
+	prefix := secretPrefix(token)
+	digest := HashToken(token)
+	// Rows converted by UpgradeSecrets carry the legacy prefix until their
+	// secret is next presented
+	legacy := legacyPrefix(digest)
+	rows, err := s.db.Query(
+		"SELECT id, secret_hash, secret_prefix, previous_hash, previous_prefix, previous_expires_at FROM tokens WHERE revoked_at IS NULL AND (secret_prefix IN (?, ?) OR (previous_prefix IN (?, ?) AND previous_expires_at > ?))",
+		prefix, legacy, prefix, legacy, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token: %w", err)
+	}
+	type candidate struct {
+		id                           int64
+		secretHash                   string
+		secretPrefix                 sql.NullString
+		previousHash, previousPrefix sql.NullString
+		previousExpiresAt            sql.NullString
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.secretHash, &c.secretPrefix, &c.previousHash, &c.previousPrefix, &c.previousExpiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query token: %w", err)
+	}
+
+	matches := func(p sql.NullString) bool { return p.Valid && (p.String == prefix || p.String == legacy) }
+	for _, c := range candidates {
+		switch {
+		case matches(c.secretPrefix) && s.verified.check(digest, c.secretHash):
+			if c.secretPrefix.String != prefix {
+				if _, err := s.db.Exec("UPDATE tokens SET secret_prefix = ? WHERE id = ?", prefix, c.id); err != nil {
+					return nil, fmt.Errorf("failed to update token: %w", err)
+				}
+			}
+		case c.previousHash.Valid && matches(c.previousPrefix) && activeGrace(c.previousExpiresAt) != nil &&
+			s.verified.check(digest, c.previousHash.String):
+		default:
+			continue
+		}
+		return s.active("id = ?", c.id)
+	}
+	return nil, nil
+}
+
+// ByName returns the newest unrevoked token with the given name, or nil,
+// for callers that authenticated some other way and act as that token
+func (s *TokenStore) ByName(name string) (*models.Token, error) {
+	return s.active("name = ? AND revoked_at IS NULL ORDER BY created_at DESC, id DESC LIMIT 1", name)
+}
+
+// ByID returns the token with the given ID, or nil if there is none or it
+// is revoked, for work the relay does on a token's behalf. Unlike a
+// presented secret it does not mark the token used.
+func (s *TokenStore) ByID(id int64) (*models.Token, error) {
+	return s.lookup("id = ?", id)
+}
+
+// active returns the token matching where, or nil if there is none or it
+// is revoked, and marks it used
+func (s *TokenStore) active(where string, args ...any) (*models.Token, error) {
+	t, err := s.lookup(where, args...)
+	if t == nil || err != nil {
+		return nil, err
+	}
+
+	// Update last used
+	go func() {
+		_, _ = s.db.Exec(
+			"UPDATE tokens SET last_used_at = ? WHERE id = ?",
+			time.Now().UTC().Format(time.RFC3339), t.ID,
+		)
+	}()
 
+	return t, nil
+}
+
+// lookup returns the token matching where, or nil if there is none or it
+// is revoked
+func (s *TokenStore) lookup(where string, args ...any) (*models.Token, error) {
 	var t models.Token
-	var createdAt, lastUsedAt, revokedAt sql.NullString
+	var scopes, defaults, features string
+	var createdAt, lastUsedAt, revokedAt, previousExpiresAt sql.NullString
 
 	err := s.db.QueryRow(
-		"SELECT id, hash, name, rate_limit, created_at, last_used_at, revoked_at FROM tokens WHERE hash = ?",
-		hash,
-	).Scan(&t.ID, &t.Hash, &t.Name, &t.RateLimit, &createdAt, &lastUsedAt, &revokedAt)
+		"SELECT id, hash, name, rate_limit, rate_burst, rate_debt, scopes, defaults, features, created_at, last_used_at, revoked_at, previous_expires_at FROM tokens WHERE "+where,
+		args...,
+	).Scan(&t.ID, &t.Hash, &t.Name, &t.RateLimit, &t.RateBurst, &t.RateDebt, &scopes, &defaults, &features, &createdAt, &lastUsedAt, &revokedAt, &previousExpiresAt)
 
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil // Token not found
@@ -83,6 +191,10 @@ func (s *TokenStore) Validate(token string) (*models.Token, error) {
 		return nil, nil // Token is revoked
 	}
 
+	t.Scopes = parseScopes(scopes)
+	t.Defaults = parseDefaults(defaults)
+	t.Features = parseFeatures(features)
+
 	// Parse timestamps
 	if createdAt.Valid {
 		t.CreatedAt, _ = time.Parse(time.RFC3339, createdAt.String)
@@ -91,14 +203,7 @@ func (s *TokenStore) Validate(token string) (*models.Token, error) {
 		parsed, _ := time.Parse(time.RFC3339, lastUsedAt.String)
 		t.LastUsedAt = &parsed
 	}
-
-	// Update last used
-	go func() {
-		_, _ = s.db.Exec(
-			"UPDATE tokens SET last_used_at = ? WHERE id = ?",
-			time.Now().UTC().Format(time.RFC3339), t.ID,
-		)
-	}()
+	t.PreviousExpiresAt = activeGrace(previousExpiresAt)
 
 	return &t, nil
 }
@@ -106,7 +211,7 @@ func (s *TokenStore) Validate(token string) (*models.Token, error) {
 // List returns all tokens (without hashes)
 func (s *TokenStore) List() ([]*models.Token, error) {
 	rows, err := s.db.Query(
-		"SELECT id, name, rate_limit, created_at, last_used_at, revoked_at FROM tokens ORDER BY created_at DESC",
+		"SELECT id, name, rate_limit, rate_burst, rate_debt, scopes, defaults, features, created_at, last_used_at, revoked_at, previous_expires_at FROM tokens ORDER BY created_at DESC",
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query tokens: %w", err)
@@ -116,12 +221,17 @@ func (s *TokenStore) List() ([]*models.Token, error) {
 	var tokens []*models.Token
 	for rows.Next() {
 		var t models.Token
-		var createdAt, lastUsedAt, revokedAt sql.NullString
+		var scopes, defaults, features string
+		var createdAt, lastUsedAt, revokedAt, previousExpiresAt sql.NullString
 
-		if err := rows.Scan(&t.ID, &t.Name, &t.RateLimit, &createdAt, &lastUsedAt, &revokedAt); err != nil {
+		if err := rows.Scan(&t.ID, &t.Name, &t.RateLimit, &t.RateBurst, &t.RateDebt, &scopes, &defaults, &features, &createdAt, &lastUsedAt, &revokedAt, &previousExpiresAt); err != nil {
 			return nil, fmt.Errorf("failed to scan token: %w", err)
 		}
 
+		t.Scopes = parseScopes(scopes)
+		t.Defaults = parseDefaults(defaults)
+		t.Features = parseFeatures(features)
+
 		if createdAt.Valid {
 			t.CreatedAt, _ = time.Parse(time.RFC3339, createdAt.String)
 		}
@@ -133,6 +243,7 @@ func (s *TokenStore) List() ([]*models.Token, error) {
 			parsed, _ := time.Parse(time.RFC3339, revokedAt.String)
 			t.RevokedAt = &parsed
 		}
+		t.PreviousExpiresAt = activeGrace(previousExpiresAt)
 
 		tokens = append(tokens, &t)
 	}
@@ -157,3 +268,232 @@ func (s *TokenStore) Revoke(id int64) error {
 
 	return nil
 }
+
+// Rotate issues a new secret for a token. The secret it replaces stays
+// valid for grace, which may be zero; a secret still in its grace period
+// from an earlier rotation stops working at once. It returns sql.ErrNoRows
+// if the token does not exist or is revoked.
+func (s *TokenStore) Rotate(id int64, grace time.Duration) (*models.RotateTokenResponse, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	secretHash, err := hashSecret(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash token: %w", err)
+	}
+
+	resp := &models.RotateTokenResponse{
+		ID:                id,
+		Token:             token,
+		PreviousExpiresAt: time.Now().UTC().Add(grace).Truncate(time.Second),
+	}
+	err = s.db.QueryRow(
+		"UPDATE tokens SET previous_hash = secret_hash, previous_prefix = secret_prefix, previous_expires_at = ?, secret_hash = ?, secret_prefix = ? WHERE id = ? AND revoked_at IS NULL RETURNING name",
+		resp.PreviousExpiresAt.Format(time.RFC3339), secretHash, secretPrefix(token), id,
+	).Scan(&resp.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to rotate token: %w", err)
+	}
+	return resp, nil
+}
+
+// UpgradeSecrets converts tokens stored with a bare SHA-256 of their
+// secret to argon2id and gives them an identity not derived from the
+// secret, moving their session history over. Their lookup prefixes come
+// from the old hashes (see legacyPrefix). It returns how many tokens were
+// converted.
+func (s *TokenStore) UpgradeSecrets() (int, error) {
+	rows, err := s.db.Query(
+		"SELECT id, hash, secret_hash, previous_hash FROM tokens WHERE secret_hash NOT LIKE ?",
+		argonPrefix+"%",
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query tokens: %w", err)
+	}
+	type legacy struct {
+		id               int64
+		identity, secret string
+		previous         sql.NullString
+	}
+	var tokens []legacy
+	for rows.Next() {
+		var t legacy
+		if err := rows.Scan(&t.id, &t.identity, &t.secret, &t.previous); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to query tokens: %w", err)
+	}
+
+	driver := s.db.Driver()
+	for _, t := range tokens {
+		identity, err := newIdentity()
+		if err != nil {
+			return 0, err
+		}
+		secret, err := argonHash(t.secret)
+		if err != nil {
+			return 0, err
+		}
+		previous, previousPrefix := t.previous, sql.NullString{}
+		if previous.Valid && !strings.HasPrefix(previous.String, argonPrefix) {
+			previousPrefix = sql.NullString{String: legacyPrefix(previous.String), Valid: true}
+			if previous.String, err = argonHash(previous.String); err != nil {
+				return 0, err
+			}
+		}
+
+		tx, err := s.db.DB.Begin()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(driver.Rebind(
+			"UPDATE tokens SET hash = ?, secret_hash = ?, secret_prefix = ?, previous_hash = ?, previous_prefix = COALESCE(?, previous_prefix) WHERE id = ?"),
+			identity, secret, legacyPrefix(t.secret), previous, previousPrefix, t.id); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to upgrade token %d: %w", t.id, err)
+		}
+		if _, err := tx.Exec(driver.Rebind("UPDATE sessions SET token_hash = ? WHERE token_hash = ?"),
+			identity, t.identity); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("failed to upgrade token %d: %w", t.id, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("failed to upgrade token %d: %w", t.id, err)
+		}
+	}
+	return len(tokens), nil
+}
+
+// activeGrace returns when a replaced secret stops working, or nil if
+// there is none or it already has
+func activeGrace(expiresAt sql.NullString) *time.Time {
+	if !expiresAt.Valid {
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, expiresAt.String)
+	if err != nil || !parsed.After(time.Now()) {
+		return nil
+	}
+	return &parsed
+}
+
+// Defaults returns a token's action defaults. It returns sql.ErrNoRows if
+// the token does not exist.
+func (s *TokenStore) Defaults(id int64) (models.TokenDefaults, error) {
+	var defaults string
+	err := s.db.QueryRow("SELECT defaults FROM tokens WHERE id = ?", id).Scan(&defaults)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.TokenDefaults{}, err
+		}
+		return models.TokenDefaults{}, fmt.Errorf("failed to query token defaults: %w", err)
+	}
+	return parseDefaults(defaults), nil
+}
+
+// SetDefaults replaces a token's action defaults. It returns sql.ErrNoRows
+// if the token does not exist.
+func (s *TokenStore) SetDefaults(id int64, defaults models.TokenDefaults) error {
+	data, err := json.Marshal(defaults)
+	if err != nil {
+		return fmt.Errorf("failed to encode token defaults: %w", err)
+	}
+
+	result, err := s.db.Exec("UPDATE tokens SET defaults = ? WHERE id = ?", string(data), id)
+	if err != nil {
+		return fmt.Errorf("failed to update token defaults: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Features returns a token's feature flag overrides. It returns
+// sql.ErrNoRows if the token does not exist.
+func (s *TokenStore) Features(id int64) (map[string]bool, error) {
+	var features string
+	err := s.db.QueryRow("SELECT features FROM tokens WHERE id = ?", id).Scan(&features)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to query token features: %w", err)
+	}
+	return parseFeatures(features), nil
+}
+
+// SetFeatures replaces a token's feature flag overrides. It returns
+// sql.ErrNoRows if the token does not exist.
+func (s *TokenStore) SetFeatures(id int64, features map[string]bool) error {
+	data, err := json.Marshal(features)
+	if err != nil {
+		return fmt.Errorf("failed to encode token features: %w", err)
+	}
+
+	result, err := s.db.Exec("UPDATE tokens SET features = ? WHERE id = ?", string(data), id)
+	if err != nil {
+		return fmt.Errorf("failed to update token features: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Limits returns a token's rate limit settings, or sql.ErrNoRows
+func (s *TokenStore) Limits(id int64) (models.TokenLimits, error) {
+	var l models.TokenLimits
+	err := s.db.QueryRow("SELECT rate_limit, rate_burst, rate_debt FROM tokens WHERE id = ?", id).
+		Scan(&l.RateLimit, &l.RateBurst, &l.RateDebt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return l, err
+		}
+		return l, fmt.Errorf("failed to query token limits: %w", err)
+	}
+	return l, nil
+}
+
+// SetLimits replaces a token's rate limit settings. It returns
+// sql.ErrNoRows if the token does not exist.
+func (s *TokenStore) SetLimits(id int64, l models.TokenLimits) error {
+	result, err := s.db.Exec("UPDATE tokens SET rate_limit = ?, rate_burst = ?, rate_debt = ? WHERE id = ?",
+		l.RateLimit, l.RateBurst, l.RateDebt, id)
+	if err != nil {
+		return fmt.Errorf("failed to update token limits: %w", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func parseFeatures(s string) map[string]bool {
+	features := map[string]bool{}
+	_ = json.Unmarshal([]byte(s), &features)
+	return features
+}
+
+func parseDefaults(s string) models.TokenDefaults {
+	var d models.TokenDefaults
+	_ = json.Unmarshal([]byte(s), &d)
+	return d
+}
+
+func parseScopes(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/database"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// WebhookStore handles the URLs events are delivered to
+type WebhookStore struct {
+	db *database.DB
+}
+
+// NewWebhookStore creates a new WebhookStore
+func NewWebhookStore(db *database.DB) *WebhookStore {
+	return &WebhookStore{db: db}
+}
+
+// List returns every webhook with its secret, oldest first
+func (s *WebhookStore) List() ([]*models.Webhook, error) {
+	rows, err := s.db.Query("SELECT id, url, events, secret, description, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	hooks := []*models.Webhook{}
+	for rows.Next() {
+		var wh models.Webhook
+		var events, createdAt string
+		if err := rows.Scan(&wh.ID, &wh.URL, &events, &wh.Secret, &wh.Description, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		if err := json.Unmarshal([]byte(events), &wh.Events); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		wh.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		hooks = append(hooks, &wh)
+	}
+	return hooks, rows.Err()
+}
+
+// Create stores a webhook, generating its secret if the request has none
+func (s *WebhookStore) Create(req *models.WebhookRequest) (*models.Webhook, error) {
+	secret := req.Secret
+	if secret == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = "whsec_" + hex.EncodeToString(b)
+	}
+	events, err := json.Marshal(req.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	wh := &models.Webhook{
+		URL:         req.URL,
+		Events:      req.Events,
+		Secret:      secret,
+		Description: req.Description,
+		CreatedAt:   now.Truncate(time.Second),
+	}
+	err = s.db.QueryRow(
+		"INSERT INTO webhooks (url, events, secret, description, created_at) VALUES (?, ?, ?, ?, ?) RETURNING id",
+		req.URL, string(events), secret, req.Description, now.Format(time.RFC3339),
+	).Scan(&wh.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert webhook: %w", err)
+	}
+	return wh, nil
+}
+
+// Delete removes a webhook
+func (s *WebhookStore) Delete(id int64) error {
+	result, err := s.db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	affected, _ := result.RowsAffected()
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
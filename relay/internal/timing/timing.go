@@ -0,0 +1,107 @@
+// Package timing breaks a request's latency down into phases (auth, rate
+// limit, hub dispatch, extension execution, artifact write) when the client
+// asks for it with ?debugTiming=1. Code on the request path records into
+// the Recorder in its context; without one, recording does nothing.
+package timing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+)
+
+// Phase names
+const (
+	Auth               = "auth"
+	RateLimit          = "rate_limit"
+	Queue              = "queue"               // waiting for a screenshot slot
+	HubDispatch        = "hub_dispatch"        // queued and written to the extension's socket
+	Extension          = "extension"           // from the write until the response arrived
+	ExtensionExecution = "extension_execution" // as reported by the extension, part of Extension
+	ClusterForward     = "cluster_forward"     // sent through the relay holding the session
+	Decode             = "decode"
+	ArtifactWrite      = "artifact_write"
+)
+
+// Recorder collects the phases of one request
+type Recorder struct {
+	start time.Time
+
+	mu     sync.Mutex
+	phases []models.TimingPhase
+}
+
+// New creates a Recorder for a request starting now
+func New() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that records phases into r
+func NewContext(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+// FromContext returns the request's Recorder, or nil if timing was not
+// requested
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(contextKey{}).(*Recorder)
+	return r
+}
+
+// Add records d against a phase; repeated phases add up
+func (r *Recorder) Add(name string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ms := float64(d.Microseconds()) / 1000
+	for i := range r.phases {
+		if r.phases[i].Name == name {
+			r.phases[i].Ms += ms
+			return
+		}
+	}
+	r.phases = append(r.phases, models.TimingPhase{Name: name, Ms: ms})
+}
+
+// Since records the time from start until now against a phase
+func (r *Recorder) Since(name string, start time.Time) {
+	r.Add(name, time.Since(start))
+}
+
+// Phases returns the recorded phases in the order they first happened, or
+// nil without a Recorder
+func (r *Recorder) Phases() []models.TimingPhase {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.TimingPhase(nil), r.phases...)
+}
+
+// Timing returns the request's timing block so far, or nil without a
+// Recorder
+func (r *Recorder) Timing() *models.RequestTiming {
+	if r == nil {
+		return nil
+	}
+	return &models.RequestTiming{Total: time.Since(r.start).Milliseconds(), Phases: r.Phases()}
+}
+
+// ServerTiming formats the phases as a Server-Timing header value
+func (r *Recorder) ServerTiming() string {
+	var parts []string
+	for _, p := range r.Phases() {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", p.Name, p.Ms))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,407 @@
+// Package tracing records OpenTelemetry spans for requests and the
+// commands they send, and exports them to an OTLP/HTTP collector as JSON.
+// Trace context travels in W3C traceparent headers between relays and in
+// the command message to the extension, which echoes it back.
+//
+// Without OTEL_EXPORTER_OTLP_ENDPOINT tracing is off: Start returns a nil
+// Span, and every Span method does nothing on nil.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+)
+
+// Kind is a span's OTLP kind
+type Kind int
+
+// Span kinds
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+const (
+	// Spans waiting for export; more are dropped
+	queueSize = 4096
+	// Spans sent per export request
+	batchSize = 512
+	// How long a span may wait for its batch to fill
+	batchDelay = 5 * time.Second
+	// How long one export request may take
+	exportTimeout = 10 * time.Second
+)
+
+// tracer is the active exporter; nil when tracing is off
+var tracer atomic.Pointer[exporter]
+
+type exporter struct {
+	endpoint string
+	headers  map[string]string
+	resource map[string]any
+	scope    map[string]any
+	sampling float64
+	client   *http.Client
+
+	queue   chan *Span
+	flush   chan chan struct{}
+	dropped atomic.Int64
+}
+
+// Setup starts exporting spans when OTEL_EXPORTER_OTLP_ENDPOINT is set
+func Setup(cfg *config.Config, version string) {
+	if cfg.OTLPEndpoint == "" {
+		return
+	}
+	e := &exporter{
+		endpoint: strings.TrimSuffix(cfg.OTLPEndpoint, "/") + "/v1/traces",
+		headers:  cfg.ParsedOTLPHeaders,
+		resource: map[string]any{"attributes": attributes([]attribute{
+			{"service.name", cfg.OTELServiceName},
+			{"service.version", version},
+		})},
+		scope:    map[string]any{"name": "github.com/emreylmaz/owlrelay/relay", "version": version},
+		sampling: cfg.OTELSampleRatio,
+		client:   &http.Client{Timeout: exportTimeout},
+		queue:    make(chan *Span, queueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go e.run()
+	tracer.Store(e)
+	log.Info().Str("endpoint", e.endpoint).Float64("sample_ratio", e.sampling).Msg("Exporting traces")
+}
+
+// Shutdown exports the spans still queued, waiting at most until ctx is done
+func Shutdown(ctx context.Context) {
+	e := tracer.Load()
+	if e == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case e.flush <- done:
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+}
+
+// Span is one timed operation of a trace
+type Span struct {
+	exp      *exporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []attribute
+	errorMsg string
+	hasError bool
+	ended    bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// spanContext identifies a span to its children, which may be in another
+// process
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span as a child of the span in ctx, or of the remote
+// parent from ContextWithTraceParent, and returns a context holding it. It
+// returns a nil Span when tracing is off or the trace is not sampled.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	return StartAt(ctx, name, kind, time.Now())
+}
+
+// StartAt is Start for an operation that began at t
+func StartAt(ctx context.Context, name string, kind Kind, t time.Time) (context.Context, *Span) {
+	e := tracer.Load()
+	if e == nil {
+		return ctx, nil
+	}
+
+	s := &Span{exp: e, name: name, kind: kind, start: t}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		if !remote.sampled {
+			return ctx, nil
+		}
+		s.traceID, s.parentID = remote.traceID, remote.spanID
+	} else {
+		rand.Read(s.traceID[:])
+		if !e.sample(s.traceID) {
+			return ctx, nil
+		}
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext returns the span in ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithTraceParent returns a context whose next span continues the
+// trace in a W3C traceparent header value; an invalid value is ignored
+func ContextWithTraceParent(ctx context.Context, traceparent string) context.Context {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	var sc spanContext
+	var flags [1]byte
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return ctx
+	}
+	if sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+		return ctx
+	}
+	sc.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// TraceParent returns the W3C traceparent header value naming the span as
+// parent, or "" for a nil Span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// TraceID returns the span's trace ID in hex, or "" for a nil Span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetName renames the span, e.g. once the route that matched is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttr records a string, bool, integer or float attribute
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.hasError, s.errorMsg = true, msg
+	s.mu.Unlock()
+}
+
+// End finishes the span now and queues it for export
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt finishes the span at t; later calls do nothing
+func (s *Span) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, t
+	s.mu.Unlock()
+
+	select {
+	case s.exp.queue <- s:
+	default:
+		s.exp.dropped.Add(1)
+	}
+}
+
+// sample keeps a root trace with probability OTEL_TRACES_SAMPLER_ARG,
+// deciding from the trace ID as OpenTelemetry's TraceIdRatioBased does
+func (e *exporter) sample(traceID [16]byte) bool {
+	if e.sampling >= 1 {
+		return true
+	}
+	var x uint64
+	for _, b := range traceID[8:] {
+		x = x<<8 | uint64(b)
+	}
+	return float64(x>>1) < e.sampling*float64(math.MaxUint64>>1)
+}
+
+// run batches finished spans and posts them to the collector
+func (e *exporter) run() {
+	ticker := time.NewTicker(batchDelay)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	send := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+		if dropped := e.dropped.Swap(0); dropped > 0 {
+			log.Warn().Int64("spans", dropped).Msg("Trace export queue full, dropped spans")
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+				if len(batch) >= batchSize {
+					send()
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// export posts spans as an OTLP ExportTraceServiceRequest
+func (e *exporter) export(batch []*Span) {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   e.resource,
+			"scopeSpans": []any{map[string]any{"scope": e.scope, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode spans")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to export spans")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Warn().Err(err).Int("spans", len(batch)).Msg("Failed to export spans")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warn().Int("status", resp.StatusCode).Int("spans", len(batch)).Msg("Collector rejected spans")
+	}
+}
+
+func (s *Span) otlp() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := map[string]any{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              int(s.kind),
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        attributes(s.attrs),
+	}
+	if s.parentID != ([8]byte{}) {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.hasError {
+		span["status"] = map[string]any{"code": 2, "message": s.errorMsg}
+	}
+	return span
+}
+
+// attributes encodes attributes as OTLP KeyValues
+func attributes(attrs []attribute) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": a.key, "value": value})
+	}
+	return out
+}
@@ -0,0 +1,297 @@
+// Package webhooks delivers relay events to the URLs operators register.
+// Each delivery is a signed JSON POST, retried with exponential backoff
+// until the receiver answers 2xx or WEBHOOK_MAX_ATTEMPTS is reached.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"github.com/emreylmaz/owlrelay/relay/internal/config"
+	"github.com/emreylmaz/owlrelay/relay/internal/models"
+	"github.com/emreylmaz/owlrelay/relay/internal/store"
+)
+
+const (
+	// Deliveries sent at once
+	workers = 4
+
+	// How often webhooks are reloaded, to pick up changes made through
+	// other relays sharing the database
+	reloadInterval = 30 * time.Second
+
+	// Wait before the first retry, doubled for each one after it
+	baseBackoff = 5 * time.Second
+	maxBackoff  = 5 * time.Minute
+
+	// A token's rate_limited event is sent at most this often, however many
+	// of its requests are rejected
+	rateLimitedInterval = time.Minute
+)
+
+// Notifier queues events for the webhooks subscribed to them and delivers
+// them in the background. Retries still waiting are lost on shutdown.
+type Notifier struct {
+	cfg    *config.Config
+	store  *store.WebhookStore
+	client *http.Client
+	queue  chan *delivery
+
+	mu    sync.RWMutex
+	hooks []*models.Webhook
+
+	limitedMu sync.Mutex
+	limited   map[int64]time.Time // token ID → last rate_limited event
+
+	delivered, failed, retried, dropped atomic.Int64
+}
+
+// Stats counts deliveries by outcome
+type Stats struct {
+	Delivered int64 // answered with 2xx
+	Failed    int64 // given up on
+	Retried   int64 // attempts that will be tried again
+	Dropped   int64 // not queued because the queue was full
+}
+
+// delivery is one event on its way to one webhook
+type delivery struct {
+	hookID  int64
+	url     string
+	secret  string
+	id      string
+	event   string
+	body    []byte
+	attempt int
+}
+
+// New creates a Notifier and starts its workers
+func New(cfg *config.Config, s *store.WebhookStore) *Notifier {
+	n := &Notifier{
+		cfg:     cfg,
+		store:   s,
+		client:  &http.Client{},
+		queue:   make(chan *delivery, cfg.WebhookQueueSize),
+		limited: make(map[int64]time.Time),
+	}
+	if err := n.Reload(); err != nil {
+		log.Error().Err(err).Msg("Failed to load webhooks")
+	}
+	for range workers {
+		go n.work()
+	}
+	go n.reloadLoop()
+	return n
+}
+
+// Reload reads the webhooks from the database; call it after changing them
+func (n *Notifier) Reload() error {
+	hooks, err := n.store.List()
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.hooks = hooks
+	n.mu.Unlock()
+	return nil
+}
+
+// Stats returns the delivery counts
+func (n *Notifier) Stats() Stats {
+	return Stats{
+		Delivered: n.delivered.Load(),
+		Failed:    n.failed.Load(),
+		Retried:   n.retried.Load(),
+		Dropped:   n.dropped.Load(),
+	}
+}
+
+// Notify queues an event for every webhook subscribed to it
+func (n *Notifier) Notify(event string, data any) {
+	n.mu.RLock()
+	var targets []*models.Webhook
+	for _, wh := range n.hooks {
+		if wh.Subscribes(event) {
+			targets = append(targets, wh)
+		}
+	}
+	n.mu.RUnlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := models.WebhookPayload{
+		ID:        uuid.New().String(),
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("Failed to encode webhook payload")
+		return
+	}
+	for _, wh := range targets {
+		n.enqueue(&delivery{
+			hookID: wh.ID,
+			url:    wh.URL,
+			secret: wh.Secret,
+			id:     payload.ID,
+			event:  event,
+			body:   body,
+		})
+	}
+}
+
+// RateLimited sends rate_limited for a token whose request was rejected,
+// unless one was sent for it within the last minute
+func (n *Notifier) RateLimited(token *models.Token, limit, retryAfter int) {
+	now := time.Now()
+	n.limitedMu.Lock()
+	if last, ok := n.limited[token.ID]; ok && now.Sub(last) < rateLimitedInterval {
+		n.limitedMu.Unlock()
+		return
+	}
+	n.limited[token.ID] = now
+	n.limitedMu.Unlock()
+
+	n.Notify(models.WebhookRateLimited, models.WebhookRateLimit{
+		TokenID:    token.ID,
+		TokenName:  token.Name,
+		Limit:      limit,
+		RetryAfter: retryAfter,
+	})
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under a
+// webhook's secret, as sent in X-Owlrelay-Signature
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifier) enqueue(d *delivery) {
+	select {
+	case n.queue <- d:
+	default:
+		n.dropped.Add(1)
+		log.Warn().
+			Int64("webhook_id", d.hookID).
+			Str("event", d.event).
+			Str("delivery", d.id).
+			Msg("Webhook queue full, dropping delivery")
+	}
+}
+
+func (n *Notifier) work() {
+	for d := range n.queue {
+		n.deliver(d)
+	}
+}
+
+// deliver makes one attempt and schedules the next if it failed
+func (n *Notifier) deliver(d *delivery) {
+	d.attempt++
+	err := n.post(d)
+	if err == nil {
+		n.delivered.Add(1)
+		return
+	}
+
+	var rejected *rejectedError
+	if errors.As(err, &rejected) || d.attempt >= n.cfg.WebhookMaxAttempts {
+		n.failed.Add(1)
+		log.Warn().Err(err).
+			Int64("webhook_id", d.hookID).
+			Str("event", d.event).
+			Str("delivery", d.id).
+			Int("attempts", d.attempt).
+			Msg("Webhook delivery failed")
+		return
+	}
+
+	n.retried.Add(1)
+	backoff := baseBackoff
+	for i := 1; i < d.attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	log.Debug().Err(err).
+		Int64("webhook_id", d.hookID).
+		Str("delivery", d.id).
+		Dur("retry_in", backoff).
+		Msg("Webhook delivery attempt failed")
+	time.AfterFunc(backoff, func() { n.enqueue(d) })
+}
+
+// rejectedError is a failure retrying would not change
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (n *Notifier) post(d *delivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.cfg.WebhookTimeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return &rejectedError{err: err}
+	}
+	// Signed per attempt, so receivers can reject stale timestamps
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "owlrelay-webhooks")
+	req.Header.Set("X-Owlrelay-Event", d.event)
+	req.Header.Set("X-Owlrelay-Delivery", d.id)
+	req.Header.Set("X-Owlrelay-Attempt", strconv.Itoa(d.attempt))
+	req.Header.Set("X-Owlrelay-Timestamp", timestamp)
+	req.Header.Set("X-Owlrelay-Signature", "sha256="+Sign(d.secret, timestamp, d.body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("receiver answered %d", resp.StatusCode)
+	default:
+		return &rejectedError{err: fmt.Errorf("receiver rejected the delivery with %d", resp.StatusCode)}
+	}
+}
+
+func (n *Notifier) reloadLoop() {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := n.Reload(); err != nil {
+			log.Warn().Err(err).Msg("Failed to reload webhooks")
+		}
+	}
+}
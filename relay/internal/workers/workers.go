@@ -0,0 +1,108 @@
+// Package workers bounds how much work each token runs at once. Every
+// token gets its own fixed number of slots, so one token with a flood of
+// heavy requests waits on itself instead of delaying the others.
+package workers
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Pools hands out per-token worker slots. A token's pool exists only while
+// some of its work is running or waiting.
+type Pools struct {
+	size int // slots per token; 0 for no limit
+
+	mu    sync.Mutex
+	pools map[string]*pool
+
+	waiting atomic.Int64
+	waited  atomic.Int64
+}
+
+type pool struct {
+	slots chan struct{}
+	users int // holders and waiters; the pool is dropped at zero
+}
+
+// Stats is a snapshot of a Pools
+type Stats struct {
+	Tokens  int   // tokens with work running or waiting
+	Busy    int   // slots held across all tokens
+	Waiting int64 // callers waiting for a slot of their token
+	Waited  int64 // callers that had to wait, since start
+}
+
+// New creates Pools giving each token size slots; 0 means no limit
+func New(size int) *Pools {
+	return &Pools{size: size, pools: make(map[string]*pool)}
+}
+
+// Acquire waits for a slot of the token's pool; the returned func frees it.
+// It fails only when ctx is done first.
+func (p *Pools) Acquire(ctx context.Context, tokenHash string) (func(), error) {
+	if p.size <= 0 {
+		return func() {}, nil
+	}
+
+	p.mu.Lock()
+	tp := p.pools[tokenHash]
+	if tp == nil {
+		tp = &pool{slots: make(chan struct{}, p.size)}
+		p.pools[tokenHash] = tp
+	}
+	tp.users++
+	p.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-tp.slots
+			p.leave(tokenHash, tp)
+		})
+	}
+
+	select {
+	case tp.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	p.waiting.Add(1)
+	p.waited.Add(1)
+	defer p.waiting.Add(-1)
+
+	select {
+	case tp.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		p.leave(tokenHash, tp)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops the token's pool once nothing holds or waits for it
+func (p *Pools) leave(tokenHash string, tp *pool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tp.users--
+	if tp.users == 0 && p.pools[tokenHash] == tp {
+		delete(p.pools, tokenHash)
+	}
+}
+
+// Stats returns current usage
+func (p *Pools) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := Stats{
+		Tokens:  len(p.pools),
+		Waiting: p.waiting.Load(),
+		Waited:  p.waited.Load(),
+	}
+	for _, tp := range p.pools {
+		s.Busy += len(tp.slots)
+	}
+	return s
+}